@@ -0,0 +1,111 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// The Go runtime keeps track of all the goroutines ever created in the allgs
+// global variable, which is a []*g. The variable lives in the bss section of
+// the module, but WebAssembly binaries produced by Go do not carry a symbol
+// table for data, so its address is discovered by scanning the section for a
+// slice header that looks like allgs and contains the current goroutine.
+//
+// https://github.com/golang/go/blob/go1.21.0/src/runtime/proc.go#L528
+
+// Offset of the g.atomicstatus field, after sched (7 words) and syscallsp,
+// syscallpc, stktopsp, and param.
+const gAtomicStatusOffset = 8 * 18
+
+// Goroutine status values, see runtime/runtime2.go.
+const (
+	gStatusIdle    = 0
+	gStatusRunning = 2
+	gStatusDead    = 6
+	gStatusScan    = 0x1000
+)
+
+// Upper bound on the number of goroutines accepted when looking for allgs, it
+// prevents random bytes from being interpreted as a huge slice.
+const maxAllgs = 1 << 20
+
+func gStatus(m vmem, g gptr) uint32 {
+	return deref[uint32](m, ptr64(g)+gAtomicStatusOffset) &^ gStatusScan
+}
+
+// findAllgs returns the address of the runtime.allgs variable, or zero if it
+// could not be found. gp must be a user goroutine, which the runtime records in
+// allgs when it is created.
+func findAllgs(mem vmem, md *moduledata, gp gptr) ptr64 {
+	if gp == 0 || md.ebss <= md.bss {
+		return 0
+	}
+	bss, ok := mem.Read(md.bss.addr(), uint32(md.ebss-md.bss))
+	if !ok {
+		return 0
+	}
+	for i := 0; i+24 <= len(bss); i += 8 {
+		data := binary.LittleEndian.Uint64(bss[i:])
+		size := binary.LittleEndian.Uint64(bss[i+8:])
+		capa := binary.LittleEndian.Uint64(bss[i+16:])
+		if data == 0 || size == 0 || size > capa || capa > maxAllgs {
+			continue
+		}
+		if allgsContains(mem, ptr64(data), size, gp) {
+			return md.bss + ptr64(i)
+		}
+	}
+	return 0
+}
+
+func allgsContains(mem vmem, data ptr64, size uint64, gp gptr) bool {
+	b, ok := mem.Read(data.addr(), uint32(size*8))
+	if !ok {
+		return false
+	}
+	found := false
+	for i := 0; i < len(b); i += 8 {
+		g := gptr(binary.LittleEndian.Uint64(b[i:]))
+		if g == 0 {
+			return false
+		}
+		found = found || g == gp
+	}
+	return found
+}
+
+// readAllgs returns the goroutines currently recorded in the allgs variable at
+// the given address.
+func readAllgs(mem vmem, allgs ptr64) []gptr {
+	data := deref[ptr64](mem, allgs)
+	size := deref[uint64](mem, allgs+8)
+	if size > maxAllgs {
+		return nil
+	}
+	return derefArray[gptr](mem, data, uint32(size))
+}
+
+// goroutineStack unwinds the stack of a goroutine which is not running, from
+// the registers saved when it was descheduled. The second return value is false
+// if the stack could not be unwound, which may happen when the memory is
+// concurrently modified by the guest.
+func (p *Profiling) goroutineStack(st stackTrace, symbols *pclntab, mem vmem, g gptr) (_ stackTrace, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	si := &goStackIterator{
+		first:    true,
+		pclntab:  symbols,
+		unwinder: unwinder{mem: mem, symbols: symbols},
+	}
+	// Like the Go runtime, the stack of goroutines blocked in a system call
+	// is unwound from the registers saved when entering the call.
+	if sp := gSyscallSp(mem, g); sp != 0 {
+		si.initAt(gSyscallPc(mem, g), sp, 0, g, unwindSilentErrors)
+	} else {
+		si.initAt(gSchedPc(mem, g), gSchedSp(mem, g), gSchedLr(mem, g), g, unwindSilentErrors)
+	}
+	return p.makeStackTrace(context.Background(), st, si), true
+}
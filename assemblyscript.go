@@ -0,0 +1,108 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Try to detect if the module was compiled by AssemblyScript by looking for
+// the functions of its runtime in the name section, which are named after the
+// path of their file in the standard library, e.g. "~lib/rt/itcms/__new". The
+// name section is only emitted when compiling with --debug.
+func binCompiledByAssemblyScript(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("~lib/rt/"))
+}
+
+// assemblyscriptName splits the name of an AssemblyScript function in the file
+// it is declared in and its name in the file, e.g. "assembly/index/fib" is
+// "fib" in assembly/index.ts and "~lib/array/Array<i32>#push" is the push
+// method of Array<i32> in the array file of the standard library. The file is
+// empty if the name does not follow the naming of AssemblyScript.
+//
+// Type arguments may contain paths, e.g. "~lib/map/Map<~lib/string/String,i32>",
+// only the slashes outside of them separate the file from the function.
+func assemblyscriptName(name string) (file, function string) {
+	// Top-level statements of files are run by their start function.
+	if path, ok := strings.CutPrefix(name, "start:"); ok {
+		return path + ".ts", name
+	}
+	depth, split := 0, -1
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '<':
+			depth++
+		case '>':
+			// Function types like (i32)=>void have an arrow.
+			if i == 0 || name[i-1] != '=' {
+				depth--
+			}
+		case '/':
+			if depth == 0 {
+				split = i
+			}
+		}
+	}
+	if split <= 0 || split+1 == len(name) {
+		return "", name
+	}
+	return name[:split] + ".ts", name[split+1:]
+}
+
+// assemblyscriptSymbolizer symbolizes functions of AssemblyScript modules from
+// their names, the compiler emits source maps instead of DWARF information.
+type assemblyscriptSymbolizer struct{}
+
+func (assemblyscriptSymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	offset := fn.SourceOffsetForPC(pc)
+	name := fn.Definition().Name()
+	file, function := assemblyscriptName(name)
+	if file == "" {
+		return offset, nil
+	}
+	return offset, []location{{File: file, StableName: name, HumanName: function}}
+}
+
+// Size of the header of AssemblyScript objects which precedes their data in
+// the blocks allocated for them, minus the one of the blocks.
+//
+// https://github.com/AssemblyScript/assemblyscript/blob/v0.27.0/std/assembly/rt/common.ts
+const asObjectOverhead = 16
+
+// asObjectProfiler adapts the addresses of AssemblyScript objects to the
+// addresses of the blocks allocated for them, which are the ones passed to
+// __free when the garbage collector releases the objects.
+type asObjectProfiler struct {
+	l      allocatorListener
+	renew  bool // __renew(ptr, size) instead of __new(size, id)
+	params [2]uint64
+	result [1]uint64
+}
+
+func (p *asObjectProfiler) clone() allocatorListener {
+	return &asObjectProfiler{l: p.l.clone(), renew: p.renew}
+}
+
+func (p *asObjectProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	if p.renew && len(params) == 2 {
+		p.params = [2]uint64{params[0] - asObjectOverhead, params[1]}
+		params = p.params[:]
+	}
+	p.l.Before(ctx, mod, def, params, si)
+}
+
+func (p *asObjectProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if len(results) == 1 && results[0] != 0 {
+		p.result = [1]uint64{results[0] - asObjectOverhead}
+		results = p.result[:]
+	}
+	p.l.After(ctx, mod, def, results)
+}
+
+func (p *asObjectProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	p.l.Abort(ctx, mod, def, err)
+}
@@ -0,0 +1,91 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestAssemblyScriptName(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		function string
+	}{
+		{"assembly/index/fib", "assembly/index.ts", "fib"},
+		{"~lib/array/Array<i32>#push", "~lib/array.ts", "Array<i32>#push"},
+		{"~lib/map/Map<~lib/string/String,i32>#set", "~lib/map.ts", "Map<~lib/string/String,i32>#set"},
+		{"~lib/array/Array<%28i32%29=>void>#forEach", "~lib/array.ts", "Array<%28i32%29=>void>#forEach"},
+		{"start:assembly/index", "assembly/index.ts", "start:assembly/index"},
+		{"malloc", "", "malloc"},
+	}
+
+	for _, test := range tests {
+		file, function := assemblyscriptName(test.name)
+		if file != test.file || function != test.function {
+			t.Errorf("%s: name mismatch: want=%q/%q got=%q/%q", test.name, test.file, test.function, file, function)
+		}
+	}
+}
+
+func TestBinCompiledByAssemblyScript(t *testing.T) {
+	if !binCompiledByAssemblyScript(testWasmModule("\x13~lib/rt/itcms/__new", "")) {
+		t.Error("assemblyscript module not detected")
+	}
+	if binCompiledByAssemblyScript(testWasmModule("\x04main", "")) {
+		t.Error("module wrongly detected as assemblyscript")
+	}
+}
+
+func TestMemoryProfilerAssemblyScript(t *testing.T) {
+	profiling := ProfilingFor(nil)
+	profiling.lang = assemblyscript
+	p := profiling.MemoryProfiler(InuseMemory(true))
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	newObject := function("~lib/rt/itcms/__new")
+	renew := function("~lib/rt/itcms/__renew")
+	alloc := function("~lib/rt/tlsf/__alloc")
+	free := function("~lib/rt/tlsf/__free")
+
+	module := wazerotest.NewModule(nil, newObject, renew, alloc, free)
+	ctx := context.Background()
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// Objects are allocated in blocks of the runtime allocator.
+	done := call(newObject, []uint64{10, 3}, []uint64{0x110})
+	call(alloc, []uint64{26}, []uint64{0x100})()
+	done()
+	call(newObject, []uint64{20, 3}, []uint64{0x210})()
+	// The object is moved to a larger block.
+	call(renew, []uint64{0x210, 40}, []uint64{0x310})()
+	// The garbage collector releases the first object.
+	call(free, []uint64{0x100}, nil)()
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if allocObjects != 3 || allocSpace != 70 {
+		t.Errorf("wrong allocations: want=3/70 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 1 || inuseSpace != 40 {
+		t.Errorf("wrong memory in use: want=1/40 got=%d/%d", inuseObjects, inuseSpace)
+	}
+}
@@ -0,0 +1,228 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// BlockProfiler is the implementation of an off-CPU profiler recording the
+// time that the guest spends blocked in calls to host functions, waiting for
+// I/O readiness, timers, or yielding the CPU.
+//
+// WASI does not have a dedicated sleep function, programs sleep by calling
+// poll_oneoff with a clock subscription, so time spent sleeping is accounted
+// for as well.
+//
+// The profiler generates samples of two types:
+// - "contentions" counts the number of calls to blocking functions.
+// - "delay" records the time spent blocked in those calls (in nanoseconds).
+//
+// Comparing the block profile with the CPU profile helps distinguish code that
+// is CPU-bound from code that is waiting on external events.
+type BlockProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts stackCounterMap
+	calls  instanceState[blockCallStack]
+	funcs  map[string]struct{}
+	time   func() int64
+	start  time.Time
+}
+
+// BlockProfilerOption is a type used to represent configuration options for
+// BlockProfiler instances created by Profiling.BlockProfiler.
+type BlockProfilerOption func(*BlockProfiler)
+
+// BlockingFunctions configures additional host functions that the block
+// profiler considers blocking. Functions are identified by their module and
+// function names separated by a dot (e.g. "env.sleep").
+//
+// The profiler always accounts for calls to wasi_snapshot_preview1.poll_oneoff
+// and wasi_snapshot_preview1.sched_yield.
+func BlockingFunctions(names ...string) BlockProfilerOption {
+	return func(p *BlockProfiler) {
+		for _, name := range names {
+			p.funcs[name] = struct{}{}
+		}
+	}
+}
+
+// BlockTimeFunc configures the time function used by the block profiler to
+// collect monotonic timestamps.
+//
+// By default, the system's monotonic time is used.
+func BlockTimeFunc(time func() int64) BlockProfilerOption {
+	return func(p *BlockProfiler) { p.time = time }
+}
+
+var defaultBlockingFunctions = [...]string{
+	"wasi_snapshot_preview1.poll_oneoff",
+	"wasi_snapshot_preview1.sched_yield",
+}
+
+type blockFrame struct {
+	start int64
+	trace stackTrace
+}
+
+// blockCallStack is the stack of calls in progress of an instance of the guest.
+type blockCallStack struct {
+	frames []blockFrame
+	traces []stackTrace
+}
+
+func newBlockProfiler(p *Profiling, options ...BlockProfilerOption) *BlockProfiler {
+	b := &BlockProfiler{
+		p:     p,
+		funcs: make(map[string]struct{}, len(defaultBlockingFunctions)),
+		time:  nanotime,
+	}
+	for _, name := range defaultBlockingFunctions {
+		b.funcs[name] = struct{}{}
+	}
+	for _, opt := range options {
+		opt(b)
+	}
+	return b
+}
+
+// StartProfile begins recording the block profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *BlockProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(stackCounterMap)
+	p.start = time.Now()
+	return true
+}
+
+// StopProfile stops recording and returns the block profile. The method
+// returns nil if recording of the block profile wasn't started.
+func (p *BlockProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts = nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+
+	// Unlike CPU time, the delays of calls which were not sampled are never
+	// measured, so both values are scaled by the sampling rate.
+	ratio := 1 / sampleRate
+	prof := buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), []float64{ratio, ratio})
+	prof.PeriodType = &profile.ValueType{Type: "contentions", Unit: "count"}
+	prof.Period = 1
+	return prof
+}
+
+// Name returns "block" to match the name of the block profiler in pprof.
+func (p *BlockProfiler) Name() string {
+	return "block"
+}
+
+// Desc returns a description of the block profiler.
+func (p *BlockProfiler) Desc() string {
+	return "Stack traces that led to blocking in host functions waiting on I/O, timers, or yielding the CPU. You can specify the duration in the seconds GET parameter."
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *BlockProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// block profiler.
+func (p *BlockProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "contentions", Unit: "count"},
+		{Type: "delay", Unit: "nanoseconds"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *BlockProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("block", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
+	})
+}
+
+// NewFunctionListener returns a function listener recording the time spent in
+// calls to the function passed as argument, or nil if the function is not a
+// blocking host function.
+func (p *BlockProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil {
+		return nil
+	}
+	if _, ok := p.funcs[def.ModuleName()+"."+def.Name()]; !ok {
+		return nil
+	}
+	return profilingListener{p.p, blockProfiler{p}}
+}
+
+type blockProfiler struct{ *BlockProfiler }
+
+func (p blockProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	var frame blockFrame
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+
+	if p.counts != nil {
+		trace := stackTrace{}
+
+		if i := len(s.traces); i > 0 {
+			i--
+			trace = s.traces[i]
+			s.traces = s.traces[:i]
+		}
+
+		frame = blockFrame{
+			start: p.time(),
+			trace: p.p.makeStackTrace(ctx, trace, si),
+		}
+	}
+
+	s.frames = append(s.frames, frame)
+	p.mutex.Unlock()
+}
+
+func (p blockProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.frames) - 1
+	f := s.frames[i]
+	s.frames = s.frames[:i]
+
+	if f.start != 0 {
+		if p.counts != nil {
+			p.counts.observe(f.trace, p.time()-f.start)
+		}
+		s.traces = append(s.traces, f.trace)
+	}
+	p.mutex.Unlock()
+}
+
+func (p blockProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
@@ -0,0 +1,60 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestBlockProfilerDelay(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).BlockProfiler(
+		BlockTimeFunc(func() int64 { return currentTime }),
+		BlockingFunctions("wasi_snapshot_preview1.sleep"),
+	)
+
+	module := newTestModule(nil, "main", "poll_oneoff", "sleep")
+	module.ModuleName = "wasi_snapshot_preview1"
+
+	if f := p.NewFunctionListener(module.Function(0).Definition()); f != nil {
+		t.Error("non-blocking function must not be instrumented")
+	}
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+	f2 := p.NewFunctionListener(module.Function(2).Definition())
+
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+		{Function: module.Function(1), PC: 1},
+	}
+
+	stack2 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+		{Function: module.Function(2), PC: 2},
+	}
+
+	def1 := stack1[1].Function.Definition()
+	def2 := stack2[1].Function.Definition()
+
+	ctx := context.Background()
+	p.StartProfile()
+
+	currentTime = 10
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime = 15
+	f1.After(ctx, module, def1, nil)
+
+	currentTime = 20
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime = 30
+	f1.After(ctx, module, def1, nil)
+
+	currentTime = 40
+	f2.Before(ctx, module, def2, nil, experimental.NewStackIterator(stack2...))
+	currentTime = 100
+	f2.After(ctx, module, def2, nil)
+
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack1), 2, 15)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack2), 1, 60)
+}
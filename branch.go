@@ -0,0 +1,113 @@
+package wzprof
+
+import (
+	"net/http"
+
+	"github.com/google/pprof/profile"
+)
+
+// BranchProfiler is the implementation of a profiler recording the number of
+// times the basic blocks of the hot functions of the guest are executed, and
+// how often their conditional branches are taken, which can be overlaid on the
+// disassembly of the functions (see ReportDisassembly).
+//
+// The module must be instrumented with Profiling.CountOpcodes, which counts the
+// executions of the segments of instructions running together: a segment
+// starts at the targets of branches, after calls and at the entry of the
+// functions, and ends after the instructions which branch. The profile has a
+// sample for each block executed, located at its first instruction, and a
+// sample for each conditional branch (br_if and if), located at the branch
+// instruction with a "branch" label naming it. The block which follows a
+// conditional branch is only entered when the branch is not taken, the
+// number of times it is taken is the difference of the executions of the two
+// blocks. The targets of br_table instructions are the blocks they branch to,
+// their executions show how often each target is taken.
+//
+// The profiler generates samples of three types:
+// - "executions" counts the number of times the block was executed.
+// - "instructions" records the number of instructions executed by the block.
+// - "taken" counts the number of times the conditional branch was taken.
+type BranchProfiler struct {
+	segmentCounter
+}
+
+func newBranchProfiler(p *Profiling) *BranchProfiler {
+	return &BranchProfiler{newSegmentCounter(p)}
+}
+
+// StartProfile begins recording the branch profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *BranchProfiler) StartProfile() bool {
+	return p.startProfile()
+}
+
+// StopProfile stops recording and returns the branch profile. The method
+// returns nil if recording of the profile wasn't started.
+//
+// All the executions are counted, the values are not scaled by a sample rate.
+func (p *BranchProfiler) StopProfile() *profile.Profile {
+	counts, start, defs := p.stopProfile()
+	if counts == nil {
+		return nil
+	}
+
+	segments := p.p.countedSegments
+	b := newSegmentProfile(p.p, p.SampleType(), start)
+	for i, seg := range segments {
+		def := defs[seg.function]
+		if counts[i] == 0 || def == nil || len(seg.instructions) == 0 {
+			continue
+		}
+		n := int64(len(seg.instructions))
+		b.prof.Sample = append(b.prof.Sample, &profile.Sample{
+			Location: []*profile.Location{b.location(def, seg.instructions[0].offset)},
+			Value:    []int64{counts[i], counts[i] * n, 0},
+		})
+
+		last := seg.instructions[n-1]
+		switch last.opcode {
+		case "br_if", "if":
+		default:
+			continue
+		}
+		taken := counts[i]
+		if i+1 < len(segments) && segments[i+1].function == seg.function {
+			taken -= counts[i+1]
+		}
+		b.prof.Sample = append(b.prof.Sample, &profile.Sample{
+			Location: []*profile.Location{b.location(def, last.offset)},
+			Value:    []int64{0, 0, taken},
+			Label:    map[string][]string{"branch": {last.opcode}},
+		})
+	}
+	return b.profile()
+}
+
+// Name returns "branches".
+func (p *BranchProfiler) Name() string {
+	return "branches"
+}
+
+// Desc returns a description of the branch profiler.
+func (p *BranchProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// branch profiler.
+func (p *BranchProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "executions", Unit: "count"},
+		{Type: "instructions", Unit: "count"},
+		{Type: "taken", Unit: "count"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is ignored since the profiler counts all the executions.
+func (p *BranchProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("branch", p.StartProfile, p.StopProfile)
+}
@@ -0,0 +1,86 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestBranchProfiler(t *testing.T) {
+	wasm := testLoopModule()
+	p := ProfilingFor(wasm)
+	branches := p.BranchProfiler()
+
+	instrumented, err := p.CountOpcodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, branches)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := runtime.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	branches.StartProfile()
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prof := branches.StopProfile()
+
+	// The body of the loop is the block at offset 0xe of the code section,
+	// which ends with the br_if at offset 0x18.
+	values := make(map[uint64][3]int64)
+	for _, sample := range prof.Sample {
+		addr := sample.Location[0].Address
+		v := values[addr]
+		for i := range v {
+			v[i] += sample.Value[i]
+		}
+		values[addr] = v
+		if sample.Value[2] != 0 && sample.Label["branch"][0] != "br_if" {
+			t.Errorf("wrong branch label at %#x: %v", addr, sample.Label)
+		}
+	}
+	if v := values[0x0e]; v != [3]int64{20, 140, 0} {
+		t.Errorf("wrong values of the body of the loop: %v", v)
+	}
+	if v := values[0x18]; v != [3]int64{0, 0, 18} {
+		t.Errorf("wrong values of the br_if: %v", v)
+	}
+	if v := values[0x0c]; v != [3]int64{2, 2, 0} {
+		t.Errorf("wrong values of the loop: %v", v)
+	}
+
+	// The report lists the instructions of the functions with their values.
+	prof.DefaultSampleType = "executions"
+	b := new(bytes.Buffer)
+	if err := WriteHTMLReport(b, prof, 0, nil, ReportDisassembly(wasm)); err != nil {
+		t.Fatal(err)
+	}
+	report := b.String()
+	for _, want := range []string{
+		`<td class="value">2</td><td class="value">2</td><td class="number">0xc</td><td>loop</td>`,
+		`<td class="value">20</td><td class="value">20</td><td class="number">0xe</td><td>  local.get 0</td>`,
+		`<td class="value"></td><td class="value"></td><td class="number">0x10</td><td>  i32.const 1</td>`,
+		`<td class="value">1</td><td class="value">1</td><td class="number">0x3</td><td>call 1</td>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+}
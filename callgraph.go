@@ -0,0 +1,422 @@
+package wzprof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CallGraph is the static call graph of a wasm module, extracted from the code
+// of its functions without executing it. It complements the profiles with the
+// calls which may happen, for dead-code and hot-path analysis: functions which
+// are not reachable from the entry points of the module can be removed, and
+// the callers of a function show the paths it can be reached from.
+//
+// Direct calls have a single callee. The callees of indirect calls are
+// resolved by type: they are all the functions of the same signature whose
+// reference is taken by the module, either in the element segments which
+// initialize its tables or by ref.func instructions.
+type CallGraph struct {
+	Functions []CallGraphFunction `json:"functions"`
+	Calls     []CallGraphCall     `json:"calls"`
+}
+
+// CallGraphFunction is a function of the static call graph of a module.
+type CallGraphFunction struct {
+	// Index of the function in the function index space of the module, the
+	// imported functions come first.
+	Index uint32 `json:"index"`
+	// Name of the function, from the name section (demangled for C++ and
+	// Rust), its export, or its import.
+	Name string `json:"name"`
+	// Module and name of the import for imported functions, e.g.
+	// "wasi_snapshot_preview1.fd_write".
+	Import string `json:"import,omitempty"`
+	// Names the function is exported with.
+	Exports []string `json:"exports,omitempty"`
+	// Size of the body of the function in the code section, zero for
+	// imported functions.
+	Size uint64 `json:"size"`
+	// Reachable is true if the function may be called from the entry points
+	// of the module: the exported functions, the start function and the
+	// functions of exported or imported tables.
+	Reachable bool `json:"reachable"`
+}
+
+// CallGraphCall is an edge of the static call graph, from a caller to a
+// callee it may call.
+type CallGraphCall struct {
+	Caller   uint32 `json:"caller"`
+	Callee   uint32 `json:"callee"`
+	Indirect bool   `json:"indirect,omitempty"`
+	// Number of call instructions of the caller which may call the callee.
+	Sites int `json:"sites"`
+}
+
+// StaticCallGraph decodes the code section of a wasm module and returns its
+// call graph.
+func StaticCallGraph(wasm []byte) (*CallGraph, error) {
+	if len(wasm) < 8 || string(wasm[:4]) != "\x00asm" {
+		return nil, errors.New("invalid wasm module: missing magic number")
+	}
+
+	var (
+		types       []string // signatures, compared by their encoding
+		funcTypes   []uint32 // type of each function of the index space
+		imports     []string
+		exports     = make(map[uint32][]string)
+		roots       []uint32
+		exportTable bool
+		importTable bool
+		tableFuncs  []uint32
+		code        []byte
+	)
+	for b := wasm[8:]; len(b) > 0; {
+		id := b[0]
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < size {
+			return nil, errors.New("invalid wasm module: truncated section")
+		}
+		r := wasmReader{b: b[1+n : 1+n+int(size)]}
+		b = b[1+n+int(size):]
+
+		switch id {
+		case typeSectionId:
+			for count := r.uleb(); count > 0 && r.err == nil; count-- {
+				start := r.i
+				if form := r.byte(); form != 0x60 && r.err == nil {
+					return nil, fmt.Errorf("invalid wasm module: unsupported type form %#x", form)
+				}
+				r.skip(int(r.uleb())) // params
+				r.skip(int(r.uleb())) // results
+				types = append(types, string(r.b[start:r.i]))
+			}
+		case importSectionId:
+			for count := r.uleb(); count > 0 && r.err == nil; count-- {
+				module := string(r.read(int(r.uleb())))
+				name := string(r.read(int(r.uleb())))
+				switch kind := r.byte(); kind {
+				case 0x00: // function
+					funcTypes = append(funcTypes, uint32(r.uleb()))
+					imports = append(imports, module+"."+name)
+				case 0x01: // table
+					r.byte()
+					r.limits()
+					importTable = true
+				case 0x02: // memory
+					r.limits()
+				case 0x03: // global
+					r.byte()
+					r.byte()
+				case 0x04: // tag
+					r.byte()
+					r.uleb()
+				default:
+					return nil, fmt.Errorf("invalid wasm module: unknown import kind %#x", kind)
+				}
+			}
+		case functionSectionId:
+			for count := r.uleb(); count > 0 && r.err == nil; count-- {
+				funcTypes = append(funcTypes, uint32(r.uleb()))
+			}
+		case exportSectionId:
+			for count := r.uleb(); count > 0 && r.err == nil; count-- {
+				name := string(r.read(int(r.uleb())))
+				kind, index := r.byte(), uint32(r.uleb())
+				switch kind {
+				case 0x00: // function
+					exports[index] = append(exports[index], name)
+					roots = append(roots, index)
+				case 0x01: // table
+					exportTable = true
+				}
+			}
+		case startSectionId:
+			roots = append(roots, uint32(r.uleb()))
+		case elementSectionId:
+			tableFuncs = wasmElementFunctions(&r)
+		case codeSectionId:
+			code = r.b
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid wasm module: section %d: %w", id, r.err)
+		}
+	}
+
+	bodies := wasmFunctionBodies(wasm)
+	if len(imports)+len(bodies) != len(funcTypes) {
+		return nil, fmt.Errorf("invalid wasm module: %d function bodies for %d functions", len(bodies), len(funcTypes)-len(imports))
+	}
+	names := wasmFunctionNames(wasm)
+
+	g := &CallGraph{Functions: make([]CallGraphFunction, len(funcTypes))}
+	for i := range g.Functions {
+		fn := &g.Functions[i]
+		fn.Index = uint32(i)
+		fn.Exports = exports[fn.Index]
+		if i < len(imports) {
+			fn.Import = imports[i]
+		} else {
+			fn.Size = bodies[i-len(imports)].size
+		}
+		switch name, ok := names[fn.Index]; {
+		case ok:
+			if human, ok := demangleCxx(name); ok {
+				name = human
+			} else if human, ok := demangleRust(name); ok {
+				name = human
+			}
+			fn.Name = name
+		case len(fn.Exports) > 0:
+			fn.Name = fn.Exports[0]
+		case fn.Import != "":
+			fn.Name = fn.Import
+		default:
+			fn.Name = rawFunctionName(fn.Index)
+		}
+	}
+
+	// The calls are collected before being resolved, the references to
+	// functions taken by the code are candidates of the indirect calls too.
+	type callSite struct {
+		caller, index uint32 // callee or type
+		indirect      bool
+	}
+	var sites []callSite
+	addressTaken := make(map[uint32]bool)
+	for _, index := range tableFuncs {
+		addressTaken[index] = true
+	}
+	for i, body := range bodies {
+		caller := uint32(len(imports) + i)
+		r := wasmReader{b: code[body.offset : body.offset+body.size]}
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			r.uleb()
+			r.byte()
+		}
+		for r.i < len(r.b) && r.err == nil {
+			start := r.i
+			switch op := r.instruction(); op {
+			case 0x10, 0x12: // call, return_call
+				sites = append(sites, callSite{caller, wasmImmediate(r.b, start), false})
+			case 0x11, 0x13: // call_indirect, return_call_indirect
+				sites = append(sites, callSite{caller, wasmImmediate(r.b, start), true})
+			case 0xD2: // ref.func
+				addressTaken[wasmImmediate(r.b, start)] = true
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid wasm module: function %d: %w", caller, r.err)
+		}
+	}
+
+	// Indirect calls may call all the functions of the same signature in
+	// tables, which are grouped by type once for all the call sites.
+	targets := make(map[string][]uint32)
+	for i, t := range funcTypes {
+		if addressTaken[uint32(i)] && int(t) < len(types) {
+			targets[types[t]] = append(targets[types[t]], uint32(i))
+		}
+	}
+
+	type callKey struct {
+		caller, callee uint32
+		indirect       bool
+	}
+	calls := make(map[callKey]int)
+	for _, site := range sites {
+		if !site.indirect {
+			if int(site.index) >= len(funcTypes) {
+				return nil, fmt.Errorf("invalid wasm module: function %d calls unknown function %d", site.caller, site.index)
+			}
+			calls[callKey{site.caller, site.index, false}]++
+			continue
+		}
+		if int(site.index) >= len(types) {
+			return nil, fmt.Errorf("invalid wasm module: function %d calls unknown type %d", site.caller, site.index)
+		}
+		for _, callee := range targets[types[site.index]] {
+			calls[callKey{site.caller, callee, true}]++
+		}
+	}
+	g.Calls = make([]CallGraphCall, 0, len(calls))
+	for k, n := range calls {
+		g.Calls = append(g.Calls, CallGraphCall{Caller: k.caller, Callee: k.callee, Indirect: k.indirect, Sites: n})
+	}
+	sort.Slice(g.Calls, func(i, j int) bool {
+		ci, cj := g.Calls[i], g.Calls[j]
+		if ci.Caller != cj.Caller {
+			return ci.Caller < cj.Caller
+		}
+		if ci.Callee != cj.Callee {
+			return ci.Callee < cj.Callee
+		}
+		return !ci.Indirect && cj.Indirect
+	})
+
+	// The host may call the functions of the tables it has access to.
+	if exportTable || importTable {
+		roots = append(roots, tableFuncs...)
+	}
+	g.markReachable(roots)
+	return g, nil
+}
+
+func (g *CallGraph) markReachable(roots []uint32) {
+	callees := make(map[uint32][]uint32)
+	for _, c := range g.Calls {
+		callees[c.Caller] = append(callees[c.Caller], c.Callee)
+	}
+	stack := append([]uint32{}, roots...)
+	for len(stack) > 0 {
+		index := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if int(index) >= len(g.Functions) || g.Functions[index].Reachable {
+			continue
+		}
+		g.Functions[index].Reachable = true
+		stack = append(stack, callees[index]...)
+	}
+}
+
+// WriteJSON writes the call graph to w as an indented JSON document.
+func (g *CallGraph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the call graph to w in the DOT language of Graphviz. The
+// functions which are not reachable from the entry points of the module are
+// grayed out, imported functions are drawn as ellipses, and indirect calls are
+// dashed.
+func (g *CallGraph) WriteDOT(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "digraph \"callgraph\" {\n")
+	fmt.Fprintf(b, "  node [shape=box fontname=\"sans-serif\"];\n")
+	for _, fn := range g.Functions {
+		var attrs []string
+		if fn.Import != "" {
+			attrs = append(attrs, fmt.Sprintf("label=\"%s\\nimport %s\"", dotEscape(fn.Name), dotEscape(fn.Import)))
+			attrs = append(attrs, "shape=ellipse")
+		} else {
+			attrs = append(attrs, fmt.Sprintf("label=\"%s\\n%s\"", dotEscape(fn.Name), FormatValue(int64(fn.Size), "bytes")))
+		}
+		if !fn.Reachable {
+			attrs = append(attrs, "style=dashed", "color=gray", "fontcolor=gray")
+		}
+		fmt.Fprintf(b, "  F%d [%s];\n", fn.Index, strings.Join(attrs, " "))
+	}
+	for _, c := range g.Calls {
+		var attrs []string
+		if c.Sites > 1 {
+			attrs = append(attrs, fmt.Sprintf("label=\"%d\"", c.Sites))
+		}
+		if c.Indirect {
+			attrs = append(attrs, "style=dashed")
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(b, "  F%d -> F%d;\n", c.Caller, c.Callee)
+		} else {
+			fmt.Fprintf(b, "  F%d -> F%d [%s];\n", c.Caller, c.Callee, strings.Join(attrs, " "))
+		}
+	}
+	fmt.Fprintf(b, "}\n")
+	return b.Flush()
+}
+
+// wasmImmediate decodes the first immediate of the instruction at offset i of
+// b, an index for the instructions it is used with.
+func wasmImmediate(b []byte, i int) uint32 {
+	v, _ := binary.Uvarint(b[i+1:])
+	return uint32(v)
+}
+
+// wasmElementFunctions returns the functions referenced by the segments of
+// the element section, which initialize the tables of the module.
+func wasmElementFunctions(r *wasmReader) []uint32 {
+	var funcs []uint32
+	indexes := func() {
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			funcs = append(funcs, uint32(r.uleb()))
+		}
+	}
+	// Element expressions reference functions with ref.func, offsets are
+	// constant expressions without references.
+	expr := func() {
+		for r.err == nil {
+			start := r.i
+			op := r.instruction()
+			if op == 0xD2 { // ref.func
+				funcs = append(funcs, wasmImmediate(r.b, start))
+			}
+			if op == 0x0B { // end
+				return
+			}
+		}
+	}
+	exprs := func() {
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			expr()
+		}
+	}
+	for count := r.uleb(); count > 0 && r.err == nil; count-- {
+		switch flags := r.uleb(); flags {
+		case 0: // active, table 0
+			expr()
+			indexes()
+		case 1, 3: // passive or declarative
+			r.byte() // elemkind
+			indexes()
+		case 2: // active
+			r.uleb() // table
+			expr()
+			r.byte() // elemkind
+			indexes()
+		case 4: // active expressions, table 0
+			expr()
+			exprs()
+		case 5, 7: // passive or declarative expressions
+			r.byte() // reftype
+			exprs()
+		case 6: // active expressions
+			r.uleb() // table
+			expr()
+			r.byte() // reftype
+			exprs()
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown element segment kind %d", flags)
+			}
+		}
+	}
+	return funcs
+}
+
+// wasmFunctionNames returns the names of the functions found in the name
+// section of a wasm module, indexed by function index.
+func wasmFunctionNames(wasm []byte) map[uint32]string {
+	const functionNamesSubsectionId = 1
+	names := make(map[uint32]string)
+	r := wasmReader{b: wasmCustomSection(wasm, "name")}
+	for r.i < len(r.b) && r.err == nil {
+		id := r.byte()
+		sub := wasmReader{b: r.read(int(r.uleb()))}
+		if id != functionNamesSubsectionId {
+			continue
+		}
+		for n := sub.uleb(); n > 0 && sub.err == nil; n-- {
+			index := uint32(sub.uleb())
+			name := string(sub.read(int(sub.uleb())))
+			if sub.err == nil {
+				names[index] = name
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,138 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testCallGraphModule() []byte {
+	section := func(id byte, content string) []byte {
+		return append(binary.AppendUvarint([]byte{id}, uint64(len(content))), content...)
+	}
+	body := func(code string) string {
+		return string(binary.AppendUvarint(nil, uint64(len(code)))) + code
+	}
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	b = append(b, section(1, "\x03"+
+		"\x60\x00\x00"+ // type 0 () -> ()
+		"\x60\x01\x7F\x01\x7F"+ // type 1 (i32) -> i32
+		"\x60\x00\x00")...) // type 2 () -> (), same signature as type 0
+	b = append(b, section(2, "\x01\x03env\x03log\x00\x00")...) // (import "env" "log" (func 0))
+	b = append(b, section(3, "\x05\x00\x02\x01\x00\x00")...)   // five functions
+	b = append(b, section(4, "\x01\x70\x00\x02")...)           // (table 2 funcref)
+	b = append(b, section(7, "\x01\x04main\x00\x01")...)
+	b = append(b, section(9, "\x01\x00\x41\x00\x0B\x02\x02\x03")...) // (elem (i32.const 0) 2 3)
+	b = append(b, section(10, "\x05"+
+		body("\x00"+ // main
+			"\x10\x00"+ // call log
+			"\x41\x00"+ // i32.const 0
+			"\x11\x00\x00"+ // call_indirect (type 0)
+			"\x10\x00"+ // call log
+			"\x0B")+
+		body("\x00\x0B")+ // in the table
+		body("\x00\x20\x00\x0B")+ // in the table, of another type
+		body("\x00"+ // dead
+			"\xD2\x05"+ // ref.func 5
+			"\x1A"+ // drop
+			"\x10\x00"+ // call log
+			"\x0B")+
+		body("\x00\x0B"), // referenced by dead
+	)...)
+	functionNames := "\x03\x01\x04main\x02\x0A_ZN2ns1aEv\x04\x04dead"
+	b = append(b, section(0, "\x04name"+string(section(1, functionNames)))...)
+	return b
+}
+
+func TestStaticCallGraph(t *testing.T) {
+	g, err := StaticCallGraph(testCallGraphModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFunctions := []CallGraphFunction{
+		{Index: 0, Name: "env.log", Import: "env.log", Reachable: true},
+		{Index: 1, Name: "main", Exports: []string{"main"}, Size: 11, Reachable: true},
+		{Index: 2, Name: "ns::a()", Size: 2, Reachable: true},
+		{Index: 3, Name: "wasm-function[3]", Size: 4},
+		{Index: 4, Name: "dead", Size: 7},
+		{Index: 5, Name: "wasm-function[5]", Size: 2, Reachable: true},
+	}
+	if !reflect.DeepEqual(g.Functions, wantFunctions) {
+		t.Errorf("wrong functions:\nwant: %+v\ngot:  %+v", wantFunctions, g.Functions)
+	}
+
+	// The indirect call of main may call the functions of the same signature
+	// in the table or referenced by ref.func, but not the ones of other
+	// signatures.
+	wantCalls := []CallGraphCall{
+		{Caller: 1, Callee: 0, Sites: 2},
+		{Caller: 1, Callee: 2, Indirect: true, Sites: 1},
+		{Caller: 1, Callee: 5, Indirect: true, Sites: 1},
+		{Caller: 4, Callee: 0, Sites: 1},
+	}
+	if !reflect.DeepEqual(g.Calls, wantCalls) {
+		t.Errorf("wrong calls:\nwant: %+v\ngot:  %+v", wantCalls, g.Calls)
+	}
+
+	b := new(bytes.Buffer)
+	if err := g.WriteDOT(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`F0 [label="env.log\nimport env.log" shape=ellipse];`,
+		`F2 [label="ns::a()\n2B"];`,
+		`F4 [label="dead\n7B" style=dashed color=gray fontcolor=gray];`,
+		`F1 -> F0 [label="2"];`,
+		`F1 -> F5 [style=dashed];`,
+		`F4 -> F0;`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %s in the dot output:\n%s", want, b)
+		}
+	}
+
+	b.Reset()
+	if err := g.WriteJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded CallGraph
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, g) {
+		t.Errorf("call graph changed by the JSON encoding:\n%s", b)
+	}
+}
+
+func TestStaticCallGraphDWARF(t *testing.T) {
+	// The main function of Rust programs is called indirectly by the
+	// runtime, through a closure.
+	for path, main := range map[string]string{
+		"testdata/c/simple.wasm":                                    "main",
+		"testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm": "simple::main",
+	} {
+		wasm, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := StaticCallGraph(wasm)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if n := len(wasmFunctionBodies(wasm)); n == 0 || len(g.Functions) < n {
+			t.Errorf("%s: wrong number of functions: %d for %d bodies", path, len(g.Functions), n)
+		}
+		reachable := make(map[string]bool)
+		for _, fn := range g.Functions {
+			reachable[fn.Name] = fn.Reachable
+		}
+		if !reachable["_start"] || !reachable[main] {
+			t.Errorf("%s: %s is not reachable from _start", path, main)
+		}
+	}
+}
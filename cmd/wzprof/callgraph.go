@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func callgraphCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("callgraph", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof callgraph [flags] </path/to/app.wasm>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the call graph to the specified file instead of stdout.")
+	format := flags.String("format", "dot", "Format of the call graph: dot (Graphviz) or json.")
+	var diag diagnostics
+	diag.register(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected the wasm module to analyze")
+	}
+	wasmPath := flags.Arg(0)
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	var write func(*wzprof.CallGraph, io.Writer) error
+	switch *format {
+	case "dot":
+		write = (*wzprof.CallGraph).WriteDOT
+	case "json":
+		write = (*wzprof.CallGraph).WriteJSON
+	default:
+		return fmt.Errorf("invalid call graph format: %s (expected dot or json)", *format)
+	}
+
+	wasmCode, err := os.ReadFile(wasmPath)
+	if err != nil {
+		return fmt.Errorf("reading wasm module: %w", err)
+	}
+	g, err := wzprof.StaticCallGraph(wasmCode)
+	if err != nil {
+		return err
+	}
+
+	var unreachable int
+	var unreachableSize uint64
+	for _, fn := range g.Functions {
+		if !fn.Reachable {
+			unreachable++
+			unreachableSize += fn.Size
+		}
+	}
+	progress.Printf("%d functions, %d calls, %d unreachable functions (%d bytes of code)", len(g.Functions), len(g.Calls), unreachable, unreachableSize)
+
+	if *output == "" {
+		return write(g, os.Stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := write(g, f); err != nil {
+		f.Close()
+		return err
+	}
+	progress.Printf("writing call graph to %s", *output)
+	return f.Close()
+}
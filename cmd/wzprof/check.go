@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func checkCommand(ctx context.Context, args []string) error {
+	var (
+		budgetPath string
+		diag       diagnostics
+		mounts     string
+		env        stringList
+		invokeName string
+	)
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof check -budget <budgets.yaml> [flags] </path/to/app.wasm> [--] [args...]\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&budgetPath, "budget", "", "Path to the file of budgets of the functions of the module.")
+	diag.register(flags)
+	flags.StringVar(&mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
+	flags.Var(&env, "env", "Set an environment variable of the guest (e.g. -env KEY=VALUE), may be repeated.")
+	flags.StringVar(&invokeName, "invoke", "", "Call the function exported under this name instead of _start, passing the arguments following the module path.")
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 1 {
+		flags.Usage()
+		return fmt.Errorf("missing path to the wasm module")
+	}
+	if budgetPath == "" {
+		flags.Usage()
+		return fmt.Errorf("missing path to the budgets")
+	}
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(budgetPath)
+	if err != nil {
+		return fmt.Errorf("reading budgets: %w", err)
+	}
+	budgets, err := parseBudgets(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading budgets: %s: %w", budgetPath, err)
+	}
+
+	filePath, args := args[0], args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	// Only the profiles needed to check the budgets are collected, and all
+	// the calls are recorded so the costs are not estimates.
+	dir, err := os.MkdirTemp("", "wzprof-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	prog := &program{
+		filePath:   filePath,
+		args:       args,
+		format:     "pprof",
+		sampleRate: 1,
+		demangle:   true,
+		mounts:     split(mounts),
+		env:        env,
+		invoke:     invokeName,
+	}
+	for _, b := range budgets {
+		path := filepath.Join(dir, b.metric+".pprof")
+		switch b.metric {
+		case "time":
+			prog.cpuProfile = path
+		case "instructions":
+			prog.instrProfile = path
+		case "alloc":
+			prog.memProfile = path
+		}
+	}
+	if err := prog.run(ctx); err != nil {
+		return err
+	}
+
+	costs := make(map[string]map[string]int64)
+	for _, b := range budgets {
+		if costs[b.metric] != nil {
+			continue
+		}
+		prof, err := readProfile(filepath.Join(dir, b.metric+".pprof"))
+		if err != nil {
+			return err
+		}
+		index, err := wzprof.SampleTypeIndex(prof, budgetSampleTypes[b.metric])
+		if err != nil {
+			return err
+		}
+		costs[b.metric] = cumulativeValues(prof, index)
+	}
+
+	results := checkBudgets(budgets, costs)
+	if err := writeBudgetResults(os.Stdout, results); err != nil {
+		return err
+	}
+
+	over := 0
+	for _, r := range results {
+		if r.over() {
+			over++
+		}
+	}
+	if over > 0 {
+		return fmt.Errorf("%d of %d budgets exceeded", over, len(results))
+	}
+	return nil
+}
+
+// budgetSampleTypes maps the metrics of budgets to the sample types of the
+// profiles measuring them.
+var budgetSampleTypes = map[string]string{
+	"time":         "cpu",
+	"instructions": "instructions",
+	"alloc":        "alloc_space",
+}
+
+// budget is the maximum cost of a function for a metric, which includes the
+// cost of the functions it calls.
+type budget struct {
+	function string
+	metric   string
+	limit    int64
+}
+
+// parseBudgets reads budgets from a YAML document mapping the names of
+// functions to the limits of their metrics:
+//
+//	main.parse:
+//	  instructions: 1200000
+//	  time: 20ms
+//	"encoding/json.Unmarshal":
+//	  alloc: 4MiB
+//
+// Only this subset of YAML is supported: keys may be quoted, and comments
+// start with #.
+func parseBudgets(r io.Reader) ([]budget, error) {
+	var budgets []budget
+	var function string
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.Index(text, " #"); i >= 0 {
+			text = text[:i]
+		}
+		if strings.HasPrefix(strings.TrimSpace(text), "#") || strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(text), ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		key, value = unquote(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		if text[0] != ' ' && text[0] != '\t' {
+			if value != "" {
+				return nil, fmt.Errorf("line %d: expected the budgets of %s on the following lines", line, key)
+			}
+			function = key
+			continue
+		}
+		if function == "" {
+			return nil, fmt.Errorf("line %d: budget of no function", line)
+		}
+
+		limit, err := parseBudgetLimit(key, unquote(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, function, err)
+		}
+		budgets = append(budgets, budget{function: function, metric: key, limit: limit})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(budgets) == 0 {
+		return nil, fmt.Errorf("no budgets")
+	}
+	return budgets, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseBudgetLimit parses the limit of a metric: a duration for time (e.g.
+// 20ms), a size in bytes for allocations (e.g. 4MiB), and a count for
+// instructions which may have a k, M or G suffix (e.g. 1.2M).
+func parseBudgetLimit(metric, value string) (int64, error) {
+	switch metric {
+	case "time":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid time budget: %q", value)
+		}
+		return int64(d), nil
+	case "alloc":
+		n, err := parseScaled(value, []scaleSuffix{
+			{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+			{"GB", 1 << 30}, {"MB", 1 << 20}, {"kB", 1 << 10}, {"KB", 1 << 10},
+			{"B", 1},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("invalid alloc budget: %q", value)
+		}
+		return n, nil
+	case "instructions":
+		n, err := parseScaled(value, []scaleSuffix{{"G", 1e9}, {"M", 1e6}, {"k", 1e3}})
+		if err != nil {
+			return 0, fmt.Errorf("invalid instructions budget: %q", value)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric %q (time, instructions, alloc)", metric)
+	}
+}
+
+type scaleSuffix struct {
+	suffix string
+	scale  float64
+}
+
+func parseScaled(value string, suffixes []scaleSuffix) (int64, error) {
+	scale := 1.0
+	for _, s := range suffixes {
+		if v, ok := strings.CutSuffix(value, s.suffix); ok {
+			value, scale = strings.TrimSpace(v), s.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid value: %q", value)
+	}
+	return int64(f * scale), nil
+}
+
+// cumulativeValues returns the sum of sample values of the stacks each
+// function appears in.
+func cumulativeValues(prof *profile.Profile, index int) map[string]int64 {
+	values := make(map[string]int64)
+	seen := make(map[string]struct{})
+	for _, s := range prof.Sample {
+		// Recursive functions appear multiple times in the stack but must
+		// only be accounted once.
+		for k := range seen {
+			delete(seen, k)
+		}
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				if line.Function == nil {
+					continue
+				}
+				if _, ok := seen[line.Function.Name]; !ok {
+					seen[line.Function.Name] = struct{}{}
+					values[line.Function.Name] += s.Value[index]
+				}
+			}
+		}
+	}
+	return values
+}
+
+type budgetResult struct {
+	budget
+	cost   int64
+	called bool
+}
+
+func (r budgetResult) over() bool {
+	return r.cost > r.limit
+}
+
+// checkBudgets returns the costs of the functions measured against their
+// budgets, ordered by decreasing ratio of the cost to the budget.
+func checkBudgets(budgets []budget, costs map[string]map[string]int64) []budgetResult {
+	results := make([]budgetResult, len(budgets))
+	for i, b := range budgets {
+		cost, called := costs[b.metric][b.function]
+		results[i] = budgetResult{budget: b, cost: cost, called: called}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		ri := float64(results[i].cost) / float64(results[i].limit)
+		rj := float64(results[j].cost) / float64(results[j].limit)
+		return ri > rj
+	})
+	return results
+}
+
+func writeBudgetResults(w io.Writer, results []budgetResult) error {
+	units := map[string]string{
+		"time":         "nanoseconds",
+		"instructions": "count",
+		"alloc":        "bytes",
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "cost\tbudget\tusage\t %-10s %-12s %s\n", "status", "metric", "function")
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.over():
+			status = "OVER"
+		case !r.called:
+			// The function may have been renamed, its budget is met but
+			// does not measure anything.
+			status = "not called"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t %-10s %-12s %s\n",
+			wzprof.FormatValue(r.cost, units[r.metric]),
+			wzprof.FormatValue(r.limit, units[r.metric]),
+			100*float64(r.cost)/float64(r.limit),
+			status,
+			r.metric,
+			r.function,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func diffCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof diff [flags] <base.pprof> <new.pprof>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the difference as a pprof profile with negative samples for the base to the specified file.")
+	sampleIndex := flags.String("sample_index", "", "Name of the sample type to compare (default to the last sample type).")
+	normalize := flags.Bool("normalize", true, "Scale the sample counts of the base profile to the sampling period of the new profile.")
+	limit := flags.Int("n", 20, "Maximum number of functions to print (0 for no limit).")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected two profiles to compare")
+	}
+
+	base, err := readProfile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	next, err := readProfile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if err := compatibleSampleTypes(base, next); err != nil {
+		return fmt.Errorf("comparing profiles: %w", err)
+	}
+
+	index, err := wzprof.SampleTypeIndex(next, *sampleIndex)
+	if err != nil {
+		return err
+	}
+
+	if *normalize {
+		if err := normalizeProfile(base, next); err != nil {
+			return fmt.Errorf("normalizing profiles: %w", err)
+		}
+	}
+
+	deltas := diffFunctions(base, next, index)
+	if *limit > 0 && len(deltas) > *limit {
+		deltas = deltas[:*limit]
+	}
+
+	unit := next.SampleType[index].Unit
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "delta\tdelta%%\tbase\tnew\t %s\n", next.SampleType[index].Type)
+	for _, d := range deltas {
+		// Functions missing from the base profile have no relative change.
+		percent := "-"
+		if d.base != 0 {
+			percent = wzprof.FormatPercent(d.next-d.base, d.base)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t %s\n",
+			wzprof.FormatValue(d.next-d.base, unit),
+			percent,
+			wzprof.FormatValue(d.base, unit),
+			wzprof.FormatValue(d.next, unit),
+			d.name,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		base.Scale(-1)
+		diff, err := wzprof.MergeProfiles(next, base)
+		if err != nil {
+			return fmt.Errorf("merging profiles: %w", err)
+		}
+		if err := wzprof.WriteProfile(*output, diff); err != nil {
+			return fmt.Errorf("writing profile: %w", err)
+		}
+	}
+	return nil
+}
+
+type functionDelta struct {
+	name string
+	base int64
+	next int64
+}
+
+// diffFunctions returns the flat values of the functions of the two profiles,
+// ordered by decreasing magnitude of their difference.
+func diffFunctions(base, next *profile.Profile, index int) []functionDelta {
+	baseFlat := flatValues(base, index)
+	nextFlat := flatValues(next, index)
+
+	deltas := make([]functionDelta, 0, len(nextFlat))
+	for name, v := range nextFlat {
+		deltas = append(deltas, functionDelta{name: name, base: baseFlat[name], next: v})
+	}
+	for name, v := range baseFlat {
+		if _, ok := nextFlat[name]; !ok {
+			deltas = append(deltas, functionDelta{name: name, base: v})
+		}
+	}
+
+	sort.Slice(deltas, func(i, j int) bool {
+		di := abs(deltas[i].next - deltas[i].base)
+		dj := abs(deltas[j].next - deltas[j].base)
+		if di != dj {
+			return di > dj
+		}
+		return deltas[i].name < deltas[j].name
+	})
+	return deltas
+}
+
+// flatValues returns the sum of sample values by leaf function.
+func flatValues(prof *profile.Profile, index int) map[string]int64 {
+	values := make(map[string]int64)
+	for _, s := range prof.Sample {
+		values[leafFunctionName(s)] += s.Value[index]
+	}
+	return values
+}
+
+func leafFunctionName(s *profile.Sample) string {
+	if len(s.Location) == 0 || len(s.Location[0].Line) == 0 || s.Location[0].Line[0].Function == nil {
+		return "<unknown>"
+	}
+	// The first line of a location is the innermost inlined function.
+	return s.Location[0].Line[0].Function.Name
+}
+
+// normalizeProfile scales the values of the base profile so they can be
+// compared with the ones of the next profile.
+//
+// Profiles sampled by function calls are extrapolated with their sampling rate
+// when wzprof builds them, so their values are already comparable. Profiles
+// sampled at a fixed period (e.g. the wall-clock profiles) record it in their
+// period type, and each count represents one period: the counts of the base
+// profile are expressed at the period of the next profile, while the values
+// measured in other units already account for the period.
+func normalizeProfile(base, next *profile.Profile) error {
+	if base.PeriodType == nil || next.PeriodType == nil {
+		return nil
+	}
+	if base.PeriodType.Type != next.PeriodType.Type || base.PeriodType.Unit != next.PeriodType.Unit {
+		return fmt.Errorf("incompatible period types: %v and %v", base.PeriodType, next.PeriodType)
+	}
+	if base.PeriodType.Unit == "count" || base.Period <= 0 || next.Period <= 0 || base.Period == next.Period {
+		return nil
+	}
+	ratio := float64(base.Period) / float64(next.Period)
+	ratios := make([]float64, len(base.SampleType))
+	for i, t := range base.SampleType {
+		ratios[i] = 1
+		if t.Unit == "count" {
+			ratios[i] = ratio
+		}
+	}
+	base.Period = next.Period
+	return base.ScaleN(ratios)
+}
+
+func compatibleSampleTypes(p1, p2 *profile.Profile) error {
+	if len(p1.SampleType) != len(p2.SampleType) {
+		return fmt.Errorf("incompatible sample types: %v and %v", p1.SampleType, p2.SampleType)
+	}
+	for i := range p1.SampleType {
+		t1, t2 := p1.SampleType[i], p2.SampleType[i]
+		if t1.Type != t2.Type || t1.Unit != t2.Unit {
+			return fmt.Errorf("incompatible sample types: %v and %v", t1, t2)
+		}
+	}
+	return nil
+}
+
+func readProfile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing profile %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -2,25 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"runtime"
-	"runtime/pprof"
 	"strings"
 
-	"github.com/google/pprof/profile"
-	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/experimental"
-	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"golang.org/x/exp/slog"
 
 	"github.com/stealthrocket/wzprof"
 )
@@ -29,240 +21,163 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	if err := run(ctx); err != nil {
+	if err := run(ctx, os.Args[1:]); err != nil {
+		// The profiles are written when the guest exits, wzprof then exits
+		// with the code of the guest so wrapper scripts can rely on it.
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(int(exitErr.ExitCode()))
+		}
 		stderr.Print(err)
 		os.Exit(1)
 	}
 }
 
-const defaultSampleRate = 1.0 / 19
+var (
+	version  = "dev"
+	progress = log.Default()
+	stderr   = log.New(os.Stderr, "ERROR: ", 0)
+)
 
-type program struct {
-	filePath    string
-	args        []string
-	pprofAddr   string
-	cpuProfile  string
-	memProfile  string
-	sampleRate  float64
-	hostProfile bool
-	hostTime    bool
-	inuseMemory bool
-	mounts      []string
+// diagnostics are the flags controlling the diagnostics of wzprof, like the
+// progress of the commands, the language detected in the module, the
+// symbolizer chosen, or the number of samples of the profiles. They are
+// written to stderr, separately from the output of the guest.
+type diagnostics struct {
+	verbose bool
+	debug   bool
+	quiet   bool
 }
 
-func (prog *program) run(ctx context.Context) error {
-	wasmName := filepath.Base(prog.filePath)
-	wasmCode, err := os.ReadFile(prog.filePath)
-	if err != nil {
-		return fmt.Errorf("reading wasm module: %w", err)
-	}
-
-	p := wzprof.ProfilingFor(wasmCode)
-
-	cpu := p.CPUProfiler(wzprof.HostTime(prog.hostTime))
-	mem := p.MemoryProfiler(wzprof.InuseMemory(prog.inuseMemory))
-
-	var listeners []experimental.FunctionListenerFactory
-	if prog.cpuProfile != "" || prog.pprofAddr != "" {
-		stdout.Printf("enabling cpu profiler")
-		listeners = append(listeners, cpu)
-	}
-	if prog.memProfile != "" || prog.pprofAddr != "" {
-		stdout.Printf("enabling memory profiler")
-		listeners = append(listeners, mem)
-	}
-	if prog.sampleRate < 1 {
-		stdout.Printf("configuring sampling rate to %.2g%%", prog.sampleRate)
-		for i, lstn := range listeners {
-			listeners[i] = wzprof.Sample(prog.sampleRate, lstn)
-		}
-	}
-
-	ctx = context.WithValue(ctx,
-		experimental.FunctionListenerFactoryKey{},
-		experimental.MultiFunctionListenerFactory(listeners...),
-	)
-
-	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
-		WithDebugInfoEnabled(true).
-		WithCustomSections(true))
+func (d *diagnostics) register(flags *flag.FlagSet) {
+	flags.BoolVar(&d.verbose, "v", false, "Print diagnostics about the profiling (module detection, symbolizer, sample counts) to stderr.")
+	flags.BoolVar(&d.verbose, "verbose", false, "Same as -v.")
+	flags.BoolVar(&d.debug, "vv", false, "Print debugging diagnostics (e.g. DWARF sections, dropped samples) to stderr, in addition to the ones of -v.")
+	flags.BoolVar(&d.quiet, "quiet", false, "Only print errors to stderr.")
+}
 
-	stdout.Printf("compiling wasm module %s", prog.filePath)
-	compiledModule, err := runtime.CompileModule(ctx, wasmCode)
-	if err != nil {
-		return fmt.Errorf("compiling wasm module: %w", err)
-	}
-	err = p.Prepare(compiledModule)
-	if err != nil {
-		return fmt.Errorf("preparing wasm module: %w", err)
+// setup configures the loggers of the progress messages of the commands and
+// of the diagnostics of the wzprof package. Warnings are printed unless
+// -quiet is set.
+func (d *diagnostics) setup() error {
+	if d.quiet && (d.verbose || d.debug) {
+		return fmt.Errorf("-quiet cannot be combined with -v or -vv")
+	}
+	level := slog.LevelWarn
+	switch {
+	case d.debug:
+		level = slog.LevelDebug
+	case d.verbose:
+		level = slog.LevelInfo
+	case d.quiet:
+		level = slog.LevelError
+	}
+	log.SetPrefix("==> ")
+	log.SetFlags(0)
+	log.SetOutput(os.Stderr)
+	if level > slog.LevelInfo {
+		log.SetOutput(io.Discard)
 	}
+	wzprof.SetLogger(slog.New(slog.HandlerOptions{Level: level}.NewTextHandler(os.Stderr)))
+	return nil
+}
 
-	if prog.pprofAddr != "" {
-		u := &url.URL{Scheme: "http", Host: prog.pprofAddr, Path: "/debug/pprof"}
-		stdout.Printf("starting prrof http sever at %s", u)
+// command is a subcommand of the wzprof CLI.
+type command struct {
+	name string
+	desc string
+	run  func(ctx context.Context, args []string) error
+}
 
-		server := http.NewServeMux()
-		server.Handle("/debug/pprof/", wzprof.Handler(prog.sampleRate, cpu, mem))
+var commands []command
 
-		go func() {
-			if err := http.ListenAndServe(prog.pprofAddr, server); err != nil {
-				stderr.Println(err)
-			}
-		}()
+func init() {
+	commands = []command{
+		{"run", "Run a WebAssembly module and profile its execution.", runCommand},
+		{"serve", "Serve HTTP requests with a WebAssembly module and profile their handling.", serveCommand},
+		{"trace", "Run a WebAssembly module and write the calls of selected functions as JSON lines.", traceCommand},
+		{"check", "Run a WebAssembly module and check the cost of its functions against budgets.", checkCommand},
+		{"top", "Print the functions with the highest values of a profile.", topCommand},
+		{"diff", "Compare two profiles.", diffCommand},
+		{"merge", "Merge multiple profiles into one.", mergeCommand},
+		{"report", "Generate an HTML report of a profile with a flame graph and annotated source.", reportCommand},
+		{"order", "Write the functions of profiles ordered by weight for post-link optimizers.", orderCommand},
+		{"profdata", "Export profiles as LLVM sample profiles for profile guided optimizations.", profdataCommand},
+		{"symbolize", "Symbolize a raw profile collected with run -raw.", symbolizeCommand},
+		{"size", "Profile the size of the code of the functions of a WebAssembly module.", sizeCommand},
+		{"callgraph", "Extract the static call graph of a WebAssembly module.", callgraphCommand},
+		{"version", "Print the wzprof version.", versionCommand},
 	}
+}
 
-	if prog.hostProfile {
-		if prog.cpuProfile != "" {
-			f, err := os.Create(prog.cpuProfile)
-			if err != nil {
-				return err
+func run(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				return cmd.run(ctx, args[1:])
 			}
-			startCPUProfile(f)
-			defer stopCPUProfile(f)
 		}
-
-		if prog.memProfile != "" {
-			f, err := os.Create(prog.memProfile)
-			if err != nil {
-				return err
-			}
-			defer writeHeapProfile(f)
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage()
+			return nil
 		}
 	}
-
-	if prog.cpuProfile != "" {
-		cpu.StartProfile()
-		defer func() {
-			p := cpu.StopProfile(prog.sampleRate)
-			if !prog.hostProfile {
-				writeProfile("cpu", wasmName, prog.cpuProfile, p)
-			}
-		}()
+	// When no subcommand is given, wzprof runs the module for compatibility
+	// with versions that did not have subcommands.
+	if len(args) == 0 {
+		usage()
+		return fmt.Errorf("missing command")
 	}
-
-	if prog.memProfile != "" {
-		defer func() {
-			p := mem.NewProfile(prog.sampleRate)
-			if !prog.hostProfile {
-				writeProfile("memory", wasmName, prog.memProfile, p)
-			}
-		}()
-	}
-
-	ctx, cancel := context.WithCancelCause(ctx)
-	go func() {
-		defer cancel(nil)
-		stdout.Printf("instantiating host module: wasi_snapshot_preview1")
-		wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
-
-		config := wazero.NewModuleConfig().
-			WithStdout(os.Stdout).
-			WithStderr(os.Stderr).
-			WithStdin(os.Stdin).
-			WithRandSource(rand.Reader).
-			WithSysNanosleep().
-			WithSysNanotime().
-			WithSysWalltime().
-			WithArgs(append([]string{wasmName}, prog.args...)...).
-			WithFSConfig(createFSConfig(prog.mounts))
-
-		moduleName := compiledModule.Name()
-		if moduleName == "" {
-			moduleName = wasmName
-		}
-		stdout.Printf("instantiating guest module: %s", moduleName)
-		instance, err := runtime.InstantiateModule(ctx, compiledModule, config)
-		if err != nil {
-			cancel(fmt.Errorf("instantiating guest module: %w", err))
-			return
-		}
-		if err := instance.Close(ctx); err != nil {
-			cancel(fmt.Errorf("closing guest module: %w", err))
-			return
-		}
-	}()
-
-	<-ctx.Done()
-	return silenceContextCanceled(context.Cause(ctx))
+	return runCommand(ctx, args)
 }
 
-func silenceContextCanceled(err error) error {
-	if err == context.Canceled {
-		err = nil
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: wzprof <command> [flags] [args...]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.desc)
 	}
-	return err
+	fmt.Fprintf(w, "\nRun 'wzprof <command> -h' for details about a command.\n")
 }
 
-var (
-	pprofAddr    string
-	cpuProfile   string
-	memProfile   string
-	sampleRate   float64
-	hostProfile  bool
-	hostTime     bool
-	inuseMemory  bool
-	verbose      bool
-	mounts       string
-	printVersion bool
+func versionCommand(ctx context.Context, args []string) error {
+	fmt.Printf("wzprof version %s\n", version)
+	return nil
+}
 
-	version = "dev"
-	stdout  = log.Default()
-	stderr  = log.New(os.Stderr, "ERROR: ", 0)
-)
+// stringList is a flag.Value collecting the values of a flag which may be
+// repeated on the command line.
+type stringList []string
 
-func init() {
-	flag.StringVar(&pprofAddr, "pprof-addr", "", "Address where to expose a pprof HTTP endpoint.")
-	flag.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile to the specified file before exiting.")
-	flag.StringVar(&memProfile, "memprofile", "", "Write a memory profile to the specified file before exiting.")
-	flag.Float64Var(&sampleRate, "sample", defaultSampleRate, "Set the profile sampling rate (0-1).")
-	flag.BoolVar(&hostProfile, "host", false, "Generate profiles of the host instead of the guest application.")
-	flag.BoolVar(&hostTime, "iowait", false, "Include time spent waiting on I/O in guest CPU profile.")
-	flag.BoolVar(&inuseMemory, "inuse", false, "Include snapshots of memory in use (experimental).")
-	flag.BoolVar(&verbose, "verbose", false, "Enable more output")
-	flag.StringVar(&mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
-	flag.BoolVar(&printVersion, "version", false, "Print the wzprof version.")
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
 }
 
-func run(ctx context.Context) error {
-	flag.Parse()
-
-	if printVersion {
-		fmt.Printf("wzprof version %s\n", version)
-		return nil
-	}
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-	args := flag.Args()
-	if len(args) < 1 {
-		// TODO: print flag usage
-		return fmt.Errorf("usage: wzprof </path/to/app.wasm>")
+// sourcePathOptions returns the options remapping the prefixes of the source
+// file names of the profiles, from the values of the -trim-path and
+// -source-map-prefix flags.
+func sourcePathOptions(trimPath, sourceMap []string) ([]wzprof.ProfilingOption, error) {
+	var options []wzprof.ProfilingOption
+	for _, prefix := range trimPath {
+		if prefix == "" {
+			return nil, fmt.Errorf("invalid -trim-path: empty prefix")
+		}
+		options = append(options, wzprof.SourcePathPrefix(prefix, ""))
 	}
-
-	if verbose {
-		log.SetPrefix("==> ")
-		log.SetFlags(0)
-		log.SetOutput(os.Stdout)
-	} else {
-		log.SetOutput(io.Discard)
+	for _, m := range sourceMap {
+		old, new, ok := strings.Cut(m, "=")
+		if !ok || old == "" {
+			return nil, fmt.Errorf("invalid -source-map-prefix: %s: expected old=new", m)
+		}
+		options = append(options, wzprof.SourcePathPrefix(old, new))
 	}
-
-	filePath := args[0]
-
-	rate := int(math.Ceil(1 / sampleRate))
-	runtime.SetBlockProfileRate(rate)
-	runtime.SetMutexProfileFraction(rate)
-
-	return (&program{
-		filePath:    filePath,
-		args:        args[1:],
-		pprofAddr:   pprofAddr,
-		cpuProfile:  cpuProfile,
-		memProfile:  memProfile,
-		sampleRate:  sampleRate,
-		hostProfile: hostProfile,
-		hostTime:    hostTime,
-		inuseMemory: inuseMemory,
-		mounts:      split(mounts),
-	}).run(ctx)
+	return options, nil
 }
 
 func split(s string) []string {
@@ -271,53 +186,3 @@ func split(s string) []string {
 	}
 	return strings.Split(s, ",")
 }
-
-func startCPUProfile(f *os.File) {
-	if err := pprof.StartCPUProfile(f); err != nil {
-		stderr.Print("starting CPU profile:", err)
-	}
-}
-
-func stopCPUProfile(f *os.File) {
-	stdout.Printf("writing host cpu profile to %s", f.Name())
-	pprof.StopCPUProfile()
-}
-
-func writeHeapProfile(f *os.File) {
-	stdout.Printf("writing host memory profile to %s", f.Name())
-	if err := pprof.WriteHeapProfile(f); err != nil {
-		stderr.Print("writing memory profile:", err)
-	}
-}
-
-func writeProfile(profileName, wasmName, path string, prof *profile.Profile) {
-	m := &profile.Mapping{ID: 1, File: wasmName}
-	prof.Mapping = []*profile.Mapping{m}
-	stdout.Printf("writing guest %s profile to %s", profileName, path)
-	if err := wzprof.WriteProfile(path, prof); err != nil {
-		stderr.Print("writing profile:", err)
-	}
-}
-
-func createFSConfig(mounts []string) wazero.FSConfig {
-	fs := wazero.NewFSConfig()
-	for _, m := range mounts {
-		parts := strings.Split(m, ":")
-		if len(parts) < 2 {
-			stderr.Fatalf("invalid mount: %s", m)
-		}
-
-		var mode string
-		if len(parts) == 3 {
-			mode = parts[2]
-		}
-
-		if mode == "ro" {
-			fs = fs.WithReadOnlyDirMount(parts[0], parts[1])
-			continue
-		}
-
-		fs = fs.WithDirMount(parts[0], parts[1])
-	}
-	return fs
-}
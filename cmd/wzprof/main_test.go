@@ -1,12 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+	"golang.org/x/exp/slog"
+
+	"github.com/stealthrocket/wzprof"
 )
 
 // This test file performs end-to-end validation of the profiler on actual wasm
@@ -15,42 +34,747 @@ import (
 // the expected samples below. Use the printSamples() function to help you with
 // that.
 
+var cSimpleSamples = []sample{
+	{
+		[]int64{1, 10},
+		[]frame{
+			{"malloc", 0, false},
+			{"func1", 6, false},
+			{"main", 34, false},
+			{"__main_void", 0, false},
+			{"_start", 0, false},
+		},
+	},
+	{
+		[]int64{1, 20},
+		[]frame{
+			{"malloc", 0, false},
+			{"func21", 12, false},
+			{"func2", 18, false},
+			{"main", 35, false},
+			{"__main_void", 0, false},
+			{"_start", 0, false},
+		},
+	},
+	{
+		[]int64{1, 30},
+		[]frame{
+			{"malloc", 0, false},
+			{"func31", 29, true},
+			{"func3", 23, false},
+			{"main", 36, false},
+			{"__main_void", 0, false},
+			{"_start", 0, false},
+		},
+	},
+}
+
 func TestDataCSimple(t *testing.T) {
 	p := program{filePath: "../../testdata/c/simple.wasm"}
-	testMemoryProfiler(t, p, []sample{
+	testMemoryProfiler(t, p, cSimpleSamples)
+}
+
+func TestDataCSimpleInterpreter(t *testing.T) {
+	// The interpreter reports the same call sites as the compiler.
+	p := program{filePath: "../../testdata/c/simple.wasm", engine: "interpreter"}
+	testMemoryProfiler(t, p, cSimpleSamples)
+
+	err := runCommand(context.Background(), []string{"-engine", "jit", p.filePath})
+	if err == nil {
+		t.Error("expected an error running the module with an unknown engine")
+	}
+}
+
+func TestDataCSimplePreciseLocations(t *testing.T) {
+	// The instructions of func31 are at its lines, and func3 is at the line
+	// of the call to func31.
+	samples := make([]sample, len(cSimpleSamples))
+	copy(samples, cSimpleSamples)
+	samples[2] = sample{
+		[]int64{1, 30},
+		[]frame{
+			{"malloc", 0, false},
+			{"func31", 23, true},
+			{"func3", 29, false},
+			{"main", 36, false},
+			{"__main_void", 0, false},
+			{"_start", 0, false},
+		},
+	}
+	p := program{filePath: "../../testdata/c/simple.wasm", precise: true}
+	testMemoryProfiler(t, p, samples)
+}
+
+func TestDataCSimpleRaw(t *testing.T) {
+	p := program{filePath: "../../testdata/c/simple.wasm", raw: true, sampleRate: 1}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+
+	raw := execForProfile(t, &p, p.memProfile)
+	for _, fn := range raw.Function {
+		if !strings.HasPrefix(fn.SystemName, "wasm-function[") || fn.Filename != "" {
+			t.Errorf("function not raw: %s (%s)", fn.SystemName, fn.Filename)
+		}
+	}
+	if len(raw.Mapping) != 1 || raw.Mapping[0].HasFunctions {
+		t.Errorf("wrong mapping for a raw profile: %+v", raw.Mapping)
+	}
+
+	symbolized := filepath.Join(t.TempDir(), "symbolized.pprof")
+	if err := symbolizeCommand(context.Background(), []string{"-o", symbolized, p.memProfile, p.filePath}); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := readProfile(symbolized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSamples(t, []string{"alloc_objects", "alloc_space"}, cSimpleSamples, prof)
+	if m := prof.Mapping[0]; !m.HasFunctions || !m.HasFilenames || !m.HasLineNumbers || !m.HasInlineFrames {
+		t.Errorf("wrong mapping for a symbolized profile: %+v", m)
+	}
+
+	// Raw profiles of other modules are rejected.
+	err = symbolizeCommand(context.Background(), []string{"-o", symbolized, p.memProfile, "../../testdata/c/bench.wasm"})
+	if err == nil {
+		t.Error("expected an error symbolizing a profile with another module")
+	}
+}
+
+func TestDataCSimpleAddresses(t *testing.T) {
+	// The addresses of the locations are the offsets of the calls in the
+	// code section whether the profile is symbolized or raw.
+	addresses := func(raw bool) map[uint64]bool {
+		p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1, raw: raw}
+		p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+		prof := execForProfile(t, &p, p.memProfile)
+		m := prof.Mapping[0]
+		set := make(map[uint64]bool)
+		for _, loc := range prof.Location {
+			if loc.Address == 0 || loc.Address >= m.Limit {
+				t.Errorf("location of %s out of the code section: %#x", loc.Line[0].Function.Name, loc.Address)
+			}
+			set[loc.Address] = true
+		}
+		return set
+	}
+	symbolized, raw := addresses(false), addresses(true)
+	if !reflect.DeepEqual(symbolized, raw) {
+		t.Errorf("addresses of symbolized and raw profiles differ:\n%v\n%v", symbolized, raw)
+	}
+}
+
+func TestDataCSimpleSourcePaths(t *testing.T) {
+	// The DWARF information of the module has the paths of the machine it
+	// was built on.
+	const buildDir = "/home/thomas/src/github.com/stealthrocket/wzprof"
+
+	sourcePaths, err := sourcePathOptions([]string{buildDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1, sourcePaths: sourcePaths}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+
+	prof := execForProfile(t, &p, p.memProfile)
+	assertFilenames(t, prof, "internal/testdata/simple.c")
+
+	// Raw profiles are remapped when they are symbolized.
+	p = program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1, raw: true}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	execForProfile(t, &p, p.memProfile)
+
+	symbolized := filepath.Join(t.TempDir(), "symbolized.pprof")
+	err = symbolizeCommand(context.Background(), []string{"-o", symbolized, "-source-map-prefix", buildDir + "=/src", p.memProfile, p.filePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof, err = readProfile(symbolized); err != nil {
+		t.Fatal(err)
+	}
+	assertFilenames(t, prof, "/src/internal/testdata/simple.c")
+
+	for _, flag := range []string{"-source-map-prefix=/src", "-source-map-prefix==/src", "-trim-path="} {
+		if err := runCommand(context.Background(), []string{flag, p.filePath}); err == nil {
+			t.Errorf("expected an error running with %s", flag)
+		}
+	}
+}
+
+func assertFilenames(t *testing.T, prof *profile.Profile, want string) {
+	t.Helper()
+	found := false
+	for _, fn := range prof.Function {
+		if fn.Filename != "" {
+			found = true
+			if fn.Filename != want {
+				t.Errorf("wrong file name of %s: want=%q got=%q", fn.Name, want, fn.Filename)
+			}
+		}
+	}
+	if !found {
+		t.Error("no function with a file name in the profile")
+	}
+}
+
+func TestDataCSimpleReport(t *testing.T) {
+	// The source of the module is in testdata, next to it.
+	sourcePaths, err := sourcePathOptions(nil, []string{"/home/thomas/src/github.com/stealthrocket/wzprof/internal/testdata=../../testdata/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1, sourcePaths: sourcePaths}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	execForProfile(t, &p, p.memProfile)
+
+	output := filepath.Join(t.TempDir(), "report.html")
+	if err := reportCommand(context.Background(), []string{"-html", output, "-sample_index", "alloc_objects", p.memProfile}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(b)
+	for _, want := range []string{
+		"<li>Sample type: alloc_objects</li>",
+		`title="func1: 1 (20.00%)"`,
+		`<td class="number">34</td><td>  func1();</td>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+
+	err = reportCommand(context.Background(), []string{"-html", output, "-sample_index", "cpu", p.memProfile})
+	if err == nil {
+		t.Error("expected an error reporting a sample type missing from the profile")
+	}
+}
+
+func TestDataCSimpleOrder(t *testing.T) {
+	p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	execForProfile(t, &p, p.memProfile)
+
+	output := filepath.Join(t.TempDir(), "order.txt")
+	if err := orderCommand(context.Background(), []string{"-o", output, "-sample_index", "alloc_space", p.memProfile, p.memProfile}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The allocations are made by malloc, and by calloc in the libc, the
+	// functions which call them follow by the size of their allocations. The
+	// symbol of main is __main_argc_argv, and func31 is inlined in func3.
+	want := "malloc calloc __main_void _start __main_argc_argv func3 func2 func21 func1"
+	if got := strings.Join(strings.Fields(string(b)), " "); got != want {
+		t.Errorf("wrong symbol order:\nwant: %s\ngot:  %s", want, got)
+	}
+
+	err = orderCommand(context.Background(), []string{"-sample_index", "cpu", p.memProfile})
+	if err == nil {
+		t.Error("expected an error ordering by a sample type missing from the profile")
+	}
+}
+
+func TestDataCSimpleTop(t *testing.T) {
+	p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	execForProfile(t, &p, p.memProfile)
+
+	output := filepath.Join(t.TempDir(), "top.txt")
+	if err := topCommand(context.Background(), []string{"-o", output, "-n", "2", "-sample_index", "alloc_space", p.memProfile}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of lines: want=3 got=%d\n%s", len(lines), b)
+	}
+	// The allocations are made by malloc, and by calloc in the libc.
+	for i, want := range []string{
+		"72B 90.00% 90.00% 72B 90.00% 4 malloc",
+		"8B 10.00% 100.00% 8B 10.00% 1 calloc",
+	} {
+		if got := strings.Join(strings.Fields(lines[i+1]), " "); got != want {
+			t.Errorf("wrong line %d:\nwant: %s\ngot:  %s", i+1, want, got)
+		}
+	}
+
+	err = topCommand(context.Background(), []string{"-sample_index", "cpu", p.memProfile})
+	if err == nil {
+		t.Error("expected an error ranking by a sample type missing from the profile")
+	}
+}
+
+func TestDiffFunctions(t *testing.T) {
+	tests := []struct {
+		name string
+		base map[string]int64
+		next map[string]int64
+		want []functionDelta
+	}{
 		{
-			[]int64{1, 10},
-			[]frame{
-				{"malloc", 0, false},
-				{"func1", 6, false},
-				{"main", 34, false},
-				{"__main_void", 0, false},
-				{"_start", 0, false},
+			name: "empty",
+			want: []functionDelta{},
+		},
+		{
+			name: "ordered by magnitude of the difference",
+			base: map[string]int64{"a": 10, "b": 50, "c": 5},
+			next: map[string]int64{"a": 30, "b": 20, "c": 5},
+			want: []functionDelta{
+				{name: "b", base: 50, next: 20},
+				{name: "a", base: 10, next: 30},
+				{name: "c", base: 5, next: 5},
 			},
 		},
 		{
-			[]int64{1, 20},
-			[]frame{
-				{"malloc", 0, false},
-				{"func21", 12, false},
-				{"func2", 18, false},
-				{"main", 35, false},
-				{"__main_void", 0, false},
-				{"_start", 0, false},
+			name: "functions missing from one of the profiles",
+			base: map[string]int64{"removed": 7},
+			next: map[string]int64{"added": 3},
+			want: []functionDelta{
+				{name: "removed", base: 7},
+				{name: "added", next: 3},
 			},
 		},
 		{
-			[]int64{1, 30},
-			[]frame{
-				{"malloc", 0, false},
-				{"func31", 29, true},
-				{"func3", 23, false},
-				{"main", 36, false},
-				{"__main_void", 0, false},
-				{"_start", 0, false},
+			name: "ties ordered by name",
+			base: map[string]int64{"b": 1, "a": 1},
+			next: map[string]int64{"a": 2, "b": 2},
+			want: []functionDelta{
+				{name: "a", base: 1, next: 2},
+				{name: "b", base: 1, next: 2},
 			},
 		},
-	})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := newDiffProfile(nil, 0, test.base)
+			next := newDiffProfile(nil, 0, test.next)
+			if got := diffFunctions(base, next, 1); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong deltas:\nwant: %+v\ngot:  %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeProfile(t *testing.T) {
+	wall := &profile.ValueType{Type: "wall", Unit: "nanoseconds"}
+	calls := &profile.ValueType{Type: "contentions", Unit: "count"}
+
+	tests := []struct {
+		name       string
+		basePeriod *profile.ValueType
+		base       int64
+		nextPeriod *profile.ValueType
+		next       int64
+		want       []int64
+		err        bool
+	}{
+		{
+			name: "sampled by function calls",
+			want: []int64{10, 10},
+		},
+		{
+			name:       "same period",
+			basePeriod: wall, base: 1e6,
+			nextPeriod: wall, next: 1e6,
+			want: []int64{10, 10e6},
+		},
+		{
+			name:       "longer period",
+			basePeriod: wall, base: 2e6,
+			nextPeriod: wall, next: 1e6,
+			want: []int64{20, 20e6},
+		},
+		{
+			name:       "shorter period",
+			basePeriod: wall, base: 1e6,
+			nextPeriod: wall, next: 5e6,
+			want: []int64{2, 10e6},
+		},
+		{
+			name:       "period in counts",
+			basePeriod: calls, base: 1,
+			nextPeriod: calls, next: 2,
+			want: []int64{10, 10},
+		},
+		{
+			name:       "incompatible period types",
+			basePeriod: wall, base: 1e6,
+			nextPeriod: calls, next: 1,
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := newDiffProfile(test.basePeriod, test.base, map[string]int64{"f": 10})
+			next := newDiffProfile(test.nextPeriod, test.next, nil)
+
+			err := normalizeProfile(base, next)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error normalizing the profiles")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := base.Sample[0].Value; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong values: want=%v got=%v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDiffOutput(t *testing.T) {
+	wall := &profile.ValueType{Type: "wall", Unit: "nanoseconds"}
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.pprof")
+	nextPath := filepath.Join(dir, "next.pprof")
+	output := filepath.Join(dir, "diff.pprof")
+
+	base := newDiffProfile(wall, 2e6, map[string]int64{"a": 20, "b": 5})
+	next := newDiffProfile(wall, 1e6, map[string]int64{"a": 50, "c": 5})
+	if err := wzprof.WriteProfile(basePath, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := wzprof.WriteProfile(nextPath, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := diffCommand(context.Background(), []string{"-o", output, basePath, nextPath}); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := readProfile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The samples of the base profile are negated, and its counts expressed at
+	// the period of the new profile.
+	got := make(map[string][]int64)
+	for _, s := range diff.Sample {
+		name := leafFunctionName(s)
+		if got[name] == nil {
+			got[name] = make([]int64, 2)
+		}
+		got[name][0] += s.Value[0]
+		got[name][1] += s.Value[1]
+	}
+	want := map[string][]int64{
+		"a": {50 - 40, 50e6 - 40e6},
+		"b": {-10, -10e6},
+		"c": {5, 5e6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong diff profile:\nwant: %v\ngot:  %v", want, got)
+	}
+
+	err = diffCommand(context.Background(), []string{"-sample_index", "alloc_space", basePath, nextPath})
+	if err == nil {
+		t.Error("expected an error comparing a sample type missing from the profiles")
+	}
+}
+
+// newDiffProfile returns a profile with the "samples" and "wall" sample types
+// and one sample per function, with the given count of samples each lasting
+// one period.
+func newDiffProfile(periodType *profile.ValueType, period int64, values map[string]int64) *profile.Profile {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "wall", Unit: "nanoseconds"},
+		},
+		PeriodType: periodType,
+		Period:     period,
+	}
+	weight := period
+	if weight == 0 {
+		weight = 1
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		id := uint64(i) + 1
+		fn := &profile.Function{ID: id, Name: name}
+		loc := &profile.Location{ID: id, Line: []profile.Line{{Function: fn}}}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{values[name], values[name] * weight},
+		})
+	}
+	return prof
+}
+
+func TestDataCSimpleProfdata(t *testing.T) {
+	p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	execForProfile(t, &p, p.memProfile)
+
+	output := filepath.Join(t.TempDir(), "simple.prof.txt")
+	if err := profdataCommand(context.Background(), []string{"-o", output, "-sample_index", "alloc_objects", p.memProfile}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// main is declared at line 32 and calls func1 and func2 at lines 34 and
+	// 35, func1 is declared at line 5 and calls malloc at line 6.
+	for _, want := range []string{
+		" 2: 1 func1:1\n",
+		" 3: 1 func2:1\n",
+		"func1:1:0\n 1: 1 malloc:1\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("sample profile does not contain %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestDataCSimpleMaxOverhead(t *testing.T) {
+	// The program completes before the sampling rates are first adjusted,
+	// all the calls are sampled.
+	p := program{filePath: "../../testdata/c/simple.wasm", maxOverhead: 0.02}
+	p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+
+	prof := execForProfile(t, &p, p.memProfile)
+	assertSamples(t, []string{"alloc_objects", "alloc_space"}, cSimpleSamples, prof)
+}
+
+func TestDataCSimpleInstructions(t *testing.T) {
+	instructions := func() map[string]int64 {
+		p := program{filePath: "../../testdata/c/simple.wasm", sampleRate: 1}
+		p.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+		p.instrProfile = filepath.Join(t.TempDir(), "instr.pprof")
+
+		// The locations of the instrumented module are those of the
+		// original one.
+		mem := execForProfile(t, &p, p.memProfile)
+		assertSamples(t, []string{"alloc_objects", "alloc_space"}, cSimpleSamples, mem)
+
+		instr, err := readProfile(p.instrProfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int64)
+		for _, s := range instr.Sample {
+			var stack []string
+			for _, loc := range s.Location {
+				for _, line := range loc.Line {
+					stack = append(stack, line.Function.Name)
+				}
+			}
+			counts[strings.Join(stack, ";")] += s.Value[1]
+		}
+		return counts
+	}
+
+	first, second := instructions(), instructions()
+	if len(first) == 0 {
+		t.Fatal("no instructions recorded")
+	}
+	for stack, n := range first {
+		if n != second[stack] {
+			t.Errorf("instruction counts differ between runs: %s: %d != %d", stack, n, second[stack])
+		}
+	}
+}
+
+func TestDataCSimpleOpcodes(t *testing.T) {
+	p := program{
+		filePath: "../../testdata/c/simple.wasm",
+		engine:   "interpreter",
+		focus:    regexp.MustCompile("^func3$"),
+		precise:  true,
+	}
+	p.opProfile = filepath.Join(t.TempDir(), "opcodes.pprof")
+
+	prof := execForProfile(t, &p, p.opProfile)
+	if len(prof.Sample) == 0 {
+		t.Fatal("no instructions recorded")
+	}
+	calls := make(map[int64]int64)
+	for _, s := range prof.Sample {
+		if len(s.Location) != 1 {
+			t.Fatalf("instructions must have a single location: %d", len(s.Location))
+		}
+		// func31 is inlined in func3, which is the only function counted.
+		lines := s.Location[0].Line
+		if name := lines[len(lines)-1].Function.Name; name != "func3" {
+			t.Errorf("instruction of %s recorded", name)
+		}
+		if s.Label["opcode"][0] == "call" {
+			calls[lines[0].Line] += s.Value[0]
+		}
+	}
+	// func31 calls malloc and printf once, at lines 23 and 24.
+	if calls[23] != 1 || calls[24] != 1 {
+		t.Errorf("wrong executions of the calls of func31: %v", calls)
+	}
+}
+
+func TestDataCSimpleBranches(t *testing.T) {
+	p := program{
+		filePath: "../../testdata/c/simple.wasm",
+		focus:    regexp.MustCompile("^func3$"),
+	}
+	p.branchProf = filepath.Join(t.TempDir(), "branches.pprof")
+
+	prof := execForProfile(t, &p, p.branchProf)
+	if len(prof.Sample) == 0 {
+		t.Fatal("no blocks recorded")
+	}
+	// func3 has no loops, each of its blocks is executed once.
+	for _, s := range prof.Sample {
+		if s.Value[0] > 1 {
+			t.Errorf("block at %#x executed %d times", s.Location[0].Address, s.Value[0])
+		}
+	}
+
+	output := filepath.Join(t.TempDir(), "report.html")
+	if err := reportCommand(context.Background(), []string{"-html", output, "-sample_index", "executions", "-wasm", p.filePath, p.branchProf}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<td>call ") {
+		t.Errorf("report does not list the instructions of func3:\n%s", b)
+	}
+}
+
+func TestDataCSimpleCoverage(t *testing.T) {
+	p := program{filePath: "../../testdata/c/simple.wasm"}
+	p.coverage = filepath.Join(t.TempDir(), "coverage.out")
+	p.lcov = filepath.Join(t.TempDir(), "lcov.info")
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	coverage, err := os.ReadFile(p.coverage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcov, err := os.ReadFile(p.lcov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// func1 is declared at line 5 and calls malloc at line 6, func31 is
+	// inlined in func3 and calls printf at line 24.
+	for _, want := range []string{"mode: count\n", "simple.c:6.1,7.0 1 1\n", "simple.c:24.1,25.0 1 1\n"} {
+		if !strings.Contains(string(coverage), want) {
+			t.Errorf("Go coverage profile does not contain %q:\n%s", want, coverage)
+		}
+	}
+	for _, want := range []string{"FN:5,func1\n", "FNDA:1,func1\n", "DA:6,1\n", "DA:24,1\n"} {
+		if !strings.Contains(string(lcov), want) {
+			t.Errorf("LCOV tracefile does not contain %q:\n%s", want, lcov)
+		}
+	}
+}
+
+func TestDataCSimpleTrace(t *testing.T) {
+	var trace bytes.Buffer
+	p := program{filePath: "../../testdata/c/simple.wasm"}
+	p.trace = &trace
+	p.traceMatch = regexp.MustCompile(`^(func2|func21|malloc)$`)
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	type call struct {
+		Depth    int      `json:"depth"`
+		Function string   `json:"function"`
+		Params   []uint32 `json:"params"`
+	}
+	var calls []call
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var c call
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			t.Fatalf("invalid trace line %q: %v", line, err)
+		}
+		// The C runtime allocates the buffer of stdout on the first call to
+		// printf, which is not part of the program.
+		if c.Function == "malloc" && c.Params[0]%10 != 0 {
+			continue
+		}
+		calls = append(calls, c)
+	}
+	// func21 is called by func2 and returns before it, func1 and func31 are
+	// not traced.
+	want := []call{
+		{0, "malloc", []uint32{10}},
+		{2, "malloc", []uint32{20}},
+		{1, "func21", []uint32{}},
+		{0, "func2", []uint32{}},
+		{0, "malloc", []uint32{30}},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("wrong calls traced:\nwant: %v\ngot:  %v", want, calls)
+	}
+}
+
+func TestDataCSimpleSpans(t *testing.T) {
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	var spans []span
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer server.Close()
+
+	p := program{filePath: "../../testdata/c/simple.wasm"}
+	p.spans = regexp.MustCompile(`^(main|func2|func21)$`)
+	p.spanExport = &wzprof.OTLPSpanExporter{URL: server.URL}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spans) != 3 {
+		t.Fatalf("wrong number of spans: want=3 got=%d", len(spans))
+	}
+	func21, func2, main := spans[0], spans[1], spans[2]
+	if func21.Name != "func21" || func2.Name != "func2" || main.Name != "main" {
+		t.Fatalf("wrong spans: %+v", spans)
+	}
+	if main.ParentSpanID != "" || func2.ParentSpanID != main.SpanID || func21.ParentSpanID != func2.SpanID {
+		t.Errorf("wrong parents of the spans: %+v", spans)
+	}
+	if func21.TraceID != main.TraceID || func2.TraceID != main.TraceID {
+		t.Errorf("spans not in the same trace: %+v", spans)
+	}
 }
 
 func TestCBench(t *testing.T) {
@@ -81,15 +805,71 @@ func TestCBench(t *testing.T) {
 	})
 }
 
+func TestSize(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "size.pprof")
+	err := sizeCommand(context.Background(), []string{"-top", "0", "-o", output, "../../testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof, err := readProfile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.SampleType) != 2 || prof.SampleType[1].Type != "code_bytes" {
+		t.Fatalf("wrong sample types: %v", prof.SampleType)
+	}
+
+	packages := make(map[string]int64)
+	for _, s := range prof.Sample {
+		for _, pkg := range s.Label["package"] {
+			packages[pkg] += s.Value[1]
+		}
+	}
+	for _, pkg := range []string{"core", "std", "alloc", "simple"} {
+		if packages[pkg] == 0 {
+			t.Errorf("no code attributed to the %s crate: %v", pkg, packages)
+		}
+	}
+}
+
+func TestCallGraph(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "callgraph.json")
+	err := callgraphCommand(context.Background(), []string{"-format", "json", "-o", output, "../../testdata/c/simple.wasm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g wzprof.CallGraph
+	if err := json.Unmarshal(b, &g); err != nil {
+		t.Fatal(err)
+	}
+
+	index := make(map[string]uint32)
+	for _, fn := range g.Functions {
+		index[fn.Name] = fn.Index
+	}
+	calls := make(map[[2]uint32]bool)
+	for _, c := range g.Calls {
+		calls[[2]uint32{c.Caller, c.Callee}] = true
+	}
+	if !calls[[2]uint32{index["main"], index["func1"]}] {
+		t.Errorf("missing call from main to func1")
+	}
+
+	if err := callgraphCommand(context.Background(), []string{"-format", "svg", "../../testdata/c/simple.wasm"}); err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+}
+
 func TestDataRustSimple(t *testing.T) {
 	p := program{filePath: "../../testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm"}
 	testMemoryProfiler(t, p, []sample{
 		{
 			[]int64{1, 120},
 			[]frame{
-				{"malloc", 0, false},                                                                        // malloc
-				{"std:sys:wasi:alloc:{impl#0}:alloc", 381, true},                                            // _ZN3std3sys4wasi5alloc81_$LT$impl$u20$core..alloc..global..GlobalAlloc$u20$for$u20$std..alloc..System$GT$5alloc17hf06d843ee28c936eE
-				{"std:alloc:__default_lib_allocator:__rdl_alloc", 14, false},                                // std:alloc:__default_lib_allocator:__rdl_alloc
 				{"__rust_alloc", 0, false},                                                                  // __rust_alloc
 				{"alloc:alloc:alloc_impl", 95, false},                                                       // _ZN5alloc5alloc6Global10alloc_impl17h579ac88351552cb7E
 				{"alloc:alloc:{impl#1}:allocate", 237, false},                                               // _ZN63_$LT$alloc..alloc..Global$u20$as$u20$core..alloc..Allocator$GT$8allocate17hcb9ff3e2ca003c84E
@@ -175,7 +955,7 @@ func TestGoTwoCalls(t *testing.T) {
 				{"runtime.mallocgc", 948, false},  // runtime.mallocgc
 				{"runtime.makeslice", 103, false}, // runtime.makeslice
 				{"main.myalloc1", 5, false},       // main.myalloc1
-				{"main.main", 18, true},           // main.main
+				{"main.intermediate", 18, true},   // main.intermediate
 				{"main.main", 25, false},          // main.main
 				{"runtime.main", 267, false},      // runtime.main
 				{"runtime.goexit", 401, false},    // runtime.goexit
@@ -212,7 +992,7 @@ func TestGoTwoCalls(t *testing.T) {
 				{"runtime.mallocgc", 948, false},  // runtime.mallocgc
 				{"runtime.makeslice", 103, false}, // runtime.makeslice
 				{"main.myalloc1", 5, false},       // main.myalloc1
-				{"main.main", 18, true},           // main.main
+				{"main.intermediate", 18, true},   // main.intermediate
 				{"main.main", 25, false},          // main.main
 				{"runtime.main", 267, false},      // runtime.main
 				{"runtime.goexit", 401, false},    // runtime.goexit
@@ -232,6 +1012,423 @@ func TestGoTwoCalls(t *testing.T) {
 	})
 }
 
+func TestGoPGO(t *testing.T) {
+	p := program{filePath: "../../testdata/go/twocalls.wasm", sampleRate: 1, pgo: true}
+	p.cpuProfile = filepath.Join(t.TempDir(), "default.pgo")
+	prof := execForProfile(t, &p, p.cpuProfile)
+
+	if len(prof.SampleType) != 1 || prof.SampleType[0].Type != "cpu" || prof.SampleType[0].Unit != "nanoseconds" {
+		t.Errorf("wrong sample types: %v", prof.SampleType)
+	}
+	// The go compiler matches the call sites of the profile with the names of
+	// the functions, including the inlined ones, and the offset of the lines
+	// from the start of the functions.
+	startLines := make(map[string]int64)
+	for _, fn := range prof.Function {
+		startLines[fn.Name] = fn.StartLine
+	}
+	for name, want := range map[string]int64{
+		"main.main":         21,
+		"main.intermediate": 17,
+		"main.myalloc1":     4,
+	} {
+		if got, ok := startLines[name]; !ok || got != want {
+			t.Errorf("wrong start line of %s: want=%d got=%d (found=%t)", name, want, got, ok)
+		}
+	}
+}
+
+func TestGoAddresses(t *testing.T) {
+	p := program{filePath: "../../testdata/go/twocalls.wasm", sampleRate: 1}
+	p.cpuProfile = filepath.Join(t.TempDir(), "cpu.pprof")
+	prof := execForProfile(t, &p, p.cpuProfile)
+
+	// Go frames are located at the start of their function in the code
+	// section, the frames inlined in a function share its address.
+	m := prof.Mapping[0]
+	addresses := make(map[string]uint64)
+	for _, loc := range prof.Location {
+		if loc.Address == 0 || loc.Address >= m.Limit {
+			t.Errorf("location out of the code section: %#x", loc.Address)
+		}
+		name := loc.Line[len(loc.Line)-1].Function.Name
+		if addr, ok := addresses[name]; ok && addr != loc.Address {
+			t.Errorf("locations of %s at different addresses: %#x, %#x", name, addr, loc.Address)
+		}
+		addresses[name] = loc.Address
+	}
+}
+
+func TestWatAddInvoke(t *testing.T) {
+	p := program{
+		filePath: "../../testdata/wat/add.wasm",
+		invoke:   "add",
+		args:     []string{"1", "2"},
+	}
+
+	testCpuProfiler(t, p, []sample{
+		{
+			[]int64{1},
+			[]frame{
+				{"add", 0, false},
+			},
+		},
+	})
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		typ  api.ValueType
+		arg  string
+		want uint64
+		err  bool
+	}{
+		{api.ValueTypeI32, "42", 42, false},
+		{api.ValueTypeI32, "-1", 0xffffffff, false},
+		{api.ValueTypeI32, "0xffffffff", 0xffffffff, false},
+		{api.ValueTypeI32, "0x100000000", 0, true},
+		{api.ValueTypeI32, "-0x80000001", 0, true},
+		{api.ValueTypeI64, "-2", 0xfffffffffffffffe, false},
+		{api.ValueTypeI64, "0xffffffffffffffff", 0xffffffffffffffff, false},
+		{api.ValueTypeI64, "abc", 0, true},
+		{api.ValueTypeF64, "1.5", api.EncodeF64(1.5), false},
+	}
+
+	for _, test := range tests {
+		params, err := parseParams([]api.ValueType{test.typ}, []string{test.arg})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s %s: expected an error", api.ValueTypeName(test.typ), test.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", api.ValueTypeName(test.typ), test.arg, err)
+		} else if params[0] != test.want {
+			t.Errorf("%s %s: want=%#x got=%#x", api.ValueTypeName(test.typ), test.arg, test.want, params[0])
+		}
+	}
+}
+
+func TestWatTrapCoreDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "core.wasm")
+	p := program{
+		filePath: "../../testdata/wat/trap.wasm",
+		coreDump: path,
+	}
+	if err := p.run(context.Background()); err == nil {
+		t.Fatal("the guest did not trap")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("\x00asm")) {
+		t.Errorf("coredump is not a wasm module")
+	}
+	if !bytes.Contains(b, []byte("corestack")) {
+		t.Errorf("coredump has no stack")
+	}
+}
+
+func TestWatExitCode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.pprof")
+	p := program{
+		filePath:   "../../testdata/wat/exit.wasm",
+		cpuProfile: path,
+		sampleRate: 1,
+	}
+	err := p.run(context.Background())
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("wrong exit of the guest: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("profile not written when the guest exited: %v", err)
+	}
+}
+
+func TestWatEnv(t *testing.T) {
+	// The guest exits with the size of its environment.
+	err := runCommand(context.Background(), []string{
+		"-quiet", "-env", "A=1", "-env", "B=22", "../../testdata/wat/env.wasm",
+	})
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("the guest did not exit: %v", err)
+	}
+	if size := len("A=1\x00B=22\x00"); exitErr.ExitCode() != uint32(size) {
+		t.Errorf("wrong size of the environment: want=%d got=%d", size, exitErr.ExitCode())
+	}
+
+	err = runCommand(context.Background(), []string{"-env", "A", "../../testdata/wat/env.wasm"})
+	if err == nil || !strings.Contains(err.Error(), "invalid environment variable") {
+		t.Errorf("expected an error for an environment variable without a value: %v", err)
+	}
+}
+
+func TestStdioRedirection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.txt")
+	p := program{
+		filePath: "../../testdata/c/simple.wasm",
+		stdout:   path,
+		stderr:   path,
+	}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "start\n") || !strings.HasSuffix(string(b), "end\n") {
+		t.Errorf("wrong output of the guest: %q", b)
+	}
+
+	p = program{
+		filePath: "../../testdata/c/simple.wasm",
+		stdin:    filepath.Join(t.TempDir(), "missing.txt"),
+	}
+	if err := p.run(context.Background()); err == nil {
+		t.Error("expected an error redirecting stdin from a missing file")
+	}
+}
+
+func TestWatServe(t *testing.T) {
+	// The address of the server is chosen before starting it so the test
+	// can send requests to it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	path := filepath.Join(t.TempDir(), "cpu.pprof")
+	p := program{
+		filePath:   "../../testdata/wat/wagi.wasm",
+		serveAddr:  addr,
+		cpuProfile: path,
+		sampleRate: 1,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.run(ctx) }()
+
+	get := func(path string) (*http.Response, error) {
+		var res *http.Response
+		var err error
+		for i := 0; i < 100; i++ {
+			if res, err = http.Get("http://" + addr + path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return res, err
+	}
+	for _, path := range []string{"/a", "/b", "/b"} {
+		res, err := get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/plain" || string(body) != "hello\n" {
+			t.Errorf("wrong response for %s: %s %q %q", path, res.Status, res.Header, body)
+		}
+	}
+
+	// The samples of requests with a trace context are labeled with it.
+	req, err := http.NewRequest("GET", "http://"+addr+"/c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	prof, err := readProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := make(map[string]int64)
+	for _, s := range prof.Sample {
+		if s.Label["http_method"][0] != "GET" {
+			t.Errorf("wrong method label: %v", s.Label)
+		}
+		traced := s.Label["http_path"][0] == "/c"
+		if hasTrace := len(s.Label["trace_id"]) == 1 && s.Label["trace_id"][0] == "4bf92f3577b34da6a3ce929d0e0e4736" && s.Label["span_id"][0] == "00f067aa0ba902b7"; hasTrace != traced {
+			t.Errorf("wrong trace labels: %v", s.Label)
+		}
+		calls[s.Label["http_path"][0]] += s.Value[0]
+	}
+	if calls["/a"] == 0 || calls["/b"] != 2*calls["/a"] || calls["/c"] != calls["/a"] {
+		t.Errorf("wrong calls by path: %v", calls)
+	}
+}
+
+func TestWriteCGIResponse(t *testing.T) {
+	tests := []struct {
+		output string
+		status int
+		header string
+		body   string
+	}{
+		{"Content-Type: text/plain\n\nhello", 200, "text/plain", "hello"},
+		{"Content-Type: text/html\r\nStatus: 404 Not Found\r\n\r\n", 404, "text/html", ""},
+		{"Location: /b\n\n", 302, "", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if err := writeCGIResponse(w, strings.NewReader(test.output)); err != nil {
+			t.Errorf("%q: %v", test.output, err)
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Content-Type") != test.header || w.Body.String() != test.body {
+			t.Errorf("%q: wrong response: %d %q %q", test.output, w.Code, w.Header(), w.Body)
+		}
+		if w.Header().Get("Status") != "" {
+			t.Errorf("%q: status header not removed", test.output)
+		}
+	}
+
+	for _, output := range []string{"hello", "Status: ok\n\n"} {
+		if err := writeCGIResponse(httptest.NewRecorder(), strings.NewReader(output)); err == nil {
+			t.Errorf("%q: expected an error", output)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	// The socket is opened when the module is instantiated, which fails if
+	// the address is already in use.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p := program{filePath: "../../testdata/c/simple.wasm", listen: []string{"tcp:" + l.Addr().String()}}
+	if err := p.run(context.Background()); err == nil {
+		t.Error("expected an error listening on an address in use")
+	}
+	p.listen = []string{"tcp:127.0.0.1:0"}
+	if err := p.run(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"tcp:0.0.0.0:8080", "0.0.0.0", 8080},
+		{"tcp::8080", "", 8080},
+		{"tcp:[::1]:80", "::1", 80},
+	}
+	for _, test := range tests {
+		host, port, err := parseListenAddr(test.addr)
+		if err != nil || host != test.host || port != test.port {
+			t.Errorf("%s: want=%s %d got=%s %d (%v)", test.addr, test.host, test.port, host, port, err)
+		}
+	}
+
+	for _, addr := range []string{"0.0.0.0:8080", "udp:0.0.0.0:53", "tcp:8080", "tcp:localhost:http", "tcp:localhost:65536"} {
+		if _, _, err := parseListenAddr(addr); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+	}
+}
+
+func TestInuseSeries(t *testing.T) {
+	p := program{
+		filePath:    "../../testdata/c/simple.wasm",
+		sampleRate:  1,
+		inuseSeries: filepath.Join(t.TempDir(), "inuse.pprof"),
+		inuseRate:   time.Hour,
+		format:      "pprof",
+	}
+	prof := execForProfile(t, &p, p.inuseSeries)
+
+	if len(prof.SampleType) != 2 || prof.SampleType[0].Type != "inuse_objects" || prof.SampleType[1].Type != "inuse_space" {
+		t.Fatalf("wrong sample types: %v", prof.SampleType)
+	}
+	if len(prof.Sample) == 0 {
+		t.Fatal("no memory in use")
+	}
+	// The program exits before the first interval, only the snapshot taken
+	// when it exited is recorded.
+	for _, s := range prof.Sample {
+		if at := s.Label["time"]; len(at) != 1 || !strings.HasSuffix(at[0], "s") {
+			t.Errorf("wrong time label: %v", s.Label)
+		}
+	}
+}
+
+func TestParseDropThreshold(t *testing.T) {
+	tests := []struct {
+		s        string
+		value    int64
+		fraction float64
+	}{
+		{"", 0, 0},
+		{"4096", 4096, 0},
+		{"1%", 0, 0.01},
+		{"0.5%", 0, 0.005},
+	}
+	for _, test := range tests {
+		value, fraction, err := parseDropThreshold(test.s)
+		if err != nil || value != test.value || fraction != test.fraction {
+			t.Errorf("%q: want=%d %g got=%d %g (%v)", test.s, test.value, test.fraction, value, fraction, err)
+		}
+	}
+
+	for _, s := range []string{"-1", "1.5", "x%", "101%"} {
+		if _, _, err := parseDropThreshold(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	dir := t.TempDir()
+	run := func(prog program) {
+		t.Helper()
+		prog.filePath = "../../testdata/c/simple.wasm"
+		prog.sampleRate = 1
+		prog.compileCache = dir
+		if err := prog.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Runs with the same profilers share the compiled module, the ones with
+	// other profilers hook other functions and are cached separately.
+	for i := 0; i < 2; i++ {
+		run(program{memProfile: filepath.Join(t.TempDir(), "mem.pprof")})
+	}
+	run(program{cpuProfile: filepath.Join(t.TempDir(), "cpu.pprof")})
+	run(program{cpuProfile: filepath.Join(t.TempDir(), "cpu.pprof"), focus: regexp.MustCompile("^func")})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("wrong number of compilation caches: want=3 got=%d", len(entries))
+	}
+}
+
 func testCpuProfiler(t *testing.T, prog program, expectedSamples []sample) {
 	prog.sampleRate = 1
 	prog.cpuProfile = filepath.Join(t.TempDir(), "cpu.pprof")
@@ -355,3 +1552,171 @@ func printSamples(samples []*profile.Sample) {
 	}
 }
 */
+
+func TestRotationPath(t *testing.T) {
+	now := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		template string
+		paths    []string
+	}{
+		{"cpu.pprof", []string{"cpu-20230102T150405Z.pprof", "cpu-20230102T150405Z.pprof"}},
+		{"cpu-{seq}.pprof", []string{"cpu-1.pprof", "cpu-2.pprof"}},
+		{"{time}/mem-{seq}", []string{"20230102T150405Z/mem-1", "20230102T150405Z/mem-2"}},
+	}
+	for _, test := range tests {
+		r := &rotation{template: test.template}
+		for _, want := range test.paths {
+			if got := r.path(now); got != want {
+				t.Errorf("%s: want=%q got=%q", test.template, want, got)
+			}
+		}
+	}
+}
+
+func TestS3Exporter(t *testing.T) {
+	t.Setenv("GITHUB_SHA", "0123abc")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	tests := []struct {
+		url    string
+		bucket string
+		key    string
+	}{
+		{"s3://profiles", "profiles", "{module}/{time}-{profile}.pprof"},
+		{"s3://profiles/ci/", "profiles", "ci/{module}/{time}-{profile}.pprof"},
+		{"s3://profiles/{sha}/{profile}.pprof", "profiles", "{sha}/{profile}.pprof"},
+	}
+	for _, test := range tests {
+		exporter, err := newExporter(test.url, "parca", nil, "testdata/app.wasm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := exporter.(*wzprof.S3Exporter)
+		if !ok {
+			t.Fatalf("%s: wrong exporter: %T", test.url, exporter)
+		}
+		if e.Bucket != test.bucket || e.Key != test.key {
+			t.Errorf("%s: wrong location: bucket=%q key=%q", test.url, e.Bucket, e.Key)
+		}
+		if e.Module != "app" || e.Commit != "0123abc" || e.Region != "eu-west-1" {
+			t.Errorf("%s: wrong configuration: module=%q commit=%q region=%q", test.url, e.Module, e.Commit, e.Region)
+		}
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	budgets, err := parseBudgets(strings.NewReader(`# budgets of the program
+main.parse:
+  instructions: 1.2M
+  time: 20ms # including the children
+"encoding/json.Unmarshal":
+  alloc: 4MiB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []budget{
+		{"main.parse", "instructions", 1200000},
+		{"main.parse", "time", int64(20 * time.Millisecond)},
+		{"encoding/json.Unmarshal", "alloc", 4 << 20},
+	}
+	if len(budgets) != len(want) {
+		t.Fatalf("wrong number of budgets: %v", budgets)
+	}
+	for i := range want {
+		if budgets[i] != want[i] {
+			t.Errorf("wrong budget %d: want=%v got=%v", i, want[i], budgets[i])
+		}
+	}
+
+	for _, invalid := range []string{
+		"main: 10\n",
+		"  alloc: 10B\n",
+		"main:\n  memory: 10B\n",
+		"main:\n  time: 10\n",
+	} {
+		if _, err := parseBudgets(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestCheckBudgets(t *testing.T) {
+	check := func(budgets string) error {
+		path := filepath.Join(t.TempDir(), "budgets.yaml")
+		if err := os.WriteFile(path, []byte(budgets), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return checkCommand(context.Background(), []string{"-budget", path, "../../testdata/c/simple.wasm"})
+	}
+
+	// The program allocates 60 bytes: 10 in func1, 20 in func21 and 30 in
+	// func3 where func31 is inlined.
+	if err := check("main:\n  alloc: 60B\nfunc2:\n  alloc: 20B\n"); err != nil {
+		t.Errorf("budgets exceeded: %v", err)
+	}
+	if err := check("main:\n  alloc: 60B\nfunc3:\n  alloc: 29B\n"); err == nil {
+		t.Error("expected an error for a budget exceeded")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	defer wzprof.SetLogger(nil)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		args  []string
+		level slog.Level
+	}{
+		{nil, slog.LevelWarn},
+		{[]string{"-v"}, slog.LevelInfo},
+		{[]string{"-verbose"}, slog.LevelInfo},
+		{[]string{"-vv"}, slog.LevelDebug},
+		{[]string{"-quiet"}, slog.LevelError},
+	} {
+		var diag diagnostics
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		diag.register(flags)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := diag.setup(); err != nil {
+			t.Fatal(err)
+		}
+		logger := wzprof.Logger()
+		if !logger.Enabled(context.Background(), test.level) || logger.Enabled(context.Background(), test.level-1) {
+			t.Errorf("wrong level of diagnostics with %v: want=%s", test.args, test.level)
+		}
+		if enabled := log.Writer() != io.Discard; enabled != (test.level <= slog.LevelInfo) {
+			t.Errorf("wrong output of progress messages with %v: %v", test.args, enabled)
+		}
+	}
+
+	diag := diagnostics{verbose: true, quiet: true}
+	if err := diag.setup(); err == nil {
+		t.Error("expected an error combining -quiet and -v")
+	}
+}
+
+func TestWriteProfileFile(t *testing.T) {
+	prof := &profile.Profile{SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}}}
+	path := filepath.Join(t.TempDir(), "profile.folded")
+
+	if err := writeProfileFile(path, prof, func(w io.Writer, _ *profile.Profile) error {
+		_, err := io.WriteString(w, "main 1\n")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "main 1\n" {
+		t.Errorf("wrong content of profile file: %q (%v)", b, err)
+	}
+
+	errWrite := errors.New("write failed")
+	if err := writeProfileFile(path, prof, func(io.Writer, *profile.Profile) error { return errWrite }); err != errWrite {
+		t.Errorf("wrong error of failed write: want=%v got=%v", errWrite, err)
+	}
+	if err := writeProfileFile(filepath.Join(path, "missing"), prof, wzprof.WriteFolded); err == nil {
+		t.Error("no error creating a file in a missing directory")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func mergeCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof merge -o <merged.pprof> <profile.pprof>...\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the merged profile to the specified file.")
+	flags.Parse(args)
+
+	if *output == "" {
+		flags.Usage()
+		return fmt.Errorf("missing output file")
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("expected at least one profile to merge")
+	}
+
+	profiles := make([]*profile.Profile, flags.NArg())
+	for i, path := range flags.Args() {
+		p, err := readProfile(path)
+		if err != nil {
+			return err
+		}
+		profiles[i] = p
+	}
+
+	merged, err := wzprof.MergeProfiles(profiles...)
+	if err != nil {
+		return fmt.Errorf("merging profiles: %w", err)
+	}
+	return wzprof.WriteProfile(*output, merged)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func orderCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("order", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof order [flags] <profile.pprof>...\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the symbol ordering file to the specified file instead of stdout.")
+	sampleIndex := flags.String("sample_index", "", "Name of the sample type to order the functions by (default to the last sample type).")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("expected at least one profile to order the functions of")
+	}
+
+	// The profiles of multiple runs are merged, so the order reflects a
+	// representative workload rather than a single run.
+	profiles := make([]*profile.Profile, flags.NArg())
+	for i, path := range flags.Args() {
+		p, err := readProfile(path)
+		if err != nil {
+			return err
+		}
+		profiles[i] = p
+	}
+	prof, err := wzprof.MergeProfiles(profiles...)
+	if err != nil {
+		return fmt.Errorf("merging profiles: %w", err)
+	}
+	if *sampleIndex != "" {
+		if _, err := wzprof.SampleTypeIndex(prof, *sampleIndex); err != nil {
+			return err
+		}
+		prof.DefaultSampleType = *sampleIndex
+	}
+
+	if *output == "" {
+		return wzprof.WriteSymbolOrder(os.Stdout, prof)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := wzprof.WriteSymbolOrder(f, prof); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func profdataCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("profdata", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof profdata [flags] <profile.pprof>...\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the LLVM sample profile to the specified file instead of stdout.")
+	sampleIndex := flags.String("sample_index", "", "Name of the sample type to export (default to the call counts of CPU profiles, or the last sample type).")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("expected at least one profile to export")
+	}
+
+	profiles := make([]*profile.Profile, flags.NArg())
+	for i, path := range flags.Args() {
+		p, err := readProfile(path)
+		if err != nil {
+			return err
+		}
+		profiles[i] = p
+	}
+	prof, err := wzprof.MergeProfiles(profiles...)
+	if err != nil {
+		return fmt.Errorf("merging profiles: %w", err)
+	}
+	switch {
+	case *sampleIndex != "":
+		if _, err := wzprof.SampleTypeIndex(prof, *sampleIndex); err != nil {
+			return err
+		}
+		prof.DefaultSampleType = *sampleIndex
+	default:
+		// LLVM expects counts, the samples of the CPU profile are the
+		// number of calls of the functions.
+		if _, err := wzprof.SampleTypeIndex(prof, "samples"); err == nil {
+			prof.DefaultSampleType = "samples"
+		}
+	}
+
+	if *output == "" {
+		return wzprof.WriteLLVMSampleProfile(os.Stdout, prof)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := wzprof.WriteLLVMSampleProfile(f, prof); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func reportCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof report -html <out.html> [flags] <profile.pprof>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("html", "", "Write an HTML report with a flame graph and the annotated source of the top functions to the specified file.")
+	sampleIndex := flags.String("sample_index", "", "Name of the sample type to report (default to the last sample type).")
+	limit := flags.Int("n", 10, "Maximum number of functions to annotate the source of (0 for no limit).")
+	wasmPath := flags.String("wasm", "", "List the instructions of the top functions of this wasm module, annotated with the values of the profile (e.g. of -branchprofile).")
+	flags.Parse(args)
+
+	if *output == "" {
+		flags.Usage()
+		return fmt.Errorf("missing output file")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a profile to report")
+	}
+
+	prof, err := readProfile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *sampleIndex != "" {
+		if _, err := wzprof.SampleTypeIndex(prof, *sampleIndex); err != nil {
+			return err
+		}
+		prof.DefaultSampleType = *sampleIndex
+	}
+
+	var options []wzprof.ReportOption
+	if *wasmPath != "" {
+		wasm, err := os.ReadFile(*wasmPath)
+		if err != nil {
+			return fmt.Errorf("reading wasm module: %w", err)
+		}
+		options = append(options, wzprof.ReportDisassembly(wasm))
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	// The source files are read from the paths of the DWARF information,
+	// which may be remapped when collecting the profile with -trim-path or
+	// -source-map-prefix; relative paths are relative to the current
+	// directory.
+	if err := wzprof.WriteHTMLReport(w, prof, *limit, os.ReadFile, options...); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
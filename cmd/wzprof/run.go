@@ -0,0 +1,1801 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/sock"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+const defaultSampleRate = 1.0 / 19
+
+type program struct {
+	filePath     string
+	args         []string
+	serveAddr    string
+	pprofAddr    string
+	cpuProfile   string
+	pgo          bool
+	memProfile   string
+	wallProfile  string
+	blockProfile string
+	ioProfile    string
+	sysProfile   string
+	gcProfile    string
+	instrProfile string
+	opProfile    string
+	branchProf   string
+	coverage     string
+	lcov         string
+	growProfile  string
+	growTimeline string
+	stackProfile string
+	coreDump     string
+	timeline     string
+	timelineMax  int
+	trace        io.Writer
+	traceMatch   *regexp.Regexp
+	spans        *regexp.Regexp
+	spanExport   *wzprof.OTLPSpanExporter
+	format       string
+	dropBelow    int64
+	dropFraction float64
+	sampleRate   float64
+	hostProfile  bool
+	hostTime     bool
+	inuseMemory  bool
+	memGrowth    bool
+	sizeClasses  bool
+	timeLabels   time.Duration
+	demangle     bool
+	debugInfo    string
+	sourcePaths  []wzprof.ProfilingOption
+	precise      bool
+	raw          bool
+	mounts       []string
+	listen       []string
+	env          []string
+	invoke       string
+	top          int
+	exporter     wzprof.Exporter
+	cpuInterval  time.Duration
+	memInterval  time.Duration
+	inuseSeries  string
+	inuseRate    time.Duration
+	flight       string
+	flightWindow time.Duration
+	memStats     string
+	memStatsRate time.Duration
+	maxOverhead  float64
+	focus        *regexp.Regexp
+	ignore       *regexp.Regexp
+	stdin        string
+	stdout       string
+	stderr       string
+	compileCache string
+	engine       string
+}
+
+// interpreter returns whether the module is run by the interpreter of wazero,
+// which NewRuntimeConfig selects on the platforms where the compiler is not
+// supported.
+func (prog *program) interpreter() bool {
+	switch prog.engine {
+	case "interpreter":
+		return true
+	case "compiler":
+		return false
+	}
+	switch runtime.GOOS {
+	case "darwin", "windows", "linux", "freebsd":
+		return runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64"
+	default:
+		return true
+	}
+}
+
+func (prog *program) run(ctx context.Context) error {
+	wasmName := filepath.Base(prog.filePath)
+	wasmCode, err := os.ReadFile(prog.filePath)
+	if err != nil {
+		return fmt.Errorf("reading wasm module: %w", err)
+	}
+
+	options := []wzprof.ProfilingOption{
+		wzprof.Demangle(prog.demangle),
+		wzprof.Symbolize(!prog.raw),
+		wzprof.ModulePath(prog.filePath),
+		wzprof.Metrics(prog.pprofAddr != ""),
+		wzprof.TimeLabels(prog.timeLabels),
+		wzprof.PreciseLocations(prog.precise),
+		wzprof.Interpreter(prog.interpreter()),
+	}
+	options = append(options, prog.sourcePaths...)
+	if prog.focus != nil {
+		options = append(options, wzprof.Focus(prog.focus))
+	}
+	if prog.ignore != nil {
+		options = append(options, wzprof.Ignore(prog.ignore))
+	}
+	if prog.debugInfo != "" {
+		debugInfo, err := os.ReadFile(prog.debugInfo)
+		if err != nil {
+			return fmt.Errorf("reading debug info: %w", err)
+		}
+		options = append(options, wzprof.DebugInfo(debugInfo))
+	}
+
+	p := wzprof.ProfilingFor(wasmCode, options...)
+
+	switch {
+	case prog.opProfile != "" || prog.branchProf != "" || prog.coverage != "" || prog.lcov != "":
+		// Counting the executions of instructions also counts the number of
+		// instructions executed, which the instruction profiler records.
+		progress.Printf("instrumenting wasm module to count the executions of instructions")
+		if wasmCode, err = p.CountOpcodes(); err != nil {
+			return fmt.Errorf("instrumenting wasm module: %w", err)
+		}
+	case prog.instrProfile != "":
+		// The module is instrumented to count the instructions it executes,
+		// the profiles still refer to the original module.
+		progress.Printf("instrumenting wasm module to count instructions")
+		if wasmCode, err = p.CountInstructions(); err != nil {
+			return fmt.Errorf("instrumenting wasm module: %w", err)
+		}
+	}
+
+	cpu := p.CPUProfiler(wzprof.HostTime(prog.hostTime))
+	mem := p.MemoryProfiler(wzprof.InuseMemory(prog.inuseMemory || prog.inuseSeries != ""), wzprof.MemoryGrowth(prog.memGrowth), wzprof.AllocSizeClasses(prog.sizeClasses))
+	wall := p.WallClockProfiler()
+	block := p.BlockProfiler()
+	io := p.IOProfiler()
+	sys := p.SyscallProfiler()
+	goroutine := p.GoroutineProfiler()
+	gc := p.GCProfiler()
+	instr := p.InstructionProfiler()
+	opcodes := p.OpcodeProfiler()
+	branches := p.BranchProfiler()
+	coverage := p.CoverageProfiler()
+	stack := p.StackProfiler()
+	grow := p.GrowProfiler(wzprof.GrowTimeline(prog.growTimeline != ""))
+	memStats := p.MemStatsCollector()
+	timeline := p.Timeline(wzprof.TimelineLimit(prog.timelineMax))
+	tracer := p.CallTracer(prog.trace, wzprof.TraceMatch(prog.traceMatch))
+	spans := p.SpanRecorder(wzprof.SpanMatch(prog.spans))
+	core := p.CoreDumper()
+	flight := p.FlightRecorder(
+		wzprof.FlightWindow(prog.flightWindow),
+		wzprof.FlightCPUOptions(wzprof.HostTime(prog.hostTime)),
+	)
+
+	var listeners []experimental.FunctionListenerFactory
+	// When a top report is requested or profiles are pushed to a remote
+	// backend without specifying which profiles to collect, a CPU profile is
+	// collected.
+	defaultCPU := (prog.top > 0 || prog.exporter != nil) && prog.cpuProfile == "" && prog.memProfile == "" && prog.wallProfile == "" && prog.blockProfile == "" && prog.ioProfile == "" && prog.sysProfile == "" && prog.gcProfile == "" && prog.instrProfile == "" && prog.opProfile == "" && prog.branchProf == "" && prog.growProfile == "" && prog.stackProfile == ""
+
+	if prog.cpuProfile != "" || prog.pprofAddr != "" || defaultCPU {
+		progress.Printf("enabling cpu profiler")
+		listeners = append(listeners, cpu)
+	}
+	if prog.memProfile != "" || prog.inuseSeries != "" || prog.pprofAddr != "" {
+		progress.Printf("enabling memory profiler")
+		listeners = append(listeners, mem)
+	}
+	if prog.wallProfile != "" {
+		progress.Printf("enabling wall-clock profiler")
+		listeners = append(listeners, wall)
+	}
+	if prog.blockProfile != "" || prog.pprofAddr != "" {
+		progress.Printf("enabling block profiler")
+		listeners = append(listeners, block)
+	}
+	if prog.ioProfile != "" || prog.pprofAddr != "" {
+		progress.Printf("enabling i/o profiler")
+		listeners = append(listeners, io)
+	}
+	if prog.sysProfile != "" || prog.pprofAddr != "" {
+		progress.Printf("enabling syscall profiler")
+		listeners = append(listeners, sys)
+	}
+	if prog.stackProfile != "" {
+		progress.Printf("enabling stack profiler")
+		listeners = append(listeners, stack)
+	}
+	if prog.flight != "" {
+		progress.Printf("enabling flight recorder")
+		listeners = append(listeners, flight)
+	}
+	// The types of the factories identify the profilers, and the wrappers of
+	// the sampled ones are created below.
+	listenerTypes := make([]string, 0, len(listeners))
+	for _, lstn := range listeners {
+		listenerTypes = append(listenerTypes, fmt.Sprintf("%T", lstn))
+	}
+	sampledListeners := len(listeners)
+
+	// With adaptive sampling, the sample rate used to scale the values of
+	// profiles changes over time.
+	sampleRate := func() float64 { return prog.sampleRate }
+	if prog.maxOverhead > 0 {
+		progress.Printf("configuring adaptive sampling to %.2g%% of overhead", 100*prog.maxOverhead)
+		sampler := wzprof.NewAdaptiveSampler(prog.maxOverhead)
+		for i, lstn := range listeners {
+			listeners[i] = sampler.Sample(lstn)
+		}
+		sampleRate = sampler.SampleRate
+	} else if prog.sampleRate < 1 {
+		progress.Printf("configuring sampling rate to %.2g%%", prog.sampleRate)
+		for i, lstn := range listeners {
+			listeners[i] = wzprof.Sample(prog.sampleRate, lstn)
+		}
+	}
+	if prog.pprofAddr != "" {
+		// The goroutine profile captures the calls in progress, which would
+		// be missing if they were not sampled.
+		progress.Printf("enabling goroutine profiler")
+		listeners = append(listeners, goroutine)
+	}
+	if prog.gcProfile != "" || prog.pprofAddr != "" {
+		// Garbage collections are rare, the GC profiler only instruments the
+		// runtime functions which run them and does not need to be sampled.
+		progress.Printf("enabling gc profiler")
+		listeners = append(listeners, gc)
+	}
+	if prog.instrProfile != "" {
+		// Instruction counts do not vary between runs, they are recorded for
+		// all the calls so the profiles can be compared exactly.
+		progress.Printf("enabling instruction profiler")
+		listeners = append(listeners, instr)
+	}
+	if prog.opProfile != "" {
+		progress.Printf("enabling opcode profiler")
+		listeners = append(listeners, opcodes)
+	}
+	if prog.branchProf != "" {
+		progress.Printf("enabling branch profiler")
+		listeners = append(listeners, branches)
+	}
+	if prog.coverage != "" || prog.lcov != "" {
+		progress.Printf("enabling code coverage")
+		listeners = append(listeners, coverage)
+	}
+	if prog.growProfile != "" || prog.growTimeline != "" {
+		// The growth of the memory is detected between calls, they must all
+		// be observed to attribute it to the right stacks.
+		progress.Printf("enabling memory growth profiler")
+		listeners = append(listeners, grow)
+	}
+	if prog.memStats != "" || prog.pprofAddr != "" {
+		progress.Printf("enabling go memstats collector")
+		listeners = append(listeners, memStats)
+	}
+	if prog.timeline != "" {
+		// The timeline is not sampled, it records the exact sequence of
+		// function calls.
+		progress.Printf("enabling timeline")
+		listeners = append(listeners, timeline)
+	}
+	if prog.trace != nil {
+		progress.Printf("enabling call tracer")
+		listeners = append(listeners, tracer)
+	}
+	if prog.spanExport != nil {
+		progress.Printf("enabling span recorder")
+		listeners = append(listeners, spans)
+	}
+	if prog.coreDump != "" {
+		// The coredump holds the whole stack of the guest, all the calls
+		// must be tracked.
+		progress.Printf("enabling coredump on trap")
+		listeners = append(listeners, core)
+	}
+
+	ctx = context.WithValue(ctx,
+		experimental.FunctionListenerFactoryKey{},
+		experimental.MultiFunctionListenerFactory(listeners...),
+	)
+
+	var config wazero.RuntimeConfig
+	switch prog.engine {
+	case "interpreter":
+		config = wazero.NewRuntimeConfigInterpreter()
+	case "compiler":
+		config = wazero.NewRuntimeConfigCompiler()
+	default:
+		config = wazero.NewRuntimeConfig()
+	}
+	config = config.
+		WithDebugInfoEnabled(true).
+		WithCustomSections(true)
+	if prog.compileCache != "" {
+		for _, lstn := range listeners[sampledListeners:] {
+			listenerTypes = append(listenerTypes, fmt.Sprintf("%T", lstn))
+		}
+		dir := filepath.Join(prog.compileCache, prog.compileCacheKey(listenerTypes))
+		progress.Printf("using compilation cache at %s", dir)
+		cache, err := wazero.NewCompilationCacheWithDir(dir)
+		if err != nil {
+			return fmt.Errorf("creating compilation cache: %w", err)
+		}
+		defer cache.Close(ctx)
+		config = config.WithCompilationCache(cache)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	progress.Printf("compiling wasm module %s", prog.filePath)
+	compiledModule, err := runtime.CompileModule(ctx, wasmCode)
+	if err != nil {
+		return fmt.Errorf("compiling wasm module: %w", err)
+	}
+	err = p.Prepare(compiledModule)
+	if err != nil {
+		return fmt.Errorf("preparing wasm module: %w", err)
+	}
+	if prog.compileCache != "" && hasCustomSection(compiledModule, ".debug_line") {
+		// wazero does not persist the mapping of the compiled code to the
+		// wasm code, which locates the DWARF information of functions.
+		wzprof.Logger().Warn("line numbers and inlined functions are not symbolized when the module is loaded from the compilation cache")
+	}
+
+	if prog.pprofAddr != "" {
+		u := &url.URL{Scheme: "http", Host: prog.pprofAddr, Path: "/debug/pprof"}
+		progress.Printf("starting prrof http sever at %s", u)
+
+		server := http.NewServeMux()
+		profilers := []wzprof.Profiler{cpu, mem, block, io, sys, goroutine, gc}
+		if prog.flight != "" {
+			profilers = append(profilers, flight)
+		}
+		if prog.instrProfile != "" {
+			profilers = append(profilers, instr)
+		}
+		if prog.opProfile != "" {
+			profilers = append(profilers, opcodes)
+		}
+		if prog.branchProf != "" {
+			profilers = append(profilers, branches)
+		}
+		if prog.growProfile != "" || prog.growTimeline != "" {
+			profilers = append(profilers, grow)
+		}
+		if prog.stackProfile != "" {
+			profilers = append(profilers, stack)
+		}
+		cmdline := append([]string{wasmName}, prog.args...)
+		server.Handle("/debug/pprof/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.Handler(sampleRate(), cmdline, profilers...).ServeHTTP(w, r)
+		}))
+		server.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.MetricsHandler(profilers...).ServeHTTP(w, r)
+			memStats.NewHandler().ServeHTTP(w, r)
+		}))
+
+		go func() {
+			if err := http.ListenAndServe(prog.pprofAddr, server); err != nil {
+				stderr.Println(err)
+			}
+		}()
+	}
+
+	if prog.hostProfile {
+		if prog.cpuProfile != "" {
+			f, err := os.Create(prog.cpuProfile)
+			if err != nil {
+				return err
+			}
+			startCPUProfile(f)
+			defer stopCPUProfile(f)
+		}
+
+		if prog.memProfile != "" {
+			f, err := os.Create(prog.memProfile)
+			if err != nil {
+				return err
+			}
+			defer writeHeapProfile(f)
+		}
+	}
+
+	// Functions called to write the current profiles to disk when the process
+	// receives a dump signal, the guest keeps running.
+	var dumps []func(time.Time)
+
+	if prog.cpuProfile != "" || defaultCPU {
+		// With -pgo, the CPU profiles written are shaped for the Go compiler,
+		// the ones reported and exported are not.
+		writeCPUProfile := func(path string, p *profile.Profile) {
+			if prog.pgo {
+				pgo, err := wzprof.GoPGOProfile(p)
+				if err != nil {
+					stderr.Print("shaping profile for go build -pgo:", err)
+					return
+				}
+				p = pgo
+			}
+			prog.writeProfile("cpu", path, p)
+		}
+		cpu.StartProfile()
+		stopRotation := func() {}
+		rotation := &rotation{template: prog.cpuProfile}
+		if prog.cpuProfile != "" && !prog.hostProfile {
+			dumps = append(dumps, func(now time.Time) {
+				if p := cpu.SnapshotProfile(sampleRate()); p != nil {
+					writeCPUProfile(rotation.path(now), p)
+				}
+			})
+		}
+		if prog.cpuInterval > 0 {
+			stopRotation = every(prog.cpuInterval, func(now time.Time) {
+				p := cpu.StopProfile(sampleRate())
+				cpu.StartProfile()
+				writeCPUProfile(rotation.path(now), p)
+				prog.exportProfile("cpu", p)
+			})
+		}
+		defer func() {
+			stopRotation()
+			p := cpu.StopProfile(sampleRate())
+			if !prog.hostProfile {
+				if prog.cpuInterval > 0 {
+					writeCPUProfile(rotation.path(time.Now()), p)
+				} else if prog.cpuProfile != "" {
+					writeCPUProfile(prog.cpuProfile, p)
+				}
+				printTop("cpu", p, prog.top)
+				prog.exportProfile("cpu", p)
+			}
+		}()
+	}
+
+	if prog.wallProfile != "" {
+		wall.StartProfile()
+		defer func() {
+			p := wall.StopProfile()
+			prog.writeProfile("wall-clock", prog.wallProfile, p)
+			printTop("wall-clock", p, prog.top)
+			prog.exportProfile("wall", p)
+		}()
+	}
+
+	if prog.blockProfile != "" {
+		block.StartProfile()
+		defer func() {
+			p := block.StopProfile(sampleRate())
+			prog.writeProfile("block", prog.blockProfile, p)
+			printTop("block", p, prog.top)
+			prog.exportProfile("block", p)
+		}()
+	}
+
+	if prog.flight != "" {
+		flight.Start()
+		defer flight.Stop()
+
+		rotation := &rotation{template: prog.flight}
+		dumps = append(dumps, func(now time.Time) {
+			if p := flight.Dump(sampleRate()); p != nil {
+				prog.writeProfile("flight recorder", rotation.path(now), p)
+			}
+		})
+	}
+
+	if prog.timeline != "" {
+		timeline.StartTimeline()
+		defer func() {
+			timeline.StopTimeline()
+			writeTimeline(prog.timeline, timeline)
+		}()
+	}
+
+	if prog.trace != nil {
+		tracer.StartTrace()
+		defer func() {
+			if err := tracer.StopTrace(); err != nil {
+				stderr.Print("writing call trace: ", err)
+			}
+			progress.Printf("traced %d calls", tracer.Count())
+		}()
+	}
+
+	if prog.spanExport != nil {
+		// Spans are pushed in batches while the guest runs, so the traces of
+		// long-running programs show up and the spans are not retained.
+		spans.StartRecording()
+		stopExport := every(spanExportInterval, func(time.Time) {
+			prog.exportSpans(spans.Flush())
+		})
+		defer func() {
+			stopExport()
+			spans.StopRecording()
+			prog.exportSpans(spans.Flush())
+		}()
+	}
+
+	if prog.sysProfile != "" {
+		sys.StartProfile()
+		defer func() {
+			p := sys.StopProfile(sampleRate())
+			prog.writeProfile("syscall", prog.sysProfile, p)
+			printSyscallSummary(p)
+			prog.exportProfile("syscalls", p)
+		}()
+	}
+
+	if prog.gcProfile != "" {
+		gc.StartProfile()
+		defer func() {
+			p := gc.StopProfile(1)
+			prog.writeProfile("gc", prog.gcProfile, p)
+			printTop("gc", p, prog.top)
+			prog.exportProfile("gc", p)
+		}()
+	}
+
+	if prog.instrProfile != "" {
+		instr.StartProfile()
+		defer func() {
+			p := instr.StopProfile(1)
+			prog.writeProfile("instruction", prog.instrProfile, p)
+			printTop("instruction", p, prog.top)
+			prog.exportProfile("instructions", p)
+		}()
+	}
+
+	if prog.opProfile != "" {
+		opcodes.StartProfile()
+		defer func() {
+			p := opcodes.StopProfile()
+			prog.writeProfile("opcode", prog.opProfile, p)
+			printTop("opcode", p, prog.top)
+			prog.exportProfile("opcodes", p)
+		}()
+	}
+
+	if prog.branchProf != "" {
+		branches.StartProfile()
+		defer func() {
+			p := branches.StopProfile()
+			prog.writeProfile("branch", prog.branchProf, p)
+			printTop("branch", p, prog.top)
+			prog.exportProfile("branches", p)
+		}()
+	}
+
+	if prog.coverage != "" || prog.lcov != "" {
+		coverage.StartProfile()
+		defer func() {
+			c, err := coverage.StopProfile()
+			if err != nil {
+				stderr.Print("recording coverage: ", err)
+				return
+			}
+			if prog.coverage != "" {
+				writeCoverage(prog.coverage, "Go", c.WriteGoCoverProfile)
+			}
+			if prog.lcov != "" {
+				writeCoverage(prog.lcov, "LCOV", c.WriteLCOV)
+			}
+		}()
+	}
+
+	if prog.stackProfile != "" {
+		stack.StartProfile()
+		defer func() {
+			p := stack.StopProfile(sampleRate())
+			prog.writeProfile("stack", prog.stackProfile, p)
+			progress.Printf("guest stack high-water mark: %d bytes", stack.HighWaterMark())
+			printTop("stack", p, prog.top)
+			prog.exportProfile("stack", p)
+		}()
+	}
+
+	if prog.growProfile != "" || prog.growTimeline != "" {
+		grow.StartProfile()
+		defer func() {
+			p := grow.StopProfile()
+			if prog.growProfile != "" {
+				prog.writeProfile("memory growth", prog.growProfile, p)
+				printTop("memory growth", p, prog.top)
+				prog.exportProfile("grow", p)
+			}
+			if prog.growTimeline != "" {
+				writeGrowTimeline(prog.growTimeline, grow)
+			}
+		}()
+	}
+
+	if prog.memStats != "" {
+		stopCollect := every(prog.memStatsRate, func(time.Time) { memStats.Collect() })
+		defer func() {
+			stopCollect()
+			memStats.Collect()
+			writeMemStats(prog.memStats, memStats)
+		}()
+	}
+
+	if prog.ioProfile != "" {
+		defer func() {
+			p := io.NewProfile(sampleRate())
+			prog.writeProfile("i/o", prog.ioProfile, p)
+			printTop("i/o", p, prog.top)
+			prog.exportProfile("io", p)
+		}()
+	}
+
+	if prog.memProfile != "" {
+		stopRotation := func() {}
+		rotation := &rotation{template: prog.memProfile}
+		// The memory profile is cumulative. With -memprofile-interval, each
+		// file holds the difference with the snapshot taken at the previous
+		// rotation, like the CPU profiles hold the samples of their interval.
+		var lastMutex sync.Mutex
+		var last *profile.Profile
+		intervalProfile := func(p *profile.Profile, rotate bool) *profile.Profile {
+			if prog.memInterval <= 0 {
+				return p
+			}
+			lastMutex.Lock()
+			defer lastMutex.Unlock()
+			base := last
+			if rotate {
+				last = p
+			}
+			if base == nil {
+				return p
+			}
+			delta, err := wzprof.DeltaProfile(base, p)
+			if err != nil {
+				stderr.Print("computing memory profile of interval:", err)
+				return nil
+			}
+			return delta
+		}
+		if !prog.hostProfile {
+			dumps = append(dumps, func(now time.Time) {
+				if p := intervalProfile(mem.NewProfile(sampleRate()), false); p != nil {
+					prog.writeProfile("memory", rotation.path(now), p)
+				}
+			})
+		}
+		if prog.memInterval > 0 {
+			stopRotation = every(prog.memInterval, func(now time.Time) {
+				if p := intervalProfile(mem.NewProfile(sampleRate()), true); p != nil {
+					prog.writeProfile("memory", rotation.path(now), p)
+					prog.exportProfile("memory", p)
+				}
+			})
+		}
+		defer func() {
+			stopRotation()
+			p := mem.NewProfile(sampleRate())
+			if !prog.hostProfile {
+				if prog.memInterval > 0 {
+					if p := intervalProfile(p, true); p != nil {
+						prog.writeProfile("memory", rotation.path(time.Now()), p)
+						prog.exportProfile("memory", p)
+					}
+				} else {
+					prog.writeProfile("memory", prog.memProfile, p)
+					prog.exportProfile("memory", p)
+				}
+				printTop("memory", p, prog.top)
+			}
+		}()
+	}
+
+	if prog.inuseSeries != "" {
+		// The snapshots are labeled with the time they were taken at and
+		// merged in a single profile.
+		var snapshots []*profile.Profile
+		start := time.Now()
+		snapshot := func(at time.Duration) {
+			if p := mem.InuseProfile(sampleRate()); p != nil {
+				labelSamples(p, "time", at.String())
+				snapshots = append(snapshots, p)
+			}
+		}
+		// Ticks are dropped when snapshots take longer than the interval,
+		// the time of each snapshot is rounded to the interval it was taken
+		// at.
+		stopSnapshots := every(prog.inuseRate, func(now time.Time) {
+			snapshot(now.Sub(start).Round(prog.inuseRate))
+		})
+		defer func() {
+			stopSnapshots()
+			snapshot(time.Since(start).Round(time.Millisecond))
+			p, err := wzprof.MergeProfiles(snapshots...)
+			if err != nil {
+				stderr.Print("merging memory snapshots: ", err)
+				return
+			}
+			prog.writeProfile("memory in use series", prog.inuseSeries, p)
+		}()
+	}
+
+	if len(dumps) > 0 && len(dumpSignals) > 0 {
+		progress.Printf("send SIGUSR1 to process %d to dump the guest profiles", os.Getpid())
+		stopNotify := notify(dumpSignals, func(now time.Time) {
+			for _, dump := range dumps {
+				dump(now)
+			}
+		})
+		defer stopNotify()
+	}
+
+	guestStdin, guestStdout, guestStderr, closeStdio, err := prog.openStdio()
+	if err != nil {
+		return err
+	}
+	defer closeStdio()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		defer cancel(nil)
+		progress.Printf("instantiating host module: wasi_snapshot_preview1")
+		wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+		if importsModule(compiledModule, wzprof.HostModuleName) {
+			progress.Printf("instantiating host module: %s", wzprof.HostModuleName)
+			if _, err := p.InstantiateHostModule(ctx, runtime, cpu); err != nil {
+				cancel(fmt.Errorf("instantiating host module: %w", err))
+				return
+			}
+		}
+
+		config := wazero.NewModuleConfig().
+			WithStdout(guestStdout).
+			WithStderr(guestStderr).
+			WithStdin(guestStdin).
+			WithRandSource(rand.Reader).
+			WithSysNanosleep().
+			WithSysNanotime().
+			WithSysWalltime().
+			WithArgs(append([]string{wasmName}, prog.args...)...).
+			WithFSConfig(createFSConfig(prog.mounts))
+
+		for _, env := range prog.env {
+			k, v, _ := strings.Cut(env, "=")
+			config = config.WithEnv(k, v)
+		}
+
+		if prog.invoke != "" {
+			// Reactor modules export _initialize instead of _start, which
+			// must be called before any other export.
+			config = config.
+				WithArgs(wasmName).
+				WithStartFunctions("_initialize")
+		}
+
+		if prog.serveAddr != "" {
+			cancel(prog.serve(ctx, runtime, compiledModule, config))
+			return
+		}
+
+		moduleName := compiledModule.Name()
+		if moduleName == "" {
+			moduleName = wasmName
+		}
+		for _, addr := range prog.listen {
+			progress.Printf("pre-opening socket: %s", addr)
+		}
+		progress.Printf("instantiating guest module: %s", moduleName)
+		instance, err := runtime.InstantiateModule(sock.WithConfig(ctx, createSockConfig(prog.listen)), compiledModule, config)
+		if err != nil {
+			cancel(fmt.Errorf("instantiating guest module: %w", err))
+			return
+		}
+		if prog.invoke != "" {
+			if err := invoke(ctx, instance, prog.invoke, prog.args); err != nil {
+				cancel(err)
+				return
+			}
+		}
+		if err := instance.Close(ctx); err != nil {
+			cancel(fmt.Errorf("closing guest module: %w", err))
+			return
+		}
+	}()
+
+	<-ctx.Done()
+	if prog.coreDump != "" && core.Trapped() {
+		writeCoreDump(prog.coreDump, core)
+	}
+	return silenceContextCanceled(context.Cause(ctx))
+}
+
+// compileCacheKey returns the name of the directory of the compilation cache
+// for the profilers of the program. wazero only compiles the hooks calling
+// function listeners into the functions which have one, but the keys of its
+// cache do not account for them. Modules compiled with different profilers, or
+// with different functions selected by -focus and -ignore, are cached in
+// separate directories.
+func (prog *program) compileCacheKey(listenerTypes []string) string {
+	var focus, ignore string
+	if prog.focus != nil {
+		focus = prog.focus.String()
+	}
+	if prog.ignore != nil {
+		ignore = prog.ignore.String()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q\n%q\n%q\n%t\n%t\n",
+		version,
+		listenerTypes,
+		focus,
+		ignore,
+		prog.memGrowth,
+		prog.sampleRate <= 0 && prog.maxOverhead <= 0)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// openStdio opens the files the standard I/O of the guest are redirected to,
+// which default to the ones of wzprof. The guest output is written to a single
+// file when stdout and stderr are redirected to the same path. The returned
+// function closes the files.
+func (prog *program) openStdio() (stdin, stdout, stderr *os.File, closeStdio func(), err error) {
+	var files []*os.File
+	closeStdio = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	open := func(path string, flag int, std *os.File) (*os.File, error) {
+		if path == "" {
+			return std, nil
+		}
+		f, err := os.OpenFile(path, flag, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("redirecting guest stdio: %w", err)
+		}
+		files = append(files, f)
+		return f, nil
+	}
+
+	const output = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if stdin, err = open(prog.stdin, os.O_RDONLY, os.Stdin); err != nil {
+		closeStdio()
+		return nil, nil, nil, nil, err
+	}
+	if stdout, err = open(prog.stdout, output, os.Stdout); err != nil {
+		closeStdio()
+		return nil, nil, nil, nil, err
+	}
+	if prog.stderr != "" && prog.stderr == prog.stdout {
+		return stdin, stdout, stdout, closeStdio, nil
+	}
+	if stderr, err = open(prog.stderr, output, os.Stderr); err != nil {
+		closeStdio()
+		return nil, nil, nil, nil, err
+	}
+	return stdin, stdout, stderr, closeStdio, nil
+}
+
+// exportTimeout is the maximum time spent pushing a profile to a remote
+// backend.
+const exportTimeout = 30 * time.Second
+
+// exportProfile pushes the profile to the remote backend configured for the
+// program, if any.
+func (prog *program) exportProfile(profileName string, prof *profile.Profile) {
+	if prog.exporter == nil || prof == nil {
+		return
+	}
+	progress.Printf("exporting guest %s profile (%d samples)", profileName, len(prof.Sample))
+	// The context of the program may already be canceled when the profiles
+	// are exported, so a separate context is used.
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := prog.exporter.Export(ctx, profileName, prof); err != nil {
+		stderr.Printf("exporting %s profile: %v", profileName, err)
+	}
+}
+
+// spanExportInterval is the interval at which the spans recorded are pushed
+// to the OTLP receiver.
+const spanExportInterval = 5 * time.Second
+
+func (prog *program) exportSpans(spans []wzprof.Span) {
+	if len(spans) == 0 {
+		return
+	}
+	progress.Printf("exporting %d guest spans", len(spans))
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := prog.spanExport.ExportSpans(ctx, spans); err != nil {
+		stderr.Printf("exporting spans: %v", err)
+	}
+}
+
+// invoke calls the function exported by the module under the given name,
+// passing the arguments after converting them to the types of the function
+// parameters. The results are printed to stdout.
+func invoke(ctx context.Context, mod api.Module, name string, args []string) error {
+	fn := mod.ExportedFunction(name)
+	if fn == nil {
+		return fmt.Errorf("invoking guest function: %s is not exported by the module", name)
+	}
+	def := fn.Definition()
+	params, err := parseParams(def.ParamTypes(), args)
+	if err != nil {
+		return fmt.Errorf("invoking guest function %s: %w", name, err)
+	}
+	progress.Printf("invoking guest function: %s", name)
+	results, err := fn.Call(ctx, params...)
+	if err != nil {
+		return fmt.Errorf("invoking guest function %s: %w", name, err)
+	}
+	for i, t := range def.ResultTypes() {
+		fmt.Println(formatValue(t, results[i]))
+	}
+	return nil
+}
+
+func parseParams(types []api.ValueType, args []string) ([]uint64, error) {
+	if len(args) != len(types) {
+		return nil, fmt.Errorf("expected %d arguments, got %d", len(types), len(args))
+	}
+	params := make([]uint64, len(types))
+	for i, t := range types {
+		var err error
+		switch t {
+		case api.ValueTypeI32:
+			var v uint64
+			v, err = parseInteger(args[i], 32)
+			params[i] = api.EncodeU32(uint32(v))
+		case api.ValueTypeI64:
+			params[i], err = parseInteger(args[i], 64)
+		case api.ValueTypeF32:
+			var v float64
+			v, err = strconv.ParseFloat(args[i], 32)
+			params[i] = api.EncodeF32(float32(v))
+		case api.ValueTypeF64:
+			var v float64
+			v, err = strconv.ParseFloat(args[i], 64)
+			params[i] = api.EncodeF64(v)
+		default:
+			err = fmt.Errorf("unsupported parameter type %s", api.ValueTypeName(t))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i, err)
+		}
+	}
+	return params, nil
+}
+
+// parseInteger parses an integer argument of the given bit size. Wasm integers
+// are sign-agnostic, values which do not fit in a signed integer are parsed as
+// unsigned (e.g. 0xffffffff for an i32).
+func parseInteger(s string, bitSize int) (uint64, error) {
+	v, err := strconv.ParseInt(s, 0, bitSize)
+	if err == nil {
+		return uint64(v), nil
+	}
+	u, uerr := strconv.ParseUint(s, 0, bitSize)
+	if uerr != nil {
+		return 0, err
+	}
+	return u, nil
+}
+
+func formatValue(t api.ValueType, v uint64) string {
+	switch t {
+	case api.ValueTypeI32:
+		return strconv.FormatInt(int64(api.DecodeI32(v)), 10)
+	case api.ValueTypeI64:
+		return strconv.FormatInt(int64(v), 10)
+	case api.ValueTypeF32:
+		return strconv.FormatFloat(float64(api.DecodeF32(v)), 'g', -1, 32)
+	case api.ValueTypeF64:
+		return strconv.FormatFloat(api.DecodeF64(v), 'g', -1, 64)
+	default:
+		return fmt.Sprintf("%#x", v)
+	}
+}
+
+func silenceContextCanceled(err error) error {
+	if err == context.Canceled {
+		err = nil
+	}
+	return err
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	return runModule(ctx, "run", args)
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	return runModule(ctx, "serve", args)
+}
+
+// runModule parses the flags of the run and serve commands, which only differ
+// in the way the module is run.
+func runModule(ctx context.Context, cmd string, args []string) error {
+	var (
+		serveAddr    string
+		pprofAddr    string
+		cpuProfile   string
+		pgo          bool
+		memProfile   string
+		wallProfile  string
+		blockProfile string
+		ioProfile    string
+		sysProfile   string
+		gcProfile    string
+		instrProfile string
+		opProfile    string
+		branchProf   string
+		coverage     string
+		lcov         string
+		growProfile  string
+		growTimeline string
+		stackProfile string
+		coreDump     string
+		timeline     string
+		timelineMax  int
+		spans        string
+		spansURL     string
+		format       string
+		dropBelow    string
+		sampleRate   float64
+		hostProfile  bool
+		hostTime     bool
+		inuseMemory  bool
+		memGrowth    bool
+		sizeClasses  bool
+		timeLabels   time.Duration
+		demangle     bool
+		debugInfo    string
+		trimPath     stringList
+		sourceMap    stringList
+		precise      bool
+		raw          bool
+		diag         diagnostics
+		mounts       string
+		listen       stringList
+		env          stringList
+		invokeName   string
+		top          int
+		pushURL      string
+		pushProtocol string
+		pushLabels   stringList
+		cpuInterval  time.Duration
+		memInterval  time.Duration
+		inuseSeries  string
+		inuseRate    time.Duration
+		flight       string
+		flightWindow time.Duration
+		memStats     string
+		memStatsRate time.Duration
+		maxOverhead  string
+		focus        string
+		ignore       string
+		printVersion bool
+		compileCache string
+		engine       string
+		stdinPath    string
+		stdoutPath   string
+		stderrPath   string
+	)
+
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof %s [flags] </path/to/app.wasm> [--] [args...]\n", cmd)
+		flags.PrintDefaults()
+	}
+	if cmd == "serve" {
+		flags.StringVar(&serveAddr, "addr", ":8080", "Address where the HTTP server running the module for each request listens.")
+	}
+	flags.StringVar(&pprofAddr, "pprof-addr", "", "Address where to expose a pprof HTTP endpoint.")
+	flags.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile to the specified file before exiting.")
+	flags.BoolVar(&pgo, "pgo", false, "Shape the CPU profile of Go programs for profile guided optimizations with go build -pgo (requires -cpuprofile).")
+	flags.StringVar(&memProfile, "memprofile", "", "Write a memory profile to the specified file before exiting.")
+	flags.StringVar(&wallProfile, "wallprofile", "", "Write a wall-clock profile to the specified file before exiting.")
+	flags.StringVar(&blockProfile, "blockprofile", "", "Write a profile of time spent blocked in host functions (e.g. poll_oneoff) to the specified file before exiting.")
+	flags.StringVar(&ioProfile, "ioprofile", "", "Write a profile of I/O operations on file descriptors to the specified file before exiting.")
+	flags.StringVar(&sysProfile, "syscallprofile", "", "Write a profile of the latency of host function calls to the specified file before exiting, and print a summary to stderr.")
+	flags.StringVar(&gcProfile, "gcprofile", "", "Write a profile of the garbage collection cycles and pauses of Go programs to the specified file before exiting.")
+	flags.StringVar(&instrProfile, "instrprofile", "", "Write a profile of the number of wasm instructions executed by each function to the specified file before exiting, the module is instrumented to count them.")
+	flags.StringVar(&opProfile, "opcodeprofile", "", "Write a profile of the number of times each wasm instruction of the functions selected by -focus and -ignore is executed to the specified file before exiting, the module is instrumented to count them.")
+	flags.StringVar(&branchProf, "branchprofile", "", "Write a profile of the executions of the basic blocks and conditional branches of the functions selected by -focus and -ignore to the specified file before exiting, the module is instrumented to count them.")
+	flags.StringVar(&coverage, "coverprofile", "", "Write the coverage of the source lines of the guest in the format of go test -coverprofile to the specified file before exiting, the module is instrumented to count the executions of the functions selected by -focus and -ignore.")
+	flags.StringVar(&lcov, "lcov", "", "Write the coverage of the source lines of the guest in the LCOV tracefile format to the specified file before exiting, like -coverprofile.")
+	flags.StringVar(&growProfile, "growprofile", "", "Write a profile of the growth of the linear memory by stack to the specified file before exiting.")
+	flags.StringVar(&growTimeline, "growtimeline", "", "Write the size of the linear memory after each growth in the Chrome Trace Event format to the specified file before exiting.")
+	flags.StringVar(&stackProfile, "stackprofile", "", "Write a profile of the maximum stack usage of the guest by call path to the specified file before exiting, and print the high-water mark.")
+	flags.StringVar(&coreDump, "coredump", "", "Write a WebAssembly coredump of the guest to the specified file when it traps.")
+	flags.StringVar(&memStats, "memstats", "", "Write the heap statistics of Go programs read at a fixed interval to the specified CSV file before exiting.")
+	flags.DurationVar(&memStatsRate, "memstats-interval", time.Second, "Interval at which the heap statistics of Go programs are read.")
+	flags.StringVar(&timeline, "timeline", "", "Write a timeline of function calls in the Chrome Trace Event format to the specified file before exiting.")
+	flags.IntVar(&timelineMax, "timeline-limit", wzprof.DefaultTimelineLimit, "Maximum number of events recorded in the timeline, calls made once it is reached are not recorded (0 for no limit).")
+	flags.StringVar(&spans, "spans", "", "Push the calls of the functions with a name matching this regular expression as OpenTelemetry spans to -spans-url.")
+	flags.StringVar(&spansURL, "spans-url", "http://localhost:4318", "URL of the OTLP/HTTP receiver the spans are pushed to.")
+	flags.StringVar(&format, "format", "pprof", "Format of the profiles written to files (pprof, folded, flamegraph for a standalone HTML page, dot for a Graphviz call graph).")
+	flags.StringVar(&dropBelow, "drop-below", "", "Drop the stacks with a value below this threshold from the profiles written, either absolute (e.g. 4096) or a percentage of the total value of the profile (e.g. 0.01%).")
+	flags.Float64Var(&sampleRate, "sample", defaultSampleRate, "Set the profile sampling rate (0-1).")
+	flags.BoolVar(&hostProfile, "host", false, "Generate profiles of the host instead of the guest application.")
+	flags.BoolVar(&hostTime, "iowait", false, "Include time spent waiting on I/O in guest CPU profile.")
+	flags.BoolVar(&inuseMemory, "inuse", false, "Include snapshots of memory in use (experimental).")
+	flags.BoolVar(&memGrowth, "memgrowth", false, "Include the growth of the linear memory caused by calls to sbrk in the memory profile.")
+	flags.BoolVar(&sizeClasses, "sizeclasses", false, "Split the allocations of the memory profile by size class with a size_class label.")
+	flags.DurationVar(&timeLabels, "time-labels", 0, "Label the samples with the time window they were recorded in, counted from the start of the program (e.g. 10s labels them time=0s, time=10s...).")
+	flags.BoolVar(&demangle, "demangle", true, "Show demangled names of C++ and Rust functions in profiles.")
+	flags.StringVar(&debugInfo, "debug-info", "", "Read DWARF information from this wasm module (e.g. the unstripped build of the program) instead of the profiled one.")
+	flags.Var(&trimPath, "trim-path", "Remove this prefix from the source file names of the profiles (e.g. /build/src), may be repeated.")
+	flags.Var(&sourceMap, "source-map-prefix", "Replace a prefix of the source file names of the profiles (e.g. -source-map-prefix /build/src=$HOME/src), may be repeated.")
+	flags.BoolVar(&precise, "precise-locations", false, "Resolve the locations of profiles to the source lines of the statements making the calls, including the calls of inlined functions.")
+	flags.BoolVar(&raw, "raw", false, "Write raw profiles of unsymbolized locations, which are symbolized later with wzprof symbolize.")
+	diag.register(flags)
+	flags.StringVar(&engine, "engine", "", "Engine running the wasm module (compiler, interpreter), default to the compiler on platforms which support it.")
+	flags.StringVar(&compileCache, "compile-cache", "", "Cache the compiled wasm modules in the specified directory, to speed up repeated runs of large modules.")
+	flags.StringVar(&stdinPath, "stdin", "", "Read the standard input of the guest from the specified file instead of the one of wzprof.")
+	flags.StringVar(&stdoutPath, "stdout", "", "Write the standard output of the guest to the specified file instead of the one of wzprof.")
+	flags.StringVar(&stderrPath, "stderr", "", "Write the standard error of the guest to the specified file, separately from the diagnostics of wzprof.")
+	flags.StringVar(&mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
+	flags.Var(&listen, "listen", "Pre-open a socket listening on this address for the guest (e.g. tcp:0.0.0.0:8080), may be repeated.")
+	flags.Var(&env, "env", "Set an environment variable of the guest (e.g. -env KEY=VALUE), may be repeated.")
+	flags.StringVar(&invokeName, "invoke", "", "Call the function exported under this name instead of _start, passing the arguments following the module path.")
+	flags.IntVar(&top, "top", 0, "Print the top N functions of each guest profile to stderr after the run (implies a CPU profile if none is collected).")
+	flags.StringVar(&pushURL, "push", "", "URL of a continuous profiling backend to push the guest profiles to before exiting, or s3://bucket/prefix/ to upload them to object storage (implies a CPU profile if none is collected).")
+	flags.StringVar(&pushProtocol, "push-protocol", "parca", "Protocol used to push profiles (parca, pyroscope, otlp).")
+	flags.Var(&pushLabels, "push-label", "Add a label to the pushed profiles (e.g. -push-label env=staging), may be repeated.")
+	flags.DurationVar(&cpuInterval, "cpuprofile-interval", 0, "Write the CPU profile to a new file at this interval (e.g. 1m), the -cpuprofile path is a template which may contain {time} and {seq}.")
+	flags.DurationVar(&memInterval, "memprofile-interval", 0, "Write the memory allocated during each interval to a new file (e.g. 1m), the -memprofile path is a template which may contain {time} and {seq}.")
+	flags.StringVar(&inuseSeries, "inuse-series", "", "Take snapshots of the memory in use at a fixed interval and write them to the specified file before exiting, in a single profile where the samples of each snapshot have a time label.")
+	flags.DurationVar(&inuseRate, "inuse-series-interval", 10*time.Second, "Interval at which the snapshots of -inuse-series are taken.")
+	flags.StringVar(&flight, "flightrecorder", "", "Keep the CPU samples of the last seconds of execution and write them to a profile when receiving SIGUSR1, the path is a template which may contain {time} and {seq}.")
+	flags.DurationVar(&flightWindow, "flightrecorder-window", 30*time.Second, "Duration of execution retained by the flight recorder.")
+	flags.StringVar(&maxOverhead, "max-overhead", "", "Adjust the sampling rate to hold the time spent in the profilers under this percentage of the execution time (e.g. 2%), instead of sampling at a fixed rate.")
+	flags.StringVar(&focus, "focus", "", "Only instrument the functions with a name matching this regular expression in the CPU, wall-clock, instruction and goroutine profiles.")
+	flags.StringVar(&ignore, "ignore", "", "Do not instrument the functions with a name matching this regular expression in the CPU, wall-clock, instruction and goroutine profiles.")
+	flags.BoolVar(&printVersion, "version", false, "Print the wzprof version.")
+	flags.Parse(args)
+
+	if printVersion {
+		return versionCommand(ctx, nil)
+	}
+
+	args = flags.Args()
+	if len(args) < 1 {
+		flags.Usage()
+		return fmt.Errorf("missing path to the wasm module")
+	}
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	for _, e := range env {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("invalid environment variable: %s", e)
+		}
+	}
+
+	switch format {
+	case "pprof", "folded", "flamegraph", "dot":
+	default:
+		return fmt.Errorf("unsupported profile format: %s", format)
+	}
+
+	if pgo {
+		switch {
+		case cpuProfile == "":
+			return fmt.Errorf("-pgo requires -cpuprofile")
+		case format != "pprof":
+			return fmt.Errorf("-pgo requires the pprof format")
+		case raw || hostProfile:
+			return fmt.Errorf("-pgo cannot be used with -raw or -host")
+		}
+	}
+
+	switch engine {
+	case "", "compiler", "interpreter":
+	default:
+		return fmt.Errorf("unsupported engine: %s", engine)
+	}
+
+	for _, addr := range listen {
+		if _, _, err := parseListenAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	if cmd == "serve" {
+		// The standard input and output of the guest are the body of the
+		// request and the response, and the instances of the module cannot
+		// share the sockets.
+		if invokeName != "" || stdinPath != "" || stdoutPath != "" || len(listen) > 0 {
+			return fmt.Errorf("-invoke, -listen, -stdin and -stdout cannot be used with serve")
+		}
+	}
+
+	// Arguments following the path to the module are passed to the guest. They
+	// may be separated by "--" to prevent them from being confused with flags
+	// of wzprof.
+	filePath, args := args[0], args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if cpuInterval != 0 || memInterval != 0 {
+		if cpuInterval < 0 || memInterval < 0 {
+			return fmt.Errorf("profile intervals must be positive")
+		}
+		if cpuInterval != 0 && cpuProfile == "" {
+			return fmt.Errorf("-cpuprofile-interval requires -cpuprofile")
+		}
+		if memInterval != 0 && memProfile == "" {
+			return fmt.Errorf("-memprofile-interval requires -memprofile")
+		}
+		if hostProfile {
+			return fmt.Errorf("profile intervals cannot be used with -host")
+		}
+	}
+
+	if memStatsRate <= 0 {
+		return fmt.Errorf("invalid memstats interval: %s", memStatsRate)
+	}
+
+	dropValue, dropFraction, err := parseDropThreshold(dropBelow)
+	if err != nil {
+		return err
+	}
+
+	if timeLabels < 0 {
+		return fmt.Errorf("invalid time labels window: %s", timeLabels)
+	}
+
+	if inuseRate <= 0 {
+		return fmt.Errorf("invalid inuse series interval: %s", inuseRate)
+	}
+
+	if flightWindow <= 0 {
+		return fmt.Errorf("invalid flight recorder window: %s", flightWindow)
+	}
+
+	var overhead float64
+	if maxOverhead != "" {
+		sampleSet := false
+		flags.Visit(func(f *flag.Flag) { sampleSet = sampleSet || f.Name == "sample" })
+		if sampleSet {
+			return fmt.Errorf("-max-overhead cannot be used with -sample")
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(maxOverhead, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid maximum overhead: %s", maxOverhead)
+		}
+		overhead = percent / 100
+	}
+
+	sourcePaths, err := sourcePathOptions(trimPath, sourceMap)
+	if err != nil {
+		return err
+	}
+
+	var focusRegexp, ignoreRegexp *regexp.Regexp
+	if focus != "" {
+		var err error
+		if focusRegexp, err = regexp.Compile(focus); err != nil {
+			return fmt.Errorf("invalid -focus expression: %w", err)
+		}
+	}
+	if ignore != "" {
+		var err error
+		if ignoreRegexp, err = regexp.Compile(ignore); err != nil {
+			return fmt.Errorf("invalid -ignore expression: %w", err)
+		}
+	}
+
+	var spansRegexp *regexp.Regexp
+	var spanExport *wzprof.OTLPSpanExporter
+	if spans != "" {
+		var err error
+		if spansRegexp, err = regexp.Compile(spans); err != nil {
+			return fmt.Errorf("invalid -spans expression: %w", err)
+		}
+		appName := strings.TrimSuffix(filepath.Base(filePath), ".wasm")
+		spanExport = &wzprof.OTLPSpanExporter{
+			URL: spansURL,
+			Attributes: map[string]string{
+				"service.name":     appName,
+				"wasm.module.name": appName,
+			},
+		}
+	}
+
+	var exporter wzprof.Exporter
+	if pushURL != "" {
+		var err error
+		exporter, err = newExporter(pushURL, pushProtocol, pushLabels, filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	rate := int(math.Ceil(1 / sampleRate))
+	runtime.SetBlockProfileRate(rate)
+	runtime.SetMutexProfileFraction(rate)
+
+	return (&program{
+		filePath:     filePath,
+		args:         args,
+		serveAddr:    serveAddr,
+		pprofAddr:    pprofAddr,
+		cpuProfile:   cpuProfile,
+		pgo:          pgo,
+		memProfile:   memProfile,
+		wallProfile:  wallProfile,
+		blockProfile: blockProfile,
+		ioProfile:    ioProfile,
+		sysProfile:   sysProfile,
+		gcProfile:    gcProfile,
+		instrProfile: instrProfile,
+		opProfile:    opProfile,
+		branchProf:   branchProf,
+		coverage:     coverage,
+		lcov:         lcov,
+		growProfile:  growProfile,
+		growTimeline: growTimeline,
+		stackProfile: stackProfile,
+		coreDump:     coreDump,
+		timeline:     timeline,
+		timelineMax:  timelineMax,
+		spans:        spansRegexp,
+		spanExport:   spanExport,
+		format:       format,
+		dropBelow:    dropValue,
+		dropFraction: dropFraction,
+		sampleRate:   sampleRate,
+		hostProfile:  hostProfile,
+		hostTime:     hostTime,
+		inuseMemory:  inuseMemory,
+		memGrowth:    memGrowth,
+		sizeClasses:  sizeClasses,
+		timeLabels:   timeLabels,
+		demangle:     demangle,
+		debugInfo:    debugInfo,
+		sourcePaths:  sourcePaths,
+		precise:      precise,
+		raw:          raw,
+		mounts:       split(mounts),
+		listen:       listen,
+		env:          env,
+		invoke:       invokeName,
+		top:          top,
+		exporter:     exporter,
+		cpuInterval:  cpuInterval,
+		memInterval:  memInterval,
+		inuseSeries:  inuseSeries,
+		inuseRate:    inuseRate,
+		flight:       flight,
+		flightWindow: flightWindow,
+		memStats:     memStats,
+		memStatsRate: memStatsRate,
+		maxOverhead:  overhead,
+		focus:        focusRegexp,
+		ignore:       ignoreRegexp,
+		stdin:        stdinPath,
+		stdout:       stdoutPath,
+		stderr:       stderrPath,
+		compileCache: compileCache,
+		engine:       engine,
+	}).run(ctx)
+}
+
+// newExporter constructs the exporter pushing profiles of the module at
+// filePath to the backend at the given URL.
+func newExporter(url, protocol string, labelList []string, filePath string) (wzprof.Exporter, error) {
+	appName := strings.TrimSuffix(filepath.Base(filePath), ".wasm")
+	if rest, ok := strings.CutPrefix(url, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		return newS3Exporter(bucket, key, appName), nil
+	}
+	labels := map[string]string{"module": appName}
+	for _, l := range labelList {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label: %s", l)
+		}
+		labels[k] = v
+	}
+
+	switch protocol {
+	case "parca":
+		return &wzprof.ParcaExporter{URL: url, Labels: labels}, nil
+	case "pyroscope":
+		return &wzprof.PyroscopeExporter{URL: url, Application: appName, Labels: labels}, nil
+	case "otlp":
+		wasmCode, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		buildHash := sha256.Sum256(wasmCode)
+		attrs := map[string]string{
+			"service.name":           appName,
+			"wasm.module.name":       appName,
+			"wasm.module.build_hash": hex.EncodeToString(buildHash[:]),
+		}
+		for k, v := range labels {
+			if k != "module" {
+				attrs[k] = v
+			}
+		}
+		return &wzprof.OTLPExporter{URL: url, Attributes: attrs}, nil
+	default:
+		return nil, fmt.Errorf("unsupported push protocol: %s", protocol)
+	}
+}
+
+// newS3Exporter constructs the exporter uploading profiles to the bucket. The
+// key is a template of the keys of the profiles, or a prefix when it ends with
+// a slash. The credentials, region and endpoint are read from the standard
+// environment variables of the AWS tools, and the git commit from the ones of
+// common CI systems.
+func newS3Exporter(bucket, key, module string) *wzprof.S3Exporter {
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += wzprof.DefaultS3Key
+	}
+	return &wzprof.S3Exporter{
+		Bucket:          bucket,
+		Key:             key,
+		Module:          module,
+		Commit:          getenv("GITHUB_SHA", "CI_COMMIT_SHA", "GIT_COMMIT"),
+		Region:          getenv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		Endpoint:        getenv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// getenv returns the value of the first environment variable which is set.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// every calls fn at each tick of the interval in a separate goroutine, until
+// the returned function is called. When stop returns, fn is guaranteed not to
+// be running anymore.
+func every(interval time.Duration, fn func(time.Time)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		for {
+			select {
+			case now := <-ticker.C:
+				fn(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-exit
+	}
+}
+
+// notify calls fn each time the process receives one of the signals, until
+// the returned function is called. When stop returns, fn is guaranteed not to
+// be running anymore.
+func notify(signals []os.Signal, fn func(time.Time)) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		for range c {
+			fn(time.Now())
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+		<-exit
+	}
+}
+
+// rotation generates the paths of files written by profile rotation and
+// dumps, it is safe to use from multiple goroutines.
+type rotation struct {
+	mutex    sync.Mutex
+	template string
+	seq      int
+}
+
+// path expands the path template, replacing {time} with the UTC timestamp t
+// and {seq} with the number of files written so far. When the template has
+// neither, the timestamp is inserted before the file extension (e.g. cpu.pprof
+// becomes cpu-20230102T150405Z.pprof) so that profiles don't overwrite each
+// other.
+func (r *rotation) path(t time.Time) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.seq++
+	timestamp := t.UTC().Format("20060102T150405Z")
+	if !strings.Contains(r.template, "{time}") && !strings.Contains(r.template, "{seq}") {
+		ext := filepath.Ext(r.template)
+		return strings.TrimSuffix(r.template, ext) + "-" + timestamp + ext
+	}
+	return strings.NewReplacer("{time}", timestamp, "{seq}", strconv.Itoa(r.seq)).Replace(r.template)
+}
+
+func startCPUProfile(f *os.File) {
+	if err := pprof.StartCPUProfile(f); err != nil {
+		stderr.Print("starting CPU profile:", err)
+	}
+}
+
+func stopCPUProfile(f *os.File) {
+	progress.Printf("writing host cpu profile to %s", f.Name())
+	pprof.StopCPUProfile()
+}
+
+func writeHeapProfile(f *os.File) {
+	progress.Printf("writing host memory profile to %s", f.Name())
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		stderr.Print("writing memory profile:", err)
+	}
+}
+
+func (prog *program) writeProfile(profileName, path string, prof *profile.Profile) {
+	if prog.dropBelow > 0 || prog.dropFraction > 0 {
+		n := wzprof.DropSamples(prof, prog.dropBelow, prog.dropFraction)
+		progress.Printf("dropped %d samples below the threshold from the guest %s profile", n, profileName)
+	}
+	progress.Printf("writing guest %s profile to %s (%d samples)", profileName, path, len(prof.Sample))
+
+	var err error
+	switch prog.format {
+	case "folded":
+		err = writeProfileFile(path, prof, wzprof.WriteFolded)
+	case "flamegraph":
+		err = writeProfileFile(path, prof, wzprof.WriteFlameGraph)
+	case "dot":
+		err = writeProfileFile(path, prof, wzprof.WriteDOT)
+	default:
+		err = wzprof.WriteProfile(path, prof)
+	}
+	if err != nil {
+		stderr.Print("writing profile:", err)
+	}
+}
+
+// printTop writes a report of the top n functions of a profile to stderr, it
+// does nothing if n is zero or negative.
+func printTop(profileName string, prof *profile.Profile, n int) {
+	if n <= 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nguest %s profile: top %d functions\n", profileName, n)
+	if err := wzprof.WriteTop(os.Stderr, prof, n); err != nil {
+		stderr.Print("writing top report:", err)
+	}
+}
+
+// printSyscallSummary writes the breakdown of the latency of host function calls
+// recorded in a syscall profile to stderr.
+func printSyscallSummary(prof *profile.Profile) {
+	fmt.Fprintf(os.Stderr, "\nguest syscall profile: host function latency\n")
+	if err := wzprof.WriteSyscallSummary(os.Stderr, prof); err != nil {
+		stderr.Print("writing syscall summary:", err)
+	}
+}
+
+func writeTimeline(path string, timeline *wzprof.Timeline) {
+	progress.Printf("writing guest timeline to %s", path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing timeline:", err)
+		return
+	}
+	defer f.Close()
+	if err := timeline.WriteTrace(f); err != nil {
+		stderr.Print("writing timeline:", err)
+	}
+}
+
+func writeMemStats(path string, memStats *wzprof.MemStatsCollector) {
+	progress.Printf("writing guest memstats to %s", path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing memstats:", err)
+		return
+	}
+	defer f.Close()
+	if err := memStats.WriteCSV(f); err != nil {
+		stderr.Print("writing memstats:", err)
+	}
+}
+
+// writeProfileFile writes a profile to the file at path in the format of the
+// write function, like wzprof.WriteProfile does in the pprof format. Errors
+// closing the file are returned, since they may mean the content was lost.
+func writeProfileFile(path string, prof *profile.Profile, write func(io.Writer, *profile.Profile) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f, prof); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseDropThreshold parses the value of -drop-below, which is either an
+// absolute value or a percentage of the total value of profiles.
+func parseDropThreshold(s string) (value int64, fraction float64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(percent, 64)
+		if err != nil || f < 0 || f > 100 {
+			return 0, 0, fmt.Errorf("invalid drop threshold: %s", s)
+		}
+		return 0, f / 100, nil
+	}
+	value, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || value < 0 {
+		return 0, 0, fmt.Errorf("invalid drop threshold: %s", s)
+	}
+	return value, 0, nil
+}
+
+// labelSamples adds a label to all the samples of the profile.
+func labelSamples(prof *profile.Profile, key, value string) {
+	for _, s := range prof.Sample {
+		labels := make(map[string][]string, len(s.Label)+1)
+		for k, v := range s.Label {
+			labels[k] = v
+		}
+		labels[key] = []string{value}
+		s.Label = labels
+	}
+}
+
+func createFSConfig(mounts []string) wazero.FSConfig {
+	fs := wazero.NewFSConfig()
+	for _, m := range mounts {
+		parts := strings.Split(m, ":")
+		if len(parts) < 2 {
+			stderr.Fatalf("invalid mount: %s", m)
+		}
+
+		var mode string
+		if len(parts) == 3 {
+			mode = parts[2]
+		}
+
+		if mode == "ro" {
+			fs = fs.WithReadOnlyDirMount(parts[0], parts[1])
+			continue
+		}
+
+		fs = fs.WithDirMount(parts[0], parts[1])
+	}
+	return fs
+}
+
+// createSockConfig returns the configuration of the sockets pre-opened for the
+// guest, which wazero exposes with the sock_accept function of WASI. The
+// addresses must have been validated with parseListenAddr.
+func createSockConfig(listen []string) sock.Config {
+	config := sock.NewConfig()
+	for _, addr := range listen {
+		host, port, _ := parseListenAddr(addr)
+		config = config.WithTCPListener(host, port)
+	}
+	return config
+}
+
+// parseListenAddr parses the address of a socket pre-opened for the guest, in
+// the network:host:port format (e.g. tcp:0.0.0.0:8080). wazero only supports
+// TCP listeners.
+func parseListenAddr(addr string) (host string, port int, err error) {
+	network, hostPort, ok := strings.Cut(addr, ":")
+	if !ok || network != "tcp" {
+		return "", 0, fmt.Errorf("invalid listen address: %s: expected tcp:host:port", addr)
+	}
+	host, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid listen address: %s: %w", addr, err)
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid listen address: %s: invalid port", addr)
+	}
+	return host, port, nil
+}
+
+func importsModule(mod wazero.CompiledModule, name string) bool {
+	for _, f := range mod.ImportedFunctions() {
+		if moduleName, _, _ := f.Import(); moduleName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCustomSection(mod wazero.CompiledModule, name string) bool {
+	for _, section := range mod.CustomSections() {
+		if section.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func writeGrowTimeline(path string, grow *wzprof.GrowProfiler) {
+	progress.Printf("writing guest memory growth timeline to %s", path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing memory growth timeline:", err)
+		return
+	}
+	defer f.Close()
+	if err := grow.WriteTrace(f); err != nil {
+		stderr.Print("writing memory growth timeline:", err)
+	}
+}
+
+func writeCoverage(path, format string, write func(io.Writer) error) {
+	progress.Printf("writing guest coverage in the %s format to %s", format, path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing coverage:", err)
+		return
+	}
+	defer f.Close()
+	if err := write(f); err != nil {
+		stderr.Print("writing coverage:", err)
+	}
+}
+
+func writeCoreDump(path string, core *wzprof.CoreDumper) {
+	progress.Printf("writing guest coredump to %s", path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing coredump:", err)
+		return
+	}
+	defer f.Close()
+	if err := core.WriteCoreDump(f); err != nil {
+		stderr.Print("writing coredump:", err)
+	}
+}
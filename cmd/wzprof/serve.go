@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// serve runs an HTTP server instantiating the module for each request, until
+// the context is canceled.
+//
+// wazero does not implement the component model, so handlers of the wasi-http
+// proxy world cannot run. The module is instead run as a WASI command
+// following the conventions of the WebAssembly Gateway Interface (WAGI), which
+// are those of CGI: the request is described by environment variables and its
+// body is the standard input of the guest, which writes the headers and body
+// of the response to its standard output.
+func (prog *program) serve(ctx context.Context, runtime wazero.Runtime, module wazero.CompiledModule, config wazero.ModuleConfig) error {
+	l, err := net.Listen("tcp", prog.serveAddr)
+	if err != nil {
+		return fmt.Errorf("serving wasm module: %w", err)
+	}
+	progress.Printf("serving wasm module at http://%s", l.Addr())
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := prog.handle(ctx, runtime, module, config, w, r); err != nil {
+				stderr.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+				http.Error(w, "wasm module failed to handle the request", http.StatusInternalServerError)
+			}
+		}),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		return fmt.Errorf("serving wasm module: %w", err)
+	}
+	return nil
+}
+
+// handle runs an instance of the module handling the request. The samples
+// recorded while it runs are labeled with the method and path of the request,
+// so the profiles can be broken down by endpoint, and with the trace context
+// of its traceparent header, so the profile of a request can be found from
+// its trace.
+func (prog *program) handle(ctx context.Context, runtime wazero.Runtime, module wazero.CompiledModule, config wazero.ModuleConfig, w http.ResponseWriter, r *http.Request) error {
+	ctx = wzprof.WithLabels(ctx, map[string]string{
+		"http_method": r.Method,
+		"http_path":   r.URL.Path,
+	})
+	if tc, err := wzprof.ParseTraceParent(r.Header.Get("traceparent")); err == nil {
+		ctx = wzprof.WithTraceContext(ctx, tc)
+	}
+
+	var stdout bytes.Buffer
+	config = config.
+		WithName("").
+		WithStdin(r.Body).
+		WithStdout(&stdout)
+	for _, env := range cgiEnv(r) {
+		k, v, _ := strings.Cut(env, "=")
+		config = config.WithEnv(k, v)
+	}
+
+	instance, err := runtime.InstantiateModule(ctx, module, config)
+	if err != nil {
+		return err
+	}
+	if err := instance.Close(ctx); err != nil {
+		return err
+	}
+	return writeCGIResponse(w, &stdout)
+}
+
+// cgiEnv returns the environment variables describing the request to the
+// guest, as defined by RFC 3875.
+func cgiEnv(r *http.Request) []string {
+	host, port, _ := net.SplitHostPort(r.Host)
+	if host == "" {
+		host = r.Host
+	}
+	remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=wzprof/" + version,
+		"SERVER_PROTOCOL=" + r.Proto,
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"REQUEST_METHOD=" + r.Method,
+		"PATH_INFO=" + r.URL.Path,
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"REMOTE_ADDR=" + remoteAddr,
+		"X_FULL_URL=" + r.URL.String(),
+	}
+	if r.ContentLength >= 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(r.ContentLength, 10))
+	}
+	if t := r.Header.Get("Content-Type"); t != "" {
+		env = append(env, "CONTENT_TYPE="+t)
+	}
+	for k, v := range r.Header {
+		k = strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		env = append(env, "HTTP_"+k+"="+strings.Join(v, ", "))
+	}
+	return env
+}
+
+// writeCGIResponse writes the response output by the guest, made of headers
+// followed by an empty line and the body. The status is set by the Status
+// header, and defaults to 302 Found when the guest sets a Location.
+func writeCGIResponse(w http.ResponseWriter, output io.Reader) error {
+	r := textproto.NewReader(bufio.NewReader(output))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("reading response headers: %w", err)
+	}
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("invalid response status: %s", s)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, r.R)
+	return err
+}
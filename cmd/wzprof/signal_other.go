@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// dumpSignals is empty on platforms without SIGUSR1, profiles are then only
+// written when the program exits (the flight recorder can still be dumped
+// through the pprof http endpoint).
+var dumpSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals are the signals triggering a dump of the guest profiles.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
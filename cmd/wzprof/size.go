@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func sizeCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("size", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof size [flags] </path/to/app.wasm>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write a profile of the size of the code of the functions to the specified file.")
+	top := flags.Int("top", 20, "Print the N largest functions to stdout (0 to disable).")
+	demangle := flags.Bool("demangle", true, "Show demangled names of C++ and Rust functions in profiles.")
+	debugInfo := flags.String("debug-info", "", "Read DWARF information from this wasm module (e.g. the unstripped build of the program) instead of the profiled one.")
+	var trimPath, sourceMap stringList
+	flags.Var(&trimPath, "trim-path", "Remove this prefix from the source file names of the profile (e.g. /build/src), may be repeated.")
+	flags.Var(&sourceMap, "source-map-prefix", "Replace a prefix of the source file names of the profile (e.g. -source-map-prefix /build/src=$HOME/src), may be repeated.")
+	var diag diagnostics
+	diag.register(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected the wasm module to profile")
+	}
+	wasmPath := flags.Arg(0)
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	sourcePaths, err := sourcePathOptions(trimPath, sourceMap)
+	if err != nil {
+		return err
+	}
+	wasmCode, err := os.ReadFile(wasmPath)
+	if err != nil {
+		return fmt.Errorf("reading wasm module: %w", err)
+	}
+
+	options := append([]wzprof.ProfilingOption{wzprof.Demangle(*demangle), wzprof.ModulePath(wasmPath)}, sourcePaths...)
+	if *debugInfo != "" {
+		debugInfo, err := os.ReadFile(*debugInfo)
+		if err != nil {
+			return fmt.Errorf("reading debug info: %w", err)
+		}
+		options = append(options, wzprof.DebugInfo(debugInfo))
+	}
+	p := wzprof.ProfilingFor(wasmCode, options...)
+	size := p.SizeProfiler()
+
+	// The module is never run, the interpreter compiles it the fastest.
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().
+		WithDebugInfoEnabled(true).
+		WithCustomSections(true))
+	defer runtime.Close(ctx)
+
+	ctx = context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, size)
+	compiledModule, err := runtime.CompileModule(ctx, wasmCode)
+	if err != nil {
+		return fmt.Errorf("compiling wasm module: %w", err)
+	}
+	if err := p.Prepare(compiledModule); err != nil {
+		return fmt.Errorf("preparing wasm module: %w", err)
+	}
+
+	prof, err := size.NewProfile()
+	if err != nil {
+		return err
+	}
+	if *top > 0 {
+		if err := wzprof.WriteTop(os.Stdout, prof, *top); err != nil {
+			return err
+		}
+	}
+	if *output != "" {
+		progress.Printf("writing size profile to %s (%d functions)", *output, len(prof.Sample))
+		return wzprof.WriteProfile(*output, prof)
+	}
+	return nil
+}
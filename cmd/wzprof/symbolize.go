@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tetratelabs/wazero"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func symbolizeCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("symbolize", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof symbolize [flags] <raw.pprof> </path/to/app.wasm>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the symbolized profile to the specified file (default to replacing the raw profile).")
+	demangle := flags.Bool("demangle", true, "Show demangled names of C++ and Rust functions in profiles.")
+	debugInfo := flags.String("debug-info", "", "Read DWARF information from this wasm module (e.g. the unstripped build of the program) instead of the profiled one.")
+	var trimPath, sourceMap stringList
+	flags.Var(&trimPath, "trim-path", "Remove this prefix from the source file names of the profile (e.g. /build/src), may be repeated.")
+	flags.Var(&sourceMap, "source-map-prefix", "Replace a prefix of the source file names of the profile (e.g. -source-map-prefix /build/src=$HOME/src), may be repeated.")
+	precise := flags.Bool("precise-locations", false, "Resolve the locations of the profile to the source lines of the statements making the calls, including the calls of inlined functions.")
+	var diag diagnostics
+	diag.register(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected a raw profile and the wasm module it was collected for")
+	}
+	profilePath, wasmPath := flags.Arg(0), flags.Arg(1)
+	if *output == "" {
+		*output = profilePath
+	}
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	sourcePaths, err := sourcePathOptions(trimPath, sourceMap)
+	if err != nil {
+		return err
+	}
+
+	prof, err := readProfile(profilePath)
+	if err != nil {
+		return err
+	}
+	wasmCode, err := os.ReadFile(wasmPath)
+	if err != nil {
+		return fmt.Errorf("reading wasm module: %w", err)
+	}
+
+	options := append([]wzprof.ProfilingOption{wzprof.Demangle(*demangle), wzprof.PreciseLocations(*precise)}, sourcePaths...)
+	if *debugInfo != "" {
+		debugInfo, err := os.ReadFile(*debugInfo)
+		if err != nil {
+			return fmt.Errorf("reading debug info: %w", err)
+		}
+		options = append(options, wzprof.DebugInfo(debugInfo))
+	}
+	p := wzprof.ProfilingFor(wasmCode, options...)
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithDebugInfoEnabled(true).
+		WithCustomSections(true))
+	defer runtime.Close(ctx)
+
+	compiledModule, err := runtime.CompileModule(ctx, wasmCode)
+	if err != nil {
+		return fmt.Errorf("compiling wasm module: %w", err)
+	}
+	if err := p.Prepare(compiledModule); err != nil {
+		return fmt.Errorf("preparing wasm module: %w", err)
+	}
+
+	if err := p.SymbolizeProfile(prof); err != nil {
+		return fmt.Errorf("symbolizing %s: %w", profilePath, err)
+	}
+	return wzprof.WriteProfile(*output, prof)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func topCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof top [flags] <profile.pprof>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Write the table to the specified file instead of stdout.")
+	sampleIndex := flags.String("sample_index", "", "Name of the sample type to rank the functions by (default to the last sample type).")
+	limit := flags.Int("n", 20, "Maximum number of functions to print (0 for no limit).")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one profile to print")
+	}
+
+	prof, err := readProfile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *sampleIndex != "" {
+		if _, err := wzprof.SampleTypeIndex(prof, *sampleIndex); err != nil {
+			return err
+		}
+		prof.DefaultSampleType = *sampleIndex
+	}
+
+	if *output == "" {
+		return wzprof.WriteTop(os.Stdout, prof, *limit)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := wzprof.WriteTop(f, prof, *limit); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
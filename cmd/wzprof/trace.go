@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+func traceCommand(ctx context.Context, args []string) error {
+	var (
+		match      string
+		output     string
+		diag       diagnostics
+		mounts     string
+		env        stringList
+		invokeName string
+	)
+
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: wzprof trace [flags] </path/to/app.wasm> [--] [args...]\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&match, "match", "", "Regular expression selecting the functions whose calls are traced (default to all functions).")
+	flags.StringVar(&output, "o", "", "Write the calls to the specified file instead of stderr.")
+	diag.register(flags)
+	flags.StringVar(&mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
+	flags.Var(&env, "env", "Set an environment variable of the guest (e.g. -env KEY=VALUE), may be repeated.")
+	flags.StringVar(&invokeName, "invoke", "", "Call the function exported under this name instead of _start, passing the arguments following the module path.")
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 1 {
+		flags.Usage()
+		return fmt.Errorf("missing path to the wasm module")
+	}
+
+	if err := diag.setup(); err != nil {
+		return err
+	}
+
+	filePath, args := args[0], args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	prog := &program{
+		filePath:   filePath,
+		args:       args,
+		format:     "pprof",
+		sampleRate: 1,
+		demangle:   true,
+		mounts:     split(mounts),
+		env:        env,
+		invoke:     invokeName,
+		trace:      os.Stderr,
+	}
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return fmt.Errorf("invalid -match expression: %w", err)
+		}
+		prog.traceMatch = re
+	}
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		prog.trace = f
+	}
+	return prog.run(ctx)
+}
@@ -0,0 +1,354 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// CoreDumper records the state of the guest when it traps, which is written as
+// a WebAssembly coredump to be inspected post-mortem with tools like wasmgdb.
+// The format of coredumps is described in
+// https://github.com/WebAssembly/tool-conventions/blob/main/Coredump.md
+//
+// The coredump holds the stack of calls in progress when the guest trapped,
+// and the content of its linear memory and globals. Function listeners cannot
+// observe the locals and the operand stack of functions, the locals of the
+// frames are the parameters that the functions were called with, and their
+// operand stacks are empty. The instruction which trapped is not known either,
+// the innermost frame points at the start of its function, and the other ones
+// at the instructions calling the next frame. wazero only maps the program
+// counters to instructions for modules with DWARF information, the frames of
+// other modules point at the start of their functions.
+//
+// Exits of the guest (e.g. with proc_exit) are not traps and do not produce
+// coredumps.
+type CoreDumper struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	calls  instanceState[coreCallStack]
+	bodies []wasmFunctionBody
+	core   *coreDump
+}
+
+// coreCallStack is the stack of calls in progress of an instance of the guest,
+// the coredump holds the stack of the instance which trapped.
+type coreCallStack struct {
+	calls []coreCall
+	// Whether the calls in progress are aborting, the state of the guest is
+	// only captured by the innermost one.
+	unwind bool
+}
+
+// coreCall is a call in progress of a function of the guest.
+type coreCall struct {
+	fn     experimental.InternalFunction
+	pc     experimental.ProgramCounter // zero if the function calls no other
+	index  uint32
+	params []uint64
+	types  []api.ValueType
+}
+
+type coreDump struct {
+	name    string
+	frames  []coreFrame // innermost first
+	memory  []byte
+	globals []coreGlobal
+}
+
+type coreFrame struct {
+	index  uint32
+	offset uint64
+	params []uint64
+	types  []api.ValueType
+}
+
+type coreGlobal struct {
+	typ   api.ValueType
+	value uint64
+}
+
+func newCoreDumper(p *Profiling) *CoreDumper {
+	return &CoreDumper{p: p}
+}
+
+// Trapped reports whether the guest trapped, in which case WriteCoreDump
+// writes the state of the guest at the time of the last trap.
+func (d *CoreDumper) Trapped() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.core != nil
+}
+
+// WriteCoreDump writes the coredump of the last trap of the guest to w. An
+// error is returned if the guest did not trap.
+func (d *CoreDumper) WriteCoreDump(w io.Writer) error {
+	d.mutex.Lock()
+	core := d.core
+	d.mutex.Unlock()
+
+	if core == nil {
+		return errors.New("the guest did not trap")
+	}
+	_, err := w.Write(core.encode())
+	return err
+}
+
+// NewFunctionListener returns a function listener tracking the calls of the
+// function passed as argument. All the functions of the guest must be tracked
+// to reconstruct its stack, the listeners of the core dumper must not be
+// sampled.
+func (d *CoreDumper) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() != nil {
+		return nil
+	}
+	return coreDumper{d}
+}
+
+type coreDumper struct{ *CoreDumper }
+
+func (d coreDumper) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !si.Next() {
+		return
+	}
+	s := d.calls.load(mod)
+	fn := si.Function()
+	if n := len(s.calls); n > 0 && si.Next() {
+		// The caller is only known when it is a function of the guest,
+		// host functions calling back into the guest are not tracked.
+		if caller := &s.calls[n-1]; si.Function().Definition().Index() == caller.index {
+			caller.fn, caller.pc = si.Function(), si.ProgramCounter()
+		}
+	}
+
+	// The calls are reused to retain the capacity of their parameters.
+	if n := len(s.calls); n < cap(s.calls) {
+		s.calls = s.calls[:n+1]
+	} else {
+		s.calls = append(s.calls, coreCall{})
+	}
+	c := &s.calls[len(s.calls)-1]
+	c.fn, c.pc, c.index = fn, 0, def.Index()
+	c.params = append(c.params[:0], params...)
+	c.types = def.ParamTypes()
+	s.unwind = false
+}
+
+func (d coreDumper) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	d.mutex.Lock()
+	d.calls.load(mod).pop()
+	d.mutex.Unlock()
+}
+
+func (d coreDumper) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// The calls are aborted from the innermost one, the state of the guest
+	// is captured when the first one is.
+	s := d.calls.load(mod)
+	var exitErr *sys.ExitError
+	if !s.unwind && !errors.As(err, &exitErr) {
+		d.core = d.capture(mod, s)
+	}
+	s.unwind = true
+	s.pop()
+}
+
+// pop removes the innermost call from the stack.
+func (s *coreCallStack) pop() {
+	if n := len(s.calls); n > 0 {
+		s.calls = s.calls[:n-1]
+	}
+}
+
+// capture returns the coredump of the current state of the instance of the
+// guest. It must be called with the mutex held.
+func (d coreDumper) capture(mod api.Module, s *coreCallStack) *coreDump {
+	core := &coreDump{
+		name:   mod.Name(),
+		frames: make([]coreFrame, len(s.calls)),
+	}
+	if d.p.path != "" {
+		core.name = filepath.Base(d.p.path)
+	}
+
+	for i := range core.frames {
+		c := &s.calls[len(s.calls)-1-i]
+		f := &core.frames[i]
+		f.index = c.index
+		f.params = append([]uint64(nil), c.params...)
+		f.types = c.types
+		if d.p.hasProgramCounter(c.pc) {
+			f.offset = d.codeOffset(d.p.originalFunction(c.fn).SourceOffsetForPC(c.pc))
+		}
+	}
+
+	if mem := mod.Memory(); mem != nil {
+		b, _ := mem.Read(0, mem.Size())
+		core.memory = append([]byte{}, b...)
+	}
+
+	if m, ok := mod.(experimental.InternalModule); ok {
+		core.globals = make([]coreGlobal, m.NumGlobal())
+		for i := range core.globals {
+			g := m.Global(i)
+			core.globals[i] = coreGlobal{typ: g.Type(), value: g.Get()}
+		}
+	}
+	return core
+}
+
+// codeOffset converts an offset in the code section of the module to an
+// offset relative to the start of the body of the function it is in, which is
+// the code offset of coredump frames. It must be called with the mutex held.
+func (d coreDumper) codeOffset(offset uint64) uint64 {
+	if d.bodies == nil {
+		d.bodies = wasmFunctionBodies(d.p.wasm)
+	}
+	i := sort.Search(len(d.bodies), func(i int) bool { return d.bodies[i].offset > offset })
+	if i == 0 {
+		return offset
+	}
+	return offset - d.bodies[i-1].offset
+}
+
+// wasmFunctionBody is the location of the body of a function in the code
+// section of a wasm module, relative to the start of the section like source
+// offsets.
+type wasmFunctionBody struct {
+	offset uint64
+	size   uint64
+}
+
+// wasmFunctionBodies returns the bodies of the functions in the code section
+// of a wasm module.
+func wasmFunctionBodies(wasm []byte) []wasmFunctionBody {
+	start, size := wasmCodeSection(wasm)
+	if size == 0 {
+		return nil
+	}
+	r := wasmReader{b: wasm[start : start+size]}
+	count := r.uleb()
+	bodies := make([]wasmFunctionBody, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		n := r.uleb()
+		bodies = append(bodies, wasmFunctionBody{offset: uint64(r.i), size: n})
+		r.skip(int(n))
+	}
+	return bodies
+}
+
+// encode returns the coredump as a wasm module: the process and stack are
+// recorded in the "core" and "corestack" custom sections, the memory and
+// globals are defined with their values at the time of the trap.
+func (c *coreDump) encode() []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	section := func(id byte, content []byte) {
+		b = append(b, id)
+		b = binary.AppendUvarint(b, uint64(len(content)))
+		b = append(b, content...)
+	}
+
+	b = appendCustomSection(b, "core", appendName([]byte{0}, c.name))
+
+	stack := appendName([]byte{0}, "main")
+	stack = binary.AppendUvarint(stack, uint64(len(c.frames)))
+	for _, f := range c.frames {
+		stack = append(stack, 0)
+		stack = binary.AppendUvarint(stack, uint64(f.index))
+		stack = binary.AppendUvarint(stack, f.offset)
+		stack = binary.AppendUvarint(stack, uint64(len(f.params)))
+		for i, v := range f.params {
+			stack = appendCoreValue(stack, f.types[i], v)
+		}
+		stack = append(stack, 0) // operand stack
+	}
+	b = appendCustomSection(b, "corestack", stack)
+
+	if c.memory != nil {
+		pages := uint64(len(c.memory)) / wasmPageSize
+		memory := []byte{1, 0x00}
+		section(memorySectionId, binary.AppendUvarint(memory, pages))
+	}
+
+	if len(c.globals) > 0 {
+		globals := binary.AppendUvarint(nil, uint64(len(c.globals)))
+		for _, g := range c.globals {
+			globals = appendGlobal(globals, g)
+		}
+		section(globalSectionId, globals)
+	}
+
+	if c.memory != nil {
+		data := []byte{1, 0x00, 0x41, 0x00, 0x0B} // active segment at offset 0
+		data = binary.AppendUvarint(data, uint64(len(c.memory)))
+		section(dataSectionId, append(data, c.memory...))
+	}
+	return b
+}
+
+func appendCustomSection(b []byte, name string, content []byte) []byte {
+	n := appendName(nil, name)
+	b = append(b, customSectionId)
+	b = binary.AppendUvarint(b, uint64(len(n)+len(content)))
+	b = append(b, n...)
+	return append(b, content...)
+}
+
+func appendName(b []byte, name string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+// appendCoreValue appends the encoding of a value of the frames of coredumps.
+func appendCoreValue(b []byte, t api.ValueType, v uint64) []byte {
+	switch t {
+	case api.ValueTypeI32:
+		return appendSleb128(append(b, t), int64(int32(v)))
+	case api.ValueTypeI64:
+		return appendSleb128(append(b, t), int64(v))
+	case api.ValueTypeF32:
+		return binary.LittleEndian.AppendUint32(append(b, t), uint32(v))
+	case api.ValueTypeF64:
+		return binary.LittleEndian.AppendUint64(append(b, t), v)
+	default:
+		return append(b, 0x01) // missing
+	}
+}
+
+// appendGlobal appends the definition of a mutable global initialized to the
+// value of g.
+func appendGlobal(b []byte, g coreGlobal) []byte {
+	b = append(b, g.typ, 0x01)
+	switch g.typ {
+	case api.ValueTypeI32:
+		b = appendSleb128(append(b, 0x41), int64(int32(g.value)))
+	case api.ValueTypeI64:
+		b = appendSleb128(append(b, 0x42), int64(g.value))
+	case api.ValueTypeF32:
+		b = binary.LittleEndian.AppendUint32(append(b, 0x43), uint32(g.value))
+	case api.ValueTypeF64:
+		b = binary.LittleEndian.AppendUint64(append(b, 0x44), g.value)
+	case 0x7B: // v128
+		// Only the low 64 bits of vectors are exposed by wazero.
+		b = append(b, 0xFD, 0x0C)
+		b = binary.LittleEndian.AppendUint64(b, g.value)
+		b = binary.LittleEndian.AppendUint64(b, 0)
+	default:
+		// References cannot be restored, they are null in the coredump.
+		b = append(b, 0xD0, g.typ)
+	}
+	return append(b, 0x0B)
+}
@@ -0,0 +1,103 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func TestCoreDumper(t *testing.T) {
+	d := ProfilingFor(nil).CoreDumper()
+
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(mem,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module, int32, int64) {}),
+	)
+	module.Globals = []*wazerotest.Global{wazerotest.GlobalI32(4096)}
+	mem.Bytes[42] = 0xFF
+
+	// The listeners of wazerotest functions are created directly, they would
+	// be skipped as host functions.
+	lstn := coreDumper{d}
+	stack0 := []experimental.StackFrame{{Function: module.Function(0)}}
+	stack1 := []experimental.StackFrame{{Function: module.Function(1)}, {Function: module.Function(0), PC: 1}}
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[0].Function.Definition()
+	ctx := context.Background()
+
+	call := func(err error) {
+		lstn.Before(ctx, module, def0, nil, &testStackIterator{index: -1, frames: stack0})
+		lstn.Before(ctx, module, def1, []uint64{api.EncodeI32(-1), 42}, &testStackIterator{index: -1, frames: stack1})
+		lstn.Abort(ctx, module, def1, err)
+		lstn.Abort(ctx, module, def0, err)
+	}
+
+	call(sys.NewExitError(1))
+	if d.Trapped() {
+		t.Fatal("exit of the guest recorded as a trap")
+	}
+	if err := d.WriteCoreDump(&bytes.Buffer{}); err == nil {
+		t.Error("coredump written without trap")
+	}
+
+	call(errors.New("wasm error: unreachable"))
+	if !d.Trapped() {
+		t.Fatal("trap not recorded")
+	}
+	var buf bytes.Buffer
+	if err := d.WriteCoreDump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	if !bytes.HasPrefix(b, []byte("\x00asm\x01\x00\x00\x00")) {
+		t.Fatalf("coredump is not a wasm module: %x", b[:8])
+	}
+	if core := wasmCustomSection(b, "core"); !bytes.Equal(core, appendName([]byte{0}, module.Name())) {
+		t.Errorf("wrong process info: %x", core)
+	}
+
+	want := appendName([]byte{0}, "main")
+	want = append(want,
+		2,                      // frames
+		0, 1, 0, 2, 0x7F, 0x7F, // $1 at offset 0, locals (i32 -1)
+		0x7E, 42, 0, // (i64 42), empty stack
+		0, 0, 0, 0, 0, // $0, no locals, empty stack
+	)
+	if stack := wasmCustomSection(b, "corestack"); !bytes.Equal(stack, want) {
+		t.Errorf("wrong stack:\nwant=%x\ngot= %x", want, stack)
+	}
+
+	data := wasmdataSection(b)
+	if data == nil {
+		t.Fatal("missing data section")
+	}
+	it := newDataIterator(data)
+	addr, seg := it.Next()
+	if addr != 0 || len(seg) != wazerotest.PageSize || seg[42] != 0xFF {
+		t.Errorf("wrong memory in the data section: address=%d size=%d", addr, len(seg))
+	}
+}
+
+func TestCoreDumperCodeOffset(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := coreDumper{ProfilingFor(wasm).CoreDumper()}
+	bodies := wasmFunctionBodies(wasm)
+	if len(bodies) < 2 {
+		t.Fatalf("wrong number of function bodies: %d", len(bodies))
+	}
+	if offset := d.codeOffset(bodies[1].offset + 3); offset != 3 {
+		t.Errorf("wrong code offset: want=3 got=%d", offset)
+	}
+}
@@ -0,0 +1,204 @@
+package wzprof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// CoverageProfiler is the implementation of a recorder of the coverage of the
+// source code of the guest: which lines and functions were executed during a
+// run, and how many times. The coverage is written in the formats of the
+// coverage tools of Go (WriteGoCoverProfile) and of LCOV (WriteLCOV), so the
+// integration tests of wasm programs can report coverage without rebuilding
+// them with coverage instrumentation.
+//
+// The module must be instrumented with Profiling.CountOpcodes, which counts
+// the executions of the instructions of the functions selected by Focus and
+// Ignore. Each instruction is attributed to the line of its statement in the
+// DWARF information of the module: the coverage is only available for
+// languages compiling to DWARF (e.g. C, C++, Rust or Zig), and lines of
+// functions without it are not reported. A line is covered if one of its
+// instructions was executed, its count is the highest number of executions of
+// its instructions.
+type CoverageProfiler struct {
+	segmentCounter
+}
+
+func newCoverageProfiler(p *Profiling) *CoverageProfiler {
+	return &CoverageProfiler{newSegmentCounter(p)}
+}
+
+// StartProfile begins recording the coverage. The method returns a boolean to
+// indicate whether starting the profile succeeded (e.g. false is returned if
+// it was already started).
+func (p *CoverageProfiler) StartProfile() bool {
+	return p.startProfile()
+}
+
+// StopProfile stops recording and returns the coverage of the source files of
+// the module. An error is returned if recording wasn't started, or if no line
+// of the module was found in its DWARF information.
+func (p *CoverageProfiler) StopProfile() (*Coverage, error) {
+	counts, _, defs := p.stopProfile()
+	if counts == nil {
+		return nil, errors.New("coverage recording was not started")
+	}
+
+	files := make(map[string]*FileCoverage)
+	lines := make(map[*FileCoverage]map[int64]int64)
+	file := func(name string) *FileCoverage {
+		f := files[name]
+		if f == nil {
+			f = &FileCoverage{Name: name}
+			files[name] = f
+			lines[f] = make(map[int64]int64)
+		}
+		return f
+	}
+
+	segments := p.p.countedSegments
+	for i, seg := range segments {
+		def := defs[seg.function]
+		if def == nil {
+			continue
+		}
+		// The first segment of a function starts at its entry, the
+		// function was called as many times as it was executed.
+		entry := i == 0 || segments[i-1].function != seg.function
+		for _, instr := range seg.instructions {
+			call := p.p.symbolizeWith(p.p.symbols, sizeFunction{def: def, offset: instr.offset}, 1, true)
+			if !call.symbolFound {
+				continue
+			}
+			name, line := p.statement(call.locations)
+			if name == "" || line <= 0 {
+				continue
+			}
+			f := file(name)
+			if n, ok := lines[f][line]; !ok || counts[i] > n {
+				lines[f][line] = counts[i]
+			}
+			if entry {
+				entry = false
+				fn := call.locations[0]
+				startLine := fn.StartLine
+				if startLine <= 0 {
+					startLine = line
+				}
+				f.Functions = append(f.Functions, FunctionCoverage{
+					Name:  fn.HumanName,
+					Line:  startLine,
+					Count: counts[i],
+				})
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no source lines found in the DWARF information of the module")
+	}
+
+	c := &Coverage{Files: make([]*FileCoverage, 0, len(files))}
+	for _, f := range files {
+		for line, count := range lines[f] {
+			f.Lines = append(f.Lines, LineCoverage{Line: line, Count: count})
+		}
+		sort.Slice(f.Lines, func(i, j int) bool { return f.Lines[i].Line < f.Lines[j].Line })
+		sort.Slice(f.Functions, func(i, j int) bool {
+			if f.Functions[i].Line != f.Functions[j].Line {
+				return f.Functions[i].Line < f.Functions[j].Line
+			}
+			return f.Functions[i].Name < f.Functions[j].Name
+		})
+		c.Files = append(c.Files, f)
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Name < c.Files[j].Name })
+	return c, nil
+}
+
+// statement returns the file and line of the statement of a symbolized
+// instruction, which is the one of the outermost location unless precise
+// locations moved it to the innermost inlined function.
+func (p *CoverageProfiler) statement(locations []location) (string, int64) {
+	loc := locations[0]
+	if p.p.preciseLocations {
+		loc = locations[len(locations)-1]
+	}
+	return loc.File, loc.Line
+}
+
+// Coverage is the coverage of the source files of a module, sorted by name.
+type Coverage struct {
+	Files []*FileCoverage
+}
+
+// FileCoverage is the coverage of a source file, its lines and functions are
+// sorted by line.
+type FileCoverage struct {
+	Name      string
+	Lines     []LineCoverage
+	Functions []FunctionCoverage
+}
+
+// LineCoverage is the number of times a line of a source file was executed.
+type LineCoverage struct {
+	Line  int64
+	Count int64
+}
+
+// FunctionCoverage is the number of times a function was called, and the line
+// it is declared at.
+type FunctionCoverage struct {
+	Name  string
+	Line  int64
+	Count int64
+}
+
+// WriteGoCoverProfile writes the coverage to w in the format of the coverage
+// profiles of Go (go test -coverprofile) in count mode, which tools consuming
+// Go coverage like go tool cover -func or coverage services accept. Each line
+// is a block of one statement, from the start of the line to the start of the
+// next one.
+func (c *Coverage) WriteGoCoverProfile(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("mode: count\n")
+	for _, f := range c.Files {
+		for _, l := range f.Lines {
+			fmt.Fprintf(b, "%s:%d.1,%d.0 1 %d\n", f.Name, l.Line, l.Line+1, l.Count)
+		}
+	}
+	return b.Flush()
+}
+
+// WriteLCOV writes the coverage to w in the tracefile format of LCOV, which
+// genhtml and coverage services accept.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, f := range c.Files {
+		b.WriteString("TN:\n")
+		fmt.Fprintf(b, "SF:%s\n", f.Name)
+		hit := 0
+		for _, fn := range f.Functions {
+			fmt.Fprintf(b, "FN:%d,%s\n", fn.Line, fn.Name)
+		}
+		for _, fn := range f.Functions {
+			fmt.Fprintf(b, "FNDA:%d,%s\n", fn.Count, fn.Name)
+			if fn.Count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(b, "FNF:%d\nFNH:%d\n", len(f.Functions), hit)
+		hit = 0
+		for _, l := range f.Lines {
+			fmt.Fprintf(b, "DA:%d,%d\n", l.Line, l.Count)
+			if l.Count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(b, "LF:%d\nLH:%d\n", len(f.Lines), hit)
+		b.WriteString("end_of_record\n")
+	}
+	return b.Flush()
+}
@@ -0,0 +1,64 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testCoverage() *Coverage {
+	return &Coverage{Files: []*FileCoverage{{
+		Name: "/src/main.c",
+		Lines: []LineCoverage{
+			{Line: 2, Count: 3},
+			{Line: 3, Count: 0},
+			{Line: 6, Count: 1},
+		},
+		Functions: []FunctionCoverage{
+			{Name: "compute", Line: 1, Count: 3},
+			{Name: "main", Line: 5, Count: 1},
+			{Name: "unused", Line: 8, Count: 0},
+		},
+	}}}
+}
+
+func TestWriteGoCoverProfile(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := testCoverage().WriteGoCoverProfile(b); err != nil {
+		t.Fatal(err)
+	}
+	const want = `mode: count
+/src/main.c:2.1,3.0 1 3
+/src/main.c:3.1,4.0 1 0
+/src/main.c:6.1,7.0 1 1
+`
+	if b.String() != want {
+		t.Errorf("wrong Go coverage profile:\nwant:\n%s\ngot:\n%s", want, b)
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := testCoverage().WriteLCOV(b); err != nil {
+		t.Fatal(err)
+	}
+	const want = `TN:
+SF:/src/main.c
+FN:1,compute
+FN:5,main
+FN:8,unused
+FNDA:3,compute
+FNDA:1,main
+FNDA:0,unused
+FNF:3
+FNH:2
+DA:2,3
+DA:3,0
+DA:6,1
+LF:3
+LH:2
+end_of_record
+`
+	if b.String() != want {
+		t.Errorf("wrong LCOV tracefile:\nwant:\n%s\ngot:\n%s", want, b)
+	}
+}
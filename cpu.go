@@ -3,8 +3,8 @@ package wzprof
 import (
 	"context"
 	"net/http"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/pprof/profile"
@@ -17,16 +17,131 @@ import (
 //
 // The profiler generates samples of two types:
 // - "sample" counts the number of function calls.
-// - "cpu" records the time spent in function calls (in nanoseconds).
+// - "cpu" records the time spent in function calls (in nanoseconds), excluding
+// the time spent in their children.
+//
+// The profiler can be shared by instances of the module running concurrently,
+// the calls in progress are tracked per instance and the samples are
+// aggregated in shards which are merged when the profile is built.
 type CPUProfiler struct {
-	p      *Profiling
+	p       *Profiling
+	mutex   sync.Mutex // serializes the changes of the profile and pause states
+	gen     uint64
+	profile atomic.Pointer[cpuProfile]
+	stacks  sync.Map // api.Module => *cpuCallStack
+	nstacks atomic.Int64
+	time    func() int64
+	host    bool
+	// The guest pauses recording with the host module, the time spent
+	// paused is not accounted to the calls in progress.
+	paused atomic.Pointer[cpuPause]
+}
+
+// cpuProfile is a CPU profile being recorded. Samples are sharded by stack so
+// that calls made concurrently rarely contend on the same lock, the shards are
+// merged when the profile is collected.
+type cpuProfile struct {
+	// Generation of the profile, incremented each time the profiler starts
+	// recording new samples, and the time at which it started. Calls in
+	// progress when the profile starts are only accounted the time spent
+	// since.
+	gen       uint64
+	start     time.Time
+	startTime int64
+	paused    int64 // time spent paused when the profile started
+	shards    [cpuProfileShards]cpuProfileShard
+}
+
+const cpuProfileShards = 16
+
+type cpuProfileShard struct {
 	mutex  sync.Mutex
 	counts stackCounterMap
+	_      [48]byte // avoid false sharing between shards
+}
+
+func (prof *cpuProfile) observe(st stackTrace, value int64) {
+	shard := &prof.shards[st.key%cpuProfileShards]
+	shard.mutex.Lock()
+	if shard.counts != nil {
+		shard.counts.observe(st, value)
+	}
+	shard.mutex.Unlock()
+}
+
+// collect takes the samples of the profile, the samples observed after the
+// profile was collected are discarded.
+func (prof *cpuProfile) collect() stackCounterMap {
+	samples := make(stackCounterMap)
+	for i := range prof.shards {
+		shard := &prof.shards[i]
+		shard.mutex.Lock()
+		for k, sc := range shard.counts {
+			samples[k] = sc
+		}
+		shard.counts = nil
+		shard.mutex.Unlock()
+	}
+	return samples
+}
+
+// snapshot returns a copy of the samples recorded so far.
+func (prof *cpuProfile) snapshot() stackCounterMap {
+	samples := make(stackCounterMap)
+	for i := range prof.shards {
+		shard := &prof.shards[i]
+		shard.mutex.Lock()
+		for k, sc := range shard.counts {
+			c := *sc
+			samples[k] = &c
+		}
+		shard.mutex.Unlock()
+	}
+	return samples
+}
+
+func (prof *cpuProfile) len() (n int) {
+	for i := range prof.shards {
+		shard := &prof.shards[i]
+		shard.mutex.Lock()
+		n += len(shard.counts)
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+// cpuCallStack is the stack of calls in progress of a module instance, with a
+// free list of stack traces to reuse.
+type cpuCallStack struct {
 	frames []cpuTimeFrame
 	traces []stackTrace
-	time   func() int64
-	start  time.Time
-	host   bool
+	// Time spent in the Before/After methods of the listeners of the
+	// instance, which is not accounted to its calls in progress so functions
+	// called often do not appear more expensive than they are. Instances
+	// running concurrently do not delay the calls of each other, the
+	// overhead is tracked separately for each of them.
+	overhead int64
+	// Overhead of the instance when it first observed the profile of
+	// generation gen, the calls which started before the profile are only
+	// accounted the overhead since.
+	gen         uint64
+	genOverhead int64
+}
+
+// observe records the overhead of the instance when it first observes the
+// profile.
+func (s *cpuCallStack) observe(prof *cpuProfile) {
+	if s.gen != prof.gen {
+		s.gen, s.genOverhead = prof.gen, s.overhead
+	}
+}
+
+// cpuPause is the pause state of the CPU profiler, which is replaced as a
+// whole so listeners read a consistent state without locking.
+type cpuPause struct {
+	paused bool
+	at     int64 // time at which the profiler was paused
+	total  int64 // time spent paused before
 }
 
 // CPUProfilerOption is a type used to represent configuration options for
@@ -50,9 +165,18 @@ func TimeFunc(time func() int64) CPUProfilerOption {
 }
 
 type cpuTimeFrame struct {
-	start int64
-	sub   int64
-	trace stackTrace
+	start    int64
+	excluded int64 // time excluded from calls when the call started
+	gen      uint64
+	// Time spent in the children of the call during the profile of
+	// generation subGen, which is subtracted from the call duration so
+	// samples record the self time of functions.
+	sub    int64
+	subGen uint64
+	trace  stackTrace
+	// Whether recording was paused when the call started, the call is not
+	// recorded if it also ended before recording was resumed.
+	skip bool
 }
 
 func newCPUProfiler(p *Profiling, options ...CPUProfilerOption) *CPUProfiler {
@@ -73,29 +197,118 @@ func (p *CPUProfiler) StartProfile() bool {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if p.counts != nil {
+	if p.profile.Load() != nil {
 		return false // already started
 	}
 
-	p.counts = make(stackCounterMap)
-	p.start = time.Now()
+	p.profile.Store(p.newProfile())
 	return true
 }
 
+// newProfile creates the profile of a new generation. The mutex must be held.
+func (p *CPUProfiler) newProfile() *cpuProfile {
+	p.gen++
+	now := p.time()
+	prof := &cpuProfile{
+		gen:       p.gen,
+		start:     time.Now(),
+		startTime: now,
+		paused:    p.timePaused(now),
+	}
+	for i := range prof.shards {
+		prof.shards[i].counts = make(stackCounterMap)
+	}
+	return prof
+}
+
 // StopProfile stops recording and returns the CPU profile. The method returns
 // nil if recording of the CPU profile wasn't started.
 func (p *CPUProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	prof := p.profile.Swap(nil)
+	if prof == nil {
+		return nil
+	}
+	return p.buildProfile(prof.collect(), prof.start, time.Since(prof.start), sampleRate)
+}
+
+// SnapshotProfile returns the CPU profile recorded since the profile was
+// started, without stopping it. The method returns nil if recording of the
+// CPU profile wasn't started.
+func (p *CPUProfiler) SnapshotProfile(sampleRate float64) *profile.Profile {
+	prof := p.profile.Load()
+	if prof == nil {
+		return nil
+	}
+	return p.buildProfile(prof.snapshot(), prof.start, time.Since(prof.start), sampleRate)
+}
+
+// pause stops accounting time to calls until resume is called, without
+// stopping the profile.
+func (p *CPUProfiler) pause() {
 	p.mutex.Lock()
-	samples, start := p.counts, p.start
-	p.counts = nil
+	if s := p.pauseState(); !s.paused {
+		p.paused.Store(&cpuPause{paused: true, at: p.time(), total: s.total})
+	}
 	p.mutex.Unlock()
+}
 
-	if samples == nil {
-		return nil
+func (p *CPUProfiler) resume() {
+	p.mutex.Lock()
+	if s := p.pauseState(); s.paused {
+		p.paused.Store(&cpuPause{total: s.total + (p.time() - s.at)})
 	}
+	p.mutex.Unlock()
+}
 
-	duration := time.Since(start)
+func (p *CPUProfiler) pauseState() cpuPause {
+	if s := p.paused.Load(); s != nil {
+		return *s
+	}
+	return cpuPause{}
+}
 
+// timePaused returns the total time spent paused at now.
+func (p *CPUProfiler) timePaused(now int64) int64 {
+	s := p.pauseState()
+	if s.paused {
+		return s.total + (now - s.at)
+	}
+	return s.total
+}
+
+// timeExcluded returns the total time spent paused or in the listeners of the
+// instance at now, which is not accounted to its calls.
+func (p *CPUProfiler) timeExcluded(stack *cpuCallStack, now int64) int64 {
+	return p.timePaused(now) + stack.overhead
+}
+
+// addOverhead records time spent in the listeners of the instance. The
+// overhead is already excluded from calls while recording is paused.
+func (p *CPUProfiler) addOverhead(stack *cpuCallStack, start, end int64) {
+	if !p.pauseState().paused {
+		stack.overhead += end - start
+	}
+}
+
+// swapProfile replaces the samples recorded by the profiler with an empty set,
+// returning the previous samples and the time at which they started to be
+// recorded. The method returns nil if recording of the CPU profile wasn't
+// started.
+func (p *CPUProfiler) swapProfile() (stackCounterMap, time.Time) {
+	p.mutex.Lock()
+	prof := p.profile.Load()
+	if prof != nil {
+		p.profile.Store(p.newProfile())
+	}
+	p.mutex.Unlock()
+
+	if prof == nil {
+		return nil, time.Time{}
+	}
+	return prof.collect(), prof.start
+}
+
+func (p *CPUProfiler) buildProfile(samples stackCounterMap, start time.Time, duration time.Duration, sampleRate float64) *profile.Profile {
 	if !p.host {
 		for k, sample := range samples {
 			if sample.stack.host() {
@@ -126,10 +339,10 @@ func (p *CPUProfiler) Desc() string {
 
 // Count returns the number of execution stacks currently recorded in p.
 func (p *CPUProfiler) Count() int {
-	p.mutex.Lock()
-	n := len(p.counts)
-	p.mutex.Unlock()
-	return n
+	if prof := p.profile.Load(); prof != nil {
+		return prof.len()
+	}
+	return 0
 }
 
 // SampleType returns the set of value types present in samples recorded by the
@@ -151,52 +364,15 @@ func (p *CPUProfiler) SampleType() []*profile.ValueType {
 // The symbolizer passed as argument is used to resolve names of program
 // locations recorded in the profile.
 func (p *CPUProfiler) NewHandler(sampleRate float64) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		duration := 30 * time.Second
-
-		if seconds := r.FormValue("seconds"); seconds != "" {
-			n, err := strconv.ParseInt(seconds, 10, 64)
-			if err == nil && n > 0 {
-				duration = time.Duration(n) * time.Second
-			}
-		}
-
-		ctx := r.Context()
-		deadline, ok := ctx.Deadline()
-		if ok {
-			if timeout := time.Until(deadline); duration > timeout {
-				serveError(w, http.StatusBadRequest, "profile duration exceeds server's WriteTimeout")
-				return
-			}
-		}
-
-		if !p.StartProfile() {
-			serveError(w, http.StatusInternalServerError, "Could not enable CPU profiling: profiler already running")
-			return
-		}
-
-		timer := time.NewTimer(duration)
-		select {
-		case <-timer.C:
-		case <-ctx.Done():
-		}
-		timer.Stop()
-		serveProfile(w, p.StopProfile(sampleRate))
+	return newDurationHandler("CPU", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
 	})
 }
 
 // NewFunctionListener returns a function listener suited to record CPU timings
 // of calls to the function passed as argument.
 func (p *CPUProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
-	name := def.Name()
-	if len(p.p.onlyFunctions) > 0 {
-		_, keep := p.p.onlyFunctions[name]
-		if !keep {
-			return nil
-		}
-	}
-	_, skip := p.p.filteredFunctions[name]
-	if skip {
+	if !p.p.instrumented(def) {
 		return nil
 	}
 	return profilingListener{p.p, cpuProfiler{p}}
@@ -204,47 +380,111 @@ func (p *CPUProfiler) NewFunctionListener(def api.FunctionDefinition) experiment
 
 type cpuProfiler struct{ *CPUProfiler }
 
+// callStack returns the stack of calls in progress of the module instance.
+// The stacks of closed instances are dropped from time to time when new ones
+// are added, so they are not retained.
+func (p *CPUProfiler) callStack(mod api.Module) *cpuCallStack {
+	if s, ok := p.stacks.Load(mod); ok {
+		return s.(*cpuCallStack)
+	}
+	depth := p.p.maxStackDepth.Load()
+	s, loaded := p.stacks.LoadOrStore(mod, &cpuCallStack{
+		frames: make([]cpuTimeFrame, 0, depth),
+		traces: make([]stackTrace, 0, depth),
+	})
+	if !loaded && p.nstacks.Add(1)%cpuCallStackSweep == 0 {
+		p.stacks.Range(func(k, _ any) bool {
+			if k.(api.Module).IsClosed() {
+				p.stacks.Delete(k)
+			}
+			return true
+		})
+	}
+	return s.(*cpuCallStack)
+}
+
+// Number of instances added between sweeps of the call stacks of closed ones.
+const cpuCallStackSweep = 64
+
 func (p cpuProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
 	var frame cpuTimeFrame
-	p.mutex.Lock()
+	stack := p.callStack(mod)
 
-	if p.counts != nil {
+	if prof := p.profile.Load(); prof != nil {
 		start := p.time()
 		trace := stackTrace{}
+		stack.observe(prof)
 
-		if i := len(p.traces); i > 0 {
+		if i := len(stack.traces); i > 0 {
 			i--
-			trace = p.traces[i]
-			p.traces = p.traces[:i]
+			trace = stack.traces[i]
+			stack.traces = stack.traces[:i]
 		}
 
 		frame = cpuTimeFrame{
-			start: start,
-			trace: makeStackTrace(trace, si),
+			gen:    prof.gen,
+			subGen: prof.gen,
+			trace:  p.p.makeStackTrace(ctx, trace, si),
+			skip:   p.pauseState().paused,
 		}
+		// The call starts when the profiler returns, the time spent
+		// capturing the stack is overhead.
+		frame.start = p.time()
+		p.addOverhead(stack, start, frame.start)
+		frame.excluded = p.timeExcluded(stack, frame.start)
 	}
 
-	p.mutex.Unlock()
-	p.frames = append(p.frames, frame)
+	stack.frames = append(stack.frames, frame)
 }
 
 func (p cpuProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
-	i := len(p.frames) - 1
-	f := p.frames[i]
-	p.frames = p.frames[:i]
+	stack := p.callStack(mod)
+	i := len(stack.frames) - 1
+	f := stack.frames[i]
+	stack.frames = stack.frames[:i]
 
 	if f.start != 0 {
-		duration := p.time() - f.start
-		if i := len(p.frames); i > 0 {
-			p.frames[i-1].sub += duration
-		}
-		duration -= f.sub
-		p.mutex.Lock()
-		if p.counts != nil {
-			p.counts.observe(f.trace, duration)
+		now := p.time()
+		if prof := p.profile.Load(); prof != nil {
+			stack.observe(prof)
+			start, excluded := f.start, f.excluded
+			if f.gen != prof.gen {
+				// The call started before the current profile, the time
+				// spent in previous profiles was already accounted to its
+				// children or is not part of this profile.
+				start, excluded = prof.startTime, prof.paused+stack.genOverhead
+			}
+			excluded = p.timeExcluded(stack, now) - excluded
+			if excluded < now-start {
+				f.skip = false
+			}
+			// The clock may be coarser than the time spent in the
+			// listeners, durations are never negative.
+			duration := now - start - excluded
+			if duration < 0 {
+				duration = 0
+			}
+			if i > 0 {
+				parent := &stack.frames[i-1]
+				if parent.subGen != prof.gen {
+					parent.sub, parent.subGen = 0, prof.gen
+				}
+				parent.sub += duration
+			}
+			if f.subGen == prof.gen {
+				if duration -= f.sub; duration < 0 {
+					duration = 0
+				}
+			}
+			if !f.skip {
+				prof.observe(f.trace, duration)
+				if s := f.trace.scope; s != nil && (p.host || !f.trace.host()) {
+					s.observe(s.cpu, f.trace, duration)
+				}
+			}
 		}
-		p.mutex.Unlock()
-		p.traces = append(p.traces, f.trace)
+		p.addOverhead(stack, now, p.time())
+		stack.traces = append(stack.traces, f.trace)
 	}
 }
 
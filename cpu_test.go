@@ -2,6 +2,7 @@ package wzprof
 
 import (
 	"context"
+	"sync"
 	"testing"
 
 	"github.com/tetratelabs/wazero/api"
@@ -95,9 +96,209 @@ func TestCPUProfilerTime(t *testing.T) {
 	d1 := t4 - (t1 + d2)
 	d0 := t5 - (t0 + d1 + d2)
 
-	assertStackCount(t, p.counts, trace0, 1, d0)
-	assertStackCount(t, p.counts, trace1, 1, d1)
-	assertStackCount(t, p.counts, trace2, 1, d2)
+	assertStackCount(t, cpuSamples(p), trace0, 1, d0)
+	assertStackCount(t, cpuSamples(p), trace1, 1, d1)
+	assertStackCount(t, cpuSamples(p), trace2, 1, d2)
+}
+
+func TestCPUProfilerSnapshot(t *testing.T) {
+	currentTime := int64(1)
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f := p.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	def := stack[0].Function.Definition()
+
+	call := func(duration int64) {
+		f.Before(context.Background(), module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(context.Background(), module, def, nil)
+	}
+
+	if p.SnapshotProfile(1) != nil {
+		t.Error("snapshot of a profile which was not started must be nil")
+	}
+
+	p.StartProfile()
+	call(10)
+
+	snapshot := p.SnapshotProfile(1)
+	if len(snapshot.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(snapshot.Sample))
+	}
+	if v := snapshot.Sample[0].Value; v[0] != 1 || v[1] != 10 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+
+	// The profile keeps recording after the snapshot, which is not modified.
+	call(20)
+
+	prof := p.StopProfile(1)
+	if v := prof.Sample[0].Value; v[0] != 2 || v[1] != 30 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+	if v := snapshot.Sample[0].Value; v[0] != 1 || v[1] != 10 {
+		t.Errorf("snapshot was modified: %v", v)
+	}
+}
+
+func TestCPUProfilerSelfTime(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	listeners := make([]experimental.FunctionListener, 4)
+	for i := range listeners {
+		listeners[i] = p.NewFunctionListener(module.Function(i).Definition())
+	}
+	main := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	f := append(main, experimental.StackFrame{Function: module.Function(1), PC: 2})
+	g := append(f[:2:2], experimental.StackFrame{Function: module.Function(2), PC: 3})
+	h := append(main, experimental.StackFrame{Function: module.Function(3), PC: 4})
+
+	ctx := context.Background()
+	before := func(now int64, stack []experimental.StackFrame) {
+		currentTime = now
+		fn := stack[len(stack)-1].Function
+		listeners[fn.Definition().Index()].Before(ctx, module, fn.Definition(), nil, experimental.NewStackIterator(stack...))
+	}
+	after := func(now int64, stack []experimental.StackFrame) {
+		currentTime = now
+		fn := stack[len(stack)-1].Function
+		listeners[fn.Definition().Index()].After(ctx, module, fn.Definition(), nil)
+	}
+
+	p.StartProfile()
+	before(1, main)
+	before(2, f)
+	before(4, g)
+	after(7, g)
+	after(9, f)
+
+	// Samples record the self time of calls, the time spent in children is
+	// not accounted to their parents.
+	currentTime = 10
+	samples, _ := p.swapProfile()
+	assertStackCount(t, samples, makeStackTraceFromFrames(g), 1, 3)
+	assertStackCount(t, samples, makeStackTraceFromFrames(f), 1, 4)
+	if c := samples.lookup(makeStackTraceFromFrames(main)); c.count() != 0 {
+		t.Errorf("call in progress was recorded: %d", c.total())
+	}
+
+	// The call in progress when the profile was swapped is only accounted
+	// the time spent in the new profile, so the cumulative time of all the
+	// calls matches the duration of the profile.
+	before(12, h)
+	after(15, h)
+	after(20, main)
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(h), 1, 3)
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(main), 1, 7)
+}
+
+func TestCPUProfilerOverhead(t *testing.T) {
+	// The profiler reads the time when entering and leaving its hooks, the
+	// work done in between is simulated by advancing the time on every other
+	// read.
+	currentTime, reads := int64(0), 0
+	const overhead = 5
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 {
+			now := currentTime
+			if reads++; reads%2 == 1 {
+				currentTime += overhead
+			}
+			return now
+		}),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+	stack0 := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	stack1 := append(stack0, experimental.StackFrame{Function: module.Function(1), PC: 2})
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+	ctx := context.Background()
+
+	currentTime = 1
+	p.StartProfile()
+	reads = 0
+
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	currentTime += 10
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime += 20
+	f1.After(ctx, module, def1, nil)
+	currentTime += 30
+	f0.After(ctx, module, def0, nil)
+
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack1), 1, 20)
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack0), 1, 10+30)
+}
+
+func TestCPUProfilerOverheadPerInstance(t *testing.T) {
+	currentTime, reads := int64(0), 0
+	const overhead = 5
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 {
+			now := currentTime
+			if reads++; reads%2 == 1 {
+				currentTime += overhead
+			}
+			return now
+		}),
+	)
+
+	module0 := wazerotest.NewModule(nil, wazerotest.NewFunction(func(context.Context, api.Module) {}))
+	module1 := wazerotest.NewModule(nil, wazerotest.NewFunction(func(context.Context, api.Module) {}))
+	f0 := p.NewFunctionListener(module0.Function(0).Definition())
+	f1 := p.NewFunctionListener(module1.Function(0).Definition())
+	stack0 := []experimental.StackFrame{{Function: module0.Function(0), PC: 1}}
+	stack1 := []experimental.StackFrame{{Function: module1.Function(0), PC: 2}}
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[0].Function.Definition()
+	ctx := context.Background()
+
+	currentTime = 1
+	p.StartProfile()
+	reads = 0
+
+	f0.Before(ctx, module0, def0, nil, experimental.NewStackIterator(stack0...))
+	currentTime += 10
+	// The second instance runs on another thread, the time spent in its
+	// calls and listeners does not delay the call of the first instance.
+	resumeAt := currentTime
+	f1.Before(ctx, module1, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime += 20
+	f1.After(ctx, module1, def1, nil)
+	currentTime = resumeAt + 30
+	f0.After(ctx, module0, def0, nil)
+
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack1), 1, 20)
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack0), 1, 10+30)
 }
 
 func assertStackCount(t *testing.T, counts stackCounterMap, trace stackTrace, count, total int64) {
@@ -113,6 +314,83 @@ func assertStackCount(t *testing.T, counts stackCounterMap, trace stackTrace, co
 	}
 }
 
+func TestCPUProfilerConcurrently(t *testing.T) {
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+	)
+	p.StartProfile()
+
+	const instances, calls = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each goroutine runs its own instance, with the same functions
+			// and stacks as the others.
+			module := wazerotest.NewModule(nil,
+				wazerotest.NewFunction(func(context.Context, api.Module) {}),
+				wazerotest.NewFunction(func(context.Context, api.Module) {}),
+			)
+			f0 := p.NewFunctionListener(module.Function(0).Definition())
+			f1 := p.NewFunctionListener(module.Function(1).Definition())
+			stack0 := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+			stack1 := append(stack0, experimental.StackFrame{Function: module.Function(1), PC: 2})
+			def0 := stack0[0].Function.Definition()
+			def1 := stack1[1].Function.Definition()
+			ctx := context.Background()
+
+			for j := 0; j < calls; j++ {
+				f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+				f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+				f1.After(ctx, module, def1, nil)
+				f0.After(ctx, module, def0, nil)
+			}
+			module.Close(ctx)
+		}()
+	}
+	wg.Wait()
+
+	prof := p.StopProfile(1)
+	if len(prof.Sample) != 2 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	for _, sample := range prof.Sample {
+		if sample.Value[0] != instances*calls {
+			t.Errorf("wrong number of calls: want=%d got=%d", instances*calls, sample.Value[0])
+		}
+	}
+
+	// The call stacks of closed instances are dropped when new instances are
+	// added.
+	for i := 0; i < cpuCallStackSweep; i++ {
+		module := wazerotest.NewModule(nil)
+		p.callStack(module)
+		module.Close(context.Background())
+	}
+	n := 0
+	p.stacks.Range(func(any, any) bool { n++; return true })
+	if n >= cpuCallStackSweep {
+		t.Errorf("call stacks of %d closed instances retained", n)
+	}
+}
+
+// cpuSamples returns a copy of the samples recorded by the CPU profiler.
+func cpuSamples(p *CPUProfiler) stackCounterMap {
+	return p.profile.Load().snapshot()
+}
+
+// newTestModule returns a module of functions doing nothing with the given
+// names, for the tests calling the listeners of profilers directly.
+func newTestModule(memory *wazerotest.Memory, names ...string) *wazerotest.Module {
+	functions := make([]*wazerotest.Function, len(names))
+	for i, name := range names {
+		functions[i] = wazerotest.NewFunction(func(context.Context, api.Module) {})
+		functions[i].FunctionName = name
+	}
+	return wazerotest.NewModule(memory, functions...)
+}
+
 func makeStackTraceFromFrames(stackFrames []experimental.StackFrame) stackTrace {
-	return makeStackTrace(stackTrace{}, experimental.NewStackIterator(stackFrames...))
+	return ProfilingFor(nil).makeStackTrace(context.Background(), stackTrace{}, experimental.NewStackIterator(stackFrames...))
 }
@@ -0,0 +1,42 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// Name of the custom section holding the build id of a module, which is copied
+// to the module holding its debug information when they are split.
+//
+// https://github.com/WebAssembly/tool-conventions/blob/main/BuildId.md
+const buildIDSection = "build_id"
+
+// wasmBuildID returns the build id of a wasm binary, or nil if it has none.
+func wasmBuildID(b []byte) []byte {
+	section := wasmCustomSection(b, buildIDSection)
+	length, n := binary.Uvarint(section)
+	if n <= 0 || length > uint64(len(section)-n) {
+		return nil
+	}
+	return section[n : n+int(length)]
+}
+
+// debugInfoModule is a compiled module whose DWARF information is read from a
+// separate module, e.g. the unstripped build of a module deployed without
+// debug information. The code sections of both modules must be the same, which
+// is checked with their build ids when they have one.
+type debugInfoModule struct {
+	wazero.CompiledModule
+	debug []byte
+}
+
+func withDebugInfo(mod wazero.CompiledModule, wasm, debug []byte) (debugInfoModule, error) {
+	id, debugID := wasmBuildID(wasm), wasmBuildID(debug)
+	if id != nil && debugID != nil && !bytes.Equal(id, debugID) {
+		return debugInfoModule{}, fmt.Errorf("debug info does not match the module: build id %x differs from %x", debugID, id)
+	}
+	return debugInfoModule{mod, debug}, nil
+}
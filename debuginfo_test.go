@@ -0,0 +1,88 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+func TestDebugInfo(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := testStripCustomSections(wasm)
+	if wasmHasCustomSection(stripped, debugInfo) {
+		t.Fatal("debug info not stripped")
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProfilingFor(stripped, DebugInfo(wasm))
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.symbols.(*dwarfmapper); !ok {
+		t.Errorf("wrong symbolizer for a module with separate debug info: %T", p.symbols)
+	}
+
+	// Modules with different build ids do not match.
+	p = ProfilingFor(testAppendBuildID(stripped, "a"), DebugInfo(testAppendBuildID(wasm, "b")))
+	if err := p.Prepare(mod); err == nil {
+		t.Error("expected an error for debug info of another build")
+	}
+	p = ProfilingFor(testAppendBuildID(stripped, "a"), DebugInfo(testAppendBuildID(wasm, "a")))
+	if err := p.Prepare(mod); err != nil {
+		t.Error(err)
+	}
+}
+
+// testStripCustomSections returns a copy of a wasm binary without the custom
+// sections of the given names, or without any custom sections if no names are
+// given.
+func testStripCustomSections(b []byte, names ...string) []byte {
+	out := append([]byte{}, b[:8]...)
+	b = b[8:]
+	for len(b) > 0 {
+		length, n := binary.Uvarint(b[1:])
+		end := 1 + n + int(length)
+		if b[0] != 0 || !testStripCustomSection(b[1+n:end], names) {
+			out = append(out, b[:end]...)
+		}
+		b = b[end:]
+	}
+	return out
+}
+
+func testStripCustomSection(content []byte, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	length, n := binary.Uvarint(content)
+	name := string(content[n : n+int(length)])
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func testAppendBuildID(b []byte, id string) []byte {
+	content := append([]byte{byte(len(buildIDSection))}, buildIDSection...)
+	content = append(content, byte(len(id)))
+	content = append(content, id...)
+	out := append([]byte{}, b...)
+	out = append(out, 0, byte(len(content)))
+	return append(out, content...)
+}
@@ -0,0 +1,86 @@
+package wzprof
+
+import (
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+)
+
+// isRustSymbol returns true if name is mangled with either of the schemes of
+// the Rust compiler: legacy symbols look like C++ ones but end with the hash of
+// the function ("_ZN...17h<16 hex digits>E", optionally followed by a suffix
+// starting with a dot), v0 symbols start with "_R".
+//
+// https://doc.rust-lang.org/rustc/symbol-mangling/index.html
+func isRustSymbol(name string) bool {
+	if strings.HasPrefix(name, "_R") {
+		return true
+	}
+	if !strings.HasPrefix(name, "_ZN") {
+		return false
+	}
+	if i := strings.LastIndex(name, "E."); i > 0 {
+		name = name[:i+1]
+	}
+	const hashLen = len("17h0123456789abcdefE")
+	if len(name) < len("_ZN")+hashLen || !strings.HasSuffix(name, "E") {
+		return false
+	}
+	hash := name[len(name)-hashLen:]
+	if !strings.HasPrefix(hash, "17h") {
+		return false
+	}
+	for _, c := range hash[3 : len(hash)-1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// demangleRust returns the path of the function of a Rust symbol, without its
+// hash, e.g. "std::rt::lang_start". It returns false if the name is not a Rust
+// symbol or could not be demangled.
+func demangleRust(name string) (string, bool) {
+	if !isRustSymbol(name) {
+		return "", false
+	}
+	s, err := demangle.ToString(name)
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// demangleCxx returns the demangled name of a C++ symbol mangled with the
+// Itanium ABI used by clang, including the types of its parameters, e.g.
+// "ns::Class::method(int)". It returns false if the name is not a C++ symbol or
+// could not be demangled.
+//
+// https://itanium-cxx-abi.github.io/cxx-abi/abi.html#mangling
+func demangleCxx(name string) (string, bool) {
+	if !strings.HasPrefix(name, "_Z") || isRustSymbol(name) {
+		return "", false
+	}
+	s, err := demangle.ToString(name)
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// demangleLocations replaces the human names of locations with the demangled
+// names of their functions. The linkage names of C++ functions found in DWARF
+// are more precise than their DW_AT_name, which has neither the namespace nor
+// the parameters. The names of Rust functions found in DWARF are already
+// readable, only the symbols found in the name section are still mangled.
+func demangleLocations(locations []location) {
+	for i := range locations {
+		loc := &locations[i]
+		if human, ok := demangleCxx(loc.StableName); ok {
+			loc.HumanName = human
+		} else if human, ok := demangleRust(loc.HumanName); ok {
+			loc.HumanName = human
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestDemangleRust(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"_ZN3std2rt10lang_start17h1b9e8a8c5c6d7e8fE", "std::rt::lang_start"},
+		{"_ZN4core3fmt9Formatter3pad17h0123456789abcdefE.llvm.123", "core::fmt::Formatter::pad"},
+		{"_RNvCs1234_7mycrate3foo", "mycrate::foo"},
+		{"_RNvMs_NtCsabc_5hello3fooNtB4_3Bar3baz", "<hello::foo::Bar>::baz"},
+		{"_Z3fooi", ""},                         // C++
+		{"_ZN3foo3barE", ""},                    // C++ without hash
+		{"_ZN3foo3bar17hxxxxxxxxxxxxxxxxE", ""}, // invalid hash
+		{"main", ""},
+	}
+
+	for _, test := range tests {
+		got, ok := demangleRust(test.name)
+		if ok != (test.want != "") || got != test.want {
+			t.Errorf("%s: demangled name mismatch: want=%q got=%q (%t)", test.name, test.want, got, ok)
+		}
+	}
+}
+
+func TestDemangleCxx(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"_Z3fooi", "foo(int)"},
+		{"_ZN2ns5Class6methodEi", "ns::Class::method(int)"},
+		{"_ZNK2ns5Class3getEv", "ns::Class::get() const"},
+		{"_ZN3std2rt10lang_start17h1b9e8a8c5c6d7e8fE", ""}, // Rust
+		{"_Zinvalid", ""},
+		{"main", ""},
+	}
+
+	for _, test := range tests {
+		got, ok := demangleCxx(test.name)
+		if ok != (test.want != "") || got != test.want {
+			t.Errorf("%s: demangled name mismatch: want=%q got=%q (%t)", test.name, test.want, got, ok)
+		}
+	}
+}
+
+func TestLocationForCallDemanglesRust(t *testing.T) {
+	const mangled = "_ZN3std2rt10lang_start17h1b9e8a8c5c6d7e8fE"
+	fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	fn.FunctionName = mangled
+	wazerotest.NewModule(nil, fn)
+
+	loc := locationForCall(ProfilingFor(nil), testInternalFunction{fn.Definition()}, 1, map[string]*profile.Function{})
+	if f := loc.Line[0].Function; f.Name != "std::rt::lang_start" || f.SystemName != mangled {
+		t.Errorf("function names mismatch: name=%q system name=%q", f.Name, f.SystemName)
+	}
+}
+
+func TestLocationForCallDemanglesCxx(t *testing.T) {
+	const mangled = "_ZN2ns5Class6methodEi"
+	fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	fn.FunctionName = mangled
+	wazerotest.NewModule(nil, fn)
+
+	tests := []struct {
+		options []ProfilingOption
+		want    string
+	}{
+		{nil, "ns::Class::method(int)"},
+		{[]ProfilingOption{Demangle(false)}, mangled},
+	}
+
+	for _, test := range tests {
+		p := ProfilingFor(nil, test.options...)
+		loc := locationForCall(p, testInternalFunction{fn.Definition()}, 1, map[string]*profile.Function{})
+		if f := loc.Line[0].Function; f.Name != test.want || f.SystemName != mangled {
+			t.Errorf("function names mismatch: name=%q system name=%q", f.Name, f.SystemName)
+		}
+	}
+}
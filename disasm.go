@@ -0,0 +1,114 @@
+package wzprof
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// disassembledInstruction is an instruction of a function body, located by
+// its offset in the code section, with its text indented by the depth of the
+// blocks it is nested in.
+type disassembledInstruction struct {
+	offset uint64
+	text   string
+}
+
+// disassemble returns the instructions of a function body of the code
+// section, which starts with the declarations of its locals.
+func disassemble(code []byte, body wasmFunctionBody) []disassembledInstruction {
+	if body.offset+body.size > uint64(len(code)) {
+		return nil
+	}
+	r := wasmReader{b: code[body.offset : body.offset+body.size]}
+	for n := r.uleb(); n > 0 && r.err == nil; n-- {
+		r.uleb()
+		r.byte()
+	}
+
+	var instructions []disassembledInstruction
+	depth := 0
+	for r.i < len(r.b) && r.err == nil {
+		start := r.i
+		op := r.instruction()
+		if r.err != nil {
+			break
+		}
+		indent := depth
+		switch op {
+		case 0x02, 0x03, 0x04, 0x06: // block, loop, if, try
+			depth++
+		case 0x05, 0x07, 0x19: // else, catch, catch_all
+			indent--
+		case 0x0B, 0x18: // end, delegate
+			depth--
+			indent--
+		}
+		if indent < 0 {
+			indent = 0
+		}
+		instructions = append(instructions, disassembledInstruction{
+			offset: body.offset + uint64(start),
+			text:   strings.Repeat("  ", indent) + instructionText(r.b[start:r.i]),
+		})
+	}
+	return instructions
+}
+
+// instructionText returns the text of an instruction, its name followed by
+// its immediates (e.g. "local.get 2" or "i32.load offset=8"). The types of
+// blocks and the immediates of prefixed instructions are omitted.
+func instructionText(b []byte) string {
+	name := opcodeName(b)
+	r := wasmReader{b: b, i: 1}
+	switch op := b[0]; {
+	case op == 0x07 || op == 0x08 || op == 0x09 || op == 0x0C || op == 0x0D || op == 0x10 || op == 0x12 || op == 0x18 ||
+		(op >= 0x20 && op <= 0x26) || op == 0xD2:
+		return name + " " + strconv.FormatUint(r.uleb(), 10)
+	case op == 0x0E: // br_table
+		var targets []string
+		for n := r.uleb() + 1; n > 0 && r.err == nil; n-- {
+			targets = append(targets, strconv.FormatUint(r.uleb(), 10))
+		}
+		return name + " " + strings.Join(targets, " ")
+	case op == 0x11 || op == 0x13: // call_indirect, return_call_indirect
+		typ, table := r.uleb(), r.uleb()
+		if table != 0 {
+			return name + " " + strconv.FormatUint(table, 10) + " (type " + strconv.FormatUint(typ, 10) + ")"
+		}
+		return name + " (type " + strconv.FormatUint(typ, 10) + ")"
+	case op >= 0x28 && op <= 0x3E: // loads and stores
+		if align := r.uleb(); align&0x40 != 0 {
+			r.uleb() // memory index
+		}
+		if offset := r.uleb(); offset != 0 {
+			return name + " offset=" + strconv.FormatUint(offset, 10)
+		}
+	case op == 0x41 || op == 0x42: // i32.const, i64.const
+		return name + " " + strconv.FormatInt(decodeSleb128(b[1:]), 10)
+	case op == 0x43 && len(b) == 5: // f32.const
+		v := math.Float32frombits(binary.LittleEndian.Uint32(b[1:]))
+		return name + " " + strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case op == 0x44 && len(b) == 9: // f64.const
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b[1:]))
+		return name + " " + strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return name
+}
+
+func decodeSleb128(b []byte) int64 {
+	var v int64
+	var shift uint
+	for _, c := range b {
+		v |= int64(c&0x7F) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			break
+		}
+	}
+	return v
+}
@@ -0,0 +1,25 @@
+package wzprof
+
+import "testing"
+
+func TestInstructionText(t *testing.T) {
+	tests := []struct {
+		code string
+		text string
+	}{
+		{"\x20\x02", "local.get 2"},
+		{"\x41\x7F", "i32.const -1"},
+		{"\x42\x80\x01", "i64.const 128"},
+		{"\x28\x02\x08", "i32.load offset=8"},
+		{"\x36\x02\x00", "i32.store"},
+		{"\x0E\x02\x00\x01\x02", "br_table 0 1 2"},
+		{"\x11\x03\x00", "call_indirect (type 3)"},
+		{"\x44\x00\x00\x00\x00\x00\x00\xF8\x3F", "f64.const 1.5"},
+		{"\x03\x40", "loop"},
+	}
+	for _, test := range tests {
+		if text := instructionText([]byte(test.code)); text != test.text {
+			t.Errorf("wrong text of %x: want=%q got=%q", test.code, test.text, text)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package wzprof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteDOT writes the call graph of a profile to w in the DOT language of
+// Graphviz, so the profiles can be rendered with `dot -Tsvg` or fed to other
+// graph visualization tools without going through pprof.
+//
+// The nodes of the graph are the functions of the profile, labeled with their
+// flat and cumulative values. The edges go from callers to callees, following
+// the adjacent frames of the stacks (including inlined functions), and are
+// weighted with the values of the samples of the stacks they appear in. The
+// width of the edges is proportional to their weight.
+//
+// The weights are the values of the default sample type of the profile.
+func WriteDOT(w io.Writer, prof *profile.Profile) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+	unit := prof.SampleType[index].Unit
+
+	nodes := make(map[string]*dotNode)
+	node := func(name string) *dotNode {
+		n := nodes[name]
+		if n == nil {
+			n = &dotNode{name: name}
+			nodes[name] = n
+		}
+		return n
+	}
+	edges := make(map[dotEdge]int64)
+
+	var total int64
+	var stack []*dotNode
+	seenNodes := make(map[*dotNode]struct{})
+	seenEdges := make(map[dotEdge]struct{})
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		total += value
+
+		// The stack is collected from the leaf, the lines of each location
+		// start with the innermost inlined function.
+		stack = stack[:0]
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				stack = append(stack, node(topFunctionName(line.Function)))
+			}
+		}
+		if len(stack) == 0 {
+			continue
+		}
+		stack[0].flat += value
+
+		// Recursive functions appear multiple times in the stack but must
+		// only be accounted once in the cumulative values and the weights of
+		// the edges.
+		for k := range seenNodes {
+			delete(seenNodes, k)
+		}
+		for k := range seenEdges {
+			delete(seenEdges, k)
+		}
+		for i, callee := range stack {
+			if _, ok := seenNodes[callee]; !ok {
+				seenNodes[callee] = struct{}{}
+				callee.cum += value
+			}
+			if i+1 < len(stack) {
+				e := dotEdge{caller: stack[i+1], callee: callee}
+				if _, ok := seenEdges[e]; !ok {
+					seenEdges[e] = struct{}{}
+					edges[e] += value
+				}
+			}
+		}
+	}
+
+	// Nodes are numbered by decreasing cumulative value, so the roots of the
+	// call graph come first and the output is deterministic.
+	list := make([]*dotNode, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].cum != list[j].cum {
+			return list[i].cum > list[j].cum
+		}
+		return list[i].name < list[j].name
+	})
+	for i, n := range list {
+		n.id = i + 1
+	}
+
+	edgeList := make([]dotEdge, 0, len(edges))
+	var maxWeight int64
+	for e, weight := range edges {
+		edgeList = append(edgeList, e)
+		if abs(weight) > maxWeight {
+			maxWeight = abs(weight)
+		}
+	}
+	sort.Slice(edgeList, func(i, j int) bool {
+		ei, ej := edgeList[i], edgeList[j]
+		if ei.caller.id != ej.caller.id {
+			return ei.caller.id < ej.caller.id
+		}
+		return ei.callee.id < ej.callee.id
+	})
+
+	title := prof.SampleType[index].Type
+	if len(prof.Mapping) > 0 && prof.Mapping[0].File != "" {
+		title = prof.Mapping[0].File + ": " + title
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "digraph \"%s\" {\n", dotEscape(title))
+	fmt.Fprintf(b, "  label=\"%s\\ntotal %s\";\n", dotEscape(title), FormatValue(total, unit))
+	fmt.Fprintf(b, "  node [shape=box fontname=\"sans-serif\"];\n")
+	for _, n := range list {
+		fmt.Fprintf(b, "  N%d [label=\"%s\\nflat %s (%s)\\ncum %s (%s)\"];\n",
+			n.id,
+			dotEscape(n.name),
+			FormatValue(n.flat, unit),
+			FormatPercent(n.flat, total),
+			FormatValue(n.cum, unit),
+			FormatPercent(n.cum, total),
+		)
+	}
+	for _, e := range edgeList {
+		weight := edges[e]
+		penwidth := 1.0
+		if maxWeight > 0 {
+			penwidth += 4 * float64(abs(weight)) / float64(maxWeight)
+		}
+		fmt.Fprintf(b, "  N%d -> N%d [label=\"%s\" penwidth=%.2f];\n",
+			e.caller.id,
+			e.callee.id,
+			FormatValue(weight, unit),
+			penwidth,
+		)
+	}
+	fmt.Fprintf(b, "}\n")
+	return b.Flush()
+}
+
+type dotNode struct {
+	id   int
+	name string
+	flat int64
+	cum  int64
+}
+
+type dotEdge struct {
+	caller *dotNode
+	callee *dotNode
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotEscape(s string) string {
+	return dotEscaper.Replace(s)
+}
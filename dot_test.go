@@ -0,0 +1,56 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteDOT(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	inlined := &profile.Function{ID: 2, Name: `parse"json"`}
+	malloc := &profile.Function{ID: 3, Name: "malloc"}
+	fib := &profile.Function{ID: 4, Name: "fib"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: inlined}, {Function: main}}}
+	leaf := &profile.Location{ID: 2, Line: []profile.Line{{Function: malloc}}}
+	recursive := &profile.Location{ID: 3, Line: []profile.Line{{Function: fib}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, root}, Value: []int64{1, 30}},
+			{Location: []*profile.Location{root}, Value: []int64{1, 10}},
+			// Recursive calls are only accounted once.
+			{Location: []*profile.Location{leaf, recursive, recursive, root}, Value: []int64{1, 20}},
+		},
+		Mapping: []*profile.Mapping{{ID: 1, File: "app.wasm"}},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteDOT(b, prof); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `digraph "app.wasm: alloc_space" {
+  label="app.wasm: alloc_space\ntotal 60B";
+  node [shape=box fontname="sans-serif"];
+  N1 [label="main\nflat 0B (0.00%)\ncum 60B (100.00%)"];
+  N2 [label="parse\"json\"\nflat 10B (16.67%)\ncum 60B (100.00%)"];
+  N3 [label="malloc\nflat 50B (83.33%)\ncum 50B (83.33%)"];
+  N4 [label="fib\nflat 0B (0.00%)\ncum 20B (33.33%)"];
+  N1 -> N2 [label="60B" penwidth=5.00];
+  N2 -> N3 [label="30B" penwidth=3.00];
+  N2 -> N4 [label="20B" penwidth=2.33];
+  N4 -> N3 [label="20B" penwidth=2.33];
+  N4 -> N4 [label="20B" penwidth=2.33];
+}
+`
+	if got := b.String(); got != want {
+		t.Errorf("wrong dot output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,92 @@
+package wzprof
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// NativeAOT-LLVM compiles the managed methods of .NET programs to wasm
+// functions, named after the mangled names of ILCompiler. They are prefixed by
+// the assembly, namespace and type of the method with dots replaced by
+// underscores, followed by two underscores and the name of the method, e.g.
+// "S_P_CoreLib_System_String__Concat_0" or "HelloWasm_Program__Main".
+//
+// https://github.com/dotnet/runtimelab/blob/feature/NativeAOT-LLVM/src/coreclr/tools/aot/ILCompiler.Compiler/Compiler/NativeAotNameMangler.cs
+const dotnetCoreLibPrefix = "S_P_CoreLib_"
+
+// Try to detect if the module was compiled by NativeAOT-LLVM, which always
+// includes methods of System.Private.CoreLib (names are prefixed by their
+// length, the check only looks for the prefix of the assembly).
+func binCompiledByNativeAOT(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte(dotnetCoreLibPrefix+"System_"))
+}
+
+// dotnetMethodName converts the mangled name of a managed method to its
+// qualified name, e.g. "System.String.Concat" or "Program..ctor" for
+// constructors, or returns an empty string if the name is not the one of a
+// managed method. Underscores in the names of namespaces and types cannot be
+// told apart from the separators, and the assembly prefix is only removed for
+// System.Private.CoreLib, whose types all live in the System namespace.
+func dotnetMethodName(name string) string {
+	i := strings.LastIndex(name, "__")
+	if i <= 0 || i+2 == len(name) {
+		return ""
+	}
+	typ, method := name[:i], name[i+2:]
+	typ = strings.TrimPrefix(typ, dotnetCoreLibPrefix)
+	// Overloads of a method are suffixed by a number.
+	if j := strings.LastIndexByte(method, '_'); j > 0 && isDigits(method[j+1:]) {
+		method = method[:j]
+	}
+	// The arity of generic types follows their name, e.g. List`1.
+	parts := strings.Split(typ, "_")
+	for i := 1; i < len(parts); i++ {
+		if isDigits(parts[i]) {
+			parts[i-1] += "`" + parts[i]
+			parts = append(parts[:i], parts[i+1:]...)
+			i--
+		}
+	}
+	return strings.Join(parts, ".") + "." + method
+}
+
+func isDigits(s string) bool {
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// dotnetSymbolizer wraps the DWARF symbolizer to show the qualified names of
+// managed methods, the mangled names are kept as stable names.
+type dotnetSymbolizer struct {
+	symbolizer
+}
+
+func (s dotnetSymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	addr, locs := s.symbolizer.Locations(fn, pc)
+	if len(locs) == 0 {
+		// Modules compiled without debug information still have the
+		// names of the functions.
+		name := fn.Definition().Name()
+		if human := dotnetMethodName(name); human != "" {
+			locs = []location{{StableName: name, HumanName: human}}
+		}
+		return addr, locs
+	}
+	for i := range locs {
+		name := locs[i].StableName
+		if name == "" {
+			name = locs[i].HumanName
+		}
+		if human := dotnetMethodName(name); human != "" {
+			locs[i].StableName, locs[i].HumanName = name, human
+		}
+	}
+	return addr, locs
+}
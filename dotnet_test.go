@@ -0,0 +1,32 @@
+package wzprof
+
+import "testing"
+
+func TestDotnetMethodName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"S_P_CoreLib_System_String__Concat_0", "System.String.Concat"},
+		{"S_P_CoreLib_System_Collections_Generic_List_1__Add", "System.Collections.Generic.List`1.Add"},
+		{"HelloWasm_Program__Main", "HelloWasm.Program.Main"},
+		{"HelloWasm_Program___ctor", "HelloWasm.Program..ctor"},
+		{"malloc", ""},
+		{"__wasm_call_ctors", ""},
+	}
+
+	for _, test := range tests {
+		if got := dotnetMethodName(test.name); got != test.want {
+			t.Errorf("%s: method name mismatch: want=%q got=%q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestBinCompiledByNativeAOT(t *testing.T) {
+	if !binCompiledByNativeAOT(testWasmModule("\x1fS_P_CoreLib_System_String__Concat", "")) {
+		t.Error("nativeaot module not detected")
+	}
+	if binCompiledByNativeAOT(testWasmModule("\x04main", "")) {
+		t.Error("module wrongly detected as nativeaot")
+	}
+}
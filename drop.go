@@ -0,0 +1,99 @@
+package wzprof
+
+import (
+	"encoding/binary"
+
+	"github.com/google/pprof/profile"
+)
+
+// DropSamples removes the stacks of a profile whose value is below minValue, or
+// below the fraction of the total value of the profile, and returns the number
+// of samples removed. Either threshold may be zero to be ignored. Allocation
+// heavy workloads record millions of stacks with tiny values, dropping them
+// reduces the profiles to a size that pprof can open.
+//
+// The values compared are the ones of the default sample type of the profile.
+// Samples of the same stack with different labels are summed and dropped
+// together. The locations and functions which are not referenced anymore are
+// removed from the profile.
+func DropSamples(prof *profile.Profile, minValue int64, fraction float64) int {
+	index := defaultSampleIndex(prof)
+	if index < 0 || (minValue <= 0 && fraction <= 0) {
+		return 0
+	}
+
+	var total int64
+	stacks := make(map[string]int64, len(prof.Sample))
+	keys := make([]string, len(prof.Sample))
+	for i, sample := range prof.Sample {
+		keys[i] = stackKey(sample)
+		stacks[keys[i]] += sample.Value[index]
+		total += sample.Value[index]
+	}
+
+	threshold := float64(minValue)
+	if t := fraction * float64(abs(total)); t > threshold {
+		threshold = t
+	}
+
+	samples := prof.Sample[:0]
+	for i, sample := range prof.Sample {
+		if float64(abs(stacks[keys[i]])) >= threshold {
+			samples = append(samples, sample)
+		}
+	}
+	dropped := len(prof.Sample) - len(samples)
+	for i := len(samples); i < len(prof.Sample); i++ {
+		prof.Sample[i] = nil
+	}
+	prof.Sample = samples
+	if dropped > 0 {
+		removeUnusedLocations(prof)
+	}
+	return dropped
+}
+
+func stackKey(sample *profile.Sample) string {
+	b := make([]byte, 0, 4*len(sample.Location))
+	for _, loc := range sample.Location {
+		b = binary.AppendUvarint(b, loc.ID)
+	}
+	return string(b)
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// removeUnusedLocations removes the locations and functions which are not
+// referenced by the samples of the profile.
+func removeUnusedLocations(prof *profile.Profile) {
+	locations := make(map[*profile.Location]struct{})
+	for _, sample := range prof.Sample {
+		for _, loc := range sample.Location {
+			locations[loc] = struct{}{}
+		}
+	}
+	functions := make(map[*profile.Function]struct{})
+	used := prof.Location[:0]
+	for _, loc := range prof.Location {
+		if _, ok := locations[loc]; ok {
+			used = append(used, loc)
+			for _, line := range loc.Line {
+				functions[line.Function] = struct{}{}
+			}
+		}
+	}
+	prof.Location = used
+
+	usedFunctions := prof.Function[:0]
+	for _, fn := range prof.Function {
+		if _, ok := functions[fn]; ok {
+			usedFunctions = append(usedFunctions, fn)
+		}
+	}
+	prof.Function = usedFunctions
+}
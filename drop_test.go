@@ -0,0 +1,76 @@
+package wzprof
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestDropSamples(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		main := &profile.Function{ID: 1, Name: "main"}
+		malloc := &profile.Function{ID: 2, Name: "malloc"}
+		small := &profile.Function{ID: 3, Name: "small"}
+
+		root := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+		leaf := &profile.Location{ID: 2, Line: []profile.Line{{Function: malloc}}}
+		tiny := &profile.Location{ID: 3, Line: []profile.Line{{Function: small}}}
+
+		return &profile.Profile{
+			SampleType: []*profile.ValueType{
+				{Type: "alloc_objects", Unit: "count"},
+				{Type: "alloc_space", Unit: "bytes"},
+			},
+			Sample: []*profile.Sample{
+				{Location: []*profile.Location{leaf, root}, Value: []int64{1, 60}},
+				{Location: []*profile.Location{root}, Value: []int64{1, 30}},
+				{Location: []*profile.Location{tiny, root}, Value: []int64{1, 4}},
+				// The samples of a stack with different labels are
+				// summed before comparing them to the threshold.
+				{Location: []*profile.Location{root}, Value: []int64{1, 2}, Label: map[string][]string{"tenant": {"a"}}},
+				{Location: []*profile.Location{tiny, root}, Value: []int64{100, 4}, Label: map[string][]string{"tenant": {"a"}}},
+			},
+			Location: []*profile.Location{root, leaf, tiny},
+			Function: []*profile.Function{main, malloc, small},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		min      int64
+		fraction float64
+		dropped  int
+		values   []int64
+	}{
+		{"disabled", 0, 0, 0, []int64{60, 30, 4, 2, 4}},
+		{"absolute", 10, 0, 2, []int64{60, 30, 2}},
+		{"fraction", 0, 0.5, 4, []int64{60}},
+		{"both", 10, 0.01, 2, []int64{60, 30, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prof := newProfile()
+			if n := DropSamples(prof, test.min, test.fraction); n != test.dropped {
+				t.Errorf("wrong number of samples dropped: want=%d got=%d", test.dropped, n)
+			}
+			values := make([]int64, len(prof.Sample))
+			for i, s := range prof.Sample {
+				values[i] = s.Value[1]
+			}
+			if len(values) != len(test.values) {
+				t.Fatalf("wrong samples: want=%v got=%v", test.values, values)
+			}
+			for i := range values {
+				if values[i] != test.values[i] {
+					t.Fatalf("wrong samples: want=%v got=%v", test.values, values)
+				}
+			}
+			if err := prof.CheckValid(); err != nil {
+				t.Error(err)
+			}
+			if test.dropped > 0 && (len(prof.Location) != 2 || len(prof.Function) != 2) {
+				t.Errorf("unused locations and functions not removed: %v %v", prof.Location, prof.Function)
+			}
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"sort"
 	"sync"
@@ -39,13 +38,68 @@ type subprogramRange struct {
 	Subprogram *subprogram
 }
 
+// dwarfmapper symbolizes source offsets with the DWARF information of the
+// module. Only the top level entries of the compile units are read when the
+// module is loaded, the subprograms and line tables of a unit are parsed the
+// first time one of its source offsets is symbolized.
 type dwarfmapper struct {
-	d           *dwarf.Data
-	subprograms []subprogramRange
+	d *dwarf.Data
+	// units in the order of .debug_info, to find the unit of an entry.
+	units []*compileUnit
+	// ranges of the units sorted by start offset.
+	ranges []unitRange
+	// sequences of the line tables of the units without ranges, sorted by
+	// start offset.
+	sequences []lineSequence
+	// Whether the locations are resolved to the statements of the source
+	// offsets, see PreciseLocations.
+	precise bool
 	// once value used to limit the logging output on error
 	onceSourceOffsetNotFound sync.Once
 }
 
+type unitRange struct {
+	Range sourceOffsetRange
+	Unit  *compileUnit
+}
+
+// compileUnit holds the data of a compile unit, which is materialized on
+// demand by dwarfmapper.load.
+type compileUnit struct {
+	entry *dwarf.Entry
+	once  sync.Once
+	// subprogram ranges sorted by start offset, along with the maximum end
+	// offset of the ranges up to each index to binary search them.
+	subprograms []subprogramRange
+	ends        []uint64
+	// subprograms indexed by the offset of their entry, to resolve the
+	// names of inlined functions.
+	entries map[dwarf.Offset]*subprogram
+	lines   *lineTable
+	// sequences of the line table sorted by start offset.
+	sequences []lineSequence
+}
+
+// lineSequence is a contiguous range of source offsets described by the line
+// table of a compile unit.
+type lineSequence struct {
+	Range sourceOffsetRange
+	Unit  *compileUnit
+}
+
+// lineTable is the decoded line program of a compile unit.
+type lineTable struct {
+	rows  []lineRow // sorted by address
+	files []*dwarf.LineFile
+}
+
+type lineRow struct {
+	Address uint64
+	File    *dwarf.LineFile
+	Line    int
+	Column  int
+}
+
 const (
 	debugInfo   = ".debug_info"
 	debugLine   = ".debug_line"
@@ -55,11 +109,14 @@ const (
 )
 
 func newDwarfparser(module wazero.CompiledModule) (dwarfparser, error) {
+	if m, ok := module.(debugInfoModule); ok {
+		return newDwarfParserFromBin(m.debug)
+	}
 	sections := module.CustomSections()
 
 	var info, line, ranges, str, abbrev []byte
 	for _, section := range sections {
-		log.Printf("dwarf: found section %s", section.Name())
+		Logger().Debug("dwarf: found section", "section", section.Name())
 		switch section.Name() {
 		case debugInfo:
 			info = section.Data()
@@ -74,13 +131,7 @@ func newDwarfparser(module wazero.CompiledModule) (dwarfparser, error) {
 		}
 	}
 
-	d, err := dwarf.New(abbrev, nil, nil, info, line, nil, ranges, str)
-	if err != nil {
-		return dwarfparser{}, fmt.Errorf("dwarf: %w", err)
-	}
-
-	r := d.Reader()
-	return dwarfparser{d: d, r: r}, nil
+	return newDwarfparserFromSections(info, line, ranges, str, abbrev)
 }
 
 func newDwarfParserFromBin(wasmbin []byte) (dwarfparser, error) {
@@ -90,23 +141,162 @@ func newDwarfParserFromBin(wasmbin []byte) (dwarfparser, error) {
 	str := wasmCustomSection(wasmbin, debugStr)
 	abbrev := wasmCustomSection(wasmbin, debugAbbrev)
 
+	return newDwarfparserFromSections(info, line, ranges, str, abbrev)
+}
+
+// newDwarfparserFromSections builds a parser for the given DWARF sections.
+// Toolchains and strip tools sometimes only keep some of them:
+//
+//   - without .debug_ranges, functions which are not contiguous in the code
+//     section are located with the line tables of their compilation unit and
+//     named after the name section.
+//   - without .debug_str, entries cannot be read at all and an error is
+//     returned, so the functions are only symbolized with their names.
+func newDwarfparserFromSections(info, line, ranges, str, abbrev []byte) (dwarfparser, error) {
+	for _, s := range []struct {
+		name string
+		data []byte
+	}{
+		{debugInfo, info},
+		{debugLine, line},
+		{debugRanges, ranges},
+		{debugStr, str},
+		{debugAbbrev, abbrev},
+	} {
+		if s.data == nil {
+			Logger().Debug("dwarf: missing section", "section", s.name)
+		}
+	}
+
 	d, err := dwarf.New(abbrev, nil, nil, info, line, nil, ranges, str)
 	if err != nil {
 		return dwarfparser{}, fmt.Errorf("dwarf: %w", err)
 	}
 
 	r := d.Reader()
+	if _, err := r.Next(); err != nil {
+		return dwarfparser{}, fmt.Errorf("dwarf: %w", err)
+	}
+	r.Seek(0)
 	return dwarfparser{d: d, r: r}, nil
 }
 
 func newDwarfmapper(p dwarfparser) *dwarfmapper {
-	subprograms := p.Parse()
-	log.Printf("dwarf: parsed %d subprogramm ranges", len(subprograms))
+	d := &dwarfmapper{d: p.d}
+
+	for _, cu := range p.CompileUnits() {
+		u := &compileUnit{entry: cu}
+		d.units = append(d.units, u)
 
-	return &dwarfmapper{
-		d:           p.d,
-		subprograms: subprograms,
+		ranges, err := p.d.Ranges(cu)
+		for _, r := range ranges {
+			if codeRange(r) {
+				d.ranges = append(d.ranges, unitRange{Range: r, Unit: u})
+			}
+		}
+		if err != nil || (len(ranges) == 0 && cu.Val(dwarf.AttrRanges) != nil) {
+			// Typically .debug_ranges is missing, the code of the unit
+			// can only be located with its line table.
+			d.load(u)
+			d.sequences = append(d.sequences, u.sequences...)
+		}
 	}
+	Logger().Debug("dwarf: indexed compile units", "units", len(d.units))
+
+	sort.Slice(d.ranges, func(i, j int) bool {
+		return d.ranges[i].Range[0] < d.ranges[j].Range[0]
+	})
+	sort.Slice(d.sequences, func(i, j int) bool {
+		return d.sequences[i].Range[0] < d.sequences[j].Range[0]
+	})
+	return d
+}
+
+// load parses the subprograms and the line table of the compile unit, once.
+func (d *dwarfmapper) load(u *compileUnit) {
+	u.once.Do(func() {
+		r := d.d.Reader()
+		r.Seek(u.entry.Offset)
+		if _, err := r.Next(); err != nil {
+			Logger().Warn("dwarf: failed to read compile unit", "error", err)
+			return
+		}
+		p := dwarfparser{d: d.d, r: r}
+		p.parseCompileUnit(u.entry, "")
+
+		u.entries = make(map[dwarf.Offset]*subprogram, len(p.subprograms))
+		for _, sr := range p.subprograms {
+			u.entries[sr.Subprogram.Entry.Offset] = sr.Subprogram
+			// Subprograms without ranges are only kept for name
+			// resolution.
+			if codeRange(sr.Range) {
+				u.subprograms = append(u.subprograms, sr)
+			}
+		}
+		sort.SliceStable(u.subprograms, func(i, j int) bool {
+			return u.subprograms[i].Range[0] < u.subprograms[j].Range[0]
+		})
+		u.ends = make([]uint64, len(u.subprograms))
+		for i, sr := range u.subprograms {
+			u.ends[i] = sr.Range[1]
+			if i > 0 && u.ends[i-1] > u.ends[i] {
+				u.ends[i] = u.ends[i-1]
+			}
+		}
+
+		d.readLineTable(u)
+	})
+}
+
+// readLineTable decodes the line program of the compile unit and records its
+// sequences.
+func (d *dwarfmapper) readLineTable(u *compileUnit) {
+	lr, err := d.d.LineReader(u.entry)
+	if err != nil || lr == nil {
+		if err != nil {
+			Logger().Warn("dwarf: failed to read lines", "error", err)
+		}
+		return
+	}
+
+	t := new(lineTable)
+	var le dwarf.LineEntry
+	var sequence []lineRow
+	for {
+		err := lr.Next(&le)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			Logger().Warn("dwarf: failed to iterate on lines", "error", err)
+			break
+		}
+		if le.EndSequence {
+			// The end of a sequence is the first address past it and
+			// does not describe any instruction.
+			if len(sequence) > 0 && codeRange(sourceOffsetRange{sequence[0].Address, le.Address}) {
+				u.sequences = append(u.sequences, lineSequence{
+					Range: sourceOffsetRange{sequence[0].Address, le.Address},
+					Unit:  u,
+				})
+				t.rows = append(t.rows, sequence...)
+			}
+			sequence = sequence[:0]
+			continue
+		}
+		sequence = append(sequence, lineRow{
+			Address: le.Address,
+			File:    le.File,
+			Line:    le.Line,
+			Column:  le.Column,
+		})
+	}
+	sort.SliceStable(t.rows, func(i, j int) bool { return t.rows[i].Address < t.rows[j].Address })
+	sort.Slice(u.sequences, func(i, j int) bool {
+		return u.sequences[i].Range[0] < u.sequences[j].Range[0]
+	})
+	t.files = lr.Files()
+	u.lines = t
 }
 
 type dwarfparser struct {
@@ -116,19 +306,21 @@ type dwarfparser struct {
 	subprograms []subprogramRange
 }
 
-func (d *dwarfparser) Parse() []subprogramRange {
+// CompileUnits returns the top level entries of the compile units, without
+// parsing their children.
+func (d *dwarfparser) CompileUnits() []*dwarf.Entry {
+	var units []*dwarf.Entry
 	for {
 		ent, err := d.r.Next()
 		if err != nil || ent == nil {
 			break
 		}
 		if ent.Tag == dwarf.TagCompileUnit {
-			d.parseCompileUnit(ent, "")
-		} else {
-			d.r.SkipChildren()
+			units = append(units, ent)
 		}
+		d.r.SkipChildren()
 	}
-	return d.subprograms
+	return units
 }
 
 func (d *dwarfparser) parseCompileUnit(cu *dwarf.Entry, ns string) {
@@ -200,8 +392,11 @@ func (d *dwarfparser) parseSubprogram(cu *dwarf.Entry, ns string, e *dwarf.Entry
 
 	ranges, err := d.d.Ranges(e)
 	if err != nil {
-		log.Printf("dwarf: failed to read ranges: %s\n", err)
-		return
+		// Typically .debug_ranges is missing, keep the subprogram for the
+		// name resolution of inlined functions; its code is located with
+		// the line tables of the compilation unit instead.
+		Logger().Warn("dwarf: failed to read ranges", "error", err)
+		ranges = nil
 	}
 
 	spgm := &subprogram{
@@ -238,103 +433,63 @@ func (d *dwarfmapper) Locations(fn experimental.InternalFunction, pc experimenta
 		return offset, nil
 	}
 
-	// TODO: replace with binary search
-
-	var spgm *subprogram
-
-	for _, sr := range d.subprograms {
-		if sr.Range[0] <= offset && offset <= sr.Range[1] {
-			spgm = sr.Subprogram
-			break
-		}
-	}
-
-	if spgm == nil {
+	u := d.unitAt(offset)
+	if u == nil {
 		d.onceSourceOffsetNotFound.Do(func() {
-			log.Printf("dwarf: no subprogram ranges found for source offset %d (silencing similar errors now)", offset)
+			Logger().Debug("dwarf: no compile unit found for source offset (silencing similar errors now)", "offset", offset)
 		})
 		return offset, nil
 	}
+	d.load(u)
 
-	lr, err := d.d.LineReader(spgm.CU)
-	if err != nil || lr == nil {
-		log.Printf("dwarf: failed to read lines: %s\n", err)
-		return offset, nil
-	}
-
-	// TODO: cache this
-	var lines []line
-	var le dwarf.LineEntry
-	for {
-		pos := lr.Tell()
-		err = lr.Next(&le)
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			log.Printf("dwarf: failed to iterate on lines: %s\n", err)
-			break
+	spgm := u.subprogramAt(offset)
+	if spgm == nil {
+		// Without the ranges of the subprograms, the line tables still
+		// give the position in the source; the function is then named
+		// after the name section.
+		if row, ok := d.lineAt(u, offset); ok {
+			return offset, []location{{
+				File:   lineFileName(row.File),
+				Line:   int64(row.Line),
+				Column: int64(row.Column),
+			}}
 		}
-		lines = append(lines, line{Pos: pos, Address: le.Address})
-	}
-	sort.Slice(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address })
-
-	i := sort.Search(len(lines), func(i int) bool { return lines[i].Address >= offset })
-	if i == len(lines) {
-		// no line information for this source offset.
-		log.Printf("dwarf: no line information for source offset %d", offset)
+		d.onceSourceOffsetNotFound.Do(func() {
+			Logger().Debug("dwarf: no subprogram ranges found for source offset (silencing similar errors now)", "offset", offset)
+		})
 		return offset, nil
 	}
 
-	l := lines[i]
-	if l.Address != offset {
-		// https://github.com/stealthrocket/wazero/blob/867459d7d5ed988a55452d6317ff3cc8451b8ff0/internal/wasmdebug/dwarf.go#L141-L150
-		// If the address doesn't match exactly, the previous
-		// entry is the one that contains the instruction.
-		// That can happen anytime as the DWARF spec allows
-		// it, and other tools can handle it in this way
-		// conventionally
-		// https://github.com/gimli-rs/addr2line/blob/3a2dbaf84551a06a429f26e9c96071bb409b371f/src/lib.rs#L236-L242
-		// https://github.com/kateinoigakukun/wasminspect/blob/f29f052f1b03104da9f702508ac0c1bbc3530ae4/crates/debugger/src/dwarf/mod.rs#L453-L459
-		if i-1 < 0 {
-			log.Printf("dwarf: first line address does not match source (line=%d offset=%d)", l.Address, offset)
-			return offset, nil
-		}
-		l = lines[i-1]
-	}
-
-	lr.Seek(l.Pos)
-	err = lr.Next(&le)
-	if err != nil {
-		// l.Pos was created from parsing dwarf, should not
-		// happen.
-		panic("BUG: l.Pos was created from parsing dwarf but got error: " + err.Error())
+	row, ok := d.lineAt(u, offset)
+	if !ok {
+		return offset, nil
 	}
 
-	human, stable := d.namesForSubprogram(spgm.Entry, spgm)
+	human, stable, startLine := d.namesForSubprogram(spgm.Entry, spgm)
 	locations := make([]location, 0, 1+len(spgm.Inlines))
 	locations = append(locations, location{
-		File:       le.File.Name,
-		Line:       int64(le.Line),
-		Column:     int64(le.Column),
+		File:       lineFileName(row.File),
+		Line:       int64(row.Line),
+		Column:     int64(row.Column),
 		Inlined:    false,
 		HumanName:  human,
 		StableName: stable,
+		StartLine:  startLine,
 	})
 
 	if len(spgm.Inlines) > 0 {
-		files := lr.Files()
+		files := u.lines.files
 		for i := len(spgm.Inlines) - 1; i >= 0; i-- {
 			er := spgm.Inlines[i]
 			fileIdx, ok := er.entry.Val(dwarf.AttrCallFile).(int64)
-			if !ok || fileIdx >= int64(len(files)) || !offsetInRanges(er.ranges, offset) {
+			if !ok || fileIdx >= int64(len(files)) || files[fileIdx] == nil || !offsetInRanges(er.ranges, offset) {
 				continue
 			}
 
 			file := files[fileIdx]
 			line, _ := er.entry.Val(dwarf.AttrCallLine).(int64)
-			col, _ := er.entry.Val(dwarf.AttrCallLine).(int64)
-			human, stable := d.namesForSubprogram(er.entry, nil)
+			col, _ := er.entry.Val(dwarf.AttrCallColumn).(int64)
+			human, stable, startLine := d.namesForSubprogram(er.entry, nil)
 			locations = append(locations, location{
 				File:       file.Name,
 				Line:       line,
@@ -342,13 +497,145 @@ func (d *dwarfmapper) Locations(fn experimental.InternalFunction, pc experimenta
 				Inlined:    true,
 				StableName: stable,
 				HumanName:  human,
+				StartLine:  startLine,
 			})
 		}
 	}
 
+	if d.precise && len(locations) > 1 {
+		// The line of the instruction is in the innermost inlined
+		// function, the functions it is inlined in are at the lines of
+		// their calls.
+		last := len(locations) - 1
+		file, line, col := locations[0].File, locations[0].Line, locations[0].Column
+		for i := 0; i < last; i++ {
+			locations[i].File = locations[i+1].File
+			locations[i].Line = locations[i+1].Line
+			locations[i].Column = locations[i+1].Column
+		}
+		locations[last].File, locations[last].Line, locations[last].Column = file, line, col
+	}
 	return offset, locations
 }
 
+// lineAt returns the row of the line table of the unit which contains the
+// source offset. With precise locations, the rows without line, which
+// compilers emit for the instructions they do not attribute to a statement
+// (e.g. spills or the joins of branches), resolve to the closest row of the
+// same sequence before them which has one.
+func (d *dwarfmapper) lineAt(u *compileUnit, offset uint64) (lineRow, bool) {
+	i, ok := u.lines.index(offset)
+	if !ok {
+		return lineRow{}, false
+	}
+	rows := u.lines.rows
+	if d.precise {
+		start := rows[i].Address
+		if seq, ok := u.sequenceAt(offset); ok {
+			start = seq.Range[0]
+		}
+		for i > 0 && rows[i].Line == 0 && rows[i-1].Address >= start {
+			i--
+		}
+	}
+	return rows[i], true
+}
+
+// sequenceAt returns the sequence of the line table of the unit which contains
+// the source offset.
+func (u *compileUnit) sequenceAt(offset uint64) (lineSequence, bool) {
+	i := sort.Search(len(u.sequences), func(i int) bool { return u.sequences[i].Range[1] > offset })
+	if i < len(u.sequences) && u.sequences[i].Range[0] <= offset {
+		return u.sequences[i], true
+	}
+	return lineSequence{}, false
+}
+
+// codeRange returns true if r is a range of the code section. The code of
+// functions removed by the linker is relocated at address zero or at the
+// 0xffffffff tombstone, while the first function in the code section is always
+// past the section header.
+func codeRange(r sourceOffsetRange) bool {
+	return r[0] != 0 && r[0] < math.MaxUint32 && r[0] < r[1]
+}
+
+func lineFileName(f *dwarf.LineFile) string {
+	if f == nil {
+		return ""
+	}
+	return f.Name
+}
+
+// unitAt returns the compile unit which code contains the source offset, or
+// nil if there are none.
+func (d *dwarfmapper) unitAt(offset uint64) *compileUnit {
+	i := sort.Search(len(d.ranges), func(i int) bool { return d.ranges[i].Range[1] > offset })
+	if i < len(d.ranges) && d.ranges[i].Range[0] <= offset {
+		return d.ranges[i].Unit
+	}
+	i = sort.Search(len(d.sequences), func(i int) bool { return d.sequences[i].Range[1] > offset })
+	if i < len(d.sequences) && d.sequences[i].Range[0] <= offset {
+		return d.sequences[i].Unit
+	}
+	return nil
+}
+
+// unitOf returns the compile unit containing the entry at the given offset of
+// .debug_info.
+func (d *dwarfmapper) unitOf(offset dwarf.Offset) *compileUnit {
+	i := sort.Search(len(d.units), func(i int) bool { return d.units[i].entry.Offset > offset })
+	if i == 0 {
+		return nil
+	}
+	return d.units[i-1]
+}
+
+// subprogramAt returns the subprogram which ranges contain the source offset,
+// or nil if there are none.
+func (u *compileUnit) subprogramAt(offset uint64) *subprogram {
+	// Ranges starting past the offset cannot contain it, and the ones
+	// before can only contain it as long as one of them ends after it.
+	i := sort.Search(len(u.subprograms), func(i int) bool { return u.subprograms[i].Range[0] > offset })
+	for i--; i >= 0 && u.ends[i] >= offset; i-- {
+		if sr := u.subprograms[i]; offset <= sr.Range[1] {
+			return sr.Subprogram
+		}
+	}
+	return nil
+}
+
+// index returns the index of the row of the line table which contains the
+// source offset.
+func (t *lineTable) index(offset uint64) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	i := sort.Search(len(t.rows), func(i int) bool { return t.rows[i].Address >= offset })
+	if i == len(t.rows) {
+		// no line information for this source offset.
+		Logger().Debug("dwarf: no line information for source offset", "offset", offset)
+		return 0, false
+	}
+
+	if t.rows[i].Address != offset {
+		// https://github.com/stealthrocket/wazero/blob/867459d7d5ed988a55452d6317ff3cc8451b8ff0/internal/wasmdebug/dwarf.go#L141-L150
+		// If the address doesn't match exactly, the previous
+		// entry is the one that contains the instruction.
+		// That can happen anytime as the DWARF spec allows
+		// it, and other tools can handle it in this way
+		// conventionally
+		// https://github.com/gimli-rs/addr2line/blob/3a2dbaf84551a06a429f26e9c96071bb409b371f/src/lib.rs#L236-L242
+		// https://github.com/kateinoigakukun/wasminspect/blob/f29f052f1b03104da9f702508ac0c1bbc3530ae4/crates/debugger/src/dwarf/mod.rs#L453-L459
+		if i-1 < 0 {
+			Logger().Debug("dwarf: first line address does not match source", "line", t.rows[i].Address, "offset", offset)
+			return 0, false
+		}
+		i--
+	}
+	return i, true
+}
+
 func offsetInRanges(ranges []sourceOffsetRange, offset uint64) bool {
 	for _, x := range ranges {
 		if x[0] <= offset && offset <= x[1] {
@@ -358,18 +645,14 @@ func offsetInRanges(ranges []sourceOffsetRange, offset uint64) bool {
 	return false
 }
 
-// line is used to cache line entries for a given compilation unit.
-type line struct {
-	Pos     dwarf.LineReaderPos
-	Address uint64
-}
-
 // Returns a human-readable name and the name the most likely to match the one
 // used in the wasm module. Walks up the inlining chain.
 //
 // Subprogram is optional. This function will look for the associated subprogram
 // if spgm is nil.
-func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (string, string) {
+// namesForSubprogram returns the human and stable names of a subprogram, and
+// the line it is declared at in its source file.
+func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (string, string, int64) {
 	// If an inlined function, grab the name from the origin.
 	var err error
 	r := d.d.Reader()
@@ -386,13 +669,10 @@ func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (stri
 		}
 	}
 
-	// TODO: index
 	if spgm == nil {
-		for _, s := range d.subprograms {
-			if s.Subprogram.Entry.Offset == e.Offset {
-				spgm = s.Subprogram
-				break
-			}
+		if u := d.unitOf(e.Offset); u != nil {
+			d.load(u)
+			spgm = u.entries[e.Offset]
 		}
 	}
 
@@ -409,6 +689,7 @@ func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (stri
 	if !ok {
 		stableName = name
 	}
+	startLine, _ := e.Val(dwarf.AttrDeclLine).(int64)
 
-	return name, stableName
+	return name, stableName, startLine
 }
@@ -0,0 +1,303 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"golang.org/x/exp/slog"
+)
+
+type testOffsetFunction struct {
+	testInternalFunction
+	offset uint64
+}
+
+func (f testOffsetFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+	return f.offset
+}
+
+func TestDwarfMissingRanges(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := testStripCustomSections(wasm, debugRanges)
+	if wasmHasCustomSection(stripped, debugRanges) || !wasmHasCustomSection(stripped, debugInfo) {
+		t.Fatal("wrong sections stripped")
+	}
+
+	full, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err := newDwarfParserFromBin(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := newDwarfmapper(full), newDwarfmapper(partial)
+	// The functions of this module are all contiguous and have no ranges
+	// in .debug_ranges, forget their subprograms to locate them with the
+	// line tables only, as if their ranges were missing.
+	for _, u := range got.units {
+		got.load(u)
+		u.subprograms, u.ends = nil, nil
+	}
+
+	tested := 0
+	for _, sr := range testDwarfSubprograms(want) {
+		fn := testOffsetFunction{offset: sr.Range[0]}
+		_, wantLocations := want.Locations(fn, 0)
+		_, gotLocations := got.Locations(fn, 0)
+		if len(wantLocations) == 0 {
+			continue
+		}
+		if len(gotLocations) == 0 {
+			t.Errorf("no locations for source offset %d", fn.offset)
+			continue
+		}
+		w, g := wantLocations[0], gotLocations[0]
+		if w.File != g.File || w.Line != g.Line {
+			t.Errorf("wrong location for source offset %d: want %s:%d, got %s:%d", fn.offset, w.File, w.Line, g.File, g.Line)
+		}
+		if g.HumanName != "" {
+			t.Errorf("unexpected function name for source offset %d: %s", fn.offset, g.HumanName)
+		}
+		tested++
+	}
+	if tested == 0 {
+		t.Fatal("no source offsets tested")
+	}
+}
+
+func TestDwarfMissingStrings(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := testStripCustomSections(wasm, debugStr)
+
+	if _, err := newDwarfParserFromBin(stripped); err == nil {
+		t.Error("expected an error for debug info without strings")
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProfilingFor(stripped)
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.symbols.(namesymbolizer); !ok {
+		t.Errorf("wrong symbolizer for a module without .debug_str: %T", p.symbols)
+	}
+}
+
+func TestDwarfSubprogramAt(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDwarfmapper(p)
+	subprograms := testDwarfSubprograms(d)
+	if len(subprograms) == 0 {
+		t.Fatal("no subprograms")
+	}
+
+	contains := func(spgm *subprogram, offset uint64) bool {
+		for _, sr := range subprograms {
+			if sr.Subprogram == spgm && sr.Range[0] <= offset && offset <= sr.Range[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, sr := range subprograms {
+		for _, offset := range []uint64{sr.Range[0], (sr.Range[0] + sr.Range[1]) / 2, sr.Range[1] - 1} {
+			var spgm *subprogram
+			if u := d.unitAt(offset); u != nil {
+				spgm = u.subprogramAt(offset)
+			}
+			if spgm == nil {
+				t.Fatalf("source offset %d: subprogram not found", offset)
+			}
+			if !contains(spgm, offset) {
+				t.Fatalf("source offset %d: subprogram does not contain it", offset)
+			}
+		}
+	}
+}
+
+func TestDwarfLazyLoading(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDwarfmapper(p)
+	if len(d.units) < 2 {
+		t.Fatalf("not enough compile units: %d", len(d.units))
+	}
+	loaded := func() (n int) {
+		for _, u := range d.units {
+			if u.entries != nil {
+				n++
+			}
+		}
+		return n
+	}
+	if n := loaded(); n != 0 {
+		t.Fatalf("%d compile units loaded before symbolization", n)
+	}
+
+	offset := d.ranges[0].Range[0]
+	_, locations := d.Locations(testOffsetFunction{offset: offset}, 0)
+	if len(locations) == 0 {
+		t.Fatalf("no locations for source offset %d", offset)
+	}
+	if n := loaded(); n == 0 || n == len(d.units) {
+		t.Errorf("wrong number of compile units loaded: %d/%d", n, len(d.units))
+	}
+}
+
+// testDwarfSubprograms loads all the compile units of the mapper and returns
+// their subprogram ranges.
+func TestDwarfPreciseInlinedLines(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDwarfmapper(p)
+	p, err = newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	precise := newDwarfmapper(p)
+	precise.precise = true
+
+	// func31 (lines 22-25 of simple.c) is inlined in func3, which calls it
+	// on line 29.
+	tested := 0
+	for _, sr := range testDwarfSubprograms(d) {
+		for _, inline := range sr.Subprogram.Inlines {
+			fn := testOffsetFunction{offset: inline.ranges[0][0]}
+			_, locations := d.Locations(fn, 0)
+			_, preciseLocations := precise.Locations(fn, 0)
+			if len(locations) != 2 || len(preciseLocations) != 2 {
+				t.Fatalf("source offset %d: wrong number of locations: %d, %d", fn.offset, len(locations), len(preciseLocations))
+			}
+			caller, callee := preciseLocations[0], preciseLocations[1]
+			if caller.HumanName != "func3" || callee.HumanName != "func31" || !callee.Inlined {
+				t.Errorf("source offset %d: wrong functions: %s, %s", fn.offset, caller.HumanName, callee.HumanName)
+			}
+			if caller.Line != 29 {
+				t.Errorf("source offset %d: wrong line of the call of func31: %d", fn.offset, caller.Line)
+			}
+			if callee.Line < 22 || callee.Line > 25 {
+				t.Errorf("source offset %d: wrong line in func31: %d", fn.offset, callee.Line)
+			}
+			if caller.Line != locations[1].Line || callee.Line != locations[0].Line {
+				t.Errorf("source offset %d: lines not swapped: %d, %d", fn.offset, locations[0].Line, locations[1].Line)
+			}
+			tested++
+		}
+	}
+	if tested == 0 {
+		t.Fatal("no inlined functions tested")
+	}
+}
+
+func TestDwarfPreciseLineZero(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/crunch_numbers.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDwarfmapper(p)
+	d.precise = true
+
+	tested := 0
+	for _, u := range d.units {
+		d.load(u)
+		if u.lines == nil {
+			continue
+		}
+		rows := u.lines.rows
+		for i, row := range rows {
+			if row.Line != 0 || i == 0 || rows[i-1].Line == 0 || rows[i-1].Address == row.Address {
+				continue
+			}
+			got, ok := d.lineAt(u, row.Address)
+			if !ok {
+				t.Fatalf("source offset %d: no line", row.Address)
+			}
+			if got.Line != rows[i-1].Line {
+				t.Errorf("source offset %d: want line %d, got %d", row.Address, rows[i-1].Line, got.Line)
+			}
+			tested++
+		}
+	}
+	if tested == 0 {
+		t.Fatal("no instructions without line tested")
+	}
+}
+
+func testDwarfSubprograms(d *dwarfmapper) []subprogramRange {
+	var subprograms []subprogramRange
+	for _, u := range d.units {
+		d.load(u)
+		subprograms = append(subprograms, u.subprograms...)
+	}
+	return subprograms
+}
+
+func TestDwarfLogger(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := testStripCustomSections(wasm, debugRanges)
+
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.HandlerOptions{Level: slog.LevelWarn}.NewTextHandler(&buf)))
+	defer SetLogger(nil)
+
+	if _, err := newDwarfParserFromBin(stripped); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("debug diagnostics logged at the warn level: %s", buf.String())
+	}
+
+	SetLogger(slog.New(slog.HandlerOptions{Level: slog.LevelDebug}.NewTextHandler(&buf)))
+	if _, err := newDwarfParserFromBin(stripped); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), "section=.debug_ranges") {
+		t.Errorf("missing section not logged: %s", buf.String())
+	}
+}
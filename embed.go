@@ -0,0 +1,307 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Profilers is a set of profilers wired to a wazero runtime by Instrument.
+//
+// The profilers are created when the first module is compiled with
+// CompileModule, they profile this module and the modules compiled after it,
+// which are prepared with PrepareModule. The accessors of the profilers return
+// nil until then, or when the profilers are not enabled.
+type Profilers struct {
+	// Runtime compiling and running the modules, created with the
+	// configuration passed to Instrument. Custom sections are enabled so the
+	// modules are symbolized with their DWARF information.
+	Runtime wazero.Runtime
+
+	sampleRate  float64
+	options     []ProfilingOption
+	cpuOptions  []CPUProfilerOption
+	memOptions  []MemoryProfilerOption
+	wallOptions []WallClockProfilerOption
+	cpuEnabled  bool
+	memEnabled  bool
+	wallEnabled bool
+	configure   []func(wazero.ModuleConfig) wazero.ModuleConfig
+
+	mutex     sync.Mutex
+	profiling *Profiling
+	cpu       *CPUProfiler
+	mem       *MemoryProfiler
+	wall      *WallClockProfiler
+	// Factory of the listeners of the profilers, read without the mutex
+	// while compiling modules.
+	factory atomic.Pointer[multiFactory]
+}
+
+type multiFactory struct {
+	experimental.FunctionListenerFactory
+}
+
+// Option is a type used to represent configuration options for Profilers
+// instances created by Instrument.
+type Option func(*Profilers)
+
+// SampleRate configures the rate at which the calls of functions are sampled
+// by the profilers (0-1).
+//
+// Default to 1.
+func SampleRate(rate float64) Option {
+	return func(p *Profilers) { p.sampleRate = rate }
+}
+
+// ProfilingOptions configures the profiling of the modules compiled with
+// CompileModule, e.g. with Focus or ThreadLabels.
+func ProfilingOptions(options ...ProfilingOption) Option {
+	return func(p *Profilers) { p.options = append(p.options, options...) }
+}
+
+// CPUProfiling enables the CPU profiler, created with the options.
+func CPUProfiling(options ...CPUProfilerOption) Option {
+	return func(p *Profilers) { p.cpuEnabled, p.cpuOptions = true, options }
+}
+
+// MemoryProfiling enables the memory profiler, created with the options.
+func MemoryProfiling(options ...MemoryProfilerOption) Option {
+	return func(p *Profilers) { p.memEnabled, p.memOptions = true, options }
+}
+
+// WallClockProfiling enables the wall-clock profiler, created with the
+// options.
+func WallClockProfiling(options ...WallClockProfilerOption) Option {
+	return func(p *Profilers) { p.wallEnabled, p.wallOptions = true, options }
+}
+
+// ModuleConfig adds a function configuring the modules instantiated with
+// InstantiateModule, e.g. to set the arguments or the file system of the
+// guest. The functions are applied in the order of the options.
+func ModuleConfig(configure func(wazero.ModuleConfig) wazero.ModuleConfig) Option {
+	return func(p *Profilers) { p.configure = append(p.configure, configure) }
+}
+
+// Env sets environment variables of the modules instantiated with
+// InstantiateModule, given as KEY=VALUE strings like the -env flag of wzprof.
+func Env(env ...string) Option {
+	return ModuleConfig(func(config wazero.ModuleConfig) wazero.ModuleConfig {
+		for _, e := range env {
+			k, v, _ := strings.Cut(e, "=")
+			config = config.WithEnv(k, v)
+		}
+		return config
+	})
+}
+
+// Instrument creates a wazero runtime with the configuration and wires
+// profilers to it, so embedders do not have to assemble the listeners, the
+// sampling, the preparation of the modules, and the HTTP handlers themselves.
+// The CPU and memory profilers are enabled unless the options select others.
+//
+// The returned context carries the listeners of the profilers, it must be
+// used to instantiate the modules, including host modules like WASI so their
+// functions are profiled. Modules must be compiled with CompileModule:
+//
+//	ctx, profilers := wzprof.Instrument(ctx, wazero.NewRuntimeConfig())
+//	defer profilers.Runtime.Close(ctx)
+//
+//	wasi_snapshot_preview1.MustInstantiate(ctx, profilers.Runtime)
+//
+//	compiled, err := profilers.CompileModule(ctx, wasmCode)
+//	...
+//	http.Handle("/debug/pprof/", profilers.Handler())
+//
+// Runtimes configured with the interpreter of wazero must pass the Interpreter
+// option with ProfilingOptions, so calls are located at the right instructions.
+func Instrument(ctx context.Context, cfg wazero.RuntimeConfig, opts ...Option) (context.Context, *Profilers) {
+	p := &Profilers{sampleRate: 1}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if !p.cpuEnabled && !p.memEnabled && !p.wallEnabled {
+		p.cpuEnabled, p.memEnabled = true, true
+	}
+	ctx = context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, profilersFactory{p})
+	p.Runtime = wazero.NewRuntimeWithConfig(ctx, cfg.WithCustomSections(true))
+	return ctx, p
+}
+
+// CompileModule compiles the module with the runtime and prepares its
+// profiling. The profilers are created for the first module compiled.
+func (p *Profilers) CompileModule(ctx context.Context, wasm []byte) (wazero.CompiledModule, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	first := p.profiling == nil
+	if first {
+		p.init(wasm)
+	}
+	ctx = context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, profilersFactory{p})
+	mod, err := p.Runtime.CompileModule(ctx, wasm)
+	if err == nil {
+		if first {
+			err = p.profiling.Prepare(mod)
+		} else {
+			err = p.profiling.PrepareModule(wasm, mod, p.options...)
+		}
+	}
+	if err != nil {
+		if first {
+			p.profiling, p.cpu, p.mem, p.wall = nil, nil, nil, nil
+			p.factory.Store(nil)
+		}
+		return nil, err
+	}
+	return mod, nil
+}
+
+// InstantiateModule instantiates a module compiled with CompileModule in the
+// runtime, with the configuration amended by the ModuleConfig options.
+func (p *Profilers) InstantiateModule(ctx context.Context, compiled wazero.CompiledModule, config wazero.ModuleConfig) (api.Module, error) {
+	for _, configure := range p.configure {
+		config = configure(config)
+	}
+	return p.Runtime.InstantiateModule(ctx, compiled, config)
+}
+
+// init creates the profilers for the module. It must be called with the mutex
+// held.
+func (p *Profilers) init(wasm []byte) {
+	p.profiling = ProfilingFor(wasm, p.options...)
+
+	var listeners []experimental.FunctionListenerFactory
+	if p.cpuEnabled {
+		p.cpu = p.profiling.CPUProfiler(p.cpuOptions...)
+		listeners = append(listeners, p.cpu)
+	}
+	if p.memEnabled {
+		p.mem = p.profiling.MemoryProfiler(p.memOptions...)
+		listeners = append(listeners, p.mem)
+	}
+	if p.wallEnabled {
+		p.wall = p.profiling.WallClockProfiler(p.wallOptions...)
+		listeners = append(listeners, p.wall)
+	}
+	if p.sampleRate < 1 {
+		for i, lstn := range listeners {
+			listeners[i] = Sample(p.sampleRate, lstn)
+		}
+	}
+	p.factory.Store(&multiFactory{experimental.MultiFunctionListenerFactory(listeners...)})
+}
+
+// Profiling returns the profiling of the first module compiled.
+func (p *Profilers) Profiling() *Profiling {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.profiling
+}
+
+// CPU returns the CPU profiler. The profile is recorded between calls to its
+// StartProfile and StopProfile methods, or by the HTTP handler.
+func (p *Profilers) CPU() *CPUProfiler {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.cpu
+}
+
+// Memory returns the memory profiler.
+func (p *Profilers) Memory() *MemoryProfiler {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.mem
+}
+
+// WallClock returns the wall-clock profiler.
+func (p *Profilers) WallClock() *WallClockProfiler {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.wall
+}
+
+// SampleRate returns the sample rate of the profilers, which is passed to the
+// methods building their profiles.
+func (p *Profilers) SampleRate() float64 {
+	return p.sampleRate
+}
+
+// Handler returns a http handler serving the profiles of the enabled profilers
+// like Profiling.Handler, it is meant to be installed on "/debug/pprof/". The
+// handler responds with 503 Service Unavailable until a module is compiled.
+func (p *Profilers) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mutex.Lock()
+		prof := p.profiling
+		var profilers []Profiler
+		if p.cpu != nil {
+			profilers = append(profilers, p.cpu)
+		}
+		if p.mem != nil {
+			profilers = append(profilers, p.mem)
+		}
+		if p.wall != nil {
+			profilers = append(profilers, p.wall)
+		}
+		p.mutex.Unlock()
+
+		if prof == nil {
+			http.Error(w, "no module compiled", http.StatusServiceUnavailable)
+			return
+		}
+		prof.Handler(p.sampleRate, nil, profilers...).ServeHTTP(w, r)
+	})
+}
+
+// profilersFactory creates the listeners of the profilers. The functions of
+// host modules may be compiled before the profilers are created, their
+// listeners are created when they are first called.
+type profilersFactory struct{ p *Profilers }
+
+func (f profilersFactory) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if factory := f.p.factory.Load(); factory != nil {
+		return factory.NewFunctionListener(def)
+	}
+	return &lazyListener{p: f.p, def: def}
+}
+
+type lazyListener struct {
+	p    *Profilers
+	def  api.FunctionDefinition
+	once sync.Once
+	l    experimental.FunctionListener
+}
+
+func (l *lazyListener) listener() experimental.FunctionListener {
+	factory := l.p.factory.Load()
+	if factory == nil {
+		return nil
+	}
+	l.once.Do(func() { l.l = factory.NewFunctionListener(l.def) })
+	return l.l
+}
+
+func (l *lazyListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	if lstn := l.listener(); lstn != nil {
+		lstn.Before(ctx, mod, def, params, si)
+	}
+}
+
+func (l *lazyListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if lstn := l.listener(); lstn != nil {
+		lstn.After(ctx, mod, def, results)
+	}
+}
+
+func (l *lazyListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	if lstn := l.listener(); lstn != nil {
+		lstn.Abort(ctx, mod, def, err)
+	}
+}
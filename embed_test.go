@@ -0,0 +1,93 @@
+package wzprof
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func TestInstrument(t *testing.T) {
+	ctx, profilers := Instrument(context.Background(), wazero.NewRuntimeConfig(), CPUProfiling())
+	defer profilers.Runtime.Close(ctx)
+
+	if profilers.CPU() != nil {
+		t.Error("profilers created before compiling a module")
+	}
+	handler := profilers.Handler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status before compiling a module: %d", w.Code)
+	}
+
+	compiled, err := profilers.CompileModule(ctx, testLoopModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := profilers.CPU()
+	if cpu == nil || profilers.Memory() != nil {
+		t.Fatal("wrong profilers enabled")
+	}
+
+	instance, err := profilers.Runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.StartProfile()
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prof := cpu.StopProfile(profilers.SampleRate())
+
+	found := false
+	for _, sample := range prof.Sample {
+		if sample.Location[0].Line[0].Function.Name == "inner" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("calls of inner not profiled")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong status after compiling a module: %d", w.Code)
+	}
+}
+
+func TestInstrumentModuleConfig(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/wat/env.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, profilers := Instrument(context.Background(), wazero.NewRuntimeConfig(),
+		Env("A=1", "B=22"),
+		ModuleConfig(func(config wazero.ModuleConfig) wazero.ModuleConfig {
+			return config.WithEnv("C", "333")
+		}),
+	)
+	defer profilers.Runtime.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, profilers.Runtime)
+
+	compiled, err := profilers.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The guest exits with the size of its environment.
+	_, err = profilers.InstantiateModule(ctx, compiled, wazero.NewModuleConfig())
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("the guest did not exit: %v", err)
+	}
+	if size := len("A=1\x00B=22\x00C=333\x00"); exitErr.ExitCode() != uint32(size) {
+		t.Errorf("wrong size of the environment: want=%d got=%d", size, exitErr.ExitCode())
+	}
+}
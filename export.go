@@ -0,0 +1,179 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Exporter is an interface implemented by types that push profiles to remote
+// continuous profiling backends.
+type Exporter interface {
+	// Export sends the profile to the backend. The name identifies the kind
+	// of profile (e.g. "cpu", "memory").
+	Export(ctx context.Context, name string, prof *profile.Profile) error
+}
+
+// ParcaExporter is an Exporter pushing profiles to the remote-write API of
+// Parca (https://parca.dev).
+//
+// Profiles are sent as JSON to the HTTP/JSON gateway of the WriteRaw method of
+// the profile store service (parca.profilestore.v1alpha1.ProfileStoreService),
+// at the /profiles/writeraw path, and not over gRPC. The gateway must be
+// enabled on the server receiving the profiles: Parca serves it on the same
+// port as its gRPC API, but proxies and other implementations of the profile
+// store which only accept gRPC requests cannot receive profiles from the
+// exporter.
+type ParcaExporter struct {
+	// URL of the Parca server (e.g. http://localhost:7070).
+	URL string
+	// Labels attached to the profiles. The "__name__" label is set to the name
+	// of the profile being exported.
+	Labels map[string]string
+	// HTTP client used to send requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+type parcaWriteRawRequest struct {
+	Series     []parcaRawProfileSeries `json:"series"`
+	Normalized bool                    `json:"normalized"`
+}
+
+type parcaRawProfileSeries struct {
+	Labels  parcaLabelSet    `json:"labels"`
+	Samples []parcaRawSample `json:"samples"`
+}
+
+type parcaLabelSet struct {
+	Labels []parcaLabel `json:"labels"`
+}
+
+type parcaLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type parcaRawSample struct {
+	RawProfile []byte `json:"rawProfile"`
+}
+
+// Export implements the Exporter interface.
+func (e *ParcaExporter) Export(ctx context.Context, name string, prof *profile.Profile) error {
+	var raw bytes.Buffer
+	if err := prof.Write(&raw); err != nil {
+		return err
+	}
+
+	labels := []parcaLabel{{Name: "__name__", Value: name}}
+	for _, k := range sortedKeys(e.Labels) {
+		if k != "__name__" {
+			labels = append(labels, parcaLabel{Name: k, Value: e.Labels[k]})
+		}
+	}
+
+	body, err := json.Marshal(parcaWriteRawRequest{
+		Series: []parcaRawProfileSeries{{
+			Labels:  parcaLabelSet{Labels: labels},
+			Samples: []parcaRawSample{{RawProfile: raw.Bytes()}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(e.URL, "/") + "/profiles/writeraw"
+	return postExport(ctx, e.Client, u, "application/json", body)
+}
+
+// PyroscopeExporter is an Exporter pushing profiles to the ingestion API of
+// Grafana Pyroscope (https://grafana.com/oss/pyroscope/).
+type PyroscopeExporter struct {
+	// URL of the Pyroscope server (e.g. http://localhost:4040).
+	URL string
+	// Name of the application that the profiles are attributed to. The name
+	// of the profile is appended to it (e.g. "app.cpu").
+	Application string
+	// Labels attached to the profiles.
+	Labels map[string]string
+	// HTTP client used to send requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Export implements the Exporter interface.
+func (e *PyroscopeExporter) Export(ctx context.Context, name string, prof *profile.Profile) error {
+	var raw bytes.Buffer
+	if err := prof.Write(&raw); err != nil {
+		return err
+	}
+
+	// Pyroscope expects the labels to be part of the application name, using
+	// the same syntax as Prometheus series (e.g. app.cpu{env=staging}).
+	appName := new(strings.Builder)
+	appName.WriteString(e.Application)
+	appName.WriteString(".")
+	appName.WriteString(name)
+	appName.WriteString("{")
+	for i, k := range sortedKeys(e.Labels) {
+		if i != 0 {
+			appName.WriteString(",")
+		}
+		appName.WriteString(k)
+		appName.WriteString("=")
+		appName.WriteString(e.Labels[k])
+	}
+	appName.WriteString("}")
+
+	start := time.Unix(0, prof.TimeNanos)
+	until := start.Add(time.Duration(prof.DurationNanos))
+	query := url.Values{
+		"name":   {appName.String()},
+		"from":   {strconv.FormatInt(start.Unix(), 10)},
+		"until":  {strconv.FormatInt(until.Unix(), 10)},
+		"format": {"pprof"},
+	}
+
+	u := strings.TrimSuffix(e.URL, "/") + "/ingest?" + query.Encode()
+	return postExport(ctx, e.Client, u, "application/octet-stream", raw.Bytes())
+}
+
+func postExport(ctx context.Context, client *http.Client, url, contentType string, body []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("exporting to %s: %s: %s", req.URL.Host, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,238 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func newExportedProfile() *profile.Profile {
+	fn := &profile.Function{ID: 1, Name: "main"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{1}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+		TimeNanos:  1e9,
+	}
+}
+
+func TestParcaExporter(t *testing.T) {
+	var method, contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/profiles/writeraw" {
+			t.Errorf("wrong path: %s", r.URL.Path)
+		}
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	e := &ParcaExporter{URL: server.URL + "/", Labels: map[string]string{"env": "test"}}
+	if err := e.Export(context.Background(), "cpu", newExportedProfile()); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPost || contentType != "application/json" {
+		t.Errorf("wrong request: %s %s", method, contentType)
+	}
+
+	// The request is decoded with the field names of the JSON mapping of the
+	// WriteRawRequest message served by the gateway, rather than with the
+	// types of the exporter.
+	var req struct {
+		Series []struct {
+			Labels struct {
+				Labels []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"labels"`
+			} `json:"labels"`
+			Samples []struct {
+				RawProfile string `json:"rawProfile"`
+			} `json:"samples"`
+		} `json:"series"`
+		Normalized bool `json:"normalized"`
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&req); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+
+	if len(req.Series) != 1 || len(req.Series[0].Samples) != 1 {
+		t.Fatalf("wrong request: %s", body)
+	}
+	if req.Normalized {
+		t.Error("profiles are not normalized by the exporter")
+	}
+	labels := req.Series[0].Labels.Labels
+	if len(labels) != 2 ||
+		labels[0].Name != "__name__" || labels[0].Value != "cpu" ||
+		labels[1].Name != "env" || labels[1].Value != "test" {
+		t.Errorf("wrong labels: %+v", labels)
+	}
+	// Bytes fields are encoded in base64 in the JSON mapping of protobuf.
+	raw, err := base64.StdEncoding.DecodeString(req.Series[0].Samples[0].RawProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof, err := profile.ParseData(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 1 {
+		t.Errorf("wrong number of samples: %d", len(prof.Sample))
+	}
+}
+
+func TestPyroscopeExporter(t *testing.T) {
+	var name string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = r.URL.Query().Get("name")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	e := &PyroscopeExporter{URL: server.URL, Application: "app", Labels: map[string]string{"b": "2", "a": "1"}}
+	if err := e.Export(context.Background(), "cpu", newExportedProfile()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "app.cpu{a=1,b=2}"; name != want {
+		t.Errorf("wrong application name: want=%q got=%q", want, name)
+	}
+	if _, err := profile.Parse(bytes.NewReader(body)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var req otlpExportProfilesServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1development/profiles" {
+			t.Errorf("wrong path: %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	e := &OTLPExporter{URL: server.URL, Attributes: map[string]string{"service.name": "test"}}
+	if err := e.Export(context.Background(), "cpu", newExportedProfile()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.ResourceProfiles) != 1 || len(req.ResourceProfiles[0].ScopeProfiles) != 1 {
+		t.Fatalf("wrong request: %+v", req)
+	}
+	rp := req.ResourceProfiles[0]
+	if attrs := rp.Resource.Attributes; len(attrs) != 1 || attrs[0] != otlpString("service.name", "test") {
+		t.Errorf("wrong resource attributes: %v", attrs)
+	}
+	profiles := rp.ScopeProfiles[0].Profiles
+	if len(profiles) != 1 {
+		t.Fatalf("wrong number of profiles: %d", len(profiles))
+	}
+
+	p := profiles[0]
+	str := func(i int32) string { return p.StringTable[i] }
+	if p.StringTable[0] != "" {
+		t.Errorf("first string is not empty: %q", p.StringTable[0])
+	}
+	if len(p.SampleType) != 1 || str(p.SampleType[0].TypeStrindex) != "samples" || str(p.SampleType[0].UnitStrindex) != "count" {
+		t.Errorf("wrong sample type: %v", p.SampleType)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].LocationsLength != 1 {
+		t.Fatalf("wrong samples: %v", p.Sample)
+	}
+	loc := p.LocationTable[p.LocationIndices[p.Sample[0].LocationsStartIndex]]
+	if name := str(p.FunctionTable[loc.Line[0].FunctionIndex].NameStrindex); name != "main" {
+		t.Errorf("wrong function name: %q", name)
+	}
+	if len(p.ProfileID) != 32 {
+		t.Errorf("wrong profile id: %q", p.ProfileID)
+	}
+}
+
+func TestExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	e := &ParcaExporter{URL: server.URL}
+	if err := e.Export(context.Background(), "cpu", newExportedProfile()); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestOTLPSpanExporter(t *testing.T) {
+	var req otlpExportTraceServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("wrong path: %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	root := Span{
+		TraceID:       [16]byte{1},
+		SpanID:        [8]byte{2},
+		Name:          "main",
+		TimeNanos:     1e9,
+		DurationNanos: 300,
+	}
+	child := Span{
+		TraceID:       root.TraceID,
+		SpanID:        [8]byte{3},
+		ParentSpanID:  root.SpanID,
+		Name:          "parse",
+		TimeNanos:     1e9 + 100,
+		DurationNanos: 100,
+		Error:         "unreachable",
+	}
+	e := &OTLPSpanExporter{URL: server.URL, Attributes: map[string]string{"service.name": "test"}}
+	if err := e.ExportSpans(context.Background(), []Span{child, root}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("wrong request: %+v", req)
+	}
+	rs := req.ResourceSpans[0]
+	if attrs := rs.Resource.Attributes; len(attrs) != 1 || attrs[0] != otlpString("service.name", "test") {
+		t.Errorf("wrong resource attributes: %v", attrs)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("wrong number of spans: %d", len(spans))
+	}
+
+	c, r := spans[0], spans[1]
+	if r.TraceID != "01000000000000000000000000000000" || r.SpanID != "0200000000000000" || r.ParentSpanID != "" {
+		t.Errorf("wrong ids of the root span: %+v", r)
+	}
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID {
+		t.Errorf("wrong parent of the child span: %+v", c)
+	}
+	if r.Name != "main" || r.StartTimeUnixNano != 1e9 || r.EndTimeUnixNano != 1e9+300 || r.Status != nil {
+		t.Errorf("wrong root span: %+v", r)
+	}
+	if c.Status == nil || c.Status.Code != otlpStatusCodeError || c.Status.Message != "unreachable" {
+		t.Errorf("wrong status of the child span: %+v", c.Status)
+	}
+}
@@ -0,0 +1,182 @@
+package wzprof
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteFlameGraph writes a profile to w as an interactive flame graph in a
+// standalone HTML page, which opens in a web browser without the Go toolchain
+// or any other tool installed. Hovering a frame shows its value, clicking it
+// zooms on its stacks, and clicking the root frame zooms out.
+//
+// Frames are sized by the values of the default sample type of the profile,
+// the ones below 0.1% of the total value are left out of the graph.
+func WriteFlameGraph(w io.Writer, prof *profile.Profile) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+
+	graph := htmlFlameGraph{
+		SampleType: prof.SampleType[index].Type,
+		Flame:      flameGraph(prof, index),
+	}
+	if len(prof.Mapping) > 0 {
+		graph.Module = prof.Mapping[0].File
+	}
+	return flameGraphTemplate.Execute(w, graph)
+}
+
+// flameGraph returns the root frame of the flame graph of the values of the
+// sample type at index, or nil if the profile has no positive values.
+func flameGraph(prof *profile.Profile, index int) *htmlFrame {
+	root := &flameNode{name: "root"}
+	for _, sample := range prof.Sample {
+		if value := sample.Value[index]; value > 0 {
+			root.add(sample, value)
+		}
+	}
+	if root.value == 0 {
+		return nil
+	}
+	return root.render(root.value, root.value, prof.SampleType[index].Unit)
+}
+
+// flameNode is a frame of the flame graph, its value is the sum of the values
+// of the stacks going through it.
+type flameNode struct {
+	name     string
+	value    int64
+	children map[string]*flameNode
+}
+
+func (n *flameNode) add(sample *profile.Sample, value int64) {
+	n.value += value
+	for i := len(sample.Location) - 1; i >= 0; i-- {
+		loc := sample.Location[i]
+		// The lines of a location start with the innermost inlined
+		// function.
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			name := topFunctionName(loc.Line[j].Function)
+			child := n.children[name]
+			if child == nil {
+				if n.children == nil {
+					n.children = make(map[string]*flameNode)
+				}
+				child = &flameNode{name: name}
+				n.children[name] = child
+			}
+			child.value += value
+			n = child
+		}
+	}
+}
+
+// flameMinFraction is the fraction of the total value below which frames are
+// left out of the flame graph, to bound the size of the page.
+const flameMinFraction = 0.001
+
+func (n *flameNode) render(parent, total int64, unit string) *htmlFrame {
+	frame := &htmlFrame{
+		Name:    n.name,
+		Width:   fmt.Sprintf("%.4f%%", 100*float64(n.value)/float64(parent)),
+		Value:   FormatValue(n.value, unit),
+		Percent: FormatPercent(n.value, total),
+		Color:   template.CSS(flameColor(n.name)),
+	}
+	names := make([]string, 0, len(n.children))
+	for name, child := range n.children {
+		if float64(child.value) >= flameMinFraction*float64(total) {
+			names = append(names, name)
+		}
+	}
+	// Frames are sorted by name like in the flame graphs of flamegraph.pl,
+	// so the graphs of similar profiles look alike.
+	sort.Strings(names)
+	for _, name := range names {
+		frame.Children = append(frame.Children, n.children[name].render(n.value, total, unit))
+	}
+	return frame
+}
+
+// flameColor returns a warm color derived from the name of the function, so
+// functions have the same color across the graph.
+func flameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	return fmt.Sprintf("background-color: hsl(%d, 80%%, %d%%)", 10+v%40, 55+(v>>8)%15)
+}
+
+type htmlFlameGraph struct {
+	Module     string
+	SampleType string
+	Flame      *htmlFrame
+}
+
+type htmlFrame struct {
+	Name     string
+	Width    string
+	Value    string
+	Percent  string
+	Color    template.CSS
+	Children []*htmlFrame
+}
+
+// flameGraphTemplate renders the standalone flame graph page, its flame,
+// flame-style and frame templates are shared with the HTML report.
+var flameGraphTemplate = template.Must(template.New("flamegraph").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>wzprof flame graph{{if .Module}}: {{.Module}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+{{template "flame-style"}}
+</style>
+</head>
+<body>
+<h1>{{if .Module}}{{.Module}}: {{end}}{{.SampleType}}</h1>
+{{- if .Flame}}
+{{template "flame" .Flame}}
+{{- else}}
+<p>No samples.</p>
+{{- end}}
+</body>
+</html>
+{{define "flame-style"}}.flame { display: flex; flex-direction: column-reverse; width: 100%; font-size: 12px; }
+.node { display: flex; flex-direction: column-reverse; min-width: 0; }
+.children { display: flex; flex-direction: row; }
+.frame { height: 16px; line-height: 16px; margin: 0 1px 1px 0; padding: 0 2px; overflow: hidden; white-space: nowrap; text-overflow: ellipsis; border-radius: 2px; cursor: pointer; }
+.frame:hover { filter: brightness(80%); }
+{{- end}}
+{{define "flame"}}<div class="flame">{{template "frame" .}}</div>
+{{- /* Clicking a frame zooms on it: the frames which are not its ancestors or
+descendants are hidden, and its ancestors take the full width. */}}
+<script>
+document.querySelectorAll(".flame .frame").forEach(function(frame) {
+  frame.addEventListener("click", function() {
+    document.querySelectorAll(".flame .node").forEach(function(node) {
+      node.style.display = "";
+      node.style.width = node.dataset.width;
+    });
+    for (var node = frame.parentElement; node.classList.contains("node"); node = node.parentElement.parentElement) {
+      Array.prototype.forEach.call(node.parentElement.children, function(sibling) {
+        if (sibling !== node) {
+          sibling.style.display = "none";
+        }
+      });
+      node.style.width = "100%";
+    }
+  });
+});
+</script>
+{{- end}}
+{{define "frame"}}<div class="node" style="width: {{.Width}}" data-width="{{.Width}}"><div class="frame" style="{{.Color}}" title="{{.Name}}: {{.Value}} ({{.Percent}})">{{.Name}}</div>{{if .Children}}<div class="children">{{range .Children}}{{template "frame" .}}{{end}}</div>{{end}}</div>{{end}}
+`))
@@ -0,0 +1,66 @@
+package wzprof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteFlameGraph(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	inlined := &profile.Function{ID: 2, Name: "inlined"}
+	malloc := &profile.Function{ID: 3, Name: "malloc<int>"}
+	tiny := &profile.Function{ID: 4, Name: "tiny"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: inlined}, {Function: main}}}
+	leaf := &profile.Location{ID: 2, Line: []profile.Line{{Function: malloc}}}
+	other := &profile.Location{ID: 3, Line: []profile.Line{{Function: tiny}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, root}, Value: []int64{1, 3000}},
+			{Location: []*profile.Location{root}, Value: []int64{1, 1000}},
+			// Below the threshold of frames left out of the graph.
+			{Location: []*profile.Location{other}, Value: []int64{1, 1}},
+		},
+		Mapping: []*profile.Mapping{{ID: 1, File: "app.wasm"}},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteFlameGraph(b, prof); err != nil {
+		t.Fatal(err)
+	}
+	graph := b.String()
+
+	for _, want := range []string{
+		"<h1>app.wasm: alloc_space</h1>",
+		// Inlined functions are children of their caller, the widths are
+		// relative to the parent frame.
+		`title="main: 3.91kB (99.98%)">main</div><div class="children"><div class="node" style="width: 100.0000%" data-width="100.0000%"><div class="frame"`,
+		`title="inlined: 3.91kB (99.98%)"`,
+		`style="width: 75.0000%" data-width="75.0000%"`,
+		`title="malloc&lt;int&gt;: 2.93kB (74.98%)">malloc&lt;int&gt;</div>`,
+	} {
+		if !strings.Contains(graph, want) {
+			t.Errorf("flame graph does not contain %q", want)
+		}
+	}
+	if strings.Contains(graph, "tiny") {
+		t.Error("flame graph contains a frame below the threshold")
+	}
+
+	prof.DefaultSampleType = "alloc_objects"
+	b.Reset()
+	if err := WriteFlameGraph(b, prof); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `title="tiny: 1 (33.33%)"`) {
+		t.Error("flame graph does not use the default sample type")
+	}
+}
@@ -0,0 +1,236 @@
+package wzprof
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// FlightRecorder is a CPU profiler which continuously records samples, only
+// retaining those of the last few seconds of execution. Profiles can be dumped
+// at any time to capture what the guest was doing right before an event of
+// interest (e.g. an incident), without having to profile the whole lifetime of
+// the program.
+//
+// Samples are kept in a ring of time buckets, the recorded window is therefore
+// approximate: a dumped profile covers at least the configured window (if the
+// recorder ran long enough), and at most one more bucket.
+type FlightRecorder struct {
+	cpu     *CPUProfiler
+	window  time.Duration
+	period  time.Duration
+	mutex   sync.Mutex
+	buckets []flightBucket
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// FlightRecorderOption is a type used to represent configuration options for
+// FlightRecorder instances created by Profiling.FlightRecorder.
+type FlightRecorderOption func(*FlightRecorder)
+
+// FlightWindow configures the duration of execution covered by the profiles
+// dumped by the flight recorder.
+//
+// Default to 30 seconds.
+func FlightWindow(window time.Duration) FlightRecorderOption {
+	return func(r *FlightRecorder) { r.window = window }
+}
+
+// FlightCPUOptions configures the CPU profiler used by the flight recorder to
+// collect samples.
+func FlightCPUOptions(options ...CPUProfilerOption) FlightRecorderOption {
+	return func(r *FlightRecorder) {
+		for _, opt := range options {
+			opt(r.cpu)
+		}
+	}
+}
+
+// flightBuckets is the number of buckets that the recording window is split
+// into, it determines the precision of the window of dumped profiles.
+const flightBuckets = 10
+
+type flightBucket struct {
+	counts stackCounterMap
+	start  time.Time
+	end    time.Time
+}
+
+func newFlightRecorder(p *Profiling, options ...FlightRecorderOption) *FlightRecorder {
+	r := &FlightRecorder{cpu: newCPUProfiler(p)}
+	for _, opt := range options {
+		opt(r)
+	}
+	if r.window <= 0 {
+		r.window = 30 * time.Second
+	}
+	r.period = r.window / flightBuckets
+	if r.period <= 0 {
+		r.period = r.window
+	}
+	return r
+}
+
+// Start begins recording samples. The method returns a boolean to indicate
+// whether starting the recorder succeeded (e.g. false is returned if it was
+// already started).
+func (r *FlightRecorder) Start() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil || !r.cpu.StartProfile() {
+		return false
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+	return true
+}
+
+// Stop stops recording and discards the samples recorded so far.
+func (r *FlightRecorder) Stop() {
+	r.mutex.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	r.mutex.Lock()
+	r.cpu.profile.Store(nil)
+	r.buckets = nil
+	r.mutex.Unlock()
+}
+
+func (r *FlightRecorder) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.mutex.Lock()
+			r.rotate(now)
+			r.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rotate moves the samples recorded since the last rotation to a new bucket,
+// and drops the buckets which have fallen out of the recording window.
+func (r *FlightRecorder) rotate(now time.Time) {
+	counts, start := r.cpu.swapProfile()
+	if counts == nil {
+		return
+	}
+	r.buckets = append(r.buckets, flightBucket{
+		counts: counts,
+		start:  start,
+		end:    now,
+	})
+
+	i := 0
+	for i < len(r.buckets) && now.Sub(r.buckets[i].end) > r.window {
+		i++
+	}
+	r.buckets = append(r.buckets[:0], r.buckets[i:]...)
+}
+
+// Dump returns a CPU profile of the samples recorded during the last window of
+// execution. The recorder keeps running. The method returns nil if the
+// recorder wasn't started.
+func (r *FlightRecorder) Dump(sampleRate float64) *profile.Profile {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop == nil {
+		return nil
+	}
+
+	now := time.Now()
+	r.rotate(now)
+
+	// Buckets are merged in a new map because they are retained for the next
+	// dumps, until they fall out of the window.
+	samples := make(stackCounterMap)
+	start := now
+	for _, b := range r.buckets {
+		if b.start.Before(start) {
+			start = b.start
+		}
+		for k, sc := range b.counts {
+			s := samples[k]
+			if s == nil {
+				s = &stackCounter{stack: sc.stack}
+				samples[k] = s
+			}
+			s.value[0] += sc.value[0]
+			s.value[1] += sc.value[1]
+		}
+	}
+
+	return r.cpu.buildProfile(samples, start, now.Sub(start), sampleRate)
+}
+
+// Name returns "flight".
+func (r *FlightRecorder) Name() string {
+	return "flight"
+}
+
+// Desc returns a description of the flight recorder.
+func (r *FlightRecorder) Desc() string {
+	return profileDescriptions[r.Name()]
+}
+
+// Count returns the number of execution stacks currently retained by the
+// flight recorder.
+func (r *FlightRecorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.cpu.Count()
+	for _, b := range r.buckets {
+		n += len(b.counts)
+	}
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// flight recorder, which are the same as those of CPU profiles.
+func (r *FlightRecorder) SampleType() []*profile.ValueType {
+	return r.cpu.SampleType()
+}
+
+// NewHandler returns a http handler dumping the profile of the flight recorder
+// on each request.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (r *FlightRecorder) NewHandler(sampleRate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prof := r.Dump(sampleRate)
+		if prof == nil {
+			serveError(w, http.StatusServiceUnavailable, "Flight recorder is not running")
+			return
+		}
+		serveProfile(w, prof)
+	})
+}
+
+// NewFunctionListener returns a function listener suited to record CPU timings
+// of calls to the function passed as argument.
+func (r *FlightRecorder) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	return r.cpu.NewFunctionListener(def)
+}
@@ -0,0 +1,80 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestFlightRecorderWindow(t *testing.T) {
+	currentTime := int64(1)
+
+	r := ProfilingFor(nil).FlightRecorder(
+		FlightWindow(time.Hour),
+		FlightCPUOptions(
+			HostTime(true), // wazerotest functions are host functions
+			TimeFunc(func() int64 { return currentTime }),
+		),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+
+	f0 := r.NewFunctionListener(module.Function(0).Definition())
+	f1 := r.NewFunctionListener(module.Function(1).Definition())
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+	}
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(1), PC: 2},
+	}
+
+	ctx := context.Background()
+	call := func(f experimental.FunctionListener, stack []experimental.StackFrame, duration int64) {
+		def := stack[0].Function.Definition()
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(ctx, module, def, nil)
+	}
+
+	if r.Dump(1) != nil {
+		t.Error("dumping a flight recorder which is not running must return nil")
+	}
+	if !r.Start() {
+		t.Fatal("starting the flight recorder failed")
+	}
+	defer r.Stop()
+
+	call(f0, stack0, 10)
+	r.mutex.Lock()
+	r.rotate(time.Now().Add(-2 * time.Hour))
+	r.mutex.Unlock()
+	call(f1, stack1, 20)
+	call(f1, stack1, 30)
+
+	// The first call fell out of the window when dumping the profile.
+	prof := r.Dump(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 2 || v[1] != 50 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+
+	// Samples remain in the window after being dumped.
+	call(f1, stack1, 40)
+	prof = r.Dump(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 3 || v[1] != 90 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+}
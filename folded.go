@@ -0,0 +1,68 @@
+package wzprof
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteFolded writes a profile to w in the folded stack format popularized by
+// Brendan Gregg's flamegraph.pl. Each line contains the semicolon-separated
+// list of functions of a stack, starting from the root, followed by the value
+// of the samples recorded for this stack.
+//
+// The value written is the one of the default sample type of the profile.
+func WriteFolded(w io.Writer, prof *profile.Profile) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return nil
+	}
+
+	stacks := make(map[string]int64, len(prof.Sample))
+	frames := make([]string, 0, 64)
+
+	for _, sample := range prof.Sample {
+		frames = frames[:0]
+		// Locations and lines are ordered from the leaf to the root.
+		for i := len(sample.Location) - 1; i >= 0; i-- {
+			lines := sample.Location[i].Line
+			for j := len(lines) - 1; j >= 0; j-- {
+				frames = append(frames, foldedFunctionName(lines[j].Function))
+			}
+		}
+		if len(frames) > 0 {
+			stacks[strings.Join(frames, ";")] += sample.Value[index]
+		}
+	}
+
+	keys := make([]string, 0, len(stacks))
+	for k := range stacks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := bufio.NewWriter(w)
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(stacks[k], 10))
+		b.WriteByte('\n')
+	}
+	return b.Flush()
+}
+
+func foldedFunctionName(fn *profile.Function) string {
+	if fn == nil || fn.Name == "" {
+		return "?"
+	}
+	// Semicolons are used as frame separators and newlines as stack
+	// separators, so they cannot appear in function names. Spaces are kept
+	// (e.g. in demangled C++ names), the value is separated by the last one.
+	return foldedNameReplacer.Replace(fn.Name)
+}
+
+var foldedNameReplacer = strings.NewReplacer(";", ":", "\n", " ", "\r", " ")
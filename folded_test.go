@@ -0,0 +1,56 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteFolded(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	inlined := &profile.Function{ID: 2, Name: "inlined"}
+	malloc := &profile.Function{ID: 3, Name: "malloc"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: inlined}, {Function: main}}}
+	leaf := &profile.Location{ID: 2, Line: []profile.Line{{Function: malloc}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, root}, Value: []int64{1, 10}},
+			{Location: []*profile.Location{root}, Value: []int64{1, 5}},
+			{Location: []*profile.Location{leaf, root}, Value: []int64{2, 32}},
+		},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteFolded(b, prof); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "main;inlined 5\nmain;inlined;malloc 42\n"
+	if got := b.String(); got != want {
+		t.Errorf("wrong folded output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFoldedFunctionName(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"", "?"},
+		{"main", "main"},
+		{"std::vector<int, std::allocator<int> >::push_back(int const&)", "std::vector<int, std::allocator<int> >::push_back(int const&)"},
+		{"a;b", "a:b"},
+		{"a\nb", "a b"},
+	} {
+		if got := foldedFunctionName(&profile.Function{Name: test.name}); got != test.want {
+			t.Errorf("wrong folded name of %q: want=%q got=%q", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// GCProfiler is the implementation of a profiler recording the garbage
+// collection cycles of Go guests.
+//
+// The profiler instruments the runtime.gcStart and runtime.gcMarkTermination
+// functions, which contain the stop-the-world phases of a collection. It
+// generates samples of two types:
+// - "gc_cycles" counts the number of garbage collection cycles completed.
+// - "gc_pause" records the time spent in the two phases (in nanoseconds).
+//
+// Samples are attributed to the stack which started the cycle, which usually
+// is an allocation made when the heap reached its target size, or a call to
+// runtime.GC.
+//
+// The profiler records nothing for modules which were not compiled by Go.
+type GCProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts stackCounterMap
+	calls  instanceState[gcCallStack]
+	cycle  *stackCounter
+	trace  stackTrace
+	time   func() int64
+	start  time.Time
+}
+
+// GCProfilerOption is a type used to represent configuration options for
+// GCProfiler instances created by Profiling.GCProfiler.
+type GCProfilerOption func(*GCProfiler)
+
+// GCTimeFunc configures the time function used by the GC profiler to measure
+// the duration of garbage collection pauses.
+//
+// By default, the system's monotonic time is used.
+func GCTimeFunc(time func() int64) GCProfilerOption {
+	return func(p *GCProfiler) { p.time = time }
+}
+
+type gcFrame struct {
+	start       int64
+	sample      *stackCounter
+	termination bool
+}
+
+// gcCallStack is the stack of calls in progress of an instance of the guest.
+type gcCallStack struct {
+	frames []gcFrame
+}
+
+const (
+	gcStartFunction           = "runtime.gcStart"
+	gcMarkTerminationFunction = "runtime.gcMarkTermination"
+)
+
+func newGCProfiler(p *Profiling, options ...GCProfilerOption) *GCProfiler {
+	g := &GCProfiler{
+		p:    p,
+		time: nanotime,
+	}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
+}
+
+// StartProfile begins recording the GC profile. The method returns a boolean
+// to indicate whether starting the profile succeeded (e.g. false is returned if
+// it was already started).
+func (p *GCProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(stackCounterMap)
+	p.cycle = nil
+	p.start = time.Now()
+	return true
+}
+
+// StopProfile stops recording and returns the GC profile. The method returns
+// nil if recording of the GC profile wasn't started.
+//
+// The GC profiler is not meant to be sampled since garbage collections are
+// rare events, the sample rate is used to scale the values if it was.
+func (p *GCProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts, p.cycle = nil, nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+
+	ratio := 1 / sampleRate
+	return buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), []float64{ratio, ratio})
+}
+
+// Name returns "gc".
+func (p *GCProfiler) Name() string {
+	return "gc"
+}
+
+// Desc returns a description of the GC profiler.
+func (p *GCProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *GCProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// GC profiler.
+func (p *GCProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "gc_cycles", Unit: "count"},
+		{Type: "gc_pause", Unit: "nanoseconds"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *GCProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("GC", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
+	})
+}
+
+// NewFunctionListener returns a function listener recording the garbage
+// collection phases if the function passed as argument is one of the runtime
+// functions instrumented by the profiler, or nil otherwise.
+func (p *GCProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	switch def.Name() {
+	case gcStartFunction, gcMarkTerminationFunction:
+		return profilingListener{p.p, gcProfiler{p}}
+	default:
+		return nil
+	}
+}
+
+type gcProfiler struct{ *GCProfiler }
+
+func (p gcProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	var frame gcFrame
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+
+	if p.counts != nil {
+		frame.start = p.time()
+		frame.termination = def.Name() == gcMarkTerminationFunction
+
+		// The mark termination runs on the goroutine which completed the
+		// marking phase, the pause is attributed to the stack which started
+		// the cycle instead.
+		if frame.termination && p.cycle != nil {
+			frame.sample = p.cycle
+		} else {
+			p.trace = p.p.makeStackTrace(ctx, p.trace, si)
+			frame.sample = p.counts.lookup(p.trace)
+		}
+		if !frame.termination {
+			p.cycle = frame.sample
+		}
+	}
+
+	s.frames = append(s.frames, frame)
+	p.mutex.Unlock()
+}
+
+func (p gcProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	// Go functions return 1 when they unwind the wasm stack to switch to
+	// another goroutine, the call is resumed later and the cycle is not
+	// completed yet.
+	unwinding := len(results) > 0 && results[0] != 0
+
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.frames) - 1
+	f := s.frames[i]
+	s.frames = s.frames[:i]
+
+	// Samples of a previous profile may be seen if the profile was restarted
+	// during the call, they are not part of the current profile anymore.
+	if f.sample != nil && p.counts[f.sample.stack.key] == f.sample {
+		f.sample.value[1] += p.time() - f.start
+		if f.termination && !unwinding {
+			f.sample.value[0]++
+			p.cycle = nil
+		}
+	}
+	p.mutex.Unlock()
+}
+
+func (p gcProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
@@ -0,0 +1,71 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestGCProfilerCycles(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).GCProfiler(
+		GCTimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := newTestModule(nil,
+		"main.alloc",
+		"runtime.gcStart",
+		"runtime.gcBgMarkWorker",
+		"runtime.gcMarkTermination",
+	)
+
+	if p.NewFunctionListener(module.Function(0).Definition()) != nil {
+		t.Error("listener created for a function which is not part of the garbage collector")
+	}
+	start := p.NewFunctionListener(module.Function(1).Definition())
+	termination := p.NewFunctionListener(module.Function(3).Definition())
+
+	// The first frame is the innermost function of the stack.
+	startStack := []experimental.StackFrame{
+		{Function: module.Function(1), PC: 2},
+		{Function: module.Function(0), PC: 1},
+	}
+	terminationStack := []experimental.StackFrame{
+		{Function: module.Function(3), PC: 4},
+		{Function: module.Function(2), PC: 3},
+	}
+	startDef := module.Function(1).Definition()
+	terminationDef := module.Function(3).Definition()
+	ctx := context.Background()
+
+	p.StartProfile()
+	for _, pause := range []int64{10, 30} {
+		start.Before(ctx, module, startDef, nil, experimental.NewStackIterator(startStack...))
+		currentTime += pause
+		start.After(ctx, module, startDef, nil)
+
+		currentTime += 1000 // concurrent marking
+
+		termination.Before(ctx, module, terminationDef, nil, experimental.NewStackIterator(terminationStack...))
+		currentTime += pause
+		termination.After(ctx, module, terminationDef, nil)
+	}
+
+	if n := p.Count(); n != 1 {
+		t.Fatalf("wrong number of stacks: %d", n)
+	}
+	sample := p.counts[makeStackTraceFromFrames(startStack).key]
+	if sample == nil {
+		t.Fatal("stack which started the cycles not recorded")
+	}
+	if want := [2]int64{2, 80}; sample.value != want {
+		t.Errorf("wrong sample values: want=%v got=%v", want, sample.value)
+	}
+
+	prof := p.StopProfile(1)
+	if len(prof.Sample) != 1 || prof.Sample[0].Value[0] != 2 || prof.Sample[0].Value[1] != 80 {
+		t.Errorf("wrong profile samples: %v", prof.Sample)
+	}
+}
@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	github.com/google/pprof v0.0.0-20230406165453-00490a63f317
+	github.com/ianlancetaylor/demangle v0.0.0-20220517205856-0058ec4f073c
 	github.com/tetratelabs/wazero v1.5.0
 	golang.org/x/exp v0.0.0-20230425010034-47ecfdc1ba53
 )
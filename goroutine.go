@@ -0,0 +1,248 @@
+package wzprof
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// GoroutineProfiler is the implementation of a profiler capturing the stack of
+// the calls in progress in the guest, similarly to the goroutine profile of Go
+// programs.
+//
+// The profile contains the stack of the innermost call in progress of each
+// instance of the module when the profile is taken, programs built for the
+// threads proposal run each thread in its own instance. When the profiler is
+// sampled, the stacks are the ones of the innermost calls that were sampled.
+//
+// For modules compiled by Go, the profile contains the stacks of all the
+// goroutines of the guest instead, which are unwound from the runtime data
+// structures found in memory. The stacks are read while the guest may be
+// running, the profile is a best effort and goroutines which cannot be unwound
+// are omitted.
+type GoroutineProfiler struct {
+	p     *Profiling
+	mutex sync.Mutex
+	calls instanceState[goroutineCallStack]
+	// Go guests only: the calls, memory, and current goroutine of the
+	// instance which made the innermost call, and address of runtime.allgs.
+	last  *goroutineCallStack
+	mem   vmem
+	gp    gptr
+	allgs ptr64
+}
+
+// goroutineCallStack is the stack of calls in progress of an instance of the
+// guest.
+type goroutineCallStack struct {
+	stacks []stackTrace
+	traces []stackTrace
+}
+
+func newGoroutineProfiler(p *Profiling) *GoroutineProfiler {
+	return &GoroutineProfiler{p: p}
+}
+
+// NewProfile builds a profile of the stack of calls currently in progress.
+func (p *GoroutineProfiler) NewProfile() *profile.Profile {
+	samples := make(stackCounterMap, 1)
+	p.mutex.Lock()
+	if p.p.lang == golang {
+		p.observeGoroutines(samples)
+	} else {
+		p.calls.each(func(s *goroutineCallStack) {
+			if i := len(s.stacks); i > 0 {
+				samples.observe(s.stacks[i-1], 0)
+			}
+		})
+	}
+	p.mutex.Unlock()
+
+	prof := buildProfile(p.p, samples, time.Now(), 0, p.SampleType(), []float64{1})
+	prof.PeriodType = &profile.ValueType{Type: "goroutine", Unit: "count"}
+	prof.Period = 1
+	return prof
+}
+
+// Name returns "goroutine" to match the name of the goroutine profiler in
+// pprof.
+func (p *GoroutineProfiler) Name() string {
+	return "goroutine"
+}
+
+// Desc returns a description of the goroutine profiler.
+func (p *GoroutineProfiler) Desc() string {
+	return "Stack traces of the calls currently in progress in the guest, or of all goroutines of Go programs. Use debug=1 as a query parameter to export in a text format."
+}
+
+// Count returns the number of stacks captured by the profiler, which is the
+// number of instances of the guest executing. For Go guests, it is the number
+// of live goroutines.
+func (p *GoroutineProfiler) Count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.p.lang == golang {
+		n := 0
+		p.forEachGoroutine(func(gptr, uint32) { n++ })
+		return n
+	}
+	n := 0
+	p.calls.each(func(s *goroutineCallStack) {
+		if len(s.stacks) > 0 {
+			n++
+		}
+	})
+	return n
+}
+
+// forEachGoroutine calls fn with each live goroutine of a Go guest and its
+// status. The mutex must be held.
+func (p *GoroutineProfiler) forEachGoroutine(fn func(g gptr, status uint32)) {
+	symbols, _ := p.p.symbols.(*pclntab)
+	if symbols == nil || p.mem == nil {
+		return
+	}
+	defer func() {
+		// The guest memory may be modified while it is being read, in which
+		// case the pointers found in it might be invalid.
+		recover()
+	}()
+	mem := p.mem
+	if p.allgs == 0 {
+		if p.gp == 0 || gMCurg(mem, p.gp) != p.gp {
+			return // not running on a user goroutine yet
+		}
+		if p.allgs = findAllgs(mem, &symbols.md, p.gp); p.allgs == 0 {
+			return
+		}
+	}
+	for _, g := range readAllgs(mem, p.allgs) {
+		switch status := gStatus(mem, g); status {
+		case gStatusIdle, gStatusDead:
+		default:
+			fn(g, status)
+		}
+	}
+}
+
+// observeGoroutines records the stacks of all the goroutines of a Go guest.
+// The goroutine running on the guest is given the stack of the innermost call
+// in progress since its saved registers are stale. The mutex must be held.
+func (p *GoroutineProfiler) observeGoroutines(samples stackCounterMap) {
+	symbols, _ := p.p.symbols.(*pclntab)
+	trace := stackTrace{}
+	p.forEachGoroutine(func(g gptr, status uint32) {
+		if status == gStatusRunning {
+			if i := len(p.last.stacks); i > 0 {
+				samples.observe(p.last.stacks[i-1], 0)
+			}
+			return
+		}
+		var ok bool
+		if trace, ok = p.p.goroutineStack(trace, symbols, p.mem, g); ok && trace.len() > 0 {
+			samples.observe(trace, 0)
+		}
+	})
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// goroutine profiler.
+func (p *GoroutineProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "goroutine", Unit: "count"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The goroutine profile is not sampled, the sample rate is ignored.
+func (p *GoroutineProfiler) NewHandler(sampleRate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prof := p.NewProfile()
+
+		if debug, _ := strconv.Atoi(r.FormValue("debug")); debug > 0 {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeGoroutines(w, prof)
+			return
+		}
+
+		serveProfile(w, prof)
+	})
+}
+
+// writeGoroutines writes a goroutine profile in the text format used by Go
+// with debug=1.
+func writeGoroutines(w io.Writer, prof *profile.Profile) {
+	total := int64(0)
+	for _, sample := range prof.Sample {
+		total += sample.Value[0]
+	}
+	fmt.Fprintf(w, "goroutine profile: total %d\n", total)
+
+	for _, sample := range prof.Sample {
+		fmt.Fprintf(w, "%d @", sample.Value[0])
+		for _, loc := range sample.Location {
+			fmt.Fprintf(w, " %#x", loc.Address)
+		}
+		fmt.Fprintln(w)
+		for _, loc := range sample.Location {
+			for i := len(loc.Line) - 1; i >= 0; i-- {
+				line := loc.Line[i]
+				fmt.Fprintf(w, "#\t%#x\t%s\t%s:%d\n", loc.Address, line.Function.Name, line.Function.Filename, line.Line)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// NewFunctionListener returns a function listener tracking the calls to the
+// function passed as argument.
+func (p *GoroutineProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !p.p.instrumented(def) {
+		return nil
+	}
+	return profilingListener{p.p, goroutineProfiler{p}}
+}
+
+type goroutineProfiler struct{ *GoroutineProfiler }
+
+func (p goroutineProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	trace := stackTrace{}
+	if i := len(s.traces); i > 0 {
+		i--
+		trace = s.traces[i]
+		s.traces = s.traces[:i]
+	}
+	s.stacks = append(s.stacks, p.p.makeStackTrace(ctx, trace, si))
+	if p.p.lang == golang {
+		p.last = s
+		p.mem = mod.Memory()
+		p.gp = gptr(mod.(experimental.InternalModule).Global(2).Get())
+	}
+	p.mutex.Unlock()
+}
+
+func (p goroutineProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.stacks) - 1
+	s.traces = append(s.traces, s.stacks[i])
+	s.stacks = s.stacks[:i]
+	p.mutex.Unlock()
+}
+
+func (p goroutineProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
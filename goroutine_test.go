@@ -0,0 +1,96 @@
+package wzprof
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+func TestGoroutineProfilerStack(t *testing.T) {
+	p := ProfilingFor(nil).GoroutineProfiler()
+
+	module := newTestModule(nil, "main", "work")
+
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+	}
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(1), PC: 2},
+		{Function: module.Function(0), PC: 1},
+	}
+
+	def0 := module.Function(0).Definition()
+	def1 := module.Function(1).Definition()
+	ctx := context.Background()
+
+	if n := len(p.NewProfile().Sample); n != 0 {
+		t.Errorf("wrong number of samples before calls: %d", n)
+	}
+
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+
+	prof := p.NewProfile()
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if locs := prof.Sample[0].Location; len(locs) != 2 || locs[0].Line[0].Function.Name != "work" || locs[1].Line[0].Function.Name != "main" {
+		t.Errorf("wrong stack: %v", prof.Sample[0])
+	}
+
+	w := httptest.NewRecorder()
+	p.NewHandler(1).ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	text, _ := io.ReadAll(w.Result().Body)
+	if !strings.HasPrefix(string(text), "goroutine profile: total 1\n") || !strings.Contains(string(text), "\twork\t") {
+		t.Errorf("wrong text output:\n%s", text)
+	}
+
+	f1.After(ctx, module, def1, nil)
+	f0.After(ctx, module, def0, nil)
+
+	if n := p.Count(); n != 0 {
+		t.Errorf("wrong count after calls: %d", n)
+	}
+}
+
+func TestFindAllgs(t *testing.T) {
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	md := &moduledata{bss: 0x100, ebss: 0x200}
+
+	gs := []gptr{0x1000, 0x2000, 0x3000}
+	statuses := []uint32{gStatusRunning, gStatusDead, gStatusScan | 4}
+	for i, g := range gs {
+		mem.WriteUint64Le(uint32(0x800+8*i), uint64(g))
+		mem.WriteUint32Le(uint32(g)+gAtomicStatusOffset, statuses[i])
+	}
+	// A slice header which does not contain the goroutine, followed by allgs.
+	mem.WriteUint64Le(0x120, 0x800)
+	mem.WriteUint64Le(0x128, 1)
+	mem.WriteUint64Le(0x130, 1)
+	mem.WriteUint64Le(0x140, 0x800)
+	mem.WriteUint64Le(0x148, 3)
+	mem.WriteUint64Le(0x150, 4)
+
+	allgs := findAllgs(mem, md, 0x3000)
+	if allgs != 0x140 {
+		t.Fatalf("wrong allgs address: %#x", allgs)
+	}
+	if got := readAllgs(mem, allgs); !slices.Equal(got, gs) {
+		t.Errorf("wrong goroutines: %v", got)
+	}
+	if s := gStatus(mem, 0x3000); s != 4 {
+		t.Errorf("wrong status: %d", s)
+	}
+	if findAllgs(mem, md, 0x4000) != 0 {
+		t.Error("found allgs for unknown goroutine")
+	}
+}
@@ -0,0 +1,319 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/stealthrocket/wzprof/internal/goruntime"
+)
+
+// goVersion is the minor version of the Go toolchain which compiled a module,
+// for example 21 for go1.21.x. The layout of the runtime data structures read
+// by wzprof changes between versions.
+type goVersion int
+
+// Oldest version supported, which introduced the pclntab layout that wzprof
+// knows how to read. Modules compiled by versions more recent than Go 1.22 are
+// assumed to have the same layout as Go 1.22.
+const minGoVersion goVersion = 18
+
+// Magic numbers at the start of pclntab, see debug/gosym.
+const (
+	go118magic = 0xfffffff0
+	go120magic = 0xfffffff1
+)
+
+var goVersionRegexp = regexp.MustCompile(`go1\.(\d+)`)
+
+// parseGoVersion extracts the minor version from a Go version string like
+// "go1.21.3" or "devel go1.22-7b87461", returning zero if it is not valid.
+func parseGoVersion(s string) goVersion {
+	m := goVersionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	v, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return goVersion(v)
+}
+
+// goModuleVersion returns the version of Go which compiled a module, or zero if
+// it could not be determined. Go versions prior to 1.21 do not record their
+// version in the module, the magic number of pclntab then tells the oldest
+// version with its layout.
+func goModuleVersion(wasmbin []byte) goVersion {
+	if v := parseGoVersion(goProducerVersion(wasmbin)); v != 0 {
+		return v
+	}
+	pch := pclntabHeaderFromData(wasmdataSection(wasmbin))
+	switch {
+	case !pch.Valid():
+		return 0
+	case pch.magic == go118magic:
+		return 18
+	default:
+		return 20
+	}
+}
+
+// goProducerVersion returns the version of Go recorded in the "producers"
+// custom section of a wasm module, or an empty string if it could not be found.
+// The Go linker writes this section since Go 1.21.
+//
+// See https://github.com/WebAssembly/tool-conventions/blob/main/ProducersSection.md
+func goProducerVersion(wasmbin []byte) string {
+	b := wasmCustomSection(wasmbin, "producers")
+
+	str := func() (string, bool) {
+		n, r := binary.Uvarint(b)
+		if r <= 0 || n > uint64(len(b)-r) {
+			return "", false
+		}
+		s := string(b[r : r+int(n)])
+		b = b[r+int(n):]
+		return s, true
+	}
+	vec := func() (uint64, bool) {
+		n, r := binary.Uvarint(b)
+		if r <= 0 {
+			return 0, false
+		}
+		b = b[r:]
+		return n, true
+	}
+
+	fields, ok := vec()
+	for i := uint64(0); ok && i < fields; i++ {
+		var field string
+		var values uint64
+		if field, ok = str(); !ok {
+			break
+		}
+		if values, ok = vec(); !ok {
+			break
+		}
+		for j := uint64(0); ok && j < values; j++ {
+			var name, version string
+			if name, ok = str(); !ok {
+				break
+			}
+			if version, ok = str(); !ok {
+				break
+			}
+			if field == "language" && name == "Go" {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+// Markers surrounding the value of runtime.modinfo, see cmd/go/internal/modload.
+var (
+	goModInfoStart = []byte("0w\xaf\x0c\x92t\x08\x02A\xe1\xc1\x07\xe6\xd6\x18\xe6")
+	goModInfoEnd   = []byte("\xf92C1\x86\x18 r\x00\x82B\x10A\x16\xd8\xf2")
+)
+
+// goBuildInfo returns the build information embedded in a module compiled by
+// Go, or nil if it could not be found. The linker does not write the buildinfo
+// section on wasm, the information is read from the string of runtime.modinfo
+// which runtime/debug.ReadBuildInfo returns to the guest.
+func goBuildInfo(wasmbin []byte) *debug.BuildInfo {
+	data := wasmdataSection(wasmbin)
+	i := bytes.Index(data, goModInfoStart)
+	if i < 0 {
+		return nil
+	}
+	data = data[i+len(goModInfoStart):]
+	j := bytes.Index(data, goModInfoEnd)
+	if j < 0 {
+		return nil
+	}
+	info, err := debug.ParseBuildInfo(string(data[:j]))
+	if err != nil {
+		return nil
+	}
+	info.GoVersion = goProducerVersion(wasmbin)
+	return info
+}
+
+// goBuildInfoComments formats the build information of a Go module as comments
+// of profiles, in the format of `go version -m`.
+func goBuildInfoComments(wasmbin []byte) []string {
+	info := goBuildInfo(wasmbin)
+	if info == nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(info.String(), "\n"), "\n")
+}
+
+// funcID converts a function ID found in a module compiled by this version of
+// Go to the values of the goruntime package, which are the ones of Go 1.21.
+func (v goVersion) funcID(id goruntime.FuncID) goruntime.FuncID {
+	// Go 1.22 added FuncID_corostart after FuncID_cgocallback.
+	const funcIDCorostart = goruntime.FuncID_cgocallback + 1
+	if v >= 22 {
+		switch {
+		case id == funcIDCorostart:
+			return goruntime.FuncIDNormal
+		case id > funcIDCorostart:
+			return id - 1
+		}
+	}
+	return id
+}
+
+// _func118 is the layout of _func in Go 1.18 and 1.19, before the start line
+// of functions was added.
+type _func118 struct {
+	EntryOff    uint32
+	NameOff     int32
+	Args        int32
+	Deferreturn uint32
+	Pcsp        uint32
+	Pcfile      uint32
+	Pcln        uint32
+	Npcdata     uint32
+	CuOffset    uint32
+	FuncID      goruntime.FuncID
+	Flag        goruntime.FuncFlag
+	_           [1]byte
+	Nfuncdata   uint8
+}
+
+// inlinedCall118 is the layout of inlinedCall in Go 1.18 and 1.19.
+type inlinedCall118 struct {
+	parent   int16
+	funcID   goruntime.FuncID
+	_        byte
+	file     int32
+	line     int32
+	func_    int32
+	parentPc int32
+}
+
+// moduledata118 is the layout of the first fields of moduledata in Go 1.18 and
+// 1.19, before the coverage counters were added.
+// nolint:unused
+type moduledata118 struct {
+	pcHeader              ptr64
+	funcnametab           []byte
+	cutab                 []uint32
+	filetab               []byte
+	pctab                 []byte
+	pclntable             []byte
+	ftab                  []functab
+	findfunctab           ptr64
+	minpc, maxpc          ptr64
+	text, etext           ptr64
+	noptrdata, enoptrdata ptr64
+	data, edata           ptr64
+	bss, ebss             ptr64
+	noptrbss, enoptrbss   ptr64
+	end, gcdata, gcbss    ptr64
+	types, etypes         ptr64
+	rodata                ptr64
+	gofunc                ptr64
+	textsectmap           []textsect
+}
+
+// readModuledata reads the moduledata structure at addr, converting it to the
+// latest layout.
+func (v goVersion) readModuledata(mem vmem, addr ptr64) moduledata {
+	if v >= 20 {
+		return deref[moduledata](mem, addr)
+	}
+	m := deref[moduledata118](mem, addr)
+	return moduledata{
+		pcHeader:    m.pcHeader,
+		funcnametab: m.funcnametab,
+		cutab:       m.cutab,
+		filetab:     m.filetab,
+		pctab:       m.pctab,
+		pclntable:   m.pclntable,
+		ftab:        m.ftab,
+		findfunctab: m.findfunctab,
+		minpc:       m.minpc,
+		maxpc:       m.maxpc,
+		text:        m.text,
+		etext:       m.etext,
+		noptrdata:   m.noptrdata,
+		enoptrdata:  m.enoptrdata,
+		data:        m.data,
+		edata:       m.edata,
+		bss:         m.bss,
+		ebss:        m.ebss,
+		noptrbss:    m.noptrbss,
+		enoptrbss:   m.enoptrbss,
+		end:         m.end,
+		gcdata:      m.gcdata,
+		gcbss:       m.gcbss,
+		types:       m.types,
+		etypes:      m.etypes,
+		rodata:      m.rodata,
+		gofunc:      m.gofunc,
+		textsectmap: m.textsectmap,
+	}
+}
+
+// funcSize returns the size of the _func structure, which is followed by the
+// pcdata and funcdata offsets in pclntab.
+func (v goVersion) funcSize() pclntabOff {
+	if v >= 20 {
+		return pclntabOff(unsafe.Sizeof(_func{}))
+	}
+	return pclntabOff(unsafe.Sizeof(_func118{}))
+}
+
+// readFunc returns the _func structure at the beginning of b, converting it to
+// the latest layout if needed.
+func (v goVersion) readFunc(b []byte) *_func {
+	p := unsafe.Pointer(unsafe.SliceData(b))
+	switch {
+	case v < 20:
+		f := (*_func118)(p)
+		return &_func{
+			EntryOff:    f.EntryOff,
+			NameOff:     f.NameOff,
+			Args:        f.Args,
+			Deferreturn: f.Deferreturn,
+			Pcsp:        f.Pcsp,
+			Pcfile:      f.Pcfile,
+			Pcln:        f.Pcln,
+			Npcdata:     f.Npcdata,
+			CuOffset:    f.CuOffset,
+			FuncID:      f.FuncID,
+			Flag:        f.Flag,
+			Nfuncdata:   f.Nfuncdata,
+		}
+	case v >= 22:
+		f := *(*_func)(p)
+		f.FuncID = v.funcID(f.FuncID)
+		return &f
+	default:
+		return (*_func)(p)
+	}
+}
+
+// readInlinedCall returns the i-th entry of the inlining tree at addr,
+// converting it to the latest layout if needed.
+func (v goVersion) readInlinedCall(mem vmem, addr ptr64, i int32) inlinedCall {
+	if v < 20 {
+		c := derefArrayIndex[inlinedCall118](mem, addr, i)
+		return inlinedCall{
+			funcID:   c.funcID,
+			nameOff:  c.func_,
+			parentPc: c.parentPc,
+		}
+	}
+	c := derefArrayIndex[inlinedCall](mem, addr, i)
+	c.funcID = v.funcID(c.funcID)
+	return c
+}
@@ -0,0 +1,106 @@
+package wzprof
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/stealthrocket/wzprof/internal/goruntime"
+)
+
+func TestParseGoVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    goVersion
+	}{
+		{"go1.18", 18},
+		{"go1.21.13", 21},
+		{"go1.22rc1", 22},
+		{"devel go1.21-7b87461 Wed Apr 26 19:25:46 2023 +0000", 21},
+		{"", 0},
+		{"tinygo", 0},
+	}
+
+	for _, test := range tests {
+		if got := parseGoVersion(test.version); got != test.want {
+			t.Errorf("%q: go version mismatch: want=%d got=%d", test.version, test.want, got)
+		}
+	}
+}
+
+func TestGoProducerVersion(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := parseGoVersion(goProducerVersion(wasm)); v != 21 {
+		t.Errorf("go version mismatch: want=21 got=%d", v)
+	}
+	if v := goModuleVersion(wasm); v != 21 {
+		t.Errorf("go module version mismatch: want=21 got=%d", v)
+	}
+
+	wasm, err = os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := goProducerVersion(wasm); v != "" {
+		t.Errorf("unexpected go version in C module: %q", v)
+	}
+	if v := goModuleVersion(wasm); v != 0 {
+		t.Errorf("unexpected go module version in C module: %d", v)
+	}
+}
+
+func TestGoVersionFuncID(t *testing.T) {
+	tests := []struct {
+		version goVersion
+		funcID  goruntime.FuncID
+		want    goruntime.FuncID
+	}{
+		{21, goruntime.FuncID_goexit, goruntime.FuncID_goexit},
+		{22, goruntime.FuncIDNormal, goruntime.FuncIDNormal},
+		{22, goruntime.FuncID_cgocallback, goruntime.FuncID_cgocallback},
+		{22, goruntime.FuncID_cgocallback + 1, goruntime.FuncIDNormal}, // corostart
+		{22, goruntime.FuncID_goexit + 1, goruntime.FuncID_goexit},
+	}
+
+	for _, test := range tests {
+		if got := test.version.funcID(test.funcID); got != test.want {
+			t.Errorf("go1.%d: funcID(%d) mismatch: want=%d got=%d", test.version, test.funcID, test.want, got)
+		}
+	}
+}
+
+func TestGoBuildInfo(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := goBuildInfo(wasm)
+	if info == nil {
+		t.Fatal("build information not found")
+	}
+	if info.Path != "command-line-arguments" {
+		t.Errorf("path mismatch: want=command-line-arguments got=%q", info.Path)
+	}
+	if parseGoVersion(info.GoVersion) != 21 {
+		t.Errorf("go version mismatch: want=go1.21 got=%q", info.GoVersion)
+	}
+
+	want := []string{
+		"go\tdevel go1.21-7b87461 Wed Apr 26 19:25:46 2023 +0000",
+		"path\tcommand-line-arguments",
+		"build\t-buildmode=exe",
+		"build\t-compiler=gc",
+		"build\tCGO_ENABLED=0",
+		"build\tGOARCH=wasm",
+		"build\tGOOS=wasip1",
+	}
+	comments := ProfilingFor(wasm).CPUProfiler().buildProfile(nil, time.Now(), 0, 1).Comments
+	if !slices.Equal(comments, want) {
+		t.Errorf("comments mismatch:\nwant: %q\ngot:  %q", want, comments)
+	}
+}
@@ -0,0 +1,316 @@
+package wzprof
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// GrowProfiler is the implementation of a profiler recording the growth of the
+// linear memory of the guest, whether it is grown by the memory.grow
+// instruction or by host functions (e.g. emscripten_resize_heap).
+//
+// The memory.grow instruction cannot be intercepted, the profiler compares the
+// size of the memory when entering and leaving each function of the guest: a
+// growth seen when a function returns is attributed to its stack, and one seen
+// when a function is called is attributed to the stack of its caller. The
+// growth is attributed exactly when all the functions are instrumented, and to
+// the closest instrumented caller otherwise.
+//
+// The profiler generates samples of three types:
+// - "grow_count" counts the number of times the memory was grown.
+// - "grow_pages" records the number of 64 KiB pages added to the memory.
+// - "grow_space" records the number of bytes added to the memory.
+//
+// The profiler can also record the size of the memory after each growth, see
+// GrowTimeline and WriteTrace.
+type GrowProfiler struct {
+	p        *Profiling
+	mutex    sync.Mutex
+	counts   map[uint64]*growSample
+	calls    instanceState[growCallStack]
+	memory   api.Memory
+	size     uint32
+	start    time.Time
+	time     func() int64
+	timeline bool
+	events   []growEvent
+	epoch    int64
+	// Number of pages added to the memory since the profiler was created,
+	// exposed by MetricsHandler.
+	pages int64
+}
+
+// GrowProfilerOption is a type used to represent configuration options for
+// GrowProfiler instances created by Profiling.GrowProfiler.
+type GrowProfilerOption func(*GrowProfiler)
+
+// GrowTimeline configures the profiler to record the time and size of the
+// memory after each growth, which WriteTrace writes as a timeline.
+//
+// Default to false.
+func GrowTimeline(enable bool) GrowProfilerOption {
+	return func(p *GrowProfiler) { p.timeline = enable }
+}
+
+// wasmPageSize is the size of the pages of the linear memory.
+const wasmPageSize = 65536
+
+type growSample struct {
+	stack stackTrace
+	value [3]int64 // count, pages, bytes
+}
+
+func (s *growSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *growSample) sampleValue() []int64 {
+	return s.value[:]
+}
+
+// growCallStack is the stack of calls in progress of an instance of the guest.
+type growCallStack struct {
+	stack  []stackTrace
+	traces []stackTrace
+}
+
+type growEvent struct {
+	time     int64
+	pages    uint32 // size of the memory after the growth
+	grown    uint32
+	function string
+}
+
+func newGrowProfiler(p *Profiling, options ...GrowProfilerOption) *GrowProfiler {
+	g := &GrowProfiler{
+		p:    p,
+		time: nanotime,
+	}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
+}
+
+// StartProfile begins recording the memory growth profile. The method returns
+// a boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+//
+// The events of the timeline recorded by a previous profile are discarded.
+func (p *GrowProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(map[uint64]*growSample)
+	p.start = time.Now()
+	p.events = p.events[:0]
+	p.epoch = p.time()
+	return true
+}
+
+// StopProfile stops recording and returns the memory growth profile. The
+// method returns nil if recording of the profile wasn't started.
+//
+// All the function calls must be instrumented to observe the growth of the
+// memory, the values are not scaled by a sample rate.
+func (p *GrowProfiler) StopProfile() *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts = nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+	return buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), []float64{1, 1, 1})
+}
+
+// Name returns "grow".
+func (p *GrowProfiler) Name() string {
+	return "grow"
+}
+
+// Desc returns a description of the memory growth profiler.
+func (p *GrowProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *GrowProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// memory growth profiler.
+func (p *GrowProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "grow_count", Unit: "count"},
+		{Type: "grow_pages", Unit: "count"},
+		{Type: "grow_space", Unit: "bytes"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is ignored since the profiler must observe all the calls.
+func (p *GrowProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("memory growth", p.StartProfile, p.StopProfile)
+}
+
+// WriteTrace writes the size of the memory after each growth recorded with
+// GrowTimeline to w in the JSON Chrome Trace Event format. Each growth is a
+// counter event of the number of pages of the memory, followed by an instant
+// event naming the function which grew it. The timeline starts with the size of
+// the memory when the first call was observed.
+func (p *GrowProfiler) WriteTrace(w io.Writer) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	b := bufio.NewWriter(w)
+	b.WriteString(`{"displayTimeUnit":"ns","traceEvents":[`)
+
+	var buf []byte
+	for i, e := range p.events {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		function, err := json.Marshal(e.function)
+		if err != nil {
+			return err
+		}
+		// Timestamps are expressed in microseconds.
+		ts := strconv.AppendFloat(nil, float64(e.time-p.epoch)/1e3, 'f', 3, 64)
+
+		buf = append(buf[:0], "\n{\"name\":\"memory\",\"ph\":\"C\",\"ts\":"...)
+		buf = append(buf, ts...)
+		buf = append(buf, ",\"pid\":1,\"tid\":1,\"args\":{\"pages\":"...)
+		buf = strconv.AppendUint(buf, uint64(e.pages), 10)
+		buf = append(buf, "}}"...)
+		if e.grown != 0 {
+			buf = append(buf, ",\n{\"name\":\"memory.grow\",\"ph\":\"i\",\"s\":\"g\",\"ts\":"...)
+			buf = append(buf, ts...)
+			buf = append(buf, ",\"pid\":1,\"tid\":1,\"args\":{\"function\":"...)
+			buf = append(buf, function...)
+			buf = append(buf, ",\"pages\":"...)
+			buf = strconv.AppendUint(buf, uint64(e.grown), 10)
+			buf = append(buf, "}}"...)
+		}
+		b.Write(buf)
+	}
+
+	b.WriteString("\n]}\n")
+	return b.Flush()
+}
+
+// NewFunctionListener returns a function listener comparing the size of the
+// memory when entering and leaving the function passed as argument.
+func (p *GrowProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil && !p.p.instrumented(def) {
+		return nil
+	}
+	return profilingListener{p.p, growthProfiler{p}}
+}
+
+type growthProfiler struct{ *GrowProfiler }
+
+func (p growthProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	// The memory grown since the last event was grown by the caller.
+	p.observe(mod, s)
+	trace := stackTrace{}
+
+	if i := len(s.traces); i > 0 {
+		i--
+		trace = s.traces[i]
+		s.traces = s.traces[:i]
+	}
+
+	s.stack = append(s.stack, p.p.makeStackTrace(ctx, trace, si))
+	p.mutex.Unlock()
+}
+
+func (p growthProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	p.observe(mod, s)
+	i := len(s.stack) - 1
+	s.traces = append(s.traces, s.stack[i])
+	s.stack = s.stack[:i]
+	p.mutex.Unlock()
+}
+
+func (p growthProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
+
+// observe records the growth of the memory since the last call, attributed to
+// the stack at the top of the call stack of the instance. Instances sharing
+// their memory (e.g. the threads of programs built for the threads proposal)
+// attribute the growth to the first one which observes it. It must be called
+// with the mutex held.
+func (p growthProfiler) observe(mod api.Module, s *growCallStack) {
+	mem := mod.Memory()
+	if mem == nil {
+		return
+	}
+	size := mem.Size() / wasmPageSize
+	if mem != p.memory {
+		// The memory of a new instance was not grown by the functions of
+		// the previous one, its initial size starts the timeline.
+		p.memory, p.size = mem, size
+		if p.timeline && p.counts != nil {
+			p.events = append(p.events, growEvent{time: p.time(), pages: size})
+		}
+		return
+	}
+	grown := size - p.size
+	p.size = size
+	p.pages += int64(grown)
+
+	i := len(s.stack) - 1
+	if grown == 0 || i < 0 || p.counts == nil {
+		return
+	}
+	stack := s.stack[i]
+	sample := p.counts[stack.key]
+	if sample == nil {
+		sample = &growSample{stack: stack.clone()}
+		p.counts[stack.key] = sample
+	}
+	sample.value[0]++
+	sample.value[1] += int64(grown)
+	sample.value[2] += int64(grown) * wasmPageSize
+
+	if p.timeline && stack.len() > 0 {
+		def := stack.index(0).fn.Definition()
+		name := wasmFunctionName(def)
+		if def.GoFunction() != nil {
+			name = def.DebugName()
+		}
+		p.events = append(p.events, growEvent{
+			time:     p.time(),
+			pages:    size,
+			grown:    grown,
+			function: name,
+		})
+	}
+}
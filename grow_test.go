@@ -0,0 +1,79 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestGrowProfiler(t *testing.T) {
+	p := ProfilingFor(nil).GrowProfiler(GrowTimeline(true))
+
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(mem,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+	stack0 := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	stack1 := append(stack0, experimental.StackFrame{Function: module.Function(1), PC: 2})
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+	ctx := context.Background()
+
+	p.StartProfile()
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	mem.Grow(1) // grown by f0 before calling f1
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	mem.Grow(2)
+	f1.After(ctx, module, def1, nil)
+	mem.Grow(3) // grown by f0 after calling f1
+	f0.After(ctx, module, def0, nil)
+	prof := p.StopProfile()
+
+	if len(prof.Sample) != 2 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	for _, sample := range prof.Sample {
+		want := []int64{2, 4, 4 * wazerotest.PageSize}
+		if len(sample.Location) == 2 {
+			want = []int64{1, 2, 2 * wazerotest.PageSize}
+		}
+		for i := range want {
+			if sample.Value[i] != want[i] {
+				t.Errorf("wrong sample values for a stack of depth %d: want=%v got=%v", len(sample.Location), want, sample.Value)
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []struct {
+			Name string         `json:"name"`
+			Ph   string         `json:"ph"`
+			Args map[string]any `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	var pages []float64
+	for _, e := range trace.TraceEvents {
+		if e.Ph == "C" {
+			pages = append(pages, e.Args["pages"].(float64))
+		}
+	}
+	if len(pages) != 4 || pages[0] != 1 || pages[1] != 2 || pages[2] != 4 || pages[3] != 7 {
+		t.Errorf("wrong sizes of the memory in the timeline: %v", pages)
+	}
+}
@@ -0,0 +1,194 @@
+package wzprof
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// HostModuleName is the name of the host module which guests import to control
+// profiling from inside the program. The module exports the functions:
+//
+//	start_cpu()
+//	stop_cpu()
+//	set_label(key_ptr, key_len, value_ptr, value_len i32)
+//	mark(name_ptr, name_len i32)
+//	set_traceparent(ptr, len i32)
+//
+// start_cpu and stop_cpu resume and pause the recording of the CPU profile, so
+// the program can scope profiling to the phases it is interested in. When the
+// module imports start_cpu, recording is paused until the guest calls it.
+//
+// set_label adds a label to the samples recorded from then on, an empty value
+// removes the label. mark is a shorthand for setting the "mark" label, e.g. to
+// name the phase of the program the following samples belong to. Labels of
+// the guest are shared by all the instances of the module; labels set by the
+// host with WithLabels take precedence over them.
+//
+// set_traceparent sets the trace context of the guest from the value of a
+// traceparent header of W3C Trace Context, e.g. received with a request, which
+// adds the trace_id and span_id labels to the samples recorded from then on
+// like WithTraceContext does for the host. An empty or invalid value removes
+// the trace context.
+const HostModuleName = "wzprof"
+
+// guestMarkLabel is the label set by the mark function of the host module.
+const guestMarkLabel = "mark"
+
+// InstantiateHostModule instantiates the host module which guests import to
+// control profiling in the runtime. The CPU profiler driven by start_cpu and
+// stop_cpu may be nil if the CPU profile is not collected, the functions then
+// have no effect.
+//
+// Prepare must be called before the host module is instantiated, so the
+// profiling knows whether the guest imports start_cpu.
+func (p *Profiling) InstantiateHostModule(ctx context.Context, runtime wazero.Runtime, cpu *CPUProfiler) (api.Module, error) {
+	h := &hostModule{p: p, cpu: cpu}
+	if cpu != nil && p.guestStartsCPU {
+		cpu.pause()
+	}
+	return runtime.NewHostModuleBuilder(HostModuleName).
+		NewFunctionBuilder().WithFunc(h.startCPU).Export("start_cpu").
+		NewFunctionBuilder().WithFunc(h.stopCPU).Export("stop_cpu").
+		NewFunctionBuilder().WithFunc(h.setLabel).Export("set_label").
+		NewFunctionBuilder().WithFunc(h.mark).Export("mark").
+		NewFunctionBuilder().WithFunc(h.setTraceParent).Export("set_traceparent").
+		Instantiate(ctx)
+}
+
+// importsHostModule returns whether the module imports the named function of
+// the host module.
+func importsHostModule(mod wazero.CompiledModule, name string) bool {
+	for _, f := range mod.ImportedFunctions() {
+		if moduleName, funcName, _ := f.Import(); moduleName == HostModuleName && funcName == name {
+			return true
+		}
+	}
+	return false
+}
+
+type hostModule struct {
+	p   *Profiling
+	cpu *CPUProfiler
+}
+
+func (h *hostModule) startCPU(ctx context.Context) {
+	if h.cpu != nil {
+		h.cpu.resume()
+	}
+}
+
+func (h *hostModule) stopCPU(ctx context.Context) {
+	if h.cpu != nil {
+		h.cpu.pause()
+	}
+}
+
+func (h *hostModule) setLabel(ctx context.Context, mod api.Module, keyPtr, keyLen, valuePtr, valueLen uint32) {
+	key, ok := mod.Memory().Read(keyPtr, keyLen)
+	if !ok || keyLen == 0 {
+		return
+	}
+	value, ok := mod.Memory().Read(valuePtr, valueLen)
+	if !ok {
+		return
+	}
+	h.p.setGuestLabel(string(key), string(value))
+}
+
+func (h *hostModule) mark(ctx context.Context, mod api.Module, namePtr, nameLen uint32) {
+	name, ok := mod.Memory().Read(namePtr, nameLen)
+	if !ok {
+		return
+	}
+	h.p.setGuestLabel(guestMarkLabel, string(name))
+}
+
+func (h *hostModule) setTraceParent(ctx context.Context, mod api.Module, ptr, length uint32) {
+	traceparent, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		return
+	}
+	tc, err := ParseTraceParent(string(traceparent))
+	if err != nil {
+		h.p.guestTrace.Store(nil)
+		h.p.setGuestLabels(map[string]string{traceIDLabel: "", spanIDLabel: ""})
+		return
+	}
+	h.p.guestTrace.Store(&tc)
+	h.p.setGuestLabels(tc.labels())
+}
+
+func (p *Profiling) setGuestLabel(key, value string) {
+	p.setGuestLabels(map[string]string{key: value})
+}
+
+// setGuestLabels sets multiple labels of the guest at once, so the samples
+// never have some of them only.
+func (p *Profiling) setGuestLabels(set map[string]string) {
+	p.guestMutex.Lock()
+	defer p.guestMutex.Unlock()
+
+	labels := p.guestLabels.Load().values(nil)
+	for key, value := range set {
+		if value == "" {
+			delete(labels, key)
+		} else {
+			labels[key] = value
+		}
+	}
+	p.guestLabels.Store(newLabelSet(labels))
+}
+
+// guestContext returns ctx with the labels set by the guest added to it. The
+// last merge of the labels of the guest and host is cached since they rarely
+// change between calls.
+func (p *Profiling) guestContext(ctx context.Context) context.Context {
+	guest := p.guestLabels.Load()
+	if guest == nil {
+		return ctx
+	}
+	host := contextLabels(ctx)
+	if host == nil {
+		return context.WithValue(ctx, labelsKey{}, guest)
+	}
+	m := p.mergedLabels.Load()
+	if m == nil || m.guest != guest || m.host != host {
+		merged := guest.values(nil)
+		for k, v := range host.labels {
+			merged[k] = v[0]
+		}
+		m = &mergedLabels{guest: guest, host: host, merged: newLabelSet(merged)}
+		p.mergedLabels.Store(m)
+	}
+	return context.WithValue(ctx, labelsKey{}, m.merged)
+}
+
+type mergedLabels struct {
+	guest, host, merged *labelSet
+}
+
+// threadState holds the thread label of an instance of the guest, and the
+// last merge of it with the labels of the calls.
+type threadState struct {
+	thread, labels, merged *labelSet
+}
+
+// threadContext returns ctx with the thread label of the instance added to it.
+func (p *Profiling) threadContext(ctx context.Context, mod api.Module) context.Context {
+	t := p.threads.load(mod)
+	if t.thread == nil {
+		id := p.nthreads.Add(1)
+		t.thread = newLabelSet(map[string]string{"thread": strconv.FormatInt(id, 10)})
+	}
+	labels := contextLabels(ctx)
+	if labels == nil {
+		return context.WithValue(ctx, labelsKey{}, t.thread)
+	}
+	if t.merged == nil || t.labels != labels {
+		t.labels, t.merged = labels, newLabelSet(labels.values(t.thread.values(nil)))
+	}
+	return context.WithValue(ctx, labelsKey{}, t.merged)
+}
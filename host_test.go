@@ -0,0 +1,208 @@
+package wzprof
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestInstantiateHostModule(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	p := ProfilingFor(nil)
+	mod, err := p.InstantiateHostModule(ctx, runtime, p.CPUProfiler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"start_cpu", "stop_cpu", "set_label", "mark", "set_traceparent"} {
+		if mod.ExportedFunction(name) == nil {
+			t.Errorf("missing function: %s", name)
+		}
+	}
+}
+
+func TestHostModuleLabels(t *testing.T) {
+	currentTime := int64(1)
+
+	p := ProfilingFor(nil)
+	cpu := p.CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+	h := &hostModule{p: p, cpu: cpu}
+
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	module.Memory().Write(0, []byte("tenantabcrequest"))
+
+	f := cpu.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	def := stack[0].Function.Definition()
+
+	call := func(ctx context.Context, duration int64) {
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(ctx, module, def, nil)
+	}
+
+	cpu.StartProfile()
+	h.setLabel(context.Background(), module, 0, 6, 6, 1) // tenant=a
+	call(context.Background(), 10)
+	h.mark(context.Background(), module, 7, 2) // mark=bc
+	call(context.Background(), 20)
+	// Labels of the host take precedence over the ones of the guest.
+	call(WithLabels(context.Background(), map[string]string{"tenant": "b"}), 30)
+	h.setLabel(context.Background(), module, 0, 6, 0, 0) // removes tenant
+	h.mark(context.Background(), module, 0, 0)           // removes mark
+	call(context.Background(), 40)
+	// Out of bounds reads do not change the labels.
+	h.setLabel(context.Background(), module, 0, 6, wazerotest.PageSize, 1)
+	call(context.Background(), 50)
+
+	prof := cpu.StopProfile(1)
+	times := make(map[string]int64)
+	for _, s := range prof.Sample {
+		key := ""
+		for _, name := range []string{"tenant", "mark"} {
+			if v := s.Label[name]; len(v) == 1 {
+				key += name + "=" + v[0] + " "
+			}
+		}
+		times[key] += s.Value[1]
+	}
+	want := map[string]int64{
+		"tenant=a ":         10,
+		"tenant=a mark=bc ": 20,
+		"tenant=b mark=bc ": 30,
+		"":                  90,
+	}
+	if len(times) != len(want) {
+		t.Errorf("wrong labels: %v", times)
+	}
+	for key, v := range want {
+		if times[key] != v {
+			t.Errorf("wrong time for labels %q: want=%d got=%d", key, v, times[key])
+		}
+	}
+}
+
+func TestHostModuleTraceParent(t *testing.T) {
+	currentTime := int64(1)
+
+	p := ProfilingFor(nil)
+	cpu := p.CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+	h := &hostModule{p: p, cpu: cpu}
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	module.Memory().Write(0, []byte(traceparent))
+
+	f := cpu.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	def := stack[0].Function.Definition()
+
+	call := func(duration int64) {
+		f.Before(context.Background(), module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(context.Background(), module, def, nil)
+	}
+
+	cpu.StartProfile()
+	h.setTraceParent(context.Background(), module, 0, uint32(len(traceparent)))
+	if tc := p.guestTrace.Load(); tc == nil || tc.SpanID != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} {
+		t.Errorf("wrong trace context of the guest: %v", tc)
+	}
+	call(10)
+	// Invalid values remove the trace context.
+	h.setTraceParent(context.Background(), module, 1, uint32(len(traceparent)))
+	if tc := p.guestTrace.Load(); tc != nil {
+		t.Errorf("trace context of the guest not removed: %v", tc)
+	}
+	call(20)
+
+	prof := cpu.StopProfile(1)
+	times := make(map[string]int64)
+	for _, s := range prof.Sample {
+		key := ""
+		for _, name := range []string{"trace_id", "span_id"} {
+			if v := s.Label[name]; len(v) == 1 {
+				key += name + "=" + v[0] + " "
+			}
+		}
+		times[key] += s.Value[1]
+	}
+	want := map[string]int64{
+		"trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7 ": 10,
+		"": 20,
+	}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("wrong labels: want=%v got=%v", want, times)
+	}
+}
+
+func TestCPUProfilerPause(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+	f2 := p.NewFunctionListener(module.Function(2).Definition())
+
+	stack0 := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	stack1 := append(stack0, experimental.StackFrame{Function: module.Function(1), PC: 2})
+	stack2 := append(stack0, experimental.StackFrame{Function: module.Function(2), PC: 3})
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+	def2 := stack2[1].Function.Definition()
+	ctx := context.Background()
+
+	p.StartProfile()
+
+	currentTime = 1
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	currentTime = 10
+	p.pause()
+	// Calls made while recording is paused are not recorded.
+	currentTime = 20
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime = 30
+	f1.After(ctx, module, def1, nil)
+	// Calls in progress when recording is resumed are recorded with the time
+	// spent after resuming.
+	currentTime = 35
+	f2.Before(ctx, module, def2, nil, experimental.NewStackIterator(stack2...))
+	currentTime = 40
+	p.resume()
+	currentTime = 45
+	f2.After(ctx, module, def2, nil)
+	currentTime = 50
+	f0.After(ctx, module, def0, nil)
+
+	if cpuSamples(p).lookup(makeStackTraceFromFrames(stack1)).count() != 0 {
+		t.Error("call made while paused was recorded")
+	}
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack2), 1, 5)
+	assertStackCount(t, cpuSamples(p), makeStackTraceFromFrames(stack0), 1, (50-1-30)-5)
+}
@@ -0,0 +1,50 @@
+package wzprof
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// instanceState associates the state of a profiler with the instances of the
+// module calling the functions it instruments. Programs built for the threads
+// proposal (e.g. with -pthread) run each thread in its own instance over a
+// shared memory, the calls in progress must be tracked per instance.
+//
+// The state of an instance is only accessed by the goroutine running it, the
+// states of closed instances are dropped from time to time when new ones are
+// added, so they are not retained.
+type instanceState[T any] struct {
+	states sync.Map // api.Module => *T
+	count  atomic.Int64
+}
+
+// Number of instances added between sweeps of the states of closed ones.
+const instanceStateSweep = 64
+
+// load returns the state of the instance, which is zero the first time it is
+// loaded.
+func (s *instanceState[T]) load(mod api.Module) *T {
+	if v, ok := s.states.Load(mod); ok {
+		return v.(*T)
+	}
+	v, loaded := s.states.LoadOrStore(mod, new(T))
+	if !loaded && s.count.Add(1)%instanceStateSweep == 0 {
+		s.states.Range(func(k, _ any) bool {
+			if k.(api.Module).IsClosed() {
+				s.states.Delete(k)
+			}
+			return true
+		})
+	}
+	return v.(*T)
+}
+
+// each calls f with the state of each instance.
+func (s *instanceState[T]) each(f func(*T)) {
+	s.states.Range(func(_, v any) bool {
+		f(v.(*T))
+		return true
+	})
+}
@@ -0,0 +1,195 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// InstructionProfiler is the implementation of a profiler recording the number
+// of wasm instructions executed by the guest, which unlike time does not vary
+// with the load of the host, the compiler of the runtime or the overhead of
+// profiling. Two runs of the same program with the same input report the same
+// counts, making the profile suitable to compare the cost of code changes.
+//
+// The module must be instrumented with Profiling.CountInstructions, the
+// profiler reads the counter of instructions when entering and leaving the
+// functions of the guest.
+//
+// The profiler generates samples of two types:
+// - "samples" counts the number of calls.
+// - "instructions" records the number of instructions executed by the calls,
+// excluding those of their children.
+type InstructionProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts stackCounterMap
+	calls  instanceState[instructionCallStack]
+	trace  stackTrace
+	start  time.Time
+}
+
+type instructionFrame struct {
+	// Value of the counter when the call started, and number of instructions
+	// executed by the calls it made.
+	counter  int64
+	children int64
+	sample   *stackCounter
+}
+
+// instructionCallStack is the stack of calls in progress of an instance of
+// the guest.
+type instructionCallStack struct {
+	frames []instructionFrame
+}
+
+func newInstructionProfiler(p *Profiling) *InstructionProfiler {
+	return &InstructionProfiler{p: p}
+}
+
+// StartProfile begins recording the instruction profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *InstructionProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(stackCounterMap)
+	p.start = time.Now()
+	return true
+}
+
+// StopProfile stops recording and returns the instruction profile. The method
+// returns nil if recording of the instruction profile wasn't started.
+func (p *InstructionProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts = nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+
+	for k, sample := range samples {
+		if sample.count() == 0 {
+			// The call was still in progress when the profile stopped.
+			delete(samples, k)
+		}
+	}
+
+	ratio := 1 / sampleRate
+	return buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), []float64{ratio, ratio})
+}
+
+// Name returns "instructions".
+func (p *InstructionProfiler) Name() string {
+	return "instructions"
+}
+
+// Desc returns a description of the instruction profiler.
+func (p *InstructionProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *InstructionProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// instruction profiler.
+func (p *InstructionProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "instructions", Unit: "count"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *InstructionProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("instruction", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
+	})
+}
+
+// NewFunctionListener returns a function listener recording the instructions
+// executed by calls to the function passed as argument, or nil if the module
+// was not instrumented with Profiling.CountInstructions or if the function is
+// a host function.
+func (p *InstructionProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if p.p.instructionCounter < 0 || def.GoFunction() != nil || !p.p.instrumented(def) {
+		return nil
+	}
+	return profilingListener{p.p, instructionProfiler{p}}
+}
+
+type instructionProfiler struct{ *InstructionProfiler }
+
+func (p instructionProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	frame := instructionFrame{counter: p.counter(mod)}
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+
+	if p.counts != nil {
+		p.trace = p.p.makeStackTrace(ctx, p.trace, si)
+		frame.sample = p.counts.lookup(p.trace)
+	}
+
+	s.frames = append(s.frames, frame)
+	p.mutex.Unlock()
+}
+
+func (p instructionProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	counter := p.counter(mod)
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.frames) - 1
+	f := s.frames[i]
+	s.frames = s.frames[:i]
+
+	// The instructions executed by the call are not accounted to its parent,
+	// so each stack is only attributed the instructions of its leaf function.
+	total := counter - f.counter
+	if i > 0 {
+		s.frames[i-1].children += total
+	}
+
+	// Samples of a previous profile may be seen if the profile was restarted
+	// during the call, they are not part of the current profile anymore.
+	if f.sample != nil && p.counts[f.sample.stack.key] == f.sample {
+		f.sample.observe(total - f.children)
+	}
+	p.mutex.Unlock()
+}
+
+func (p instructionProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
+
+// counter returns the number of instructions executed so far by the instance
+// of the module.
+func (p instructionProfiler) counter(mod api.Module) int64 {
+	m, ok := mod.(experimental.InternalModule)
+	if !ok || int64(m.NumGlobal()) <= p.p.instructionCounter {
+		return 0
+	}
+	return int64(m.Global(int(p.p.instructionCounter)).Get())
+}
@@ -0,0 +1,149 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// testLoopModule returns a module exporting two functions: inner runs a loop
+// of ten iterations executing 73 instructions, outer calls inner twice.
+func testLoopModule() []byte {
+	section := func(id byte, content string) []byte {
+		return append(binary.AppendUvarint([]byte{id}, uint64(len(content))), content...)
+	}
+	body := func(code string) string {
+		return string(binary.AppendUvarint(nil, uint64(len(code)))) + code
+	}
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	b = append(b, section(1, "\x01\x60\x00\x00")...)         // type () -> ()
+	b = append(b, section(3, "\x02\x00\x00")...)             // two functions
+	b = append(b, section(6, "\x01\x7F\x01\x41\x00\x0B")...) // (global (mut i32))
+	b = append(b, section(7, "\x02\x05outer\x00\x00\x05inner\x00\x01")...)
+	b = append(b, section(10, "\x02"+
+		body("\x00"+ // no locals
+			"\x10\x01"+ // call inner
+			"\x10\x01"+ // call inner
+			"\x0B")+ // end
+		body("\x01\x01\x7F"+ // (local i32)
+			"\x03\x40"+ // loop
+			"\x20\x00"+ // local.get 0
+			"\x41\x01"+ // i32.const 1
+			"\x6A"+ // i32.add
+			"\x22\x00"+ // local.tee 0
+			"\x41\x0A"+ // i32.const 10
+			"\x49"+ // i32.lt_u
+			"\x0D\x00"+ // br_if 0
+			"\x0B"+ // end
+			"\x0B"), // end
+	)...)
+	return b
+}
+
+func TestInstructionProfiler(t *testing.T) {
+	wasm := testLoopModule()
+	p := ProfilingFor(wasm)
+	instr := p.InstructionProfiler()
+
+	instrumented, err := p.CountInstructions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.instructionCounter != 1 {
+		t.Errorf("wrong index of the instruction counter: %d", p.instructionCounter)
+	}
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, instr)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := runtime.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instr.StartProfile()
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prof := instr.StopProfile(1)
+
+	const inner, outer = 73, 3
+	if n := instance.(experimental.InternalModule).Global(1).Get(); n != 2*inner+outer {
+		t.Errorf("wrong number of instructions executed: want=%d got=%d", 2*inner+outer, n)
+	}
+
+	// Each call of inner is made from a different call site of outer.
+	values := make(map[string][2]int64)
+	for _, sample := range prof.Sample {
+		name := sample.Location[0].Line[0].Function.Name
+		v := values[name]
+		v[0] += sample.Value[0]
+		v[1] += sample.Value[1]
+		values[name] = v
+	}
+	if v := values["inner"]; v != [2]int64{2, 2 * inner} {
+		t.Errorf("wrong samples of inner: %v", v)
+	}
+	if v := values["outer"]; v != [2]int64{1, outer} {
+		t.Errorf("wrong samples of outer: %v", v)
+	}
+}
+
+func TestInstructionProfilerNotInstrumented(t *testing.T) {
+	p := ProfilingFor(testLoopModule()).InstructionProfiler()
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, testLoopModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range mod.ExportedFunctions() {
+		if p.NewFunctionListener(def) != nil {
+			t.Errorf("listener returned for %s in a module which is not instrumented", def.Name())
+		}
+	}
+}
+
+func TestCountInstructionsSourceOffsets(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrumented, _, offsets, err := countInstructions(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOffset, oldSize := wasmCodeSection(wasm)
+	newOffset, newSize := wasmCodeSection(instrumented)
+	oldCode := wasm[oldOffset : oldOffset+oldSize]
+	newCode := instrumented[newOffset : newOffset+newSize]
+
+	// The code of the original module is found at the offsets of each run in
+	// the instrumented module.
+	for _, run := range offsets.runs {
+		if !bytes.Equal(newCode[run.new:run.new+run.size], oldCode[run.old:run.old+run.size]) {
+			t.Fatalf("code of the original module not found at offset %d", run.new)
+		}
+		if offset := offsets.original(run.new + run.size/2); offset != run.old+run.size/2 {
+			t.Errorf("wrong original offset of %d: want=%d got=%d", run.new+run.size/2, run.old+run.size/2, offset)
+		}
+	}
+	if len(offsets.runs) == 0 {
+		t.Fatal("no source offsets recorded")
+	}
+}
@@ -0,0 +1,593 @@
+package wzprof
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// countInstructions returns a copy of the wasm module where each function
+// counts the instructions it executes in a new mutable i64 global, which is
+// appended to the globals of the module so the indexes of the others do not
+// change. The function returns the index of the global, and the map from the
+// offsets in the code section of the instrumented module to the ones of the
+// original module.
+//
+// Function bodies are split in segments of instructions which run together:
+// a segment ends after instructions which branch, call, or start a block
+// that can be branched to. The global is incremented by the number of
+// instructions of a segment when it starts, so the counter is exact for the
+// functions which return normally.
+func countInstructions(wasm []byte) ([]byte, uint32, *sourceOffsetMap, error) {
+	m, err := instrumentModule(wasm, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return m.wasm, m.global, m.offsets, nil
+}
+
+// instrumentedModule is a module instrumented by instrumentModule.
+type instrumentedModule struct {
+	wasm []byte
+	// Index of the global counting the instructions, and the map of offsets
+	// in the code section to the ones of the original module.
+	global  uint32
+	offsets *sourceOffsetMap
+	// Segments counting their executions, the global of segments[i] is
+	// global+1+i.
+	segments []countedSegment
+}
+
+// countedSegment is a segment of a function body which counts the number of
+// times it is executed.
+type countedSegment struct {
+	// Index of the function in the index space of the module, which starts
+	// with the imported functions.
+	function     uint32
+	instructions []wasmInstruction
+}
+
+// wasmInstruction is an instruction of the original module, located by its
+// offset in the code section.
+type wasmInstruction struct {
+	offset uint64
+	opcode string
+}
+
+// instrumentModule instruments the module like countInstructions. The
+// segments of the functions for which counted returns true also count their
+// executions, each in a new mutable i64 global following the instruction
+// counter. A nil counted function counts no segments.
+func instrumentModule(wasm []byte, counted func(function uint32) bool) (*instrumentedModule, error) {
+	if len(wasm) < 8 || string(wasm[:4]) != "\x00asm" {
+		return nil, errors.New("invalid wasm module: missing magic number")
+	}
+
+	type section struct {
+		id      byte
+		content []byte
+	}
+	var sections []section
+	for b := wasm[8:]; len(b) > 0; {
+		id := b[0]
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < size {
+			return nil, errors.New("invalid wasm module: truncated section")
+		}
+		b = b[1+n:]
+		sections = append(sections, section{id, b[:size]})
+		b = b[size:]
+	}
+
+	var imports wasmImports
+	var definedGlobals uint64
+	var code []byte
+	for _, s := range sections {
+		var err error
+		switch s.id {
+		case importSectionId:
+			imports, err = wasmImportCounts(s.content)
+		case globalSectionId:
+			definedGlobals, _ = binary.Uvarint(s.content)
+		case codeSectionId:
+			code = s.content
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := &instrumentedModule{
+		global:  uint32(imports.globals + definedGlobals),
+		offsets: new(sourceOffsetMap),
+	}
+
+	// The code is instrumented first since the number of globals added to
+	// the module depends on the segments counted.
+	if code != nil {
+		if counted == nil {
+			counted = func(uint32) bool { return false }
+		}
+		newCode, err := m.instrumentCode(code, uint32(imports.functions), counted)
+		if err != nil {
+			return nil, err
+		}
+		code = newCode
+	}
+
+	// The new globals are mutable i64 initialized to zero.
+	newGlobal := []byte{0x7E, 0x01, 0x42, 0x00, 0x0B}
+	globalSection := func(content []byte) []byte {
+		count, n := binary.Uvarint(content)
+		added := 1 + len(m.segments)
+		out := binary.AppendUvarint(nil, count+uint64(added))
+		out = append(out, content[n:]...)
+		for i := 0; i < added; i++ {
+			out = append(out, newGlobal...)
+		}
+		return out
+	}
+
+	out := append([]byte{}, wasm[:8]...)
+	appendSection := func(id byte, content []byte) {
+		out = append(out, id)
+		out = binary.AppendUvarint(out, uint64(len(content)))
+		out = append(out, content...)
+	}
+
+	hasGlobals := definedGlobals > 0
+	for _, s := range sections {
+		switch s.id {
+		case globalSectionId:
+			appendSection(s.id, globalSection(s.content))
+			hasGlobals = true
+			continue
+		case exportSectionId, startSectionId, elementSectionId, dataCountSectionId, codeSectionId, dataSectionId:
+			// The global section is added before the first section which
+			// follows it when the module has none.
+			if !hasGlobals {
+				appendSection(globalSectionId, globalSection([]byte{0}))
+				hasGlobals = true
+			}
+		}
+		if s.id == codeSectionId {
+			appendSection(s.id, code)
+			continue
+		}
+		appendSection(s.id, s.content)
+	}
+	if !hasGlobals {
+		appendSection(globalSectionId, globalSection([]byte{0}))
+	}
+	m.wasm = out
+	return m, nil
+}
+
+const (
+	customSectionId    = 0
+	typeSectionId      = 1
+	importSectionId    = 2
+	functionSectionId  = 3
+	memorySectionId    = 5
+	globalSectionId    = 6
+	exportSectionId    = 7
+	startSectionId     = 8
+	elementSectionId   = 9
+	codeSectionId      = 10
+	dataSectionId      = 11
+	dataCountSectionId = 12
+)
+
+// wasmImports is the number of functions and globals in the import section,
+// which precede the ones defined by the module in their index spaces.
+type wasmImports struct {
+	functions uint64
+	globals   uint64
+}
+
+// wasmImportCounts returns the number of functions and globals in the import
+// section.
+func wasmImportCounts(b []byte) (wasmImports, error) {
+	var imports wasmImports
+	r := wasmReader{b: b}
+	count := r.uleb()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		r.skip(int(r.uleb())) // module
+		r.skip(int(r.uleb())) // name
+		switch kind := r.byte(); kind {
+		case 0x00: // function
+			r.uleb()
+			imports.functions++
+		case 0x01: // table
+			r.byte()
+			r.limits()
+		case 0x02: // memory
+			r.limits()
+		case 0x03: // global
+			r.byte()
+			r.byte()
+			imports.globals++
+		case 0x04: // tag
+			r.byte()
+			r.uleb()
+		default:
+			return imports, fmt.Errorf("invalid wasm module: unknown import kind %#x", kind)
+		}
+	}
+	if r.err != nil {
+		return imports, fmt.Errorf("invalid wasm module: import section: %w", r.err)
+	}
+	return imports, nil
+}
+
+// instrumentCode instruments the function bodies of the code section to
+// count the instructions they execute in the global of m, and the executions
+// of the segments of the counted functions. The functions defined by the
+// module follow the imported ones in the index space.
+func (m *instrumentedModule) instrumentCode(code []byte, imported uint32, counted func(function uint32) bool) ([]byte, error) {
+	r := wasmReader{b: code}
+	count := r.uleb()
+	out := binary.AppendUvarint(nil, count)
+
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		size := r.uleb()
+		start := r.i
+		body := r.read(int(size))
+		if r.err != nil {
+			break
+		}
+		segments, err := wasmSegments(body)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		function := imported + uint32(i)
+		countSegments := counted(function)
+
+		var newBody []byte
+		var runs []sourceOffsetRun
+		for _, seg := range segments {
+			if seg.count > 0 {
+				newBody = appendCountInstructions(newBody, m.global, seg.count)
+				if countSegments {
+					global := m.global + 1 + uint32(len(m.segments))
+					newBody = appendCountInstructions(newBody, global, 1)
+					m.segments = append(m.segments, countedSegment{
+						function:     function,
+						instructions: wasmInstructions(body[seg.start:seg.end], uint64(start+seg.start)),
+					})
+				}
+			}
+			runs = append(runs, sourceOffsetRun{
+				new:  uint64(len(newBody)),
+				old:  uint64(start + seg.start),
+				size: uint64(seg.end - seg.start),
+			})
+			newBody = append(newBody, body[seg.start:seg.end]...)
+		}
+
+		out = binary.AppendUvarint(out, uint64(len(newBody)))
+		for _, run := range runs {
+			run.new += uint64(len(out))
+			m.offsets.runs = append(m.offsets.runs, run)
+		}
+		out = append(out, newBody...)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid wasm module: code section: %w", r.err)
+	}
+	return out, nil
+}
+
+// wasmInstructions returns the instructions of a segment, located at offset
+// in the code section.
+func wasmInstructions(b []byte, offset uint64) []wasmInstruction {
+	var instructions []wasmInstruction
+	r := wasmReader{b: b}
+	for r.i < len(r.b) && r.err == nil {
+		start := r.i
+		r.instruction()
+		instructions = append(instructions, wasmInstruction{
+			offset: offset + uint64(start),
+			opcode: opcodeName(r.b[start:r.i]),
+		})
+	}
+	return instructions
+}
+
+// appendCountInstructions appends the instructions adding n to the global:
+//
+//	global.get $global
+//	i64.const n
+//	i64.add
+//	global.set $global
+func appendCountInstructions(b []byte, global uint32, n int) []byte {
+	b = append(b, 0x23)
+	b = binary.AppendUvarint(b, uint64(global))
+	b = append(b, 0x42)
+	b = appendSleb128(b, int64(n))
+	b = append(b, 0x7C, 0x24)
+	return binary.AppendUvarint(b, uint64(global))
+}
+
+func appendSleb128(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// wasmSegment is a range of a function body, the count is the number of
+// instructions in the range.
+type wasmSegment struct {
+	start, end int
+	count      int
+}
+
+// wasmSegments splits a function body in segments of instructions which run
+// together. The first segment holds the declarations of locals and has no
+// instructions.
+func wasmSegments(body []byte) ([]wasmSegment, error) {
+	r := wasmReader{b: body}
+	for n := r.uleb(); n > 0 && r.err == nil; n-- {
+		r.uleb()
+		r.byte()
+	}
+	segments := []wasmSegment{{start: 0, end: r.i}}
+	seg := wasmSegment{start: r.i}
+
+	for r.i < len(r.b) && r.err == nil {
+		op := r.instruction()
+		seg.count++
+		switch op {
+		case 0x00, // unreachable
+			0x03, // loop
+			0x04, // if
+			0x05, // else
+			0x07, // catch
+			0x08, // throw
+			0x09, // rethrow
+			0x0B, // end
+			0x0C, // br
+			0x0D, // br_if
+			0x0E, // br_table
+			0x0F, // return
+			0x10, // call
+			0x11, // call_indirect
+			0x12, // return_call
+			0x13, // return_call_indirect
+			0x18, // delegate
+			0x19: // catch_all
+			seg.end = r.i
+			segments = append(segments, seg)
+			seg = wasmSegment{start: r.i}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if seg.count > 0 {
+		seg.end = r.i
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// wasmReader decodes the binary format of wasm modules, the first error is
+// retained and stops the decoding.
+type wasmReader struct {
+	b   []byte
+	i   int
+	err error
+}
+
+var errWasmTruncated = errors.New("unexpected end of section")
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.i >= len(r.b) {
+		r.err = errWasmTruncated
+		return 0
+	}
+	r.i++
+	return r.b[r.i-1]
+}
+
+func (r *wasmReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b)-r.i < n {
+		r.err = errWasmTruncated
+		return nil
+	}
+	r.i += n
+	return r.b[r.i-n : r.i]
+}
+
+func (r *wasmReader) skip(n int) {
+	r.read(n)
+}
+
+func (r *wasmReader) uleb() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b[r.i:])
+	if n <= 0 {
+		r.err = errWasmTruncated
+		return 0
+	}
+	r.i += n
+	return v
+}
+
+// sleb skips a signed LEB128 value, which is not needed decoded.
+func (r *wasmReader) sleb() {
+	for r.byte()&0x80 != 0 && r.err == nil {
+	}
+}
+
+func (r *wasmReader) limits() {
+	flags := r.byte()
+	r.uleb()
+	if flags&0x01 != 0 {
+		r.uleb()
+	}
+}
+
+func (r *wasmReader) memarg() {
+	if align := r.uleb(); align&0x40 != 0 {
+		r.uleb() // memory index
+	}
+	r.uleb()
+}
+
+// instruction decodes the next instruction, returning its opcode.
+func (r *wasmReader) instruction() byte {
+	op := r.byte()
+	switch {
+	case op == 0x02 || op == 0x03 || op == 0x04 || op == 0x06: // block, loop, if, try
+		r.sleb()
+	case op == 0x07 || op == 0x08 || op == 0x09 || op == 0x0C || op == 0x0D || op == 0x10 || op == 0x12 || op == 0x18:
+		r.uleb()
+	case op == 0x0E: // br_table
+		for n := r.uleb(); n > 0 && r.err == nil; n-- {
+			r.uleb()
+		}
+		r.uleb()
+	case op == 0x11 || op == 0x13: // call_indirect, return_call_indirect
+		r.uleb()
+		r.uleb()
+	case op == 0x1C: // select t*
+		r.skip(int(r.uleb()))
+	case op >= 0x20 && op <= 0x26: // local.*, global.*, table.get, table.set
+		r.uleb()
+	case op >= 0x28 && op <= 0x3E: // loads and stores
+		r.memarg()
+	case op == 0x3F || op == 0x40: // memory.size, memory.grow
+		r.uleb()
+	case op == 0x41 || op == 0x42: // i32.const, i64.const
+		r.sleb()
+	case op == 0x43: // f32.const
+		r.skip(4)
+	case op == 0x44: // f64.const
+		r.skip(8)
+	case op == 0xD0: // ref.null
+		r.sleb()
+	case op == 0xD2: // ref.func
+		r.uleb()
+	case op == 0xFC:
+		r.miscInstruction()
+	case op == 0xFD:
+		r.vectorInstruction()
+	case op == 0xFE:
+		r.atomicInstruction()
+	case op <= 0x01 || op == 0x05 || op == 0x0B || op == 0x0F || op == 0x19 || op == 0x1A || op == 0x1B:
+	case op >= 0x45 && op <= 0xC4: // numeric instructions
+	case op == 0xD1: // ref.is_null
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported instruction %#x at offset %d", op, r.i-1)
+		}
+	}
+	return op
+}
+
+func (r *wasmReader) miscInstruction() {
+	switch op := r.uleb(); op {
+	case 0, 1, 2, 3, 4, 5, 6, 7: // saturating truncations
+	case 8: // memory.init
+		r.uleb()
+		r.uleb()
+	case 9, 11, 13, 15, 16, 17: // data.drop, memory.fill, elem.drop, table.grow/size/fill
+		r.uleb()
+	case 10, 12, 14: // memory.copy, table.init, table.copy
+		r.uleb()
+		r.uleb()
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported instruction 0xfc %d", op)
+		}
+	}
+}
+
+func (r *wasmReader) vectorInstruction() {
+	switch op := r.uleb(); {
+	case op <= 11 || op == 92 || op == 93: // loads and stores
+		r.memarg()
+	case op == 12 || op == 13: // v128.const, i8x16.shuffle
+		r.skip(16)
+	case op >= 21 && op <= 34: // lane extraction and replacement
+		r.byte()
+	case op >= 84 && op <= 91: // lane loads and stores
+		r.memarg()
+		r.byte()
+	}
+}
+
+func (r *wasmReader) atomicInstruction() {
+	if op := r.uleb(); op == 3 { // atomic.fence
+		r.byte()
+	} else {
+		r.memarg()
+	}
+}
+
+// sourceOffsetMap maps the offsets in the code section of an instrumented
+// module to the ones of the original module, which debug information refers
+// to. Each run is a range of bytes copied from the original module.
+type sourceOffsetMap struct {
+	runs []sourceOffsetRun
+}
+
+type sourceOffsetRun struct {
+	new, old, size uint64
+}
+
+// original returns the offset in the original module of the instruction at
+// offset in the instrumented module. Offsets of instructions added to the
+// module are those of the original instruction which follows them.
+func (m *sourceOffsetMap) original(offset uint64) uint64 {
+	i := sort.Search(len(m.runs), func(i int) bool { return m.runs[i].new > offset }) - 1
+	if i < 0 {
+		return offset
+	}
+	run := m.runs[i]
+	if delta := offset - run.new; delta < run.size {
+		return run.old + delta
+	}
+	return run.old + run.size
+}
+
+// originalFunction returns the function reporting the offsets of the original
+// module when the profiled one was instrumented by CountInstructions or
+// CountOpcodes. Go
+// frames and the frames of interpreters are not located by their offsets in
+// the code section.
+func (p *Profiling) originalFunction(fn experimental.InternalFunction) experimental.InternalFunction {
+	if p.sourceOffsets == nil {
+		return fn
+	}
+	switch fn.(type) {
+	case interpcall, *goFunction:
+		return fn
+	}
+	return originalFunction{fn, p.sourceOffsets}
+}
+
+type originalFunction struct {
+	experimental.InternalFunction
+	offsets *sourceOffsetMap
+}
+
+func (f originalFunction) SourceOffsetForPC(pc experimental.ProgramCounter) uint64 {
+	return f.offsets.original(f.InternalFunction.SourceOffsetForPC(pc))
+}
@@ -0,0 +1,84 @@
+package wzprof
+
+import (
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// interpcall represent a specific place in the source of an interpreted
+// language (e.g. Python or Ruby) where a function call occurred. Its locations
+// have no address since it is not part of the code section of the module.
+//
+// Interpreted functions have no index nor signature in the module; the file
+// they are defined in stands for their module, so functions with the same name
+// in different files remain distinct.
+type interpcall struct {
+	file string
+	name string
+	line int32
+
+	api.FunctionDefinition // required for WazeroOnly
+}
+
+func (f interpcall) location() location {
+	return location{
+		File:       f.file,
+		Line:       int64(f.line),
+		Column:     0, // interpreters only track lines
+		Inlined:    false,
+		HumanName:  f.name,
+		StableName: f.file + "." + f.name,
+	}
+}
+
+func (f interpcall) Definition() api.FunctionDefinition {
+	return f
+}
+
+func (f interpcall) SourceOffsetForPC(pc experimental.ProgramCounter) uint64 {
+	return 0
+}
+
+func (f interpcall) ModuleName() string {
+	return f.file
+}
+
+func (f interpcall) Index() uint32 {
+	return 0
+}
+
+func (f interpcall) Import() (string, string, bool) {
+	return "", "", false
+}
+
+func (f interpcall) ExportNames() []string {
+	return nil
+}
+
+func (f interpcall) Name() string {
+	return f.name
+}
+
+func (f interpcall) DebugName() string {
+	return f.name
+}
+
+func (f interpcall) GoFunction() interface{} {
+	return nil
+}
+
+func (f interpcall) ParamTypes() []api.ValueType {
+	return nil
+}
+
+func (f interpcall) ParamNames() []string {
+	return nil
+}
+
+func (f interpcall) ResultTypes() []api.ValueType {
+	return nil
+}
+
+func (f interpcall) ResultNames() []string {
+	return nil
+}
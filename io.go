@@ -0,0 +1,222 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// IOProfiler is the implementation of a profiler recording the I/O operations
+// performed by the guest through the WASI file descriptor functions fd_read,
+// fd_write, fd_pread, and fd_pwrite.
+//
+// The profiler generates the following samples:
+// - "reads"       counts the number of read operations
+// - "read_bytes"  records the number of bytes read
+// - "writes"      counts the number of write operations
+// - "write_bytes" records the number of bytes written
+// - "io"          records the time spent in I/O operations (in nanoseconds)
+//
+// Like memory allocations, the values are all time counters since the creation
+// of the profiler.
+type IOProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts map[uint64]*ioSample
+	calls  instanceState[ioCallStack]
+	trace  stackTrace
+	time   func() int64
+	start  time.Time
+}
+
+// IOProfilerOption is a type used to represent configuration options for
+// IOProfiler instances created by Profiling.IOProfiler.
+type IOProfilerOption func(*IOProfiler)
+
+// IOTimeFunc configures the time function used by the I/O profiler to measure
+// the duration of I/O operations.
+//
+// By default, the system's monotonic time is used.
+func IOTimeFunc(time func() int64) IOProfilerOption {
+	return func(p *IOProfiler) { p.time = time }
+}
+
+type ioSample struct {
+	stack stackTrace
+	value [5]int64 // reads, readBytes, writes, writeBytes, time
+}
+
+func (s *ioSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *ioSample) sampleValue() []int64 {
+	return s.value[:]
+}
+
+type ioFrame struct {
+	start  int64
+	size   uint32 // address of the number of bytes transferred
+	sample *ioSample
+}
+
+// ioCallStack is the stack of calls in progress of an instance of the guest.
+type ioCallStack struct {
+	frames []ioFrame
+}
+
+func newIOProfiler(p *Profiling, options ...IOProfilerOption) *IOProfiler {
+	i := &IOProfiler{
+		p:      p,
+		counts: make(map[uint64]*ioSample),
+		time:   nanotime,
+		start:  time.Now(),
+	}
+	for _, opt := range options {
+		opt(i)
+	}
+	return i
+}
+
+// NewProfile builds a profile of the I/O operations recorded since the
+// profiler was created.
+func (p *IOProfiler) NewProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples := make(map[uint64]*ioSample, len(p.counts))
+	for k, s := range p.counts {
+		c := *s
+		samples[k] = &c
+	}
+	p.mutex.Unlock()
+
+	ratio := 1 / sampleRate
+	return buildProfile(p.p, samples, p.start, time.Since(p.start), p.SampleType(),
+		[]float64{ratio, ratio, ratio, ratio, ratio},
+	)
+}
+
+// Name returns "io".
+func (p *IOProfiler) Name() string {
+	return "io"
+}
+
+// Desc returns a description of the I/O profiler.
+func (p *IOProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of I/O stacks recorded in p.
+func (p *IOProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// I/O profiler.
+func (p *IOProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "reads", Unit: "count"},
+		{Type: "read_bytes", Unit: "bytes"},
+		{Type: "writes", Unit: "count"},
+		{Type: "write_bytes", Unit: "bytes"},
+		{Type: "io", Unit: "nanoseconds"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *IOProfiler) NewHandler(sampleRate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveProfile(w, p.NewProfile(sampleRate))
+	})
+}
+
+// NewFunctionListener returns a function listener suited to install a hook on
+// the WASI functions performing I/O on file descriptors.
+func (p *IOProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil || def.ModuleName() != "wasi_snapshot_preview1" {
+		return nil
+	}
+	switch def.Name() {
+	case "fd_read":
+		return profilingListener{p.p, ioProfiler{p, ioRead, 3}}
+	case "fd_pread":
+		return profilingListener{p.p, ioProfiler{p, ioRead, 4}}
+	case "fd_write":
+		return profilingListener{p.p, ioProfiler{p, ioWrite, 3}}
+	case "fd_pwrite":
+		return profilingListener{p.p, ioProfiler{p, ioWrite, 4}}
+	}
+	return nil
+}
+
+const (
+	ioRead  = 0
+	ioWrite = 2
+)
+
+type ioProfiler struct {
+	*IOProfiler
+	// Index of the first value of the sample updated by the function, either
+	// ioRead or ioWrite.
+	op int
+	// Index of the parameter holding the address where the function writes
+	// the number of bytes transferred.
+	size int
+}
+
+func (p ioProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	p.trace = p.p.makeStackTrace(ctx, p.trace, si)
+	sample := p.counts[p.trace.key]
+	if sample == nil {
+		sample = &ioSample{stack: p.trace.clone()}
+		p.counts[p.trace.key] = sample
+	}
+	s.frames = append(s.frames, ioFrame{
+		start:  p.time(),
+		size:   api.DecodeU32(params[p.size]),
+		sample: sample,
+	})
+	p.mutex.Unlock()
+}
+
+func (p ioProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	var size uint32
+	var errno uint64 = 1
+	if len(results) > 0 {
+		errno = results[0]
+	}
+
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.frames) - 1
+	f := s.frames[i]
+	s.frames = s.frames[:i]
+
+	if mem := mod.Memory(); mem != nil && errno == 0 {
+		// The number of bytes is only written on success.
+		size, _ = mem.ReadUint32Le(f.size)
+	}
+
+	f.sample.value[p.op+0]++
+	f.sample.value[p.op+1] += int64(size)
+	f.sample.value[4] += p.time() - f.start
+	p.mutex.Unlock()
+}
+
+func (p ioProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
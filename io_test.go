@@ -0,0 +1,62 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestIOProfilerBytes(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).IOProfiler(
+		IOTimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := newTestModule(wazerotest.NewFixedMemory(wazerotest.PageSize),
+		"main",
+		"fd_read",
+		"fd_write",
+	)
+	module.ModuleName = "wasi_snapshot_preview1"
+
+	if f := p.NewFunctionListener(module.Function(0).Definition()); f != nil {
+		t.Error("function not performing i/o must not be instrumented")
+	}
+	read := p.NewFunctionListener(module.Function(1).Definition())
+	write := p.NewFunctionListener(module.Function(2).Definition())
+
+	stack := []experimental.StackFrame{
+		{Function: module.Function(0)},
+		{Function: module.Function(2), PC: 1},
+	}
+	def := stack[1].Function.Definition()
+	ctx := context.Background()
+
+	const sizeAddr = 1024
+	call := func(f experimental.FunctionListener, size uint32, errno uint64, duration int64) {
+		f.Before(ctx, module, def, []uint64{1, 0, 1, sizeAddr}, experimental.NewStackIterator(stack...))
+		module.Memory().WriteUint32Le(sizeAddr, size)
+		currentTime += duration
+		f.After(ctx, module, def, []uint64{errno})
+	}
+
+	call(write, 10, 0, 1)
+	call(write, 32, 0, 2)
+	call(write, 99, 8, 3) // EBADF, the size must be ignored
+	call(read, 5, 0, 4)
+
+	samples := p.NewProfile(1).Sample
+	if len(samples) != 1 {
+		t.Fatalf("wrong number of samples: want=1 got=%d", len(samples))
+	}
+	want := []int64{1, 5, 3, 42, 10}
+	for i, v := range samples[0].Value {
+		if v != want[i] {
+			t.Errorf("wrong sample values: want=%v got=%v", want, samples[0].Value)
+			break
+		}
+	}
+}
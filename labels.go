@@ -0,0 +1,106 @@
+package wzprof
+
+import (
+	"context"
+	"hash/maphash"
+	"sort"
+	"strings"
+	"time"
+)
+
+type labelsKey struct{}
+
+// labelSet is the set of labels of a context, in the format of pprof samples.
+// The hash of the labels is mixed in the keys of stack traces so samples with
+// different labels are recorded separately.
+type labelSet struct {
+	labels map[string][]string
+	hash   uint64
+}
+
+func newLabelSet(labels map[string]string) *labelSet {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	set := &labelSet{labels: make(map[string][]string, len(labels))}
+	var b strings.Builder
+	for _, k := range keys {
+		set.labels[k] = []string{labels[k]}
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	set.hash = maphash.String(stackTraceHashSeed, b.String())
+	return set
+}
+
+// values returns the labels of the set, with the ones of labels added to them.
+func (set *labelSet) values(labels map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels))
+	if set != nil {
+		for k, v := range set.labels {
+			merged[k] = v[0]
+		}
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// WithLabels returns a copy of ctx carrying labels which are added to the
+// samples recorded during the calls of functions made with it, e.g. to tag the
+// samples of a request with a tenant or request id. The labels are merged with
+// the ones already in ctx, the new values take precedence.
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	set := newLabelSet(contextLabels(ctx).values(labels))
+	if set == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, labelsKey{}, set)
+}
+
+func contextLabels(ctx context.Context) *labelSet {
+	set, _ := ctx.Value(labelsKey{}).(*labelSet)
+	return set
+}
+
+// timeState holds the time label of a window, and the last merge of it with
+// the labels of the calls.
+type timeState struct {
+	window               int64
+	time, labels, merged *labelSet
+}
+
+// timeContext returns ctx with the label of the current time window added to
+// it. The state is replaced as a whole so concurrent calls read a consistent
+// one without locking.
+func (p *Profiling) timeContext(ctx context.Context) context.Context {
+	window := (nanotime() - p.timeStart) / int64(p.timeLabels)
+	labels := contextLabels(ctx)
+	t := p.timeState.Load()
+	if t == nil || t.window != window || t.labels != labels {
+		next := &timeState{window: window, labels: labels}
+		if t != nil && t.window == window {
+			next.time = t.time
+		} else {
+			next.time = newLabelSet(map[string]string{
+				"time": (time.Duration(window) * p.timeLabels).String(),
+			})
+		}
+		next.merged = next.time
+		if labels != nil {
+			next.merged = newLabelSet(labels.values(next.time.values(nil)))
+		}
+		t = next
+		p.timeState.Store(t)
+	}
+	return context.WithValue(ctx, labelsKey{}, t.merged)
+}
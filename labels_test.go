@@ -0,0 +1,178 @@
+package wzprof
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestWithLabels(t *testing.T) {
+	ctx := context.Background()
+	if WithLabels(ctx, nil) != ctx {
+		t.Error("context without labels must not be modified")
+	}
+
+	ctx = WithLabels(ctx, map[string]string{"tenant": "a", "request": "1"})
+	ctx = WithLabels(ctx, map[string]string{"request": "2"})
+
+	want := map[string][]string{"tenant": {"a"}, "request": {"2"}}
+	if got := contextLabels(ctx).labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong labels: want=%v got=%v", want, got)
+	}
+
+	same := WithLabels(context.Background(), map[string]string{"tenant": "a", "request": "2"})
+	if contextLabels(same).hash != contextLabels(ctx).hash {
+		t.Error("the same labels must have the same hash")
+	}
+}
+
+func TestCPUProfilerLabels(t *testing.T) {
+	currentTime := int64(1)
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f := p.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	def := stack[0].Function.Definition()
+
+	call := func(ctx context.Context, duration int64) {
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(ctx, module, def, nil)
+	}
+
+	p.StartProfile()
+	call(WithLabels(context.Background(), map[string]string{"tenant": "a"}), 10)
+	call(WithLabels(context.Background(), map[string]string{"tenant": "b"}), 20)
+	call(WithLabels(context.Background(), map[string]string{"tenant": "a"}), 30)
+	call(context.Background(), 40)
+
+	prof := p.StopProfile(1)
+	if len(prof.Sample) != 3 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+
+	times := make(map[string]int64)
+	for _, s := range prof.Sample {
+		if len(s.Location) != 1 || s.Location[0] != prof.Sample[0].Location[0] {
+			t.Error("samples with different labels must share their locations")
+		}
+		tenant := ""
+		if v := s.Label["tenant"]; len(v) == 1 {
+			tenant = v[0]
+		}
+		times[tenant] += s.Value[1]
+	}
+	want := map[string]int64{"a": 40, "b": 20, "": 40}
+	for tenant, v := range want {
+		if times[tenant] != v {
+			t.Errorf("wrong time for tenant %q: want=%d got=%d", tenant, v, times[tenant])
+		}
+	}
+}
+
+func TestThreadLabels(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil, ThreadLabels(true)).SyscallProfiler(
+		SyscallTimeFunc(func() int64 { return currentTime }),
+	)
+
+	newModule := func() *wazerotest.Module {
+		f := wazerotest.NewFunction(func(context.Context, api.Module) {})
+		f.FunctionName = "clock_time_get"
+		return wazerotest.NewModule(nil, f)
+	}
+	// Each thread of the program runs in its own instance of the module.
+	threads := []*wazerotest.Module{newModule(), newModule()}
+	f := p.NewFunctionListener(threads[0].Function(0).Definition())
+	ctx := WithLabels(context.Background(), map[string]string{"tenant": "a"})
+
+	before := func(mod *wazerotest.Module) {
+		stack := []experimental.StackFrame{{Function: mod.Function(0)}}
+		f.Before(ctx, mod, stack[0].Function.Definition(), nil, experimental.NewStackIterator(stack...))
+	}
+	after := func(mod *wazerotest.Module) {
+		f.After(ctx, mod, mod.Function(0).Definition(), nil)
+	}
+
+	// The calls of the threads overlap, their latencies are measured from
+	// the start of the call made by the same thread.
+	p.StartProfile()
+	before(threads[0])
+	currentTime += 10
+	before(threads[1])
+	currentTime += 20
+	after(threads[0])
+	currentTime += 40
+	after(threads[1])
+
+	prof := p.StopProfile(1)
+	if len(prof.Sample) != 2 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	latencies := make(map[string]int64)
+	for _, s := range prof.Sample {
+		if tenant := s.Label["tenant"]; len(tenant) != 1 || tenant[0] != "a" {
+			t.Errorf("labels of the context lost: %v", s.Label)
+		}
+		if thread := s.Label["thread"]; len(thread) == 1 {
+			latencies[thread[0]] += s.Value[1]
+		}
+	}
+	want := map[string]int64{"1": 30, "2": 60}
+	if !reflect.DeepEqual(latencies, want) {
+		t.Errorf("wrong latencies of the threads: want=%v got=%v", want, latencies)
+	}
+}
+
+func TestTimeLabels(t *testing.T) {
+	profiling := ProfilingFor(nil, TimeLabels(10*time.Second))
+	p := profiling.CPUProfiler(HostTime(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f := p.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+	def := stack[0].Function.Definition()
+
+	call := func(ctx context.Context, at time.Duration) {
+		// The windows are counted from the creation of the profiling.
+		profiling.timeStart = nanotime() - int64(at)
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		f.After(ctx, module, def, nil)
+	}
+
+	p.StartProfile()
+	tenant := WithLabels(context.Background(), map[string]string{"tenant": "a"})
+	call(tenant, 2*time.Second)
+	call(tenant, 42*time.Second)
+	call(context.Background(), 45*time.Second)
+	call(tenant, 49*time.Second)
+
+	prof := p.StopProfile(1)
+	calls := make(map[string]int64)
+	for _, s := range prof.Sample {
+		key := s.Label["time"][0]
+		if tenant := s.Label["tenant"]; len(tenant) == 1 {
+			key += "/" + tenant[0]
+		}
+		calls[key] += s.Value[0]
+	}
+	want := map[string]int64{"0s/a": 1, "40s/a": 2, "40s": 1}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("wrong calls by time window: want=%v got=%v", want, calls)
+	}
+}
@@ -0,0 +1,220 @@
+package wzprof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteLLVMSampleProfile writes a profile to w in the text format of the
+// sample profiles of LLVM, which llvm-profdata converts for the sample-based
+// profile guided optimizations of clang (-fprofile-sample-use) and rustc
+// (-Zprofile-sample-use):
+//
+//	llvm-profdata merge --sample -o app.profdata app.prof.txt
+//
+// The records of the profile are the functions of the module, named after
+// their symbols. The lines of the functions are offsets from the line they are
+// declared at, as found in DWARF: the samples of functions without it are only
+// accounted in the number of times they were entered (their head samples).
+// Inlined functions are nested in the records of the functions they are
+// inlined in, at the line of the call site.
+//
+// The stacks of the profiles of wzprof end with the call of a function, their
+// values are accounted as entries of the function at the leaf of the stack,
+// and as calls from the lines of its callers. With the "samples" sample type
+// of the CPU profile, which counts the calls of the functions, the profile
+// holds the number of calls made from each line of the module.
+//
+// The counts are the values of the default sample type of the profile, the
+// negative ones are ignored.
+func WriteLLVMSampleProfile(w io.Writer, prof *profile.Profile) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+
+	records := make(map[string]*llvmSampleRecord)
+	record := func(fn *profile.Function) *llvmSampleRecord {
+		name := symbolName(fn)
+		r := records[name]
+		if r == nil {
+			r = newLLVMSampleRecord(name)
+			records[name] = r
+		}
+		return r
+	}
+
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		if value <= 0 {
+			continue
+		}
+		// Locations are ordered from the leaf to the root, and their lines
+		// start with the innermost inlined function.
+		for i := len(sample.Location) - 1; i >= 0; i-- {
+			lines := sample.Location[i].Line
+			if len(lines) == 0 {
+				continue
+			}
+			r := record(lines[len(lines)-1].Function)
+			if i == 0 {
+				r.head += value
+			}
+			line := lines[len(lines)-1]
+			for j := len(lines) - 2; j >= 0; j-- {
+				offset, ok := llvmLineOffset(line)
+				if !ok {
+					break
+				}
+				r = r.callsite(offset, lines[j].Function)
+				line = lines[j]
+			}
+			offset, ok := llvmLineOffset(line)
+			if !ok {
+				continue
+			}
+			body := r.line(offset)
+			body.samples += value
+			if i > 0 {
+				if callee := sample.Location[i-1].Line; len(callee) > 0 {
+					body.calls[symbolName(callee[len(callee)-1].Function)] += value
+				}
+			}
+		}
+	}
+
+	list := make([]*llvmSampleRecord, 0, len(records))
+	for _, r := range records {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if ti, tj := list[i].total(), list[j].total(); ti != tj {
+			return ti > tj
+		}
+		return list[i].name < list[j].name
+	})
+
+	b := bufio.NewWriter(w)
+	for _, r := range list {
+		fmt.Fprintf(b, "%s:%d:%d\n", r.name, r.total(), r.head)
+		r.writeBody(b, 1)
+	}
+	return b.Flush()
+}
+
+// llvmLineOffset returns the offset of a line from the start of its function,
+// which the sample profiles of LLVM are keyed by.
+func llvmLineOffset(line profile.Line) (int64, bool) {
+	start := line.Function.StartLine
+	if start <= 0 || line.Line < start {
+		return 0, false
+	}
+	return line.Line - start, true
+}
+
+// llvmSampleRecord is the record of a function in a sample profile of LLVM,
+// or of the instance of a function inlined at a call site.
+type llvmSampleRecord struct {
+	name    string
+	head    int64
+	lines   map[int64]*llvmSampleLine
+	inlined map[llvmCallsite]*llvmSampleRecord
+}
+
+type llvmSampleLine struct {
+	samples int64
+	calls   map[string]int64
+}
+
+type llvmCallsite struct {
+	offset int64
+	name   string
+}
+
+func newLLVMSampleRecord(name string) *llvmSampleRecord {
+	return &llvmSampleRecord{
+		name:    name,
+		lines:   make(map[int64]*llvmSampleLine),
+		inlined: make(map[llvmCallsite]*llvmSampleRecord),
+	}
+}
+
+func (r *llvmSampleRecord) line(offset int64) *llvmSampleLine {
+	l := r.lines[offset]
+	if l == nil {
+		l = &llvmSampleLine{calls: make(map[string]int64)}
+		r.lines[offset] = l
+	}
+	return l
+}
+
+func (r *llvmSampleRecord) callsite(offset int64, fn *profile.Function) *llvmSampleRecord {
+	k := llvmCallsite{offset: offset, name: symbolName(fn)}
+	c := r.inlined[k]
+	if c == nil {
+		c = newLLVMSampleRecord(k.name)
+		r.inlined[k] = c
+	}
+	return c
+}
+
+func (r *llvmSampleRecord) total() (total int64) {
+	for _, l := range r.lines {
+		total += l.samples
+	}
+	for _, c := range r.inlined {
+		total += c.total()
+	}
+	return total
+}
+
+// writeBody writes the lines and the inlined call sites of a record, indented
+// by their depth, ordered by offset.
+func (r *llvmSampleRecord) writeBody(b *bufio.Writer, depth int) {
+	indent := strings.Repeat(" ", depth)
+
+	offsets := make([]int64, 0, len(r.lines))
+	for offset := range r.lines {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		l := r.lines[offset]
+		fmt.Fprintf(b, "%s%d: %d", indent, offset, l.samples)
+		callees := make([]string, 0, len(l.calls))
+		for name := range l.calls {
+			callees = append(callees, name)
+		}
+		sort.Slice(callees, func(i, j int) bool {
+			if ci, cj := l.calls[callees[i]], l.calls[callees[j]]; ci != cj {
+				return ci > cj
+			}
+			return callees[i] < callees[j]
+		})
+		for _, name := range callees {
+			fmt.Fprintf(b, " %s:%d", name, l.calls[name])
+		}
+		b.WriteByte('\n')
+	}
+
+	callsites := make([]llvmCallsite, 0, len(r.inlined))
+	for k := range r.inlined {
+		callsites = append(callsites, k)
+	}
+	sort.Slice(callsites, func(i, j int) bool {
+		if callsites[i].offset != callsites[j].offset {
+			return callsites[i].offset < callsites[j].offset
+		}
+		return callsites[i].name < callsites[j].name
+	})
+	for _, k := range callsites {
+		c := r.inlined[k]
+		fmt.Fprintf(b, "%s%d: %s:%d\n", indent, k.offset, c.name, c.total())
+		c.writeBody(b, depth+1)
+	}
+}
@@ -0,0 +1,49 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteLLVMSampleProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", SystemName: "main", StartLine: 10}
+	parse := &profile.Function{ID: 2, Name: "ns::parse(char const*)", SystemName: "_ZN2ns5parseEPKc", StartLine: 20}
+	skip := &profile.Function{ID: 3, Name: "ns::skip()", SystemName: "_ZN2ns4skipEv", StartLine: 30}
+	malloc := &profile.Function{ID: 4, Name: "malloc"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: main, Line: 12}}}
+	// skip is inlined at line 22 of parse.
+	parsing := &profile.Location{ID: 2, Line: []profile.Line{{Function: skip, Line: 31}, {Function: parse, Line: 22}}}
+	// The line of malloc is unknown, only its entries are accounted.
+	leaf := &profile.Location{ID: 3, Line: []profile.Line{{Function: malloc}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		DefaultSampleType: "samples",
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, parsing, root}, Value: []int64{3, 30}},
+			{Location: []*profile.Location{parsing, root}, Value: []int64{5, 10}},
+			{Location: []*profile.Location{root}, Value: []int64{-1, -10}},
+		},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteLLVMSampleProfile(b, prof); err != nil {
+		t.Fatal(err)
+	}
+	want := `_ZN2ns5parseEPKc:8:5
+ 2: _ZN2ns4skipEv:8
+  1: 8 malloc:3
+main:8:0
+ 2: 8 _ZN2ns5parseEPKc:8
+malloc:0:3
+`
+	if got := b.String(); got != want {
+		t.Errorf("wrong sample profile:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,40 @@
+package wzprof
+
+import (
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/exp/slog"
+)
+
+// The logger of the package is read by the profilers while the guest runs, it
+// is stored in an atomic pointer so it can be replaced at any time.
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	SetLogger(nil)
+}
+
+// SetLogger configures the logger receiving the diagnostics of the package,
+// like the DWARF sections found or missing in the profiled module, or the
+// errors which do not prevent profiling it. Diagnostics are never written to
+// the standard output, which belongs to the profiled program.
+//
+// Passing nil restores the default logger, which writes the warnings and
+// errors to stderr. The level and destination of the diagnostics are
+// configured by the handler of the logger:
+//
+//	wzprof.SetLogger(slog.New(slog.HandlerOptions{
+//		Level: slog.LevelDebug,
+//	}.NewTextHandler(w)))
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.HandlerOptions{Level: slog.LevelWarn}.NewTextHandler(os.Stderr))
+	}
+	logger.Store(l)
+}
+
+// Logger returns the logger receiving the diagnostics of the package.
+func Logger() *slog.Logger {
+	return logger.Load()
+}
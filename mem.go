@@ -3,7 +3,11 @@ package wzprof
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
+	"math/bits"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,16 +24,32 @@ import (
 // - "alloc_space"   records the locations where bytes are allocated
 // - "inuse_objects" records the allocation of active objects
 // - "inuse_space"   records the bytes used by active objects
+// - "grow_count"    records the locations where the linear memory is grown
+// - "grow_space"    records the bytes added to the linear memory
 //
 // "alloc_objects" and "alloc_space" are all time counters since the start of
 // the program, while "inuse_objects" and "inuse_space" capture the current state
-// of the program at the time the profile is taken.
+// of the program at the time the profile is taken. "grow_count" and
+// "grow_space" are also all time counters, they are only recorded when enabled
+// with MemoryGrowth.
+//
+// The samples of allocations can also be split by size class, see
+// AllocSizeClasses.
 type MemoryProfiler struct {
 	p     *Profiling
 	mutex sync.Mutex
 	alloc stackCounterMap
-	inuse map[uint32]memoryAllocation
+	inuse *memoryInuse
+	grow  stackCounterMap
 	start time.Time
+	// Label sets of the size classes, indexed by the labels of the context
+	// the allocations are made in. Nil when size classes are not enabled.
+	sizeClasses map[*labelSet]*[numSizeClasses]*labelSet
+	// Depth of nested calls to allocators of each instance of the guest.
+	depths instanceState[int]
+	// Number of bytes of the allocations observed since the profiler was
+	// created, exposed by MetricsHandler.
+	allocBytes int64
 }
 
 // MemoryProfilerOption is a type used to represent configuration options for
@@ -39,19 +59,198 @@ type MemoryProfilerOption func(*MemoryProfiler)
 // InuseMemory is a memory profiler option which enables tracking of allocated
 // and freed objects to generate snapshots of the current state of a program
 // memory.
+//
+// The objects of Go guests are not freed one by one, the profiler only sees
+// the spans of memory that the garbage collector returns to the heap once all
+// their objects are dead. Objects freed by sweeping spans which still hold
+// live objects remain in use until the whole span is released, so the memory
+// in use by Go guests is over-estimated.
 func InuseMemory(enable bool) MemoryProfilerOption {
 	return func(p *MemoryProfiler) {
 		if enable {
-			p.inuse = make(map[uint32]memoryAllocation)
+			p.inuse = newMemoryInuse()
+		}
+	}
+}
+
+// MemoryGrowth is a memory profiler option which enables tracking of the growth
+// of the linear memory of the module. The memory.grow instruction cannot be
+// intercepted, growth is detected when calls to sbrk increase the size of the
+// memory, so the samples point at the allocations which required more memory.
+func MemoryGrowth(enable bool) MemoryProfilerOption {
+	return func(p *MemoryProfiler) {
+		if enable {
+			p.grow = make(stackCounterMap)
+		}
+	}
+}
+
+// AllocSizeClasses is a memory profiler option which splits the samples of
+// allocations by size class, from 16B to 1MiB in powers of two, with a
+// "size_class" label. The histogram of the labels of a stack tells apart the
+// churn of small objects from the allocation of large buffers, e.g. with the
+// -tags or -tagfocus options of pprof.
+func AllocSizeClasses(enable bool) MemoryProfilerOption {
+	return func(p *MemoryProfiler) {
+		if enable {
+			p.sizeClasses = make(map[*labelSet]*[numSizeClasses]*labelSet)
 		}
 	}
 }
 
+const (
+	minSizeClassShift = 4  // 16B
+	maxSizeClassShift = 20 // 1MiB
+	// The last class holds the allocations larger than 1MiB.
+	numSizeClasses = maxSizeClassShift - minSizeClassShift + 2
+)
+
+// sizeClass returns the index of the smallest power of two size class which
+// fits an allocation of the given size.
+func sizeClass(size uint32) int {
+	switch {
+	case size <= 1<<minSizeClassShift:
+		return 0
+	case size > 1<<maxSizeClassShift:
+		return numSizeClasses - 1
+	default:
+		return bits.Len32(size-1) - minSizeClassShift
+	}
+}
+
+// sizeClassLabel returns the value of the "size_class" label of a class, which
+// is the upper bound of the sizes of its allocations (e.g. "16B", "4KiB"), or
+// "1MiB+" for allocations larger than 1MiB.
+func sizeClassLabel(class int) string {
+	if class == numSizeClasses-1 {
+		return "1MiB+"
+	}
+	shift := class + minSizeClassShift
+	switch {
+	case shift >= 20:
+		return strconv.Itoa(1<<(shift-20)) + "MiB"
+	case shift >= 10:
+		return strconv.Itoa(1<<(shift-10)) + "KiB"
+	default:
+		return strconv.Itoa(1<<shift) + "B"
+	}
+}
+
+// withSizeClass returns a copy of stack with the label of the size class of
+// the allocation added to its labels. It must be called with the mutex held.
+func (p *MemoryProfiler) withSizeClass(stack stackTrace, size uint32) stackTrace {
+	classes := p.sizeClasses[stack.labels]
+	if classes == nil {
+		classes = new([numSizeClasses]*labelSet)
+		p.sizeClasses[stack.labels] = classes
+	}
+	class := sizeClass(size)
+	labels := classes[class]
+	if labels == nil {
+		labels = newLabelSet(stack.labels.values(map[string]string{
+			"size_class": sizeClassLabel(class),
+		}))
+		classes[class] = labels
+	}
+	if stack.labels != nil {
+		stack.key ^= stack.labels.hash
+	}
+	stack.key ^= labels.hash
+	stack.labels = labels
+	return stack
+}
+
 type memoryAllocation struct {
 	*stackCounter
 	size uint32
 }
 
+// memoryInuse is the set of live allocations, indexed by the page of their
+// address so the allocations of a range of memory are released without
+// scanning all of them.
+type memoryInuse struct {
+	pages map[uint32]map[uint32]memoryAllocation
+}
+
+// Size of the pages indexing the allocations in use, which matches the page
+// size of the Go heap so releasing a span only visits its pages.
+const memoryInusePageShift = 13
+
+func newMemoryInuse() *memoryInuse {
+	return &memoryInuse{pages: make(map[uint32]map[uint32]memoryAllocation)}
+}
+
+func (m *memoryInuse) insert(addr uint32, alloc memoryAllocation) {
+	page := m.pages[addr>>memoryInusePageShift]
+	if page == nil {
+		page = make(map[uint32]memoryAllocation)
+		m.pages[addr>>memoryInusePageShift] = page
+	}
+	page[addr] = alloc
+}
+
+func (m *memoryInuse) delete(addr uint32) {
+	page := m.pages[addr>>memoryInusePageShift]
+	if page != nil {
+		if delete(page, addr); len(page) == 0 {
+			delete(m.pages, addr>>memoryInusePageShift)
+		}
+	}
+}
+
+// deleteRange releases the allocations that start within [start, end).
+func (m *memoryInuse) deleteRange(start, end uint32) {
+	if start >= end {
+		return
+	}
+	first, last := start>>memoryInusePageShift, (end-1)>>memoryInusePageShift
+	if uint64(last-first) >= uint64(len(m.pages)) {
+		// The range spans more pages than there are pages with allocations,
+		// it is cheaper to visit the pages in use.
+		for n := range m.pages {
+			if n >= first && n <= last {
+				m.deletePageRange(n, start, end)
+			}
+		}
+		return
+	}
+	for n := first; ; n++ {
+		m.deletePageRange(n, start, end)
+		if n == last {
+			break
+		}
+	}
+}
+
+func (m *memoryInuse) deletePageRange(n, start, end uint32) {
+	page := m.pages[n]
+	if page == nil {
+		return
+	}
+	pageStart := uint64(n) << memoryInusePageShift
+	pageEnd := pageStart + 1<<memoryInusePageShift
+	if uint64(start) <= pageStart && pageEnd <= uint64(end) {
+		delete(m.pages, n)
+		return
+	}
+	for addr := range page {
+		if addr >= start && addr < end {
+			delete(page, addr)
+		}
+	}
+	if len(page) == 0 {
+		delete(m.pages, n)
+	}
+}
+
+func (m *memoryInuse) forEach(f func(memoryAllocation)) {
+	for _, page := range m.pages {
+		for _, alloc := range page {
+			f(alloc)
+		}
+	}
+}
+
 // newMemoryProfiler constructs a new instance of MemoryProfiler using the given
 // time function to record the profile execution time.
 func newMemoryProfiler(p *Profiling, options ...MemoryProfilerOption) *MemoryProfiler {
@@ -71,10 +270,35 @@ func newMemoryProfiler(p *Profiling, options ...MemoryProfilerOption) *MemoryPro
 func (p *MemoryProfiler) NewProfile(sampleRate float64) *profile.Profile {
 	ratio := 1 / sampleRate
 	return buildProfile(p.p, p.snapshot(), p.start, time.Since(p.start), p.SampleType(),
-		[]float64{ratio, ratio, ratio, ratio},
+		[]float64{ratio, ratio, ratio, ratio, ratio, ratio},
 	)
 }
 
+// InuseProfile takes a snapshot of the memory in use by the program, with only
+// the "inuse_objects" and "inuse_space" sample types. The method returns nil
+// unless the profiler tracks the memory in use (see InuseMemory).
+//
+// Unlike the allocations, the memory in use is not cumulative; snapshots taken
+// at a fixed interval show the growth of the memory over time, e.g. when they
+// are labeled with the time they were taken at and merged with MergeProfiles.
+func (p *MemoryProfiler) InuseProfile(sampleRate float64) *profile.Profile {
+	if p.inuse == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	samples := make(stackCounterMap)
+	p.inuse.forEach(func(inuse memoryAllocation) {
+		samples.observe(inuse.stack, int64(inuse.size))
+	})
+	p.mutex.Unlock()
+
+	ratio := 1 / sampleRate
+	return buildProfile(p.p, samples, p.start, time.Since(p.start), []*profile.ValueType{
+		{Type: "inuse_objects", Unit: "count"},
+		{Type: "inuse_space", Unit: "bytes"},
+	}, []float64{ratio, ratio})
+}
+
 // Name returns "allocs" to match the name of the memory profiler in pprof.
 func (p *MemoryProfiler) Name() string {
 	return "allocs"
@@ -111,12 +335,20 @@ func (p *MemoryProfiler) SampleType() []*profile.ValueType {
 		)
 	}
 
+	if p.grow != nil {
+		sampleType = append(sampleType,
+			&profile.ValueType{Type: "grow_count", Unit: "count"},
+			&profile.ValueType{Type: "grow_space", Unit: "bytes"},
+		)
+	}
+
 	return sampleType
 }
 
 type memorySample struct {
 	stack stackTrace
-	value [4]int64 // allocCount, allocBytes, inuseCount, inuseBytes
+	value [6]int64 // allocCount, allocBytes, inuseCount, inuseBytes, growCount, growBytes
+	inuse bool     // whether the in-use values are part of the profile
 }
 
 func (m *memorySample) sampleLocation() stackTrace {
@@ -124,7 +356,10 @@ func (m *memorySample) sampleLocation() stackTrace {
 }
 
 func (m *memorySample) sampleValue() []int64 {
-	return m.value[:]
+	if m.inuse {
+		return m.value[:]
+	}
+	return append(m.value[:2:2], m.value[4:]...)
 }
 
 func (p *MemoryProfiler) snapshot() map[uint64]*memorySample {
@@ -136,21 +371,34 @@ func (p *MemoryProfiler) snapshot() map[uint64]*memorySample {
 	defer p.mutex.Unlock()
 
 	samples := make(map[uint64]*memorySample, len(p.alloc))
+	inuse := p.inuse != nil
+	sample := func(stack stackTrace) *memorySample {
+		s := samples[stack.key]
+		if s == nil {
+			s = &memorySample{stack: stack, inuse: inuse}
+			samples[stack.key] = s
+		}
+		return s
+	}
 
 	for _, alloc := range p.alloc {
-		p := samples[alloc.stack.key]
-		if p == nil {
-			p = &memorySample{stack: alloc.stack}
-			samples[alloc.stack.key] = p
-		}
-		p.value[0] += alloc.count()
-		p.value[1] += alloc.total()
+		s := sample(alloc.stack)
+		s.value[0] += alloc.count()
+		s.value[1] += alloc.total()
 	}
 
-	for _, inuse := range p.inuse {
-		p := samples[inuse.stack.key]
-		p.value[2] += 1
-		p.value[3] += int64(inuse.size)
+	if p.inuse != nil {
+		p.inuse.forEach(func(inuse memoryAllocation) {
+			s := samples[inuse.stack.key]
+			s.value[2] += 1
+			s.value[3] += int64(inuse.size)
+		})
+	}
+
+	for _, grow := range p.grow {
+		s := sample(grow.stack)
+		s.value[4] += grow.count()
+		s.value[5] += grow.total()
 	}
 
 	return samples
@@ -166,88 +414,382 @@ func (p *MemoryProfiler) snapshot() map[uint64]*memorySample {
 // The symbolizer passed as argument is used to resolve names of program
 // locations recorded in the profile.
 func (p *MemoryProfiler) NewHandler(sampleRate float64) http.Handler {
+	return p.newHandler(sampleRate, "alloc_space")
+}
+
+func (p *MemoryProfiler) newHandler(sampleRate float64, defaultSampleType string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveProfile(w, p.NewProfile(sampleRate))
+		var prof *profile.Profile
+
+		if seconds := r.FormValue("seconds"); seconds != "" {
+			n, err := strconv.ParseInt(seconds, 10, 64)
+			if err != nil || n <= 0 {
+				serveError(w, http.StatusBadRequest, `invalid value for "seconds" - must be a positive integer`)
+				return
+			}
+			duration := time.Duration(n) * time.Second
+
+			ctx := r.Context()
+			if deadline, ok := ctx.Deadline(); ok {
+				if timeout := time.Until(deadline); duration > timeout {
+					serveError(w, http.StatusBadRequest, "profile duration exceeds server's WriteTimeout")
+					return
+				}
+			}
+
+			prof, err = p.deltaProfile(ctx, duration, sampleRate)
+			if err != nil {
+				serveError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		} else {
+			prof = p.NewProfile(sampleRate)
+		}
+
+		prof.DefaultSampleType = defaultSampleType
+		serveProfile(w, prof)
 	})
 }
 
+// deltaProfile returns a profile of the memory allocations made during the
+// given duration, computed as the difference between two snapshots of the
+// memory profile, which matches the semantics of net/http/pprof when the
+// seconds parameter is passed to the heap or allocs handlers.
+func (p *MemoryProfiler) deltaProfile(ctx context.Context, duration time.Duration, sampleRate float64) (*profile.Profile, error) {
+	start := time.Now()
+	p0 := p.NewProfile(sampleRate)
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("profile canceled: %w", ctx.Err())
+	}
+
+	p1 := p.NewProfile(sampleRate)
+	delta, err := DeltaProfile(p0, p1)
+	if err != nil {
+		return nil, err
+	}
+	delta.TimeNanos = start.UnixNano()
+	delta.DurationNanos = int64(time.Since(start))
+	return delta, nil
+}
+
+// heapSampleType returns the default sample type of heap profiles, which is
+// the memory in use when it is tracked by the profiler.
+func (p *MemoryProfiler) heapSampleType() string {
+	if p.inuse != nil {
+		return "inuse_space"
+	}
+	return "alloc_space"
+}
+
 // NewFunctionListener returns a function listener suited to install a hook on
 // functions responsible for memory allocation.
 //
 // The listener recognizes multiple memory allocation functions used by
 // compilers and libraries. It uses the function name to detect memory
-// allocators, currently supporting libc, Go, and TinyGo.
+// allocators, currently supporting libc, C++, Rust, Zig, Emscripten, Go,
+// TinyGo, CPython, and AssemblyScript.
 func (p *MemoryProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
-	if p.p.lang == python311 {
-		switch def.Name() {
-		// Raw domain
-		case "PyMem_RawMalloc":
-			return profilingListener{p.p, &mallocProfiler{memory: p}}
-		case "PyMem_RawCalloc":
-			return profilingListener{p.p, &callocProfiler{memory: p}}
-		case "PyMem_RawRealloc":
-			return profilingListener{p.p, &reallocProfiler{memory: p}}
-		case "PyMem_RawFree":
-			return profilingListener{p.p, &freeProfiler{memory: p}}
-		// Memory domain
-		case "PyMem_Malloc":
-			return profilingListener{p.p, &mallocProfiler{memory: p}}
-		case "PyMem_Calloc":
-			return profilingListener{p.p, &callocProfiler{memory: p}}
-		case "PyMem_Realloc":
-			return profilingListener{p.p, &reallocProfiler{memory: p}}
-		case "PyMem_Free":
-			return profilingListener{p.p, &freeProfiler{memory: p}}
-		// Object domain
-		case "PyObject_Malloc":
-			return profilingListener{p.p, &mallocProfiler{memory: p}}
-		case "PyObject_Calloc":
-			return profilingListener{p.p, &callocProfiler{memory: p}}
-		case "PyObject_Realloc":
-			return profilingListener{p.p, &reallocProfiler{memory: p}}
-		case "PyObject_Free":
-			return profilingListener{p.p, &freeProfiler{memory: p}}
+	switch p.p.lang {
+	case python3:
+		return p.newPythonFunctionListener(def)
+	case assemblyscript:
+		return p.newAssemblyScriptFunctionListener(def)
+	case zig:
+		if l := p.newZigFunctionListener(def); l != nil {
+			return l
 		}
-		return nil
 	}
 	switch def.Name() {
-	// C standard library, Rust
+	// C standard library
 	case "malloc":
-		return profilingListener{p.p, &mallocProfiler{memory: p}}
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
 	case "calloc":
-		return profilingListener{p.p, &callocProfiler{memory: p}}
+		return p.newAllocatorListener(&callocProfiler{memory: p}, 0)
 	case "realloc":
-		return profilingListener{p.p, &reallocProfiler{memory: p}}
+		return p.newAllocatorListener(&reallocProfiler{memory: p}, 0)
 	case "free":
-		return profilingListener{p.p, &freeProfiler{memory: p}}
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 0)
+	case "aligned_alloc", "memalign":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 1)
+	case "posix_memalign":
+		return p.newAllocatorListener(&posixMemalignProfiler{memory: p}, 0)
+	case "sbrk":
+		// Calls to sbrk are nested in the ones to allocators, they are
+		// not wrapped to record the growth of memory they cause.
+		if p.grow == nil {
+			return nil
+		}
+		return profilingListener{p.p, &instanceListener{l: &growProfiler{memory: p}}}
+
+	// Emscripten, the allocator is either emmalloc or dlmalloc, their
+	// functions are aliased as malloc, free, etc.
+	case "emscripten_builtin_malloc", "emmalloc_malloc", "dlmalloc":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
+	case "emmalloc_calloc", "dlcalloc":
+		return p.newAllocatorListener(&callocProfiler{memory: p}, 0)
+	case "emmalloc_realloc", "dlrealloc":
+		return p.newAllocatorListener(&reallocProfiler{memory: p}, 0)
+	case "emscripten_builtin_free", "emmalloc_free", "dlfree":
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 0)
+	case "emscripten_builtin_memalign", "emmalloc_memalign", "emmalloc_aligned_alloc", "dlmemalign":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 1)
+
+	// Rust, the shims generated by the compiler call the global allocator,
+	// which is either the one of the standard library (__rdl_*), or the one
+	// declared with #[global_allocator] like wee_alloc or dlmalloc (__rg_*).
+	// The shims may be inlined by LTO, leaving the calls to the allocators.
+	case "__rust_alloc", "__rdl_alloc", "__rg_alloc",
+		"__rust_alloc_zeroed", "__rdl_alloc_zeroed", "__rg_alloc_zeroed":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
+	case "__rust_realloc", "__rdl_realloc", "__rg_realloc":
+		return p.newAllocatorListener(&sizedReallocProfiler{reallocProfiler{memory: p}}, 0)
+	case "__rust_dealloc", "__rdl_dealloc", "__rg_dealloc":
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 0)
+
+	// C++, the operators of libc++ call malloc and free, which may also be
+	// inlined in them by LTO.
+	case "_Znwm", "_Znam", // new, new[]
+		"_ZnwmRKSt9nothrow_t", "_ZnamRKSt9nothrow_t",
+		"_ZnwmSt11align_val_t", "_ZnamSt11align_val_t":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
+	case "_ZdlPv", "_ZdaPv", // delete, delete[]
+		"_ZdlPvm", "_ZdaPvm",
+		"_ZdlPvSt11align_val_t", "_ZdaPvSt11align_val_t":
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 0)
 
 	// Go
 	case "runtime.mallocgc":
-		return profilingListener{p.p, &goRuntimeMallocgcProfiler{memory: p}}
+		if _, ok := p.p.goVersion.mspanLayout(); !ok {
+			return nil
+		}
+		return profilingListener{p.p, &instanceListener{l: &goRuntimeMallocgcProfiler{memory: p}}}
+	case "runtime.(*mheap).freeSpan":
+		layout, ok := p.p.goVersion.mspanLayout()
+		if !ok {
+			Logger().Warn("memory profiling is not supported for this version of Go",
+				"version", p.p.goVersion)
+			return nil
+		}
+		// Spans may be released while mallocgc is running, so the call must
+		// not be skipped like the nested calls of an allocator.
+		return profilingListener{p.p, &instanceListener{l: &goRuntimeFreeSpanProfiler{memory: p, layout: layout}}}
 
 	// TinyGo
 	case "runtime.alloc":
-		return profilingListener{p.p, &mallocProfiler{memory: p}}
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
+
+	default:
+		return nil
+	}
+}
+
+// CPython routes the allocations of its memory domains to the allocators
+// installed in them: the public functions (e.g. PyObject_Malloc) call the ones
+// of pymalloc (e.g. _PyObject_Malloc), which take a context as first parameter,
+// allocate arenas to carve small objects from, and fall back to the raw domain
+// for large objects.
+//
+// https://github.com/python/cpython/blob/3.12/Objects/obmalloc.c
+func (p *MemoryProfiler) newPythonFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	var l allocatorListener
+	var ctxParams int
+	switch def.Name() {
+	case "PyMem_RawMalloc", "PyMem_Malloc", "PyObject_Malloc":
+		l = &mallocProfiler{memory: p}
+	case "PyMem_RawCalloc", "PyMem_Calloc", "PyObject_Calloc":
+		l = &callocProfiler{memory: p}
+	case "PyMem_RawRealloc", "PyMem_Realloc", "PyObject_Realloc":
+		l = &reallocProfiler{memory: p}
+	case "PyMem_RawFree", "PyMem_Free", "PyObject_Free":
+		l = &freeProfiler{memory: p}
+	case "_PyMem_RawMalloc", "_PyObject_Malloc", "_PyObject_ArenaMalloc", "_PyObject_ArenaMmap":
+		l, ctxParams = &mallocProfiler{memory: p}, 1
+	case "_PyMem_RawCalloc", "_PyObject_Calloc":
+		l, ctxParams = &callocProfiler{memory: p}, 1
+	case "_PyMem_RawRealloc", "_PyObject_Realloc":
+		l, ctxParams = &reallocProfiler{memory: p}, 1
+	case "_PyMem_RawFree", "_PyObject_Free", "_PyObject_ArenaFree", "_PyObject_ArenaMunmap":
+		l, ctxParams = &freeProfiler{memory: p}, 1
+	default:
+		return nil
+	}
+	return p.newAllocatorListener(l, ctxParams)
+}
+
+// AssemblyScript allocates objects with __new, which calls the allocator of the
+// runtime with __alloc (TLSF by default). Objects are released by the garbage
+// collector, which calls __free with the address of their block.
+//
+// https://www.assemblyscript.org/runtime.html#memory-layout
+func (p *MemoryProfiler) newAssemblyScriptFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	name := def.Name()
+	name = name[strings.LastIndexByte(name, '/')+1:]
+	switch name {
+	case "__new":
+		return p.newAllocatorListener(&asObjectProfiler{l: &mallocProfiler{memory: p}}, 0)
+	case "__renew":
+		return p.newAllocatorListener(&asObjectProfiler{l: &reallocProfiler{memory: p}, renew: true}, 0)
+	case "__alloc":
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 0)
+	case "__realloc":
+		return p.newAllocatorListener(&reallocProfiler{memory: p}, 0)
+	case "__free":
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 0)
+	default:
+		return nil
+	}
+}
 
+// Zig programs allocate memory through the vtables of std.mem.Allocator, which
+// are implemented by the allocators of the standard library (e.g.
+// GeneralPurposeAllocator, ArenaAllocator) and wrap each other down to the page
+// allocator, which grows the memory. Their functions take a context as first
+// parameter.
+//
+// https://github.com/ziglang/zig/blob/0.11.0/lib/std/mem/Allocator.zig
+func (p *MemoryProfiler) newZigFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if _, ok := zigPageRequestFunctions[zigFunctionName(def)]; ok {
+		if p.grow == nil {
+			return nil
+		}
+		return profilingListener{p.p, &instanceListener{l: &growProfiler{memory: p}}}
+	}
+	switch zigAllocatorFunction(def) {
+	case "alloc": // alloc(ctx, len, log2_align, ret_addr) ?[*]u8
+		return p.newAllocatorListener(&mallocProfiler{memory: p}, 1)
+	case "resize": // resize(ctx, buf.ptr, buf.len, log2_align, new_len, ret_addr) bool
+		return p.newAllocatorListener(&zigResizeProfiler{memory: p}, 1)
+	case "remap": // remap(ctx, buf.ptr, buf.len, alignment, new_len, ret_addr) ?[*]u8
+		return p.newAllocatorListener(&sizedReallocProfiler{reallocProfiler{memory: p}}, 1)
+	case "free": // free(ctx, buf.ptr, buf.len, log2_align, ret_addr)
+		return p.newAllocatorListener(&freeProfiler{memory: p}, 1)
 	default:
 		return nil
 	}
 }
 
+// newAllocatorListener wraps the listener of an allocator which may call other
+// allocators (e.g. operator new calling malloc), so only the outermost call is
+// recorded. Allocations are attributed to the code which made them, and not
+// counted twice. The first skip parameters of the allocator are not passed to
+// the listener, e.g. the alignment taken by aligned_alloc before the size.
+func (p *MemoryProfiler) newAllocatorListener(l allocatorListener, skip int) experimental.FunctionListener {
+	return profilingListener{p.p, &allocatorProfiler{memory: p, skip: skip, instanceListener: instanceListener{l: l}}}
+}
+
+// allocatorListener is the listener of an allocator, which holds the state of
+// the call in progress.
+type allocatorListener interface {
+	experimental.FunctionListener
+	// clone returns a new listener for the same allocator, each instance of
+	// the guest calls the allocators with its own listeners.
+	clone() allocatorListener
+}
+
+type allocatorProfiler struct {
+	memory *MemoryProfiler
+	skip   int
+	instanceListener
+}
+
+// instanceListener dispatches the calls of each instance of the guest to its
+// own clone of the listener.
+type instanceListener struct {
+	l     allocatorListener
+	calls instanceState[allocatorCall]
+}
+
+type allocatorCall struct {
+	l allocatorListener
+}
+
+func (p *instanceListener) listener(mod api.Module) allocatorListener {
+	c := p.calls.load(mod)
+	if c.l == nil {
+		c.l = p.l.clone()
+	}
+	return c.l
+}
+
+func (p *instanceListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.listener(mod).Before(ctx, mod, def, params, si)
+}
+
+func (p *instanceListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	p.listener(mod).After(ctx, mod, def, results)
+}
+
+func (p *instanceListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	p.listener(mod).Abort(ctx, mod, def, err)
+}
+
+func (p *allocatorProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	depth := p.memory.depths.load(mod)
+	*depth++
+	if *depth == 1 {
+		p.listener(mod).Before(ctx, mod, def, params[p.skip:], si)
+	}
+}
+
+func (p *allocatorProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	depth := p.memory.depths.load(mod)
+	if *depth == 1 {
+		p.listener(mod).After(ctx, mod, def, results)
+	}
+	*depth--
+}
+
+func (p *allocatorProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	depth := p.memory.depths.load(mod)
+	if *depth == 1 {
+		p.listener(mod).Abort(ctx, mod, def, err)
+	}
+	*depth--
+}
+
 func (p *MemoryProfiler) observeAlloc(addr, size uint32, stack stackTrace) {
+	if s := stack.scope; s != nil {
+		s.observe(s.alloc, stack, int64(size))
+	}
 	p.mutex.Lock()
+	if p.sizeClasses != nil {
+		stack = p.withSizeClass(stack, size)
+	}
 	alloc := p.alloc.lookup(stack)
 	alloc.observe(int64(size))
+	p.allocBytes += int64(size)
 	if p.inuse != nil {
-		p.inuse[addr] = memoryAllocation{alloc, size}
+		p.inuse.insert(addr, memoryAllocation{alloc, size})
 	}
 	p.mutex.Unlock()
 }
 
+func (p *MemoryProfiler) observeGrow(size uint32, stack stackTrace) {
+	p.mutex.Lock()
+	p.grow.lookup(stack).observe(int64(size))
+	p.mutex.Unlock()
+}
+
 func (p *MemoryProfiler) observeFree(addr uint32) {
 	if p.inuse != nil {
 		p.mutex.Lock()
-		delete(p.inuse, addr)
+		p.inuse.delete(addr)
+		p.mutex.Unlock()
+	}
+}
+
+// observeFreeRange releases all the allocations that start within the memory
+// range [start, end). It is used for garbage collected languages where memory
+// is released in bulk rather than object per object.
+func (p *MemoryProfiler) observeFreeRange(start, end uint32) {
+	if p.inuse != nil {
+		p.mutex.Lock()
+		p.inuse.deleteRange(start, end)
 		p.mutex.Unlock()
 	}
 }
@@ -258,9 +800,13 @@ type mallocProfiler struct {
 	stack  stackTrace
 }
 
+func (p *mallocProfiler) clone() allocatorListener {
+	return &mallocProfiler{memory: p.memory}
+}
+
 func (p *mallocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
 	p.size = api.DecodeU32(params[0])
-	p.stack = makeStackTrace(p.stack, si)
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
 }
 
 func (p *mallocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
@@ -277,10 +823,14 @@ type callocProfiler struct {
 	stack  stackTrace
 }
 
+func (p *callocProfiler) clone() allocatorListener {
+	return &callocProfiler{memory: p.memory}
+}
+
 func (p *callocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
 	p.count = api.DecodeU32(params[0])
 	p.size = api.DecodeU32(params[1])
-	p.stack = makeStackTrace(p.stack, si)
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
 }
 
 func (p *callocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
@@ -297,25 +847,149 @@ type reallocProfiler struct {
 	stack  stackTrace
 }
 
+func (p *reallocProfiler) clone() allocatorListener {
+	return &reallocProfiler{memory: p.memory}
+}
+
 func (p *reallocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
 	p.addr = api.DecodeU32(params[0])
 	p.size = api.DecodeU32(params[1])
-	p.stack = makeStackTrace(p.stack, si)
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
 }
 
 func (p *reallocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	addr := api.DecodeU32(results[0])
+	if addr == 0 && p.size != 0 {
+		// The reallocation failed, the original block is left untouched.
+		return
+	}
 	p.memory.observeFree(p.addr)
-	p.memory.observeAlloc(api.DecodeU32(results[0]), p.size, p.stack)
+	if p.size != 0 {
+		// realloc(ptr, 0) is equivalent to free(ptr).
+		p.memory.observeAlloc(addr, p.size, p.stack)
+	}
 }
 
 func (p *reallocProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
 }
 
+// sizedReallocProfiler intercepts calls to reallocation functions which take
+// the pointer, its current size and alignment, and the new size, like the ones
+// of Rust allocators: __rust_realloc(ptr, old_size, align, new_size).
+type sizedReallocProfiler struct {
+	reallocProfiler
+}
+
+func (p *sizedReallocProfiler) clone() allocatorListener {
+	return &sizedReallocProfiler{reallocProfiler{memory: p.memory}}
+}
+
+func (p *sizedReallocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.reallocProfiler.Before(ctx, mod, def, []uint64{params[0], params[3]}, si)
+}
+
+// zigResizeProfiler intercepts calls to the resize functions of Zig allocators,
+// which return whether the allocation could be resized in place.
+type zigResizeProfiler struct {
+	memory *MemoryProfiler
+	addr   uint32
+	size   uint32
+	stack  stackTrace
+}
+
+func (p *zigResizeProfiler) clone() allocatorListener {
+	return &zigResizeProfiler{memory: p.memory}
+}
+
+func (p *zigResizeProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.addr = api.DecodeU32(params[0])
+	p.size = api.DecodeU32(params[3])
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
+}
+
+func (p *zigResizeProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if api.DecodeU32(results[0]) == 0 {
+		return
+	}
+	p.memory.observeFree(p.addr)
+	if p.size != 0 {
+		p.memory.observeAlloc(p.addr, p.size, p.stack)
+	}
+}
+
+func (p *zigResizeProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+}
+
+// posixMemalignProfiler intercepts calls to posix_memalign(memptr, alignment,
+// size), which returns zero on success and stores the address of the
+// allocation at memptr.
+type posixMemalignProfiler struct {
+	memory *MemoryProfiler
+	memptr uint32
+	size   uint32
+	stack  stackTrace
+}
+
+func (p *posixMemalignProfiler) clone() allocatorListener {
+	return &posixMemalignProfiler{memory: p.memory}
+}
+
+func (p *posixMemalignProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.memptr = api.DecodeU32(params[0])
+	p.size = api.DecodeU32(params[2])
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
+}
+
+func (p *posixMemalignProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if api.DecodeI32(results[0]) != 0 {
+		return
+	}
+	if addr, ok := mod.Memory().ReadUint32Le(p.memptr); ok {
+		p.memory.observeAlloc(addr, p.size, p.stack)
+	}
+}
+
+func (p *posixMemalignProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+}
+
+// growProfiler intercepts calls to functions which may grow the linear memory,
+// like sbrk when the program break moves past the end of the memory. Emscripten
+// calls the host with emscripten_resize_heap instead of growing the memory
+// itself, which is also seen as growth since the size of the memory is compared
+// after the call.
+type growProfiler struct {
+	memory *MemoryProfiler
+	size   uint32
+	stack  stackTrace
+}
+
+func (p *growProfiler) clone() allocatorListener {
+	return &growProfiler{memory: p.memory}
+}
+
+func (p *growProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p.size = mod.Memory().Size()
+	p.stack = p.memory.p.makeStackTrace(ctx, p.stack, si)
+}
+
+func (p *growProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if size := mod.Memory().Size(); size > p.size {
+		p.memory.observeGrow(size-p.size, p.stack)
+	}
+}
+
+func (p *growProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+}
+
 type freeProfiler struct {
 	memory *MemoryProfiler
 	addr   uint32
 }
 
+func (p *freeProfiler) clone() allocatorListener {
+	return &freeProfiler{memory: p.memory}
+}
+
 func (p *freeProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
 	p.addr = api.DecodeU32(params[0])
 }
@@ -328,35 +1002,148 @@ func (p *freeProfiler) Abort(ctx context.Context, mod api.Module, def api.Functi
 	p.After(ctx, mod, def, nil)
 }
 
+// The Go compiler passes arguments and results on the stack of the goroutine,
+// after the return address pushed by the caller. Results are laid out after
+// the arguments. For runtime.mallocgc(size uintptr, typ *_type, needzero bool)
+// the returned pointer is therefore the fourth 8 bytes word after the return
+// address.
+//
+// https://github.com/golang/go/blob/go1.21.0/src/runtime/malloc.go#L948
+const (
+	goMallocgcSizeOffset   = 8 * (0 + 1) // +1 for the return address
+	goMallocgcResultOffset = 8 * (3 + 1)
+)
+
 type goRuntimeMallocgcProfiler struct {
 	memory *MemoryProfiler
 	size   uint32
 	stack  stackTrace
 }
 
+func (p *goRuntimeMallocgcProfiler) clone() allocatorListener {
+	return &goRuntimeMallocgcProfiler{memory: p.memory}
+}
+
 func (p *goRuntimeMallocgcProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, wasmsi experimental.StackIterator) {
 	imod := mod.(experimental.InternalModule)
 	mem := imod.Memory()
 
 	sp := uint32(imod.Global(0).Get())
-	offset := sp + 8*(uint32(0)+1) // +1 for the return address
-	b, ok := mem.Read(offset, 8)
+	b, ok := mem.Read(sp+goMallocgcSizeOffset, 8)
 	if ok {
 		p.size = binary.LittleEndian.Uint32(b)
-		p.stack = makeStackTrace(p.stack, wasmsi)
+		p.stack = p.memory.p.makeStackTrace(ctx, p.stack, wasmsi)
 	} else {
 		p.size = 0
 	}
 }
 
-func (p *goRuntimeMallocgcProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
-	if p.size != 0 {
-		// TODO: get the returned pointer
-		addr := uint32(0)
-		p.memory.observeAlloc(addr, p.size, p.stack)
+func (p *goRuntimeMallocgcProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if p.size == 0 {
+		return
+	}
+	// Go functions return 1 when they unwind the wasm stack to switch to
+	// another goroutine. The call has not completed yet and will be resumed
+	// later, so there is no result to read.
+	if len(results) > 0 && results[0] != 0 {
+		return
 	}
+	imod := mod.(experimental.InternalModule)
+	mem := imod.Memory()
+
+	// The callee pops the return address before returning, so the stack
+	// pointer now points to the first argument. It may also differ from the
+	// one seen in Before if the stack of the goroutine was grown by the call.
+	sp := uint32(imod.Global(0).Get()) - 8
+	addr := uint32(0)
+	if b, ok := mem.Read(sp+goMallocgcResultOffset, 8); ok {
+		addr = binary.LittleEndian.Uint32(b)
+	}
+	p.memory.observeAlloc(addr, p.size, p.stack)
 }
 
 func (p *goRuntimeMallocgcProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
-	p.After(ctx, mod, def, nil)
+}
+
+// goMspanLayout describes the fields of the mspan struct read to find the range
+// of memory released by runtime.(*mheap).freeSpan.
+type goMspanLayout struct {
+	startAddrOffset uint32
+	npagesOffset    uint32
+	pageSize        uint64
+}
+
+// mspanLayout returns the layout of the mspan struct in this version of Go,
+// and false if it was not verified for this version. The first fields of the
+// struct, as well as the signatures of mallocgc and freeSpan, have not changed
+// from Go 1.18 to Go 1.22:
+//
+// size, offset, field
+// 8,    0,      next
+// 8,    8,      prev
+// 8,    16,     list
+// 8,    24,     startAddr
+// 8,    32,     npages
+//
+// https://github.com/golang/go/blob/go1.18/src/runtime/mheap.go
+// https://github.com/golang/go/blob/go1.22.0/src/runtime/mheap.go
+func (v goVersion) mspanLayout() (goMspanLayout, bool) {
+	if v < minGoVersion || v > 22 {
+		return goMspanLayout{}, false
+	}
+	return goMspanLayout{
+		startAddrOffset: 24,
+		npagesOffset:    32,
+		pageSize:        8192, // _PageSize
+	}, true
+}
+
+// goRuntimeFreeSpanProfiler intercepts calls to runtime.(*mheap).freeSpan,
+// which the Go garbage collector uses to return spans of memory to the heap
+// once all the objects they contained have been swept. All the allocations
+// recorded in the span are then considered released.
+type goRuntimeFreeSpanProfiler struct {
+	memory *MemoryProfiler
+	layout goMspanLayout
+	start  uint32
+	end    uint32
+}
+
+func (p *goRuntimeFreeSpanProfiler) clone() allocatorListener {
+	return &goRuntimeFreeSpanProfiler{memory: p.memory, layout: p.layout}
+}
+
+func (p *goRuntimeFreeSpanProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	imod := mod.(experimental.InternalModule)
+	mem := imod.Memory()
+
+	p.start, p.end = 0, 0
+	// func (h *mheap) freeSpan(s *mspan)
+	sp := uint32(imod.Global(0).Get())
+	s, ok := mem.ReadUint64Le(sp + 8*(1+1)) // +1 for the return address
+	if !ok {
+		return
+	}
+	start, ok := mem.ReadUint64Le(uint32(s) + p.layout.startAddrOffset)
+	if !ok {
+		return
+	}
+	npages, ok := mem.ReadUint64Le(uint32(s) + p.layout.npagesOffset)
+	if !ok {
+		return
+	}
+	p.start = uint32(start)
+	p.end = uint32(start + npages*p.layout.pageSize)
+}
+
+func (p *goRuntimeFreeSpanProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if len(results) > 0 && results[0] != 0 {
+		return
+	}
+	if p.start != p.end {
+		p.memory.observeFreeRange(p.start, p.end)
+	}
+}
+
+func (p *goRuntimeFreeSpanProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
 }
@@ -1,10 +1,561 @@
 package wzprof
 
 import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
 )
 
 func BenchmarkMemoryProfiler(b *testing.B) {
 	p := ProfilingFor(nil).MemoryProfiler()
 	benchmarkFunctionListener(b, p)
 }
+
+func TestMemoryProfilerInuse(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+	realloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, addr, size uint32) uint32 { return 0 })
+	realloc.FunctionName = "realloc"
+	free := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, addr uint32) {})
+	free.FunctionName = "free"
+
+	module := wazerotest.NewModule(nil, malloc, realloc, free)
+	ctx := context.Background()
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		lstn.After(ctx, module, def, results)
+	}
+
+	call(malloc, []uint64{10}, []uint64{100})
+	call(malloc, []uint64{20}, []uint64{200})
+	call(realloc, []uint64{200, 5}, []uint64{300}) // shrink
+	call(free, []uint64{100}, nil)
+	call(realloc, []uint64{300, 1 << 20}, []uint64{0}) // failed allocation
+
+	var inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if inuseObjects != 1 {
+		t.Errorf("wrong number of objects in use: want=1 got=%d", inuseObjects)
+	}
+	if inuseSpace != 5 {
+		t.Errorf("wrong number of bytes in use: want=5 got=%d", inuseSpace)
+	}
+
+	p.observeFreeRange(0, 1000)
+	for _, sample := range p.snapshot() {
+		if sample.value[2] != 0 || sample.value[3] != 0 {
+			t.Errorf("memory still in use after releasing range: %v", sample.value)
+		}
+	}
+}
+
+func TestMemoryProfilerDelta(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+
+	module := wazerotest.NewModule(nil, malloc)
+	ctx := context.Background()
+
+	call := func(size uint64) {
+		def := malloc.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, []uint64{size}, experimental.NewStackIterator(experimental.StackFrame{Function: malloc, PC: 1}))
+		lstn.After(ctx, module, def, []uint64{100})
+	}
+
+	call(10)
+
+	done := make(chan *profile.Profile)
+	go func() {
+		prof, err := p.deltaProfile(ctx, 200*time.Millisecond, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- prof
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	call(20)
+
+	prof := <-done
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 1 || v[1] != 20 {
+		t.Errorf("wrong sample values: want=[1 20] got=%v", v)
+	}
+}
+
+func TestMemoryProfilerPython(t *testing.T) {
+	profiling := ProfilingFor(nil)
+	profiling.lang = python3
+	p := profiling.MemoryProfiler(InuseMemory(true))
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	objectMalloc := function("PyObject_Malloc")
+	pymalloc := function("_PyObject_Malloc")
+	rawMalloc := function("_PyMem_RawMalloc")
+	pyfree := function("_PyObject_Free")
+	malloc := function("malloc")
+
+	module := wazerotest.NewModule(nil, objectMalloc, pymalloc, rawMalloc, pyfree, malloc)
+	ctx := context.Background()
+
+	if p.NewFunctionListener(malloc.Definition()) != nil {
+		t.Error("unexpected listener for malloc in a python module")
+	}
+
+	// Each call returns a function completing it, so nested calls can be
+	// made in between.
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// A large object allocated by pymalloc from the raw domain.
+	done := call(objectMalloc, []uint64{1000}, []uint64{100})
+	call(pymalloc, []uint64{0, 1000}, []uint64{100})()
+	call(rawMalloc, []uint64{0, 1000}, []uint64{100})()
+	done()
+	// A small object allocated by pymalloc directly.
+	call(pymalloc, []uint64{0, 10}, []uint64{200})()
+	call(pyfree, []uint64{0, 200}, nil)()
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if allocObjects != 2 || allocSpace != 1010 {
+		t.Errorf("wrong allocations: want=2/1010 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 1 || inuseSpace != 1000 {
+		t.Errorf("wrong memory in use: want=1/1000 got=%d/%d", inuseObjects, inuseSpace)
+	}
+}
+
+func TestMemoryProfilerCxx(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	opNew := function("_Znwm")
+	opDelete := function("_ZdlPv")
+	malloc := function("malloc")
+	free := function("free")
+	alignedAlloc := function("aligned_alloc")
+	posixMemalign := function("posix_memalign")
+
+	mem := wazerotest.NewFixedMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(mem, opNew, opDelete, malloc, free, alignedAlloc, posixMemalign)
+	ctx := context.Background()
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// operator new and delete call malloc and free.
+	done := call(opNew, []uint64{10}, []uint64{100})
+	call(malloc, []uint64{10}, []uint64{100})()
+	done()
+	done = call(opDelete, []uint64{100}, nil)
+	call(free, []uint64{100}, nil)()
+	done()
+
+	call(opNew, []uint64{20}, []uint64{200})()
+	call(alignedAlloc, []uint64{64, 30}, []uint64{300})()
+	mem.Write(0x10, []byte{0x90, 0x01, 0, 0}) // 400
+	call(posixMemalign, []uint64{0x10, 64, 40}, []uint64{0})()
+	call(posixMemalign, []uint64{0x10, 64, 1 << 30}, []uint64{12})() // ENOMEM
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if allocObjects != 4 || allocSpace != 100 {
+		t.Errorf("wrong allocations: want=4/100 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 3 || inuseSpace != 90 {
+		t.Errorf("wrong memory in use: want=3/90 got=%d/%d", inuseObjects, inuseSpace)
+	}
+}
+
+func TestMemoryProfilerRust(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	alloc := function("__rust_alloc")
+	allocZeroed := function("__rust_alloc_zeroed")
+	realloc := function("__rust_realloc")
+	dealloc := function("__rust_dealloc")
+	rgAlloc := function("__rg_alloc")
+
+	module := wazerotest.NewModule(nil, alloc, allocZeroed, realloc, dealloc, rgAlloc)
+	ctx := context.Background()
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// The shim calls the global allocator.
+	done := call(alloc, []uint64{10, 8}, []uint64{100})
+	call(rgAlloc, []uint64{10, 8}, []uint64{100})()
+	done()
+	call(allocZeroed, []uint64{20, 4}, []uint64{200})()
+	call(realloc, []uint64{200, 20, 4, 50}, []uint64{300})()
+	call(dealloc, []uint64{100, 10, 8}, nil)()
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if allocObjects != 3 || allocSpace != 80 {
+		t.Errorf("wrong allocations: want=3/80 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 1 || inuseSpace != 50 {
+		t.Errorf("wrong memory in use: want=1/50 got=%d/%d", inuseObjects, inuseSpace)
+	}
+}
+
+func TestMemoryProfilerEmscripten(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(MemoryGrowth(true))
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	malloc := function("emscripten_builtin_malloc")
+	memalign := function("emmalloc_memalign")
+	sbrk := function("sbrk")
+
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(mem, malloc, memalign, sbrk)
+	ctx := context.Background()
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// The allocator grows the memory to allocate a large object.
+	done := call(malloc, []uint64{100000}, []uint64{0x10000})
+	growDone := call(sbrk, []uint64{131072}, []uint64{0x10000})
+	mem.Grow(2)
+	growDone()
+	done()
+	// The break moves within the memory.
+	done = call(memalign, []uint64{16, 30}, []uint64{0x30000})
+	call(sbrk, []uint64{64}, []uint64{0x30000})()
+	done()
+
+	var allocObjects, allocSpace, growCount, growSpace int64
+	for _, sample := range p.snapshot() {
+		v := sample.sampleValue()
+		allocObjects += v[0]
+		allocSpace += v[1]
+		growCount += v[2]
+		growSpace += v[3]
+	}
+	if allocObjects != 2 || allocSpace != 100030 {
+		t.Errorf("wrong allocations: want=2/100030 got=%d/%d", allocObjects, allocSpace)
+	}
+	if growCount != 1 || growSpace != 2*wazerotest.PageSize {
+		t.Errorf("wrong memory growth: want=1/%d got=%d/%d", 2*wazerotest.PageSize, growCount, growSpace)
+	}
+	if n := len(p.SampleType()); n != 4 {
+		t.Errorf("wrong number of sample types: want=4 got=%d", n)
+	}
+}
+
+func TestMemoryProfilerGoInstances(t *testing.T) {
+	profiling := ProfilingFor(nil)
+	profiling.lang = golang
+	profiling.goVersion = 21
+	p := profiling.MemoryProfiler(InuseMemory(true))
+	layout, _ := profiling.goVersion.mspanLayout()
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	mallocgcLstn := p.NewFunctionListener(function("runtime.mallocgc").Definition())
+	freeSpanLstn := p.NewFunctionListener(function("runtime.(*mheap).freeSpan").Definition())
+	ctx := context.Background()
+
+	const sp = 1024
+	const span = 2048
+
+	// Each instance allocates objects of a different size in its own range
+	// of addresses, then releases them all in a single span.
+	instances := []struct {
+		size uint64
+		base uint64
+	}{
+		{size: 16, base: 0x100000},
+		{size: 32, base: 0x200000},
+	}
+
+	// The instances of the module share the listeners of its functions, and
+	// call them concurrently.
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		mallocgc := function("runtime.mallocgc")
+		freeSpan := function("runtime.(*mheap).freeSpan")
+		mem := wazerotest.NewFixedMemory(wazerotest.PageSize)
+		global := wazerotest.GlobalI32(sp)
+		module := wazerotest.NewModule(mem, mallocgc, freeSpan)
+		module.Globals = []*wazerotest.Global{global}
+		mallocgcDef := mallocgc.Definition()
+		freeSpanDef := freeSpan.Definition()
+
+		wg.Add(1)
+		go func(size, base uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < 100; i++ {
+				global.Value = api.EncodeI32(sp)
+				mem.WriteUint64Le(sp+goMallocgcSizeOffset, size)
+				mallocgcLstn.Before(ctx, module, mallocgcDef, nil, experimental.NewStackIterator(experimental.StackFrame{Function: mallocgc}))
+				// The return address is popped by the callee.
+				global.Value = api.EncodeI32(sp + 8)
+				mem.WriteUint64Le(sp+goMallocgcResultOffset, base+i*size)
+				mallocgcLstn.After(ctx, module, mallocgcDef, []uint64{0})
+			}
+			if size != 16 {
+				return
+			}
+			global.Value = api.EncodeI32(sp)
+			mem.WriteUint64Le(sp+8*(1+1), span)
+			mem.WriteUint64Le(span+layout.startAddrOffset, base)
+			mem.WriteUint64Le(span+layout.npagesOffset, 1)
+			freeSpanLstn.Before(ctx, module, freeSpanDef, nil, experimental.NewStackIterator(experimental.StackFrame{Function: freeSpan}))
+			freeSpanLstn.After(ctx, module, freeSpanDef, []uint64{0})
+		}(instance.size, instance.base)
+	}
+	wg.Wait()
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+	}
+	if allocObjects != 200 || allocSpace != 4800 {
+		t.Errorf("wrong allocations: want=200/4800 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 100 || inuseSpace != 3200 {
+		t.Errorf("wrong memory in use: want=100/3200 got=%d/%d", inuseObjects, inuseSpace)
+	}
+}
+
+func TestMemoryProfilerGoVersion(t *testing.T) {
+	for _, test := range []struct {
+		version goVersion
+		want    bool
+	}{
+		{0, false},
+		{17, false},
+		{18, true},
+		{21, true},
+		{22, true},
+		{23, false},
+	} {
+		profiling := ProfilingFor(nil)
+		profiling.lang = golang
+		profiling.goVersion = test.version
+		p := profiling.MemoryProfiler()
+
+		for _, name := range []string{"runtime.mallocgc", "runtime.(*mheap).freeSpan"} {
+			fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+			fn.FunctionName = name
+			if got := p.NewFunctionListener(fn.Definition()) != nil; got != test.want {
+				t.Errorf("go1.%d: wrong listener of %s: want=%t got=%t", test.version, name, test.want, got)
+			}
+		}
+	}
+}
+
+func TestMemoryProfilerSizeClasses(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true), AllocSizeClasses(true))
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+	free := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, addr uint32) {})
+	free.FunctionName = "free"
+
+	module := wazerotest.NewModule(nil, malloc, free)
+	ctx := WithLabels(context.Background(), map[string]string{"tenant": "a"})
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		lstn.After(ctx, module, def, results)
+	}
+
+	call(malloc, []uint64{8}, []uint64{100})
+	call(malloc, []uint64{16}, []uint64{200})
+	call(malloc, []uint64{17}, []uint64{300})
+	call(malloc, []uint64{4096}, []uint64{400})
+	call(malloc, []uint64{2 << 20}, []uint64{500})
+	call(free, []uint64{300}, nil)
+
+	want := map[string][4]int64{
+		"16B":   {2, 24, 2, 24},
+		"32B":   {1, 17, 0, 0},
+		"4KiB":  {1, 4096, 1, 4096},
+		"1MiB+": {1, 2 << 20, 1, 2 << 20},
+	}
+	prof := p.NewProfile(1)
+	if len(prof.Sample) != len(want) {
+		t.Fatalf("wrong number of samples: want=%d got=%d", len(want), len(prof.Sample))
+	}
+	for _, sample := range prof.Sample {
+		if tenant := sample.Label["tenant"]; len(tenant) != 1 || tenant[0] != "a" {
+			t.Errorf("wrong tenant label: %v", sample.Label)
+		}
+		class := sample.Label["size_class"]
+		if len(class) != 1 {
+			t.Fatalf("missing size class label: %v", sample.Label)
+		}
+		if v := want[class[0]]; *(*[4]int64)(sample.Value) != v {
+			t.Errorf("wrong values of size class %s: want=%v got=%v", class[0], v, sample.Value)
+		}
+	}
+}
+
+func TestSizeClass(t *testing.T) {
+	tests := []struct {
+		size  uint32
+		label string
+	}{
+		{0, "16B"},
+		{16, "16B"},
+		{17, "32B"},
+		{1000, "1KiB"},
+		{1024, "1KiB"},
+		{1025, "2KiB"},
+		{1 << 20, "1MiB"},
+		{1<<20 + 1, "1MiB+"},
+	}
+	for _, test := range tests {
+		if label := sizeClassLabel(sizeClass(test.size)); label != test.label {
+			t.Errorf("wrong size class of %d bytes: want=%s got=%s", test.size, test.label, label)
+		}
+	}
+}
+
+func TestMemoryProfilerInuseProfile(t *testing.T) {
+	if prof := ProfilingFor(nil).MemoryProfiler().InuseProfile(1); prof != nil {
+		t.Error("memory in use profiled without InuseMemory")
+	}
+
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+	free := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, addr uint32) {})
+	free.FunctionName = "free"
+	module := wazerotest.NewModule(nil, malloc, free)
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(context.Background(), module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		lstn.After(context.Background(), module, def, results)
+	}
+
+	call(malloc, []uint64{10}, []uint64{100})
+	call(malloc, []uint64{20}, []uint64{200})
+	call(free, []uint64{100}, nil)
+
+	prof := p.InuseProfile(1)
+	if len(prof.SampleType) != 2 || prof.SampleType[0].Type != "inuse_objects" || prof.SampleType[1].Type != "inuse_space" {
+		t.Fatalf("wrong sample types: %v", prof.SampleType)
+	}
+	if len(prof.Sample) != 1 || prof.Sample[0].Value[0] != 1 || prof.Sample[0].Value[1] != 20 {
+		t.Errorf("wrong memory in use: %v", prof.Sample)
+	}
+}
+
+func TestMemoryInuseDeleteRange(t *testing.T) {
+	const page = 1 << memoryInusePageShift
+
+	tests := []struct {
+		scenario   string
+		start, end uint32
+		want       []uint32
+	}{
+		{"empty range", 100, 100, []uint32{0, 100, page - 1, page, 3*page + 8, 0xfffffff0}},
+		{"within a page", 50, 150, []uint32{0, page - 1, page, 3*page + 8, 0xfffffff0}},
+		{"across pages", 100, page + 1, []uint32{0, 3*page + 8, 0xfffffff0}},
+		{"whole pages", page, 4 * page, []uint32{0, 100, page - 1, 0xfffffff0}},
+		{"sparse range", 1, 0xffffffff, []uint32{0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			m := newMemoryInuse()
+			for _, addr := range []uint32{0, 100, page - 1, page, 3*page + 8, 0xfffffff0} {
+				m.insert(addr, memoryAllocation{size: addr})
+			}
+			m.deleteRange(test.start, test.end)
+
+			var got []uint32
+			m.forEach(func(alloc memoryAllocation) { got = append(got, alloc.size) })
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong allocations in use: want=%v got=%v", test.want, got)
+			}
+		})
+	}
+}
@@ -53,24 +53,24 @@ type vmem interface {
 // not recursive: if T is a struct and contains pointers or slices, deref does
 // not bring their contents from memory. Pointers can be deref'd themselves, and
 // derefSlice can help to bring the contents of slices to the host memory.
-func deref[T any](r vmem, p ptr) T {
+func deref[T any, P ptr](r vmem, p P) T {
 	var t T
 	s := uint32(unsafe.Sizeof(t))
 	b, ok := r.Read(p.addr(), s)
 	if !ok {
-		panic(fmt.Errorf("invalid virtual memory read at %#x size %d", p, s))
+		panic(fmt.Errorf("invalid virtual memory read at %#x size %d", p.addr(), s))
 	}
 	return *(*T)(unsafe.Pointer((unsafe.SliceData(b))))
 }
 
 // derefArrayInto copies into the given host slice contiguous elements
 // of type T starting at the virtual address p to fill it.
-func derefArray[T any](r vmem, p ptr, n uint32) []T {
+func derefArray[T any, P ptr](r vmem, p P, n uint32) []T {
 	var t T
 	s := uint32(unsafe.Sizeof(t)) * n
 	view, ok := r.Read(p.addr(), s)
 	if !ok {
-		panic(fmt.Errorf("invalid virtual memory array read at %#x size %d", p, s))
+		panic(fmt.Errorf("invalid virtual memory array read at %#x size %d", p.addr(), s))
 	}
 
 	outb := make([]byte, s)
@@ -87,15 +87,18 @@ func derefGoSlice[T any](r vmem, s []T) []T {
 	count := len(s)
 	sh := (*reflect.SliceHeader)(unsafe.Pointer(&s))
 	dp := ptr64(sh.Data)
-	res := make([]T, count)
-	for i := 0; i < count; i++ {
-		res[i] = derefArrayIndex[T](r, dp, int32(i))
+	size := uint32(unsafe.Sizeof(s[0])) * uint32(count)
+	view, ok := r.Read(dp.addr(), size)
+	if !ok {
+		panic(fmt.Errorf("invalid virtual memory slice read at %#x size %d", dp, size))
 	}
+	res := make([]T, count)
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(res))), size), view)
 	return res
 }
 
 // Reads the i-th element of an array that starts at address p.
-func derefArrayIndex[T any](r vmem, p ptr, i int32) T {
+func derefArrayIndex[T any, P ptr](r vmem, p P, i int32) T {
 	var t T
 	a := p.addr()
 	s := uint32(unsafe.Sizeof(t))
@@ -0,0 +1,305 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// MemStats is a subset of the runtime.MemStats of Go guests, see the
+// documentation of the runtime package for the meaning of each field.
+type MemStats struct {
+	Time         time.Time
+	HeapAlloc    uint64
+	HeapSys      uint64
+	HeapInuse    uint64
+	HeapReleased uint64
+	TotalAlloc   uint64
+	NumGC        uint32
+	PauseTotalNs uint64
+	LastGC       uint64
+}
+
+// MemStatsCollector reads the runtime.memstats structure from the memory of Go
+// guests, complementing the allocation sites recorded by MemoryProfiler with
+// the view that the Go runtime has of its heap.
+//
+// The structure does not have a symbol in the module, the collector locates it
+// by looking for the buffer of recent GC pauses at the end of the first garbage
+// collection of the guest. No statistics are available until then.
+//
+// The statistics are read while the guest may be running, and without flushing
+// the allocation caches of the Go runtime like runtime.ReadMemStats does. The
+// heap usage is an approximation which may be higher than what the guest would
+// observe.
+//
+// The layout of the runtime structures is the one of Go 1.21, statistics are
+// not collected for guests compiled by earlier versions.
+type MemStatsCollector struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	mem    vmem
+	addr   ptr64
+	series []MemStats
+}
+
+func newMemStatsCollector(p *Profiling) *MemStatsCollector {
+	return &MemStatsCollector{p: p}
+}
+
+// https://github.com/golang/go/blob/go1.21.0/src/runtime/sizeclasses.go
+const goNumSizeClasses = 68
+
+var goClassToSize = [goNumSizeClasses]uint64{0, 8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224, 240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200, 3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728, 10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760, 24576, 27264, 28672, 32768}
+
+// heapStatsDelta and mstats come from runtime/mstats.go. They must keep the
+// same layout to be read from memory, fields after enablegc are omitted.
+// nolint:unused
+type heapStatsDelta struct {
+	committed       int64
+	released        int64
+	inHeap          int64
+	inStacks        int64
+	inWorkBufs      int64
+	inPtrScalarBits int64
+	tinyAllocCount  uint64
+	largeAlloc      uint64
+	largeAllocCount uint64
+	smallAllocCount [goNumSizeClasses]uint64
+	largeFree       uint64
+	largeFreeCount  uint64
+	smallFreeCount  [goNumSizeClasses]uint64
+}
+
+// nolint:unused
+type mstats struct {
+	heapStats struct {
+		stats   [3]heapStatsDelta
+		gen     uint32
+		noPLock ptr64
+	}
+	stacksSys      uint64
+	mspanSys       uint64
+	mcacheSys      uint64
+	buckhashSys    uint64
+	gcMiscSys      uint64
+	otherSys       uint64
+	lastGCUnix     uint64
+	pauseTotalNs   uint64
+	pauseNs        [256]uint64
+	pauseEnd       [256]uint64
+	numGC          uint32
+	numForcedGC    uint32
+	gcCPUFraction  float64
+	lastGCNanotime uint64
+	lastHeapInUse  uint64
+	enableGC       bool
+}
+
+// findMemstats returns the address of runtime.memstats, or zero if it could
+// not be found. The structure contains no pointers so it lives in the noptrbss
+// section, where it is recognized by the end time of the last GC being equal
+// to the last entry of the circular buffer of GC end times.
+func findMemstats(mem vmem, md *moduledata) ptr64 {
+	if md.enoptrbss <= md.noptrbss {
+		return 0
+	}
+	b, ok := mem.Read(md.noptrbss.addr(), uint32(md.enoptrbss-md.noptrbss))
+	if !ok {
+		return 0
+	}
+	var m mstats
+	size := int(unsafe.Sizeof(m))
+	for i := 0; i+size <= len(b); i += 8 {
+		s := b[i : i+size]
+		numGC := binary.LittleEndian.Uint32(s[unsafe.Offsetof(m.numGC):])
+		lastGC := binary.LittleEndian.Uint64(s[unsafe.Offsetof(m.lastGCUnix):])
+		if numGC == 0 || lastGC == 0 || s[unsafe.Offsetof(m.enableGC)] != 1 {
+			continue
+		}
+		last := uintptr((numGC - 1) % uint32(len(m.pauseEnd)))
+		pauseEnd := binary.LittleEndian.Uint64(s[unsafe.Offsetof(m.pauseEnd)+8*last:])
+		pauseNs := binary.LittleEndian.Uint64(s[unsafe.Offsetof(m.pauseNs)+8*last:])
+		pauseTotalNs := binary.LittleEndian.Uint64(s[unsafe.Offsetof(m.pauseTotalNs):])
+		if pauseEnd == lastGC && pauseNs <= pauseTotalNs {
+			return md.noptrbss + ptr64(i)
+		}
+	}
+	return 0
+}
+
+// ReadMemStats reads the current statistics from the guest memory. The method
+// returns false if the statistics are not available yet.
+func (c *MemStatsCollector) ReadMemStats() (stats MemStats, ok bool) {
+	c.mutex.Lock()
+	mem, addr := c.mem, c.addr
+	c.mutex.Unlock()
+
+	if addr == 0 {
+		return stats, false
+	}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	m := deref[mstats](mem, addr)
+	var heap heapStatsDelta
+	for i := range m.heapStats.stats {
+		heap.merge(&m.heapStats.stats[i])
+	}
+
+	totalAlloc, totalFree := heap.largeAlloc, heap.largeFree
+	for i, size := range goClassToSize {
+		totalAlloc += heap.smallAllocCount[i] * size
+		totalFree += heap.smallFreeCount[i] * size
+	}
+
+	stats = MemStats{
+		Time:         time.Now(),
+		HeapAlloc:    totalAlloc - totalFree,
+		HeapSys:      uint64(heap.committed - heap.inStacks - heap.inWorkBufs - heap.inPtrScalarBits + heap.released),
+		HeapInuse:    uint64(heap.inHeap),
+		HeapReleased: uint64(heap.released),
+		TotalAlloc:   totalAlloc,
+		NumGC:        m.numGC,
+		PauseTotalNs: m.pauseTotalNs,
+		LastGC:       m.lastGCUnix,
+	}
+	return stats, true
+}
+
+func (d *heapStatsDelta) merge(s *heapStatsDelta) {
+	d.committed += s.committed
+	d.released += s.released
+	d.inHeap += s.inHeap
+	d.inStacks += s.inStacks
+	d.inWorkBufs += s.inWorkBufs
+	d.inPtrScalarBits += s.inPtrScalarBits
+	d.tinyAllocCount += s.tinyAllocCount
+	d.largeAlloc += s.largeAlloc
+	d.largeAllocCount += s.largeAllocCount
+	d.largeFree += s.largeFree
+	d.largeFreeCount += s.largeFreeCount
+	for i := range d.smallAllocCount {
+		d.smallAllocCount[i] += s.smallAllocCount[i]
+		d.smallFreeCount[i] += s.smallFreeCount[i]
+	}
+}
+
+// Collect reads the current statistics and appends them to the time series
+// written by WriteCSV. The method returns false if the statistics are not
+// available yet.
+func (c *MemStatsCollector) Collect() bool {
+	stats, ok := c.ReadMemStats()
+	if ok {
+		c.mutex.Lock()
+		c.series = append(c.series, stats)
+		c.mutex.Unlock()
+	}
+	return ok
+}
+
+// WriteCSV writes the time series of statistics recorded by Collect to w, one
+// row per call.
+func (c *MemStatsCollector) WriteCSV(w io.Writer) error {
+	c.mutex.Lock()
+	series := c.series
+	c.mutex.Unlock()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "heap_alloc", "heap_sys", "heap_inuse", "heap_released", "total_alloc", "num_gc", "pause_total_ns", "last_gc"})
+	for _, s := range series {
+		cw.Write([]string{
+			s.Time.UTC().Format(time.RFC3339Nano),
+			strconv.FormatUint(s.HeapAlloc, 10),
+			strconv.FormatUint(s.HeapSys, 10),
+			strconv.FormatUint(s.HeapInuse, 10),
+			strconv.FormatUint(s.HeapReleased, 10),
+			strconv.FormatUint(s.TotalAlloc, 10),
+			strconv.FormatUint(uint64(s.NumGC), 10),
+			strconv.FormatUint(s.PauseTotalNs, 10),
+			strconv.FormatUint(s.LastGC, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// NewHandler returns a http handler exposing the current statistics in the
+// Prometheus text format. Nothing is written until the statistics are
+// available.
+func (c *MemStatsCollector) NewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats, ok := c.ReadMemStats()
+		if !ok {
+			return
+		}
+		metrics := []struct {
+			name  string
+			kind  string
+			help  string
+			value float64
+		}{
+			{"go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.", float64(stats.HeapAlloc)},
+			{"go_memstats_heap_sys_bytes", "gauge", "Number of heap bytes obtained from system.", float64(stats.HeapSys)},
+			{"go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", float64(stats.HeapInuse)},
+			{"go_memstats_heap_released_bytes", "gauge", "Number of heap bytes released to OS.", float64(stats.HeapReleased)},
+			{"go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", float64(stats.TotalAlloc)},
+			{"go_memstats_gc_total", "counter", "Number of completed GC cycles.", float64(stats.NumGC)},
+			{"go_memstats_gc_pause_seconds_total", "counter", "Cumulative time spent in GC stop-the-world pauses.", time.Duration(stats.PauseTotalNs).Seconds()},
+		}
+		for _, m := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+		}
+	})
+}
+
+// NewFunctionListener returns a function listener locating the statistics at
+// the end of garbage collections if the function passed as argument is
+// runtime.gcMarkTermination, or nil otherwise.
+func (c *MemStatsCollector) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.Name() != gcMarkTerminationFunction {
+		return nil
+	}
+	return profilingListener{c.p, memStatsCollector{c}}
+}
+
+type memStatsCollector struct{ *MemStatsCollector }
+
+func (c memStatsCollector) Before(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) {
+}
+
+func (c memStatsCollector) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	// Go functions return 1 when they unwind the wasm stack to switch to
+	// another goroutine, the statistics are updated when the call completes.
+	if len(results) > 0 && results[0] != 0 {
+		return
+	}
+	symbols, _ := c.p.symbols.(*pclntab)
+	if symbols == nil || symbols.version < 21 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.addr == 0 {
+		c.mem = mod.Memory()
+		c.addr = findMemstats(c.mem, &symbols.md)
+	}
+}
+
+func (c memStatsCollector) Abort(context.Context, api.Module, api.FunctionDefinition, error) {
+}
@@ -0,0 +1,64 @@
+package wzprof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestMemStatsCollector(t *testing.T) {
+	var m mstats
+	m.heapStats.stats[0].committed = 8 << 20
+	m.heapStats.stats[0].inHeap = 1 << 20
+	m.heapStats.stats[0].inStacks = 1 << 16
+	m.heapStats.stats[1].largeAlloc = 1 << 20
+	m.heapStats.stats[1].smallAllocCount[1] = 10 // 8 bytes
+	m.heapStats.stats[2].smallFreeCount[1] = 4
+	m.lastGCUnix = 1700000000000000000
+	m.pauseTotalNs = 300
+	m.pauseNs[2] = 100
+	m.pauseEnd[2] = m.lastGCUnix
+	m.numGC = 3
+	m.enableGC = true
+
+	const addr = 0x1008
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	copy(mem.Bytes[addr:], unsafe.Slice((*byte)(unsafe.Pointer(&m)), unsafe.Sizeof(m)))
+
+	md := &moduledata{noptrbss: 0x1000, enoptrbss: 0x4000}
+	if found := findMemstats(mem, md); found != addr {
+		t.Fatalf("wrong memstats address: %#x", found)
+	}
+
+	c := ProfilingFor(nil).MemStatsCollector()
+	if c.Collect() {
+		t.Error("statistics collected before memstats was found")
+	}
+	c.mem, c.addr = mem, addr
+	if !c.Collect() {
+		t.Fatal("statistics not collected")
+	}
+
+	stats := c.series[0]
+	if want := uint64(1<<20 + 6*8); stats.HeapAlloc != want {
+		t.Errorf("wrong heap alloc: want=%d got=%d", want, stats.HeapAlloc)
+	}
+	if want := uint64(8<<20 - 1<<16); stats.HeapSys != want {
+		t.Errorf("wrong heap sys: want=%d got=%d", want, stats.HeapSys)
+	}
+	if stats.NumGC != 3 || stats.PauseTotalNs != 300 {
+		t.Errorf("wrong gc stats: %+v", stats)
+	}
+
+	b := new(bytes.Buffer)
+	if err := c.WriteCSV(b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], ",1048624,8323072,1048576,0,1048656,3,300,1700000000000000000") {
+		t.Errorf("wrong csv output:\n%s", b.String())
+	}
+}
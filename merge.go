@@ -0,0 +1,45 @@
+package wzprof
+
+import (
+	"github.com/google/pprof/profile"
+)
+
+// MergeProfiles combines multiple profiles into a single one. Samples recorded
+// for the same stacks in different profiles are merged by summing their
+// values, and the identifiers of locations, functions, and mappings are
+// re-assigned so they remain unique in the resulting profile.
+//
+// This is useful to aggregate the profiles of multiple short runs of a program
+// into a single profile containing enough samples to be representative.
+//
+// The profiles must have the same sample types. Profiles which have no period
+// type are merged as if they had an empty one, since pprof requires it to
+// merge profiles; the input profiles are not modified, so they can be merged
+// again, e.g. when they are snapshots of the memory in use.
+func MergeProfiles(profiles ...*profile.Profile) (*profile.Profile, error) {
+	inputs := make([]*profile.Profile, len(profiles))
+	for i, p := range profiles {
+		if p.PeriodType == nil {
+			p = p.Copy()
+			p.PeriodType = &profile.ValueType{}
+		}
+		inputs[i] = p
+	}
+	return profile.Merge(inputs)
+}
+
+// DeltaProfile returns the difference between two snapshots of a cumulative
+// profile, like the memory profile, holding the values recorded after base was
+// taken and until next was. Samples with values that did not change are
+// dropped. The input profiles are not modified.
+func DeltaProfile(base, next *profile.Profile) (*profile.Profile, error) {
+	neg := base.Copy()
+	neg.Scale(-1)
+	delta, err := MergeProfiles(neg, next)
+	if err != nil {
+		return nil, err
+	}
+	delta.TimeNanos = base.TimeNanos + base.DurationNanos
+	delta.DurationNanos = next.TimeNanos + next.DurationNanos - delta.TimeNanos
+	return delta, nil
+}
@@ -0,0 +1,82 @@
+package wzprof
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func newMergeProfile(name string, value int64) *profile.Profile {
+	fn := &profile.Function{ID: 1, Name: name}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	inputs := []*profile.Profile{
+		newMergeProfile("f", 1),
+		newMergeProfile("g", 2),
+		newMergeProfile("f", 3),
+	}
+	prof, err := MergeProfiles(inputs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range inputs {
+		if p.PeriodType != nil {
+			t.Errorf("input profile %d was modified: period type %v", i, p.PeriodType)
+		}
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]int64)
+	for _, s := range prof.Sample {
+		values[s.Location[0].Line[0].Function.Name] += s.Value[0]
+	}
+	if len(prof.Sample) != 2 || values["f"] != 4 || values["g"] != 2 {
+		t.Errorf("wrong merged samples: %v", values)
+	}
+}
+
+func TestDeltaProfile(t *testing.T) {
+	base, err := MergeProfiles(newMergeProfile("f", 1), newMergeProfile("g", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := MergeProfiles(newMergeProfile("f", 4), newMergeProfile("g", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.TimeNanos, base.DurationNanos = 100, 10
+	next.TimeNanos, next.DurationNanos = 100, 30
+
+	delta, err := DeltaProfile(base, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delta.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	if delta.TimeNanos != 110 || delta.DurationNanos != 20 {
+		t.Errorf("wrong interval of the delta profile: want=110+20 got=%d+%d", delta.TimeNanos, delta.DurationNanos)
+	}
+	// The samples of g did not change, they are dropped.
+	if len(delta.Sample) != 1 {
+		t.Fatalf("wrong number of samples: want=1 got=%d", len(delta.Sample))
+	}
+	if name, v := delta.Sample[0].Location[0].Line[0].Function.Name, delta.Sample[0].Value[0]; name != "f" || v != 3 {
+		t.Errorf("wrong delta sample: want=f:3 got=%s:%d", name, v)
+	}
+	for _, s := range base.Sample {
+		if s.Value[0] < 0 {
+			t.Errorf("base profile was modified: %v", s.Value)
+		}
+	}
+}
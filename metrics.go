@@ -0,0 +1,64 @@
+package wzprof
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// MetricsHandler returns a http handler exposing metrics about the state of the
+// profilers in the Prometheus text format, to monitor the profiled program and
+// the cost of profiling it:
+//
+//   - wzprof_samples_total counts the calls recorded by the profilers.
+//   - wzprof_overhead_seconds_total is the time spent recording them.
+//   - wzprof_profile_stacks is the number of unique stacks of each profile.
+//   - wzprof_alloc_bytes_total counts the bytes of the allocations observed
+//     by the memory profiler.
+//   - wzprof_memory_grow_pages_total counts the pages added to the memory
+//     observed by the memory growth profiler.
+//
+// The samples and overhead are only counted when enabled with Metrics.
+func (p *Profiling) MetricsHandler(profilers ...Profiler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		if p.metrics {
+			writeMetric(w, "wzprof_samples_total", "counter", "Number of calls recorded by the profilers.")
+			fmt.Fprintf(w, "wzprof_samples_total %d\n", p.samples.Load())
+			writeMetric(w, "wzprof_overhead_seconds_total", "counter", "Time spent recording the calls.")
+			fmt.Fprintf(w, "wzprof_overhead_seconds_total %g\n", time.Duration(p.overhead.Load()).Seconds())
+		}
+
+		writeMetric(w, "wzprof_profile_stacks", "gauge", "Number of unique stacks recorded in the profiles.")
+		for _, prof := range profilers {
+			fmt.Fprintf(w, "wzprof_profile_stacks{profile=%q} %d\n", prof.Name(), prof.Count())
+		}
+
+		for _, prof := range profilers {
+			switch prof := prof.(type) {
+			case *MemoryProfiler:
+				prof.mutex.Lock()
+				bytes := prof.allocBytes
+				prof.mutex.Unlock()
+				writeMetric(w, "wzprof_alloc_bytes_total", "counter", "Number of bytes of the allocations observed.")
+				fmt.Fprintf(w, "wzprof_alloc_bytes_total %d\n", bytes)
+			case *GrowProfiler:
+				prof.mutex.Lock()
+				pages := prof.pages
+				prof.mutex.Unlock()
+				writeMetric(w, "wzprof_memory_grow_pages_total", "counter", "Number of pages added to the linear memory.")
+				fmt.Fprintf(w, "wzprof_memory_grow_pages_total %d\n", pages)
+			}
+		}
+	})
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// observeOverhead records the time spent in a listener since start.
+func (p *Profiling) observeOverhead(start int64) {
+	p.overhead.Add(nanotime() - start)
+}
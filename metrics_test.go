@@ -0,0 +1,54 @@
+package wzprof
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	p := ProfilingFor(nil, Metrics(true))
+	mem := p.MemoryProfiler()
+	grow := p.GrowProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+	memory := wazerotest.NewMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(memory, malloc)
+	def := malloc.Definition()
+	ctx := context.Background()
+
+	grow.StartProfile()
+	for _, size := range []uint64{10, 20} {
+		stack := experimental.NewStackIterator(experimental.StackFrame{Function: malloc})
+		lstn := mem.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, []uint64{size}, stack)
+		lstn.After(ctx, module, def, []uint64{100})
+	}
+	lstn := grow.NewFunctionListener(def)
+	lstn.Before(ctx, module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: malloc}))
+	memory.Grow(3)
+	lstn.After(ctx, module, def, nil)
+
+	w := httptest.NewRecorder()
+	p.MetricsHandler(mem, grow).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, metric := range []string{
+		"wzprof_samples_total 3\n",
+		"wzprof_profile_stacks{profile=\"allocs\"} 1\n",
+		"wzprof_profile_stacks{profile=\"grow\"} 1\n",
+		"wzprof_alloc_bytes_total 30\n",
+		"wzprof_memory_grow_pages_total 3\n",
+		"# TYPE wzprof_overhead_seconds_total counter\n",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("metric not found: %q\n%s", metric, body)
+		}
+	}
+}
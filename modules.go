@@ -0,0 +1,86 @@
+package wzprof
+
+import (
+	"context"
+	"hash/maphash"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// PrepareModule prepares the profiling of another module compiled by the
+// runtime the profilers are installed in, for embedders running several
+// different modules. The calls of the instances of the module are symbolized
+// and unwound with the state of the module instead of the one of the profiled
+// module, and their locations are attributed to a separate mapping of the
+// profiles.
+//
+// The options configure the profiling of the module like the ones passed to
+// ProfilingFor; Demangle, Symbolize, SourcePathPrefix and Interpreter default
+// to the values of p. Modules must be prepared before they are instantiated, and the
+// instances are matched to their module by the functions they export, so the
+// modules must export at least one function.
+//
+// Frames of functions imported from other modules are symbolized with the
+// state of the module which made the call.
+func (p *Profiling) PrepareModule(wasm []byte, mod wazero.CompiledModule, options ...ProfilingOption) error {
+	inherited := []ProfilingOption{Demangle(p.demangle), Symbolize(p.symbolize), Interpreter(p.interpreter)}
+	for _, prefix := range p.pathPrefixes {
+		inherited = append(inherited, SourcePathPrefix(prefix.old, prefix.new))
+	}
+	m := ProfilingFor(wasm, append(inherited, options...)...)
+	if err := m.Prepare(mod); err != nil {
+		return err
+	}
+	m.moduleKey = maphash.String(stackTraceHashSeed, m.hash)
+
+	if p.modules == nil {
+		p.modules = make(map[api.FunctionDefinition]*Profiling)
+	}
+	for _, def := range mod.ExportedFunctions() {
+		p.modules[def] = m
+	}
+	return nil
+}
+
+type moduleKey struct{}
+
+// moduleInstance is the module an instance was created from.
+type moduleInstance struct {
+	p *Profiling
+}
+
+// moduleOf returns the profiling state of the module the instance was created
+// from, which is p unless other modules were prepared with PrepareModule.
+func (p *Profiling) moduleOf(mod api.Module) *Profiling {
+	if len(p.modules) == 0 {
+		return p
+	}
+	m := p.instances.load(mod)
+	if m.p == nil {
+		m.p = p
+		// The definitions of the functions are shared by the compiled
+		// module and its instances.
+		for _, def := range mod.ExportedFunctionDefinitions() {
+			if q, ok := p.modules[def]; ok {
+				m.p = q
+				break
+			}
+		}
+	}
+	return m.p
+}
+
+// moduleContext returns ctx with the module of the stack traces captured in
+// the call added to it, when it is not the profiled module.
+func (p *Profiling) moduleContext(ctx context.Context, m *Profiling) context.Context {
+	if m == p {
+		return ctx
+	}
+	return context.WithValue(ctx, moduleKey{}, m)
+}
+
+func contextModule(ctx context.Context) *Profiling {
+	m, _ := ctx.Value(moduleKey{}).(*Profiling)
+	return m
+}
@@ -0,0 +1,90 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func TestPrepareModule(t *testing.T) {
+	loop := testLoopModule()
+	simple, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProfilingFor(loop)
+	cpu := p.CPUProfiler()
+	cpu.StartProfile()
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, cpu)
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true))
+	defer runtime.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	loopModule, err := runtime.CompileModule(ctx, loop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(loopModule); err != nil {
+		t.Fatal(err)
+	}
+	simpleModule, err := runtime.CompileModule(ctx, simple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PrepareModule(simple, simpleModule); err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := runtime.InstantiateModule(ctx, loopModule, wazero.NewModuleConfig().WithName("loop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.InstantiateModule(ctx, simpleModule, wazero.NewModuleConfig().WithName("simple")); err != nil {
+		t.Fatal(err)
+	}
+
+	prof := cpu.StopProfile(1)
+	if len(prof.Mapping) != 2 {
+		t.Fatalf("wrong number of mappings: %d", len(prof.Mapping))
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The functions of the C program are symbolized with its DWARF
+	// information, in the mapping of its module.
+	builds := make(map[string]string)
+	for _, loc := range prof.Location {
+		for _, line := range loc.Line {
+			switch name := line.Function.Name; name {
+			case "inner", "outer":
+				builds[name] = loc.Mapping.BuildID
+			case "func1":
+				builds[name] = loc.Mapping.BuildID
+				if !strings.HasSuffix(line.Function.Filename, "simple.c") {
+					t.Errorf("func1 not symbolized with the DWARF information of its module: %q", line.Function.Filename)
+				}
+			}
+		}
+	}
+	want := map[string]string{
+		"inner": moduleHash(loop),
+		"outer": moduleHash(loop),
+		"func1": moduleHash(simple),
+	}
+	for name, hash := range want {
+		if builds[name] != hash {
+			t.Errorf("wrong mapping of %s: want=%s got=%s", name, hash, builds[name])
+		}
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package wzprof
+
+const raceEnabled = false
@@ -0,0 +1,525 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// OpcodeProfiler is the implementation of a profiler recording the number of
+// times each wasm instruction of the hot functions of the guest is executed,
+// which function-level profiles cannot see into: the samples of the profile
+// are the instructions themselves, located at their offsets in the code
+// section and symbolized to the source lines they were compiled from, with an
+// "opcode" label naming the instruction (e.g. "i32.add").
+//
+// The runtime does not expose the execution of instructions, the module must
+// be instrumented with Profiling.CountOpcodes to count the executions of the
+// segments of instructions of the functions, so the profiler works with both
+// the compiler and the interpreter engines. The time spent executing each
+// instruction is not measured: the counts are exact and do not vary between
+// runs, which makes them suitable to compare micro-optimizations of inner
+// loops.
+//
+// The counters live in the instances of the module, the profiler reads them
+// when the calls of the exported functions of the guest return to the host.
+// Executions by calls still in progress when the profile stops are not
+// recorded.
+//
+// The profiler generates samples of one type:
+// - "executions" counts the number of times the instruction was executed.
+type OpcodeProfiler struct {
+	segmentCounter
+}
+
+func newOpcodeProfiler(p *Profiling) *OpcodeProfiler {
+	return &OpcodeProfiler{newSegmentCounter(p)}
+}
+
+// StartProfile begins recording the opcode profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *OpcodeProfiler) StartProfile() bool {
+	return p.startProfile()
+}
+
+// StopProfile stops recording and returns the opcode profile. The method
+// returns nil if recording of the profile wasn't started.
+//
+// All the executions are counted, the values are not scaled by a sample rate.
+func (p *OpcodeProfiler) StopProfile() *profile.Profile {
+	counts, start, defs := p.stopProfile()
+	if counts == nil {
+		return nil
+	}
+
+	b := newSegmentProfile(p.p, p.SampleType(), start)
+	for i, seg := range p.p.countedSegments {
+		def := defs[seg.function]
+		if counts[i] == 0 || def == nil {
+			continue
+		}
+		for _, instr := range seg.instructions {
+			b.prof.Sample = append(b.prof.Sample, &profile.Sample{
+				Location: []*profile.Location{b.location(def, instr.offset)},
+				Value:    []int64{counts[i]},
+				Label:    map[string][]string{"opcode": {instr.opcode}},
+			})
+		}
+	}
+	return b.profile()
+}
+
+// Name returns "opcodes".
+func (p *OpcodeProfiler) Name() string {
+	return "opcodes"
+}
+
+// Desc returns a description of the opcode profiler.
+func (p *OpcodeProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// opcode profiler.
+func (p *OpcodeProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "executions", Unit: "count"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is ignored since the profiler counts all the executions.
+func (p *OpcodeProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("opcode", p.StartProfile, p.StopProfile)
+}
+
+// segmentCounter accumulates the executions of the segments of instructions
+// counted by a module instrumented with Profiling.CountOpcodes. The counters
+// live in the instances of the module, they are read when the calls of the
+// exported functions of the guest return to the host.
+type segmentCounter struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	defs   map[uint32]api.FunctionDefinition
+	counts []int64
+	calls  instanceState[segmentCounters]
+	start  time.Time
+}
+
+// segmentCounters is the state of an instance of the guest: the depth of the
+// calls in progress, and the value of the counters of segments when they were
+// last read.
+type segmentCounters struct {
+	depth int
+	seen  []int64
+}
+
+func newSegmentCounter(p *Profiling) segmentCounter {
+	return segmentCounter{
+		p:    p,
+		defs: make(map[uint32]api.FunctionDefinition),
+	}
+}
+
+func (c *segmentCounter) startProfile() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.counts != nil {
+		return false // already started
+	}
+
+	c.counts = make([]int64, len(c.p.countedSegments))
+	c.start = time.Now()
+	return true
+}
+
+// stopProfile stops recording and returns the executions of each segment, the
+// time the profile started, and the definitions of the functions of the
+// module indexed by their index in the module.
+func (c *segmentCounter) stopProfile() ([]int64, time.Time, map[uint32]api.FunctionDefinition) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts, start := c.counts, c.start
+	c.counts = nil
+	defs := make(map[uint32]api.FunctionDefinition, len(c.defs))
+	for i, def := range c.defs {
+		defs[i] = def
+	}
+	return counts, start, defs
+}
+
+// Count returns the number of segments of instructions currently recorded.
+func (c *segmentCounter) Count() int {
+	c.mutex.Lock()
+	n := 0
+	for _, v := range c.counts {
+		if v != 0 {
+			n++
+		}
+	}
+	c.mutex.Unlock()
+	return n
+}
+
+// NewFunctionListener records the definitions of the functions defined by the
+// module to symbolize the instructions, and returns a function listener
+// reading the counters of the instance when the calls of exported functions
+// return. It returns nil for the other functions, or if the module was not
+// instrumented with Profiling.CountOpcodes.
+func (c *segmentCounter) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if _, _, imported := def.Import(); imported || c.p.countedSegments == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	c.defs[def.Index()] = def
+	c.mutex.Unlock()
+
+	if len(def.ExportNames()) == 0 {
+		return nil
+	}
+	return profilingListener{c.p, segmentListener{c}}
+}
+
+type segmentListener struct{ *segmentCounter }
+
+func (c segmentListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	c.mutex.Lock()
+	c.calls.load(mod).depth++
+	c.mutex.Unlock()
+}
+
+func (c segmentListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := c.calls.load(mod)
+	if s.depth--; s.depth > 0 {
+		return
+	}
+	// Exported functions may be called by the guest itself, the counters
+	// are read once the guest returns to the host.
+	m, ok := mod.(experimental.InternalModule)
+	first := int(c.p.instructionCounter) + 1
+	if !ok || m.NumGlobal() < first+len(c.p.countedSegments) {
+		return
+	}
+	if s.seen == nil {
+		s.seen = make([]int64, len(c.p.countedSegments))
+	}
+	for i := range s.seen {
+		v := int64(m.Global(first + i).Get())
+		if c.counts != nil {
+			c.counts[i] += v - s.seen[i]
+		}
+		s.seen[i] = v
+	}
+}
+
+func (c segmentListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	c.After(ctx, mod, def, nil)
+}
+
+// segmentProfile builds the profiles of the executions of segments, where
+// each location is an instruction of the module.
+type segmentProfile struct {
+	p       *Profiling
+	prof    *profile.Profile
+	mapping *profile.Mapping
+	funcs   map[string]*profile.Function
+	symbols symbolizer
+}
+
+func newSegmentProfile(p *Profiling, sampleType []*profile.ValueType, start time.Time) *segmentProfile {
+	b := &segmentProfile{
+		p: p,
+		prof: &profile.Profile{
+			SampleType:    sampleType,
+			TimeNanos:     start.UnixNano(),
+			DurationNanos: int64(time.Since(start)),
+			Comments:      p.comments,
+		},
+		mapping: p.moduleMapping(),
+		funcs:   make(map[string]*profile.Function),
+		symbols: p.symbols,
+	}
+	b.prof.Mapping = []*profile.Mapping{b.mapping}
+	switch p.lang {
+	case golang, python3, ruby3, javascript:
+		// Frames of those languages are resolved from the memory of the
+		// guest at runtime, their functions are named after the name
+		// section.
+		b.symbols = namesymbolizer{}
+	}
+	return b
+}
+
+// location returns a new location of the instruction of the function at
+// offset in the code section.
+func (b *segmentProfile) location(def api.FunctionDefinition, offset uint64) *profile.Location {
+	call := b.p.symbolizeWith(b.symbols, sizeFunction{def: def, offset: offset}, 1, true)
+	if call.address == 0 {
+		call.address = offset
+	}
+	loc := locationForSymbols(call, b.funcs)
+	loc.ID = uint64(len(b.prof.Location)) + 1
+	loc.Mapping = b.mapping
+	b.prof.Location = append(b.prof.Location, loc)
+	return loc
+}
+
+func (b *segmentProfile) profile() *profile.Profile {
+	b.prof.Function = make([]*profile.Function, len(b.funcs))
+	for _, fn := range b.funcs {
+		b.prof.Function[fn.ID-1] = fn
+	}
+	setMappingFlags(b.mapping, b.prof.Location, b.p.symbolize)
+	return b.prof
+}
+
+// opcodeName returns the name of the instruction b starts with, as written in
+// the text format of wasm.
+func opcodeName(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch op := b[0]; op {
+	case 0xFC, 0xFD, 0xFE:
+		sub, _ := binary.Uvarint(b[1:])
+		if op == 0xFC && sub < uint64(len(miscOpcodeNames)) {
+			return miscOpcodeNames[sub]
+		}
+		return fmt.Sprintf("%#x %d", op, sub)
+	default:
+		if name := opcodeNames[op]; name != "" {
+			return name
+		}
+		return fmt.Sprintf("%#x", op)
+	}
+}
+
+var miscOpcodeNames = [...]string{
+	"i32.trunc_sat_f32_s",
+	"i32.trunc_sat_f32_u",
+	"i32.trunc_sat_f64_s",
+	"i32.trunc_sat_f64_u",
+	"i64.trunc_sat_f32_s",
+	"i64.trunc_sat_f32_u",
+	"i64.trunc_sat_f64_s",
+	"i64.trunc_sat_f64_u",
+	"memory.init",
+	"data.drop",
+	"memory.copy",
+	"memory.fill",
+	"table.init",
+	"elem.drop",
+	"table.copy",
+	"table.grow",
+	"table.size",
+	"table.fill",
+}
+
+var opcodeNames = [256]string{
+	0x00: "unreachable",
+	0x01: "nop",
+	0x02: "block",
+	0x03: "loop",
+	0x04: "if",
+	0x05: "else",
+	0x06: "try",
+	0x07: "catch",
+	0x08: "throw",
+	0x09: "rethrow",
+	0x0B: "end",
+	0x0C: "br",
+	0x0D: "br_if",
+	0x0E: "br_table",
+	0x0F: "return",
+	0x10: "call",
+	0x11: "call_indirect",
+	0x12: "return_call",
+	0x13: "return_call_indirect",
+	0x18: "delegate",
+	0x19: "catch_all",
+	0x1A: "drop",
+	0x1B: "select",
+	0x1C: "select",
+	0x20: "local.get",
+	0x21: "local.set",
+	0x22: "local.tee",
+	0x23: "global.get",
+	0x24: "global.set",
+	0x25: "table.get",
+	0x26: "table.set",
+	0x28: "i32.load",
+	0x29: "i64.load",
+	0x2A: "f32.load",
+	0x2B: "f64.load",
+	0x2C: "i32.load8_s",
+	0x2D: "i32.load8_u",
+	0x2E: "i32.load16_s",
+	0x2F: "i32.load16_u",
+	0x30: "i64.load8_s",
+	0x31: "i64.load8_u",
+	0x32: "i64.load16_s",
+	0x33: "i64.load16_u",
+	0x34: "i64.load32_s",
+	0x35: "i64.load32_u",
+	0x36: "i32.store",
+	0x37: "i64.store",
+	0x38: "f32.store",
+	0x39: "f64.store",
+	0x3A: "i32.store8",
+	0x3B: "i32.store16",
+	0x3C: "i64.store8",
+	0x3D: "i64.store16",
+	0x3E: "i64.store32",
+	0x3F: "memory.size",
+	0x40: "memory.grow",
+	0x41: "i32.const",
+	0x42: "i64.const",
+	0x43: "f32.const",
+	0x44: "f64.const",
+	0x45: "i32.eqz",
+	0x46: "i32.eq",
+	0x47: "i32.ne",
+	0x48: "i32.lt_s",
+	0x49: "i32.lt_u",
+	0x4A: "i32.gt_s",
+	0x4B: "i32.gt_u",
+	0x4C: "i32.le_s",
+	0x4D: "i32.le_u",
+	0x4E: "i32.ge_s",
+	0x4F: "i32.ge_u",
+	0x50: "i64.eqz",
+	0x51: "i64.eq",
+	0x52: "i64.ne",
+	0x53: "i64.lt_s",
+	0x54: "i64.lt_u",
+	0x55: "i64.gt_s",
+	0x56: "i64.gt_u",
+	0x57: "i64.le_s",
+	0x58: "i64.le_u",
+	0x59: "i64.ge_s",
+	0x5A: "i64.ge_u",
+	0x5B: "f32.eq",
+	0x5C: "f32.ne",
+	0x5D: "f32.lt",
+	0x5E: "f32.gt",
+	0x5F: "f32.le",
+	0x60: "f32.ge",
+	0x61: "f64.eq",
+	0x62: "f64.ne",
+	0x63: "f64.lt",
+	0x64: "f64.gt",
+	0x65: "f64.le",
+	0x66: "f64.ge",
+	0x67: "i32.clz",
+	0x68: "i32.ctz",
+	0x69: "i32.popcnt",
+	0x6A: "i32.add",
+	0x6B: "i32.sub",
+	0x6C: "i32.mul",
+	0x6D: "i32.div_s",
+	0x6E: "i32.div_u",
+	0x6F: "i32.rem_s",
+	0x70: "i32.rem_u",
+	0x71: "i32.and",
+	0x72: "i32.or",
+	0x73: "i32.xor",
+	0x74: "i32.shl",
+	0x75: "i32.shr_s",
+	0x76: "i32.shr_u",
+	0x77: "i32.rotl",
+	0x78: "i32.rotr",
+	0x79: "i64.clz",
+	0x7A: "i64.ctz",
+	0x7B: "i64.popcnt",
+	0x7C: "i64.add",
+	0x7D: "i64.sub",
+	0x7E: "i64.mul",
+	0x7F: "i64.div_s",
+	0x80: "i64.div_u",
+	0x81: "i64.rem_s",
+	0x82: "i64.rem_u",
+	0x83: "i64.and",
+	0x84: "i64.or",
+	0x85: "i64.xor",
+	0x86: "i64.shl",
+	0x87: "i64.shr_s",
+	0x88: "i64.shr_u",
+	0x89: "i64.rotl",
+	0x8A: "i64.rotr",
+	0x8B: "f32.abs",
+	0x8C: "f32.neg",
+	0x8D: "f32.ceil",
+	0x8E: "f32.floor",
+	0x8F: "f32.trunc",
+	0x90: "f32.nearest",
+	0x91: "f32.sqrt",
+	0x92: "f32.add",
+	0x93: "f32.sub",
+	0x94: "f32.mul",
+	0x95: "f32.div",
+	0x96: "f32.min",
+	0x97: "f32.max",
+	0x98: "f32.copysign",
+	0x99: "f64.abs",
+	0x9A: "f64.neg",
+	0x9B: "f64.ceil",
+	0x9C: "f64.floor",
+	0x9D: "f64.trunc",
+	0x9E: "f64.nearest",
+	0x9F: "f64.sqrt",
+	0xA0: "f64.add",
+	0xA1: "f64.sub",
+	0xA2: "f64.mul",
+	0xA3: "f64.div",
+	0xA4: "f64.min",
+	0xA5: "f64.max",
+	0xA6: "f64.copysign",
+	0xA7: "i32.wrap_i64",
+	0xA8: "i32.trunc_f32_s",
+	0xA9: "i32.trunc_f32_u",
+	0xAA: "i32.trunc_f64_s",
+	0xAB: "i32.trunc_f64_u",
+	0xAC: "i64.extend_i32_s",
+	0xAD: "i64.extend_i32_u",
+	0xAE: "i64.trunc_f32_s",
+	0xAF: "i64.trunc_f32_u",
+	0xB0: "i64.trunc_f64_s",
+	0xB1: "i64.trunc_f64_u",
+	0xB2: "f32.convert_i32_s",
+	0xB3: "f32.convert_i32_u",
+	0xB4: "f32.convert_i64_s",
+	0xB5: "f32.convert_i64_u",
+	0xB6: "f32.demote_f64",
+	0xB7: "f64.convert_i32_s",
+	0xB8: "f64.convert_i32_u",
+	0xB9: "f64.convert_i64_s",
+	0xBA: "f64.convert_i64_u",
+	0xBB: "f64.promote_f32",
+	0xBC: "i32.reinterpret_f32",
+	0xBD: "i64.reinterpret_f64",
+	0xBE: "f32.reinterpret_i32",
+	0xBF: "f64.reinterpret_i64",
+	0xC0: "i32.extend8_s",
+	0xC1: "i32.extend16_s",
+	0xC2: "i64.extend8_s",
+	0xC3: "i64.extend16_s",
+	0xC4: "i64.extend32_s",
+	0xD0: "ref.null",
+	0xD1: "ref.is_null",
+	0xD2: "ref.func",
+}
@@ -0,0 +1,114 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestOpcodeProfiler(t *testing.T) {
+	p := ProfilingFor(testLoopModule())
+	opcodes := p.OpcodeProfiler()
+
+	instrumented, err := p.CountOpcodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, opcodes)
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := runtime.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opcodes.StartProfile()
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prof := opcodes.StopProfile()
+
+	// The instruction counter is still maintained.
+	const inner, outer = 73, 3
+	if n := instance.(experimental.InternalModule).Global(1).Get(); n != 2*inner+outer {
+		t.Errorf("wrong number of instructions executed: want=%d got=%d", 2*inner+outer, n)
+	}
+
+	executions := make(map[string]int64)
+	addresses := make(map[uint64]bool)
+	for _, sample := range prof.Sample {
+		name := sample.Location[0].Line[0].Function.Name + " " + sample.Label["opcode"][0]
+		executions[name] += sample.Value[0]
+		if addresses[sample.Location[0].Address] {
+			t.Errorf("instruction at %#x found in multiple samples", sample.Location[0].Address)
+		}
+		addresses[sample.Location[0].Address] = true
+	}
+	want := map[string]int64{
+		"outer call":      2,
+		"outer end":       1,
+		"inner loop":      2,
+		"inner local.get": 20,
+		"inner i32.const": 40,
+		"inner i32.add":   20,
+		"inner local.tee": 20,
+		"inner i32.lt_u":  20,
+		"inner br_if":     20,
+		"inner end":       4,
+	}
+	for name, n := range want {
+		if executions[name] != n {
+			t.Errorf("wrong executions of %s: want=%d got=%d", name, n, executions[name])
+		}
+	}
+	if len(executions) != len(want) {
+		t.Errorf("unexpected instructions in the profile: %v", executions)
+	}
+
+	// The counters are read when the calls return, the executions before
+	// the profile started are not recorded.
+	opcodes.StartProfile()
+	if _, err := instance.ExportedFunction("inner").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prof = opcodes.StopProfile()
+	var adds int64
+	for _, sample := range prof.Sample {
+		if sample.Label["opcode"][0] == "i32.add" {
+			adds += sample.Value[0]
+		}
+	}
+	if adds != 10 {
+		t.Errorf("wrong executions of i32.add in the second profile: want=10 got=%d", adds)
+	}
+}
+
+func TestOpcodeName(t *testing.T) {
+	tests := []struct {
+		code string
+		name string
+	}{
+		{"\x6A", "i32.add"},
+		{"\x28\x02\x00", "i32.load"},
+		{"\xC4", "i64.extend32_s"},
+		{"\xFC\x0A\x00\x00", "memory.copy"},
+		{"\xFD\x0C", "0xfd 12"},
+		{"\x27", "0x27"},
+	}
+	for _, test := range tests {
+		if name := opcodeName([]byte(test.code)); name != test.name {
+			t.Errorf("wrong name of %x: want=%q got=%q", test.code, test.name, name)
+		}
+	}
+}
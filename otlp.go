@@ -0,0 +1,349 @@
+package wzprof
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// OTLPExporter is an Exporter pushing profiles to an OpenTelemetry collector
+// using the OTLP profiles signal.
+//
+// The profiles signal is still in development, the exporter implements the
+// opentelemetry.proto.profiles.v1development data model and sends requests
+// to the /v1development/profiles endpoint of OTLP/HTTP, using the JSON
+// encoding.
+type OTLPExporter struct {
+	// URL of the OTLP/HTTP receiver (e.g. http://localhost:4318).
+	URL string
+	// Resource attributes attached to the profiles (e.g. service.name).
+	Attributes map[string]string
+	// HTTP client used to send requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Export implements the Exporter interface.
+func (e *OTLPExporter) Export(ctx context.Context, name string, prof *profile.Profile) error {
+	p := newOTLPProfile(prof)
+	p.AttributeTable = []otlpKeyValue{otlpString("profile.name", name)}
+	p.AttributeIndices = []int32{0}
+
+	resource := otlpResource{}
+	for _, k := range sortedKeys(e.Attributes) {
+		resource.Attributes = append(resource.Attributes, otlpString(k, e.Attributes[k]))
+	}
+
+	body, err := json.Marshal(otlpExportProfilesServiceRequest{
+		ResourceProfiles: []otlpResourceProfiles{{
+			Resource: resource,
+			ScopeProfiles: []otlpScopeProfiles{{
+				Scope:    otlpInstrumentationScope{Name: "wzprof"},
+				Profiles: []*otlpProfile{p},
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(e.URL, "/") + "/v1development/profiles"
+	return postExport(ctx, e.Client, u, "application/json", body)
+}
+
+// OTLPSpanExporter pushes the spans of a SpanRecorder to an OpenTelemetry
+// collector, or any backend accepting the traces signal of OTLP/HTTP with the
+// JSON encoding (e.g. Jaeger, Tempo).
+type OTLPSpanExporter struct {
+	// URL of the OTLP/HTTP receiver (e.g. http://localhost:4318).
+	URL string
+	// Resource attributes attached to the spans (e.g. service.name).
+	Attributes map[string]string
+	// HTTP client used to send requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// ExportSpans sends the spans to the /v1/traces endpoint of the receiver.
+func (e *OTLPSpanExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	resource := otlpResource{}
+	for _, k := range sortedKeys(e.Attributes) {
+		resource.Attributes = append(resource.Attributes, otlpString(k, e.Attributes[k]))
+	}
+
+	list := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: s.TimeNanos,
+			EndTimeUnixNano:   s.TimeNanos + s.DurationNanos,
+			Attributes:        []otlpKeyValue{otlpString("code.function", s.Name)},
+		}
+		if s.ParentSpanID != ([8]byte{}) {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.Error != "" {
+			span.Status = &otlpStatus{Code: otlpStatusCodeError, Message: s.Error}
+		}
+		list[i] = span
+	}
+
+	body, err := json.Marshal(otlpExportTraceServiceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: resource,
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpInstrumentationScope{Name: "wzprof"},
+				Spans: list,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(e.URL, "/") + "/v1/traces"
+	return postExport(ctx, e.Client, u, "application/json", body)
+}
+
+type otlpExportTraceServiceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpInstrumentationScope `json:"scope"`
+	Spans []otlpSpan               `json:"spans"`
+}
+
+// Values of the SpanKind and StatusCode enums of OTLP.
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// otlpSpan is a span of OTLP/JSON, where the ids are encoded in hexadecimal
+// instead of base64.
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int32          `json:"kind"`
+	StartTimeUnixNano int64          `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   int64          `json:"endTimeUnixNano,string"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpExportProfilesServiceRequest struct {
+	ResourceProfiles []otlpResourceProfiles `json:"resourceProfiles"`
+}
+
+type otlpResourceProfiles struct {
+	Resource      otlpResource        `json:"resource"`
+	ScopeProfiles []otlpScopeProfiles `json:"scopeProfiles"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeProfiles struct {
+	Scope    otlpInstrumentationScope `json:"scope"`
+	Profiles []*otlpProfile           `json:"profiles"`
+}
+
+type otlpInstrumentationScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+type otlpProfile struct {
+	SampleType                []otlpValueType `json:"sampleType"`
+	Sample                    []otlpSample    `json:"sample"`
+	MappingTable              []otlpMapping   `json:"mappingTable,omitempty"`
+	LocationTable             []otlpLocation  `json:"locationTable"`
+	LocationIndices           []int32         `json:"locationIndices"`
+	FunctionTable             []otlpFunction  `json:"functionTable"`
+	AttributeTable            []otlpKeyValue  `json:"attributeTable,omitempty"`
+	StringTable               []string        `json:"stringTable"`
+	TimeNanos                 int64           `json:"timeNanos,omitempty"`
+	DurationNanos             int64           `json:"durationNanos,omitempty"`
+	PeriodType                otlpValueType   `json:"periodType"`
+	Period                    int64           `json:"period,omitempty"`
+	DefaultSampleTypeStrindex int32           `json:"defaultSampleTypeStrindex,omitempty"`
+	ProfileID                 string          `json:"profileId"`
+	AttributeIndices          []int32         `json:"attributeIndices,omitempty"`
+}
+
+type otlpValueType struct {
+	TypeStrindex int32 `json:"typeStrindex"`
+	UnitStrindex int32 `json:"unitStrindex"`
+}
+
+type otlpSample struct {
+	LocationsStartIndex int32   `json:"locationsStartIndex"`
+	LocationsLength     int32   `json:"locationsLength"`
+	Value               []int64 `json:"value"`
+}
+
+type otlpMapping struct {
+	MemoryStart      uint64 `json:"memoryStart,omitempty"`
+	MemoryLimit      uint64 `json:"memoryLimit,omitempty"`
+	FileOffset       uint64 `json:"fileOffset,omitempty"`
+	FilenameStrindex int32  `json:"filenameStrindex"`
+	HasFunctions     bool   `json:"hasFunctions,omitempty"`
+	HasFilenames     bool   `json:"hasFilenames,omitempty"`
+	HasLineNumbers   bool   `json:"hasLineNumbers,omitempty"`
+	HasInlineFrames  bool   `json:"hasInlineFrames,omitempty"`
+}
+
+type otlpLocation struct {
+	MappingIndex *int32     `json:"mappingIndex,omitempty"`
+	Address      uint64     `json:"address,omitempty"`
+	Line         []otlpLine `json:"line"`
+}
+
+type otlpLine struct {
+	FunctionIndex int32 `json:"functionIndex"`
+	Line          int64 `json:"line,omitempty"`
+	Column        int64 `json:"column,omitempty"`
+}
+
+type otlpFunction struct {
+	NameStrindex       int32 `json:"nameStrindex"`
+	SystemNameStrindex int32 `json:"systemNameStrindex"`
+	FilenameStrindex   int32 `json:"filenameStrindex"`
+	StartLine          int64 `json:"startLine,omitempty"`
+}
+
+// newOTLPProfile converts a pprof profile to the OTLP profile data model,
+// which is derived from pprof but uses indexes in tables instead of ids, and
+// shares a single array of location indices between all samples.
+func newOTLPProfile(prof *profile.Profile) *otlpProfile {
+	index := map[string]int32{"": 0}
+	p := &otlpProfile{
+		StringTable:   []string{""},
+		TimeNanos:     prof.TimeNanos,
+		DurationNanos: prof.DurationNanos,
+		Period:        prof.Period,
+	}
+
+	str := func(s string) int32 {
+		i, ok := index[s]
+		if !ok {
+			i = int32(len(p.StringTable))
+			index[s] = i
+			p.StringTable = append(p.StringTable, s)
+		}
+		return i
+	}
+	valueType := func(t *profile.ValueType) otlpValueType {
+		if t == nil {
+			return otlpValueType{}
+		}
+		return otlpValueType{TypeStrindex: str(t.Type), UnitStrindex: str(t.Unit)}
+	}
+
+	for _, t := range prof.SampleType {
+		p.SampleType = append(p.SampleType, valueType(t))
+	}
+	p.PeriodType = valueType(prof.PeriodType)
+	if prof.DefaultSampleType != "" {
+		p.DefaultSampleTypeStrindex = str(prof.DefaultSampleType)
+	}
+
+	mappings := make(map[*profile.Mapping]int32, len(prof.Mapping))
+	for i, m := range prof.Mapping {
+		mappings[m] = int32(i)
+		p.MappingTable = append(p.MappingTable, otlpMapping{
+			MemoryStart:      m.Start,
+			MemoryLimit:      m.Limit,
+			FileOffset:       m.Offset,
+			FilenameStrindex: str(m.File),
+			HasFunctions:     m.HasFunctions,
+			HasFilenames:     m.HasFilenames,
+			HasLineNumbers:   m.HasLineNumbers,
+			HasInlineFrames:  m.HasInlineFrames,
+		})
+	}
+
+	functions := make(map[*profile.Function]int32, len(prof.Function))
+	for i, fn := range prof.Function {
+		functions[fn] = int32(i)
+		p.FunctionTable = append(p.FunctionTable, otlpFunction{
+			NameStrindex:       str(fn.Name),
+			SystemNameStrindex: str(fn.SystemName),
+			FilenameStrindex:   str(fn.Filename),
+			StartLine:          fn.StartLine,
+		})
+	}
+
+	locations := make(map[*profile.Location]int32, len(prof.Location))
+	for i, loc := range prof.Location {
+		locations[loc] = int32(i)
+		l := otlpLocation{Address: loc.Address, Line: make([]otlpLine, 0, len(loc.Line))}
+		if loc.Mapping != nil {
+			if i, ok := mappings[loc.Mapping]; ok {
+				l.MappingIndex = &i
+			}
+		}
+		for _, line := range loc.Line {
+			if i, ok := functions[line.Function]; ok {
+				l.Line = append(l.Line, otlpLine{FunctionIndex: i, Line: line.Line})
+			}
+		}
+		p.LocationTable = append(p.LocationTable, l)
+	}
+
+	for _, s := range prof.Sample {
+		start := int32(len(p.LocationIndices))
+		for _, loc := range s.Location {
+			p.LocationIndices = append(p.LocationIndices, locations[loc])
+		}
+		p.Sample = append(p.Sample, otlpSample{
+			LocationsStartIndex: start,
+			LocationsLength:     int32(len(s.Location)),
+			Value:               s.Value,
+		})
+	}
+
+	// Profile IDs are required and must not be all zeroes, they are encoded
+	// in hexadecimal in OTLP/JSON.
+	var id [16]byte
+	rand.Read(id[:])
+	id[0] |= 1
+	p.ProfileID = hex.EncodeToString(id[:])
+	return p
+}
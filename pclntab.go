@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync"
 	"unsafe"
 
 	"github.com/tetratelabs/wazero"
@@ -21,6 +22,7 @@ func binCompiledByGo(b []byte) bool {
 // partialPCHeader is a small fraction of the PCHEader written by the linker.
 // See pclntabHeaderFromData for more details.
 type partialPCHeader struct {
+	magic          uint32
 	address        uint64
 	funcnametabOff uint64
 	cutabOff       uint64
@@ -35,7 +37,8 @@ func (p partialPCHeader) Valid() bool {
 // Data section of a module.
 //
 // Assumes the section is well-formed, and the segment has the layout described
-// in the 1.20.1 linker. Returns nil if the segment is missing. Does not check
+// in the 1.20.1 linker, which is the same since Go 1.18 apart from the magic
+// number. Returns nil if the segment is missing. Does not check
 // whether pclntab contains actual useful data.
 //
 // The goal is to retrieve enough of the pclntab header to compute a needle for
@@ -54,6 +57,11 @@ func pclntabHeaderFromData(b []byte) partialPCHeader {
 		0x08, // PtrSize
 	}
 	pclntabOffset := bytes.Index(b, needle)
+	if pclntabOffset == -1 {
+		// Go 1.18 and 1.19 use a different magic number.
+		binary.LittleEndian.PutUint32(needle, go118magic)
+		pclntabOffset = bytes.Index(b, needle)
+	}
 	if pclntabOffset == -1 {
 		return partialPCHeader{}
 	}
@@ -92,6 +100,7 @@ func pclntabHeaderFromData(b []byte) partialPCHeader {
 	filetabOff := readWord(5)
 
 	return partialPCHeader{
+		magic:          binary.LittleEndian.Uint32(magic),
 		address:        uint64(vaddr),
 		funcnametabOff: funcnametabOff,
 		cutabOff:       cutabOff,
@@ -170,6 +179,10 @@ func preparePclntabSymbolizer(wasmbin []byte, mod wazero.CompiledModule) (*pclnt
 	if !pch.Valid() {
 		return nil, fmt.Errorf("could not find pclnheader in data section")
 	}
+	version := goModuleVersion(wasmbin)
+	if version < minGoVersion {
+		return nil, fmt.Errorf("unsupported Go version: go1.%d (go1.%d or later is required)", version, minGoVersion)
+	}
 	mdaddr := moduledataAddrFromData(pch, data)
 	if mdaddr == 0 {
 		return nil, fmt.Errorf("could not find moduledata in data section")
@@ -178,6 +191,8 @@ func preparePclntabSymbolizer(wasmbin []byte, mod wazero.CompiledModule) (*pclnt
 		imported: uint64(len(mod.ImportedFunctions())),
 		modName:  mod.Name(),
 		datap:    ptr64(mdaddr),
+		version:  version,
+		bodies:   wasmFunctionBodies(wasmbin),
 	}, nil
 }
 
@@ -232,6 +247,8 @@ type funcInfo struct {
 	md *moduledata
 	// offset in pclntab of the start of the _func.
 	_funcoff pclntabOff
+	// size of the _func in pclntab, which depends on the Go version.
+	_funcsize pclntabOff
 }
 
 func (f funcInfo) srcFunc() srcFunc {
@@ -241,6 +258,13 @@ func (f funcInfo) srcFunc() srcFunc {
 	return srcFunc{f.md, f.NameOff, f.StartLine, f.FuncID}
 }
 
+func (s srcFunc) name() string {
+	if s.datap == nil {
+		return ""
+	}
+	return s.datap.funcName(s.nameOff)
+}
+
 func (f funcInfo) valid() bool {
 	return f._func != nil
 }
@@ -315,13 +339,13 @@ func pcdatavalue1(f funcInfo, table uint32, targetpc ptr64) int32 {
 }
 
 func pcdatastart(f funcInfo, table uint32) uint32 {
-	off := f._funcoff + pclntabOff(unsafe.Sizeof(_func{})) + pclntabOff(table)*4
+	off := f._funcoff + f._funcsize + pclntabOff(table)*4
 	return *(*uint32)(unsafe.Pointer(unsafe.SliceData(f.md.pclntable[off:])))
 }
 
 // Returns the offset from moduledata.gofunc for the i-th funcdata of f.
 func funcdataoffset(f funcInfo, index uint8) uint32 {
-	off := f._funcoff + pclntabOff(unsafe.Sizeof(_func{})) + pclntabOff(f.Npcdata)*4 + pclntabOff(index)*4
+	off := f._funcoff + f._funcsize + pclntabOff(f.Npcdata)*4 + pclntabOff(index)*4
 	return *(*uint32)(unsafe.Pointer(unsafe.SliceData(f.md.pclntable[off:])))
 }
 
@@ -333,8 +357,9 @@ func funcdataoffset(f funcInfo, index uint8) uint32 {
 // at runtime. Then it is lazily initialized from the module memory on its first
 // symbol resolution.
 //
-// Once memory is step, it is expected to stay the same throughout the lifetime
-// of this pclntab.
+// The tables are copied out of the memory, which is only read again through
+// the memory of the instance whose stack is walked. Instances of the module can
+// share the same pclntab and run concurrently.
 type pclntab struct {
 	// Number of functions imported by the module.
 	imported uint64
@@ -343,23 +368,38 @@ type pclntab struct {
 	// Virtual address of the firstmoduledata structure. Named like this for
 	// similarity with the Go implementation.
 	datap ptr64
+	// Version of Go which compiled the module, determining the layout of
+	// the runtime data structures.
+	version goVersion
+	// Bodies of the functions in the code section, the locations of Go
+	// frames are at the start of the body of their function.
+	bodies []wasmFunctionBody
+
+	// The tables are loaded from the memory of the first instance of the
+	// module. They are static data, which is the same in all instances.
+	ready       sync.Once
+	md          moduledata
+	findfunctab []findfuncbucket
 
-	mem vmem
-	md  moduledata
+	// Functions returned by stack iterators, by program counter. They are
+	// retained in stack traces, caching them avoids allocating on each call.
+	funcsMutex sync.RWMutex
+	funcs      map[ptr64]*goFunction
 }
 
 // EnsureReady loads up from memory the necessary contents of moduledata, and
 // pclntab to be able to perform symbolization and provide enough information
-// about functions to walk the stack. Just once.
+// about functions to walk the stack. Just once, from the memory of the first
+// instance of the module, the method is safe to call concurrently.
 func (p *pclntab) EnsureReady(mem vmem) {
-	if p.mem != nil {
-		if p.mem != mem {
-			panic("different memory used for pclntab")
+	p.ready.Do(func() {
+		p.md = derefModuledata(mem, p.datap, p.version)
+		n := (p.md.maxpc-p.md.minpc)/pcbucketsize + 1
+		p.findfunctab = make([]findfuncbucket, n)
+		for i := range p.findfunctab {
+			p.findfunctab[i] = derefArrayIndex[findfuncbucket](mem, p.md.findfunctab, int32(i))
 		}
-		return
-	}
-	p.mem = mem
-	p.md = derefModuledata(mem, p.datap)
+	})
 }
 
 // FindFunc searches the pclntab to build the FuncInfo that contains the
@@ -372,11 +412,6 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 		return funcInfo{}
 	}
 
-	// https://github.com/golang/go/blob/f90b4cd6554f4f20280aa5229cf42650ed47221d/src/runtime/symtab.go#L514
-	const nsub = 16
-	const minfunc = 16                 // minimum function size
-	const pcbucketsize = 256 * minfunc // size of bucket in the pc->func lookup table
-
 	pcOff, ok := p.md.textOff(pc)
 	if !ok {
 		return funcInfo{}
@@ -386,7 +421,7 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 	b := x / pcbucketsize
 	i := x % pcbucketsize / (pcbucketsize / nsub)
 
-	ffb := deref[findfuncbucket](p.mem, p.md.findfunctab+b*ptr64(unsafe.Sizeof(findfuncbucket{})))
+	ffb := p.findfunctab[b]
 
 	idx := ffb.idx + uint32(ffb.subbuckets[i])
 
@@ -396,9 +431,9 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 	}
 
 	funcoff := p.md.ftab[idx].funcoff
-	_f := (*_func)(unsafe.Pointer(unsafe.SliceData(p.md.pclntable[funcoff:])))
+	_f := p.version.readFunc(p.md.pclntable[funcoff:])
 
-	return funcInfo{_func: _f, md: &p.md, _funcoff: pclntabOff(funcoff)}
+	return funcInfo{_func: _f, md: &p.md, _funcoff: pclntabOff(funcoff), _funcsize: p.version.funcSize()}
 }
 
 // Locations perform the symolization of a physical pc belongging to a provided
@@ -406,7 +441,7 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 func (p *pclntab) Locations(gofunc experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
 	// Assumption that pclntabmapper is only used in conjuction with
 	// goStackIterator.
-	f := gofunc.(goFunction)
+	f := gofunc.(*goFunction)
 
 	locs := []location{}
 
@@ -426,11 +461,16 @@ func (p *pclntab) Locations(gofunc experimental.InternalFunction, pc experimenta
 		if !fn.valid() {
 			continue
 		}
+		// Inlined frames are named after the function inlined, like in the
+		// tracebacks of the Go runtime.
+		name := sf.name()
 		locs = append(locs, location{
 			File:       file,
 			Line:       int64(line),
-			StableName: fn.name(),
-			HumanName:  fn.name(),
+			Inlined:    uf.index >= 0,
+			StableName: name,
+			HumanName:  name,
+			StartLine:  int64(sf.startLine),
 		})
 	}
 
@@ -439,7 +479,18 @@ func (p *pclntab) Locations(gofunc experimental.InternalFunction, pc experimenta
 		locs[i], locs[j] = locs[j], locs[i]
 	}
 
-	return uint64(pc), locs
+	return p.bodyOffset(p.PCToFID(ptr64(pc))), locs
+}
+
+// bodyOffset returns the offset in the code section of the body of a function.
+// The program counters of Go are the indexes of the resume points of the
+// functions, which do not tell the offsets of the calls in the body.
+func (p *pclntab) bodyOffset(f fid) uint64 {
+	i := uint64(f) - p.imported
+	if i >= uint64(len(p.bodies)) {
+		return 0
+	}
+	return p.bodies[i].offset
 }
 
 // symPC returns the PC that should be used for symbolizing the current frame.
@@ -509,6 +560,9 @@ type gptr ptr64
 // 8,    10,    sched.ctxt
 // 8,    11,    sched.ret
 // 8,    12,    sched.lr
+// 8,    13,    sched.bp
+// 8,    14,    syscallsp
+// 8,    15,    syscallpc
 // more fields that we don't care about
 
 // Layout of M struct:
@@ -553,6 +607,14 @@ func gSchedLr(m vmem, g gptr) ptr64 {
 	return deref[ptr64](m, ptr64(g)+8*12)
 }
 
+func gSyscallSp(m vmem, g gptr) ptr64 {
+	return deref[ptr64](m, ptr64(g)+8*14)
+}
+
+func gSyscallPc(m vmem, g gptr) ptr64 {
+	return deref[ptr64](m, ptr64(g)+8*15)
+}
+
 // goStackIterator iterates over the physical frames of the Go stack. It is up
 // to the symbolizer (pclntabmapper) to expand those into logical frames to
 // account for inlining.
@@ -563,6 +625,22 @@ type goStackIterator struct {
 	unwinder
 }
 
+var goStackIterators = sync.Pool{
+	New: func() any { return new(goStackIterator) },
+}
+
+func newGoStackIterator(symbols *pclntab, mem vmem) *goStackIterator {
+	s := goStackIterators.Get().(*goStackIterator)
+	s.pclntab = symbols
+	s.unwinder = unwinder{mem: mem, symbols: symbols}
+	return s
+}
+
+func (s *goStackIterator) release() {
+	*s = goStackIterator{}
+	goStackIterators.Put(s)
+}
+
 func (s *goStackIterator) Next() bool {
 	if !s.valid() {
 		return false
@@ -587,12 +665,7 @@ func (s *goStackIterator) ProgramCounter() experimental.ProgramCounter {
 }
 
 func (s *goStackIterator) Function() experimental.InternalFunction {
-	return goFunction{
-		mem:  s.mem,
-		sym:  s.symbols,
-		info: s.frame.fn,
-		pc:   s.frame.pc,
-	}
+	return s.symbols.function(s.mem, s.frame.fn, s.frame.pc)
 }
 
 func (s *goStackIterator) Parameters() []uint64 {
@@ -609,6 +682,27 @@ func elideWrapperCalling(id goruntime.FuncID) bool {
 	return !(id == goruntime.FuncID_gopanic || id == goruntime.FuncID_sigpanic || id == goruntime.FuncID_panicwrap)
 }
 
+// function returns the function at pc, which is created on first use.
+func (p *pclntab) function(mem vmem, info funcInfo, pc ptr64) *goFunction {
+	p.funcsMutex.RLock()
+	f := p.funcs[pc]
+	p.funcsMutex.RUnlock()
+	if f != nil {
+		return f
+	}
+
+	p.funcsMutex.Lock()
+	defer p.funcsMutex.Unlock()
+	if f = p.funcs[pc]; f == nil {
+		if p.funcs == nil {
+			p.funcs = make(map[ptr64]*goFunction)
+		}
+		f = &goFunction{mem: mem, sym: p, info: info, pc: pc}
+		p.funcs[pc] = f
+	}
+	return f
+}
+
 // goFunction is a lazy implementation of wazero's FunctionDefinition and
 // InternalFunction, as the goStackIterator cannot map to an internal *function
 // in wazero.
@@ -621,56 +715,56 @@ type goFunction struct {
 	api.FunctionDefinition // required for WazeroOnly
 }
 
-func (f goFunction) Definition() api.FunctionDefinition {
+func (f *goFunction) Definition() api.FunctionDefinition {
 	return f
 }
 
-func (f goFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+func (f *goFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
 	panic("does not make sense")
 }
 
-func (f goFunction) ModuleName() string {
+func (f *goFunction) ModuleName() string {
 	return f.sym.modName
 }
 
-func (f goFunction) Index() uint32 {
+func (f *goFunction) Index() uint32 {
 	return uint32(f.sym.PCToFID(f.pc))
 }
 
-func (f goFunction) Import() (string, string, bool) {
+func (f *goFunction) Import() (string, string, bool) {
 	panic("implement me")
 }
 
-func (f goFunction) ExportNames() []string {
-	panic("implement me")
+func (f *goFunction) ExportNames() []string {
+	return nil
 }
 
-func (f goFunction) Name() string {
+func (f *goFunction) Name() string {
 	return f.sym.PCToName(f.pc)
 }
 
-func (f goFunction) DebugName() string {
+func (f *goFunction) DebugName() string {
 	panic("implement me")
 }
 
-func (f goFunction) GoFunction() interface{} {
+func (f *goFunction) GoFunction() interface{} {
 	// This is never a host function
 	return nil
 }
 
-func (f goFunction) ParamTypes() []api.ValueType {
+func (f *goFunction) ParamTypes() []api.ValueType {
 	panic("implement me")
 }
 
-func (f goFunction) ParamNames() []string {
+func (f *goFunction) ParamNames() []string {
 	panic("implement me")
 }
 
-func (f goFunction) ResultTypes() []api.ValueType {
+func (f *goFunction) ResultTypes() []api.ValueType {
 	panic("implement me")
 }
 
-func (f goFunction) ResultNames() []string {
+func (f *goFunction) ResultNames() []string {
 	panic("implement me")
 }
 
@@ -694,6 +788,13 @@ type textsect struct {
 // function index. Then scan the functab array starting at that
 // index to find the target function.
 // This table uses 20 bytes for every 4096 bytes of code, or ~0.5% overhead.
+// https://github.com/golang/go/blob/f90b4cd6554f4f20280aa5229cf42650ed47221d/src/runtime/symtab.go#L514
+const (
+	nsub         = 16
+	minfunc      = 16            // minimum function size
+	pcbucketsize = 256 * minfunc // size of bucket in the pc->func lookup table
+)
+
 type findfuncbucket struct {
 	idx        uint32
 	subbuckets [16]byte
@@ -802,8 +903,8 @@ func (md moduledata) textAddr(off32 uint32) ptr64 {
 }
 
 // Retrieve module data from memory, including slices.
-func derefModuledata(mem vmem, addr ptr64) moduledata {
-	m := deref[moduledata](mem, addr)
+func derefModuledata(mem vmem, addr ptr64, version goVersion) moduledata {
+	m := version.readModuledata(mem, addr)
 	m.funcnametab = derefGoSlice(mem, m.funcnametab)
 	m.cutab = derefGoSlice(mem, m.cutab)
 	m.filetab = derefGoSlice(mem, m.filetab)
@@ -0,0 +1,54 @@
+package wzprof
+
+import (
+	"fmt"
+
+	"github.com/google/pprof/profile"
+)
+
+// GoPGOProfile returns a copy of a CPU profile of a Go program shaped for the
+// profile guided optimizations of the Go compiler (go build -pgo), so Go
+// programs compiled to wasm can be rebuilt with the profiles of their
+// execution in wzprof.
+//
+// The Go compiler weighs the edges of the call graph of the program with the
+// first sample type of the profile which is either "samples" or "cpu". The
+// "samples" of the CPU profiles of wzprof count the calls of the functions
+// instead of the ticks of the CPU profiles of Go, the profile returned only
+// has the "cpu" sample type so the weights are the time spent under each call
+// like with the profiles of Go. Samples without CPU time are removed.
+//
+// The names of the functions are the ones of the symbol table of the Go
+// program, including the functions inlined, and the lines of the calls are
+// relative to the start line of the functions, which is what the compiler
+// matches the call sites of the profile with.
+//
+// An error is returned if the profile has no "cpu" sample type.
+func GoPGOProfile(prof *profile.Profile) (*profile.Profile, error) {
+	index := -1
+	for i, t := range prof.SampleType {
+		if t.Type == "cpu" && t.Unit == "nanoseconds" {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("profile has no cpu sample type")
+	}
+
+	pgo := prof.Copy()
+	pgo.SampleType = []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}
+	pgo.DefaultSampleType = ""
+	pgo.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+	if pgo.Period == 0 {
+		pgo.Period = 1
+	}
+	samples := pgo.Sample[:0]
+	for _, s := range pgo.Sample {
+		if v := s.Value[index]; v > 0 {
+			s.Value = []int64{v}
+			samples = append(samples, s)
+		}
+	}
+	pgo.Sample = samples
+	return pgo.Compact(), nil
+}
@@ -0,0 +1,59 @@
+package wzprof
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestGoPGOProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main.main", SystemName: "main.main", StartLine: 21}
+	alloc := &profile.Function{ID: 2, Name: "main.alloc", SystemName: "main.alloc", StartLine: 4}
+	idle := &profile.Function{ID: 3, Name: "main.idle", SystemName: "main.idle", StartLine: 10}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: main, Line: 23}}}
+	leaf := &profile.Location{ID: 2, Line: []profile.Line{{Function: alloc, Line: 5}}}
+	unused := &profile.Location{ID: 3, Line: []profile.Line{{Function: idle, Line: 11}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, root}, Value: []int64{100, 2000}},
+			{Location: []*profile.Location{root}, Value: []int64{1, 5000}},
+			{Location: []*profile.Location{unused, root}, Value: []int64{3, 0}},
+		},
+		Location: []*profile.Location{root, leaf, unused},
+		Function: []*profile.Function{main, alloc, idle},
+	}
+
+	pgo, err := GoPGOProfile(prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pgo.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pgo.SampleType) != 1 || pgo.SampleType[0].Type != "cpu" || pgo.PeriodType.Type != "cpu" {
+		t.Errorf("wrong sample types: %v (period %v)", pgo.SampleType, pgo.PeriodType)
+	}
+	if len(pgo.Sample) != 2 || pgo.Sample[0].Value[0] != 2000 || pgo.Sample[1].Value[0] != 5000 {
+		t.Errorf("wrong samples: %v", pgo.Sample)
+	}
+	for _, fn := range pgo.Function {
+		if fn.Name == "main.idle" {
+			t.Error("function without cpu time in the profile")
+		}
+	}
+	// The original profile is not modified.
+	if len(prof.SampleType) != 2 || len(prof.Sample) != 3 {
+		t.Error("original profile modified")
+	}
+
+	prof.SampleType = []*profile.ValueType{{Type: "alloc_objects", Unit: "count"}, {Type: "alloc_space", Unit: "bytes"}}
+	if _, err := GoPGOProfile(prof); err == nil {
+		t.Error("expected an error for a profile without cpu sample type")
+	}
+}
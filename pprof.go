@@ -1,6 +1,7 @@
 package wzprof
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"html"
@@ -10,7 +11,9 @@ import (
 	"net/url"
 	"runtime/pprof"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/pprof/profile"
 )
@@ -63,6 +66,46 @@ func serveError(w http.ResponseWriter, status int, txt string) {
 	fmt.Fprintln(w, txt)
 }
 
+// newDurationHandler returns a http handler recording a profile for the number
+// of seconds of the request (30 by default), like the CPU profile handler of
+// net/http/pprof. The start and stop functions start the recording and return
+// the profile; the name of the profiler is reported when it is already
+// recording.
+func newDurationHandler(name string, start func() bool, stop func() *profile.Profile) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		duration := 30 * time.Second
+
+		if seconds := r.FormValue("seconds"); seconds != "" {
+			n, err := strconv.ParseInt(seconds, 10, 64)
+			if err == nil && n > 0 {
+				duration = time.Duration(n) * time.Second
+			}
+		}
+
+		ctx := r.Context()
+		deadline, ok := ctx.Deadline()
+		if ok {
+			if timeout := time.Until(deadline); duration > timeout {
+				serveError(w, http.StatusBadRequest, "profile duration exceeds server's WriteTimeout")
+				return
+			}
+		}
+
+		if !start() {
+			serveError(w, http.StatusInternalServerError, "Could not enable "+name+" profiling: profiler already running")
+			return
+		}
+
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		serveProfile(w, stop())
+	})
+}
+
 type profileEntry struct {
 	Name    string
 	Href    string
@@ -85,6 +128,18 @@ func sortProfiles(entries []profileEntry) {
 // Handler responds to a request for "/debug/pprof/" with an HTML page listing
 // the available profiles.
 func Handler(sampleRate float64, profilers ...Profiler) http.Handler {
+	return newHandler(nil, nil, sampleRate, profilers)
+}
+
+// Handler is like the package-level Handler function, and additionally serves
+// the command line of the guest program on "/debug/pprof/cmdline", and the
+// names of functions at addresses found in the guest profiles on
+// "/debug/pprof/symbol".
+func (p *Profiling) Handler(sampleRate float64, args []string, profilers ...Profiler) http.Handler {
+	return newHandler(p, args, sampleRate, profilers)
+}
+
+func newHandler(prof *Profiling, args []string, sampleRate float64, profilers []Profiler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var guest, host []profileEntry
 
@@ -96,6 +151,31 @@ func Handler(sampleRate float64, profilers ...Profiler) http.Handler {
 				Count:   p.Count(),
 				Handler: p.NewHandler(sampleRate),
 			})
+
+			// The heap profile of Go is the same as the allocs profile,
+			// except that it shows the memory in use by default.
+			if m, ok := p.(*MemoryProfiler); ok {
+				guest = append(guest, profileEntry{
+					Name:    "heap",
+					Href:    "heap",
+					Desc:    "A sampling of memory allocations of the guest. Shows the memory in use by default when it is tracked. You can specify the seconds GET parameter to get the allocations made during that time.",
+					Count:   m.Count(),
+					Handler: m.newHandler(sampleRate, m.heapSampleType()),
+				})
+			}
+		}
+
+		if prof != nil {
+			guest = append(guest, profileEntry{
+				Name: "cmdline",
+				Href: "cmdline",
+				Desc: "The command line invocation of the guest program",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					io.WriteString(w, strings.Join(args, "\x00"))
+				}),
+			})
 		}
 
 		// Add host profiling debug entries.
@@ -146,6 +226,10 @@ func Handler(sampleRate float64, profilers ...Profiler) http.Handler {
 		if href, found := strings.CutPrefix(r.URL.Path, "/debug/pprof/"); found {
 			var entries []profileEntry
 			_, queryHost := r.URL.Query()["host"]
+			if href == "symbol" && prof != nil && !queryHost {
+				serveSymbols(w, r, prof)
+				return
+			}
 			if queryHost {
 				entries = host
 			} else {
@@ -172,6 +256,48 @@ func Handler(sampleRate float64, profilers ...Profiler) http.Handler {
 	})
 }
 
+// serveSymbols implements the symbol lookup protocol of pprof for addresses
+// of the guest profiles. Addresses are read from the request body for POST
+// requests, and from the query string otherwise, separated by '+'.
+func serveSymbols(w http.ResponseWriter, r *http.Request, p *Profiling) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+
+	// The number of symbols is only used by pprof to determine whether the
+	// lookup is supported, its value does not matter.
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "num_symbols: 1\n")
+
+	var b *bufio.Reader
+	if r.Method == http.MethodPost {
+		b = bufio.NewReader(r.Body)
+	} else {
+		b = bufio.NewReader(strings.NewReader(r.URL.RawQuery))
+	}
+
+	for {
+		word, err := b.ReadSlice('+')
+		if err == nil {
+			word = word[:len(word)-1] // trim +
+		}
+		addr, _ := strconv.ParseUint(string(word), 0, 64)
+		if addr != 0 {
+			if name, ok := p.lookupSymbol(addr); ok {
+				fmt.Fprintf(&buf, "%#x %s\n", addr, name)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(&buf, "reading request: %v\n", err)
+			}
+			break
+		}
+	}
+
+	w.Write(buf.Bytes())
+}
+
 func indexTmplExecute(w io.Writer, guest, host []profileEntry) error {
 	var b bytes.Buffer
 	b.WriteString(`<html>
@@ -248,11 +374,21 @@ Types of profiles available:
 var profileDescriptions = map[string]string{
 	"allocs":       "A sampling of all past memory allocations",
 	"block":        "Stack traces that led to blocking on synchronization primitives",
+	"branches":     "Executions of the basic blocks of the hot functions of the guest, and number of times their conditional branches were taken. The module must be instrumented to count the executions. You can specify the duration in the seconds GET parameter.",
 	"cmdline":      "The command line invocation of the current program",
+	"flight":       "CPU profile of the last seconds of execution, retained by the flight recorder. Each request dumps the profile without stopping the recorder.",
+	"gc":           "Garbage collection cycles and pause time of Go programs, attributed to the stacks which started the cycles. You can specify the duration in the seconds GET parameter.",
 	"goroutine":    "Stack traces of all current goroutines. Use debug=2 as a query parameter to export in the same format as an unrecovered panic.",
+	"grow":         "Growth of the linear memory of the guest, attributed to the stacks which grew it. You can specify the duration in the seconds GET parameter.",
 	"heap":         "A sampling of memory allocations of live objects. You can specify the gc GET parameter to run GC before taking the heap sample.",
+	"instructions": "Number of wasm instructions executed by the guest, attributed to the functions executing them. The module must be instrumented to count instructions. You can specify the duration in the seconds GET parameter.",
+	"io":           "I/O operations performed on file descriptors, with the number of bytes transferred and the time spent.",
 	"mutex":        "Stack traces of holders of contended mutexes",
+	"opcodes":      "Number of times each wasm instruction of the hot functions of the guest was executed, labeled with its opcode. The module must be instrumented to count the executions. You can specify the duration in the seconds GET parameter.",
 	"profile":      "CPU profile. You can specify the duration in the seconds GET parameter. After you get the profile file, use the go tool pprof command to investigate the profile.",
+	"stack":        "Maximum size of the stack of the guest in its linear memory, by call path. You can specify the duration in the seconds GET parameter.",
+	"syscalls":     "Latency of calls to host functions imported by the guest. You can specify the duration in the seconds GET parameter.",
 	"threadcreate": "Stack traces that led to the creation of new OS threads",
 	"trace":        "A trace of execution of the current program. You can specify the duration in the seconds GET parameter. After you get the trace file, use the go tool trace command to investigate the trace.",
+	"wall":         "Wall-clock samples of the guest stack taken at a fixed interval. You can specify the duration in the seconds GET parameter.",
 }
@@ -0,0 +1,35 @@
+package wzprof
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerGuestEndpoints(t *testing.T) {
+	p := ProfilingFor(nil)
+	p.addSymbol(0x10, "main")
+	h := p.Handler(1, []string{"app.wasm", "-v"})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   string
+	}{
+		{"GET", "/debug/pprof/cmdline", "", "app.wasm\x00-v"},
+		{"GET", "/debug/pprof/symbol", "", "num_symbols: 1\n"},
+		{"GET", "/debug/pprof/symbol?0x10", "", "num_symbols: 1\n0x10 main\n"},
+		{"POST", "/debug/pprof/symbol", "0x10+0x20", "num_symbols: 1\n0x10 main\n"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		b, _ := io.ReadAll(w.Result().Body)
+		if string(b) != test.want {
+			t.Errorf("%s %s: want=%q got=%q", test.method, test.path, test.want, b)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package wzprof
 
 import (
+	"bytes"
 	"debug/dwarf"
 	"encoding/binary"
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/tetratelabs/wazero"
@@ -16,22 +20,47 @@ import (
 const (
 	runtimeAddrName = "_PyRuntime"
 	versionAddrName = "Py_Version"
+	tstateAddrName  = "_Py_tss_tstate"
 )
 
-func supportedPython(wasmbin []byte) bool {
+// pythonVersion returns the minor version of the CPython 3 interpreter compiled
+// in the module, or zero if the module is not CPython.
+//
+// The version is read from the Py_Version variable when the module has debug
+// symbols for it (Python 3.11 and later), otherwise from the PY_VERSION string
+// found in the data section.
+func pythonVersion(wasmbin []byte) uint32 {
+	if v := pythonVersionFromSymbol(wasmbin); v != 0 {
+		return v
+	}
+	if !binIsCPython(wasmbin) {
+		return 0
+	}
+	return pythonVersionFromData(wasmbin)
+}
+
+// Try to detect if the module is a CPython interpreter by looking for the
+// function evaluating frames in the name section (names are prefixed by their
+// length).
+func binIsCPython(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("\x18_PyEval_EvalFrameDefault"))
+}
+
+func pythonVersionFromSymbol(wasmbin []byte) uint32 {
 	p, err := newDwarfParserFromBin(wasmbin)
 	if err != nil {
-		return false
+		return 0
 	}
 
 	versionAddr := pythonAddress(p, versionAddrName)
 	if versionAddr == 0 {
-		return false
+		return 0
 	}
 
 	data := wasmdataSection(wasmbin)
 	if data == nil {
-		return false
+		return 0
 	}
 
 	var versionhex uint32
@@ -55,20 +84,72 @@ func supportedPython(wasmbin []byte) bool {
 	// see cpython patchlevel.h
 	major := (versionhex >> 24) & 0xFF
 	minor := (versionhex >> 16) & 0xFF
-	return major == 3 && minor == 11
+	if major != 3 {
+		return 0
+	}
+	return minor
 }
 
-func preparePython(mod wazero.CompiledModule) (*python, error) {
+// Matches the PY_VERSION string of patchlevel.h, e.g. "3.10.4" or "3.12.0rc1".
+var pyVersionRegexp = regexp.MustCompile(`\x003\.(\d+)\.\d+(?:(?:a|b|rc)\d+)?\+?\x00`)
+
+// pythonVersionFromData looks for the PY_VERSION string in the data section of
+// the module. Libraries linked in the interpreter may have version strings of
+// the same shape (e.g. SQLite 3.x), the lowest minor version is selected since
+// theirs are much higher than the ones of CPython.
+func pythonVersionFromData(wasmbin []byte) uint32 {
+	data := wasmdataSection(wasmbin)
+	if data == nil {
+		return 0
+	}
+	version := uint32(0)
+	for _, m := range pyVersionRegexp.FindAllSubmatch(data, -1) {
+		minor, err := strconv.ParseUint(string(m[1]), 10, 32)
+		if err != nil {
+			continue
+		}
+		if version == 0 || uint32(minor) < version {
+			version = uint32(minor)
+		}
+	}
+	return version
+}
+
+// pythonLayout returns the layout of the CPython structures for a minor version
+// of Python 3, or an error if the version is not supported.
+func pythonLayout(minor uint32) (*pyLayout, error) {
+	layout := pyLayouts[minor]
+	if layout == nil {
+		return nil, fmt.Errorf("unsupported CPython version 3.%d (supported versions are 3.11 to 3.13)", minor)
+	}
+	return layout, nil
+}
+
+func preparePython(mod wazero.CompiledModule, layout *pyLayout) (*python, error) {
 	p, err := newDwarfparser(mod)
 	if err != nil {
 		return nil, fmt.Errorf("could not build dwarf parser: %w", err)
 	}
-	runtimeAddr := pythonAddress(p, runtimeAddrName)
-	if runtimeAddr == 0 {
-		return nil, fmt.Errorf("could not find python runtime address")
+	// Python 3.11 keeps the current thread state in _PyRuntime, later
+	// versions in a thread local variable.
+	name := runtimeAddrName
+	if layout.tstateInRuntime == 0 {
+		name = tstateAddrName
+	}
+	addr := pythonAddress(p, name)
+	if addr == 0 {
+		return nil, fmt.Errorf("could not find python thread state address (%s)", name)
+	}
+	// The native frames of the interpreter and C extensions are symbolized
+	// with DWARF, the parser above has already been consumed.
+	p, err = newDwarfparser(mod)
+	if err != nil {
+		return nil, fmt.Errorf("could not build dwarf parser: %w", err)
 	}
 	return &python{
-		pyrtaddr: ptr32(runtimeAddr),
+		layout:     layout,
+		tstateaddr: ptr32(addr + layout.tstateInRuntime),
+		symbols:    buildDwarfSymbolizer(p),
 	}, nil
 }
 
@@ -91,7 +172,9 @@ func pythonAddress(p dwarfparser, name string) uint32 {
 }
 
 type python struct {
-	pyrtaddr ptr32
+	layout     *pyLayout
+	tstateaddr ptr32 // PyThreadState**
+	symbols    symbolizer
 }
 
 func getDwarfLocationAddress(ent *dwarf.Entry) uint32 {
@@ -104,43 +187,108 @@ func getDwarfLocationAddress(ent *dwarf.Entry) uint32 {
 	}
 	const DW_OP_addr = 0x3
 	loc := f.Val.([]byte)
-	if len(loc) == 0 || loc[0] != DW_OP_addr {
-		panic(fmt.Errorf("unexpected address format: %X", loc))
+	if len(loc) < 5 || loc[0] != DW_OP_addr {
+		// Other expressions, like the ones of thread local variables,
+		// are not supported.
+		return 0
 	}
 	return binary.LittleEndian.Uint32(loc[1:])
 }
 
-// Padding of fields in various CPython structs. They are calculated
-// by writing a function in any CPython module, and executing it with
-// wazero.
+// pyLayout holds the offsets of the fields of the CPython structs read by
+// wzprof, which change between minor versions of Python. They are calculated
+// by writing a function in any CPython module, and executing it with wazero.
 //
 // TODO: look into using CGO and #import<Python.h> to generate them
 // instead.
-const (
-	// _PyRuntimeState.
-	padTstateCurrentInRT = 360
-	// PyThreadState.
-	padCframeInThreadState = 40
+type pyLayout struct {
+	// _PyRuntimeState: offset of gilstate.tstate_current, or zero if the
+	// current thread state is the _Py_tss_tstate thread local variable.
+	tstateInRuntime uint32
+	// PyThreadState: offset of cframe, or zero if the current frame is
+	// directly in the thread state (no _PyCFrame).
+	cframeInThreadState       uint32
+	currentFrameInThreadState uint32
 	// _PyCFrame.
-	padCurrentFrameInCFrame = 4
+	currentFrameInCFrame uint32
 	// _PyInterpreterFrame.
-	padPreviousInFrame  = 24
-	padCodeInFrame      = 16
-	padPrevInstrInFrame = 28
-	padOwnerInFrame     = 37
+	previousInFrame  uint32
+	codeInFrame      uint32
+	prevInstrInFrame uint32 // instr_ptr since 3.13
+	ownerInFrame     uint32
+	// Offset of is_entry, or zero if the frames evaluated by a call to
+	// _PyEval_EvalFrameDefault are delimited by shim frames (since 3.12).
+	isEntryInFrame uint32
 	// PyCodeObject.
-	padFilenameInCodeObject       = 80
-	padNameInCodeObject           = 84
-	padCodeAdaptiveInCodeObject   = 116
-	padFirstlinenoInCodeObject    = 48
-	padLinearrayInCodeObject      = 104
-	padLinetableInCodeObject      = 92
-	padFirstTraceableInCodeObject = 108
-	sizeCodeUnit                  = 2
+	filenameInCodeObject     uint32
+	nameInCodeObject         uint32
+	codeAdaptiveInCodeObject uint32
+	firstlinenoInCodeObject  uint32
+	linearrayInCodeObject    uint32 // zero since 3.12
+	linetableInCodeObject    uint32
+	// PyASCIIObject.
+	sizeAsciiObject uint32
+}
+
+// pyLayouts maps minor versions of Python 3 to the layout of their structs.
+var pyLayouts = map[uint32]*pyLayout{
+	11: {
+		tstateInRuntime:          360,
+		cframeInThreadState:      40,
+		currentFrameInCFrame:     4,
+		previousInFrame:          24,
+		codeInFrame:              16,
+		prevInstrInFrame:         28,
+		isEntryInFrame:           36,
+		ownerInFrame:             37,
+		filenameInCodeObject:     80,
+		nameInCodeObject:         84,
+		codeAdaptiveInCodeObject: 116,
+		firstlinenoInCodeObject:  48,
+		linearrayInCodeObject:    104,
+		linetableInCodeObject:    92,
+		sizeAsciiObject:          24,
+	},
+	// f_code and previous moved to the start of _PyInterpreterFrame,
+	// _PyCFrame lost use_tracing, PyCodeObject lost _co_linearray and
+	// PyASCIIObject lost wstr.
+	12: {
+		cframeInThreadState:      40,
+		currentFrameInCFrame:     0,
+		previousInFrame:          4,
+		codeInFrame:              0,
+		prevInstrInFrame:         28,
+		ownerInFrame:             38,
+		filenameInCodeObject:     80,
+		nameInCodeObject:         84,
+		codeAdaptiveInCodeObject: 124,
+		firstlinenoInCodeObject:  44,
+		linetableInCodeObject:    92,
+		sizeAsciiObject:          20,
+	},
+	// _PyCFrame was removed, the current frame is in PyThreadState, and
+	// f_code became f_executable.
+	13: {
+		currentFrameInThreadState: 52,
+		previousInFrame:           4,
+		codeInFrame:               0,
+		prevInstrInFrame:          28,
+		ownerInFrame:              38,
+		filenameInCodeObject:      80,
+		nameInCodeObject:          84,
+		codeAdaptiveInCodeObject:  124,
+		firstlinenoInCodeObject:   44,
+		linetableInCodeObject:     92,
+		sizeAsciiObject:           20,
+	},
+}
+
+// Layout of the CPython structs which is the same in all supported versions.
+const (
+	sizeCodeUnit = 2
 	// PyASCIIObject.
 	padStateInAsciiObject  = 16
 	padLengthInAsciiObject = 8
-	sizeAsciiObject        = 24
 	// PyBytesObject.
 	padSvalInBytesObject = 16
 	padSizeInBytesObject = 8
@@ -150,71 +298,143 @@ const (
 	enumCodeLocationNoCol     = 13
 	enumCodeLocationLong      = 14
 	enumFrameOwnedByGenerator = 1
+	// Shim frames pushed when C code calls into Python, since 3.12.
+	enumFrameOwnedByCStack = 3
 )
 
 func (p *python) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
-	call := fn.(pyfuncall)
-
-	loc := location{
-		File:       call.file,
-		Line:       int64(call.line),
-		Column:     0, // TODO
-		Inlined:    false,
-		HumanName:  call.name,
-		StableName: call.file + "." + call.name,
+	call, ok := fn.(interpcall)
+	if !ok {
+		return p.symbols.Locations(fn, pc)
 	}
 
-	return uint64(call.addr), []location{loc}
+	return 0, []location{call.location()}
 }
 
+// Name of the function of the interpreter evaluating Python frames.
+const evalFrameFunction = "_PyEval_EvalFrameDefault"
+
+// Stackiter returns an iterator over the native stack of the interpreter, where
+// each call to _PyEval_EvalFrameDefault is replaced by the Python frames it is
+// evaluating. Profiles show the Python code along with the C functions it calls,
+// like the ones of C extensions.
 func (p *python) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
 	m := mod.Memory()
-	tsp := deref[ptr32](m, p.pyrtaddr+padTstateCurrentInRT)
-	cframep := deref[ptr32](m, tsp+padCframeInThreadState)
-	framep := deref[ptr32](m, cframep+padCurrentFrameInCFrame)
+	l := p.layout
+	tsp := deref[ptr32](m, p.tstateaddr)
+	var framep ptr32
+	if l.cframeInThreadState != 0 {
+		cframep := deref[ptr32](m, tsp+ptr32(l.cframeInThreadState))
+		framep = deref[ptr32](m, cframep+ptr32(l.currentFrameInCFrame))
+	} else {
+		framep = deref[ptr32](m, tsp+ptr32(l.currentFrameInThreadState))
+	}
 
-	return &pystackiter{
-		namedbg: def.DebugName(),
-		mem:     m,
-		framep:  framep,
+	s := pyStackIterators.Get().(*pystackiter)
+	*s = pystackiter{
+		wasmsi: wasmsi,
+		layout: l,
+		mem:    m,
+		framep: framep,
 	}
+	return s
+}
+
+var pyStackIterators = sync.Pool{
+	New: func() any { return new(pystackiter) },
 }
 
 type pystackiter struct {
-	namedbg string
+	wasmsi  experimental.StackIterator
+	layout  *pyLayout
 	mem     api.Memory
 	started bool
+	python  bool  // the current frame is a Python frame
+	last    bool  // the current frame is the last of its evaluation call
+	curr    ptr32 // _PyInterpreterFrame*
 	framep  ptr32 // _PyInterpreterFrame*
 }
 
+func (p *pystackiter) release() {
+	*p = pystackiter{}
+	pyStackIterators.Put(p)
+}
+
 func (p *pystackiter) Next() bool {
+	if p.python && p.nextFrame() {
+		return true
+	}
+	p.python = false
+	if !p.wasmsi.Next() {
+		return false
+	}
+	// The first frame is the function called, which has not started
+	// evaluating Python frames yet.
 	if !p.started {
 		p.started = true
-		return p.framep != 0
+		return true
+	}
+	if p.wasmsi.Function().Definition().Name() == evalFrameFunction {
+		// Shim frames do not belong to Python code, they separate the
+		// frames of each evaluation call since 3.12.
+		for p.framep != 0 && p.isShim(p.framep) {
+			p.framep = p.previous(p.framep)
+		}
+		p.last = false
+		// Evaluation calls which have no Python frames are kept as
+		// native frames.
+		p.python = p.nextFrame()
 	}
+	return true
+}
 
-	oldframe := p.framep
-	p.framep = deref[ptr32](p.mem, p.framep+padPreviousInFrame)
-	if oldframe == p.framep {
-		p.framep = 0
+// nextFrame moves to the next Python frame evaluated by the current call to
+// _PyEval_EvalFrameDefault, returning false when there are none left.
+func (p *pystackiter) nextFrame() bool {
+	if p.last || p.framep == 0 {
 		return false
 	}
-	return p.framep != 0
+	p.curr = p.framep
+	p.framep = p.previous(p.curr)
+	if l := p.layout; l.isEntryInFrame != 0 {
+		p.last = deref[uint8](p.mem, p.curr+ptr32(l.isEntryInFrame)) != 0
+	} else {
+		p.last = p.framep == 0 || p.isShim(p.framep)
+	}
+	return true
+}
+
+func (p *pystackiter) isShim(framep ptr32) bool {
+	return deref[uint8](p.mem, framep+ptr32(p.layout.ownerInFrame)) == enumFrameOwnedByCStack
+}
+
+func (p *pystackiter) previous(framep ptr32) ptr32 {
+	previous := deref[ptr32](p.mem, framep+ptr32(p.layout.previousInFrame))
+	if previous == framep {
+		return 0
+	}
+	return previous
 }
 
 func (p *pystackiter) ProgramCounter() experimental.ProgramCounter {
-	return experimental.ProgramCounter(deref[uint32](p.mem, p.framep+padPrevInstrInFrame))
+	if !p.python {
+		return p.wasmsi.ProgramCounter()
+	}
+	return experimental.ProgramCounter(deref[uint32](p.mem, p.curr+ptr32(p.layout.prevInstrInFrame)))
 }
 
 func (p *pystackiter) Function() experimental.InternalFunction {
-	codep := deref[ptr32](p.mem, p.framep+padCodeInFrame)
-	line, _ := lineForFrame(p.mem, p.framep, codep)
-	file := derefPyUnicodeUtf8(p.mem, codep+padFilenameInCodeObject)
-	name := derefPyUnicodeUtf8(p.mem, codep+padNameInCodeObject)
-	return pyfuncall{
+	if !p.python {
+		return p.wasmsi.Function()
+	}
+	l := p.layout
+	codep := deref[ptr32](p.mem, p.curr+ptr32(l.codeInFrame))
+	line, _ := lineForFrame(p.mem, l, p.curr, codep)
+	file := derefPyUnicodeUtf8(p.mem, l, codep+ptr32(l.filenameInCodeObject))
+	name := derefPyUnicodeUtf8(p.mem, l, codep+ptr32(l.nameInCodeObject))
+	return interpcall{
 		file: file,
 		name: functionName(file, name),
-		addr: deref[uint32](p.mem, p.framep+padPrevInstrInFrame),
 		line: line,
 	}
 }
@@ -239,76 +459,18 @@ func functionName(path, function string) string {
 }
 
 func (p *pystackiter) Parameters() []uint64 {
-	panic("TODO parameters()")
-}
-
-// pyfuncall represent a specific place in the python source where a
-// function call occurred.
-type pyfuncall struct {
-	file string
-	name string
-	line int32
-	addr uint32
-
-	api.FunctionDefinition // required for WazeroOnly
-}
-
-func (f pyfuncall) Definition() api.FunctionDefinition {
-	return f
-}
-
-func (f pyfuncall) SourceOffsetForPC(pc experimental.ProgramCounter) uint64 {
-	panic("does not make sense")
-}
-
-func (f pyfuncall) ModuleName() string {
-	return "<unknown>" // TODO
-}
-
-func (f pyfuncall) Index() uint32 {
-	return 42 // TODO
-}
-
-func (f pyfuncall) Import() (string, string, bool) {
-	panic("implement me")
-}
-
-func (f pyfuncall) ExportNames() []string {
-	panic("implement me")
-}
-
-func (f pyfuncall) Name() string {
-	return f.name
-}
-
-func (f pyfuncall) DebugName() string {
-	return f.name
-}
-
-func (f pyfuncall) GoFunction() interface{} {
+	if !p.python {
+		return p.wasmsi.Parameters()
+	}
+	// The arguments of Python calls are objects of the VM, the frames have no
+	// parameters of WebAssembly types.
 	return nil
 }
 
-func (f pyfuncall) ParamTypes() []api.ValueType {
-	panic("implement me")
-}
-
-func (f pyfuncall) ParamNames() []string {
-	panic("implement me")
-}
-
-func (f pyfuncall) ResultTypes() []api.ValueType {
-	panic("implement me")
-}
-
-func (f pyfuncall) ResultNames() []string {
-	panic("implement me")
-}
-
 // Return the utf8 encoding of a PyUnicode object. It is a
 // re-implementation of PyUnicode_AsUTF8. The bytes are copied from
 // the vmem, so the returned string is safe to use.
-func pyUnicodeUTf8(m vmem, p ptr32) string {
+func pyUnicodeUTf8(m vmem, l *pyLayout, p ptr32) string {
 	statep := p + padStateInAsciiObject
 	state := deref[uint8](m, statep)
 	compact := state&(1<<5) > 0
@@ -318,30 +480,32 @@ func pyUnicodeUTf8(m vmem, p ptr32) string {
 	}
 
 	length := deref[int32](m, p+padLengthInAsciiObject)
-	bytes := derefArray[byte](m, p+sizeAsciiObject, uint32(length))
+	bytes := derefArray[byte](m, p+ptr32(l.sizeAsciiObject), uint32(length))
 	return unsafe.String(unsafe.SliceData(bytes), len(bytes))
 }
 
-func derefPyUnicodeUtf8(m vmem, p ptr32) string {
+func derefPyUnicodeUtf8(m vmem, l *pyLayout, p ptr32) string {
 	x := deref[ptr32](m, p)
-	return pyUnicodeUTf8(m, x)
+	return pyUnicodeUTf8(m, l, x)
 }
 
-func lineForFrame(m vmem, framep, codep ptr32) (int32, bool) {
-	codestart := codep + padCodeAdaptiveInCodeObject
-	previnstr := deref[ptr32](m, framep+padPrevInstrInFrame)
-	firstlineno := deref[int32](m, codep+padFirstlinenoInCodeObject)
+func lineForFrame(m vmem, l *pyLayout, framep, codep ptr32) (int32, bool) {
+	codestart := codep + ptr32(l.codeAdaptiveInCodeObject)
+	previnstr := deref[ptr32](m, framep+ptr32(l.prevInstrInFrame))
+	firstlineno := deref[int32](m, codep+ptr32(l.firstlinenoInCodeObject))
 
 	if previnstr < codestart {
 		return firstlineno, false
 	}
 
-	linearray := deref[ptr32](m, codep+padLinearrayInCodeObject)
-	if linearray != 0 {
-		panic("can't handle code sections with line arrays")
+	if l.linearrayInCodeObject != 0 {
+		linearray := deref[ptr32](m, codep+ptr32(l.linearrayInCodeObject))
+		if linearray != 0 {
+			panic("can't handle code sections with line arrays")
+		}
 	}
 
-	codebytes := deref[ptr32](m, codep+padLinetableInCodeObject)
+	codebytes := deref[ptr32](m, codep+ptr32(l.linetableInCodeObject))
 	if codebytes == 0 {
 		panic("code section must have a linetable")
 	}
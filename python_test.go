@@ -0,0 +1,142 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+func TestPythonStackIterator(t *testing.T) {
+	for minor, layout := range pyLayouts {
+		mem := wazerotest.NewMemory(wazerotest.PageSize)
+		put := func(addr, off, v uint32) {
+			binary.LittleEndian.PutUint32(mem.Bytes[addr+off:], v)
+		}
+		str := func(addr uint32, s string) {
+			mem.Bytes[addr+padStateInAsciiObject] = 1<<5 | 1<<6 // compact, ascii
+			put(addr, padLengthInAsciiObject, uint32(len(s)))
+			copy(mem.Bytes[addr+layout.sizeAsciiObject:], s)
+		}
+		code := func(addr uint32, name string, line uint32) {
+			str(addr+0x100, "script.py")
+			str(addr+0x200, name)
+			put(addr, layout.filenameInCodeObject, addr+0x100)
+			put(addr, layout.nameInCodeObject, addr+0x200)
+			put(addr, layout.firstlinenoInCodeObject, line)
+		}
+		frame := func(addr, previous, code uint32, owner byte) {
+			put(addr, layout.previousInFrame, previous)
+			put(addr, layout.codeInFrame, code)
+			mem.Bytes[addr+layout.ownerInFrame] = owner
+			if layout.isEntryInFrame != 0 {
+				mem.Bytes[addr+layout.isEntryInFrame] = 1
+			}
+		}
+
+		const tstateaddr, tstate, cframe = 0x100, 0x200, 0x300
+		put(tstateaddr, 0, tstate)
+		if layout.cframeInThreadState != 0 {
+			put(tstate, layout.cframeInThreadState, cframe)
+			put(cframe, layout.currentFrameInCFrame, 0x1000)
+		} else {
+			put(tstate, layout.currentFrameInThreadState, 0x1000)
+		}
+		// Each evaluation call has a single Python frame, which is its entry
+		// frame in 3.11, and is followed by a shim frame since 3.12.
+		code(0x4000, "f", 10)
+		code(0x5000, "<module>", 1)
+		if layout.isEntryInFrame != 0 {
+			frame(0x1000, 0x1200, 0x4000, 0)
+			frame(0x1200, 0, 0x5000, 0)
+		} else {
+			frame(0x1000, 0x1100, 0x4000, 0)
+			frame(0x1100, 0x1200, 0, enumFrameOwnedByCStack)
+			frame(0x1200, 0x1300, 0x5000, 0)
+			frame(0x1300, 0, 0, enumFrameOwnedByCStack)
+		}
+
+		function := func(name string) *wazerotest.Function {
+			fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+			fn.FunctionName = name
+			return fn
+		}
+		main := function("main")
+		eval := function(evalFrameFunction)
+		call := function("PyObject_Vectorcall")
+		ext := function("ext_func")
+		wasmsi := experimental.NewStackIterator(
+			experimental.StackFrame{Function: ext},
+			experimental.StackFrame{Function: eval},
+			experimental.StackFrame{Function: call},
+			experimental.StackFrame{Function: eval},
+			experimental.StackFrame{Function: main},
+		)
+
+		p := &python{layout: layout, tstateaddr: tstateaddr}
+		mod := wazerotest.NewModule(mem, main, eval, call, ext)
+		si := p.Stackiter(mod, ext.Definition(), wasmsi)
+
+		var names []string
+		var lines []int32
+		for si.Next() {
+			f := si.Function()
+			names = append(names, f.Definition().Name())
+			if call, ok := f.(interpcall); ok {
+				lines = append(lines, call.line)
+			}
+		}
+		if want := []string{"ext_func", "script.f", "PyObject_Vectorcall", "script", "main"}; !slices.Equal(names, want) {
+			t.Errorf("python 3.%d: wrong stack: want=%q got=%q", minor, want, names)
+		}
+		if want := []int32{10, 1}; !slices.Equal(lines, want) {
+			t.Errorf("python 3.%d: wrong lines: want=%d got=%d", minor, want, lines)
+		}
+	}
+}
+
+func TestPythonVersion(t *testing.T) {
+	tests := []struct {
+		name  string
+		names string
+		data  string
+		want  uint32
+	}{
+		{"cpython 3.10", "\x18_PyEval_EvalFrameDefault", "\x00hello\x003.10.4\x00world\x00", 10},
+		{"cpython 3.12 with sqlite", "\x18_PyEval_EvalFrameDefault", "\x003.41.2\x00\x003.12.0rc1\x00", 12},
+		{"cpython without version", "\x18_PyEval_EvalFrameDefault", "\x00hello\x00", 0},
+		{"not cpython", "\x04main", "\x003.10.4\x00", 0},
+	}
+
+	for _, test := range tests {
+		wasm := testWasmModule(test.names, test.data)
+		if got := pythonVersion(wasm); got != test.want {
+			t.Errorf("%s: python version mismatch: want=3.%d got=3.%d", test.name, test.want, got)
+		}
+	}
+
+	p := ProfilingFor(testWasmModule("\x18_PyEval_EvalFrameDefault", "\x003.10.4\x00"))
+	if p.lang != python3 {
+		t.Fatalf("module not detected as python: %d", p.lang)
+	}
+	if _, err := pythonLayout(p.pyVersion); err == nil {
+		t.Error("expected an error for an unsupported python version")
+	}
+}
+
+// testWasmModule builds a module made of a name section with the given content
+// and a data section with a single segment at address zero.
+func testWasmModule(names, data string) []byte {
+	section := func(id byte, content []byte) []byte {
+		return append(binary.AppendUvarint([]byte{id}, uint64(len(content))), content...)
+	}
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	b = append(b, section(0, append([]byte("\x04name"), names...))...)
+	segment := binary.AppendUvarint([]byte{1, 0, 0x41, 0, 0x0B}, uint64(len(data)))
+	b = append(b, section(11, append(segment, data...))...)
+	return b
+}
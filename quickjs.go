@@ -0,0 +1,222 @@
+package wzprof
+
+import (
+	"bytes"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Try to detect if the module embeds the QuickJS engine by looking for the
+// functions calling JavaScript functions and creating runtimes in the name
+// section (names are prefixed by their length).
+func binEmbedsQuickJS(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("\x0fJS_CallInternal")) &&
+		bytes.Contains(names, []byte("\x0dJS_NewRuntime"))
+}
+
+// Layout of the QuickJS structs read by wzprof on wasm32, where JSValue is NaN
+// boxed in 8 bytes. They are the same in the 2021-03-27 and 2024-01-13
+// releases.
+//
+// https://github.com/bellard/quickjs/blob/2024-01-13/quickjs.c
+const (
+	// JSContext.
+	qjsRuntimeInContext = 16
+	// JSRuntime.
+	qjsAtomArrayInRuntime         = 32
+	qjsCurrentStackFrameInRuntime = 132
+	// JSStackFrame.
+	qjsPrevFrameInStackFrame = 0
+	qjsCurFuncInStackFrame   = 8
+	qjsCurPCInStackFrame     = 32
+	// JSObject.
+	qjsClassIDInObject          = 6
+	qjsFunctionBytecodeInObject = 28
+	// JSFunctionBytecode.
+	qjsFlagsInFunctionBytecode    = 17
+	qjsFuncNameInFunctionBytecode = 28
+	qjsFilenameInFunctionBytecode = 64
+	qjsLineNumInFunctionBytecode  = 68
+	qjsHasDebugFlag               = 1 << 10
+	// JSString.
+	qjsLenInString   = 4
+	qjsCharsInString = 16
+	// JSValue tags and classes.
+	qjsTagObject             = -1
+	qjsClassCFunction        = 12
+	qjsClassCFunctionData    = 15
+	qjsAtomTagInt            = 1 << 31
+	qjsAnonymousFunctionName = "<anonymous>"
+)
+
+// Functions of the engine which push a JSStackFrame when calling a function,
+// and take the context and the function object as first parameters.
+var qjsCallFunctions = map[string]struct{}{
+	"JS_CallInternal":    {},
+	"js_call_c_function": {},
+}
+
+func prepareQuickJS(mod wazero.CompiledModule) *quickjs {
+	q := &quickjs{symbols: namesymbolizer{}}
+	// The native frames of the engine are symbolized with DWARF when it is
+	// available, it is not needed to walk the JavaScript stack.
+	if p, err := newDwarfparser(mod); err == nil {
+		q.symbols = buildDwarfSymbolizer(p)
+	}
+	return q
+}
+
+type quickjs struct {
+	symbols symbolizer
+}
+
+func (q *quickjs) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	call, ok := fn.(interpcall)
+	if !ok {
+		return q.symbols.Locations(fn, pc)
+	}
+	return 0, []location{call.location()}
+}
+
+// Stackiter returns an iterator over the native stack of the engine, where each
+// call to JS_CallInternal is replaced by the frame of the JavaScript function it
+// is running.
+func (q *quickjs) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	s := qjsStackIterators.Get().(*qjsstackiter)
+	*s = qjsstackiter{wasmsi: wasmsi, mem: mod.Memory()}
+	return s
+}
+
+var qjsStackIterators = sync.Pool{
+	New: func() any { return new(qjsstackiter) },
+}
+
+type qjsstackiter struct {
+	wasmsi  experimental.StackIterator
+	mem     api.Memory
+	started bool
+	js      bool  // the current frame is a JavaScript frame
+	rt      ptr32 // JSRuntime*
+	curr    ptr32 // JSStackFrame*
+	sf      ptr32 // JSStackFrame*
+}
+
+func (q *qjsstackiter) release() {
+	*q = qjsstackiter{}
+	qjsStackIterators.Put(q)
+}
+
+func (q *qjsstackiter) Next() bool {
+	q.js = false
+	if !q.wasmsi.Next() {
+		return false
+	}
+	// The first frame is the function called, which has not pushed its
+	// stack frame yet.
+	if !q.started {
+		q.started = true
+		return true
+	}
+	def := q.wasmsi.Function().Definition()
+	if _, ok := qjsCallFunctions[def.Name()]; !ok {
+		return true
+	}
+	params := q.wasmsi.Parameters()
+	if len(params) < 2 {
+		return true
+	}
+	if q.rt == 0 {
+		q.rt = deref[ptr32](q.mem, ptr32(params[0])+qjsRuntimeInContext)
+		q.sf = deref[ptr32](q.mem, q.rt+qjsCurrentStackFrameInRuntime)
+	}
+	// Calls of functions which do not push a stack frame, like bound
+	// functions or proxies, are not matched to the next stack frame.
+	if q.sf == 0 || deref[uint64](q.mem, q.sf+qjsCurFuncInStackFrame) != params[1] {
+		return true
+	}
+	q.curr = q.sf
+	q.sf = deref[ptr32](q.mem, q.sf+qjsPrevFrameInStackFrame)
+	// Frames of C functions are kept as native frames.
+	q.js = q.functionBytecode() != 0
+	return true
+}
+
+// functionBytecode returns the JSFunctionBytecode of the function of the
+// current stack frame, or zero if it is a C function.
+func (q *qjsstackiter) functionBytecode() ptr32 {
+	fn := deref[uint64](q.mem, q.curr+qjsCurFuncInStackFrame)
+	if int32(fn>>32) != qjsTagObject {
+		return 0
+	}
+	obj := ptr32(fn)
+	switch deref[uint16](q.mem, obj+qjsClassIDInObject) {
+	case qjsClassCFunction, qjsClassCFunctionData:
+		return 0
+	}
+	return deref[ptr32](q.mem, obj+qjsFunctionBytecodeInObject)
+}
+
+func (q *qjsstackiter) ProgramCounter() experimental.ProgramCounter {
+	if !q.js {
+		return q.wasmsi.ProgramCounter()
+	}
+	return experimental.ProgramCounter(deref[uint32](q.mem, q.curr+qjsCurPCInStackFrame))
+}
+
+// Function returns the JavaScript function of the current frame. The line is
+// the one where the function is defined.
+func (q *qjsstackiter) Function() experimental.InternalFunction {
+	if !q.js {
+		return q.wasmsi.Function()
+	}
+	b := q.functionBytecode()
+	call := interpcall{
+		name: q.atom(deref[uint32](q.mem, b+qjsFuncNameInFunctionBytecode)),
+	}
+	if call.name == "" {
+		call.name = qjsAnonymousFunctionName
+	}
+	if deref[uint16](q.mem, b+qjsFlagsInFunctionBytecode)&qjsHasDebugFlag != 0 {
+		call.file = q.atom(deref[uint32](q.mem, b+qjsFilenameInFunctionBytecode))
+		call.line = deref[int32](q.mem, b+qjsLineNumInFunctionBytecode)
+	}
+	return call
+}
+
+func (q *qjsstackiter) Parameters() []uint64 {
+	return q.wasmsi.Parameters()
+}
+
+// atom returns the string of an atom of the runtime, or an empty string for
+// the null atom and the ones representing integers.
+func (q *qjsstackiter) atom(a uint32) string {
+	if a == 0 || a&qjsAtomTagInt != 0 {
+		return ""
+	}
+	atoms := deref[ptr32](q.mem, q.rt+qjsAtomArrayInRuntime)
+	return qjsString(q.mem, deref[ptr32](q.mem, atoms+ptr32(4*a)))
+}
+
+// qjsString decodes a JSString, which holds either latin1 or UTF-16
+// characters.
+func qjsString(m vmem, s ptr32) string {
+	if s == 0 {
+		return ""
+	}
+	v := deref[uint32](m, s+qjsLenInString)
+	n, wide := v&0x7fffffff, v>>31 != 0
+	if wide {
+		return string(utf16.Decode(derefArray[uint16](m, s+qjsCharsInString, n)))
+	}
+	latin1 := derefArray[byte](m, s+qjsCharsInString, n)
+	runes := make([]rune, len(latin1))
+	for i, c := range latin1 {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,149 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+func TestBinEmbedsQuickJS(t *testing.T) {
+	if !binEmbedsQuickJS(testWasmModule("\x0fJS_CallInternal\x0dJS_NewRuntime", "")) {
+		t.Error("quickjs module not detected")
+	}
+	if binEmbedsQuickJS(testWasmModule("\x04main", "")) {
+		t.Error("module wrongly detected as quickjs")
+	}
+}
+
+func TestQuickJSStackIterator(t *testing.T) {
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	put := func(addr, off, v uint32) {
+		binary.LittleEndian.PutUint32(mem.Bytes[addr+off:], v)
+	}
+	value := func(obj uint32) uint64 {
+		return uint64(0xffffffff)<<32 | uint64(obj) // JS_TAG_OBJECT
+	}
+
+	const ctx, rt, atoms = 0x100, 0x200, 0x300
+	put(ctx, qjsRuntimeInContext, rt)
+	put(rt, qjsAtomArrayInRuntime, atoms)
+	put(rt, qjsCurrentStackFrameInRuntime, 0x1000)
+
+	// Atom 1 is a latin1 string, atom 2 a wide one.
+	put(atoms, 4, 0x400)
+	put(0x400, qjsLenInString, 1)
+	copy(mem.Bytes[0x400+qjsCharsInString:], "f")
+	put(atoms, 8, 0x500)
+	put(0x500, qjsLenInString, 4|1<<31)
+	for i, c := range []uint16{'λ', '.', 'j', 's'} {
+		binary.LittleEndian.PutUint16(mem.Bytes[0x500+qjsCharsInString+2*i:], c)
+	}
+
+	function := func(obj uint32, class uint16, name uint32, line int32) {
+		binary.LittleEndian.PutUint16(mem.Bytes[obj+qjsClassIDInObject:], class)
+		b := obj + 0x100
+		put(obj, qjsFunctionBytecodeInObject, b)
+		binary.LittleEndian.PutUint16(mem.Bytes[b+qjsFlagsInFunctionBytecode:], qjsHasDebugFlag)
+		put(b, qjsFuncNameInFunctionBytecode, name)
+		put(b, qjsFilenameInFunctionBytecode, 2)
+		put(b, qjsLineNumInFunctionBytecode, uint32(line))
+	}
+	const objF, objC, objBound, objMain = 0x2000, 0x2200, 0x2400, 0x2600
+	function(objF, 13, 1, 7)
+	function(objC, qjsClassCFunction, 0, 0)
+	function(objMain, 13, 0, 1)
+
+	frame := func(sf, prev, obj uint32) {
+		put(sf, qjsPrevFrameInStackFrame, prev)
+		binary.LittleEndian.PutUint64(mem.Bytes[sf+qjsCurFuncInStackFrame:], value(obj))
+	}
+	frame(0x1000, 0x1100, objF)
+	frame(0x1100, 0x1200, objC)
+	frame(0x1200, 0, objMain)
+
+	native := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	main := native("main")
+	call := native("JS_CallInternal")
+	ccall := native("js_call_c_function")
+	ext := native("ext_func")
+	wasmsi := &testStackIterator{index: -1, frames: []experimental.StackFrame{
+		{Function: ext},
+		{Function: call, Params: []uint64{ctx, value(objF)}},
+		{Function: ccall, Params: []uint64{ctx, value(objC)}},
+		// A bound function, which has no stack frame.
+		{Function: call, Params: []uint64{ctx, value(objBound)}},
+		{Function: call, Params: []uint64{ctx, value(objMain)}},
+		{Function: main},
+	}}
+
+	q := &quickjs{symbols: noopsymbolizer{}}
+	mod := wazerotest.NewModule(mem, main, call, ccall, ext)
+	si := q.Stackiter(mod, ext.Definition(), wasmsi)
+
+	var names, files []string
+	var lines []int32
+	for si.Next() {
+		f := si.Function()
+		names = append(names, f.Definition().Name())
+		if call, ok := f.(interpcall); ok {
+			files = append(files, call.file)
+			lines = append(lines, call.line)
+		}
+	}
+	want := []string{"ext_func", "f", "js_call_c_function", "JS_CallInternal", qjsAnonymousFunctionName, "main"}
+	if !slices.Equal(names, want) {
+		t.Errorf("wrong stack: want=%q got=%q", want, names)
+	}
+	if want := []string{"λ.js", "λ.js"}; !slices.Equal(files, want) {
+		t.Errorf("wrong files: want=%q got=%q", want, files)
+	}
+	if want := []int32{7, 1}; !slices.Equal(lines, want) {
+		t.Errorf("wrong lines: want=%d got=%d", want, lines)
+	}
+}
+
+// testStackIterator iterates over frames starting with the top most one. It
+// is used instead of experimental.NewStackIterator, which does not return the
+// parameters of the frames in the same order as their functions.
+type testStackIterator struct {
+	frames []experimental.StackFrame
+	index  int
+}
+
+func (si *testStackIterator) Next() bool {
+	si.index++
+	return si.index < len(si.frames)
+}
+
+func (si *testStackIterator) ProgramCounter() experimental.ProgramCounter {
+	return experimental.ProgramCounter(si.frames[si.index].PC)
+}
+
+func (si *testStackIterator) Function() experimental.InternalFunction {
+	return testInternalFunction{si.frames[si.index].Function.Definition()}
+}
+
+func (si *testStackIterator) Parameters() []uint64 {
+	return si.frames[si.index].Params
+}
+
+type testInternalFunction struct {
+	def api.FunctionDefinition
+}
+
+func (f testInternalFunction) Definition() api.FunctionDefinition {
+	return f.def
+}
+
+func (f testInternalFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+	return 0
+}
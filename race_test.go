@@ -0,0 +1,7 @@
+//go:build race
+
+package wzprof
+
+// The race detector instruments memory accesses and synchronization, which
+// allocates, so the tests counting allocations are skipped.
+const raceEnabled = true
@@ -0,0 +1,178 @@
+package wzprof
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Prefix of the comment of raw profiles which records the hash of the module
+// they were collected for.
+const rawProfileComment = "wzprof raw module sha256:"
+
+func moduleHash(wasm []byte) string {
+	sum := sha256.Sum256(wasm)
+	return hex.EncodeToString(sum[:])
+}
+
+// Raw locations are attached to functions named after their index, the way
+// engines name wasm functions in stack traces.
+func rawFunctionName(index uint32) string {
+	return fmt.Sprintf("wasm-function[%d]", index)
+}
+
+func parseRawFunctionName(name string) (uint32, bool) {
+	s, ok := strings.CutPrefix(name, "wasm-function[")
+	if !ok {
+		return 0, false
+	}
+	s, ok = strings.CutSuffix(s, "]")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(s, 10, 32)
+	return uint32(index), err == nil
+}
+
+// rawCall records a call without symbolizing it. The name of the function is
+// kept to make raw profiles readable, and for the symbolizers which need it.
+// The source offset of the call is only recorded when hasPC is true, see
+// hasProgramCounter.
+func rawCall(fn experimental.InternalFunction, pc experimental.ProgramCounter, hasPC bool) symbolizedCall {
+	def := fn.Definition()
+	stable := rawFunctionName(def.Index())
+	human := wasmFunctionName(def)
+	if human == "" {
+		human = stable
+	}
+	var offset uint64
+	if hasPC {
+		offset = fn.SourceOffsetForPC(pc)
+	}
+	return symbolizedCall{
+		address:   offset,
+		locations: []location{{StableName: stable, HumanName: human}},
+	}
+}
+
+// SymbolizeProfile resolves the raw locations of a profile built with
+// Symbolize(false), the profile is modified in place. The profiling must be
+// created and prepared for the same module as the one the profile was
+// collected for, optionally with the DebugInfo option.
+func (p *Profiling) SymbolizeProfile(prof *profile.Profile) error {
+	if !p.symbolize {
+		return fmt.Errorf("symbolizing a profile requires symbolization to be enabled")
+	}
+
+	hash := ""
+	comments := prof.Comments[:0]
+	for _, c := range prof.Comments {
+		if h, ok := strings.CutPrefix(c, rawProfileComment); ok {
+			hash = h
+		} else {
+			comments = append(comments, c)
+		}
+	}
+	if hash == "" {
+		return fmt.Errorf("the profile is not a raw profile")
+	}
+	if hash != p.hash {
+		return fmt.Errorf("the profile was collected for another module (sha256:%s)", hash)
+	}
+	prof.Comments = comments
+
+	// The functions already symbolized are shared with the symbolized
+	// locations, which are keyed by their system names.
+	funcs := make(map[string]*profile.Function)
+	var raw []*profile.Location
+	var calls []stackCall
+	for _, loc := range prof.Location {
+		// Locations of other modules (see PrepareModule) are left raw.
+		other := loc.Mapping != nil && loc.Mapping.BuildID != hash
+		if !other && len(loc.Line) == 1 && loc.Line[0].Function != nil {
+			f := loc.Line[0].Function
+			if index, ok := parseRawFunctionName(f.SystemName); ok {
+				raw = append(raw, loc)
+				calls = append(calls, stackCall{
+					fn: rawFunction{
+						def:    rawFunctionDefinition{index: index, name: f.Name},
+						offset: loc.Address,
+					},
+					pc: 1,
+				})
+				continue
+			}
+		}
+		for _, line := range loc.Line {
+			funcs[line.Function.SystemName] = line.Function
+		}
+	}
+
+	for i, call := range symbolizeCalls(p, calls) {
+		loc := locationForSymbols(call, funcs)
+		raw[i].Address = loc.Address
+		raw[i].Line = loc.Line
+	}
+
+	// Functions of the raw locations which are no longer referenced are
+	// removed, the others are renumbered.
+	seen := make(map[*profile.Function]bool, len(funcs))
+	prof.Function = prof.Function[:0]
+	for _, loc := range prof.Location {
+		for _, line := range loc.Line {
+			if !seen[line.Function] {
+				seen[line.Function] = true
+				line.Function.ID = uint64(len(prof.Function)) + 1
+				prof.Function = append(prof.Function, line.Function)
+			}
+		}
+	}
+	for _, m := range prof.Mapping {
+		if m.BuildID == hash {
+			setMappingFlags(m, prof.Location, true)
+		}
+	}
+	return prof.CheckValid()
+}
+
+// rawFunction is a function of a raw profile, with the definition and source
+// offset of the call needed by symbolizers.
+type rawFunction struct {
+	def    rawFunctionDefinition
+	offset uint64
+}
+
+func (f rawFunction) Definition() api.FunctionDefinition {
+	return f.def
+}
+
+func (f rawFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+	return f.offset
+}
+
+type rawFunctionDefinition struct {
+	index uint32
+	name  string
+
+	api.FunctionDefinition // required for WazeroOnly
+}
+
+func (d rawFunctionDefinition) Index() uint32 { return d.index }
+
+func (d rawFunctionDefinition) Name() string { return d.name }
+
+func (d rawFunctionDefinition) DebugName() string { return d.name }
+
+func (d rawFunctionDefinition) ModuleName() string { return "" }
+
+func (d rawFunctionDefinition) ExportNames() []string { return nil }
+
+func (d rawFunctionDefinition) Import() (string, string, bool) { return "", "", false }
+
+func (d rawFunctionDefinition) GoFunction() any { return nil }
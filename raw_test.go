@@ -0,0 +1,19 @@
+package wzprof
+
+import "testing"
+
+func TestRawFunctionName(t *testing.T) {
+	for _, index := range []uint32{0, 1, 42, 1<<32 - 1} {
+		name := rawFunctionName(index)
+		got, ok := parseRawFunctionName(name)
+		if !ok || got != index {
+			t.Errorf("%s: want %d, got %d (ok=%t)", name, index, got, ok)
+		}
+	}
+
+	for _, name := range []string{"", "main", "wasm-function[]", "wasm-function[-1]", "wasm-function[1", "wasm-function[4294967296]"} {
+		if _, ok := parseRawFunctionName(name); ok {
+			t.Errorf("%q parsed as a raw function name", name)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package wzprof
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteHTMLReport writes a self-contained HTML report of a profile to w, made
+// of a flame graph of the stacks and of the source code of the n functions
+// with the highest flat values annotated with the values of each line, like
+// the output of `go tool pprof -list`. When n is zero or negative, all the
+// functions are annotated. The report has no external dependencies, so it
+// can be attached to a pull request or a bug report.
+//
+// The source files are read with readSource, from the file names of the
+// functions of the profile, which are the paths recorded in the DWARF
+// information of the module (see SourcePathPrefix). Functions whose source
+// cannot be read are listed without source; readSource may be nil to only
+// render the flame graph. With ReportDisassembly, the instructions of the
+// functions are listed after their source.
+//
+// The values reported are the ones of the default sample type of the profile.
+func WriteHTMLReport(w io.Writer, prof *profile.Profile, n int, readSource func(path string) ([]byte, error), options ...ReportOption) error {
+	var config reportConfig
+	for _, opt := range options {
+		opt(&config)
+	}
+
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+	unit := prof.SampleType[index].Unit
+
+	functions := make(map[functionKey]*reportFunction)
+	function := func(fn *profile.Function) *reportFunction {
+		k := functionKey{name: topFunctionName(fn)}
+		if fn != nil {
+			k.file = fn.Filename
+		}
+		f := functions[k]
+		if f == nil {
+			f = &reportFunction{
+				name:         k.name,
+				file:         k.file,
+				lines:        make(map[int64]*lineValues),
+				instructions: make(map[uint64]*lineValues),
+			}
+			if fn != nil {
+				f.startLine = fn.StartLine
+			}
+			functions[k] = f
+		}
+		return f
+	}
+
+	var total int64
+	seenFunctions := make(map[*reportFunction]struct{})
+	seenLines := make(map[*lineValues]struct{})
+	seenInstructions := make(map[*lineValues]struct{})
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		total += value
+
+		for k := range seenFunctions {
+			delete(seenFunctions, k)
+		}
+		for k := range seenLines {
+			delete(seenLines, k)
+		}
+		for k := range seenInstructions {
+			delete(seenInstructions, k)
+		}
+		for i, loc := range sample.Location {
+			for j, line := range loc.Line {
+				f := function(line.Function)
+				l := f.line(line.Line)
+				if i == 0 && j == 0 {
+					// The first line of the first location is the
+					// innermost function of the stack.
+					f.flat += value
+					l.flat += value
+				}
+				// Recursive calls are only accounted once in the
+				// cumulative values.
+				if _, ok := seenFunctions[f]; !ok {
+					seenFunctions[f] = struct{}{}
+					f.cum += value
+				}
+				if _, ok := seenLines[l]; !ok {
+					seenLines[l] = struct{}{}
+					l.cum += value
+				}
+			}
+			// The address of a location is the offset of its instruction
+			// in the code section of the wasm function, which is the last
+			// line of the location.
+			if loc.Address == 0 || len(loc.Line) == 0 || !mainMapping(prof, loc) {
+				continue
+			}
+			in := function(loc.Line[len(loc.Line)-1].Function).instruction(loc.Address)
+			if i == 0 {
+				in.flat += value
+			}
+			if _, ok := seenInstructions[in]; !ok {
+				seenInstructions[in] = struct{}{}
+				in.cum += value
+			}
+		}
+	}
+
+	list := make([]*reportFunction, 0, len(functions))
+	for _, f := range functions {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].flat != list[j].flat {
+			return list[i].flat > list[j].flat
+		}
+		if list[i].cum != list[j].cum {
+			return list[i].cum > list[j].cum
+		}
+		return list[i].name < list[j].name
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+
+	report := htmlReport{
+		SampleType: prof.SampleType[index].Type,
+		Total:      FormatValue(total, unit),
+		Comments:   prof.Comments,
+	}
+	if len(prof.Mapping) > 0 {
+		report.Module = prof.Mapping[0].File
+	}
+	report.Flame = flameGraph(prof, index)
+
+	sources := make(map[string][]string)
+	var code []byte
+	var bodies []wasmFunctionBody
+	if config.wasm != nil {
+		start, size := wasmCodeSection(config.wasm)
+		code = config.wasm[start : start+size]
+		bodies = wasmFunctionBodies(config.wasm)
+	}
+	for _, f := range list {
+		fn := htmlFunction{
+			Name: f.name,
+			File: f.file,
+			Flat: FormatValue(f.flat, unit) + " (" + FormatPercent(f.flat, total) + ")",
+			Cum:  FormatValue(f.cum, unit) + " (" + FormatPercent(f.cum, total) + ")",
+		}
+		if f.file != "" && readSource != nil {
+			lines, ok := sources[f.file]
+			if !ok {
+				if b, err := readSource(f.file); err == nil {
+					lines = strings.Split(string(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))), "\n")
+				} else {
+					Logger().Debug("report: source not found", "file", f.file, "error", err)
+				}
+				sources[f.file] = lines
+			}
+			fn.Lines = f.annotate(lines, unit)
+		}
+		if bodies != nil {
+			fn.Instructions = f.disassemble(code, bodies, unit)
+		}
+		report.Functions = append(report.Functions, fn)
+	}
+	return htmlReportTemplate.Execute(w, report)
+}
+
+// ReportOption is a type used to represent configuration options for the
+// reports written by WriteHTMLReport.
+type ReportOption func(*reportConfig)
+
+type reportConfig struct {
+	wasm []byte
+}
+
+// ReportDisassembly configures the report to list the instructions of the
+// wasm functions of the top functions, annotated with the values of the
+// locations of each instruction, which is how the profiles of the branch and
+// opcode profilers are read. The module must be the one the profile was
+// recorded for: the addresses of the locations are offsets in its code
+// section.
+func ReportDisassembly(wasm []byte) ReportOption {
+	return func(c *reportConfig) { c.wasm = wasm }
+}
+
+// mainMapping returns whether the location is in the profiled module, which
+// is the first mapping of the profile.
+func mainMapping(prof *profile.Profile, loc *profile.Location) bool {
+	return loc.Mapping == nil || len(prof.Mapping) == 0 || loc.Mapping == prof.Mapping[0]
+}
+
+type functionKey struct {
+	name string
+	file string
+}
+
+type reportFunction struct {
+	name      string
+	file      string
+	startLine int64
+	flat      int64
+	cum       int64
+	lines     map[int64]*lineValues
+	// Values of the instructions of the wasm function, by offset in the
+	// code section.
+	instructions map[uint64]*lineValues
+}
+
+type lineValues struct {
+	flat int64
+	cum  int64
+}
+
+func (f *reportFunction) line(n int64) *lineValues {
+	l := f.lines[n]
+	if l == nil {
+		l = new(lineValues)
+		f.lines[n] = l
+	}
+	return l
+}
+
+func (f *reportFunction) instruction(offset uint64) *lineValues {
+	in := f.instructions[offset]
+	if in == nil {
+		in = new(lineValues)
+		f.instructions[offset] = in
+	}
+	return in
+}
+
+// reportSourceContext is the number of lines shown around the lines of a
+// function which have samples.
+const reportSourceContext = 2
+
+// annotate returns the lines of the source of the function, from its first
+// line to the last line which has samples.
+func (f *reportFunction) annotate(source []string, unit string) []htmlLine {
+	first, last := int64(0), int64(0)
+	for n := range f.lines {
+		if n <= 0 {
+			continue
+		}
+		if first == 0 || n < first {
+			first = n
+		}
+		if n > last {
+			last = n
+		}
+	}
+	if first == 0 || last > int64(len(source)) {
+		return nil
+	}
+	if f.startLine > 0 && f.startLine < first {
+		first = f.startLine
+	}
+	first = max64(first-reportSourceContext, 1)
+	last = min64(last+reportSourceContext, int64(len(source)))
+
+	lines := make([]htmlLine, 0, last-first+1)
+	for n := first; n <= last; n++ {
+		line := htmlLine{Number: n, Source: source[n-1]}
+		if l := f.lines[n]; l != nil {
+			if l.flat != 0 {
+				line.Flat = FormatValue(l.flat, unit)
+			}
+			if l.cum != 0 {
+				line.Cum = FormatValue(l.cum, unit)
+				line.Hot = true
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// disassemble returns the instructions of the wasm functions the values of the
+// function are located at, from the start of their bodies to the last
+// instruction which has values.
+func (f *reportFunction) disassemble(code []byte, bodies []wasmFunctionBody, unit string) []htmlInstruction {
+	var indexes []int
+	for offset := range f.instructions {
+		i := sort.Search(len(bodies), func(i int) bool { return bodies[i].offset > offset }) - 1
+		if i < 0 || offset >= bodies[i].offset+bodies[i].size {
+			continue
+		}
+		if !containsInt(indexes, i) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	var instructions []htmlInstruction
+	for _, i := range indexes {
+		list := disassemble(code, bodies[i])
+		last := -1
+		for j, in := range list {
+			if f.instructions[in.offset] != nil {
+				last = j
+			}
+		}
+		if last < 0 {
+			continue
+		}
+		end := last + 1 + reportSourceContext
+		if end > len(list) {
+			end = len(list)
+		}
+		for _, in := range list[:end] {
+			h := htmlInstruction{Offset: fmt.Sprintf("%#x", in.offset), Text: in.text}
+			if v := f.instructions[in.offset]; v != nil {
+				if v.flat != 0 {
+					h.Flat = FormatValue(v.flat, unit)
+				}
+				if v.cum != 0 {
+					h.Cum = FormatValue(v.cum, unit)
+					h.Hot = true
+				}
+			}
+			instructions = append(instructions, h)
+		}
+	}
+	return instructions
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type htmlReport struct {
+	Module     string
+	SampleType string
+	Total      string
+	Comments   []string
+	Flame      *htmlFrame
+	Functions  []htmlFunction
+}
+
+type htmlFunction struct {
+	Name         string
+	File         string
+	Flat         string
+	Cum          string
+	Lines        []htmlLine
+	Instructions []htmlInstruction
+}
+
+type htmlInstruction struct {
+	Offset string
+	Text   string
+	Flat   string
+	Cum    string
+	Hot    bool
+}
+
+type htmlLine struct {
+	Number int64
+	Source string
+	Flat   string
+	Cum    string
+	Hot    bool
+}
+
+var htmlReportTemplate = template.Must(template.Must(flameGraphTemplate.Clone()).New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>wzprof report{{if .Module}}: {{.Module}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+h2 { margin-top: 2em; }
+{{template "flame-style"}}
+table.source { border-collapse: collapse; font-family: monospace; font-size: 13px; }
+table.source td { padding: 0 8px; white-space: pre; vertical-align: top; }
+table.source td.value { text-align: right; color: #555; }
+table.source td.number { text-align: right; color: #999; }
+table.source tr.hot { background-color: #fff2cc; }
+.missing { color: #999; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>wzprof report</h1>
+<ul>
+{{- if .Module}}
+<li>Module: {{.Module}}</li>
+{{- end}}
+<li>Sample type: {{.SampleType}}</li>
+<li>Total: {{.Total}}</li>
+{{- range .Comments}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+<h2>Flame graph</h2>
+{{- if .Flame}}
+{{template "flame" .Flame}}
+{{- else}}
+<p class="missing">No samples.</p>
+{{- end}}
+<h2>Source</h2>
+{{- range .Functions}}
+<h3>{{.Name}}</h3>
+<p>{{if .File}}{{.File}}: {{end}}flat {{.Flat}}, cum {{.Cum}}</p>
+{{- if .Lines}}
+<table class="source">
+<tr><th>flat</th><th>cum</th><th></th><th></th></tr>
+{{- range .Lines}}
+<tr{{if .Hot}} class="hot"{{end}}><td class="value">{{.Flat}}</td><td class="value">{{.Cum}}</td><td class="number">{{.Number}}</td><td>{{.Source}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="missing">Source not available.</p>
+{{- end}}
+{{- if .Instructions}}
+<table class="source">
+<tr><th>flat</th><th>cum</th><th></th><th></th></tr>
+{{- range .Instructions}}
+<tr{{if .Hot}} class="hot"{{end}}><td class="value">{{.Flat}}</td><td class="value">{{.Cum}}</td><td class="number">{{.Offset}}</td><td>{{.Text}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
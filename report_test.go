@@ -0,0 +1,76 @@
+package wzprof
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteHTMLReport(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", Filename: "/src/main.c", StartLine: 3}
+	compute := &profile.Function{ID: 2, Name: "compute", Filename: "/src/main.c", StartLine: 1}
+	write := &profile.Function{ID: 3, Name: "write"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: main, Line: 5}}}
+	hot := &profile.Location{ID: 2, Line: []profile.Line{{Function: compute, Line: 2}}}
+	io := &profile.Location{ID: 3, Line: []profile.Line{{Function: write}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{hot, root}, Value: []int64{3, 3000}},
+			{Location: []*profile.Location{io, root}, Value: []int64{1, 1000}},
+		},
+	}
+
+	source := "int compute() {\n  return 1 < 2;\n}\nint main() {\n  compute();\n}\n"
+	readSource := func(path string) ([]byte, error) {
+		if path != "/src/main.c" {
+			return nil, fmt.Errorf("%s: not found", path)
+		}
+		return []byte(source), nil
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteHTMLReport(b, prof, 0, readSource); err != nil {
+		t.Fatal(err)
+	}
+	report := b.String()
+
+	for _, want := range []string{
+		// Flame graph frames, with widths relative to their parent.
+		`style="width: 75.0000%"`,
+		`title="compute: 3.00us (75.00%)"`,
+		`title="write: 1.00us (25.00%)"`,
+		// Annotated source, escaped.
+		`<td class="value">3.00us</td><td class="value">3.00us</td><td class="number">2</td><td>  return 1 &lt; 2;</td>`,
+		`<td class="value"></td><td class="value">4.00us</td><td class="number">5</td><td>  compute();</td>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+
+	// Functions are sorted by flat value, the ones without source are listed
+	// without annotations.
+	if i, j := strings.Index(report, "<h3>compute</h3>"), strings.Index(report, "<h3>write</h3>"); i < 0 || j < i {
+		t.Error("functions are not sorted by flat value")
+	}
+	if n := strings.Count(report, "Source not available."); n != 1 {
+		t.Errorf("wrong number of functions without source: %d", n)
+	}
+
+	b.Reset()
+	if err := WriteHTMLReport(b, prof, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(b.String(), "<h3>"); n != 1 {
+		t.Errorf("wrong number of functions reported: %d", n)
+	}
+}
@@ -0,0 +1,329 @@
+package wzprof
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Variable holding the execution context of the running Ruby thread. The
+// wasm32-wasi builds of CRuby have no threads, it is a regular global.
+const rubyExecutionContextName = "ruby_current_ec"
+
+// Try to detect if the module is a CRuby interpreter (e.g. ruby.wasm) by
+// looking for the function running the VM loop and the one initializing the
+// interpreter in the name section (names are prefixed by their length).
+func binIsCRuby(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("\x0cvm_exec_core")) &&
+		bytes.Contains(names, []byte("\x09ruby_init"))
+}
+
+// Matches the beginning of ruby_description, e.g. "ruby 3.2.2 (2023-03-30
+// revision e51014f9c0) [wasm32-wasi]".
+var rubyVersionRegexp = regexp.MustCompile(`ruby 3\.(\d+)\.\d+`)
+
+// rubyVersion returns the minor version of the CRuby 3 interpreter compiled in
+// the module, or zero if the module is not CRuby.
+func rubyVersion(wasmbin []byte) uint32 {
+	if !binIsCRuby(wasmbin) {
+		return 0
+	}
+	data := wasmdataSection(wasmbin)
+	if data == nil {
+		return 0
+	}
+	m := rubyVersionRegexp.FindSubmatch(data)
+	if m == nil {
+		return 0
+	}
+	minor, err := strconv.ParseUint(string(m[1]), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(minor)
+}
+
+// rubyLayout returns the layout of the CRuby structures for a minor version of
+// Ruby 3, or an error if the version is not supported.
+func rubyLayout(minor uint32) (*rbLayout, error) {
+	layout := rbLayouts[minor]
+	if layout == nil {
+		return nil, fmt.Errorf("unsupported CRuby version 3.%d (supported versions are 3.2 and 3.3)", minor)
+	}
+	return layout, nil
+}
+
+func prepareRuby(mod wazero.CompiledModule, layout *rbLayout) (*ruby, error) {
+	p, err := newDwarfparser(mod)
+	if err != nil {
+		return nil, fmt.Errorf("could not build dwarf parser: %w", err)
+	}
+	addr := pythonAddress(p, rubyExecutionContextName)
+	if addr == 0 {
+		return nil, fmt.Errorf("could not find ruby execution context address (%s)", rubyExecutionContextName)
+	}
+	// The native frames of the interpreter and C extensions are symbolized
+	// with DWARF, the parser above has already been consumed.
+	p, err = newDwarfparser(mod)
+	if err != nil {
+		return nil, fmt.Errorf("could not build dwarf parser: %w", err)
+	}
+	return &ruby{
+		layout:  layout,
+		ecaddr:  ptr32(addr),
+		symbols: buildDwarfSymbolizer(p),
+	}, nil
+}
+
+type ruby struct {
+	layout  *rbLayout
+	ecaddr  ptr32 // rb_execution_context_t**
+	symbols symbolizer
+}
+
+// rbLayout holds the offsets of the fields of the CRuby structs read by wzprof
+// on wasm32, where VALUE and pointers are 4 bytes.
+type rbLayout struct {
+	// rb_execution_context_t.
+	vmStackInEC     uint32
+	vmStackSizeInEC uint32 // number of VALUEs
+	cfpInEC         uint32
+	// rb_control_frame_t, which are pushed from the end of the VM stack
+	// towards its start.
+	sizeControlFrame   uint32
+	pcInControlFrame   uint32
+	iseqInControlFrame uint32
+	epInControlFrame   uint32
+	// rb_iseq_t and rb_iseq_constant_body.
+	bodyInIseq            uint32
+	pathobjInIseqBody     uint32
+	labelInIseqBody       uint32
+	firstLinenoInIseqBody uint32
+	// RString, the characters are either embedded at ptrInString or pointed
+	// to by it.
+	lenInString uint32
+	ptrInString uint32
+	// RArray, the elements are either embedded at aryInArray or pointed to by
+	// ptrInArray.
+	aryInArray uint32
+	ptrInArray uint32
+}
+
+var rb32Layout = &rbLayout{
+	vmStackInEC:           0,
+	vmStackSizeInEC:       4,
+	cfpInEC:               8,
+	sizeControlFrame:      28,
+	pcInControlFrame:      0,
+	iseqInControlFrame:    8,
+	epInControlFrame:      16,
+	bodyInIseq:            8,
+	pathobjInIseqBody:     52,
+	labelInIseqBody:       60,
+	firstLinenoInIseqBody: 64,
+	lenInString:           8,
+	ptrInString:           12,
+	aryInArray:            8,
+	ptrInArray:            16,
+}
+
+// rbLayouts maps minor versions of Ruby 3 to the layout of their structs.
+var rbLayouts = map[uint32]*rbLayout{
+	2: rb32Layout,
+	3: rb32Layout,
+}
+
+// Layout of the CRuby structs which is the same in all supported versions.
+const (
+	// RBasic flags.
+	rbTypeMask   = 0x1f
+	rbTypeString = 0x05
+	rbTypeArray  = 0x07
+	rbFlUser1    = 1 << 13 // RSTRING_NOEMBED and RARRAY_EMBED_FLAG
+	// Flags of control frames, in ep[VM_ENV_DATA_INDEX_FLAGS].
+	rbFrameFlagFinish = 0x0020
+	rbFrameFlagCFrame = 0x0080
+)
+
+func (r *ruby) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	call, ok := fn.(interpcall)
+	if !ok {
+		return r.symbols.Locations(fn, pc)
+	}
+	return 0, []location{call.location()}
+}
+
+// Name of the function of the interpreter evaluating Ruby frames.
+const rbExecFunction = "vm_exec_core"
+
+// Stackiter returns an iterator over the native stack of the interpreter, where
+// each call to vm_exec_core is replaced by the Ruby frames it is evaluating.
+func (r *ruby) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	m := mod.Memory()
+	l := r.layout
+	ec := deref[ptr32](m, r.ecaddr)
+	if ec == 0 {
+		return wasmsi
+	}
+	vmstack := deref[ptr32](m, ec+ptr32(l.vmStackInEC))
+	vmstacksize := deref[uint32](m, ec+ptr32(l.vmStackSizeInEC))
+	s := rbStackIterators.Get().(*rbstackiter)
+	*s = rbstackiter{
+		wasmsi: wasmsi,
+		layout: l,
+		mem:    m,
+		cfp:    deref[ptr32](m, ec+ptr32(l.cfpInEC)),
+		end:    vmstack + ptr32(4*vmstacksize),
+	}
+	return s
+}
+
+var rbStackIterators = sync.Pool{
+	New: func() any { return new(rbstackiter) },
+}
+
+type rbstackiter struct {
+	wasmsi  experimental.StackIterator
+	layout  *rbLayout
+	mem     api.Memory
+	started bool
+	ruby    bool  // the current frame is a Ruby frame
+	last    bool  // the current frame is the last of its evaluation call
+	curr    ptr32 // rb_control_frame_t*
+	cfp     ptr32 // rb_control_frame_t*
+	end     ptr32 // end of the control frames
+}
+
+func (r *rbstackiter) release() {
+	*r = rbstackiter{}
+	rbStackIterators.Put(r)
+}
+
+func (r *rbstackiter) Next() bool {
+	if r.ruby && r.nextFrame() {
+		return true
+	}
+	r.ruby = false
+	if !r.wasmsi.Next() {
+		return false
+	}
+	// The first frame is the function called, which has not started
+	// evaluating Ruby frames yet.
+	if !r.started {
+		r.started = true
+		return true
+	}
+	if r.wasmsi.Function().Definition().Name() == rbExecFunction {
+		r.last = false
+		// Evaluation calls which have no Ruby frames are kept as native
+		// frames.
+		r.ruby = r.nextFrame()
+	}
+	return true
+}
+
+// nextFrame moves to the next Ruby frame evaluated by the current call to
+// vm_exec_core, returning false when there are none left. The frames of C
+// functions are skipped, they are part of the native stack.
+func (r *rbstackiter) nextFrame() bool {
+	l := r.layout
+	for !r.last && r.cfp != 0 && r.cfp < r.end {
+		r.curr = r.cfp
+		r.cfp += ptr32(l.sizeControlFrame)
+
+		ep := deref[ptr32](r.mem, r.curr+ptr32(l.epInControlFrame))
+		flags := uint32(0)
+		if ep != 0 {
+			flags = deref[uint32](r.mem, ep)
+		}
+		// The frame pushed by vm_exec_core when it was called is marked
+		// as finishing the evaluation.
+		r.last = flags&rbFrameFlagFinish != 0
+		if flags&rbFrameFlagCFrame != 0 {
+			continue
+		}
+		pc := deref[ptr32](r.mem, r.curr+ptr32(l.pcInControlFrame))
+		iseq := deref[ptr32](r.mem, r.curr+ptr32(l.iseqInControlFrame))
+		if pc != 0 && iseq != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rbstackiter) ProgramCounter() experimental.ProgramCounter {
+	if !r.ruby {
+		return r.wasmsi.ProgramCounter()
+	}
+	return experimental.ProgramCounter(deref[uint32](r.mem, r.curr+ptr32(r.layout.pcInControlFrame)))
+}
+
+// Function returns the Ruby method or block of the current frame. The line is
+// the first one of the method, the VM does not keep the line being executed
+// in control frames.
+func (r *rbstackiter) Function() experimental.InternalFunction {
+	if !r.ruby {
+		return r.wasmsi.Function()
+	}
+	l := r.layout
+	iseq := deref[ptr32](r.mem, r.curr+ptr32(l.iseqInControlFrame))
+	body := deref[ptr32](r.mem, iseq+ptr32(l.bodyInIseq))
+
+	// pathobj is either the path, or an array of the path and the real path.
+	pathobj := deref[ptr32](r.mem, body+ptr32(l.pathobjInIseqBody))
+	if rbType(r.mem, pathobj) == rbTypeArray {
+		pathobj = rbArrayIndex(r.mem, l, pathobj, 0)
+	}
+	return interpcall{
+		file: rbString(r.mem, l, pathobj),
+		name: rbString(r.mem, l, deref[ptr32](r.mem, body+ptr32(l.labelInIseqBody))),
+		line: deref[int32](r.mem, body+ptr32(l.firstLinenoInIseqBody)),
+	}
+}
+
+func (r *rbstackiter) Parameters() []uint64 {
+	if !r.ruby {
+		return r.wasmsi.Parameters()
+	}
+	// The arguments of Ruby calls are objects of the VM, the frames have no
+	// parameters of WebAssembly types.
+	return nil
+}
+
+// rbType returns the type of a VALUE, or zero if it is not a pointer to an
+// object (e.g. nil or a fixnum).
+func rbType(m vmem, v ptr32) uint32 {
+	if v < 0x100 || v&3 != 0 {
+		return 0
+	}
+	return deref[uint32](m, v) & rbTypeMask
+}
+
+func rbString(m vmem, l *rbLayout, v ptr32) string {
+	if rbType(m, v) != rbTypeString {
+		return ""
+	}
+	flags := deref[uint32](m, v)
+	length := deref[uint32](m, v+ptr32(l.lenInString))
+	p := v + ptr32(l.ptrInString)
+	if flags&rbFlUser1 != 0 { // not embedded
+		p = deref[ptr32](m, p)
+	}
+	return string(derefArray[byte](m, p, length))
+}
+
+func rbArrayIndex(m vmem, l *rbLayout, v ptr32, i uint32) ptr32 {
+	flags := deref[uint32](m, v)
+	p := v + ptr32(l.aryInArray)
+	if flags&rbFlUser1 == 0 { // not embedded
+		p = deref[ptr32](m, v+ptr32(l.ptrInArray))
+	}
+	return deref[ptr32](m, p+ptr32(4*i))
+}
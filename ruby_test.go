@@ -0,0 +1,146 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+func TestRubyVersion(t *testing.T) {
+	const names = "\x0cvm_exec_core\x09ruby_init"
+	tests := []struct {
+		name  string
+		names string
+		data  string
+		want  uint32
+	}{
+		{"cruby 3.2", names, "\x00ruby 3.2.2 (2023-03-30 revision e51014f9c0) [wasm32-wasi]\x00", 2},
+		{"cruby without version", names, "\x00hello\x00", 0},
+		{"not cruby", "\x04main", "\x00ruby 3.2.2\x00", 0},
+	}
+
+	for _, test := range tests {
+		wasm := testWasmModule(test.names, test.data)
+		if got := rubyVersion(wasm); got != test.want {
+			t.Errorf("%s: ruby version mismatch: want=3.%d got=3.%d", test.name, test.want, got)
+		}
+	}
+
+	p := ProfilingFor(testWasmModule(names, "\x00ruby 3.1.4\x00"))
+	if p.lang != ruby3 {
+		t.Fatalf("module not detected as ruby: %d", p.lang)
+	}
+	if _, err := rubyLayout(p.rbVersion); err == nil {
+		t.Error("expected an error for an unsupported ruby version")
+	}
+}
+
+func TestRubyStackIterator(t *testing.T) {
+	layout := rbLayouts[3]
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	put := func(addr, off, v uint32) {
+		binary.LittleEndian.PutUint32(mem.Bytes[addr+off:], v)
+	}
+	str := func(addr uint32, s string, embed bool) {
+		put(addr, 0, rbTypeString)
+		put(addr, layout.lenInString, uint32(len(s)))
+		if embed {
+			copy(mem.Bytes[addr+layout.ptrInString:], s)
+		} else {
+			put(addr, 0, rbTypeString|rbFlUser1)
+			put(addr, layout.ptrInString, addr+0x40)
+			copy(mem.Bytes[addr+0x40:], s)
+		}
+	}
+	// iseq at addr, its body at addr+0x100, and the strings after it.
+	iseq := func(addr uint32, label string, line int32) {
+		body := addr + 0x100
+		put(addr, layout.bodyInIseq, body)
+		str(addr+0x200, "script.rb", true)
+		// The path of the main script is an array of the path and the
+		// real path.
+		put(addr+0x300, 0, rbTypeArray|rbFlUser1)
+		put(addr+0x300, layout.aryInArray, addr+0x200)
+		put(addr+0x300, layout.aryInArray+4, addr+0x200)
+		str(addr+0x400, label, false)
+		put(body, layout.pathobjInIseqBody, addr+0x300)
+		put(body, layout.labelInIseqBody, addr+0x400)
+		put(body, layout.firstLinenoInIseqBody, uint32(line))
+	}
+	const ecaddr, ec, vmstack, vmstacksize = 0x100, 0x200, 0x1000, 0x400
+	end := uint32(vmstack + 4*vmstacksize)
+	frames := end - 4*layout.sizeControlFrame
+	put(ecaddr, 0, ec)
+	put(ec, layout.vmStackInEC, vmstack)
+	put(ec, layout.vmStackSizeInEC, vmstacksize)
+	put(ec, layout.cfpInEC, frames)
+
+	iseq(0x4000, "bar", 10)
+	iseq(0x5000, "foo", 5)
+	iseq(0x6000, "<main>", 1)
+	frame := func(i, iseq, flags uint32) {
+		cfp := frames + i*layout.sizeControlFrame
+		ep := 0x3000 + 16*i
+		put(cfp, layout.pcInControlFrame, 0x7000+i)
+		put(cfp, layout.iseqInControlFrame, iseq)
+		put(cfp, layout.epInControlFrame, ep)
+		put(ep, 0, flags)
+	}
+	// A C function called by bar, which was called from C by foo.
+	frame(0, 0x4000, rbFrameFlagCFrame)
+	frame(1, 0x4000, rbFrameFlagFinish)
+	frame(2, 0x5000, 0)
+	frame(3, 0x6000, rbFrameFlagFinish)
+
+	function := func(name string) *wazerotest.Function {
+		fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+		fn.FunctionName = name
+		return fn
+	}
+	main := function("main")
+	exec := function(rbExecFunction)
+	call := function("rb_funcall")
+	ext := function("ext_func")
+	wasmsi := experimental.NewStackIterator(
+		experimental.StackFrame{Function: ext},
+		experimental.StackFrame{Function: exec},
+		experimental.StackFrame{Function: call},
+		experimental.StackFrame{Function: exec},
+		experimental.StackFrame{Function: main},
+	)
+
+	r := &ruby{layout: layout, ecaddr: ecaddr}
+	mod := wazerotest.NewModule(mem, main, exec, call, ext)
+	si := r.Stackiter(mod, ext.Definition(), wasmsi)
+
+	var names, files []string
+	var lines []int32
+	for si.Next() {
+		f := si.Function()
+		names = append(names, f.Definition().Name())
+		if call, ok := f.(interpcall); ok {
+			files = append(files, call.file)
+			lines = append(lines, call.line)
+			if params := si.Parameters(); params != nil {
+				t.Errorf("%s: Ruby frames have no parameters: %v", call.name, params)
+			}
+			if def := f.Definition(); def.ModuleName() != call.file || def.ParamTypes() != nil {
+				t.Errorf("%s: wrong definition: module=%q params=%v", call.name, def.ModuleName(), def.ParamTypes())
+			}
+		}
+	}
+	if want := []string{"ext_func", "bar", "rb_funcall", "foo", "<main>", "main"}; !slices.Equal(names, want) {
+		t.Errorf("wrong stack: want=%q got=%q", want, names)
+	}
+	if want := []string{"script.rb", "script.rb", "script.rb"}; !slices.Equal(files, want) {
+		t.Errorf("wrong files: want=%q got=%q", want, files)
+	}
+	if want := []int32{10, 5, 1}; !slices.Equal(lines, want) {
+		t.Errorf("wrong lines: want=%d got=%d", want, lines)
+	}
+}
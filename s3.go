@@ -0,0 +1,178 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// S3Exporter is an Exporter uploading profiles to an S3 bucket, or to object
+// stores implementing the S3 API (e.g. MinIO, Cloudflare R2), for teams
+// archiving the profiles of their CI runs.
+//
+// Requests are signed with AWS Signature Version 4 and use path-style URLs
+// (e.g. https://s3.us-east-1.amazonaws.com/bucket/key), which are supported by
+// all the implementations of the API.
+type S3Exporter struct {
+	// Name of the bucket the profiles are uploaded to.
+	Bucket string
+	// Template of the keys of the profiles, the variables {module},
+	// {profile}, {time} and {sha} are replaced by the name of the module, the
+	// name of the profile (e.g. "cpu"), the time of the upload (e.g.
+	// 20230809T154502Z), and Commit. Default to DefaultS3Key.
+	Key string
+	// Name of the module and git commit (e.g. the one being tested in CI)
+	// the profiles were collected for, used in the keys.
+	Module string
+	Commit string
+	// Region of the bucket, default to us-east-1.
+	Region string
+	// Endpoint of the API, default to https://s3.<region>.amazonaws.com.
+	Endpoint string
+	// Credentials signing the requests, the session token is only needed for
+	// temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// HTTP client used to send requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// DefaultS3Key is the template of the keys of S3Exporter when none is set.
+const DefaultS3Key = "{module}/{time}-{profile}.pprof"
+
+// Export implements the Exporter interface.
+func (e *S3Exporter) Export(ctx context.Context, name string, prof *profile.Profile) error {
+	var body bytes.Buffer
+	if err := prof.Write(&body); err != nil {
+		return err
+	}
+
+	now := time.Now
+	if e.now != nil {
+		now = e.now
+	}
+	t := now().UTC()
+	key := e.Key
+	if key == "" {
+		key = DefaultS3Key
+	}
+	key = strings.NewReplacer(
+		"{module}", e.Module,
+		"{profile}", name,
+		"{time}", t.Format("20060102T150405Z"),
+		"{sha}", e.Commit,
+	).Replace(key)
+
+	region := e.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/" + s3Escape(e.Bucket) + "/" + s3Escape(strings.TrimPrefix(key, "/"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if e.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", e.SessionToken)
+	}
+	signS3Request(req, body.Bytes(), region, e.AccessKeyID, e.SecretAccessKey, t)
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("uploading profile to s3://%s/%s: %s", e.Bucket, key, res.Status)
+	}
+	return nil
+}
+
+// signS3Request adds the AWS Signature Version 4 of the request to its headers,
+// all the headers of the request are signed. The request must have no query.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(req *http.Request, body []byte, region, accessKeyID, secretAccessKey string, t time.Time) {
+	payloadHash := sha256.Sum256(body)
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := sortedKeys(headers)
+
+	canonical := new(strings.Builder)
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString("\n") // no query
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n")
+	canonical.WriteString(hex.EncodeToString(payloadHash[:]))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the characters of s which are not unreserved, the slashes
+// separating the segments of keys are preserved.
+func s3Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	b := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
@@ -3,6 +3,9 @@ package wzprof
 import (
 	"context"
 	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
@@ -21,20 +24,17 @@ func Flag(flag *bool, factory experimental.FunctionListenerFactory) experimental
 		if lstn == nil {
 			return nil
 		}
-		flagged := &flaggedFunctionListener{
+		return &flaggedFunctionListener{
 			flag: flag,
 			lstn: lstn,
 		}
-		flagged.stack.bits = flagged.bits[:]
-		return flagged
 	})
 }
 
 type flaggedFunctionListener struct {
-	flag  *bool
-	bits  [1]uint64
-	stack bitstack
-	lstn  experimental.FunctionListener
+	flag   *bool
+	stacks instanceState[bitstack]
+	lstn   experimental.FunctionListener
 }
 
 func (s *flaggedFunctionListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
@@ -45,17 +45,17 @@ func (s *flaggedFunctionListener) Before(ctx context.Context, mod api.Module, de
 		bit = 1
 	}
 
-	s.stack.push(bit)
+	s.stacks.load(mod).push(bit)
 }
 
 func (s *flaggedFunctionListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	if s.stack.pop() != 0 {
+	if s.stacks.load(mod).pop() != 0 {
 		s.lstn.After(ctx, mod, def, results)
 	}
 }
 
 func (s *flaggedFunctionListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
-	if s.stack.pop() != 0 {
+	if s.stacks.load(mod).pop() != 0 {
 		s.lstn.Abort(ctx, mod, def, err)
 	}
 }
@@ -68,6 +68,10 @@ func (s *flaggedFunctionListener) Abort(ctx context.Context, mod api.Module, def
 //
 // Giving a sampling rate of one or more disables sampling, function listeners
 // are invoked for all function calls.
+//
+// The calls are counted separately in each instance of the module, so that
+// instances running concurrently (e.g. the threads of a program) do not share
+// the state of the listeners.
 func Sample(sampleRate float64, factory experimental.FunctionListenerFactory) experimental.FunctionListenerFactory {
 	if sampleRate <= 0 {
 		return emptyFunctionListenerFactory{}
@@ -81,50 +85,223 @@ func Sample(sampleRate float64, factory experimental.FunctionListenerFactory) ex
 		if lstn == nil {
 			return nil
 		}
-		sampled := &sampledFunctionListener{
+		return &sampledFunctionListener{
 			cycle: cycle,
-			count: cycle,
 			lstn:  lstn,
 		}
-		sampled.stack.bits = sampled.bits[:]
+	})
+}
+
+// AdaptiveSampler adjusts the sampling rate of function listeners to hold the
+// time spent in them under a fraction of the execution time. All the functions
+// are sampled at the same rate, so the values of profiles are scaled by a
+// single ratio without favoring the functions called rarely.
+//
+// The rate is adjusted at a fixed interval from the time spent in the
+// listeners and the number of calls of all the functions during the interval.
+// The sampler is shared by all the listener factories it wraps, the overhead
+// is measured across all of them.
+type AdaptiveSampler struct {
+	maxOverhead float64
+	time        func() int64
+
+	mutex     sync.Mutex
+	listeners []*adaptiveFunctionListener
+	start     int64 // start of the current interval
+	update    atomic.Int64
+	cycle     atomic.Uint32
+
+	// Time spent in the listeners and number of sampled calls during the
+	// current interval.
+	hookTime atomic.Int64
+	sampled  atomic.Int64
+
+	// Number of calls and sampled calls since the sampler was created, up
+	// to the last interval.
+	totalCalls   atomic.Int64
+	totalSampled atomic.Int64
+}
+
+const (
+	// Interval at which the adaptive sampler adjusts the sampling rate.
+	adaptiveInterval = int64(100 * time.Millisecond)
+	// Upper bound of the sampling cycle, so that all functions keep getting
+	// sampled from time to time.
+	adaptiveMaxCycle = 1 << 20
+)
+
+// NewAdaptiveSampler creates a sampler holding the time spent in function
+// listeners under maxOverhead, which is a fraction of the execution time
+// between 0 and 1 (e.g. 0.02 for 2%).
+func NewAdaptiveSampler(maxOverhead float64) *AdaptiveSampler {
+	s := &AdaptiveSampler{
+		maxOverhead: maxOverhead,
+		time:        nanotime,
+	}
+	s.start = s.time()
+	s.update.Store(s.start + adaptiveInterval)
+	s.cycle.Store(1)
+	return s
+}
+
+// Sample returns a function listener factory which creates listeners where
+// calls to their Before/After methods are sampled at the rate adjusted by s.
+func (s *AdaptiveSampler) Sample(factory experimental.FunctionListenerFactory) experimental.FunctionListenerFactory {
+	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
+		lstn := factory.NewFunctionListener(def)
+		if lstn == nil {
+			return nil
+		}
+		sampled := &adaptiveFunctionListener{
+			sampler: s,
+			lstn:    lstn,
+		}
+
+		s.mutex.Lock()
+		s.listeners = append(s.listeners, sampled)
+		s.mutex.Unlock()
 		return sampled
 	})
 }
 
+// SampleRate returns the fraction of function calls sampled so far, which is
+// used to scale the values of profiles.
+func (s *AdaptiveSampler) SampleRate() float64 {
+	calls, sampled := s.totalCalls.Load(), s.totalSampled.Load()
+	if calls == 0 || sampled == 0 {
+		return 1
+	}
+	return float64(sampled) / float64(calls)
+}
+
+// observe records the time spent in a listener, and adjusts the sampling
+// rate when the interval is over.
+func (s *AdaptiveSampler) observe(start, end int64) {
+	s.hookTime.Add(end - start)
+	if end >= s.update.Load() && s.mutex.TryLock() {
+		if end >= s.update.Load() {
+			s.adjust(end)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// adjust computes the sampling cycle of the next interval. The number of
+// sampled calls affordable during an interval is derived from the average time
+// spent in listeners, the cycle samples that many of the calls made during the
+// interval. The mutex must be held.
+func (s *AdaptiveSampler) adjust(now int64) {
+	elapsed := now - s.start
+	hookTime := s.hookTime.Swap(0)
+	sampled := s.sampled.Swap(0)
+	s.start = now
+	s.update.Store(now + adaptiveInterval)
+
+	total := int64(0)
+	for _, l := range s.listeners {
+		total += l.calls.Swap(0)
+	}
+	s.totalCalls.Add(total)
+	s.totalSampled.Add(sampled)
+	Logger().Debug("adjusting sampling rates",
+		"calls", total,
+		"sampled", sampled,
+		"dropped", total-sampled,
+		"overhead", time.Duration(hookTime))
+	if total == 0 || sampled == 0 || elapsed <= 0 {
+		return
+	}
+
+	cost := float64(hookTime) / float64(sampled)
+	affordable := s.maxOverhead * float64(elapsed) / cost
+
+	cycle := uint32(adaptiveMaxCycle)
+	if c := math.Ceil(float64(total) / affordable); c < adaptiveMaxCycle {
+		cycle = uint32(math.Max(c, 1))
+	}
+	s.cycle.Store(cycle)
+}
+
+type adaptiveFunctionListener struct {
+	sampler *AdaptiveSampler
+	calls   atomic.Int64
+	states  instanceState[sampleState]
+	lstn    experimental.FunctionListener
+}
+
+func (s *adaptiveFunctionListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
+	bit := uint(0)
+	s.calls.Add(1)
+
+	state := s.states.load(mod)
+	if state.count++; state.count >= s.sampler.cycle.Load() {
+		state.count = 0
+		start := s.sampler.time()
+		s.lstn.Before(ctx, mod, def, params, stack)
+		s.sampler.sampled.Add(1)
+		s.sampler.observe(start, s.sampler.time())
+		bit = 1
+	}
+
+	state.stack.push(bit)
+}
+
+func (s *adaptiveFunctionListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if s.states.load(mod).stack.pop() != 0 {
+		start := s.sampler.time()
+		s.lstn.After(ctx, mod, def, results)
+		s.sampler.observe(start, s.sampler.time())
+	}
+}
+
+func (s *adaptiveFunctionListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	if s.states.load(mod).stack.pop() != 0 {
+		start := s.sampler.time()
+		s.lstn.Abort(ctx, mod, def, err)
+		s.sampler.observe(start, s.sampler.time())
+	}
+}
+
 type emptyFunctionListenerFactory struct{}
 
 func (emptyFunctionListenerFactory) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
 	return nil
 }
 
+// sampleState is the state of a sampled listener in an instance of a module,
+// since the instances of a module share the listeners of its functions.
+type sampleState struct {
+	count uint32   // calls since the last sampled call
+	stack bitstack // whether the calls in progress were sampled
+}
+
 type sampledFunctionListener struct {
-	count uint32
-	cycle uint32
-	bits  [1]uint64
-	stack bitstack
-	lstn  experimental.FunctionListener
+	cycle  uint32
+	states instanceState[sampleState]
+	lstn   experimental.FunctionListener
 }
 
 func (s *sampledFunctionListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
 	bit := uint(0)
 
-	if s.count--; s.count == 0 {
-		s.count = s.cycle
+	state := s.states.load(mod)
+	if state.count++; state.count == s.cycle {
+		state.count = 0
 		s.lstn.Before(ctx, mod, def, params, stack)
 		bit = 1
 	}
 
-	s.stack.push(bit)
+	state.stack.push(bit)
 }
 
 func (s *sampledFunctionListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	if s.stack.pop() != 0 {
+	if s.states.load(mod).stack.pop() != 0 {
 		s.lstn.After(ctx, mod, def, results)
 	}
 }
 
 func (s *sampledFunctionListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
-	if s.stack.pop() != 0 {
+	if s.states.load(mod).stack.pop() != 0 {
 		s.lstn.Abort(ctx, mod, def, err)
 	}
 }
@@ -2,7 +2,9 @@ package wzprof
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
@@ -97,3 +99,146 @@ func BenchmarkSampledFunctionListener(b *testing.B) {
 		)),
 	)
 }
+
+func TestAdaptiveSampler(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {}),
+		wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {}),
+	)
+	hot := module.Function(0).Definition()
+	cold := module.Function(1).Definition()
+
+	// Each sampled call spends 10µs in the listener.
+	const hookCost = int64(10 * time.Microsecond)
+	currentTime := int64(0)
+	n := map[uint32]int{}
+
+	s := NewAdaptiveSampler(0.01)
+	s.time = func() int64 { return currentTime }
+	s.start = 0
+	s.update.Store(adaptiveInterval)
+
+	factory := s.Sample(experimental.FunctionListenerFactoryFunc(
+		func(def api.FunctionDefinition) experimental.FunctionListener {
+			return experimental.FunctionListenerFunc(func(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) {
+				n[def.Index()]++
+				currentTime += hookCost
+			})
+		},
+	))
+	hotListener := factory.NewFunctionListener(hot)
+	coldListener := factory.NewFunctionListener(cold)
+	ctx := context.Background()
+
+	call := func(l experimental.FunctionListener, def api.FunctionDefinition, count int) {
+		for i := 0; i < count; i++ {
+			l.Before(ctx, module, def, nil, nil)
+			l.After(ctx, module, def, nil)
+		}
+	}
+
+	// All the calls are sampled during the first interval.
+	call(hotListener, hot, 1000)
+	call(coldListener, cold, 10)
+	if n[hot.Index()] != 1000 || n[cold.Index()] != 10 {
+		t.Fatalf("wrong number of sampled calls: %v", n)
+	}
+
+	// At the end of the interval, 1% of 100ms affords 100 sampled calls of
+	// 10µs, out of the 1011 calls of the two functions.
+	currentTime = adaptiveInterval
+	call(coldListener, cold, 1)
+
+	if cycle := s.cycle.Load(); cycle != 11 {
+		t.Errorf("wrong sampling cycle: want=11 got=%d", cycle)
+	}
+	if rate := s.SampleRate(); rate != 1 {
+		t.Errorf("wrong sample rate: want=1 got=%g", rate)
+	}
+
+	for k := range n {
+		delete(n, k)
+	}
+	// Both functions are sampled at the same rate, one call out of 11.
+	call(hotListener, hot, 1000)
+	call(coldListener, cold, 10)
+	if n[hot.Index()] != 90 || n[cold.Index()] != 0 {
+		t.Errorf("wrong number of sampled calls: %v", n)
+	}
+
+	currentTime = 2 * adaptiveInterval
+	call(coldListener, cold, 1)
+	if rate, want := s.SampleRate(), float64(1011+91)/float64(1011+1011); rate != want {
+		t.Errorf("wrong sample rate: want=%g got=%g", want, rate)
+	}
+}
+
+func TestSampledFunctionListenerInstances(t *testing.T) {
+	function := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+	modules := []*wazerotest.Module{
+		wazerotest.NewModule(nil, function),
+		wazerotest.NewModule(nil, function),
+	}
+	def := modules[0].Function(0).Definition()
+
+	var mutex sync.Mutex
+	n := map[api.Module]int{}
+	listener := experimental.FunctionListenerFactoryFunc(
+		func(def api.FunctionDefinition) experimental.FunctionListener {
+			return experimental.FunctionListenerFunc(func(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
+				mutex.Lock()
+				n[mod]++
+				mutex.Unlock()
+			})
+		},
+	)
+
+	flag := true
+	sampler := NewAdaptiveSampler(1)
+	sampler.time = func() int64 { return 0 }
+
+	for _, test := range []struct {
+		name    string
+		factory experimental.FunctionListenerFactory
+		want    int
+	}{
+		{"flag", Flag(&flag, listener), 1000},
+		{"sample", Sample(0.1, listener), 100},
+		// The clock of the sampler is stopped, the sampling rates are not
+		// adjusted and all calls are sampled.
+		{"adaptive", sampler.Sample(listener), 1000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for k := range n {
+				delete(n, k)
+			}
+			lstn := test.factory.NewFunctionListener(def)
+			ctx := context.Background()
+
+			// The instances of the module share the listeners of its
+			// functions, and call them concurrently.
+			var wg sync.WaitGroup
+			for _, mod := range modules {
+				wg.Add(1)
+				go func(mod api.Module) {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						for j := 0; j < 10; j++ {
+							lstn.Before(ctx, mod, def, nil, nil)
+						}
+						for j := 0; j < 10; j++ {
+							lstn.After(ctx, mod, def, nil)
+						}
+					}
+				}(mod)
+			}
+			wg.Wait()
+
+			for i, mod := range modules {
+				if n[mod] != test.want {
+					t.Errorf("wrong number of sampled calls of instance %d: want=%d got=%d", i, test.want, n[mod])
+				}
+			}
+		})
+	}
+}
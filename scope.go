@@ -0,0 +1,112 @@
+package wzprof
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Scope records the samples of a logical unit of work of the profiled program,
+// like one invocation of a function or the handling of a request, so platforms
+// embedding wazero can return the profile of a single request rather than the
+// one of the whole process.
+//
+// The samples of the calls made with the context of the scope are recorded by
+// the CPU and memory profilers of the Profiling it was started with, in their
+// own profiles and in the scope. CPU samples are only recorded while the CPU
+// profiler is started.
+type Scope struct {
+	p     *Profiling
+	start time.Time
+
+	mutex sync.Mutex
+	end   time.Time
+	cpu   stackCounterMap
+	alloc stackCounterMap
+}
+
+type scopeKey struct{}
+
+// StartScope starts a profile scope and returns a copy of ctx carrying it,
+// which must be used to make the calls of the scope. Scopes may be nested, the
+// calls are recorded in the innermost one.
+//
+//	ctx, scope := p.StartScope(ctx)
+//	_, err := fn.Call(ctx)
+//	scope.Stop()
+//	prof := scope.CPUProfile(sampleRate)
+func (p *Profiling) StartScope(ctx context.Context) (context.Context, *Scope) {
+	s := &Scope{
+		p:     p,
+		start: time.Now(),
+		cpu:   make(stackCounterMap),
+		alloc: make(stackCounterMap),
+	}
+	return context.WithValue(ctx, scopeKey{}, s), s
+}
+
+func contextScope(ctx context.Context) *Scope {
+	s, _ := ctx.Value(scopeKey{}).(*Scope)
+	return s
+}
+
+// Stop ends the scope, the calls made with its context after it stopped are
+// not recorded in the scope anymore. Calling Stop more than once has no
+// effect.
+func (s *Scope) Stop() {
+	s.mutex.Lock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	s.mutex.Unlock()
+}
+
+// CPUProfile returns the CPU profile of the calls of the scope, with the
+// sample types of CPUProfiler. The sample rate is the one of the profiler.
+func (s *Scope) CPUProfile(sampleRate float64) *profile.Profile {
+	samples, duration := s.snapshot(s.cpu)
+	return buildProfile(s.p, samples, s.start, duration, []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "cpu", Unit: "nanoseconds"},
+	}, []float64{1 / sampleRate, 1})
+}
+
+// MemoryProfile returns the profile of the allocations made by the calls of
+// the scope, with the alloc_objects and alloc_space sample types of
+// MemoryProfiler. The sample rate is the one of the profiler.
+func (s *Scope) MemoryProfile(sampleRate float64) *profile.Profile {
+	samples, duration := s.snapshot(s.alloc)
+	ratio := 1 / sampleRate
+	return buildProfile(s.p, samples, s.start, duration, []*profile.ValueType{
+		{Type: "alloc_objects", Unit: "count"},
+		{Type: "alloc_space", Unit: "bytes"},
+	}, []float64{ratio, ratio})
+}
+
+// snapshot returns a copy of the samples and the duration of the scope so
+// far, or until it was stopped.
+func (s *Scope) snapshot(counts stackCounterMap) (stackCounterMap, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	samples := make(stackCounterMap, len(counts))
+	for k, sc := range counts {
+		c := *sc
+		samples[k] = &c
+	}
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return samples, end.Sub(s.start)
+}
+
+func (s *Scope) observe(counts stackCounterMap, st stackTrace, value int64) {
+	s.mutex.Lock()
+	if s.end.IsZero() {
+		counts.observe(st, value)
+	}
+	s.mutex.Unlock()
+}
@@ -0,0 +1,98 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestScopeCPUProfile(t *testing.T) {
+	currentTime := int64(1)
+
+	p := ProfilingFor(nil)
+	cpu := p.CPUProfiler(
+		HostTime(true), // wazerotest functions are host functions
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	f := cpu.NewFunctionListener(module.Function(0).Definition())
+	stack := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	def := stack[0].Function.Definition()
+
+	call := func(ctx context.Context, duration int64) {
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += duration
+		f.After(ctx, module, def, nil)
+	}
+
+	cpu.StartProfile()
+	ctx, scope := p.StartScope(context.Background())
+	call(ctx, 10)
+	call(context.Background(), 20)
+	call(ctx, 30)
+	scope.Stop()
+	call(ctx, 40)
+
+	prof := scope.CPUProfile(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 2 || v[1] != 40 {
+		t.Errorf("wrong values of the scope: want=[2 40] got=%v", v)
+	}
+
+	prof = cpu.StopProfile(1)
+	if len(prof.Sample) != 1 || prof.Sample[0].Value[1] != 100 {
+		t.Errorf("the calls of the scope must be recorded in the profile: %v", prof.Sample)
+	}
+}
+
+func TestScopeMemoryProfile(t *testing.T) {
+	p := ProfilingFor(nil)
+	mem := p.MemoryProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 { return 0 })
+	malloc.FunctionName = "malloc"
+	module := wazerotest.NewModule(nil, malloc)
+	def := malloc.Definition()
+	lstn := mem.NewFunctionListener(def)
+
+	call := func(ctx context.Context, size uint64) {
+		lstn.Before(ctx, module, def, []uint64{size}, experimental.NewStackIterator(experimental.StackFrame{Function: malloc}))
+		lstn.After(ctx, module, def, []uint64{0})
+	}
+
+	ctx1, scope1 := p.StartScope(context.Background())
+	ctx2, scope2 := p.StartScope(context.Background())
+	call(ctx1, 8)
+	call(ctx2, 100)
+	call(ctx1, 16)
+	call(context.Background(), 1000)
+
+	for _, test := range []struct {
+		scope *Scope
+		want  [2]int64
+	}{
+		{scope1, [2]int64{2, 24}},
+		{scope2, [2]int64{1, 100}},
+	} {
+		prof := test.scope.MemoryProfile(1)
+		if len(prof.Sample) != 1 {
+			t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+		}
+		if v := prof.Sample[0].Value; len(v) != 2 || v[0] != test.want[0] || v[1] != test.want[1] {
+			t.Errorf("wrong values of the scope: want=%v got=%v", test.want, v)
+		}
+	}
+
+	prof := mem.NewProfile(1)
+	if v := prof.Sample[0].Value; v[0] != 4 || v[1] != 1124 {
+		t.Errorf("the allocations of the scopes must be recorded in the profile: %v", v)
+	}
+}
@@ -0,0 +1,166 @@
+package wzprof
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// SizeProfiler is the implementation of a static profile of the size of the
+// code of a module, like twiggy, which attributes the bytes of the code
+// section to the functions defined by the module. The functions are
+// symbolized like the ones of the other profiles, so the profile can be
+// broken down by function, file (e.g. with pprof -granularity=files) or
+// package, and size and speed investigations share the same names.
+//
+// The profiler does not record calls, it collects the definitions of the
+// functions of the module when it is compiled: it must be installed as the
+// function listener factory of the context the module is compiled with, and
+// the profiling prepared for the compiled module.
+//
+//	ctx = context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, size)
+//	mod, _ := runtime.CompileModule(ctx, wasm)
+//	_ = p.Prepare(mod)
+//	prof, err := size.NewProfile()
+//
+// The profiler generates samples of two types:
+// - "functions" counts the number of functions.
+// - "code_bytes" records the size of the body of the functions in the code
+// section.
+//
+// The samples of functions with a name qualified by a package (e.g. Go
+// packages, Rust crates or C++ namespaces) have a "package" label. Frames of
+// Go programs and of interpreted languages are resolved from the memory of
+// the guest at runtime, the functions of those modules are named after the
+// name section.
+type SizeProfiler struct {
+	p     *Profiling
+	mutex sync.Mutex
+	defs  []api.FunctionDefinition
+}
+
+func newSizeProfiler(p *Profiling) *SizeProfiler {
+	return &SizeProfiler{p: p}
+}
+
+// NewFunctionListener records the definitions of the functions defined by the
+// module, it returns nil since calls are not recorded.
+func (s *SizeProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if _, _, imported := def.Import(); !imported {
+		s.mutex.Lock()
+		s.defs = append(s.defs, def)
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// NewProfile returns the profile of the size of the functions of the module.
+// An error is returned if the functions of the module were not collected when
+// compiling it.
+func (s *SizeProfiler) NewProfile() (*profile.Profile, error) {
+	s.mutex.Lock()
+	defs := make([]api.FunctionDefinition, len(s.defs))
+	copy(defs, s.defs)
+	s.mutex.Unlock()
+
+	bodies := wasmFunctionBodies(s.p.wasm)
+	if len(defs) == 0 || len(defs) != len(bodies) {
+		return nil, fmt.Errorf("the functions of the module were not collected when compiling it: %d functions for %d function bodies", len(defs), len(bodies))
+	}
+	// The functions defined by the module follow the imported ones in the
+	// index space, in the order of their bodies in the code section.
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Index() < defs[j].Index() })
+
+	symbols := s.p.symbols
+	switch s.p.lang {
+	case golang, python3, ruby3, javascript:
+		symbols = namesymbolizer{}
+	}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "functions", Unit: "count"},
+			{Type: "code_bytes", Unit: "bytes"},
+		},
+		TimeNanos: time.Now().UnixNano(),
+		Comments:  s.p.comments,
+	}
+	mapping := s.p.moduleMapping()
+	prof.Mapping = []*profile.Mapping{mapping}
+
+	funcs := make(map[string]*profile.Function)
+	for i, def := range defs {
+		fn := sizeFunction{def: def, offset: bodies[i].offset}
+		call := s.p.symbolizeWith(symbols, fn, 1, true)
+		if call.address == 0 {
+			// Symbolizers without source offsets do not report the address
+			// of the function, which is still located in the code section.
+			call.address = bodies[i].offset
+		}
+		loc := locationForSymbols(call, funcs)
+		loc.ID = uint64(len(prof.Location)) + 1
+		loc.Mapping = mapping
+		prof.Location = append(prof.Location, loc)
+
+		sample := &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1, int64(bodies[i].size)},
+		}
+		// The first location is the one of the wasm function, the others
+		// are inlined in it.
+		if pkg := packageName(call.locations[0].HumanName, s.p.lang); pkg != "" {
+			sample.Label = map[string][]string{"package": {pkg}}
+		}
+		prof.Sample = append(prof.Sample, sample)
+	}
+
+	prof.Function = make([]*profile.Function, len(funcs))
+	for _, fn := range funcs {
+		prof.Function[fn.ID-1] = fn
+	}
+	setMappingFlags(mapping, prof.Location, true)
+	return prof, nil
+}
+
+// sizeFunction is a function of the module located at an offset of the code
+// section (e.g. the start of its body), for symbolizers.
+type sizeFunction struct {
+	def    api.FunctionDefinition
+	offset uint64
+}
+
+func (f sizeFunction) Definition() api.FunctionDefinition {
+	return f.def
+}
+
+func (f sizeFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+	return f.offset
+}
+
+// packageName returns the package of a function from its name: the import
+// path of Go packages (e.g. "net/http.(*Server).Serve"), or the outermost
+// namespace of the functions found in DWARF, like the crates of Rust and the
+// namespaces of C++ (e.g. "core:fmt:write" or "ns::Class::method(int)" once
+// demangled). It returns an empty string if the name is not qualified.
+func packageName(name string, lang language) string {
+	if lang == golang {
+		i := strings.LastIndexByte(name, '/')
+		if j := strings.IndexByte(name[i+1:], '.'); j > 0 {
+			return name[:i+1+j]
+		}
+		return ""
+	}
+	// Trait implementations of Rust are named after the type they are
+	// implemented for, e.g. "<alloc::vec::Vec<T> as core::ops::Drop>::drop".
+	name = strings.TrimLeft(name, "<&*")
+	if i := strings.IndexByte(name, ':'); i > 0 && !strings.ContainsAny(name[:i], " (<") {
+		return name[:i]
+	}
+	return ""
+}
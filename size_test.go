@@ -0,0 +1,103 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func testSizeProfile(t *testing.T, wasm []byte) *profile.Profile {
+	t.Helper()
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().
+		WithDebugInfoEnabled(true).
+		WithCustomSections(true))
+	defer runtime.Close(ctx)
+
+	p := ProfilingFor(wasm)
+	size := p.SizeProfiler()
+	mod, err := runtime.CompileModule(context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, size), wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := size.NewProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	return prof
+}
+
+func TestSizeProfile(t *testing.T) {
+	prof := testSizeProfile(t, testLoopModule())
+
+	sizes := make(map[string]int64)
+	for _, s := range prof.Sample {
+		sizes[s.Location[0].Line[0].Function.Name] += s.Value[1]
+	}
+	// Sizes of the bodies in the code section, including the declaration of
+	// the locals.
+	if sizes["outer"] != 6 || sizes["inner"] != 19 || len(sizes) != 2 {
+		t.Errorf("wrong sizes of the functions: %v", sizes)
+	}
+}
+
+func TestSizeProfileDWARF(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := testSizeProfile(t, wasm)
+
+	var total int64
+	for _, s := range prof.Sample {
+		total += s.Value[1]
+		fn := s.Location[0].Line[0].Function
+		if fn.Name == "main" && fn.Filename != "/home/thomas/src/github.com/stealthrocket/wzprof/internal/testdata/simple.c" {
+			t.Errorf("wrong file name of main: %q", fn.Filename)
+		}
+	}
+	if n := len(wasmFunctionBodies(wasm)); len(prof.Sample) != n {
+		t.Errorf("wrong number of functions: want=%d got=%d", n, len(prof.Sample))
+	}
+	if _, size := wasmCodeSection(wasm); total > int64(size) || total < int64(size)*9/10 {
+		t.Errorf("wrong total size of the functions: %d for a code section of %d bytes", total, size)
+	}
+
+	// Without the definitions collected at compile time, the profile cannot
+	// be built.
+	if _, err := ProfilingFor(wasm).SizeProfiler().NewProfile(); err == nil {
+		t.Error("expected an error building a size profile without compiling the module")
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	tests := []struct {
+		name string
+		lang language
+		want string
+	}{
+		{"net/http.(*Server).Serve", golang, "net/http"},
+		{"fmt.Println", golang, "fmt"},
+		{"main", golang, ""},
+		{"core:fmt:write", unknown, "core"},
+		{"ns::Class::method(int)", unknown, "ns"},
+		{"<alloc::vec::Vec<T> as core::ops::Drop>::drop", unknown, "alloc"},
+		{"printf_core", unknown, ""},
+		{"operator new(unsigned long)", unknown, ""},
+	}
+	for _, test := range tests {
+		if got := packageName(test.name, test.lang); got != test.want {
+			t.Errorf("%q: want=%q got=%q", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package wzprof
+
+import (
+	"context"
+	"crypto/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Span is a call to a function of the guest recorded by a SpanRecorder, in
+// the data model of the traces of OpenTelemetry.
+type Span struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Span of the call of a recorded function in progress when the function
+	// was called, zero for root spans.
+	ParentSpanID [8]byte
+	// Name of the function called.
+	Name string
+	// Start time of the call in nanoseconds since the unix epoch, and its
+	// duration.
+	TimeNanos     int64
+	DurationNanos int64
+	// Error which aborted the call, if any.
+	Error string
+}
+
+// SpanRecorder records the calls to selected functions of the guest as spans,
+// so the phases of the execution of the guest show up in distributed tracing
+// backends.
+//
+// The parent of a span is the span of the closest call of a recorded function
+// in the stack of the guest. Calls without a parent in the guest are children
+// of the span of their trace context, set by the host with WithTraceContext or
+// by the guest with the set_traceparent function of the host module, or start
+// a new trace.
+type SpanRecorder struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	match  *regexp.Regexp
+	calls  instanceState[spanCallStack]
+	spans  []Span
+	time   func() int64
+	active bool
+}
+
+// SpanOption is a type used to represent configuration options for
+// SpanRecorder instances created by Profiling.SpanRecorder.
+type SpanOption func(*SpanRecorder)
+
+// SpanMatch configures the functions recorded as spans to the ones with a
+// name matching the regular expression.
+//
+// Default to recording all functions.
+func SpanMatch(match *regexp.Regexp) SpanOption {
+	return func(r *SpanRecorder) { r.match = match }
+}
+
+// spanCallStack tracks the calls to recorded functions in progress in an
+// instance of the guest.
+type spanCallStack struct {
+	spans []spanCall
+}
+
+type spanCall struct {
+	Span
+	recorded bool
+}
+
+func newSpanRecorder(p *Profiling, options ...SpanOption) *SpanRecorder {
+	r := &SpanRecorder{
+		p:    p,
+		time: func() int64 { return time.Now().UnixNano() },
+	}
+	for _, opt := range options {
+		opt(r)
+	}
+	return r
+}
+
+// StartRecording begins recording spans. The method returns a boolean to
+// indicate whether starting the recording succeeded (e.g. false is returned
+// if it was already started).
+func (r *SpanRecorder) StartRecording() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active {
+		return false
+	}
+	r.active = true
+	return true
+}
+
+// StopRecording stops recording spans. Calls in progress are not recorded
+// when they return, the spans recorded until then remain available to Flush.
+func (r *SpanRecorder) StopRecording() {
+	r.mutex.Lock()
+	r.active = false
+	r.mutex.Unlock()
+}
+
+// Flush returns the spans of the calls which returned since the last call to
+// Flush, in the order they returned.
+func (r *SpanRecorder) Flush() []Span {
+	r.mutex.Lock()
+	spans := r.spans
+	r.spans = nil
+	r.mutex.Unlock()
+	return spans
+}
+
+// NewFunctionListener returns a function listener recording the calls to the
+// function passed as argument as spans, or nil if the function is not
+// recorded.
+func (r *SpanRecorder) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	name := wasmFunctionName(def)
+	if def.GoFunction() != nil {
+		name = def.DebugName()
+	}
+	if r.match != nil && !r.match.MatchString(name) {
+		return nil
+	}
+	return spanListener{r, name}
+}
+
+type spanListener struct {
+	*SpanRecorder
+	name string
+}
+
+func (r spanListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	r.mutex.Lock()
+	s := r.calls.load(mod)
+	call := spanCall{recorded: r.active}
+	if call.recorded {
+		call.Name = r.name
+		call.TimeNanos = r.time()
+		rand.Read(call.SpanID[:])
+		if parent, ok := s.parent(); ok {
+			call.TraceID = parent.TraceID
+			call.ParentSpanID = parent.SpanID
+		} else if tc, ok := r.traceContext(ctx); ok {
+			call.TraceID = tc.TraceID
+			call.ParentSpanID = tc.SpanID
+		} else {
+			rand.Read(call.TraceID[:])
+		}
+	}
+	s.spans = append(s.spans, call)
+	r.mutex.Unlock()
+}
+
+func (r spanListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	r.end(mod, nil)
+}
+
+func (r spanListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	r.end(mod, err)
+}
+
+func (r spanListener) end(mod api.Module, err error) {
+	now := r.time()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.calls.load(mod)
+	if len(s.spans) == 0 {
+		return
+	}
+	call := s.spans[len(s.spans)-1]
+	s.spans = s.spans[:len(s.spans)-1]
+	if !call.recorded || !r.active {
+		return
+	}
+	call.DurationNanos = now - call.TimeNanos
+	if err != nil {
+		call.Error = err.Error()
+	}
+	r.spans = append(r.spans, call.Span)
+}
+
+// traceContext returns the trace context of a call, the one of the host takes
+// precedence over the one of the guest like their labels.
+func (r *SpanRecorder) traceContext(ctx context.Context) (TraceContext, bool) {
+	if tc, ok := contextTraceContext(ctx); ok {
+		return tc, true
+	}
+	if tc := r.p.guestTrace.Load(); tc != nil {
+		return *tc, true
+	}
+	return TraceContext{}, false
+}
+
+// parent returns the span of the innermost recorded call in progress.
+func (s *spanCallStack) parent() (Span, bool) {
+	for i := len(s.spans) - 1; i >= 0; i-- {
+		if s.spans[i].recorded {
+			return s.spans[i].Span, true
+		}
+	}
+	return Span{}, false
+}
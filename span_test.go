@@ -0,0 +1,113 @@
+package wzprof
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestSpanRecorder(t *testing.T) {
+	p := ProfilingFor(testLoopModule())
+	spans := p.SpanRecorder(SpanMatch(regexp.MustCompile(`^(inner|outer)$`)))
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, spans)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, testLoopModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := runtime.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls made before the recording is started are not recorded.
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	spans.StartRecording()
+	for i := 0; i < 2; i++ {
+		if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spans.StopRecording()
+
+	recorded := spans.Flush()
+	if len(recorded) != 6 {
+		t.Fatalf("wrong number of spans: want=6 got=%d", len(recorded))
+	}
+	if len(spans.Flush()) != 0 {
+		t.Error("spans returned by multiple flushes")
+	}
+
+	// The spans are recorded when the calls return, the calls of inner are
+	// children of the call of outer, and each call of outer starts a trace.
+	for i := 0; i < 2; i++ {
+		inner1, inner2, outer := recorded[3*i], recorded[3*i+1], recorded[3*i+2]
+		if inner1.Name != "inner" || inner2.Name != "inner" || outer.Name != "outer" {
+			t.Fatalf("wrong spans: %q %q %q", inner1.Name, inner2.Name, outer.Name)
+		}
+		if outer.ParentSpanID != ([8]byte{}) {
+			t.Errorf("span of outer has a parent: %x", outer.ParentSpanID)
+		}
+		for _, inner := range []Span{inner1, inner2} {
+			if inner.TraceID != outer.TraceID || inner.ParentSpanID != outer.SpanID {
+				t.Errorf("span of inner is not a child of the span of outer: %+v %+v", inner, outer)
+			}
+			if inner.TimeNanos < outer.TimeNanos || inner.TimeNanos+inner.DurationNanos > outer.TimeNanos+outer.DurationNanos {
+				t.Errorf("span of inner not within the span of outer: %+v %+v", inner, outer)
+			}
+		}
+		if inner1.SpanID == inner2.SpanID {
+			t.Errorf("spans of inner have the same id: %x", inner1.SpanID)
+		}
+	}
+	if recorded[2].TraceID == recorded[5].TraceID {
+		t.Errorf("calls of outer in the same trace: %x", recorded[2].TraceID)
+	}
+}
+
+func TestSpanRecorderTraceContext(t *testing.T) {
+	p := ProfilingFor(testLoopModule())
+	spans := p.SpanRecorder(SpanMatch(regexp.MustCompile(`^outer$`)))
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, spans)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	instance, err := runtime.Instantiate(ctx, testLoopModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := TraceContext{TraceID: [16]byte{1}, SpanID: [8]byte{2}}
+	guest := TraceContext{TraceID: [16]byte{3}, SpanID: [8]byte{4}}
+	p.guestTrace.Store(&guest)
+
+	spans.StartRecording()
+	// The trace context of the host takes precedence over the one of the
+	// guest.
+	if _, err := instance.ExportedFunction("outer").Call(WithTraceContext(ctx, host)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	spans.StopRecording()
+
+	recorded := spans.Flush()
+	if len(recorded) != 2 {
+		t.Fatalf("wrong number of spans: want=2 got=%d", len(recorded))
+	}
+	for i, tc := range []TraceContext{host, guest} {
+		if s := recorded[i]; s.TraceID != tc.TraceID || s.ParentSpanID != tc.SpanID {
+			t.Errorf("span %d is not a child of the span of its trace context: %+v", i, s)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// StackProfiler is the implementation of a profiler recording the maximum size
+// of the stack of the guest in its linear memory, which helps size the stack
+// of programs deployed with little memory.
+//
+// Compilers based on LLVM (C, Rust, Zig, TinyGo, ...) and Go keep the stack
+// pointer in the first global of the module. The profiler reads it when
+// functions are called, the stack usage is the distance from the stack pointer
+// to the base of the stack: its highest value seen for LLVM programs, whose
+// stack grows down from the initial value of the stack pointer, and the upper
+// bound of the stack of the current goroutine for Go programs. The frames of
+// the functions which call no other functions are not measured.
+//
+// The profiler generates samples of two types:
+// - "calls" counts the number of calls.
+// - "stack_bytes" records the maximum stack usage of the calls (in bytes).
+type StackProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts map[uint64]*stackSample
+	trace  stackTrace
+	bases  instanceState[stackBase]
+	max    int64
+	start  time.Time
+}
+
+type stackSample struct {
+	stack stackTrace
+	value [2]int64 // calls, max stack bytes
+}
+
+func (s *stackSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *stackSample) sampleValue() []int64 {
+	return s.value[:]
+}
+
+// stackBase is the base of the stack of an instance of the guest, each thread
+// of programs built for the threads proposal runs in its own instance with its
+// own stack.
+type stackBase struct {
+	base uint32
+	seen bool
+}
+
+func newStackProfiler(p *Profiling) *StackProfiler {
+	return &StackProfiler{p: p}
+}
+
+// StartProfile begins recording the stack profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *StackProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(map[uint64]*stackSample)
+	p.start = time.Now()
+	p.max = 0
+	return true
+}
+
+// StopProfile stops recording and returns the stack profile. The method
+// returns nil if recording of the stack profile wasn't started.
+func (p *StackProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts = nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+
+	ratios := []float64{
+		1 / sampleRate,
+		// The maximum stack usage is an observed value which cannot be
+		// extrapolated from the sampling rate.
+		1,
+	}
+	prof := buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), ratios)
+	prof.DefaultSampleType = "stack_bytes"
+	return prof
+}
+
+// HighWaterMark returns the maximum stack usage observed by the profiler since
+// the profile was started, in bytes.
+func (p *StackProfiler) HighWaterMark() int64 {
+	p.mutex.Lock()
+	max := p.max
+	p.mutex.Unlock()
+	return max
+}
+
+// Name returns "stack".
+func (p *StackProfiler) Name() string {
+	return "stack"
+}
+
+// Desc returns a description of the stack profiler.
+func (p *StackProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *StackProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// stack profiler.
+func (p *StackProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "calls", Unit: "count"},
+		{Type: "stack_bytes", Unit: "bytes"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *StackProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("stack", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
+	})
+}
+
+// NewFunctionListener returns a function listener recording the stack usage
+// when the function passed as argument is called. AssemblyScript programs do
+// not keep a stack pointer in their first global, the method returns nil for
+// their functions.
+func (p *StackProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if p.p.lang == assemblyscript {
+		return nil
+	}
+	if def.GoFunction() == nil && !p.p.instrumented(def) {
+		return nil
+	}
+	return profilingListener{p.p, stackProfiler{p}}
+}
+
+type stackProfiler struct{ *StackProfiler }
+
+func (p stackProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	m, ok := mod.(experimental.InternalModule)
+	if !ok || m.NumGlobal() == 0 {
+		return
+	}
+	sp := m.Global(0)
+	if sp.Type() != api.ValueTypeI32 {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// The base of the stack is tracked even when the profile is not started.
+	usage := p.usage(m, p.bases.load(mod), uint32(sp.Get()))
+	if p.counts == nil {
+		return
+	}
+
+	p.trace = p.p.makeStackTrace(ctx, p.trace, si)
+	sample := p.counts[p.trace.key]
+	if sample == nil {
+		sample = &stackSample{stack: p.trace.clone()}
+		p.counts[p.trace.key] = sample
+	}
+	sample.value[0]++
+	if usage > sample.value[1] {
+		sample.value[1] = usage
+	}
+	if usage > p.max {
+		p.max = usage
+	}
+}
+
+func (p stackProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+}
+
+func (p stackProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+}
+
+// usage returns the number of bytes between the stack pointer and the base of
+// the stack. It must be called with the mutex held.
+func (p stackProfiler) usage(mod experimental.InternalModule, s *stackBase, sp uint32) int64 {
+	var base uint32
+	if p.p.lang == golang {
+		// The base of the stack is stack.hi in the g struct of the current
+		// goroutine, which the third global points to.
+		hi, ok := mod.Memory().ReadUint64Le(uint32(mod.Global(2).Get()) + 8)
+		if !ok {
+			return 0
+		}
+		base = uint32(hi)
+	} else {
+		if !s.seen {
+			// The stack of a new instance starts at the stack pointer of
+			// the first call seen.
+			s.base, s.seen = sp, true
+		}
+		if sp > s.base {
+			s.base = sp
+		}
+		base = s.base
+	}
+	if sp > base {
+		return 0
+	}
+	return int64(base - sp)
+}
@@ -0,0 +1,60 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestStackProfiler(t *testing.T) {
+	p := ProfilingFor(nil).StackProfiler()
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	sp := wazerotest.GlobalI32(4096)
+	module.Globals = []*wazerotest.Global{sp}
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+	stack0 := []experimental.StackFrame{{Function: module.Function(0), PC: 1}}
+	stack1 := append(stack0, experimental.StackFrame{Function: module.Function(1), PC: 2})
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+	ctx := context.Background()
+
+	// The stack grows down from the stack pointer of the first call.
+	call := func(usage int32) {
+		f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+		sp.Value = api.EncodeI32(4096 - usage)
+		f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+		f1.After(ctx, module, def1, nil)
+		sp.Value = api.EncodeI32(4096)
+		f0.After(ctx, module, def0, nil)
+	}
+
+	p.StartProfile()
+	call(100)
+	call(300)
+	call(200)
+	prof := p.StopProfile(1)
+
+	if len(prof.Sample) != 2 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	for _, sample := range prof.Sample {
+		want := []int64{3, 0}
+		if len(sample.Location) == 2 {
+			want = []int64{3, 300}
+		}
+		if sample.Value[0] != want[0] || sample.Value[1] != want[1] {
+			t.Errorf("wrong sample values for a stack of depth %d: want=%v got=%v", len(sample.Location), want, sample.Value)
+		}
+	}
+	if n := p.HighWaterMark(); n != 300 {
+		t.Errorf("wrong high-water mark: want=300 got=%d", n)
+	}
+}
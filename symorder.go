@@ -0,0 +1,100 @@
+package wzprof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteSymbolOrder writes the functions of a profile to w ordered by
+// decreasing weight, one symbol per line, in the format of the symbol ordering
+// files of linkers (e.g. --symbol-ordering-file of lld). Post-link optimizers
+// can consume the list to lay out the hot functions together or pick the ones
+// to inline, closing the loop from the profile to the optimization of the
+// module.
+//
+// The symbols are the ones of the functions of the module, which the inlined
+// functions are part of: the linkage names found in DWARF or the names of the
+// name section. Functions are ordered by flat value first, then by cumulative
+// value, so the callers on the hot paths follow the hot functions; functions
+// which do not contribute to the profile are omitted.
+//
+// The functions are weighted by the default sample type of the profile.
+func WriteSymbolOrder(w io.Writer, prof *profile.Profile) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return fmt.Errorf("profile has no sample types")
+	}
+
+	weights := make(map[string]*symbolWeight)
+	seen := make(map[*symbolWeight]struct{})
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		for k := range seen {
+			delete(seen, k)
+		}
+		for i, loc := range sample.Location {
+			if len(loc.Line) == 0 {
+				continue
+			}
+			// The last line of a location is the function it is part of,
+			// the others are inlined in it.
+			name := symbolName(loc.Line[len(loc.Line)-1].Function)
+			sw := weights[name]
+			if sw == nil {
+				sw = &symbolWeight{name: name}
+				weights[name] = sw
+			}
+			if i == 0 {
+				sw.flat += value
+			}
+			// Recursive functions are only accounted once per sample.
+			if _, ok := seen[sw]; !ok {
+				seen[sw] = struct{}{}
+				sw.cum += value
+			}
+		}
+	}
+
+	list := make([]*symbolWeight, 0, len(weights))
+	for _, sw := range weights {
+		if sw.flat != 0 || sw.cum != 0 {
+			list = append(list, sw)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		wi, wj := list[i], list[j]
+		if fi, fj := abs(wi.flat), abs(wj.flat); fi != fj {
+			return fi > fj
+		}
+		if ci, cj := abs(wi.cum), abs(wj.cum); ci != cj {
+			return ci > cj
+		}
+		return wi.name < wj.name
+	})
+
+	b := bufio.NewWriter(w)
+	for _, sw := range list {
+		b.WriteString(sw.name)
+		b.WriteByte('\n')
+	}
+	return b.Flush()
+}
+
+type symbolWeight struct {
+	name string
+	flat int64
+	cum  int64
+}
+
+// symbolName returns the name of the symbol of a function, which is its
+// mangled name for C++ and Rust.
+func symbolName(fn *profile.Function) string {
+	if fn.SystemName != "" {
+		return fn.SystemName
+	}
+	return fn.Name
+}
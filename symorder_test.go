@@ -0,0 +1,50 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteSymbolOrder(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", SystemName: "main"}
+	parse := &profile.Function{ID: 2, Name: "ns::parse(char const*)", SystemName: "_ZN2ns5parseEPKc"}
+	inlined := &profile.Function{ID: 3, Name: "ns::skip()", SystemName: "_ZN2ns4skipEv"}
+	malloc := &profile.Function{ID: 4, Name: "malloc"}
+	fib := &profile.Function{ID: 5, Name: "fib", SystemName: "fib"}
+	idle := &profile.Function{ID: 6, Name: "idle", SystemName: "idle"}
+
+	root := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	// The lines of a location start with the innermost inlined function.
+	parsing := &profile.Location{ID: 2, Line: []profile.Line{{Function: inlined}, {Function: parse}}}
+	leaf := &profile.Location{ID: 3, Line: []profile.Line{{Function: malloc}}}
+	recursive := &profile.Location{ID: 4, Line: []profile.Line{{Function: fib}}}
+	unused := &profile.Location{ID: 5, Line: []profile.Line{{Function: idle}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		DefaultSampleType: "samples",
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{leaf, parsing, root}, Value: []int64{3, 30}},
+			{Location: []*profile.Location{parsing, root}, Value: []int64{5, 10}},
+			{Location: []*profile.Location{recursive, recursive, root}, Value: []int64{3, 100}},
+			{Location: []*profile.Location{unused, root}, Value: []int64{0, 0}},
+		},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteSymbolOrder(b, prof); err != nil {
+		t.Fatal(err)
+	}
+	// The inlined function is part of parse. The recursive calls of fib are
+	// only accounted once, its values are the ones of malloc and the tie is
+	// broken by name. main has no flat value and follows them.
+	want := "_ZN2ns5parseEPKc\nfib\nmalloc\nmain\n"
+	if got := b.String(); got != want {
+		t.Errorf("wrong symbol order:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,302 @@
+package wzprof
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// SyscallProfiler is the implementation of a profiler recording the latency of
+// calls to host functions imported by the guest, whether they are part of WASI
+// or custom host modules.
+//
+// The profiler generates samples of three types:
+// - "calls" counts the number of calls to host functions.
+// - "latency" records the total time spent in the calls (in nanoseconds).
+// - "max_latency" records the longest call (in nanoseconds).
+//
+// Samples are attributed to the guest stacks calling the host functions, the
+// host function itself being the leaf of each stack. WriteSyscallSummary can
+// be used to print a breakdown of the profile by host function.
+type SyscallProfiler struct {
+	p      *Profiling
+	mutex  sync.Mutex
+	counts map[uint64]*syscallSample
+	calls  instanceState[syscallCallStack]
+	trace  stackTrace
+	time   func() int64
+	start  time.Time
+}
+
+// SyscallProfilerOption is a type used to represent configuration options for
+// SyscallProfiler instances created by Profiling.SyscallProfiler.
+type SyscallProfilerOption func(*SyscallProfiler)
+
+// SyscallTimeFunc configures the time function used by the syscall profiler to
+// measure the latency of host function calls.
+//
+// By default, the system's monotonic time is used.
+func SyscallTimeFunc(time func() int64) SyscallProfilerOption {
+	return func(p *SyscallProfiler) { p.time = time }
+}
+
+type syscallSample struct {
+	stack stackTrace
+	value [3]int64 // calls, latency, maxLatency
+}
+
+func (s *syscallSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *syscallSample) sampleValue() []int64 {
+	return s.value[:]
+}
+
+type syscallFrame struct {
+	start  int64
+	sample *syscallSample
+}
+
+// syscallCallStack is the stack of calls in progress of an instance of the guest.
+type syscallCallStack struct {
+	frames []syscallFrame
+}
+
+func newSyscallProfiler(p *Profiling, options ...SyscallProfilerOption) *SyscallProfiler {
+	s := &SyscallProfiler{
+		p:    p,
+		time: nanotime,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// StartProfile begins recording the syscall profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *SyscallProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(map[uint64]*syscallSample)
+	p.start = time.Now()
+	return true
+}
+
+// StopProfile stops recording and returns the syscall profile. The method
+// returns nil if recording of the syscall profile wasn't started.
+func (p *SyscallProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	p.mutex.Lock()
+	samples, start := p.counts, p.start
+	p.counts = nil
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+
+	for k, sample := range samples {
+		if sample.value[0] == 0 {
+			// The call was still in progress when the profile stopped.
+			delete(samples, k)
+		}
+	}
+
+	ratio := 1 / sampleRate
+	ratios := []float64{
+		ratio,
+		ratio,
+		// The maximum latency is an observed value which cannot be
+		// extrapolated from the sampling rate.
+		1,
+	}
+	return buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), ratios)
+}
+
+// Name returns "syscalls".
+func (p *SyscallProfiler) Name() string {
+	return "syscalls"
+}
+
+// Desc returns a description of the syscall profiler.
+func (p *SyscallProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *SyscallProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// syscall profiler.
+func (p *SyscallProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "calls", Unit: "count"},
+		{Type: "latency", Unit: "nanoseconds"},
+		{Type: "max_latency", Unit: "nanoseconds"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *SyscallProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("syscall", p.StartProfile, func() *profile.Profile {
+		return p.StopProfile(sampleRate)
+	})
+}
+
+// NewFunctionListener returns a function listener recording the latency of
+// calls to the function passed as argument, or nil if it is not a host
+// function.
+func (p *SyscallProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if def.GoFunction() == nil {
+		return nil
+	}
+	return profilingListener{p.p, syscallProfiler{p}}
+}
+
+type syscallProfiler struct{ *SyscallProfiler }
+
+func (p syscallProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	var frame syscallFrame
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+
+	if p.counts != nil {
+		p.trace = p.p.makeStackTrace(ctx, p.trace, si)
+		sample := p.counts[p.trace.key]
+		if sample == nil {
+			sample = &syscallSample{stack: p.trace.clone()}
+			p.counts[p.trace.key] = sample
+		}
+		frame = syscallFrame{
+			start:  p.time(),
+			sample: sample,
+		}
+	}
+
+	s.frames = append(s.frames, frame)
+	p.mutex.Unlock()
+}
+
+func (p syscallProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	p.mutex.Lock()
+	s := p.calls.load(mod)
+	i := len(s.frames) - 1
+	f := s.frames[i]
+	s.frames = s.frames[:i]
+
+	// Samples of a previous profile may be seen if the profile was restarted
+	// during the call, they are not part of the current profile anymore.
+	if f.sample != nil && p.counts[f.sample.stack.key] == f.sample {
+		latency := p.time() - f.start
+		f.sample.value[0]++
+		f.sample.value[1] += latency
+		if latency > f.sample.value[2] {
+			f.sample.value[2] = latency
+		}
+	}
+	p.mutex.Unlock()
+}
+
+func (p syscallProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
+
+// WriteSyscallSummary writes to w a table summarizing the calls recorded in a
+// profile generated by SyscallProfiler. For each host function, the table
+// reports the number of calls, and the total, mean, and max latency. Rows are
+// ordered by decreasing total latency.
+func WriteSyscallSummary(w io.Writer, prof *profile.Profile) error {
+	type summary struct {
+		name  string
+		calls int64
+		total int64
+		max   int64
+	}
+
+	var calls, latency, maxLatency = -1, -1, -1
+	for i, t := range prof.SampleType {
+		switch t.Type {
+		case "calls":
+			calls = i
+		case "latency":
+			latency = i
+		case "max_latency":
+			maxLatency = i
+		}
+	}
+	if calls < 0 || latency < 0 || maxLatency < 0 {
+		return fmt.Errorf("not a syscall profile: %v", prof.SampleType)
+	}
+
+	functions := make(map[string]*summary)
+	for _, sample := range prof.Sample {
+		name := "?"
+		if len(sample.Location) > 0 && len(sample.Location[0].Line) > 0 {
+			name = topFunctionName(sample.Location[0].Line[0].Function)
+		}
+		s := functions[name]
+		if s == nil {
+			s = &summary{name: name}
+			functions[name] = s
+		}
+		s.calls += sample.Value[calls]
+		s.total += sample.Value[latency]
+		if v := sample.Value[maxLatency]; v > s.max {
+			s.max = v
+		}
+	}
+
+	summaries := make([]*summary, 0, len(functions))
+	for _, s := range functions {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].total != summaries[j].total {
+			return summaries[i].total > summaries[j].total
+		}
+		return summaries[i].name < summaries[j].name
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "calls\ttotal\tmean\tmax\t \n")
+	for _, s := range summaries {
+		mean := int64(0)
+		if s.calls != 0 {
+			mean = s.total / s.calls
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t %s\n",
+			s.calls,
+			FormatValue(s.total, "nanoseconds"),
+			FormatValue(mean, "nanoseconds"),
+			FormatValue(s.max, "nanoseconds"),
+			s.name,
+		)
+	}
+	return tw.Flush()
+}
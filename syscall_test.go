@@ -0,0 +1,55 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+func TestSyscallProfilerLatency(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).SyscallProfiler(
+		SyscallTimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := newTestModule(nil, "main", "clock_time_get")
+
+	f := p.NewFunctionListener(module.Function(1).Definition())
+
+	// The first frame is the innermost function of the stack.
+	stack := []experimental.StackFrame{
+		{Function: module.Function(1)},
+		{Function: module.Function(0)},
+	}
+	def := stack[0].Function.Definition()
+	ctx := context.Background()
+
+	p.StartProfile()
+	for _, latency := range []int64{10, 40, 25} {
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		currentTime += latency
+		f.After(ctx, module, def, nil)
+	}
+
+	trace := makeStackTraceFromFrames(stack)
+	sample := p.counts[trace.key]
+	if sample == nil {
+		t.Fatal("stack not recorded")
+	}
+	if want := [3]int64{3, 75, 40}; sample.value != want {
+		t.Errorf("wrong sample values: want=%v got=%v", want, sample.value)
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteSyscallSummary(b, p.StopProfile(1)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "3 75ns 25ns 40ns clock_time_get" {
+		t.Errorf("wrong summary:\n%s", b.String())
+	}
+}
@@ -0,0 +1,9 @@
+(module
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+  (memory $memory 1)
+  (func $start
+    i32.const 3
+    call $proc_exit)
+  (export "_start" (func $start))
+  (export "memory" (memory $memory))
+)
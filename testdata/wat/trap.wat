@@ -0,0 +1,11 @@
+(module
+  (memory $memory 1)
+  (global $sp (mut i32) (i32.const 4096))
+  (func $fail (param $code i32)
+    unreachable)
+  (func $start
+    i32.const 7
+    call $fail)
+  (export "_start" (func $start))
+  (export "memory" (memory $memory))
+)
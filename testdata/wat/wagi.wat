@@ -0,0 +1,17 @@
+(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (memory $memory 1)
+  ;; The iovec at offset 0 points to the response at offset 16, which starts
+  ;; with the headers of the response in the CGI format.
+  (data (i32.const 0) "\10\00\00\00\20\00\00\00")
+  (data (i32.const 16) "Content-Type: text/plain\n\nhello\n")
+  (func $start
+    i32.const 1 ;; stdout
+    i32.const 0 ;; iovs
+    i32.const 1 ;; iovs_len
+    i32.const 8 ;; nwritten
+    call $fd_write
+    drop)
+  (export "_start" (func $start))
+  (export "memory" (memory $memory))
+)
@@ -0,0 +1,330 @@
+package wzprof
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Timeline records the begin and end of function calls in the guest to
+// reconstruct the exact sequence of execution, instead of the aggregated view
+// provided by profiles.
+//
+// The timeline can be exported in the Chrome Trace Event format, which can be
+// loaded in chrome://tracing or https://ui.perfetto.dev.
+//
+// Each instance of the guest records its events in its own buffer, so the
+// instances running concurrently do not contend on a lock of the timeline.
+type Timeline struct {
+	p     *Profiling
+	mutex sync.Mutex
+	names []*timelineName
+	// Buffers of the instances which recorded events since the timeline was
+	// started.
+	shards []*timelineShard
+	// Generation of the events recorded, incremented each time the timeline
+	// is started. The calls in progress when the timeline restarts began in
+	// a previous generation, their end is not recorded.
+	gen    atomic.Uint64
+	calls  instanceState[timelineCallStack]
+	tids   atomic.Int32
+	count  atomic.Int64
+	start  int64
+	limit  int
+	time   func() int64
+	active atomic.Bool
+}
+
+// TimelineOption is a type used to represent configuration options for
+// Timeline instances created by Profiling.Timeline.
+type TimelineOption func(*Timeline)
+
+// DefaultTimelineLimit is the maximum number of events recorded by timelines
+// unless configured otherwise with TimelineLimit, which holds the memory used
+// by the events under a few tens of megabytes.
+const DefaultTimelineLimit = 1 << 20
+
+// TimelineLimit configures the maximum number of events recorded by a timeline.
+// Once the limit is reached, calls to new functions are not recorded anymore.
+// Zero or a negative value removes the limit.
+//
+// Default to DefaultTimelineLimit.
+func TimelineLimit(limit int) TimelineOption {
+	return func(t *Timeline) { t.limit = limit }
+}
+
+type timelineEvent struct {
+	time  int64
+	name  int32
+	tid   int32
+	begin bool
+}
+
+// timelineName is the name of a function of the timeline, resolved when it is
+// first called.
+type timelineName struct {
+	name atomic.Pointer[string]
+}
+
+// timelineShard holds the events recorded by an instance of the guest. Only
+// the instance appends events, the mutex synchronizes it with WriteTrace.
+type timelineShard struct {
+	mutex  sync.Mutex
+	events []timelineEvent
+}
+
+// timelineCallStack tracks the calls in progress of an instance of the guest,
+// whose events are recorded on their own thread of the trace.
+type timelineCallStack struct {
+	stack bitstack
+	tid   int32
+	gen   uint64
+	shard *timelineShard
+}
+
+// sync forgets the calls of the instance recorded in a previous generation
+// of the timeline, they do not record end events.
+func (s *timelineCallStack) sync(gen uint64) {
+	if s.gen != gen {
+		s.gen = gen
+		s.shard = nil
+		for i := range s.stack.bits {
+			s.stack.bits[i] = 0
+		}
+	}
+}
+
+func newTimeline(p *Profiling, options ...TimelineOption) *Timeline {
+	t := &Timeline{p: p, time: nanotime, limit: DefaultTimelineLimit}
+	for _, opt := range options {
+		opt(t)
+	}
+	return t
+}
+
+// StartTimeline begins recording events. The method returns a boolean to
+// indicate whether starting the timeline succeeded (e.g. false is returned if
+// it was already started).
+func (t *Timeline) StartTimeline() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.active.Load() {
+		return false
+	}
+	t.gen.Add(1)
+	t.shards = nil
+	t.count.Store(0)
+	t.start = t.time()
+	t.active.Store(true)
+	return true
+}
+
+// StopTimeline stops recording events. Events recorded until then remain
+// available to WriteTrace.
+func (t *Timeline) StopTimeline() {
+	t.active.Store(false)
+}
+
+// Count returns the number of events recorded in t.
+func (t *Timeline) Count() int {
+	return int(t.count.Load())
+}
+
+// WriteTrace writes the events recorded in the timeline to w in the JSON
+// Chrome Trace Event format.
+//
+// Calls that were still in progress when the timeline was stopped are left
+// open, trace viewers display them up to the end of the trace.
+func (t *Timeline) WriteTrace(w io.Writer) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	names := make([]string, len(t.names))
+	for i, name := range t.names {
+		s := ""
+		if p := name.name.Load(); p != nil {
+			s = *p
+		}
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		names[i] = string(b)
+	}
+
+	// The events of each instance are in the order they were recorded, the
+	// events of all the instances are interleaved by time.
+	var events []timelineEvent
+	for _, shard := range t.shards {
+		shard.mutex.Lock()
+		events = append(events, shard.events...)
+		shard.mutex.Unlock()
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time < events[j].time
+	})
+
+	b := bufio.NewWriter(w)
+	b.WriteString(`{"displayTimeUnit":"ns","traceEvents":[`)
+
+	var buf []byte
+	for i, e := range events {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		phase := `"E"`
+		if e.begin {
+			phase = `"B"`
+		}
+		buf = append(buf[:0], "\n{\"name\":"...)
+		buf = append(buf, names[e.name]...)
+		buf = append(buf, ",\"ph\":"...)
+		buf = append(buf, phase...)
+		buf = append(buf, ",\"ts\":"...)
+		// Timestamps are expressed in microseconds.
+		buf = strconv.AppendFloat(buf, float64(e.time-t.start)/1e3, 'f', 3, 64)
+		buf = append(buf, ",\"pid\":1,\"tid\":"...)
+		buf = strconv.AppendInt(buf, int64(e.tid), 10)
+		buf = append(buf, '}')
+		b.Write(buf)
+	}
+
+	b.WriteString("\n]}\n")
+	return b.Flush()
+}
+
+// NewFunctionListener returns a function listener recording the begin and end
+// of calls to the function passed as argument.
+//
+// The names of the functions of the guest are resolved with the symbolizer of
+// the profiling when they are first called, like the names of the functions
+// of profiles.
+func (t *Timeline) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	index := int32(len(t.names))
+	name := new(timelineName)
+	if def.GoFunction() != nil {
+		// Host functions are qualified by the name of their module
+		// (e.g. wasi_snapshot_preview1.fd_write).
+		s := def.DebugName()
+		name.name.Store(&s)
+	}
+	t.names = append(t.names, name)
+	return timelineListener{t, index, name}
+}
+
+// symbolize resolves the name of the function called first on the stack.
+func (t *Timeline) symbolize(name *timelineName, si experimental.StackIterator) {
+	if name.name.Load() != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if name.name.Load() != nil || !si.Next() {
+		return
+	}
+	fn, pc := si.Function(), si.ProgramCounter()
+	call := t.p.symbolizeWith(t.p.symbols, t.p.originalFunction(fn), pc, t.p.hasProgramCounter(pc))
+	// The function called is the last of the inlined ones.
+	s := call.locations[len(call.locations)-1].HumanName
+	name.name.Store(&s)
+}
+
+// reserve counts a begin event, returning false if the limit of events is
+// reached.
+func (t *Timeline) reserve() bool {
+	if t.limit <= 0 {
+		t.count.Add(1)
+		return true
+	}
+	for {
+		n := t.count.Load()
+		if n >= int64(t.limit) {
+			return false
+		}
+		if t.count.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// shard returns the buffer of events of the instance, which is registered in
+// the timeline when the instance records its first event.
+func (t *Timeline) shard(s *timelineCallStack) *timelineShard {
+	if s.shard == nil {
+		s.shard = new(timelineShard)
+		t.mutex.Lock()
+		if t.gen.Load() == s.gen {
+			t.shards = append(t.shards, s.shard)
+		}
+		t.mutex.Unlock()
+	}
+	return s.shard
+}
+
+type timelineListener struct {
+	*Timeline
+	index int32
+	name  *timelineName
+}
+
+func (t timelineListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	bit := uint(0)
+	s := t.calls.load(mod)
+	if s.stack.bits == nil {
+		// The instances are numbered in the order of their first call,
+		// starting with the thread 1 of the trace.
+		s.stack.bits, s.tid = make([]uint64, 1), t.tids.Add(1)
+	}
+	s.sync(t.gen.Load())
+
+	if t.active.Load() && t.reserve() {
+		t.symbolize(t.name, si)
+		shard := t.shard(s)
+		shard.mutex.Lock()
+		shard.events = append(shard.events, timelineEvent{
+			time:  t.time(),
+			name:  t.index,
+			tid:   s.tid,
+			begin: true,
+		})
+		shard.mutex.Unlock()
+		bit = 1
+	}
+
+	s.stack.push(bit)
+}
+
+func (t timelineListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	s := t.calls.load(mod)
+	s.sync(t.gen.Load())
+
+	// End events are recorded even past the limit or after the timeline was
+	// stopped, so that all the calls that were recorded are balanced.
+	if s.stack.pop() != 0 {
+		t.count.Add(1)
+		shard := t.shard(s)
+		shard.mutex.Lock()
+		shard.events = append(shard.events, timelineEvent{
+			time: t.time(),
+			name: t.index,
+			tid:  s.tid,
+		})
+		shard.mutex.Unlock()
+	}
+}
+
+func (t timelineListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	t.After(ctx, mod, def, nil)
+}
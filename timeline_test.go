@@ -0,0 +1,225 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+type timelineTrace struct {
+	TraceEvents []struct {
+		Name  string  `json:"name"`
+		Phase string  `json:"ph"`
+		Time  float64 `json:"ts"`
+		TID   int     `json:"tid"`
+	} `json:"traceEvents"`
+}
+
+func readTimeline(t *testing.T, timeline *Timeline) (events []string) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := timeline.WriteTrace(buf); err != nil {
+		t.Fatal(err)
+	}
+	var trace timelineTrace
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range trace.TraceEvents {
+		events = append(events, e.Phase+" "+e.Name)
+	}
+	return events
+}
+
+// guestFunction makes a function of wazerotest look like a function of the
+// guest instead of a host function, so its name is resolved by the symbolizer.
+type guestFunction struct{ api.Function }
+
+func (f guestFunction) Definition() api.FunctionDefinition {
+	return guestFunctionDefinition{f.Function.Definition()}
+}
+
+type guestFunctionDefinition struct{ api.FunctionDefinition }
+
+func (guestFunctionDefinition) GoFunction() any { return nil }
+
+func newTimelineTest(options ...TimelineOption) (*Timeline, func(i int), func(i int)) {
+	currentTime := int64(0)
+	timeline := ProfilingFor(nil).Timeline(options...)
+	timeline.time = func() int64 { currentTime += 1000; return currentTime }
+
+	main := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	main.FunctionName = "main"
+	rust := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	rust.FunctionName = "_ZN3std2rt10lang_start17h1b9e8a8c5c6d7e8fE"
+	module := wazerotest.NewModule(nil, main, rust)
+	ctx := context.Background()
+
+	functions := []api.Function{guestFunction{module.Function(0)}, guestFunction{module.Function(1)}}
+	listeners := make([]experimental.FunctionListener, len(functions))
+	for i, f := range functions {
+		listeners[i] = timeline.NewFunctionListener(f.Definition())
+	}
+	before := func(i int) {
+		def := functions[i].Definition()
+		si := experimental.NewStackIterator(experimental.StackFrame{Function: functions[i]})
+		listeners[i].Before(ctx, module, def, nil, si)
+	}
+	after := func(i int) {
+		listeners[i].After(ctx, module, functions[i].Definition(), nil)
+	}
+	return timeline, before, after
+}
+
+func assertTimelineEvents(t *testing.T, timeline *Timeline, want ...string) {
+	t.Helper()
+	got := readTimeline(t, timeline)
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of events: want=%q got=%q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("wrong event %d: want=%q got=%q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestTimelineNesting(t *testing.T) {
+	timeline, before, after := newTimelineTest()
+	timeline.StartTimeline()
+	before(0)
+	before(1)
+	after(1)
+	before(1)
+	after(1)
+	after(0)
+	timeline.StopTimeline()
+
+	// The names of functions are resolved by the symbolizer, which demangles
+	// them.
+	assertTimelineEvents(t, timeline,
+		"B main",
+		"B std::rt::lang_start",
+		"E std::rt::lang_start",
+		"B std::rt::lang_start",
+		"E std::rt::lang_start",
+		"E main",
+	)
+}
+
+func TestTimelinePairing(t *testing.T) {
+	timeline, before, after := newTimelineTest(TimelineLimit(2))
+	before(0) // not recorded, the timeline is not started
+	timeline.StartTimeline()
+	before(1)
+	before(1)
+	before(1) // past the limit
+	after(1)
+	after(1)
+	timeline.StopTimeline()
+	after(1) // recorded after stopping to balance the begin event
+	after(0)
+
+	assertTimelineEvents(t, timeline,
+		"B std::rt::lang_start",
+		"B std::rt::lang_start",
+		"E std::rt::lang_start",
+		"E std::rt::lang_start",
+	)
+}
+
+func TestTimelineRestart(t *testing.T) {
+	timeline, before, after := newTimelineTest()
+	timeline.StartTimeline()
+	before(0)
+	before(1)
+	timeline.StopTimeline()
+	timeline.StartTimeline()
+	// The calls in progress began in the previous timeline, their end
+	// events are not recorded.
+	after(1)
+	before(1)
+	after(1)
+	after(0)
+	timeline.StopTimeline()
+
+	assertTimelineEvents(t, timeline,
+		"B std::rt::lang_start",
+		"E std::rt::lang_start",
+	)
+}
+
+func TestTimelineInstances(t *testing.T) {
+	timeline := ProfilingFor(nil).Timeline(TimelineLimit(0))
+	var currentTime atomic.Int64
+	timeline.time = func() int64 { return currentTime.Add(1000) }
+
+	// The functions of wazerotest are host functions, their names are not
+	// symbolized. Each instance needs its own functions.
+	modules := []*wazerotest.Module{
+		newTestModule(nil, "main"),
+		newTestModule(nil, "main"),
+	}
+	def := modules[0].Function(0).Definition()
+	lstn := timeline.NewFunctionListener(def)
+	ctx := context.Background()
+	timeline.StartTimeline()
+
+	// The instances of the module share the listeners of its functions, and
+	// call them concurrently.
+	var wg sync.WaitGroup
+	for _, mod := range modules {
+		wg.Add(1)
+		go func(mod *wazerotest.Module) {
+			defer wg.Done()
+			def := mod.Function(0).Definition()
+			for i := 0; i < 100; i++ {
+				lstn.Before(ctx, mod, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: mod.Function(0)}))
+				lstn.After(ctx, mod, def, nil)
+			}
+		}(mod)
+	}
+	wg.Wait()
+	timeline.StopTimeline()
+
+	if n := timeline.Count(); n != 400 {
+		t.Errorf("wrong number of events: want=400 got=%d", n)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := timeline.WriteTrace(buf); err != nil {
+		t.Fatal(err)
+	}
+	var trace timelineTrace
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	// Each instance records its calls on its own thread, where the begin and
+	// end events alternate.
+	last := map[int]string{}
+	for i, e := range trace.TraceEvents {
+		if i > 0 && e.Time < trace.TraceEvents[i-1].Time {
+			t.Fatalf("events are not ordered by time: %v", trace.TraceEvents[i-1:i+1])
+		}
+		if e.Phase == last[e.TID] {
+			t.Fatalf("unbalanced events of thread %d", e.TID)
+		}
+		last[e.TID] = e.Phase
+	}
+	if len(last) != 2 {
+		t.Errorf("wrong number of threads: want=2 got=%d", len(last))
+	}
+}
+
+func TestTimelineDefaultLimit(t *testing.T) {
+	if limit := ProfilingFor(nil).Timeline().limit; limit != DefaultTimelineLimit {
+		t.Errorf("wrong default limit: want=%d got=%d", DefaultTimelineLimit, limit)
+	}
+}
@@ -0,0 +1,99 @@
+package wzprof
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Try to detect if the module was compiled by TinyGo. TinyGo does not leave a
+// marker in the modules it compiles, but its runtime always contains the
+// runtime.runtimePanic and runtime.alloc functions, which are looked up in the
+// name section (names are prefixed by their length).
+func binCompiledByTinyGo(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("\x14runtime.runtimePanic")) &&
+		bytes.Contains(names, []byte("\x0druntime.alloc"))
+}
+
+// TinyGo implements goroutines on wasm with the asyncify transformation of
+// binaryen: a goroutine is started by tinygo_launch and resumed by
+// tinygo_rewind, which the scheduler calls in a loop. The frames below those
+// functions belong to the scheduler and not to the goroutine.
+//
+// https://github.com/tinygo-org/tinygo/blob/v0.30.0/src/internal/task/task_asyncify_wasm.S
+var tinygoSchedulerEntries = map[string]struct{}{
+	"tinygo_launch": {},
+	"tinygo_rewind": {},
+}
+
+// Functions of the asyncify runtime, which only save and restore the state of
+// goroutines and are never interesting to profile.
+var tinygoAsyncifyFunctions = map[string]struct{}{
+	"tinygo_launch":         {},
+	"tinygo_rewind":         {},
+	"tinygo_unwind":         {},
+	"asyncify_start_unwind": {},
+	"asyncify_stop_unwind":  {},
+	"asyncify_start_rewind": {},
+	"asyncify_stop_rewind":  {},
+	"asyncify_get_state":    {},
+}
+
+// TinyGo emits the same DWARF name for all the wrappers which start
+// goroutines, the name of the function in the module is used instead so they
+// remain distinct.
+const tinygoGoroutineWrapper = "<goroutine wrapper>"
+
+// tinygoSymbolizer wraps the DWARF symbolizer to fix the names of goroutine
+// wrappers.
+type tinygoSymbolizer struct {
+	symbolizer
+}
+
+func (s tinygoSymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	addr, locs := s.symbolizer.Locations(fn, pc)
+	for i := range locs {
+		if locs[i].StableName == tinygoGoroutineWrapper || locs[i].HumanName == tinygoGoroutineWrapper {
+			name := fn.Definition().Name()
+			locs[i].StableName, locs[i].HumanName = name, name
+		}
+	}
+	return addr, locs
+}
+
+func tinygoStackIterator(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	s := tinygoStackIterators.Get().(*tinygostackiter)
+	s.StackIterator = wasmsi
+	return s
+}
+
+var tinygoStackIterators = sync.Pool{
+	New: func() any { return new(tinygostackiter) },
+}
+
+// tinygostackiter walks the wasm stack of the running goroutine, stopping at
+// the entry point of the goroutine so stacks do not include the scheduler, and
+// are the same whether the goroutine was started or resumed by it.
+type tinygostackiter struct {
+	experimental.StackIterator
+	done bool
+}
+
+func (s *tinygostackiter) release() {
+	*s = tinygostackiter{}
+	tinygoStackIterators.Put(s)
+}
+
+func (s *tinygostackiter) Next() bool {
+	if s.done || !s.StackIterator.Next() {
+		return false
+	}
+	if _, ok := tinygoSchedulerEntries[s.Function().Definition().Name()]; ok {
+		s.done = true
+		return false
+	}
+	return true
+}
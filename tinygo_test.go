@@ -0,0 +1,85 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func TestBinCompiledByTinyGo(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"testdata/tinygo/hello_world.wasm", true},
+		{"testdata/go/simple.wasm", false},
+		{"testdata/c/simple.wasm", false},
+	}
+
+	for _, test := range tests {
+		wasm, err := os.ReadFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binCompiledByTinyGo(wasm); got != test.want {
+			t.Errorf("%s: want=%t got=%t", test.path, test.want, got)
+		}
+	}
+}
+
+func TestTinyGoStacks(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/tinygo/hello_world.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProfilingFor(wasm)
+	cpu := p.CPUProfiler()
+	cpu.StartProfile()
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, cpu)
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true))
+	defer runtime.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(compiled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, sample := range cpu.StopProfile(1).Sample {
+		var names []string
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				names = append(names, line.Function.Name)
+			}
+		}
+		for _, name := range names {
+			if _, ok := tinygoAsyncifyFunctions[name]; ok {
+				t.Errorf("asyncify function found in stack: %q", names)
+			}
+			if name == "main.main" {
+				found = true
+				// The stack of the main goroutine starts at its wrapper,
+				// the scheduler frames are omitted.
+				if root := names[len(names)-1]; root != "runtime.run$1$gowrapper" {
+					t.Errorf("stack root mismatch: want=runtime.run$1$gowrapper got=%q", root)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Error("no samples of main.main found in the profile")
+	}
+}
@@ -0,0 +1,207 @@
+package wzprof
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteTop writes a table of the n functions with the highest flat values of
+// a profile to w, in a format similar to the output of `go tool pprof -top`.
+// When n is zero or negative, all functions are written.
+//
+// The values reported are the ones of the default sample type of the profile.
+// If the profile also has a sample type with the "count" unit, such as the
+// number of calls in CPU profiles or the number of allocations in memory
+// profiles, the flat counts are reported in an additional column.
+func WriteTop(w io.Writer, prof *profile.Profile, n int) error {
+	index := defaultSampleIndex(prof)
+	if index < 0 {
+		return nil
+	}
+	counts := -1
+	for i, t := range prof.SampleType {
+		if i != index && t.Unit == "count" {
+			counts = i
+			break
+		}
+	}
+
+	entries := make(map[string]*topEntry)
+	entry := func(name string) *topEntry {
+		e := entries[name]
+		if e == nil {
+			e = &topEntry{name: name}
+			entries[name] = e
+		}
+		return e
+	}
+
+	var total int64
+	seen := make(map[string]struct{})
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		total += value
+
+		if len(sample.Location) > 0 && len(sample.Location[0].Line) > 0 {
+			// The first line of the first location is the innermost function
+			// of the stack, which the sample is attributed to.
+			e := entry(topFunctionName(sample.Location[0].Line[0].Function))
+			e.flat += value
+			if counts >= 0 {
+				e.count += sample.Value[counts]
+			}
+		}
+
+		// Recursive functions appear multiple times in the stack but must
+		// only be accounted once in the cumulative values.
+		for k := range seen {
+			delete(seen, k)
+		}
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				name := topFunctionName(line.Function)
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					entry(name).cum += value
+				}
+			}
+		}
+	}
+
+	top := make([]*topEntry, 0, len(entries))
+	for _, e := range entries {
+		top = append(top, e)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].flat != top[j].flat {
+			return top[i].flat > top[j].flat
+		}
+		if top[i].cum != top[j].cum {
+			return top[i].cum > top[j].cum
+		}
+		return top[i].name < top[j].name
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+
+	unit := prof.SampleType[index].Unit
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "flat\tflat%\tsum%\tcum\tcum%\t")
+	if counts >= 0 {
+		fmt.Fprintf(tw, "%s\t", prof.SampleType[counts].Type)
+	}
+	fmt.Fprint(tw, " \n")
+
+	var sum int64
+	for _, e := range top {
+		sum += e.flat
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t",
+			FormatValue(e.flat, unit),
+			FormatPercent(e.flat, total),
+			FormatPercent(sum, total),
+			FormatValue(e.cum, unit),
+			FormatPercent(e.cum, total),
+		)
+		if counts >= 0 {
+			fmt.Fprintf(tw, "%d\t", e.count)
+		}
+		fmt.Fprintf(tw, " %s\n", e.name)
+	}
+	return tw.Flush()
+}
+
+// SampleTypeIndex returns the index of the sample type with the given name in
+// the profile, or the one of its default sample type if the name is empty.
+func SampleTypeIndex(prof *profile.Profile, name string) (int, error) {
+	if name == "" {
+		if index := defaultSampleIndex(prof); index >= 0 {
+			return index, nil
+		}
+		return 0, fmt.Errorf("profile has no sample types")
+	}
+	for i, t := range prof.SampleType {
+		if t.Type == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("sample type %q not found in profile", name)
+}
+
+// defaultSampleIndex returns the index of the default sample type of the
+// profile, or the last sample type if the profile has no default, which
+// matches the behavior of pprof. The functions writing profiles in other
+// formats report the values of this sample type, the CLI selects another one
+// with the -sample_index flag. The index is -1 if the profile has no sample
+// types.
+func defaultSampleIndex(prof *profile.Profile) int {
+	index := len(prof.SampleType) - 1
+	for i, t := range prof.SampleType {
+		if t.Type == prof.DefaultSampleType {
+			index = i
+		}
+	}
+	return index
+}
+
+type topEntry struct {
+	name  string
+	flat  int64
+	cum   int64
+	count int64
+}
+
+func topFunctionName(fn *profile.Function) string {
+	if fn == nil || fn.Name == "" {
+		return "?"
+	}
+	return fn.Name
+}
+
+// FormatValue formats a sample value of a profile for display, scaling values
+// in nanoseconds and bytes to the largest unit they have at least one of, e.g.
+// "1.50ms" for 1500000 nanoseconds.
+func FormatValue(v int64, unit string) string {
+	m := v
+	if m < 0 {
+		m = -m
+	}
+	switch unit {
+	case "nanoseconds":
+		switch {
+		case m >= 1e9:
+			return fmt.Sprintf("%.2fs", float64(v)/1e9)
+		case m >= 1e6:
+			return fmt.Sprintf("%.2fms", float64(v)/1e6)
+		case m >= 1e3:
+			return fmt.Sprintf("%.2fus", float64(v)/1e3)
+		default:
+			return fmt.Sprintf("%dns", v)
+		}
+	case "bytes":
+		switch {
+		case m >= 1<<30:
+			return fmt.Sprintf("%.2fGB", float64(v)/(1<<30))
+		case m >= 1<<20:
+			return fmt.Sprintf("%.2fMB", float64(v)/(1<<20))
+		case m >= 1<<10:
+			return fmt.Sprintf("%.2fkB", float64(v)/(1<<10))
+		default:
+			return fmt.Sprintf("%dB", v)
+		}
+	default:
+		return fmt.Sprintf("%d", v)
+	}
+}
+
+// FormatPercent formats v as a percentage of total.
+func FormatPercent(v, total int64) string {
+	if total == 0 {
+		return "0.00%"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+}
@@ -0,0 +1,170 @@
+package wzprof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteTop(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	compute := &profile.Function{ID: 2, Name: "compute"}
+	malloc := &profile.Function{ID: 3, Name: "malloc"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	computeLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: compute}}}
+	mallocLoc := &profile.Location{ID: 3, Line: []profile.Line{{Function: malloc}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{mallocLoc, computeLoc, mainLoc}, Value: []int64{2, 3e6}},
+			{Location: []*profile.Location{computeLoc, mainLoc}, Value: []int64{5, 5e6}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{1, 500e3}},
+			// The recursive calls of compute are accounted once in its
+			// cumulative value.
+			{Location: []*profile.Location{computeLoc, computeLoc, mainLoc}, Value: []int64{1, 1.5e6}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{
+			name: "all functions",
+			want: []string{
+				"flat flat% sum% cum cum% samples",
+				"6.50ms 65.00% 65.00% 9.50ms 95.00% 6 compute",
+				"3.00ms 30.00% 95.00% 3.00ms 30.00% 2 malloc",
+				"500.00us 5.00% 100.00% 10.00ms 100.00% 1 main",
+			},
+		},
+		{
+			name: "limited number of functions",
+			n:    1,
+			want: []string{
+				"flat flat% sum% cum cum% samples",
+				"6.50ms 65.00% 65.00% 9.50ms 95.00% 6 compute",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			if err := WriteTop(b, prof, test.n); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			got := make([]string, len(lines))
+			for i, line := range lines {
+				got[i] = strings.Join(strings.Fields(line), " ")
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("wrong top output:\nwant:\n%s\ngot:\n%s", strings.Join(test.want, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestWriteTopDefaultSampleType(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "malloc"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		DefaultSampleType: "alloc_objects",
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{loc}, Value: []int64{3, 3 << 20}},
+		},
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteTop(b, prof, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The counts column is omitted when the values are counts themselves.
+	want := "flat flat% sum% cum cum%\n3 100.00% 100.00% 3 100.00% malloc"
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Errorf("wrong top output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value int64
+		unit  string
+		want  string
+	}{
+		{0, "nanoseconds", "0ns"},
+		{999, "nanoseconds", "999ns"},
+		{1500, "nanoseconds", "1.50us"},
+		{2500000, "nanoseconds", "2.50ms"},
+		{-2500000, "nanoseconds", "-2.50ms"},
+		{3e9, "nanoseconds", "3.00s"},
+		{512, "bytes", "512B"},
+		{1536, "bytes", "1.50kB"},
+		{-1536, "bytes", "-1.50kB"},
+		{5 << 20, "bytes", "5.00MB"},
+		{2 << 30, "bytes", "2.00GB"},
+		{42, "count", "42"},
+	}
+
+	for _, test := range tests {
+		if got := FormatValue(test.value, test.unit); got != test.want {
+			t.Errorf("FormatValue(%d, %q): want=%q got=%q", test.value, test.unit, test.want, got)
+		}
+	}
+}
+
+func TestSampleTypeIndex(t *testing.T) {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		defaultType string
+		want        int
+		err         bool
+	}{
+		{name: "", want: 1},
+		{name: "", defaultType: "alloc_objects", want: 0},
+		{name: "", defaultType: "inuse_space", want: 1},
+		{name: "alloc_objects", defaultType: "alloc_space", want: 0},
+		{name: "cpu", err: true},
+	}
+
+	for _, test := range tests {
+		prof.DefaultSampleType = test.defaultType
+		index, err := SampleTypeIndex(prof, test.name)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: expected an error", test.name)
+		case !test.err && err != nil:
+			t.Errorf("%q: %v", test.name, err)
+		case !test.err && index != test.want:
+			t.Errorf("%q (default %q): want=%d got=%d", test.name, test.defaultType, test.want, index)
+		}
+	}
+
+	if _, err := SampleTypeIndex(&profile.Profile{}, ""); err == nil {
+		t.Error("expected an error for a profile without sample types")
+	}
+}
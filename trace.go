@@ -0,0 +1,268 @@
+package wzprof
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// CallTracer writes the calls to functions of the guest as JSON lines, with
+// their arguments, return values and duration. Where profiles aggregate the
+// calls, the trace shows each of them, which helps understand the exact
+// sequence of calls leading to a result.
+//
+// Each line is written when a call returns, so the calls made by a function
+// are written before it. The lines have the following fields:
+//
+//   - "time": start of the call, in nanoseconds since the trace was started
+//   - "instance": number of the instance of the module making the call,
+//     starting at 1 in the order of their first call
+//   - "depth": number of traced calls in progress in the instance when the
+//     call was made
+//   - "function": name of the function called
+//   - "params": arguments of the call
+//   - "results": return values of the call, absent if the call failed
+//   - "duration": duration of the call, in nanoseconds
+//   - "error": error which aborted the call, if any
+//
+// Integer values are written signed, floating point values which cannot be
+// represented in JSON (NaN and infinities) are written as strings.
+type CallTracer struct {
+	mutex    sync.Mutex
+	w        *bufio.Writer
+	buf      []byte
+	match    *regexp.Regexp
+	calls    instanceState[callTraceStack]
+	demangle bool
+	ids      int32
+	count    int
+	start    int64
+	time     func() int64
+	err      error
+	active   bool
+}
+
+// CallTracerOption is a type used to represent configuration options for
+// CallTracer instances created by Profiling.CallTracer.
+type CallTracerOption func(*CallTracer)
+
+// TraceMatch configures the functions traced by a call tracer to the ones
+// with a name matching the regular expression. Host functions are named after
+// their module and function names (e.g. wasi_snapshot_preview1.fd_write), the
+// demangled names of C++ and Rust functions are matched as well as their
+// symbols.
+//
+// Default to tracing all functions.
+func TraceMatch(match *regexp.Regexp) CallTracerOption {
+	return func(t *CallTracer) { t.match = match }
+}
+
+// callTraceStack tracks the calls in progress of an instance of the guest.
+type callTraceStack struct {
+	frames []callTraceFrame
+	id     int32
+}
+
+type callTraceFrame struct {
+	time   int64
+	params []uint64
+	traced bool
+}
+
+func newCallTracer(p *Profiling, w io.Writer, options ...CallTracerOption) *CallTracer {
+	t := &CallTracer{
+		w:        bufio.NewWriter(w),
+		demangle: p.demangle,
+		time:     nanotime,
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+	return t
+}
+
+// StartTrace begins writing the calls of the guest. The method returns a
+// boolean to indicate whether starting the trace succeeded (e.g. false is
+// returned if it was already started).
+func (t *CallTracer) StartTrace() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.active {
+		return false
+	}
+	t.active = true
+	t.start = t.time()
+	return true
+}
+
+// StopTrace stops writing the calls of the guest and flushes the lines
+// written to the underlying writer. The first error encountered writing the
+// trace is returned.
+//
+// Calls that are still in progress when the trace is stopped are not written
+// when they return.
+func (t *CallTracer) StopTrace() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.active = false
+	if err := t.w.Flush(); err != nil && t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// Count returns the number of calls written by t.
+func (t *CallTracer) Count() int {
+	t.mutex.Lock()
+	n := t.count
+	t.mutex.Unlock()
+	return n
+}
+
+// NewFunctionListener returns a function listener writing the calls to the
+// function passed as argument, or nil if the function is not traced.
+func (t *CallTracer) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	name := wasmFunctionName(def)
+	if def.GoFunction() != nil {
+		name = def.DebugName()
+	}
+	symbol := name
+	if t.demangle {
+		if human, ok := demangleCxx(name); ok {
+			name = human
+		} else if human, ok := demangleRust(name); ok {
+			name = human
+		}
+	}
+	if t.match != nil && !t.match.MatchString(name) && !t.match.MatchString(symbol) {
+		return nil
+	}
+	quoted, err := json.Marshal(name)
+	if err != nil {
+		return nil
+	}
+	return callTraceListener{t, quoted}
+}
+
+type callTraceListener struct {
+	*CallTracer
+	name []byte
+}
+
+func (t callTraceListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	t.mutex.Lock()
+	s := t.calls.load(mod)
+	if s.id == 0 {
+		t.ids++
+		s.id = t.ids
+	}
+	frame := callTraceFrame{traced: t.active}
+	if frame.traced {
+		// The parameters are only valid until the function returns.
+		frame.params = append([]uint64(nil), params...)
+		frame.time = t.time()
+	}
+	s.frames = append(s.frames, frame)
+	t.mutex.Unlock()
+}
+
+func (t callTraceListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	t.end(mod, def, results, nil)
+}
+
+func (t callTraceListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	t.end(mod, def, nil, err)
+}
+
+func (t callTraceListener) end(mod api.Module, def api.FunctionDefinition, results []uint64, err error) {
+	now := t.time()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := t.calls.load(mod)
+	if len(s.frames) == 0 {
+		return
+	}
+	depth := len(s.frames) - 1
+	frame := s.frames[depth]
+	s.frames = s.frames[:depth]
+	if !frame.traced || !t.active {
+		return
+	}
+
+	buf := append(t.buf[:0], `{"time":`...)
+	buf = strconv.AppendInt(buf, frame.time-t.start, 10)
+	buf = append(buf, `,"instance":`...)
+	buf = strconv.AppendInt(buf, int64(s.id), 10)
+	buf = append(buf, `,"depth":`...)
+	buf = strconv.AppendInt(buf, int64(depth), 10)
+	buf = append(buf, `,"function":`...)
+	buf = append(buf, t.name...)
+	buf = append(buf, `,"params":`...)
+	buf = appendTraceValues(buf, def.ParamTypes(), frame.params)
+	if err == nil {
+		buf = append(buf, `,"results":`...)
+		buf = appendTraceValues(buf, def.ResultTypes(), results)
+	}
+	buf = append(buf, `,"duration":`...)
+	buf = strconv.AppendInt(buf, now-frame.time, 10)
+	if err != nil {
+		msg, _ := json.Marshal(err.Error())
+		buf = append(buf, `,"error":`...)
+		buf = append(buf, msg...)
+	}
+	buf = append(buf, "}\n"...)
+	t.buf = buf
+
+	if _, err := t.w.Write(buf); err != nil && t.err == nil {
+		t.err = err
+	}
+	t.count++
+}
+
+// appendTraceValues appends the values of a call to buf as a JSON array,
+// decoded according to their types.
+func appendTraceValues(buf []byte, types []api.ValueType, values []uint64) []byte {
+	buf = append(buf, '[')
+	for i, v := range values {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		typ := api.ValueTypeI64
+		if i < len(types) {
+			typ = types[i]
+		}
+		switch typ {
+		case api.ValueTypeI32:
+			buf = strconv.AppendInt(buf, int64(api.DecodeI32(v)), 10)
+		case api.ValueTypeI64:
+			buf = strconv.AppendInt(buf, int64(v), 10)
+		case api.ValueTypeF32:
+			buf = appendTraceFloat(buf, float64(api.DecodeF32(v)), 32)
+		case api.ValueTypeF64:
+			buf = appendTraceFloat(buf, api.DecodeF64(v), 64)
+		default:
+			buf = strconv.AppendUint(buf, v, 10)
+		}
+	}
+	return append(buf, ']')
+}
+
+func appendTraceFloat(buf []byte, f float64, bitSize int) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		buf = append(buf, '"')
+		buf = strconv.AppendFloat(buf, f, 'g', -1, bitSize)
+		return append(buf, '"')
+	}
+	return strconv.AppendFloat(buf, f, 'g', -1, bitSize)
+}
@@ -0,0 +1,169 @@
+package wzprof
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+type testTraceLine struct {
+	Time     int64  `json:"time"`
+	Instance int    `json:"instance"`
+	Depth    int    `json:"depth"`
+	Function string `json:"function"`
+	Params   []any  `json:"params"`
+	Results  []any  `json:"results"`
+	Duration int64  `json:"duration"`
+	Error    string `json:"error"`
+}
+
+func readTestTrace(t *testing.T, b []byte) []testTraceLine {
+	t.Helper()
+	var lines []testTraceLine
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		var line testTraceLine
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			t.Fatalf("invalid trace line %q: %v", s.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestCallTracer(t *testing.T) {
+	var buf bytes.Buffer
+	p := ProfilingFor(testLoopModule())
+	tracer := p.CallTracer(&buf, TraceMatch(regexp.MustCompile(`^(inner|outer)$`)))
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, tracer)
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, testLoopModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := runtime.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls made before the trace is started are not written.
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tracer.StartTrace()
+	if _, err := instance.ExportedFunction("outer").Call(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.StopTrace(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readTestTrace(t, buf.Bytes())
+	if len(lines) != 3 || tracer.Count() != 3 {
+		t.Fatalf("wrong number of calls traced: want=3 got=%d (count=%d)", len(lines), tracer.Count())
+	}
+	// The calls are written when they return, the callees first.
+	for i, want := range []struct {
+		function string
+		depth    int
+	}{{"inner", 1}, {"inner", 1}, {"outer", 0}} {
+		line := lines[i]
+		if line.Function != want.function || line.Depth != want.depth || line.Instance != 1 {
+			t.Errorf("wrong call %d: %+v", i, line)
+		}
+		if len(line.Params) != 0 || line.Results == nil || len(line.Results) != 0 {
+			t.Errorf("wrong values of call %d: %+v", i, line)
+		}
+	}
+	outer := lines[2]
+	for _, inner := range lines[:2] {
+		if inner.Time < outer.Time || inner.Time+inner.Duration > outer.Time+outer.Duration {
+			t.Errorf("call of inner not within the call of outer: %+v %+v", inner, outer)
+		}
+	}
+	if lines[0].Time > lines[1].Time {
+		t.Errorf("calls of inner out of order: %+v %+v", lines[0], lines[1])
+	}
+}
+
+func TestCallTracerValues(t *testing.T) {
+	var buf bytes.Buffer
+	p := ProfilingFor(nil)
+	tracer := p.CallTracer(&buf, TraceMatch(regexp.MustCompile(`^env\.`)))
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, tracer)
+	// Calling host functions with listeners from the host crashes with the
+	// compiler of wazero, the calls are made with the interpreter.
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer runtime.Close(ctx)
+
+	env, err := runtime.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(a int32, b int64, c float32, d float64) (int32, float64) {
+			return a - 1, d * 2
+		}).
+		Export("values").
+		NewFunctionBuilder().
+		WithFunc(func(int32) { panic(errors.New("failed")) }).
+		Export("fail").
+		Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.StartTrace()
+	_, err = env.ExportedFunction("values").Call(ctx,
+		api.EncodeI32(-1),
+		api.EncodeI64(math.MaxInt64),
+		api.EncodeF32(1.5),
+		api.EncodeF64(math.Inf(1)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.ExportedFunction("fail").Call(ctx, 42); err == nil {
+		t.Error("the call of fail did not return an error")
+	}
+	if err := tracer.StopTrace(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readTestTrace(t, buf.Bytes())
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of calls traced: want=2 got=%d", len(lines))
+	}
+
+	values := lines[0]
+	if values.Function != "env.values" || values.Error != "" {
+		t.Errorf("wrong call: %+v", values)
+	}
+	wantParams := []any{-1.0, float64(math.MaxInt64), 1.5, "+Inf"}
+	if !reflect.DeepEqual(values.Params, wantParams) {
+		t.Errorf("wrong params: want=%v got=%v", wantParams, values.Params)
+	}
+	wantResults := []any{-2.0, "+Inf"}
+	if !reflect.DeepEqual(values.Results, wantResults) {
+		t.Errorf("wrong results: want=%v got=%v", wantResults, values.Results)
+	}
+
+	fail := lines[1]
+	if fail.Function != "env.fail" || fail.Error == "" || fail.Results != nil {
+		t.Errorf("wrong failed call: %+v", fail)
+	}
+	if !reflect.DeepEqual(fail.Params, []any{42.0}) {
+		t.Errorf("wrong params of the failed call: %v", fail.Params)
+	}
+}
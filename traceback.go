@@ -234,7 +234,7 @@ func (u *unwinder) resolveInternal(innermost bool) {
 		// We also defensively check that this won't switch M's on us,
 		// which could happen at critical points in the scheduler.
 		// This ensures gp.m doesn't change from a stack jump.
-		if u.flags&unwindJumpStack != 0 && gp == gMG0(u.mem, gp) && gMCurg(u.mem, gp) != 0 && ptr64(gMCurg(u.mem, gp)) == gM(u.mem, gp) {
+		if u.flags&unwindJumpStack != 0 && gp == gMG0(u.mem, gp) && gMCurg(u.mem, gp) != 0 && gM(u.mem, gMCurg(u.mem, gp)) == gM(u.mem, gp) {
 			switch f.FuncID {
 			case goruntime.FuncID_morestack:
 				// morestack does not return normally -- newstack()
@@ -463,7 +463,7 @@ func (u *inlineUnwinder) next(uf inlineFrame) inlineFrame {
 		uf.pc = 0
 		return uf
 	}
-	c := derefArrayIndex[inlinedCall](u.mem, u.inlTree, uf.index)
+	c := u.symbols.version.readInlinedCall(u.mem, u.inlTree, uf.index)
 	return u.resolveInternal(u.f.entry() + ptr64(c.parentPc))
 }
 
@@ -472,7 +472,7 @@ func (u *inlineUnwinder) srcFunc(uf inlineFrame) srcFunc {
 	if uf.index < 0 {
 		return u.f.srcFunc()
 	}
-	t := derefArrayIndex[inlinedCall](u.mem, u.inlTree, uf.index)
+	t := u.symbols.version.readInlinedCall(u.mem, u.inlTree, uf.index)
 	return srcFunc{
 		datap:     u.f.md,
 		nameOff:   t.nameOff,
@@ -0,0 +1,82 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+)
+
+// Names of the labels of the samples recorded in the context of a trace.
+const (
+	traceIDLabel = "trace_id"
+	spanIDLabel  = "span_id"
+)
+
+// TraceContext is the context of a distributed trace: the trace and the span
+// the calls made with it are part of.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// ParseTraceParent parses the value of a traceparent header of W3C Trace
+// Context, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+//
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func ParseTraceParent(traceparent string) (TraceContext, error) {
+	var tc TraceContext
+	// Versions following 00 may add fields after the ones it defines.
+	if len(traceparent) < 55 || (len(traceparent) > 55 && traceparent[55] != '-') {
+		return tc, fmt.Errorf("invalid traceparent: %q", traceparent)
+	}
+	version := traceparent[:2]
+	if !isLowerHex(version) || version == "ff" || (version == "00" && len(traceparent) != 55) {
+		return tc, fmt.Errorf("invalid traceparent version: %q", traceparent)
+	}
+	traceID, spanID, flags := traceparent[3:35], traceparent[36:52], traceparent[53:55]
+	if traceparent[2] != '-' || traceparent[35] != '-' || traceparent[52] != '-' ||
+		!isLowerHex(traceID) || !isLowerHex(spanID) || !isLowerHex(flags) {
+		return tc, fmt.Errorf("invalid traceparent: %q", traceparent)
+	}
+	hex.Decode(tc.TraceID[:], []byte(traceID))
+	hex.Decode(tc.SpanID[:], []byte(spanID))
+	if tc.TraceID == ([16]byte{}) || tc.SpanID == ([8]byte{}) {
+		return tc, fmt.Errorf("invalid traceparent: %q: ids must not be zero", traceparent)
+	}
+	return tc, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// labels returns the labels of the samples recorded in the trace context.
+func (tc TraceContext) labels() map[string]string {
+	return map[string]string{
+		traceIDLabel: hex.EncodeToString(tc.TraceID[:]),
+		spanIDLabel:  hex.EncodeToString(tc.SpanID[:]),
+	}
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a copy of ctx carrying a trace context, e.g. the
+// one of the request handled by the calls of functions made with it. The
+// samples recorded during the calls have the trace_id and span_id labels, so
+// the profile of a request can be found from its trace in trace-aware
+// backends, and the spans recorded by a SpanRecorder without a parent in the
+// guest are children of the span of the context.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	ctx = WithLabels(ctx, tc.labels())
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func contextTraceContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
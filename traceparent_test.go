@@ -0,0 +1,66 @@
+package wzprof
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TraceContext{
+		TraceID: [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:  [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	}
+	if tc != want {
+		t.Errorf("wrong trace context: want=%x got=%x", want, tc)
+	}
+
+	// Future versions may have more fields.
+	if _, err := ParseTraceParent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("future version: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.extra",
+	} {
+		if _, err := ParseTraceParent(invalid); err == nil {
+			t.Errorf("invalid traceparent parsed: %q", invalid)
+		}
+	}
+}
+
+func TestWithTraceContext(t *testing.T) {
+	tc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithLabels(context.Background(), map[string]string{"tenant": "a"})
+	ctx = WithTraceContext(ctx, tc)
+
+	want := map[string][]string{
+		"tenant":   {"a"},
+		"trace_id": {"4bf92f3577b34da6a3ce929d0e0e4736"},
+		"span_id":  {"00f067aa0ba902b7"},
+	}
+	if got := contextLabels(ctx).labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong labels: want=%v got=%v", want, got)
+	}
+	if got, ok := contextTraceContext(ctx); !ok || got != tc {
+		t.Errorf("wrong trace context: want=%x got=%x", tc, got)
+	}
+	if _, ok := contextTraceContext(context.Background()); ok {
+		t.Error("trace context found in the background context")
+	}
+}
@@ -0,0 +1,308 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// WallClockProfiler is the implementation of a sampling profiler which
+// periodically records the stack of the guest, regardless of how long the
+// function calls last.
+//
+// The CPU profiler attributes time to functions when they return, which does
+// not account well for long running functions (e.g. hot loops). Instead, the
+// wall-clock profiler keeps track of the current guest stack and captures it
+// at a fixed interval from a background goroutine.
+//
+// The listeners only push and pop the functions called on the stack of their
+// instance while a profile is running, the stack traces are built when the
+// sampler ticks.
+//
+// The profiler generates samples of two types:
+// - "samples" counts the number of times a stack was observed.
+// - "wall" records the wall-clock time spent in a stack (in nanoseconds).
+type WallClockProfiler struct {
+	p        *Profiling
+	mutex    sync.Mutex
+	counts   stackCounterMap
+	calls    instanceState[wallCallStack]
+	interval time.Duration
+	start    time.Time
+	done     chan struct{}
+	// Generation of the profile being recorded, or zero when the profiler is
+	// stopped. The stacks tracked during previous profiles are not sampled.
+	gen     atomic.Uint64
+	lastGen uint64
+	trace   stackTrace // reused by the sampler to build stack traces
+}
+
+// WallClockProfilerOption is a type used to represent configuration options
+// for WallClockProfiler instances created by WallClockProfiler.
+type WallClockProfilerOption func(*WallClockProfiler)
+
+// SampleInterval configures the interval at which the wall-clock profiler
+// captures the stack of the guest.
+//
+// Default to 10ms.
+func SampleInterval(interval time.Duration) WallClockProfilerOption {
+	return func(p *WallClockProfiler) { p.interval = interval }
+}
+
+const defaultSampleInterval = 10 * time.Millisecond
+
+func newWallClockProfiler(p *Profiling, options ...WallClockProfilerOption) *WallClockProfiler {
+	w := &WallClockProfiler{
+		p:        p,
+		interval: defaultSampleInterval,
+	}
+	for _, opt := range options {
+		opt(w)
+	}
+	if w.interval <= 0 {
+		w.interval = defaultSampleInterval
+	}
+	return w
+}
+
+// StartProfile begins recording the wall-clock profile. The method returns a
+// boolean to indicate whether starting the profile succeeded (e.g. false is
+// returned if it was already started).
+func (p *WallClockProfiler) StartProfile() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counts != nil {
+		return false // already started
+	}
+
+	p.counts = make(stackCounterMap)
+	p.start = time.Now()
+	p.done = make(chan struct{})
+	p.lastGen++
+	p.gen.Store(p.lastGen)
+	go p.run(p.done)
+	return true
+}
+
+// StopProfile stops recording and returns the wall-clock profile. The method
+// returns nil if recording of the profile wasn't started.
+//
+// Samples are collected at a fixed interval, so the values are not influenced
+// by the sampling rate of function calls and do not need to be scaled.
+func (p *WallClockProfiler) StopProfile() *profile.Profile {
+	p.mutex.Lock()
+	samples, start, done := p.counts, p.start, p.done
+	p.counts, p.done = nil, nil
+	p.gen.Store(0)
+	p.mutex.Unlock()
+
+	if samples == nil {
+		return nil
+	}
+	close(done)
+
+	prof := buildProfile(p.p, samples, start, time.Since(start), p.SampleType(), []float64{1, 1})
+	prof.PeriodType = &profile.ValueType{Type: "wall", Unit: "nanoseconds"}
+	prof.Period = int64(p.interval)
+	return prof
+}
+
+func (p *WallClockProfiler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.sample()
+		case <-done:
+			return
+		}
+	}
+}
+
+// wallCallStack is the stack of calls in progress of an instance of the guest.
+// The mutex is only contended when the sampler reads the stack.
+type wallCallStack struct {
+	mutex sync.Mutex
+	gen   uint64 // generation of the profile the stack is tracked in
+	// Functions on the stack of the instance and their program counters,
+	// starting with the entry point.
+	fns []experimental.InternalFunction
+	pcs []experimental.ProgramCounter
+	// Calls in progress, with the depth of the stack when they were made
+	// and the context they were made in. The frames below the first call
+	// were captured in the context ctx.
+	calls []wallCall
+	ctx   context.Context
+}
+
+type wallCall struct {
+	depth int
+	ctx   context.Context
+}
+
+// reset empties the stack of an instance seen for the first time in the
+// profile of generation gen.
+func (s *wallCallStack) reset(gen uint64) {
+	s.gen = gen
+	s.fns, s.pcs, s.calls, s.ctx = s.fns[:0], s.pcs[:0], s.calls[:0], nil
+}
+
+// sample records the stack currently tracked for each instance of the guest,
+// if any.
+func (p *WallClockProfiler) sample() {
+	p.mutex.Lock()
+	if gen := p.gen.Load(); p.counts != nil && gen != 0 {
+		p.calls.each(func(s *wallCallStack) {
+			s.mutex.Lock()
+			if s.gen == gen && len(s.fns) > 0 {
+				p.trace = s.stackTrace(p.trace)
+				p.counts.observe(p.trace, int64(p.interval))
+			}
+			s.mutex.Unlock()
+		})
+	}
+	p.mutex.Unlock()
+}
+
+// stackTrace builds the stack trace of the instance in st, with the top of
+// the stack first. The mutex of the stack must be held.
+func (s *wallCallStack) stackTrace(st stackTrace) stackTrace {
+	st.fns, st.pcs = st.fns[:0], st.pcs[:0]
+	for i := len(s.fns) - 1; i >= 0; i-- {
+		st.fns = append(st.fns, s.fns[i])
+		st.pcs = append(st.pcs, s.pcs[i])
+	}
+	ctx := s.ctx
+	if i := len(s.calls) - 1; i >= 0 {
+		ctx = s.calls[i].ctx
+	}
+	return st.withContext(ctx)
+}
+
+// Name returns "wall".
+func (p *WallClockProfiler) Name() string {
+	return "wall"
+}
+
+// Desc returns a description of the wall-clock profiler.
+func (p *WallClockProfiler) Desc() string {
+	return profileDescriptions[p.Name()]
+}
+
+// Count returns the number of execution stacks currently recorded in p.
+func (p *WallClockProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by the
+// wall-clock profiler.
+func (p *WallClockProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "wall", Unit: "nanoseconds"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is ignored since wall-clock samples are collected at a fixed
+// interval rather than on function calls.
+func (p *WallClockProfiler) NewHandler(sampleRate float64) http.Handler {
+	return newDurationHandler("wall-clock", p.StartProfile, p.StopProfile)
+}
+
+// NewFunctionListener returns a function listener tracking the stack of the
+// guest so it can be sampled by the profiler.
+func (p *WallClockProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !p.p.instrumented(def) {
+		return nil
+	}
+	return profilingListener{p.p, wallClockProfiler{p}}
+}
+
+type wallClockProfiler struct{ *WallClockProfiler }
+
+func (p wallClockProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	gen := p.gen.Load()
+	if gen == 0 || !si.Next() {
+		return
+	}
+	s := p.calls.load(mod)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.gen != gen {
+		s.reset(gen)
+	}
+	fn, pc := si.Function(), si.ProgramCounter()
+
+	switch n := len(s.fns); {
+	case !si.Next():
+		// The function is the entry point of the call stack.
+		s.fns, s.pcs, s.ctx = s.fns[:0], s.pcs[:0], ctx
+	case n > 0 && s.fns[n-1] == si.Function():
+		// The caller is at the top of the stack, only its program counter
+		// changed since it was called.
+		s.pcs[n-1] = si.ProgramCounter()
+	default:
+		// The caller is not tracked yet, e.g. because the call started
+		// before the profile or went through functions which are not
+		// instrumented, the whole stack is captured once.
+		s.fns, s.pcs, s.ctx = s.fns[:0], s.pcs[:0], ctx
+		for ok := true; ok; ok = si.Next() {
+			s.fns = append(s.fns, si.Function())
+			s.pcs = append(s.pcs, si.ProgramCounter())
+		}
+		for i, j := 0, len(s.fns)-1; i < j; i, j = i+1, j-1 {
+			s.fns[i], s.fns[j] = s.fns[j], s.fns[i]
+			s.pcs[i], s.pcs[j] = s.pcs[j], s.pcs[i]
+		}
+	}
+
+	s.calls = append(s.calls, wallCall{depth: len(s.fns), ctx: ctx})
+	s.fns = append(s.fns, fn)
+	s.pcs = append(s.pcs, pc)
+}
+
+func (p wallClockProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	gen := p.gen.Load()
+	if gen == 0 {
+		return
+	}
+	s := p.calls.load(mod)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.gen != gen {
+		return // the call started in a previous profile
+	}
+	i := len(s.calls) - 1
+	if i < 0 {
+		// The call started before the profile, the stack captured when it
+		// was first seen does not tell where it was called from.
+		s.reset(gen)
+		return
+	}
+	if depth := s.calls[i].depth; depth < len(s.fns) {
+		s.fns, s.pcs = s.fns[:depth], s.pcs[:depth]
+	}
+	s.calls[i].ctx = nil
+	s.calls = s.calls[:i]
+}
+
+func (p wallClockProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
@@ -0,0 +1,148 @@
+package wzprof
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestWallClockProfilerSample(t *testing.T) {
+	p := ProfilingFor(nil).WallClockProfiler(SampleInterval(time.Hour))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+
+	f0 := p.NewFunctionListener(module.Function(0).Definition())
+	f1 := p.NewFunctionListener(module.Function(1).Definition())
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+	}
+
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+		{Function: module.Function(1)},
+	}
+
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+
+	ctx := context.Background()
+	p.StartProfile()
+	defer p.StopProfile()
+
+	p.sample() // nothing on the stack
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	p.sample()
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	p.sample()
+	p.sample()
+	f1.After(ctx, module, def1, nil)
+	f0.After(ctx, module, def0, nil)
+	p.sample()
+
+	if n := p.Count(); n != 2 {
+		t.Errorf("wrong number of stacks recorded: want=2 got=%d", n)
+	}
+
+	interval := int64(time.Hour)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack0), 1, 1*interval)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack1), 2, 2*interval)
+}
+
+func TestWallClockProfilerRestart(t *testing.T) {
+	p := ProfilingFor(nil).WallClockProfiler(SampleInterval(time.Hour))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	main, f := module.Function(0), module.Function(1)
+	lmain := p.NewFunctionListener(main.Definition())
+	lf := p.NewFunctionListener(f.Definition())
+
+	// Stacks start with the function being called.
+	stackMain := []experimental.StackFrame{{Function: main}}
+	stackF := []experimental.StackFrame{{Function: f}, {Function: main}}
+	ctx := context.Background()
+
+	// Calls are not tracked while the profiler is stopped.
+	lmain.Before(ctx, module, main.Definition(), nil, experimental.NewStackIterator(stackMain...))
+	lmain.After(ctx, module, main.Definition(), nil)
+	n := 0
+	p.calls.each(func(*wallCallStack) { n++ })
+	if n != 0 {
+		t.Errorf("calls tracked while the profiler was stopped: %d instances", n)
+	}
+
+	p.StartProfile()
+	lmain.Before(ctx, module, main.Definition(), nil, experimental.NewStackIterator(stackMain...))
+	p.StopProfile()
+	p.StartProfile()
+	defer p.StopProfile()
+
+	p.sample() // the call of main started in the previous profile
+	lf.Before(ctx, module, f.Definition(), nil, experimental.NewStackIterator(stackF...))
+	p.sample()
+	lf.After(ctx, module, f.Definition(), nil)
+	p.sample()
+	lmain.After(ctx, module, main.Definition(), nil)
+	p.sample()
+
+	if n := p.Count(); n != 2 {
+		t.Errorf("wrong number of stacks recorded: want=2 got=%d", n)
+	}
+
+	interval := int64(time.Hour)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stackF), 1, interval)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stackMain), 1, interval)
+}
+
+func TestWallClockProfilerConcurrently(t *testing.T) {
+	p := ProfilingFor(nil).WallClockProfiler(SampleInterval(time.Millisecond))
+	p.StartProfile()
+
+	const instances, calls = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			module := wazerotest.NewModule(nil,
+				wazerotest.NewFunction(func(context.Context, api.Module) {}),
+				wazerotest.NewFunction(func(context.Context, api.Module) {}),
+			)
+			main, f := module.Function(0), module.Function(1)
+			lmain := p.NewFunctionListener(main.Definition())
+			lf := p.NewFunctionListener(f.Definition())
+			stackMain := []experimental.StackFrame{{Function: main}}
+			stackF := []experimental.StackFrame{{Function: f}, {Function: main}}
+			ctx := context.Background()
+
+			lmain.Before(ctx, module, main.Definition(), nil, experimental.NewStackIterator(stackMain...))
+			for j := 0; j < calls; j++ {
+				lf.Before(ctx, module, f.Definition(), nil, experimental.NewStackIterator(stackF...))
+				p.sample()
+				lf.After(ctx, module, f.Definition(), nil)
+			}
+			lmain.After(ctx, module, main.Definition(), nil)
+		}()
+	}
+	wg.Wait()
+
+	prof := p.StopProfile()
+	var count int64
+	for _, sample := range prof.Sample {
+		count += sample.Value[0]
+	}
+	if count < instances*calls {
+		t.Errorf("wrong number of samples: want>=%d got=%d", instances*calls, count)
+	}
+}
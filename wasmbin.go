@@ -64,6 +64,32 @@ func wasmdataSection(b []byte) []byte {
 	return nil
 }
 
+// wasmCodeSection parses a WASM binary and returns the offset and size of the
+// contents of the WASM "Code" section, which source offsets are relative to.
+// Returns zeros if the section does not exist.
+func wasmCodeSection(b []byte) (offset, size uint64) {
+	const codeSectionId = 10
+
+	if len(b) < 8 {
+		return 0, 0
+	}
+	offset = 8 // skip magic+version
+	b = b[8:]
+	for len(b) > 2 {
+		id := b[0]
+		length, n := binary.Uvarint(b[1:])
+		offset += 1 + uint64(n)
+		b = b[1+n:]
+
+		if id == codeSectionId {
+			return offset, length
+		}
+		offset += length
+		b = b[length:]
+	}
+	return 0, 0
+}
+
 // dataIterator iterates over the segments contained in a wasm Data section.
 // Only support mode 0 (memory 0 + offset) segments.
 type dataIterator struct {
@@ -2,13 +2,19 @@ package wzprof
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"hash/maphash"
+	"io"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
+	_ "unsafe" // for go:linkname
 
 	"github.com/google/pprof/profile"
 	"github.com/tetratelabs/wazero"
@@ -19,15 +25,265 @@ import (
 
 // Profiling mechanism for a given WASM binary. Entry point to generate
 // Profilers.
+//
+// The symbolization and stack unwinding state is safe to share between
+// instances of the module running concurrently, e.g. the threads of programs
+// built for the threads proposal, which run each thread in its own instance
+// over a shared memory. Profilers keep track of the calls in progress of each
+// instance separately and aggregate their samples in a single profile.
 type Profiling struct {
 	wasm []byte
 
 	onlyFunctions     map[string]struct{}
 	filteredFunctions map[string]struct{}
-	symbols           symbolizer
-	stackIterator     func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator
+	// Regular expressions selecting the functions instrumented by profilers
+	// tracking the calls of all functions, set by the Focus and Ignore
+	// options.
+	focus  *regexp.Regexp
+	ignore *regexp.Regexp
+
+	symbols       symbolizer
+	stackIterator func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator
+
+	// Names of the functions at the addresses of locations found in the
+	// profiles built so far, used to serve the pprof symbol endpoint.
+	addressMutex sync.Mutex
+	addressNames map[uint64]string
 
 	lang language
+	// Go guests only: minor version of the Go toolchain.
+	goVersion goVersion
+	// Python guests only: minor version of the CPython 3 interpreter.
+	pyVersion uint32
+	// Ruby guests only: minor version of the CRuby 3 interpreter.
+	rbVersion uint32
+	// Comments added to all the profiles, e.g. the build information of Go
+	// guests.
+	comments []string
+	// Whether mangled C++ and Rust symbols are shown demangled.
+	demangle bool
+	// Module holding the DWARF information of the profiled one, if it is
+	// not embedded in it.
+	debugInfo []byte
+	// Whether the locations of wasm functions are symbolized when building
+	// profiles, or recorded raw to be symbolized later.
+	symbolize bool
+	// Prefixes of the source file names replaced when symbolizing, set by
+	// SourcePathPrefix.
+	pathPrefixes []pathPrefix
+	// Whether the locations are resolved to the statements of the
+	// instructions, set by PreciseLocations.
+	preciseLocations bool
+	// Whether the module is run by the interpreter of wazero, set by
+	// Interpreter.
+	interpreter bool
+	// Number of frames of the deepest stack captured, new stack traces are
+	// sized to hold it. The initial value is set by StackDepth.
+	maxStackDepth atomic.Int64
+	// Path of the module and hash of its content, recorded in the mapping
+	// of the profiles.
+	path string
+	hash string
+	// Index of the global counting the instructions executed by the guest,
+	// and the map of offsets in the code section of the instrumented module
+	// to the original one, set by CountInstructions and CountOpcodes.
+	instructionCounter int64
+	sourceOffsets      *sourceOffsetMap
+	// Segments of instructions counting their executions in the globals
+	// following the instruction counter, set by CountOpcodes.
+	countedSegments []countedSegment
+
+	// Labels and trace context set by the guest with the host module, and
+	// whether the guest imports start_cpu to drive the CPU profiler.
+	guestMutex     sync.Mutex
+	guestLabels    atomic.Pointer[labelSet]
+	mergedLabels   atomic.Pointer[mergedLabels]
+	guestTrace     atomic.Pointer[TraceContext]
+	guestStartsCPU bool
+
+	// Whether samples are labeled with the thread of the instance which
+	// recorded them, the labels of each instance, and the number of threads
+	// seen so far.
+	threadLabels bool
+	threads      instanceState[threadState]
+	nthreads     atomic.Int64
+
+	// Width of the time windows the samples are labeled with, the time the
+	// windows are counted from, and the label of the last window seen.
+	timeLabels time.Duration
+	timeStart  int64
+	timeState  atomic.Pointer[timeState]
+
+	// Other modules prepared with PrepareModule, indexed by the definitions
+	// of their exported functions, and the module of each instance.
+	modules   map[api.FunctionDefinition]*Profiling
+	instances instanceState[moduleInstance]
+	// Hash of a module prepared with PrepareModule, mixed in the keys of
+	// its stack traces.
+	moduleKey uint64
+
+	// Whether the number of calls recorded by the profilers and the time
+	// spent in them are counted, set by Metrics.
+	metrics  bool
+	samples  atomic.Int64
+	overhead atomic.Int64
+}
+
+// ProfilingOption is a type used to represent configuration options for
+// Profiling instances created by ProfilingFor.
+type ProfilingOption func(*Profiling)
+
+// Demangle configures whether the names of C++ and Rust functions are shown
+// demangled in profiles (e.g. "ns::Class::method(int)"), the mangled names are
+// always kept as system names.
+//
+// Default to true.
+func Demangle(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.demangle = enable }
+}
+
+// DebugInfo configures the profiling to read DWARF information from a separate
+// wasm module instead of the profiled one, so production modules can be
+// stripped of their debug information. The module is usually the unstripped
+// build of the profiled module; if both have a build id, Prepare returns an
+// error when they differ.
+//
+// By default, DWARF information is read from the profiled module.
+func DebugInfo(wasm []byte) ProfilingOption {
+	return func(p *Profiling) { p.debugInfo = wasm }
+}
+
+// ModulePath sets the path of the profiled module, which is recorded in the
+// mapping of the profiles.
+func ModulePath(path string) ProfilingOption {
+	return func(p *Profiling) { p.path = path }
+}
+
+// Focus configures the profilers tracking the calls of all functions (CPU,
+// wall-clock, instruction and goroutine) to only instrument the functions with
+// a name matching the regular expression, e.g. the functions of the
+// application package. Functions which are not instrumented add no overhead,
+// their time is accounted to their callers.
+//
+// Default to instrumenting all functions.
+func Focus(re *regexp.Regexp) ProfilingOption {
+	return func(p *Profiling) { p.focus = re }
+}
+
+// Ignore configures the profilers tracking the calls of all functions (CPU,
+// wall-clock, instruction and goroutine) to not instrument the functions with
+// a name matching the regular expression, e.g. `^runtime\.` to leave out the
+// Go runtime. Ignore takes precedence over Focus.
+func Ignore(re *regexp.Regexp) ProfilingOption {
+	return func(p *Profiling) { p.ignore = re }
+}
+
+// Symbolize configures whether the locations of profiles are symbolized when
+// the profiles are built. When disabled, the locations of wasm functions are
+// recorded raw, as the index of the function and the offset of the call in the
+// code section, and the profiles carry the hash of the module so they can be
+// symbolized later with SymbolizeProfile. Frames of Go programs and of
+// interpreted languages are always symbolized since they are resolved from the
+// memory of the guest.
+//
+// Default to true.
+func Symbolize(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.symbolize = enable }
+}
+
+// SourcePathPrefix configures a prefix of the source file names found in the
+// debug information to be replaced by another when symbolizing, so the source
+// view of pprof finds the files on the machine of the analyst, e.g. to map the
+// /build/src directory of a CI runner to the local checkout of the program.
+// An empty replacement trims the prefix, leaving the file names relative.
+//
+// The prefix only matches whole path elements. The option may be repeated,
+// the first prefix matching a file name is replaced.
+func SourcePathPrefix(old, new string) ProfilingOption {
+	return func(p *Profiling) {
+		p.pathPrefixes = append(p.pathPrefixes, pathPrefix{old: old, new: new})
+	}
+}
+
+// PreciseLocations configures whether the locations of profiles are resolved
+// to the source lines of the statements the program counters of the stacks
+// are at, so the source view of pprof highlights the statements making the
+// calls. With the DWARF line program of the module:
+//
+//   - the instructions which compilers attribute to no line (line 0, e.g.
+//     spills or the joins of branches) resolve to the closest statement
+//     before them instead of the declaration of the function.
+//   - the line of an instruction of an inlined function is attributed to the
+//     inlined function, and the functions it is inlined in are at the lines
+//     of the calls, instead of the other way around.
+//
+// The columns of the statements are resolved as well, though the profiles
+// written by wzprof only record the lines. Frames of Go programs are always
+// resolved to the calls with the line tables of the Go runtime. The stacks are
+// recorded when functions are called, so the frame at the top of a stack is
+// at the entry of its function whichever the option.
+//
+// Default to false.
+func PreciseLocations(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.preciseLocations = enable }
+}
+
+// ThreadLabels configures whether the samples are labeled with the thread they
+// were recorded by (e.g. thread=1), where each instance of the module is a
+// thread. Programs built for the threads proposal (e.g. with -pthread) run
+// each thread in its own instance over a shared memory; the samples of all the
+// threads are aggregated in the profiles, the label allows to tell them apart
+// with pprof options like -tagfocus or -tagroot.
+//
+// Threads are numbered from 1 in the order their instance first calls a
+// function of the module. Default to false.
+func ThreadLabels(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.threadLabels = enable }
+}
+
+// TimeLabels configures the width of the time windows the samples are labeled
+// with, so profiles can be sliced by time (e.g. what was hot during a spike of
+// latency) with pprof options like -tagfocus, or in downstream tools. The
+// "time" label is the start of the window of the call, counted from the
+// creation of the Profiling (e.g. time=40s for the 10s windows of a call made
+// 42 seconds in). Samples of calls spanning multiple windows are labeled with
+// the window the call started in.
+//
+// Default to 0, which disables the labels.
+func TimeLabels(window time.Duration) ProfilingOption {
+	return func(p *Profiling) { p.timeLabels = window }
+}
+
+// Interpreter configures whether the module is run by the interpreter of wazero
+// (e.g. with wazero.NewRuntimeConfigInterpreter) instead of its compiler. The
+// compiler records the addresses of the native code of the calls, which are
+// never zero, while the interpreter records the indexes of their instructions,
+// which are zero for the calls made by the first instruction of a function;
+// the option tells the profiler that zero is a valid program counter.
+//
+// Default to false. Note that wazero.NewRuntimeConfig selects the interpreter
+// on the platforms where the compiler is not supported.
+func Interpreter(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.interpreter = enable }
+}
+
+// StackDepth configures the number of frames that the stack traces captured
+// by the profilers are sized to hold before any stack was seen. They grow to
+// the depth of the deepest stack captured since, passing the expected depth of
+// the stacks of the program avoids growing them while it runs.
+//
+// Default to 0.
+func StackDepth(depth int) ProfilingOption {
+	return func(p *Profiling) { p.maxStackDepth.Store(int64(depth)) }
+}
+
+// Metrics configures whether the number of calls recorded by the profilers and
+// the time spent recording them are counted, which MetricsHandler exposes.
+// Measuring the time adds a small overhead to each call.
+//
+// Default to false.
+func Metrics(enable bool) ProfilingOption {
+	return func(p *Profiling) { p.metrics = enable }
 }
 
 type language int8
@@ -35,15 +291,49 @@ type language int8
 const (
 	unknown language = iota
 	golang
-	python311
+	python3
+	tinygo
+	ruby3
+	javascript
+	dotnet
+	assemblyscript
+	zig
 )
 
+func (l language) String() string {
+	switch l {
+	case golang:
+		return "go"
+	case python3:
+		return "python"
+	case tinygo:
+		return "tinygo"
+	case ruby3:
+		return "ruby"
+	case javascript:
+		return "javascript"
+	case dotnet:
+		return "dotnet"
+	case assemblyscript:
+		return "assemblyscript"
+	case zig:
+		return "zig"
+	default:
+		return "unknown"
+	}
+}
+
 // ProfilingFor a given wasm binary. The resulting Profiling needs to be
 // prepared after Wazero module compilation.
-func ProfilingFor(wasm []byte) *Profiling {
+func ProfilingFor(wasm []byte, options ...ProfilingOption) *Profiling {
 	r := &Profiling{
-		wasm:    wasm,
-		symbols: noopsymbolizer{},
+		wasm:      wasm,
+		symbols:   noopsymbolizer{},
+		demangle:  true,
+		symbolize: true,
+		// No global counts instructions until CountInstructions is called.
+		instructionCounter: -1,
+		timeStart:          nanotime(),
 		stackIterator: func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
 			return wasmsi
 		},
@@ -51,6 +341,8 @@ func ProfilingFor(wasm []byte) *Profiling {
 
 	if binCompiledByGo(wasm) {
 		r.lang = golang
+		r.goVersion = goModuleVersion(wasm)
+		r.comments = goBuildInfoComments(wasm)
 		// Those functions are special. They use a different calling
 		// convention. Their call sites do not update the stack pointer,
 		// which makes it impossible to correctly walk the stack.
@@ -80,18 +372,34 @@ func ProfilingFor(wasm []byte) *Profiling {
 			"memcmp":                  {},
 			"memchr":                  {},
 		}
-	} else if supportedPython(wasm) {
-		r.lang = python311
-		r.onlyFunctions = map[string]struct{}{
-			"PyObject_Vectorcall": {},
-			// Those functions are also likely candidate for useful profiling.
-			// We may need to look into them if someone reports missing frames.
-			//
-			// "_PyEval_EvalFrameDefault": {},
-			// "_PyEvalFramePushAndInit": {},
-		}
+	} else if binCompiledByTinyGo(wasm) {
+		r.lang = tinygo
+		// The asyncify runtime used to switch goroutines is called every
+		// time a goroutine blocks, and would only add noise to profiles.
+		r.filteredFunctions = tinygoAsyncifyFunctions
+	} else if version := pythonVersion(wasm); version != 0 {
+		r.lang = python3
+		r.pyVersion = version
+	} else if version := rubyVersion(wasm); version != 0 {
+		r.lang = ruby3
+		r.rbVersion = version
+	} else if binEmbedsQuickJS(wasm) {
+		r.lang = javascript
+	} else if binCompiledByNativeAOT(wasm) {
+		r.lang = dotnet
+	} else if binCompiledByAssemblyScript(wasm) {
+		r.lang = assemblyscript
+	} else if binCompiledByZig(wasm) {
+		r.lang = zig
 	}
 
+	for _, opt := range options {
+		opt(r)
+	}
+	r.hash = moduleHash(wasm)
+	if !r.symbolize {
+		r.comments = append(r.comments, rawProfileComment+r.hash)
+	}
 	return r
 }
 
@@ -107,9 +415,180 @@ func (p *Profiling) MemoryProfiler(options ...MemoryProfilerOption) *MemoryProfi
 	return newMemoryProfiler(p, options...)
 }
 
+// WallClockProfiler constructs a new instance of WallClockProfiler which
+// periodically samples the stack of the guest.
+func (p *Profiling) WallClockProfiler(options ...WallClockProfilerOption) *WallClockProfiler {
+	return newWallClockProfiler(p, options...)
+}
+
+// BlockProfiler constructs a new instance of BlockProfiler which records the
+// time spent blocked in calls to host functions.
+func (p *Profiling) BlockProfiler(options ...BlockProfilerOption) *BlockProfiler {
+	return newBlockProfiler(p, options...)
+}
+
+// IOProfiler constructs a new instance of IOProfiler which records the I/O
+// operations performed by the guest on file descriptors.
+func (p *Profiling) IOProfiler(options ...IOProfilerOption) *IOProfiler {
+	return newIOProfiler(p, options...)
+}
+
+// SyscallProfiler constructs a new instance of SyscallProfiler which records
+// the latency of calls to host functions.
+func (p *Profiling) SyscallProfiler(options ...SyscallProfilerOption) *SyscallProfiler {
+	return newSyscallProfiler(p, options...)
+}
+
+// GCProfiler constructs a new instance of GCProfiler which records the garbage
+// collection cycles of Go guests.
+func (p *Profiling) GCProfiler(options ...GCProfilerOption) *GCProfiler {
+	return newGCProfiler(p, options...)
+}
+
+// MemStatsCollector constructs a new instance of MemStatsCollector which reads
+// the heap statistics of Go guests from their memory.
+func (p *Profiling) MemStatsCollector() *MemStatsCollector {
+	return newMemStatsCollector(p)
+}
+
+// FlightRecorder constructs a new instance of FlightRecorder which keeps the
+// CPU samples of the last seconds of execution of the guest.
+func (p *Profiling) FlightRecorder(options ...FlightRecorderOption) *FlightRecorder {
+	return newFlightRecorder(p, options...)
+}
+
+// GrowProfiler constructs a new instance of GrowProfiler which records the
+// growth of the linear memory of the guest.
+func (p *Profiling) GrowProfiler(options ...GrowProfilerOption) *GrowProfiler {
+	return newGrowProfiler(p, options...)
+}
+
+// StackProfiler constructs a new instance of StackProfiler which records the
+// maximum size of the stack of the guest in its linear memory.
+func (p *Profiling) StackProfiler() *StackProfiler {
+	return newStackProfiler(p)
+}
+
+// GoroutineProfiler constructs a new instance of GoroutineProfiler which
+// captures the stack of the calls in progress in the guest.
+func (p *Profiling) GoroutineProfiler() *GoroutineProfiler {
+	return newGoroutineProfiler(p)
+}
+
+// Timeline constructs a new instance of Timeline recording the sequence of
+// function calls in the guest.
+func (p *Profiling) Timeline(options ...TimelineOption) *Timeline {
+	return newTimeline(p, options...)
+}
+
+// CallTracer constructs a new instance of CallTracer writing the calls of the
+// guest to w as JSON lines.
+func (p *Profiling) CallTracer(w io.Writer, options ...CallTracerOption) *CallTracer {
+	return newCallTracer(p, w, options...)
+}
+
+// SpanRecorder constructs a new instance of SpanRecorder recording the calls
+// of the guest as OpenTelemetry spans.
+func (p *Profiling) SpanRecorder(options ...SpanOption) *SpanRecorder {
+	return newSpanRecorder(p, options...)
+}
+
+// CoreDumper constructs a new instance of CoreDumper which records the state
+// of the guest when it traps to write it as a WebAssembly coredump.
+func (p *Profiling) CoreDumper() *CoreDumper {
+	return newCoreDumper(p)
+}
+
+// InstructionProfiler constructs a new instance of InstructionProfiler which
+// records the number of instructions executed by the guest, the module must
+// be instrumented with CountInstructions.
+func (p *Profiling) InstructionProfiler() *InstructionProfiler {
+	return newInstructionProfiler(p)
+}
+
+// OpcodeProfiler constructs a new instance of OpcodeProfiler which records
+// the number of times each instruction of the guest is executed, the module
+// must be instrumented with CountOpcodes.
+func (p *Profiling) OpcodeProfiler() *OpcodeProfiler {
+	return newOpcodeProfiler(p)
+}
+
+// BranchProfiler constructs a new instance of BranchProfiler which records the
+// executions of the basic blocks of the guest and of their branches, the
+// module must be instrumented with CountOpcodes.
+func (p *Profiling) BranchProfiler() *BranchProfiler {
+	return newBranchProfiler(p)
+}
+
+// CoverageProfiler constructs a new instance of CoverageProfiler which records
+// the lines and functions of the source of the guest executed by a run, the
+// module must be instrumented with CountOpcodes.
+func (p *Profiling) CoverageProfiler() *CoverageProfiler {
+	return newCoverageProfiler(p)
+}
+
+// SizeProfiler constructs a new instance of SizeProfiler which attributes the
+// bytes of the code of the module to its functions.
+func (p *Profiling) SizeProfiler() *SizeProfiler {
+	return newSizeProfiler(p)
+}
+
+// CountInstructions returns a copy of the profiled module instrumented to
+// count the instructions it executes, which the instruction profiler records.
+// The returned module must be compiled and instantiated instead of the
+// original one, the locations of profiles still refer to the original module.
+//
+// The instrumented module counts instructions in a global appended to the
+// module, it runs slower than the original but its behavior is otherwise the
+// same.
+func (p *Profiling) CountInstructions() ([]byte, error) {
+	wasm, global, offsets, err := countInstructions(p.wasm)
+	if err != nil {
+		return nil, err
+	}
+	p.instructionCounter = int64(global)
+	p.sourceOffsets = offsets
+	return wasm, nil
+}
+
+// CountOpcodes returns a copy of the profiled module instrumented like with
+// CountInstructions, where the functions selected by Focus and Ignore also
+// count the executions of their instructions, which the opcode, branch and
+// coverage profilers record. The functions are selected by their names in the name
+// section.
+//
+// Each segment of instructions which run together counts its executions in
+// its own global, focusing on the hot functions keeps the overhead of the
+// instrumentation low.
+func (p *Profiling) CountOpcodes() ([]byte, error) {
+	names := wasmFunctionNames(p.wasm)
+	m, err := instrumentModule(p.wasm, func(function uint32) bool {
+		return p.instrumentedName(names[function])
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.instructionCounter = int64(m.global)
+	p.sourceOffsets = m.offsets
+	p.countedSegments = m.segments
+	if p.countedSegments == nil {
+		// The module is instrumented even if no functions were selected.
+		p.countedSegments = []countedSegment{}
+	}
+	return m.wasm, nil
+}
+
 // Prepare selects the most appropriate analysis functions for the guest
 // code in the provided module.
 func (p *Profiling) Prepare(mod wazero.CompiledModule) error {
+	if p.debugInfo != nil {
+		m, err := withDebugInfo(mod, p.wasm, p.debugInfo)
+		if err != nil {
+			return err
+		}
+		mod = m
+	}
+	p.guestStartsCPU = importsHostModule(mod, "start_cpu")
 	switch p.lang {
 	case golang:
 		s, err := preparePclntabSymbolizer(p.wasm, mod)
@@ -118,38 +597,136 @@ func (p *Profiling) Prepare(mod wazero.CompiledModule) error {
 		}
 
 		p.symbols = s
-		si := &goStackIterator{
-			pclntab:  s,
-			unwinder: unwinder{symbols: s},
-		}
 		p.stackIterator = func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+			// Each call gets its own iterator so instances of the module
+			// running concurrently do not share the state of the unwinder.
 			imod := mod.(experimental.InternalModule)
-			si.mem = imod.Memory()
-			si.pclntab.EnsureReady(si.mem)
+			mem := imod.Memory()
+			s.EnsureReady(mem)
 			sp0 := uint32(imod.Global(0).Get())
 			gp0 := imod.Global(2).Get()
-			pc0 := si.symbols.FIDToPC(fid(def.Index()))
-			si.initAt(ptr64(pc0), ptr64(sp0), 0, gptr(gp0), 0)
+			if def.GoFunction() != nil {
+				// Host functions are not part of the Go program, the stack
+				// is unwound from the guest function which called it. Those
+				// are wasmimport wrappers which have no frame, so the stack
+				// pointer still points at their return address.
+				if !wasmsi.Next() || !wasmsi.Next() {
+					return wasmsi
+				}
+				def = wasmsi.Function().Definition()
+			} else if !wasmsi.Next() {
+				return wasmsi
+			}
+			pc0 := s.FIDToPC(fid(def.Index()))
+			// Functions resumed after a goroutine switch are called with the
+			// offset of the resume point in their first parameter (PC_B),
+			// their frame is already allocated on the Go stack.
+			if params := wasmsi.Parameters(); usesGoResumePoints(def) && len(params) == 1 {
+				pc0 += ptr64(uint32(params[0]))
+			}
+			// Errors stop the traceback instead of panicking, and system
+			// stacks (e.g. systemstack) are followed by the user stack of
+			// the goroutine which switched to them.
+			si := newGoStackIterator(s, mem)
+			si.initAt(ptr64(pc0), ptr64(sp0), 0, gptr(gp0), unwindSilentErrors|unwindJumpStack)
 			si.first = true
 			return si
 		}
-	case python311:
-		py, err := preparePython(mod)
+	case python3:
+		layout, err := pythonLayout(p.pyVersion)
+		if err != nil {
+			return err
+		}
+		py, err := preparePython(mod, layout)
 		if err != nil {
 			return err
 		}
 		p.symbols = py
 		p.stackIterator = py.Stackiter
-	default:
-		dwarf, err := newDwarfparser(mod)
+	case ruby3:
+		layout, err := rubyLayout(p.rbVersion)
+		if err != nil {
+			return err
+		}
+		rb, err := prepareRuby(mod, layout)
 		if err != nil {
-			return nil // TODO: surface error as warning?
+			return err
+		}
+		p.symbols = rb
+		p.stackIterator = rb.Stackiter
+	case javascript:
+		js := prepareQuickJS(mod)
+		p.symbols = js
+		p.stackIterator = js.Stackiter
+	case dotnet:
+		// Names of managed methods are read from the name section when
+		// the module has no debug information.
+		p.symbols = dotnetSymbolizer{namesymbolizer{}}
+		if dwarf, err := newDwarfparser(mod); err == nil {
+			p.symbols = dotnetSymbolizer{p.dwarfSymbolizer(dwarf)}
+		}
+	case assemblyscript:
+		p.symbols = assemblyscriptSymbolizer{}
+	case tinygo:
+		p.stackIterator = tinygoStackIterator
+		p.symbols = tinygoSymbolizer{namesymbolizer{}}
+		if dwarf, err := newDwarfparser(mod); err == nil {
+			p.symbols = tinygoSymbolizer{p.dwarfSymbolizer(dwarf)}
+		}
+	default:
+		// Modules without DWARF information (e.g. stripped or built by
+		// zig build-exe) are symbolized with the names of their functions.
+		p.symbols = namesymbolizer{}
+		if dwarf, err := newDwarfparser(mod); err == nil {
+			p.symbols = p.dwarfSymbolizer(dwarf)
 		}
-		p.symbols = buildDwarfSymbolizer(dwarf)
 	}
+	Logger().Info("prepared module for profiling",
+		"language", p.lang,
+		"symbolizer", symbolizerName(p.symbols))
 	return nil
 }
 
+// dwarfSymbolizer constructs the symbolizer of the DWARF information of the
+// profiled module, with the options of the profiling.
+func (p *Profiling) dwarfSymbolizer(parser dwarfparser) symbolizer {
+	d := newDwarfmapper(parser)
+	d.precise = p.preciseLocations
+	return d
+}
+
+// usesGoResumePoints returns true if the function has the signature of Go
+// functions, which take the resume point as parameter and return whether the
+// WebAssembly stack is unwinding. Some assembly functions of the runtime like
+// gcWriteBarrier do not follow this convention.
+func usesGoResumePoints(def api.FunctionDefinition) bool {
+	params, results := def.ParamTypes(), def.ResultTypes()
+	return len(params) == 1 && params[0] == api.ValueTypeI32 &&
+		len(results) == 1 && results[0] == api.ValueTypeI32
+}
+
+// instrumented returns whether the calls of the function are tracked by the
+// profilers which instrument all functions.
+func (p *Profiling) instrumented(def api.FunctionDefinition) bool {
+	return p.instrumentedName(def.Name())
+}
+
+// instrumentedName is like instrumented for the name of a function.
+func (p *Profiling) instrumentedName(name string) bool {
+	if len(p.onlyFunctions) > 0 {
+		if _, keep := p.onlyFunctions[name]; !keep {
+			return false
+		}
+	}
+	if _, skip := p.filteredFunctions[name]; skip {
+		return false
+	}
+	if p.ignore != nil && p.ignore.MatchString(name) {
+		return false
+	}
+	return p.focus == nil || p.focus.MatchString(name)
+}
+
 // profilingListener wraps a FunctionListener to adapt its stack iterator to the
 // appropriate implementation according to the module support.
 type profilingListener struct {
@@ -158,15 +735,45 @@ type profilingListener struct {
 }
 
 func (s profilingListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
-	si = s.s.stackIterator(mod, def, si)
+	if s.s.metrics {
+		defer s.s.observeOverhead(nanotime())
+		s.s.samples.Add(1)
+	}
+	m := s.s.moduleOf(mod)
+	si = m.stackIterator(mod, def, si)
+	ctx = s.s.moduleContext(ctx, m)
+	ctx = s.s.guestContext(ctx)
+	if s.s.threadLabels {
+		ctx = s.s.threadContext(ctx, mod)
+	}
+	if s.s.timeLabels > 0 {
+		ctx = s.s.timeContext(ctx)
+	}
 	s.l.Before(ctx, mod, def, params, si)
+	if r, ok := si.(pooledStackIterator); ok {
+		r.release()
+	}
+}
+
+// pooledStackIterator is implemented by stack iterators which are reused
+// across calls to avoid allocating them in the listeners. The iterators are
+// released when the listener returns, profilers must not retain them.
+type pooledStackIterator interface {
+	experimental.StackIterator
+	release()
 }
 
 func (s profilingListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if s.s.metrics {
+		defer s.s.observeOverhead(nanotime())
+	}
 	s.l.After(ctx, mod, def, results)
 }
 
 func (s profilingListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	if s.s.metrics {
+		defer s.s.observeOverhead(nanotime())
+	}
 	s.l.Abort(ctx, mod, def, err)
 }
 
@@ -196,21 +803,61 @@ type Profiler interface {
 var (
 	_ Profiler = (*CPUProfiler)(nil)
 	_ Profiler = (*MemoryProfiler)(nil)
+	_ Profiler = (*WallClockProfiler)(nil)
+	_ Profiler = (*BlockProfiler)(nil)
+	_ Profiler = (*IOProfiler)(nil)
+	_ Profiler = (*SyscallProfiler)(nil)
+	_ Profiler = (*FlightRecorder)(nil)
+	_ Profiler = (*GoroutineProfiler)(nil)
+	_ Profiler = (*GCProfiler)(nil)
 )
 
 //go:linkname nanotime runtime.nanotime
 func nanotime() int64
 
-// WriteProfile writes a profile to a file at the given path.
-func WriteProfile(path string, prof *profile.Profile) error {
+// WriteProfile writes a profile to a file at the given path, the options are
+// the ones of EncodeProfile.
+func WriteProfile(path string, prof *profile.Profile, options ...EncodeOption) error {
 	w, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	if err := EncodeProfile(w, prof, options...); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// EncodeProfile writes a profile to w in the pprof format, e.g. to stream it
+// into a HTTP response or an object store instead of a file.
+func EncodeProfile(w io.Writer, prof *profile.Profile, options ...EncodeOption) error {
+	e := encoder{compress: true}
+	for _, opt := range options {
+		opt(&e)
+	}
+	if !e.compress {
+		return prof.WriteUncompressed(w)
+	}
 	return prof.Write(w)
 }
 
+type encoder struct {
+	compress bool
+}
+
+// EncodeOption is a type used to represent configuration options of
+// EncodeProfile and WriteProfile.
+type EncodeOption func(*encoder)
+
+// Compress configures whether profiles are compressed with gzip, which pprof
+// tools expect but is wasted on storages compressing the data they receive.
+//
+// Default to true.
+func Compress(enable bool) EncodeOption {
+	return func(e *encoder) { e.compress = enable }
+}
+
 type symbolizer interface {
 	// Locations returns a list of function locations for a given program
 	// counter, and the address it found them at. Locations start from
@@ -219,12 +866,70 @@ type symbolizer interface {
 	Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location)
 }
 
+// symbolizerName returns the name of the symbolizer reported in diagnostics.
+func symbolizerName(s symbolizer) string {
+	switch s := s.(type) {
+	case *pclntab:
+		return "pclntab"
+	case *python:
+		return "python"
+	case *ruby:
+		return "ruby"
+	case *quickjs:
+		return "quickjs"
+	case dotnetSymbolizer:
+		return "dotnet+" + symbolizerName(s.symbolizer)
+	case tinygoSymbolizer:
+		return "tinygo+" + symbolizerName(s.symbolizer)
+	case assemblyscriptSymbolizer:
+		return "assemblyscript"
+	case *dwarfmapper:
+		return "dwarf"
+	case namesymbolizer:
+		return "names"
+	default:
+		return "none"
+	}
+}
+
 type noopsymbolizer struct{}
 
 func (s noopsymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
 	return 0, nil
 }
 
+// namesymbolizer symbolizes functions of modules without debug information
+// with their names, see wasmFunctionName.
+type namesymbolizer struct{}
+
+func (s namesymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	offset := fn.SourceOffsetForPC(pc)
+	name := wasmFunctionName(fn.Definition())
+	if name == "" {
+		return offset, nil
+	}
+	return offset, []location{{StableName: name, HumanName: name}}
+}
+
+// wasmFunctionName returns the name of a function found in the name section of
+// its module. Modules without a name section may still export the function, or
+// import it from another module, in which case it is qualified by the name of
+// the module (e.g. wasi_snapshot_preview1.fd_write). It returns an empty string
+// if the function has no name, wazero synthesizes names from the index of the
+// functions in this case, which do not help identifying them.
+func wasmFunctionName(def api.FunctionDefinition) string {
+	if name := def.Name(); name != "" {
+		return name
+	}
+	if exports := def.ExportNames(); len(exports) > 0 {
+		return exports[0]
+	}
+	if module, name, ok := def.Import(); ok {
+		return module + "." + name
+	}
+	return ""
+}
+
 type location struct {
 	File    string
 	Line    int64
@@ -234,19 +939,103 @@ type location struct {
 	// Only present for inlined functions.
 	StableName string
 	HumanName  string
+	// Line of the declaration of the function, zero if unknown.
+	StartLine int64
+}
+
+type pathPrefix struct {
+	old, new string
+}
+
+// remapLocations replaces the prefixes of the source file names of the
+// locations, see SourcePathPrefix.
+func remapLocations(locations []location, prefixes []pathPrefix) {
+	for i := range locations {
+		locations[i].File = remapPath(locations[i].File, prefixes)
+	}
+}
+
+func remapPath(path string, prefixes []pathPrefix) string {
+	for _, prefix := range prefixes {
+		rest, ok := strings.CutPrefix(path, prefix.old)
+		if !ok || prefix.old == "" {
+			continue
+		}
+		// The prefix must end at a path separator, /build/src must not
+		// match /build/srcs/main.c.
+		if rest != "" && !isPathSeparator(rest[0]) && !isPathSeparator(prefix.old[len(prefix.old)-1]) {
+			continue
+		}
+		if prefix.new == "" {
+			return strings.TrimLeft(rest, `/\`)
+		}
+		if rest != "" && isPathSeparator(rest[0]) && isPathSeparator(prefix.new[len(prefix.new)-1]) {
+			rest = rest[1:]
+		}
+		return prefix.new + rest
+	}
+	return path
+}
+
+func isPathSeparator(c byte) bool {
+	return c == '/' || c == '\\'
+}
+
+func (p *Profiling) addSymbol(addr uint64, name string) {
+	p.addressMutex.Lock()
+	if p.addressNames == nil {
+		p.addressNames = make(map[uint64]string)
+	}
+	p.addressNames[addr] = name
+	p.addressMutex.Unlock()
+}
+
+func (p *Profiling) lookupSymbol(addr uint64) (string, bool) {
+	p.addressMutex.Lock()
+	name, ok := p.addressNames[addr]
+	p.addressMutex.Unlock()
+	return name, ok
 }
 
 func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter, funcs map[string]*profile.Function) *profile.Location {
+	return locationForSymbols(symbolizeCall(p, fn, pc), funcs)
+}
+
+// symbolizedCall holds the source locations of a call, they are resolved
+// concurrently for all the calls of a profile, see symbolizeCalls.
+type symbolizedCall struct {
+	address     uint64
+	locations   []location
+	symbolFound bool
+}
+
+// symbolizeCall resolves the source locations of a call, it is safe to call
+// concurrently.
+func symbolizeCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter) symbolizedCall {
+	hasPC := p.hasProgramCounter(pc)
+	fn = p.originalFunction(fn)
 	// Cache miss. Get or create function and all the line
 	// locations associated with inlining.
+	if !p.symbolize && p.lang != golang {
+		// Go frames and the frames of interpreters are resolved from the
+		// memory of the guest, they cannot be symbolized later.
+		if _, ok := fn.(interpcall); !ok {
+			return rawCall(fn, pc, hasPC)
+		}
+	}
+	return p.symbolizeWith(p.symbols, fn, pc, hasPC)
+}
+
+// symbolizeWith resolves the source locations of a call with the given
+// symbolizer, falling back to the name of the function.
+func (p *Profiling) symbolizeWith(symbols symbolizer, fn experimental.InternalFunction, pc experimental.ProgramCounter, hasPC bool) symbolizedCall {
+	var address uint64
 	var locations []location
 	var symbolFound bool
 	def := fn.Definition()
 
-	out := &profile.Location{}
-
-	if pc > 0 {
-		out.Address, locations = p.symbols.Locations(fn, pc)
+	if hasPC {
+		address, locations = symbols.Locations(fn, pc)
 		symbolFound = len(locations) > 0
 	}
 	if len(locations) == 0 {
@@ -256,13 +1045,40 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 	}
 	// Provide defaults in case we couldn't resolve DWARF information for
 	// the main function call's PC.
+	name := wasmFunctionName(def)
 	if locations[0].StableName == "" {
-		locations[0].StableName = def.Name()
+		locations[0].StableName = name
 	}
 	if locations[0].HumanName == "" {
-		locations[0].HumanName = def.Name()
+		locations[0].HumanName = name
+	}
+	if p.demangle {
+		demangleLocations(locations)
 	}
+	if len(p.pathPrefixes) > 0 {
+		remapLocations(locations, p.pathPrefixes)
+	}
+	if address != 0 {
+		p.addSymbol(address, locations[0].HumanName)
+	}
+	return symbolizedCall{
+		address:     address,
+		locations:   locations,
+		symbolFound: symbolFound,
+	}
+}
 
+// hasProgramCounter returns whether pc locates a call in its function, which
+// zero does not unless the module is run by the interpreter (see Interpreter).
+func (p *Profiling) hasProgramCounter(pc experimental.ProgramCounter) bool {
+	return pc != 0 || p.interpreter
+}
+
+// locationForSymbols creates the pprof location of a symbolized call, along
+// with its functions which are shared in funcs.
+func locationForSymbols(call symbolizedCall, funcs map[string]*profile.Function) *profile.Location {
+	locations, symbolFound := call.locations, call.symbolFound
+	out := &profile.Location{Address: call.address}
 	lines := make([]profile.Line, len(locations))
 
 	for i, loc := range locations {
@@ -274,6 +1090,7 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 				Name:       loc.HumanName,
 				SystemName: loc.StableName,
 				Filename:   loc.File,
+				StartLine:  loc.StartLine,
 			}
 			funcs[loc.StableName] = pprofFn
 		} else if symbolFound {
@@ -283,6 +1100,7 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 			pprofFn.Name = locations[i].HumanName
 			pprofFn.SystemName = locations[i].StableName
 			pprofFn.Filename = locations[i].File
+			pprofFn.StartLine = locations[i].StartLine
 		}
 
 		// Pprof expects lines to start with the root of the inlined
@@ -299,14 +1117,16 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 }
 
 type locationKey struct {
+	p      *Profiling
 	module string
 	index  uint32
 	name   string
 	pc     uint64
 }
 
-func makeLocationKey(fn api.FunctionDefinition, pc experimental.ProgramCounter) locationKey {
+func makeLocationKey(p *Profiling, fn api.FunctionDefinition, pc experimental.ProgramCounter) locationKey {
 	return locationKey{
+		p:      p,
 		module: fn.ModuleName(),
 		index:  fn.Index(),
 		name:   fn.Name(),
@@ -379,9 +1199,24 @@ type stackTrace struct {
 	fns []experimental.InternalFunction
 	pcs []experimental.ProgramCounter
 	key uint64
+	// Labels of the context the stack trace was captured in, if any.
+	labels *labelSet
+	// Module prepared with PrepareModule the stack trace was captured in,
+	// nil for the profiled module.
+	module *Profiling
+	// Scope of the context the stack trace was captured in, if any. Samples
+	// do not retain it.
+	scope *Scope
 }
 
-func makeStackTrace(st stackTrace, si experimental.StackIterator) stackTrace {
+func (p *Profiling) makeStackTrace(ctx context.Context, st stackTrace, si experimental.StackIterator) stackTrace {
+	if st.pcs == nil {
+		// New stack traces are sized to hold the deepest stack seen so far
+		// so they do not grow while capturing stacks.
+		depth := p.maxStackDepth.Load()
+		st.fns = make([]experimental.InternalFunction, 0, depth)
+		st.pcs = make([]experimental.ProgramCounter, 0, depth)
+	}
 	st.fns = st.fns[:0]
 	st.pcs = st.pcs[:0]
 
@@ -389,7 +1224,27 @@ func makeStackTrace(st stackTrace, si experimental.StackIterator) stackTrace {
 		st.fns = append(st.fns, si.Function())
 		st.pcs = append(st.pcs, si.ProgramCounter())
 	}
-	st.key = maphash.Bytes(stackTraceHashSeed, st.bytes())
+	for depth := p.maxStackDepth.Load(); int64(len(st.pcs)) > depth; depth = p.maxStackDepth.Load() {
+		if p.maxStackDepth.CompareAndSwap(depth, int64(len(st.pcs))) {
+			break
+		}
+	}
+	return st.withContext(ctx)
+}
+
+// withContext computes the key of the stack trace, which identifies its
+// frames and the labels and module of the context it was captured in.
+func (st stackTrace) withContext(ctx context.Context) stackTrace {
+	st.key = st.hash()
+	st.labels = contextLabels(ctx)
+	if st.labels != nil {
+		st.key ^= st.labels.hash
+	}
+	st.module = contextModule(ctx)
+	if st.module != nil {
+		st.key ^= st.module.moduleKey
+	}
+	st.scope = contextScope(ctx)
 	return st
 }
 
@@ -410,15 +1265,34 @@ func (st stackTrace) index(i int) stackFrame {
 
 func (st stackTrace) clone() stackTrace {
 	return stackTrace{
-		fns: slices.Clone(st.fns),
-		pcs: slices.Clone(st.pcs),
-		key: st.key,
+		fns:    slices.Clone(st.fns),
+		pcs:    slices.Clone(st.pcs),
+		key:    st.key,
+		labels: st.labels,
+		module: st.module,
 	}
 }
 
-func (st stackTrace) bytes() []byte {
-	pcs := unsafe.SliceData(st.pcs)
-	return unsafe.Slice((*byte)(unsafe.Pointer(pcs)), 8*len(st.pcs))
+// hash returns the hash of the frames of the stack trace. Program counters are
+// not unique across functions, the interpreter of wazero records the indexes
+// of instructions in their function, so each frame is identified by the module
+// and index of its function along with its program counter. Interpreted frames
+// have no index, they are identified by their name.
+func (st stackTrace) hash() uint64 {
+	var h maphash.Hash
+	var b [12]byte
+	h.SetSeed(stackTraceHashSeed)
+	for i, fn := range st.fns {
+		def := fn.Definition()
+		h.WriteString(def.ModuleName())
+		if call, ok := fn.(interpcall); ok {
+			h.WriteString(call.name)
+		}
+		binary.LittleEndian.PutUint32(b[:4], def.Index())
+		binary.LittleEndian.PutUint64(b[4:], uint64(st.pcs[i]))
+		h.Write(b[:])
+	}
+	return h.Sum64()
 }
 
 func (st stackTrace) String() string {
@@ -438,56 +1312,162 @@ type sampleType interface {
 	sampleValue() []int64
 }
 
+// moduleMapping returns the mapping of the module in profiles. Addresses of
+// locations are offsets in the code section, the mapping covers it and points
+// to its contents in the module file. The build id is the hash of the module.
+func (p *Profiling) moduleMapping() *profile.Mapping {
+	offset, size := wasmCodeSection(p.wasm)
+	return &profile.Mapping{
+		ID:      1,
+		Start:   0,
+		Limit:   size,
+		Offset:  offset,
+		File:    p.path,
+		BuildID: p.hash,
+	}
+}
+
+// setMappingFlags reports in the mapping whether its locations are symbolized.
+func setMappingFlags(m *profile.Mapping, locations []*profile.Location, symbolized bool) {
+	m.HasFunctions = symbolized
+	m.HasFilenames, m.HasLineNumbers, m.HasInlineFrames = false, false, false
+	if !symbolized {
+		return
+	}
+	for _, loc := range locations {
+		if loc.Mapping != m {
+			continue
+		}
+		m.HasInlineFrames = m.HasInlineFrames || len(loc.Line) > 1
+		for _, line := range loc.Line {
+			m.HasLineNumbers = m.HasLineNumbers || line.Line != 0
+			m.HasFilenames = m.HasFilenames || line.Function.Filename != ""
+		}
+	}
+}
+
+type stackCall struct {
+	fn experimental.InternalFunction
+	pc experimental.ProgramCounter
+	// Module of the call, if it is not the profiled one.
+	module *Profiling
+}
+
+// symbolizeCalls symbolizes the calls across a pool of goroutines, the results
+// are in the same order as the calls.
+func symbolizeCalls(p *Profiling, calls []stackCall) []symbolizedCall {
+	results := make([]symbolizedCall, len(calls))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(calls) {
+		workers = len(calls)
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(calls) {
+					return
+				}
+				m := p
+				if calls[i].module != nil {
+					m = calls[i].module
+				}
+				results[i] = symbolizeCall(m, calls[i].fn, calls[i].pc)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
 func buildProfile[T sampleType](p *Profiling, samples map[uint64]T, start time.Time, duration time.Duration, sampleType []*profile.ValueType, ratios []float64) *profile.Profile {
 	prof := &profile.Profile{
 		SampleType:    sampleType,
 		Sample:        make([]*profile.Sample, 0, len(samples)),
 		TimeNanos:     start.UnixNano(),
 		DurationNanos: int64(duration),
+		Comments:      p.comments,
+	}
+
+	// Symbolizing is the most expensive part of building profiles, the
+	// unique calls of the samples are symbolized concurrently, then their
+	// locations are created in the order they were first seen.
+	var calls []stackCall
+	callIndex := make(map[locationKey]int)
+	for _, sample := range samples {
+		stack := sample.sampleLocation()
+		for i := 0; i < stack.len(); i++ {
+			fn, pc := stack.fns[i], stack.pcs[i]
+			key := makeLocationKey(stack.module, fn.Definition(), pc)
+			if _, ok := callIndex[key]; !ok {
+				callIndex[key] = len(calls)
+				calls = append(calls, stackCall{fn: fn, pc: pc, module: stack.module})
+			}
+		}
 	}
 
-	locationID := uint64(1)
-	locationCache := make(map[locationKey]*profile.Location)
+	locationCache := make([]*profile.Location, len(calls))
 	functionCache := make(map[string]*profile.Function)
 
+	for i, call := range symbolizeCalls(p, calls) {
+		loc := locationForSymbols(call, functionCache)
+		loc.ID = uint64(i) + 1
+		locationCache[i] = loc
+	}
+
 	for _, sample := range samples {
 		stack := sample.sampleLocation()
 		location := make([]*profile.Location, stack.len())
 
 		for i := range location {
-			fn := stack.fns[i]
-			pc := stack.pcs[i]
-
-			def := fn.Definition()
-			key := makeLocationKey(def, pc)
-			loc := locationCache[key]
-			if loc == nil {
-				loc = locationForCall(p, fn, pc, functionCache)
-				loc.ID = locationID
-				locationID++
-				locationCache[key] = loc
-			}
-
-			location[i] = loc
+			key := makeLocationKey(stack.module, stack.fns[i].Definition(), stack.pcs[i])
+			location[i] = locationCache[callIndex[key]]
 		}
 
-		prof.Sample = append(prof.Sample, &profile.Sample{
+		s := &profile.Sample{
 			Location: location,
 			Value:    sample.sampleValue()[:len(sampleType)],
-		})
+		}
+		if stack.labels != nil {
+			s.Label = stack.labels.labels
+		}
+		prof.Sample = append(prof.Sample, s)
 	}
 
-	prof.Location = make([]*profile.Location, len(locationCache))
+	prof.Location = locationCache
 	prof.Function = make([]*profile.Function, len(functionCache))
 
-	for _, loc := range locationCache {
-		prof.Location[loc.ID-1] = loc
-	}
-
 	for _, fn := range functionCache {
 		prof.Function[fn.ID-1] = fn
 	}
 
+	// Each module prepared with PrepareModule has its own mapping, following
+	// the one of the profiled module.
+	mapping := p.moduleMapping()
+	prof.Mapping = []*profile.Mapping{mapping}
+	mappings := map[*Profiling]*profile.Mapping{nil: mapping}
+	for i, loc := range prof.Location {
+		m := mappings[calls[i].module]
+		if m == nil {
+			m = calls[i].module.moduleMapping()
+			m.ID = uint64(len(prof.Mapping)) + 1
+			mappings[calls[i].module] = m
+			prof.Mapping = append(prof.Mapping, m)
+		}
+		loc.Mapping = m
+	}
+	for m, mapping := range mappings {
+		if m == nil {
+			m = p
+		}
+		setMappingFlags(mapping, prof.Location, m.symbolize)
+	}
+
 	if err := prof.ScaleN(ratios[:len(sampleType)]); err != nil {
 		panic(err)
 	}
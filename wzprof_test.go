@@ -1,12 +1,21 @@
 package wzprof
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
 	"testing"
 
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
 func benchmarkFunctionListener(b *testing.B, factory experimental.FunctionListenerFactory) {
@@ -29,3 +38,437 @@ func benchmarkFunctionListener(b *testing.B, factory experimental.FunctionListen
 		factory.NewFunctionListener(malloc.Definition()),
 	)
 }
+
+func TestGoInstancesConcurrently(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The instances share the symbolizer and stack iterator of the same
+	// Profiling, with a profiler each.
+	p := ProfilingFor(wasm)
+	ctx := context.Background()
+
+	const instances = 4
+	profilers := make([]*MemoryProfiler, instances)
+	runtimes := make([]wazero.Runtime, instances)
+	modules := make([]wazero.CompiledModule, instances)
+
+	for i := range runtimes {
+		profilers[i] = p.MemoryProfiler()
+		ctx := context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, profilers[i])
+		runtimes[i] = wazero.NewRuntime(ctx)
+		defer runtimes[i].Close(ctx)
+		wasi_snapshot_preview1.MustInstantiate(ctx, runtimes[i])
+
+		if modules[i], err = runtimes[i].CompileModule(ctx, wasm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Prepare(modules[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, instances)
+	for i := range runtimes {
+		go func(i int) {
+			config := wazero.NewModuleConfig().WithName(strconv.Itoa(i))
+			_, err := runtimes[i].InstantiateModule(ctx, modules[i], config)
+			errs <- err
+		}(i)
+	}
+	for range runtimes {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, mem := range profilers {
+		found := false
+		for _, sample := range mem.NewProfile(1).Sample {
+			for _, loc := range sample.Location {
+				for _, line := range loc.Line {
+					found = found || line.Function.Name == "main.thealloc"
+				}
+			}
+		}
+		if !found {
+			t.Errorf("instance %d: no allocations of main.thealloc found in the profile", i)
+		}
+	}
+}
+
+func TestNameSymbolizer(t *testing.T) {
+	// A module without name section nor DWARF, which imports env.f and
+	// exports run.
+	wasm := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x04, 0x01, 0x60, 0x00, 0x00, // type section
+		0x02, 0x09, 0x01, 0x03, 'e', 'n', 'v', 0x01, 'f', 0x00, 0x00, // import section
+		0x03, 0x02, 0x01, 0x00, // function section
+		0x07, 0x07, 0x01, 0x03, 'r', 'u', 'n', 0x00, 0x01, // export section
+		0x0a, 0x04, 0x01, 0x02, 0x00, 0x0b, // code section
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	mod, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProfilingFor(wasm)
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.symbols.(namesymbolizer); !ok {
+		t.Fatalf("wrong symbolizer for a module without dwarf: %T", p.symbols)
+	}
+
+	tests := []struct {
+		def  api.FunctionDefinition
+		want string
+	}{
+		{mod.ImportedFunctions()[0], "env.f"},
+		{mod.ExportedFunctions()["run"], "run"},
+	}
+
+	for _, test := range tests {
+		fn := testOffsetFunction{testInternalFunction{test.def}, 5}
+		addr, locs := p.symbols.Locations(fn, 1)
+		if len(locs) != 1 || locs[0].HumanName != test.want || locs[0].StableName != test.want {
+			t.Errorf("wrong locations: want=%q got=%+v", test.want, locs)
+		}
+		if addr != fn.offset {
+			t.Errorf("wrong address of %s: want=%d got=%d", test.want, fn.offset, addr)
+		}
+	}
+}
+
+func TestRemapPath(t *testing.T) {
+	prefixes := []pathPrefix{
+		{old: "/build/src", new: ""},
+		{old: "/build/", new: "/home/me/"},
+		{old: "C:\\build", new: "/src"},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/build/src/main.c", "main.c"},
+		{"/build/src", ""},
+		{"/build/srcs/main.c", "/home/me/srcs/main.c"},
+		{"/build/lib/util.c", "/home/me/lib/util.c"},
+		{"C:\\build\\main.c", "/src\\main.c"},
+		{"/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := remapPath(test.path, prefixes); got != test.want {
+			t.Errorf("%q: want=%q got=%q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestSymbolizeCallsConcurrently(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProfiling := func() *Profiling {
+		parser, err := newDwarfParserFromBin(wasm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := ProfilingFor(nil)
+		p.symbols = newDwarfmapper(parser)
+		return p
+	}
+
+	fn := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	fn.FunctionName = "f"
+	wazerotest.NewModule(nil, fn)
+
+	var calls []stackCall
+	for _, r := range newProfiling().symbols.(*dwarfmapper).ranges {
+		for offset := r.Range[0]; offset < r.Range[1]; offset += 16 {
+			calls = append(calls, stackCall{
+				fn: testOffsetFunction{testInternalFunction{fn.Definition()}, offset},
+				pc: 1,
+			})
+		}
+	}
+	if len(calls) < 100 {
+		t.Fatalf("not enough calls: %d", len(calls))
+	}
+
+	sequential := newProfiling()
+	concurrent := symbolizeCalls(newProfiling(), calls)
+	for i, call := range calls {
+		want := symbolizeCall(sequential, call.fn, call.pc)
+		if !reflect.DeepEqual(want, concurrent[i]) {
+			t.Fatalf("call %d: want %+v, got %+v", i, want, concurrent[i])
+		}
+	}
+}
+
+func TestStackTraceKey(t *testing.T) {
+	f := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	g := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	mod := wazerotest.NewModule(nil, f, g)
+	fn := func(i int) experimental.InternalFunction {
+		return testInternalFunction{mod.Function(i).Definition()}
+	}
+	trace := func(fns ...experimental.InternalFunction) stackTrace {
+		// The interpreter of wazero records the indexes of the instructions
+		// in their function, which are the same for different functions.
+		pcs := make([]experimental.ProgramCounter, len(fns))
+		return stackTrace{fns: fns, pcs: pcs}.withContext(context.Background())
+	}
+	interp := func(file, name string) experimental.InternalFunction {
+		return interpcall{file: file, name: name}
+	}
+
+	for _, test := range []struct {
+		name string
+		a, b stackTrace
+		same bool
+	}{
+		{"same functions", trace(fn(0), fn(1)), trace(fn(0), fn(1)), true},
+		{"different functions", trace(fn(0), fn(1)), trace(fn(1), fn(1)), false},
+		{"different callers", trace(fn(0), fn(0)), trace(fn(0), fn(1)), false},
+		{"same interpreted functions", trace(interp("a.rb", "f")), trace(interp("a.rb", "f")), true},
+		{"different interpreted functions", trace(interp("a.rb", "f")), trace(interp("a.rb", "g")), false},
+		{"different interpreted files", trace(interp("a.rb", "f")), trace(interp("b.rb", "f")), false},
+	} {
+		if same := test.a.key == test.b.key; same != test.same {
+			t.Errorf("%s: wrong keys: %x and %x", test.name, test.a.key, test.b.key)
+		}
+	}
+}
+
+func TestInterpreterProgramCounter(t *testing.T) {
+	if ProfilingFor(nil).hasProgramCounter(0) {
+		t.Error("zero is not a program counter of the compiler")
+	}
+	if !ProfilingFor(nil, Interpreter(true)).hasProgramCounter(0) {
+		t.Error("zero is a program counter of the interpreter")
+	}
+	if !ProfilingFor(nil).hasProgramCounter(42) {
+		t.Error("non-zero program counters always locate calls")
+	}
+}
+
+func TestStackDepth(t *testing.T) {
+	fn := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+	frames := make([]experimental.StackFrame, 20)
+	for i := range frames {
+		frames[i] = experimental.StackFrame{Function: fn, PC: uint64(i)}
+	}
+	ctx := context.Background()
+
+	p := ProfilingFor(nil, StackDepth(8))
+	if st := p.makeStackTrace(ctx, stackTrace{}, experimental.NewStackIterator(frames[:4]...)); cap(st.pcs) != 8 {
+		t.Errorf("wrong capacity of stack trace: want=8 got=%d", cap(st.pcs))
+	}
+	p.makeStackTrace(ctx, stackTrace{}, experimental.NewStackIterator(frames...))
+	if st := p.makeStackTrace(ctx, stackTrace{}, experimental.NewStackIterator(frames[:4]...)); cap(st.pcs) != 20 {
+		t.Errorf("wrong capacity of stack trace after deeper stack: want=20 got=%d", cap(st.pcs))
+	}
+
+	// The depth of the stacks is tracked by each profiling separately.
+	if st := ProfilingFor(nil).makeStackTrace(ctx, stackTrace{}, experimental.NewStackIterator(frames[:4]...)); cap(st.pcs) != 4 {
+		t.Errorf("wrong capacity of stack trace of other profiling: want=4 got=%d", cap(st.pcs))
+	}
+}
+
+func TestModuleMapping(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProfilingFor(wasm, ModulePath("testdata/c/simple.wasm"))
+	m := p.moduleMapping()
+
+	if m.File != "testdata/c/simple.wasm" {
+		t.Errorf("wrong file: %q", m.File)
+	}
+	if m.BuildID != moduleHash(wasm) {
+		t.Errorf("wrong build id: %q", m.BuildID)
+	}
+	if m.Start != 0 || m.Limit == 0 || m.Offset == 0 || m.Offset+m.Limit > uint64(len(wasm)) {
+		t.Fatalf("wrong code section range: [%d,%d) at offset %d", m.Start, m.Limit, m.Offset)
+	}
+
+	// Source offsets found in DWARF are relative to the code section.
+	parser, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range newDwarfmapper(parser).ranges {
+		if r.Range[1] > m.Limit {
+			t.Errorf("range [%d,%d) past the end of the code section", r.Range[0], r.Range[1])
+		}
+	}
+}
+
+func TestEncodeProfile(t *testing.T) {
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Comments:   []string{"test"},
+	}
+
+	for _, compress := range []bool{true, false} {
+		var buf bytes.Buffer
+		if err := EncodeProfile(&buf, prof, Compress(compress)); err != nil {
+			t.Fatal(err)
+		}
+		if gzipped := bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x8b}); gzipped != compress {
+			t.Errorf("compress=%t: profile compressed=%t", compress, gzipped)
+		}
+		p, err := profile.Parse(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Comments, prof.Comments) {
+			t.Errorf("compress=%t: wrong comments: %q", compress, p.Comments)
+		}
+	}
+}
+
+func TestFocusIgnore(t *testing.T) {
+	p := ProfilingFor(nil,
+		Focus(regexp.MustCompile(`^main\.`)),
+		Ignore(regexp.MustCompile(`^main\.init`)),
+	)
+	profilers := []experimental.FunctionListenerFactory{
+		p.CPUProfiler(),
+		p.WallClockProfiler(),
+		p.GoroutineProfiler(),
+	}
+
+	for _, test := range []struct {
+		name         string
+		instrumented bool
+	}{
+		{"main.main", true},
+		{"main.run", true},
+		{"main.init.0", false},
+		{"runtime.mallocgc", false},
+	} {
+		f := wazerotest.NewFunction(func(context.Context, api.Module) {})
+		f.FunctionName = test.name
+		for _, profiler := range profilers {
+			l := profiler.NewFunctionListener(f.Definition())
+			if (l != nil) != test.instrumented {
+				t.Errorf("%T: %s: want instrumented=%t", profiler, test.name, test.instrumented)
+			}
+		}
+	}
+}
+
+// listenerBenchmark calls a function listener of a profiler repeatedly with the
+// same stack, the function instrumented by the listener being at the top.
+type listenerBenchmark struct {
+	name     string
+	listener experimental.FunctionListener
+	module   api.Module
+	stack    []experimental.StackFrame
+}
+
+func (l *listenerBenchmark) run(n int) {
+	experimental.BenchmarkFunctionListener(n, l.module, l.stack, l.listener)
+}
+
+func listenerBenchmarks(depth int) []*listenerBenchmark {
+	p := ProfilingFor(nil)
+
+	fdWrite := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, fd, iovs, iovsLen, nwritten uint32) uint32 {
+		return 0
+	})
+	fdWrite.FunctionName = "fd_write"
+	pollOneoff := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, in, out, nsubscriptions, nevents uint32) uint32 {
+		return 0
+	})
+	pollOneoff.FunctionName = "poll_oneoff"
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+
+	functions := []*wazerotest.Function{fdWrite, pollOneoff, malloc}
+	for i := 0; i < depth; i++ {
+		functions = append(functions, wazerotest.NewFunction(func(context.Context, api.Module) {}))
+	}
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), functions...)
+	module.ModuleName = "wasi_snapshot_preview1"
+	module.Function(0) // the module initializes the functions on first use
+
+	stackOf := func(fn *wazerotest.Function, params, results []uint64) []experimental.StackFrame {
+		stack := []experimental.StackFrame{{Function: fn, Params: params, Results: results}}
+		for i, f := range functions[3:] {
+			stack = append(stack, experimental.StackFrame{Function: f, PC: uint64(i + 1)})
+		}
+		return stack
+	}
+
+	cpu := p.CPUProfiler()
+	mem := p.MemoryProfiler()
+	wall := p.WallClockProfiler()
+	block := p.BlockProfiler()
+	io := p.IOProfiler()
+	sys := p.SyscallProfiler()
+	goroutine := p.GoroutineProfiler()
+	cpu.StartProfile()
+	wall.StartProfile()
+	block.StartProfile()
+	sys.StartProfile()
+
+	benchmark := func(name string, factory experimental.FunctionListenerFactory, fn *wazerotest.Function, params, results []uint64) *listenerBenchmark {
+		return &listenerBenchmark{
+			name:     name,
+			listener: factory.NewFunctionListener(fn.Definition()),
+			module:   module,
+			stack:    stackOf(fn, params, results),
+		}
+	}
+	return []*listenerBenchmark{
+		benchmark("cpu", cpu, functions[3], nil, nil),
+		benchmark("memory", mem, malloc, []uint64{42}, []uint64{1024}),
+		benchmark("wall", wall, functions[3], nil, nil),
+		benchmark("block", block, pollOneoff, []uint64{0, 0, 0, 0}, []uint64{0}),
+		benchmark("io", io, fdWrite, []uint64{1, 0, 0, 0}, []uint64{0}),
+		benchmark("syscall", sys, fdWrite, []uint64{1, 0, 0, 0}, []uint64{0}),
+		benchmark("goroutine", goroutine, functions[3], nil, nil),
+	}
+}
+
+func BenchmarkListeners(b *testing.B) {
+	for _, depth := range []int{1, 32} {
+		for _, l := range listenerBenchmarks(depth) {
+			b.Run(fmt.Sprintf("%s/depth=%d", l.name, depth), func(b *testing.B) {
+				b.ReportAllocs()
+				l.run(b.N)
+			})
+		}
+	}
+}
+
+// The listeners are called on every function call, they must not allocate in
+// steady state since their overhead skews the measurements.
+func TestListenersDoNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not measurable with the race detector")
+	}
+	for _, l := range listenerBenchmarks(32) {
+		l.run(100) // warm up the caches and free lists
+		// The benchmark harness allocates its stack iterator on each run.
+		base := testing.AllocsPerRun(10, func() { l.run(1) })
+		allocs := testing.AllocsPerRun(10, func() { l.run(101) })
+		if allocs != base {
+			t.Errorf("%s: %g allocations per call", l.name, (allocs-base)/100)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package wzprof
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Try to detect if the module was compiled by Zig by looking for the function
+// of the standard library calling the main function of programs in the name
+// section.
+func binCompiledByZig(b []byte) bool {
+	names := wasmCustomSection(b, "name")
+	return bytes.Contains(names, []byte("start.callMain"))
+}
+
+// zigFunctionName returns the name of a function of a Zig program relative to
+// the standard library, e.g. "heap.PageAllocator.alloc". Depending on the
+// version of the compiler, the names may be prefixed by "std.".
+func zigFunctionName(def api.FunctionDefinition) string {
+	return strings.TrimPrefix(def.Name(), "std.")
+}
+
+// Functions of the page allocators of the standard library which grow the
+// memory with memory.grow when they run out of pages.
+//
+// https://github.com/ziglang/zig/blob/0.11.0/lib/std/heap/WasmAllocator.zig
+// https://github.com/ziglang/zig/blob/0.11.0/lib/std/heap/WasmPageAllocator.zig
+var zigPageRequestFunctions = map[string]struct{}{
+	"heap.WasmAllocator.allocBigPages":  {},
+	"heap.WasmPageAllocator.allocPages": {},
+}
+
+// zigAllocatorFunction returns the name of the function of the Allocator vtable
+// implemented by a function of an allocator of the standard library (e.g.
+// "heap.general_purpose_allocator.GeneralPurposeAllocator(.{}).alloc"), or an
+// empty string if it is not one. The number of parameters is checked as well,
+// slices are passed as a pointer and a length.
+func zigAllocatorFunction(def api.FunctionDefinition) string {
+	name := zigFunctionName(def)
+	if !strings.HasPrefix(name, "heap.") {
+		return ""
+	}
+	method := name[strings.LastIndexByte(name, '.')+1:]
+	params, results := len(def.ParamTypes()), len(def.ResultTypes())
+	switch {
+	case method == "alloc" && params == 4 && results == 1,
+		method == "resize" && params == 6 && results == 1,
+		method == "remap" && params == 6 && results == 1,
+		method == "free" && params == 5 && results == 0:
+		return method
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,86 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestBinCompiledByZig(t *testing.T) {
+	if !binCompiledByZig(testWasmModule("\x0estart.callMain", "")) {
+		t.Error("zig module not detected")
+	}
+	if binCompiledByZig(testWasmModule("\x04main", "")) {
+		t.Error("module wrongly detected as zig")
+	}
+}
+
+func TestMemoryProfilerZig(t *testing.T) {
+	profiling := ProfilingFor(nil)
+	profiling.lang = zig
+	p := profiling.MemoryProfiler(InuseMemory(true), MemoryGrowth(true))
+
+	const gpa = "heap.general_purpose_allocator.GeneralPurposeAllocator(.{})"
+	alloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, self, len, align, ret uint32) uint32 { return 0 })
+	alloc.FunctionName = gpa + ".alloc"
+	resize := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, self, ptr, len, align, newLen, ret uint32) uint32 { return 0 })
+	resize.FunctionName = gpa + ".resize"
+	free := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, self, ptr, len, align, ret uint32) {})
+	free.FunctionName = gpa + ".free"
+	pageAlloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, self, len, align, ret uint32) uint32 { return 0 })
+	pageAlloc.FunctionName = "std.heap.WasmPageAllocator.alloc"
+	allocPages := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, count, align uint32) uint32 { return 0 })
+	allocPages.FunctionName = "heap.WasmPageAllocator.allocPages"
+	other := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, self, len uint32) uint32 { return 0 })
+	other.FunctionName = "heap.WasmPageAllocator.alloc__anon_42"
+
+	mem := wazerotest.NewMemory(wazerotest.PageSize)
+	module := wazerotest.NewModule(mem, alloc, resize, free, pageAlloc, allocPages, other)
+	ctx := context.Background()
+
+	if p.NewFunctionListener(other.Definition()) != nil {
+		t.Error("unexpected listener for a function which is not an allocator")
+	}
+
+	call := func(fn *wazerotest.Function, params []uint64, results []uint64) func() {
+		def := fn.Definition()
+		lstn := p.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, params, experimental.NewStackIterator(experimental.StackFrame{Function: fn}))
+		return func() { lstn.After(ctx, module, def, results) }
+	}
+
+	// The general purpose allocator requests pages from the page allocator,
+	// which grows the memory.
+	done := call(alloc, []uint64{1, 100, 3, 0}, []uint64{0x10000})
+	pageDone := call(pageAlloc, []uint64{0, 4096, 12, 0}, []uint64{0x10000})
+	growDone := call(allocPages, []uint64{1, 0}, []uint64{1})
+	mem.Grow(1)
+	growDone()
+	pageDone()
+	done()
+	call(alloc, []uint64{1, 10, 3, 0}, []uint64{0x10100})()
+	call(resize, []uint64{1, 0x10000, 100, 3, 50, 0}, []uint64{1})()
+	call(resize, []uint64{1, 0x10100, 10, 3, 4000, 0}, []uint64{0})() // not resized
+	call(free, []uint64{1, 0x10100, 10, 3, 0}, nil)()
+
+	var allocObjects, allocSpace, inuseObjects, inuseSpace, growSpace int64
+	for _, sample := range p.snapshot() {
+		allocObjects += sample.value[0]
+		allocSpace += sample.value[1]
+		inuseObjects += sample.value[2]
+		inuseSpace += sample.value[3]
+		growSpace += sample.value[5]
+	}
+	if allocObjects != 3 || allocSpace != 160 {
+		t.Errorf("wrong allocations: want=3/160 got=%d/%d", allocObjects, allocSpace)
+	}
+	if inuseObjects != 1 || inuseSpace != 50 {
+		t.Errorf("wrong memory in use: want=1/50 got=%d/%d", inuseObjects, inuseSpace)
+	}
+	if growSpace != wazerotest.PageSize {
+		t.Errorf("wrong memory growth: want=%d got=%d", wazerotest.PageSize, growSpace)
+	}
+}